@@ -0,0 +1,137 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// DefaultABSlotBranchWarningThreshold is the default number of PCR value combinations above which AddABSlotProfile invokes the
+// BranchWarning callback from ABSlotProfileParams.
+const DefaultABSlotBranchWarningThreshold = 64
+
+// BootSlotParams describes the boot components for a single slot on a system that uses A/B updates.
+type BootSlotParams struct {
+	// LoadSequences is a list of EFI image load sequences for this slot. These are used to compute the UEFI boot manager code
+	// profile (PCR 4) and, if enabled, the secure boot policy profile (PCR 7).
+	LoadSequences []*EFIImageLoadEvent
+
+	// KernelCmdlines is the set of kernel commandlines for this slot, which are measured by the systemd EFI stub.
+	KernelCmdlines []string
+}
+
+// ABSlotProfileParams provides the parameters to AddABSlotProfile.
+type ABSlotProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Slots contains the boot components for each slot. Either all slots or no slots must specify kernel commandlines.
+	Slots []*BootSlotParams
+
+	// IncludeSecureBootPolicy indicates whether the secure boot policy profile (PCR 7) should be included for each slot.
+	IncludeSecureBootPolicy bool
+
+	// SignatureDbUpdateKeystores is passed to AddEFISecureBootPolicyProfile if IncludeSecureBootPolicy is set.
+	SignatureDbUpdateKeystores []string
+
+	// KernelCmdlinePCRIndex is the PCR that the systemd EFI stub measures the kernel commandline to.
+	KernelCmdlinePCRIndex int
+
+	// BranchWarningThreshold is the number of PCR value combinations above which BranchWarning is invoked. If this is zero,
+	// DefaultABSlotBranchWarningThreshold is used.
+	BranchWarningThreshold int
+
+	// BranchWarning is an optional callback that is invoked with the total number of PCR value combinations if it exceeds
+	// BranchWarningThreshold. Large numbers of combinations result in large key data files and slow unsealing.
+	BranchWarning func(branches int)
+}
+
+// AddABSlotProfile adds a profile to the supplied PCR protection profile that permits booting from any of the slots specified in
+// params, for systems that use A/B updates where the kernel, initrd and kernel commandline differ between slots. The PCR 4, PCR 7
+// (if IncludeSecureBootPolicy is set) and kernel commandline profiles are computed separately for each slot and combined in to a
+// single sub-profile per slot, and the per-slot sub-profiles are then combined with PCRProtectionProfile.AddProfileOR. This means
+// that the number of PCR value combinations is the sum of the combinations for each slot, rather than the cross-product of every
+// image and kernel commandline across all slots that would result from adding each profile separately. It also means that a
+// component from one slot cannot be combined with a component from another slot.
+//
+// If the total number of PCR value combinations exceeds the warning threshold, the BranchWarning callback is invoked, if
+// supplied.
+func AddABSlotProfile(profile *PCRProtectionProfile, params *ABSlotProfileParams) error {
+	if len(params.Slots) == 0 {
+		return errors.New("no slots specified")
+	}
+
+	hasCmdlines := len(params.Slots[0].KernelCmdlines) > 0
+
+	var slotProfiles []*PCRProtectionProfile
+	branches := 0
+
+	for i, slot := range params.Slots {
+		if (len(slot.KernelCmdlines) > 0) != hasCmdlines {
+			return errors.New("either all slots or no slots must specify kernel commandlines")
+		}
+
+		slotProfile := NewPCRProtectionProfile()
+		if params.IncludeSecureBootPolicy {
+			if err := AddEFISecureBootPolicyProfile(slotProfile, &EFISecureBootPolicyProfileParams{
+				PCRAlgorithm:               params.PCRAlgorithm,
+				LoadSequences:              slot.LoadSequences,
+				SignatureDbUpdateKeystores: params.SignatureDbUpdateKeystores}); err != nil {
+				return xerrors.Errorf("cannot add secure boot policy profile for slot %d: %w", i, err)
+			}
+		}
+		if err := AddEFIBootManagerProfile(slotProfile, &EFIBootManagerProfileParams{
+			PCRAlgorithm:  params.PCRAlgorithm,
+			LoadSequences: slot.LoadSequences}); err != nil {
+			return xerrors.Errorf("cannot add boot manager profile for slot %d: %w", i, err)
+		}
+		if hasCmdlines {
+			if err := AddSystemdEFIStubProfile(slotProfile, &SystemdEFIStubProfileParams{
+				PCRAlgorithm:   params.PCRAlgorithm,
+				PCRIndex:       params.KernelCmdlinePCRIndex,
+				KernelCmdlines: slot.KernelCmdlines}); err != nil {
+				return xerrors.Errorf("cannot add systemd EFI stub profile for slot %d: %w", i, err)
+			}
+		}
+
+		values, err := slotProfile.computePCRValues(nil)
+		if err != nil {
+			return xerrors.Errorf("cannot compute PCR values for slot %d: %w", i, err)
+		}
+		branches += len(values)
+
+		slotProfiles = append(slotProfiles, slotProfile)
+	}
+
+	threshold := params.BranchWarningThreshold
+	if threshold == 0 {
+		threshold = DefaultABSlotBranchWarningThreshold
+	}
+	if branches > threshold && params.BranchWarning != nil {
+		params.BranchWarning(branches)
+	}
+
+	profile.AddProfileOR(slotProfiles...)
+	return nil
+}
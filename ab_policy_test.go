@@ -0,0 +1,130 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type abPolicySuite struct{}
+
+var _ = Suite(&abPolicySuite{})
+
+func (s *abPolicySuite) slots() []*BootSlotParams {
+	return []*BootSlotParams{
+		{
+			LoadSequences: []*EFIImageLoadEvent{
+				{
+					Image: FileEFIImage("testdata/mockshim1.efi.signed.1"),
+					Next: []*EFIImageLoadEvent{
+						{
+							Image: FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+							Next: []*EFIImageLoadEvent{
+								{Image: FileEFIImage("testdata/mockkernel1.efi.signed.shim")},
+							},
+						},
+					},
+				},
+			},
+			KernelCmdlines: []string{"console=ttyS0 root=/dev/sda1 snapd_recovery_mode=run"},
+		},
+		{
+			LoadSequences: []*EFIImageLoadEvent{
+				{
+					Image: FileEFIImage("testdata/mockshim1.efi.signed.1"),
+					Next: []*EFIImageLoadEvent{
+						{
+							Image: FileEFIImage("testdata/mockgrub1.efi.signed.shim"),
+							Next: []*EFIImageLoadEvent{
+								{Image: FileEFIImage("testdata/mockkernel2.efi.signed.shim")},
+							},
+						},
+					},
+				},
+			},
+			KernelCmdlines: []string{"console=ttyS0 root=/dev/sda2 snapd_recovery_mode=run"},
+		},
+	}
+}
+
+func (s *abPolicySuite) TestAddABSlotProfile(c *C) {
+	restoreEventLogPath := MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+
+	slots := s.slots()
+
+	var warned int
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddABSlotProfile(profile, &ABSlotProfileParams{
+		PCRAlgorithm:          tpm2.HashAlgorithmSHA256,
+		Slots:                 slots,
+		KernelCmdlinePCRIndex: 12,
+		BranchWarning:         func(n int) { warned = n }}), IsNil)
+	c.Check(warned, Equals, 0)
+
+	// Build the expected profile manually.
+	var expectedSlots []*PCRProtectionProfile
+	for _, slot := range slots {
+		p := NewPCRProtectionProfile()
+		c.Assert(AddEFIBootManagerProfile(p, &EFIBootManagerProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256, LoadSequences: slot.LoadSequences}), IsNil)
+		c.Assert(AddSystemdEFIStubProfile(p, &SystemdEFIStubProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256, PCRIndex: 12, KernelCmdlines: slot.KernelCmdlines}), IsNil)
+		expectedSlots = append(expectedSlots, p)
+	}
+	expected := NewPCRProtectionProfile().AddProfileOR(expectedSlots...)
+
+	expectedPcrs, expectedDigests, err := expected.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, expectedDigests)
+
+	// One combination per slot, rather than the cross-product of kernels and commandlines.
+	c.Check(digests, HasLen, 2)
+}
+
+func (s *abPolicySuite) TestAddABSlotProfileWarning(c *C) {
+	restoreEventLogPath := MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+
+	var warned int
+	c.Check(AddABSlotProfile(NewPCRProtectionProfile(), &ABSlotProfileParams{
+		PCRAlgorithm:           tpm2.HashAlgorithmSHA256,
+		Slots:                  s.slots(),
+		KernelCmdlinePCRIndex:  12,
+		BranchWarningThreshold: 1,
+		BranchWarning:          func(n int) { warned = n }}), IsNil)
+	c.Check(warned, Equals, 2)
+}
+
+func (s *abPolicySuite) TestAddABSlotProfileInconsistentCmdlines(c *C) {
+	restoreEventLogPath := MockEventLogPath("testdata/eventlog1.bin")
+	defer restoreEventLogPath()
+
+	slots := s.slots()
+	slots[1].KernelCmdlines = nil
+	c.Check(AddABSlotProfile(NewPCRProtectionProfile(), &ABSlotProfileParams{
+		PCRAlgorithm:          tpm2.HashAlgorithmSHA256,
+		Slots:                 slots,
+		KernelCmdlinePCRIndex: 12}), ErrorMatches, "either all slots or no slots must specify kernel commandlines")
+}
@@ -0,0 +1,150 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/xerrors"
+)
+
+var acpiTPM2TablePath = "/sys/firmware/acpi/tables/TPM2" // Path of the ACPI TPM2 table
+
+// TPMStartMethod describes the mechanism used by the platform to notify the TPM that a command is available for processing, as
+// advertised by the ACPI TPM2 table. See section 8.3 of the "TCG ACPI Specification" Family 1.2 and 2.0, Version 1.2, Revision 8.
+type TPMStartMethod uint32
+
+const (
+	TPMStartMethodACPI          TPMStartMethod = 2  // Uses the ACPI start method
+	TPMStartMethodTIS           TPMStartMethod = 6  // Uses the TIS 1.3 / FIFO interface
+	TPMStartMethodCRB           TPMStartMethod = 7  // Uses the Command Response Buffer interface
+	TPMStartMethodCRBWithACPI   TPMStartMethod = 8  // Uses the Command Response Buffer interface and the ACPI start method
+	TPMStartMethodCRBWithARMSMC TPMStartMethod = 11 // Uses the Command Response Buffer interface and an ARM Secure Monitor Call
+)
+
+func (m TPMStartMethod) String() string {
+	switch m {
+	case TPMStartMethodACPI:
+		return "ACPI"
+	case TPMStartMethodTIS:
+		return "TIS"
+	case TPMStartMethodCRB:
+		return "CRB"
+	case TPMStartMethodCRBWithACPI:
+		return "CRB with ACPI"
+	case TPMStartMethodCRBWithARMSMC:
+		return "CRB with ARM SMC"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint32(m))
+	}
+}
+
+// IsCRB indicates whether this start method uses the Command Response Buffer interface.
+func (m TPMStartMethod) IsCRB() bool {
+	switch m {
+	case TPMStartMethodCRB, TPMStartMethodCRBWithACPI, TPMStartMethodCRBWithARMSMC:
+		return true
+	default:
+		return false
+	}
+}
+
+// ACPITPM2Table contains the fields of the ACPI TPM2 table that describe how the platform communicates with the TPM.
+type ACPITPM2Table struct {
+	Revision           uint8          // The revision of the table
+	PlatformClass      uint16         // 0 for client platforms, 1 for server platforms
+	ControlAreaAddress uint64         // The physical address of the CRB control area, or 0 if the TPM doesn't use the CRB interface
+	StartMethod        TPMStartMethod // The start method
+}
+
+// acpiTPM2TableHeader corresponds to the standard ACPI system description table header and the fixed TPM2 specific fields that
+// follow it.
+type acpiTPM2TableHeader struct {
+	Signature          [4]byte
+	Length             uint32
+	Revision           uint8
+	Checksum           uint8
+	OEMID              [6]byte
+	OEMTableID         [8]byte
+	OEMRevision        uint32
+	CreatorID          uint32
+	CreatorRevision    uint32
+	PlatformClass      uint16
+	Reserved           uint16
+	ControlAreaAddress uint64
+	StartMethod        uint32
+}
+
+// decodeACPITPM2Table decodes and validates the supplied ACPI TPM2 table.
+func decodeACPITPM2Table(data []byte) (*ACPITPM2Table, error) {
+	var hdr acpiTPM2TableHeader
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &hdr); err != nil {
+		return nil, xerrors.Errorf("cannot decode table header: %w", err)
+	}
+	if !bytes.Equal(hdr.Signature[:], []byte("TPM2")) {
+		return nil, fmt.Errorf("invalid signature %q", hdr.Signature[:])
+	}
+	if int(hdr.Length) != len(data) {
+		return nil, fmt.Errorf("invalid length (got %d bytes, header specifies %d bytes)", len(data), hdr.Length)
+	}
+
+	// All bytes of the table, including the checksum field, must sum to zero.
+	var sum uint8
+	for _, b := range data {
+		sum += b
+	}
+	if sum != 0 {
+		return nil, errors.New("invalid checksum")
+	}
+
+	return &ACPITPM2Table{
+		Revision:           hdr.Revision,
+		PlatformClass:      hdr.PlatformClass,
+		ControlAreaAddress: hdr.ControlAreaAddress,
+		StartMethod:        TPMStartMethod(hdr.StartMethod)}, nil
+}
+
+// ReadACPITPM2Table reads and validates the ACPI TPM2 table exposed by the kernel, which describes the interface and start method
+// used by the platform to communicate with the TPM. This can be used to determine whether the TPM uses the Command Response Buffer
+// (CRB) interface, which is useful for diagnosing problems on platforms where the TPM device is not available. Note that the
+// interface is handled by the kernel driver, and ConnectToDefaultTPM always communicates with the TPM via the TPM character device.
+//
+// If the table is not present (eg, because the platform describes the TPM in some other way or doesn't have one), a ErrNoACPITPM2Table
+// error will be returned.
+func ReadACPITPM2Table() (*ACPITPM2Table, error) {
+	data, err := ioutil.ReadFile(acpiTPM2TablePath)
+	switch {
+	case os.IsNotExist(err):
+		return nil, ErrNoACPITPM2Table
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read table: %w", err)
+	}
+
+	table, err := decodeACPITPM2Table(data)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid ACPI TPM2 table: %w", err)
+	}
+	return table, nil
+}
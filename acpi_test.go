@@ -0,0 +1,138 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type acpiSuite struct{}
+
+var _ = Suite(&acpiSuite{})
+
+func makeACPITPM2Table(signature string, platformClass uint16, controlArea uint64, startMethod uint32) []byte {
+	w := new(bytes.Buffer)
+	w.WriteString(signature)
+	binary.Write(w, binary.LittleEndian, uint32(52)) // Length
+	w.WriteByte(4)                                   // Revision
+	w.WriteByte(0)                                   // Checksum
+	w.WriteString("FOOBAR")                          // OEMID
+	w.WriteString("FOOBAR01")                        // OEM Table ID
+	binary.Write(w, binary.LittleEndian, uint32(1))  // OEM Revision
+	w.WriteString("ABCD")                            // Creator ID
+	binary.Write(w, binary.LittleEndian, uint32(1))  // Creator Revision
+	binary.Write(w, binary.LittleEndian, platformClass)
+	binary.Write(w, binary.LittleEndian, uint16(0)) // Reserved
+	binary.Write(w, binary.LittleEndian, controlArea)
+	binary.Write(w, binary.LittleEndian, startMethod)
+
+	data := w.Bytes()
+	var sum uint8
+	for _, b := range data {
+		sum += b
+	}
+	data[9] = -sum
+	return data
+}
+
+type testReadACPITPM2TableData struct {
+	platformClass uint16
+	controlArea   uint64
+	startMethod   uint32
+	expected      *ACPITPM2Table
+}
+
+func (s *acpiSuite) testReadACPITPM2Table(c *C, data *testReadACPITPM2TableData) {
+	path := filepath.Join(c.MkDir(), "TPM2")
+	c.Assert(ioutil.WriteFile(path, makeACPITPM2Table("TPM2", data.platformClass, data.controlArea, data.startMethod), 0644), IsNil)
+	restore := MockACPITPM2TablePath(path)
+	defer restore()
+
+	table, err := ReadACPITPM2Table()
+	c.Assert(err, IsNil)
+	c.Check(table, DeepEquals, data.expected)
+}
+
+func (s *acpiSuite) TestReadACPITPM2TableCRB(c *C) {
+	s.testReadACPITPM2Table(c, &testReadACPITPM2TableData{
+		controlArea: 0xfed40040,
+		startMethod: 7,
+		expected: &ACPITPM2Table{
+			Revision:           4,
+			ControlAreaAddress: 0xfed40040,
+			StartMethod:        TPMStartMethodCRB}})
+}
+
+func (s *acpiSuite) TestReadACPITPM2TableTIS(c *C) {
+	s.testReadACPITPM2Table(c, &testReadACPITPM2TableData{
+		platformClass: 1,
+		startMethod:   6,
+		expected: &ACPITPM2Table{
+			Revision:      4,
+			PlatformClass: 1,
+			StartMethod:   TPMStartMethodTIS}})
+}
+
+func (s *acpiSuite) TestReadACPITPM2TableMissing(c *C) {
+	restore := MockACPITPM2TablePath(filepath.Join(c.MkDir(), "TPM2"))
+	defer restore()
+
+	_, err := ReadACPITPM2Table()
+	c.Check(err, Equals, ErrNoACPITPM2Table)
+}
+
+func (s *acpiSuite) testReadACPITPM2TableInvalid(c *C, data []byte, expected string) {
+	path := filepath.Join(c.MkDir(), "TPM2")
+	c.Assert(ioutil.WriteFile(path, data, 0644), IsNil)
+	restore := MockACPITPM2TablePath(path)
+	defer restore()
+
+	_, err := ReadACPITPM2Table()
+	c.Check(err, ErrorMatches, expected)
+}
+
+func (s *acpiSuite) TestReadACPITPM2TableInvalidSignature(c *C) {
+	s.testReadACPITPM2TableInvalid(c, makeACPITPM2Table("TPM1", 0, 0, 7), "invalid ACPI TPM2 table: invalid signature \"TPM1\"")
+}
+
+func (s *acpiSuite) TestReadACPITPM2TableInvalidChecksum(c *C) {
+	data := makeACPITPM2Table("TPM2", 0, 0, 7)
+	data[9]++
+	s.testReadACPITPM2TableInvalid(c, data, "invalid ACPI TPM2 table: invalid checksum")
+}
+
+func (s *acpiSuite) TestReadACPITPM2TableTruncated(c *C) {
+	data := makeACPITPM2Table("TPM2", 0, 0, 7)
+	s.testReadACPITPM2TableInvalid(c, data[:40], "invalid ACPI TPM2 table: cannot decode table header: unexpected EOF")
+}
+
+func (s *acpiSuite) TestTPMStartMethodString(c *C) {
+	c.Check(TPMStartMethodCRB.String(), Equals, "CRB")
+	c.Check(TPMStartMethod(3).String(), Equals, "unknown (3)")
+	c.Check(TPMStartMethodCRBWithARMSMC.IsCRB(), Equals, true)
+	c.Check(TPMStartMethodTIS.IsCRB(), Equals, false)
+}
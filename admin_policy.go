@@ -0,0 +1,234 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// adminPolicyData provides metadata for executing the admin override branch of a sealed key object's authorization policy. When
+// a sealed key object has an admin override, its authorization policy is a TPM2_PolicyOR of the normal policy (the one computed
+// by computeStaticPolicy) and a policy that is satisfied by a signed authorization from the admin key.
+type adminPolicyData struct {
+	AdminPublicKey *tpm2.Public
+	AuthPolicies   tpm2.DigestList
+}
+
+// adminPolicyDataRaw_v0 is version 0 of the on-disk format of adminPolicyData. They are currently the same structures.
+type adminPolicyDataRaw_v0 adminPolicyData
+
+func (d *adminPolicyDataRaw_v0) data() *adminPolicyData {
+	return (*adminPolicyData)(d)
+}
+
+// makeAdminPolicyDataRaw_v0 converts adminPolicyData to version 0 of the on-disk format. They are currently the same structures
+// so this is just a cast, but this may not be the case if the metadata version changes in the future.
+func makeAdminPolicyDataRaw_v0(data *adminPolicyData) *adminPolicyDataRaw_v0 {
+	return (*adminPolicyDataRaw_v0)(data)
+}
+
+// computeAdminOverridePolicy computes the admin override branch of a sealed key object's authorization policy. It is satisfied
+// by a TPM2_PolicySigned assertion with the admin key, and is subject to the same global lock as the normal policy.
+func computeAdminOverridePolicy(alg tpm2.HashAlgorithmId, adminKeyName, lockIndexName tpm2.Name) tpm2.Digest {
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	trial.PolicySigned(adminKeyName, nil)
+	trial.PolicyNV(lockIndexName, nil, 0, tpm2.OpEq)
+	return trial.GetDigest()
+}
+
+// computeAuthPolicyWithAdminOverride computes an authorization policy for a sealed key object that is satisfied either by the
+// supplied policy or by a signed authorization from the supplied admin key.
+func computeAuthPolicyWithAdminOverride(alg tpm2.HashAlgorithmId, policy tpm2.Digest, adminKey *tpm2.Public, lockIndexName tpm2.Name) (*adminPolicyData, tpm2.Digest, error) {
+	adminKeyName, err := adminKey.Name()
+	if err != nil {
+		return nil, nil, xerrors.Errorf("cannot compute name of admin key: %w", err)
+	}
+
+	digests := tpm2.DigestList{policy, computeAdminOverridePolicy(alg, adminKeyName, lockIndexName)}
+
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyOR(digests)
+
+	return &adminPolicyData{AdminPublicKey: adminKey, AuthPolicies: digests}, trial.GetDigest(), nil
+}
+
+// computeExpectedSealedKeyAuthPolicy computes the expected authorization policy for a sealed key object from the supplied static
+// policy digest and admin override metadata, which may be nil. An error is returned if the admin override metadata is inconsistent
+// with the static policy.
+func computeExpectedSealedKeyAuthPolicy(alg tpm2.HashAlgorithmId, policy tpm2.Digest, data *adminPolicyData, lockIndexName tpm2.Name) (tpm2.Digest, error) {
+	if data == nil {
+		return policy, nil
+	}
+
+	if data.AdminPublicKey == nil || data.AdminPublicKey.Type != tpm2.ObjectTypeRSA {
+		return nil, errors.New("public area of admin key has the wrong type")
+	}
+	expected, digest, err := computeAuthPolicyWithAdminOverride(alg, policy, data.AdminPublicKey, lockIndexName)
+	if err != nil {
+		return nil, err
+	}
+	if len(data.AuthPolicies) != len(expected.AuthPolicies) {
+		return nil, errors.New("unexpected number of OR policy digests for admin override")
+	}
+	for i, d := range expected.AuthPolicies {
+		if !bytes.Equal(d, data.AuthPolicies[i]) {
+			return nil, errors.New("unexpected OR policy digest for admin override")
+		}
+	}
+	return digest, nil
+}
+
+// executeAdminOverrideORAssertion completes the authorization policy assertions for a sealed key object with an admin override,
+// after the assertions for one of the branches have been executed. It does nothing for sealed key objects without an admin
+// override.
+func (k *SealedKeyObject) executeAdminOverrideORAssertion(tpm *TPMConnection, policySession tpm2.SessionContext) error {
+	if k.data.adminPolicyData == nil {
+		return nil
+	}
+	if err := tpm.PolicyOR(policySession, k.data.adminPolicyData.AuthPolicies); err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1) {
+			return InvalidKeyFileError{"cannot complete admin override OR assertion: invalid data"}
+		}
+		return xerrors.Errorf("cannot complete admin override OR assertion: %w", err)
+	}
+	return nil
+}
+
+// HasAdminOverride indicates whether this sealed key object was created with an admin override key, via the AdminOverrideKey
+// field of KeyCreationParams.
+func (k *SealedKeyObject) HasAdminOverride() bool {
+	return k.data.adminPolicyData != nil
+}
+
+// UnsealFromTPMWithAdminKey will load the TPM sealed object in to the TPM and attempt to unseal it using the admin override branch
+// of its authorization policy, returning the cleartext key on success. This is intended as a break-glass mechanism for
+// administrators, and requires the private part of the admin key that was supplied via the AdminOverrideKey field of
+// KeyCreationParams when the sealed key object was created. The key is unsealed regardless of the TPM's PCR values and without the
+// PIN, and the TPM's dictionary attack counter is not affected.
+//
+// If the sealed key object was not created with an admin override key, a ErrNoAdminOverride error will be returned.
+//
+// If the supplied key is not the admin key, a ErrAdminAuthFail error will be returned.
+//
+// If access to sealed key objects created by this package is disallowed until the next TPM reset or TPM restart, then a
+// ErrSealedKeyAccessLocked error will be returned.
+//
+// If the TPM is not provisioned correctly, then a ErrTPMProvisioning error will be returned.
+//
+// If the TPM sealed object cannot be loaded in to the TPM or any of the metadata in this key file is invalid, a InvalidKeyFileError
+// error will be returned.
+func (k *SealedKeyObject) UnsealFromTPMWithAdminKey(tpm *TPMConnection, adminKey *rsa.PrivateKey) ([]byte, error) {
+	if k.data.adminPolicyData == nil {
+		return nil, ErrNoAdminOverride
+	}
+	if adminKey == nil {
+		return nil, errors.New("no admin key provided")
+	}
+
+	adminPublicKey := k.data.adminPolicyData.AdminPublicKey
+	if adminPublicKey == nil || adminPublicKey.Type != tpm2.ObjectTypeRSA || !adminPublicKey.NameAlg.Supported() {
+		return nil, InvalidKeyFileError{"public area of admin key is invalid"}
+	}
+	if !bytes.Equal(adminPublicKey.Unique.RSA(), adminKey.PublicKey.N.Bytes()) {
+		return nil, ErrAdminAuthFail
+	}
+
+	// Use the HMAC session created when the connection was opened for parameter encryption rather than creating a new one.
+	hmacSession := tpm.HmacSession()
+
+	// Load the key data
+	key, err := k.loadToTPM(tpm, hmacSession)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.FlushContext(key)
+
+	// Begin and execute policy session
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	// Compute a digest for signing with the admin key
+	signDigest := tpm2.HashAlgorithmSHA256
+	h := signDigest.NewHash()
+	h.Write(policySession.NonceTPM())
+	binary.Write(h, binary.BigEndian, int32(0)) // expiration
+
+	sig, err := rsa.SignPSS(rand.Reader, adminKey, signDigest.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign authorization: %w", err)
+	}
+
+	// Load the public part of the admin key in to the TPM. There's no integrity protection for this command as if it's altered in
+	// transit then either the signature verification fails or the policy digest will not match the sealed key object's policy.
+	adminKeyLoaded, err := tpm.LoadExternal(nil, adminPublicKey, tpm2.HandleOwner)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoadExternal, 2) {
+			return nil, InvalidKeyFileError{"public area of admin key is invalid"}
+		}
+		return nil, xerrors.Errorf("cannot load public part of admin key: %w", err)
+	}
+	defer tpm.FlushContext(adminKeyLoaded)
+
+	signature := tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgRSAPSS,
+		Signature: tpm2.SignatureU{
+			Data: &tpm2.SignatureRSAPSS{
+				Hash: signDigest,
+				Sig:  tpm2.PublicKeyRSA(sig)}}}
+
+	if _, _, err := tpm.PolicySigned(adminKeyLoaded, policySession, true, nil, nil, 0, &signature); err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.ErrorSignature, tpm2.CommandPolicySigned, 5) {
+			return nil, ErrAdminAuthFail
+		}
+		return nil, xerrors.Errorf("cannot execute admin authorization assertion: %w", err)
+	}
+
+	lockIndex, err := tpm.CreateResourceContextFromTPM(lockNVHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, lockNVHandle):
+		return nil, ErrTPMProvisioning
+	case err != nil:
+		return nil, xerrors.Errorf("cannot obtain context for lock NV index: %w", err)
+	}
+	if err := tpm.PolicyNV(lockIndex, lockIndex, policySession, nil, 0, tpm2.OpEq, hmacSession); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandPolicyNV) {
+			return nil, ErrSealedKeyAccessLocked
+		}
+		return nil, xerrors.Errorf("policy lock check failed: %w", err)
+	}
+
+	if err := k.executeAdminOverrideORAssertion(tpm, policySession); err != nil {
+		return nil, err
+	}
+
+	// Unseal
+	return k.unsealWithPolicySession(tpm, key, policySession, hmacSession)
+}
@@ -0,0 +1,171 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestUnsealFromTPMWithAdminKey(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	adminKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealFromTPMWithAdminKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:       getTestPCRProfile(),
+		PINHandle:        0x01810000,
+		AdminOverrideKey: &adminKey.PublicKey}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.HasAdminOverride() {
+		t.Errorf("HasAdminOverride returned the wrong value")
+	}
+
+	t.Run("Normal", func(t *testing.T) {
+		keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	})
+
+	t.Run("WrongAdminKey", func(t *testing.T) {
+		wrongKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		if _, err := k.UnsealFromTPMWithAdminKey(tpm, wrongKey); err != ErrAdminAuthFail {
+			t.Errorf("UnsealFromTPMWithAdminKey returned an unexpected error: %v", err)
+		}
+	})
+
+	// Change PCR 7 so that the normal policy can't be satisfied anymore.
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), tpm2.Event("foo"), nil); err != nil {
+		t.Errorf("PCREvent failed: %v", err)
+	}
+
+	t.Run("NormalAfterPCRChange", func(t *testing.T) {
+		if _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+			t.Fatalf("UnsealFromTPM should have failed")
+		} else if _, ok := err.(InvalidKeyFileError); !ok {
+			t.Errorf("UnsealFromTPM returned an unexpected error: %v", err)
+		}
+	})
+
+	t.Run("AdminAfterPCRChange", func(t *testing.T) {
+		keyUnsealed, err := k.UnsealFromTPMWithAdminKey(tpm, adminKey)
+		if err != nil {
+			t.Fatalf("UnsealFromTPMWithAdminKey failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	})
+
+	t.Run("AdminAfterLock", func(t *testing.T) {
+		if err := LockAccessToSealedKeys(tpm); err != nil {
+			t.Fatalf("LockAccessToSealedKeys failed: %v", err)
+		}
+		if _, err := k.UnsealFromTPMWithAdminKey(tpm, adminKey); err != ErrSealedKeyAccessLocked {
+			t.Errorf("UnsealFromTPMWithAdminKey returned an unexpected error: %v", err)
+		}
+	})
+}
+
+func TestUnsealFromTPMWithAdminKeyNoOverride(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	adminKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealFromTPMWithAdminKeyNoOverride_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.HasAdminOverride() {
+		t.Errorf("HasAdminOverride returned the wrong value")
+	}
+	if _, err := k.UnsealFromTPMWithAdminKey(tpm, adminKey); err != ErrNoAdminOverride {
+		t.Errorf("UnsealFromTPMWithAdminKey returned an unexpected error: %v", err)
+	}
+}
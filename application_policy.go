@@ -0,0 +1,103 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+)
+
+const (
+	debugPCR              = 16 // Debug PCR, which can be reset from locality 0
+	applicationSupportPCR = 23 // Application Support PCR, which can be reset from locality 0
+)
+
+// isApplicationPCR indicates whether the specified PCR is reserved for debug or application use by the "TCG PC Client Platform
+// Firmware Profile Specification", and is therefore suitable for application-defined measurements.
+func isApplicationPCR(pcr int) bool {
+	return pcr == debugPCR || pcr == applicationSupportPCR
+}
+
+// computeApplicationMeasurementDigest computes the digest that is extended to a PCR by TPMConnection.ExtendPCR for the supplied
+// data.
+func computeApplicationMeasurementDigest(alg tpm2.HashAlgorithmId, data []byte) tpm2.Digest {
+	h := alg.NewHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// ExtendPCR measures the supplied data to the specified PCR for all supported PCR banks. The digest extended to each bank is the
+// digest of data computed with the bank's algorithm. This is intended for application-defined measurements of state (eg, a
+// configuration blob) that a key can subsequently be sealed against by using AddApplicationMeasurementProfile to model the
+// measurement.
+//
+// Only the PCRs reserved for debug (16) and application use (23) by the "TCG PC Client Platform Firmware Profile Specification" can
+// be extended with this function. Note that both of these PCRs can be reset from locality 0 by any user with access to the TPM, and
+// so a PCR policy that includes them only provides a meaningful guarantee when combined with PCRs that can't be reset.
+func (t *TPMConnection) ExtendPCR(index int, data []byte) error {
+	if !isApplicationPCR(index) {
+		return fmt.Errorf("PCR %d is not an application PCR", index)
+	}
+	return measureSnapPropertyToTPM(t, index, func(alg tpm2.HashAlgorithmId) (tpm2.Digest, error) {
+		return computeApplicationMeasurementDigest(alg, data), nil
+	})
+}
+
+// ApplicationMeasurementProfileParams provides the parameters to AddApplicationMeasurementProfile.
+type ApplicationMeasurementProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// PCRIndex is the PCR that the application measures data to with TPMConnection.ExtendPCR. This must be 16 or 23.
+	PCRIndex int
+
+	// Measurements is the set of alternative sequences of data to add to the PCR profile. Each sequence corresponds to the data
+	// supplied to consecutive calls to TPMConnection.ExtendPCR since the PCR was last reset.
+	Measurements [][][]byte
+}
+
+// AddApplicationMeasurementProfile adds a profile for application-defined measurements made with TPMConnection.ExtendPCR to the PCR
+// protection profile, in order to generate a PCR policy that restricts access to a key to a defined set of measured data. This
+// assumes that the PCR specified via the PCRIndex field of params has not been extended with anything other than the data specified
+// via the Measurements field of params since the last TPM reset, at which point it has a value of all zeroes.
+func AddApplicationMeasurementProfile(profile *PCRProtectionProfile, params *ApplicationMeasurementProfileParams) error {
+	if !isApplicationPCR(params.PCRIndex) {
+		return fmt.Errorf("PCR %d is not an application PCR", params.PCRIndex)
+	}
+	if len(params.Measurements) == 0 {
+		return errors.New("no measurements specified")
+	}
+
+	var subProfiles []*PCRProtectionProfile
+	for _, measurements := range params.Measurements {
+		subProfile := NewPCRProtectionProfile().AddPCRValue(params.PCRAlgorithm, params.PCRIndex, make(tpm2.Digest, params.PCRAlgorithm.Size()))
+		for _, data := range measurements {
+			subProfile.ExtendPCR(params.PCRAlgorithm, params.PCRIndex, computeApplicationMeasurementDigest(params.PCRAlgorithm, data))
+		}
+		subProfiles = append(subProfiles, subProfile)
+	}
+
+	profile.AddProfileOR(subProfiles...)
+	return nil
+}
@@ -0,0 +1,81 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type applicationMeasurementSuite struct {
+	tpmSimulatorTestBase
+}
+
+var _ = Suite(&applicationMeasurementSuite{})
+
+func (s *applicationMeasurementSuite) SetUpTest(c *C) {
+	s.tpmSimulatorTestBase.SetUpTest(c)
+	s.resetTPMSimulator(c)
+}
+
+func (s *applicationMeasurementSuite) testExtendPCRAndProfile(c *C, pcr int, measurements [][]byte) {
+	for _, data := range measurements {
+		c.Check(s.tpm.ExtendPCR(pcr, data), IsNil)
+	}
+
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddApplicationMeasurementProfile(profile, &ApplicationMeasurementProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     pcr,
+		Measurements: [][][]byte{{[]byte("bar")}, measurements}}), IsNil)
+
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+
+	_, values, err := s.tpm.PCRRead(pcrs)
+	c.Assert(err, IsNil)
+	expected, err := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, values)
+	c.Assert(err, IsNil)
+
+	c.Check(digests, HasLen, 2)
+	c.Check(digests[1], DeepEquals, expected)
+}
+
+func (s *applicationMeasurementSuite) TestExtendPCR16(c *C) {
+	s.testExtendPCRAndProfile(c, 16, [][]byte{[]byte("foo")})
+}
+
+func (s *applicationMeasurementSuite) TestExtendPCR23MultipleMeasurements(c *C) {
+	s.testExtendPCRAndProfile(c, 23, [][]byte{[]byte("foo"), []byte("config blob")})
+}
+
+func (s *applicationMeasurementSuite) TestExtendPCRInvalidIndex(c *C) {
+	c.Check(s.tpm.ExtendPCR(7, []byte("foo")), ErrorMatches, "PCR 7 is not an application PCR")
+}
+
+func (s *applicationMeasurementSuite) TestAddApplicationMeasurementProfileInvalidIndex(c *C) {
+	profile := NewPCRProtectionProfile()
+	c.Check(AddApplicationMeasurementProfile(profile, &ApplicationMeasurementProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		PCRIndex:     4,
+		Measurements: [][][]byte{{[]byte("foo")}}}), ErrorMatches, "PCR 4 is not an application PCR")
+}
@@ -0,0 +1,174 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"math/big"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// makeAttestationKeyTemplate returns the template for a RSA2048 restricted signing key that uses the RSASSA scheme with SHA-256.
+func makeAttestationKeyTemplate() *tpm2.Public {
+	return &tpm2.Public{
+		Type:    tpm2.ObjectTypeRSA,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs: tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrSensitiveDataOrigin | tpm2.AttrUserWithAuth | tpm2.AttrNoDA |
+			tpm2.AttrRestricted | tpm2.AttrSign,
+		Params: tpm2.PublicParamsU{
+			Data: &tpm2.RSAParams{
+				Symmetric: tpm2.SymDefObject{Algorithm: tpm2.SymObjectAlgorithmNull},
+				Scheme: tpm2.RSAScheme{
+					Scheme: tpm2.RSASchemeRSASSA,
+					Details: &tpm2.AsymSchemeU{
+						Data: &tpm2.SigSchemeRSASSA{HashAlg: tpm2.HashAlgorithmSHA256}}},
+				KeyBits:  2048,
+				Exponent: 0}},
+		Unique: tpm2.PublicIDU{Data: make(tpm2.PublicKeyRSA, 256)}}
+}
+
+// AttestationKey corresponds to a restricted signing key in the endorsement hierarchy that can be used to sign attestation
+// structures produced by the TPM, such as quotes. It is created with TPMConnection.CreateAttestationKey and must be flushed from
+// the TPM with TPMConnection.FlushAttestationKey when it is no longer required.
+type AttestationKey struct {
+	context tpm2.ResourceContext
+	public  *tpm2.Public
+}
+
+// Public returns the public area of this key, which a verifier requires in order to check signatures produced by it.
+func (k *AttestationKey) Public() *tpm2.Public {
+	return k.public
+}
+
+// Name returns the name of this key.
+func (k *AttestationKey) Name() tpm2.Name {
+	return k.context.Name()
+}
+
+// CreateAttestationKey creates a new transient attestation key in the endorsement hierarchy. The key is a RSA2048 restricted
+// signing key that uses the RSASSA scheme with SHA-256. It is derived from the endorsement primary seed, so the same key is created
+// each time until the TPM's endorsement primary seed is changed.
+//
+// This requires knowledge of the authorization value of the endorsement hierarchy. If the supplied authorization value is incorrect,
+// a AuthFailError error will be returned.
+func (t *TPMConnection) CreateAttestationKey() (*AttestationKey, error) {
+	session := t.HmacSession()
+
+	context, public, _, _, _, err := t.CreatePrimary(t.EndorsementHandleContext(), nil, makeAttestationKeyTemplate(), nil, nil, session)
+	switch {
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		return nil, AuthFailError{tpm2.HandleEndorsement}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create attestation key: %w", err)
+	}
+
+	return &AttestationKey{context: context, public: public}, nil
+}
+
+// FlushAttestationKey flushes the supplied attestation key from the TPM.
+func (t *TPMConnection) FlushAttestationKey(ak *AttestationKey) error {
+	return t.FlushContext(ak.context)
+}
+
+// Quote corresponds to a TPM2_Quote attestation over a selection of PCRs.
+type Quote struct {
+	Quoted    *tpm2.Attest    // The attestation structure, which contains the PCR selection, the digest of the PCR values and the nonce
+	Signature *tpm2.Signature // The signature of the attestation structure, produced by the attestation key
+}
+
+// Quote produces a signed attestation of the values of the PCRs in the supplied selection using the supplied attestation key. The
+// nonce is included in the attestation structure as qualifying data so that a verifier can ensure freshness.
+//
+// The returned Quote can be checked by a verifier with Quote.Verify, using the public area of the attestation key and the expected
+// PCR values (eg, those obtained by replaying an event log).
+func (t *TPMConnection) Quote(selection tpm2.PCRSelectionList, nonce []byte, ak *AttestationKey) (*Quote, error) {
+	if ak == nil {
+		return nil, errors.New("no attestation key provided")
+	}
+
+	quoted, signature, err := t.TPMContext.Quote(ak.context, nonce, nil, selection, nil, t.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot obtain quote: %w", err)
+	}
+
+	return &Quote{Quoted: quoted, Signature: signature}, nil
+}
+
+// Verify checks that this quote was signed by the attestation key with the supplied public area, that it contains the supplied
+// nonce and that it attests to the supplied PCR values for the PCRs included in the quote.
+func (q *Quote) Verify(akPublic *tpm2.Public, nonce []byte, values tpm2.PCRValues) error {
+	if q.Quoted == nil || q.Quoted.Type != tpm2.TagAttestQuote {
+		return errors.New("invalid attestation structure")
+	}
+	if q.Quoted.Magic != tpm2.TPMGeneratedValue {
+		return errors.New("attestation structure was not generated by a TPM")
+	}
+
+	if akPublic.Type != tpm2.ObjectTypeRSA {
+		return errors.New("unsupported attestation key type")
+	}
+	if q.Signature == nil || q.Signature.SigAlg != tpm2.SigSchemeAlgRSASSA {
+		return errors.New("invalid signature scheme")
+	}
+	sig := q.Signature.Signature.RSASSA()
+	if !sig.Hash.Supported() {
+		return errors.New("invalid signature digest algorithm")
+	}
+
+	quoted, err := tpm2.MarshalToBytes(q.Quoted)
+	if err != nil {
+		return xerrors.Errorf("cannot marshal attestation structure: %w", err)
+	}
+
+	exp := int(akPublic.Params.RSADetail().Exponent)
+	if exp == 0 {
+		// The default exponent of 2^^16-1 is indicated by the value of 0 in the public area.
+		exp = 65537
+	}
+	pubKey := rsa.PublicKey{
+		N: new(big.Int).SetBytes(akPublic.Unique.RSA()),
+		E: exp}
+
+	h := sig.Hash.NewHash()
+	h.Write(quoted)
+	if err := rsa.VerifyPKCS1v15(&pubKey, sig.Hash.GetHash(), h.Sum(nil), sig.Sig); err != nil {
+		return xerrors.Errorf("cannot verify signature: %w", err)
+	}
+
+	if !bytes.Equal(q.Quoted.ExtraData, nonce) {
+		return errors.New("unexpected nonce")
+	}
+
+	info := q.Quoted.Attested.Quote()
+	digest, err := tpm2.ComputePCRDigest(sig.Hash, info.PCRSelect, values)
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR digest: %w", err)
+	}
+	if !bytes.Equal(digest, info.PCRDigest) {
+		return errors.New("PCR digest doesn't match the supplied values")
+	}
+
+	return nil
+}
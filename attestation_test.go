@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestQuote(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	ak, err := tpm.CreateAttestationKey()
+	if err != nil {
+		t.Fatalf("CreateAttestationKey failed: %v", err)
+	}
+	defer tpm.FlushAttestationKey(ak)
+
+	selection := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 23}}}
+	nonce := []byte("1234567890")
+
+	quote, err := tpm.Quote(selection, nonce, ak)
+	if err != nil {
+		t.Fatalf("Quote failed: %v", err)
+	}
+	if quote.Quoted.Type != tpm2.TagAttestQuote {
+		t.Errorf("Unexpected attestation type")
+	}
+
+	_, values, err := tpm.PCRRead(selection)
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+
+	if err := quote.Verify(ak.Public(), nonce, values); err != nil {
+		t.Errorf("Verify failed: %v", err)
+	}
+	if err := quote.Verify(ak.Public(), []byte("foo"), values); err == nil || err.Error() != "unexpected nonce" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := tpm.PCRExtend(tpm.PCRHandleContext(23), tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}}, nil); err != nil {
+		t.Fatalf("PCRExtend failed: %v", err)
+	}
+	_, values, err = tpm.PCRRead(selection)
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	if err := quote.Verify(ak.Public(), nonce, values); err == nil || err.Error() != "PCR digest doesn't match the supplied values" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	quote.Quoted.ExtraData = []byte("foo")
+	if err := quote.Verify(ak.Public(), []byte("foo"), values); err == nil {
+		t.Errorf("Verify should fail with a modified attestation structure")
+	}
+}
@@ -0,0 +1,75 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// EnableSessionAudit enables session auditing for the HMAC session associated with this connection (returned from HmacSession).
+// Once enabled, the TPM maintains a running digest of the command and response parameters of every command executed with this
+// session, which can be obtained later on as cryptographic evidence of the commands executed on this connection (eg, during
+// provisioning) with SessionAuditDigest.
+//
+// Only commands that include the HMAC session associated with this connection are audited. This includes most of the commands
+// executed by this package, but excludes commands that cannot be executed with sessions (such as TPM2_ContextSave,
+// TPM2_ContextLoad and TPM2_FlushContext), policy assertions executed in policy sessions that don't include the HMAC session
+// (such as the TPM2_PolicyPCR and TPM2_PolicyOR assertions executed during unsealing), commands executed by ProvisionTPM and
+// ProvisionTPMWithParams before the endorsement key has been created (which use a separate session) and commands executed directly
+// via the embedded *tpm2.TPMContext without including the HMAC session.
+//
+// The audit digest is associated with the HMAC session, so it is reset whenever the HMAC session is recreated. This happens during
+// ProvisionTPM and ProvisionTPMWithParams after the endorsement key has been created. In this case, SessionAuditDigest only provides
+// evidence of the commands executed after this point.
+func (t *TPMConnection) EnableSessionAudit() {
+	t.sessionAudit = true
+}
+
+// SessionAuditDigest returns the current session audit digest for the HMAC session associated with this connection, in the form
+// of an attestation structure signed by the key associated with signContext. The supplied qualifyingData is included in the
+// attestation structure and can be used by the verifier to guarantee freshness. If signContext is nil, the attestation structure
+// is not signed.
+//
+// This requires knowledge of the authorization value of the endorsement hierarchy (which acts as the privacy administrator), and
+// of the authorization value of the signing key if one is supplied.
+//
+// Session auditing must be enabled first with EnableSessionAudit.
+func (t *TPMConnection) SessionAuditDigest(signContext tpm2.ResourceContext, qualifyingData []byte) (*tpm2.Attest, *tpm2.Signature, error) {
+	if !t.sessionAudit {
+		return nil, nil, errors.New("session auditing is not enabled")
+	}
+	if t.hmacSession == nil {
+		return nil, nil, errors.New("no HMAC session")
+	}
+
+	auditInfo, signature, err := t.GetSessionAuditDigest(t.EndorsementHandleContext(), signContext, t.hmacSession, qualifyingData, nil, nil, nil)
+	switch {
+	case isAuthFailError(err, tpm2.CommandGetSessionAuditDigest, 1):
+		return nil, nil, AuthFailError{tpm2.HandleEndorsement}
+	case err != nil:
+		return nil, nil, xerrors.Errorf("cannot obtain session audit digest: %w", err)
+	}
+
+	return auditInfo, signature, nil
+}
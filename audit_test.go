@@ -0,0 +1,77 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestSessionAuditDigest(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	if _, _, err := tpm.SessionAuditDigest(nil, nil); err == nil || err.Error() != "session auditing is not enabled" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	tpm.EnableSessionAudit()
+
+	if _, err := ProvisionStatus(tpm); err != nil {
+		t.Fatalf("ProvisionStatus failed: %v", err)
+	}
+
+	auditInfo, signature, err := tpm.SessionAuditDigest(nil, []byte("foo"))
+	if err != nil {
+		t.Fatalf("SessionAuditDigest failed: %v", err)
+	}
+	if signature != nil && signature.SigAlg != tpm2.SigSchemeAlgNull {
+		t.Errorf("Unexpected signature")
+	}
+	if auditInfo.Type != tpm2.TagAttestSessionAudit {
+		t.Errorf("Unexpected attestation type")
+	}
+	if !bytes.Equal(auditInfo.ExtraData, []byte("foo")) {
+		t.Errorf("Unexpected qualifying data")
+	}
+	digest := auditInfo.Attested.SessionAudit().SessionDigest
+	if bytes.Equal(digest, make(tpm2.Digest, len(digest))) {
+		t.Errorf("Audit digest should not be empty")
+	}
+
+	// Executing more commands should change the digest.
+	if _, err := ProvisionStatus(tpm); err != nil {
+		t.Fatalf("ProvisionStatus failed: %v", err)
+	}
+	auditInfo2, _, err := tpm.SessionAuditDigest(nil, nil)
+	if err != nil {
+		t.Fatalf("SessionAuditDigest failed: %v", err)
+	}
+	if bytes.Equal(digest, auditInfo2.Attested.SessionAudit().SessionDigest) {
+		t.Errorf("Audit digest should have changed")
+	}
+}
@@ -0,0 +1,452 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	authorizedPCRPolicyListHeader uint32 = 0x55534b4c
+
+	// maxAuthorizedPCRPolicies is the maximum number of authorized PCR policies that can be added to a list over its lifetime,
+	// which is limited by the size of the NV bit field index used for revocation.
+	maxAuthorizedPCRPolicies = 64
+)
+
+// pcrPolicyRevocationIndexAttrs are the attributes for a NV index used to revoke individual authorized PCR policies. Bits can only be
+// set with owner authorization, and the index can be read with an empty authorization value for the TPM2_PolicyNV assertion.
+var pcrPolicyRevocationIndexAttrs = tpm2.NVTypeBits.WithAttrs(tpm2.AttrNVOwnerWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA)
+
+// computePCRPolicyRevocationIndexPublic computes the public area of a initialized NV index used for revoking individual authorized PCR
+// policies at the specified handle.
+func computePCRPolicyRevocationIndexPublic(handle tpm2.Handle) *tpm2.NVPublic {
+	return &tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   pcrPolicyRevocationIndexAttrs | tpm2.AttrNVWritten,
+		Size:    8}
+}
+
+// authorizedPCRPolicyEntryRaw_v0 is version 0 of the on-disk format of an entry in an authorized PCR policy list.
+type authorizedPCRPolicyEntryRaw_v0 struct {
+	ID     uint32                   // The bit in the revocation index associated with this policy
+	Policy *dynamicPolicyDataRaw_v0 // The signed dynamic authorization policy
+}
+
+// authorizedPCRPolicyListRaw_v0 is version 0 of the on-disk format of an authorized PCR policy list.
+type authorizedPCRPolicyListRaw_v0 struct {
+	RevocationIndex tpm2.Handle // Handle of the NV bit field index used for revoking individual policies
+	NextID          uint32      // The ID to assign to the next policy added to the list
+	Entries         []authorizedPCRPolicyEntryRaw_v0
+}
+
+// AuthorizedPCRPolicyList is a list of PCR protection policies for a sealed key object, each of which has been individually
+// authorized with the key used to authorize dynamic authorization policies for the sealed key object, and each of which can be
+// individually revoked. This allows the set of acceptable PCR policies to be extended over time without re-sealing or modifying
+// the sealed key data file. A list is created with CreateAuthorizedPCRPolicyList, policies are added with AddAuthorizedPCRPolicy and
+// revoked with RevokeAuthorizedPCRPolicy, and the list is used to unseal a key with
+// SealedKeyObject.UnsealFromTPMWithAuthorizedPCRPolicyList.
+//
+// The list is stored on disk with a 32-bit header (0x55534b4c), a 32-bit version (currently 0), the handle of the revocation NV index,
+// the ID that will be assigned to the next policy and then the list of entries. Each entry consists of its ID and a signed dynamic
+// authorization policy in the same format as the one stored in the sealed key data file.
+//
+// The revocation NV index is a 64-bit NV bit field index (TPM_NT_BITS). Each policy in the list is assigned a unique ID which
+// corresponds to a bit in this index, and the policy contains a TPM2_PolicyNV assertion that is only satisfied if the corresponding
+// bit is clear. Revoking a policy sets the bit, which can't be cleared without undefining the index. Bits can only be set with the
+// authorization value of the storage hierarchy, and so the revocation mechanism is only as strong as the protection of that
+// authorization value - note that the storage hierarchy authorization can also be used to undefine and redefine the index, which
+// would restore previously revoked policies. As the index has 64 bits, a list can only have 64 policies added to it over its
+// lifetime.
+//
+// Policies in the list also contain the same dynamic authorization policy revocation check as the policy stored in the sealed key
+// data file, and so all of them are revoked by a subsequent call to UpdateKeyPCRProtectionPolicy.
+type AuthorizedPCRPolicyList struct {
+	revocationIndex tpm2.Handle
+	nextID          uint32
+	entries         []authorizedPCRPolicyEntryRaw_v0
+}
+
+// IDs returns the IDs of the non-revoked policies in this list.
+func (l *AuthorizedPCRPolicyList) IDs() []uint32 {
+	var ids []uint32
+	for _, e := range l.entries {
+		ids = append(ids, e.ID)
+	}
+	return ids
+}
+
+func (l *AuthorizedPCRPolicyList) write(w io.Writer) error {
+	raw := authorizedPCRPolicyListRaw_v0{
+		RevocationIndex: l.revocationIndex,
+		NextID:          l.nextID,
+		Entries:         l.entries}
+	if _, err := tpm2.MarshalToWriter(w, authorizedPCRPolicyListHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot marshal list: %w", err)
+	}
+	return nil
+}
+
+func (l *AuthorizedPCRPolicyList) writeToFileAtomic(dest string) error {
+	f, err := osutil.NewAtomicFile(dest, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := l.write(f); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+
+	return nil
+}
+
+func decodeAuthorizedPCRPolicyList(r io.Reader) (*AuthorizedPCRPolicyList, error) {
+	var header, version uint32
+	if _, err := tpm2.UnmarshalFromReader(r, &header, &version); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != authorizedPCRPolicyListHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+	if version != 0 {
+		return nil, fmt.Errorf("unexpected version (%d)", version)
+	}
+
+	var raw authorizedPCRPolicyListRaw_v0
+	if _, err := tpm2.UnmarshalFromReader(r, &raw); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal list: %w", err)
+	}
+
+	if raw.RevocationIndex.Type() != tpm2.HandleTypeNVIndex {
+		return nil, errors.New("invalid revocation NV index handle")
+	}
+	for _, e := range raw.Entries {
+		if e.ID >= raw.NextID || e.ID >= maxAuthorizedPCRPolicies {
+			return nil, fmt.Errorf("invalid ID for entry (%d)", e.ID)
+		}
+		if e.Policy == nil {
+			return nil, fmt.Errorf("no policy for entry %d", e.ID)
+		}
+	}
+
+	return &AuthorizedPCRPolicyList{
+		revocationIndex: raw.RevocationIndex,
+		nextID:          raw.NextID,
+		entries:         raw.Entries}, nil
+}
+
+// ReadAuthorizedPCRPolicyList loads the authorized PCR policy list at the specified path.
+//
+// If the file cannot be opened, a wrapped *os.PathError error will be returned.
+func ReadAuthorizedPCRPolicyList(path string) (*AuthorizedPCRPolicyList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open authorized PCR policy list: %w", err)
+	}
+	defer f.Close()
+
+	l, err := decodeAuthorizedPCRPolicyList(f)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode authorized PCR policy list: %w", err)
+	}
+	return l, nil
+}
+
+// CreateAuthorizedPCRPolicyList creates a NV bit field index at the specified handle for revoking individual authorized PCR policies,
+// and creates an empty authorized PCR policy list associated with it at the specified path. This requires knowledge of the
+// authorization value for the storage hierarchy, which must be set on the TPMConnection with
+// tpm.OwnerHandleContext().SetAuthValue. The choice of handle should take in to consideration the reserved indices from the
+// "Registry of reserved TPM 2.0 handles and localities" specification.
+//
+// If a NV index already exists at the specified handle, a TPMResourceExistsError error will be returned.
+//
+// If the authorization value for the storage hierarchy is incorrect, a AuthFailError error will be returned.
+func CreateAuthorizedPCRPolicyList(tpm *TPMConnection, handle tpm2.Handle, path string) error {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return errors.New("invalid handle type")
+	}
+
+	session := tpm.HmacSession()
+
+	pub := computePCRPolicyRevocationIndexPublic(handle)
+	pub.Attrs = pcrPolicyRevocationIndexAttrs
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, pub, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+		return TPMResourceExistsError{handle}
+	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+		return AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return xerrors.Errorf("cannot define revocation NV index: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+	}()
+
+	// Initialize the index. TPM2_PolicyNV assertions can't be executed against an index that hasn't been written.
+	if err := tpm.NVSetBits(tpm.OwnerHandleContext(), index, 0, session); err != nil {
+		return xerrors.Errorf("cannot initialize revocation NV index: %w", err)
+	}
+
+	l := &AuthorizedPCRPolicyList{revocationIndex: handle}
+	if err := l.writeToFileAtomic(path); err != nil {
+		return xerrors.Errorf("cannot write authorized PCR policy list: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
+
+// AddAuthorizedPCRPolicy computes a PCR protection policy from the profile defined by the pcrProfile argument for the sealed key at
+// the path specified by the keyPath argument, authorizes it with the key stored in the policy update data file at the path specified
+// by the policyUpdatePath argument, and appends it to the authorized PCR policy list at the path specified by the listPath argument.
+// The previously authorized policies in the list and the PCR protection policy stored in the sealed key data file remain valid.
+//
+// On success, the ID of the new policy is returned. This can be passed to RevokeAuthorizedPCRPolicy in order to revoke it.
+//
+// If any file cannot be opened, a wrapped *os.PathError error will be returned.
+//
+// If the key data file or policy update data file cannot be deserialized correctly or validation of the files fails, a
+// InvalidKeyFileError error will be returned.
+func AddAuthorizedPCRPolicy(tpm *TPMConnection, keyPath, policyUpdatePath, listPath string, pcrProfile *PCRProtectionProfile) (uint32, error) {
+	session := tpm.HmacSession()
+
+	l, err := ReadAuthorizedPCRPolicyList(listPath)
+	if err != nil {
+		return 0, err
+	}
+	if l.nextID >= maxAuthorizedPCRPolicies {
+		return 0, errors.New("the maximum number of policies have already been added to the authorized PCR policy list")
+	}
+
+	keyFile, err := os.Open(keyPath)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer keyFile.Close()
+
+	policyUpdateFile, err := os.Open(policyUpdatePath)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot open private data file: %w", err)
+	}
+	defer policyUpdateFile.Close()
+
+	data, policyUpdateData, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, policyUpdateFile, session)
+	if err != nil {
+		if isKeyFileError(err) {
+			return 0, InvalidKeyFileError{err.Error()}
+		}
+		return 0, xerrors.Errorf("cannot read and validate key data file: %w", err)
+	}
+	if len(data.userPINIndexHandles) > 0 {
+		return 0, errors.New("authorized PCR policy lists are not supported for sealed key objects with user PINs")
+	}
+
+	revocationIndexName, err := computePCRPolicyRevocationIndexPublic(l.revocationIndex).Name()
+	if err != nil {
+		return 0, xerrors.Errorf("cannot compute name of revocation NV index: %w", err)
+	}
+
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+	id := l.nextID
+	policyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, data.policyVersion(), data.keyPublic.NameAlg,
+		data.staticPolicyData.AuthPublicKey.NameAlg, policyUpdateData.authKey, rand.Reader, pinIndexPublic,
+		data.staticPolicyData.PinIndexAuthPolicies, pcrProfile, false, &pcrPolicyRevocationCheck{indexName: revocationIndexName, bit: id},
+		nil, session)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+
+	l.entries = append(l.entries, authorizedPCRPolicyEntryRaw_v0{ID: id, Policy: makeDynamicPolicyDataRaw_v0(policyData)})
+	l.nextID++
+
+	if err := l.writeToFileAtomic(listPath); err != nil {
+		return 0, xerrors.Errorf("cannot write authorized PCR policy list: %w", err)
+	}
+
+	return id, nil
+}
+
+// RevokeAuthorizedPCRPolicy revokes the policy with the specified ID in the authorized PCR policy list at the specified path, by
+// setting the corresponding bit in the list's revocation NV index, and then removes it from the list. This requires knowledge of the
+// authorization value for the storage hierarchy, which must be set on the TPMConnection with tpm.OwnerHandleContext().SetAuthValue.
+//
+// If the authorization value for the storage hierarchy is incorrect, a AuthFailError error will be returned.
+func RevokeAuthorizedPCRPolicy(tpm *TPMConnection, listPath string, id uint32) error {
+	if id >= maxAuthorizedPCRPolicies {
+		return errors.New("invalid ID")
+	}
+
+	session := tpm.HmacSession()
+
+	l, err := ReadAuthorizedPCRPolicyList(listPath)
+	if err != nil {
+		return err
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(l.revocationIndex, session.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, l.revocationIndex):
+		return errors.New("the revocation NV index does not exist")
+	case err != nil:
+		return xerrors.Errorf("cannot create context for revocation NV index: %w", err)
+	}
+
+	if err := tpm.NVSetBits(tpm.OwnerHandleContext(), index, uint64(1)<<id, session); err != nil {
+		if isAuthFailError(err, tpm2.CommandNVSetBits, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot set bit in revocation NV index: %w", err)
+	}
+
+	for i, e := range l.entries {
+		if e.ID != id {
+			continue
+		}
+		l.entries = append(l.entries[:i], l.entries[i+1:]...)
+		break
+	}
+
+	if err := l.writeToFileAtomic(listPath); err != nil {
+		return xerrors.Errorf("cannot write authorized PCR policy list: %w", err)
+	}
+
+	return nil
+}
+
+// UnsealFromTPMWithAuthorizedPCRPolicyList will load the TPM sealed object in to the TPM and attempt to unseal it using one of the
+// policies in the supplied authorized PCR policy list, rather than the PCR protection policy stored in the sealed key data file.
+// Each policy in the list is tried in turn until one is found that is satisfied by the current PCR values, and that has been
+// correctly signed and hasn't been revoked. If a PIN has been set, the correct PIN must be provided via the pin argument.
+//
+// If none of the policies in the list are satisfied, a InvalidKeyFileError error will be returned.
+//
+// Otherwise, this returns the same errors as UnsealFromTPM.
+func (k *SealedKeyObject) UnsealFromTPMWithAuthorizedPCRPolicyList(tpm *TPMConnection, list *AuthorizedPCRPolicyList, pin string) ([]byte, error) {
+	if list == nil {
+		return nil, errors.New("no authorized PCR policy list provided")
+	}
+	if len(list.entries) == 0 {
+		return nil, InvalidKeyFileError{"the authorized PCR policy list is empty"}
+	}
+
+	// Check if the TPM is in lockout mode
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch properties from TPM: %w", err)
+	}
+
+	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
+		return nil, ErrTPMLockout
+	}
+
+	if err := k.checkFirmwareVersion(tpm); err != nil {
+		return nil, err
+	}
+
+	hmacSession := tpm.HmacSession()
+
+	revocationIndex, err := tpm.CreateResourceContextFromTPM(list.revocationIndex)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, list.revocationIndex):
+		return nil, InvalidKeyFileError{"the revocation NV index for the authorized PCR policy list does not exist"}
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for revocation NV index: %w", err)
+	}
+
+	key, err := k.loadToTPM(tpm, hmacSession)
+	if err != nil {
+		return nil, err
+	}
+	defer tpm.FlushContext(key)
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	var lastErr error
+	for _, e := range list.entries {
+		if err := tpm.PolicyRestart(policySession); err != nil {
+			return nil, xerrors.Errorf("cannot restart policy session: %w", err)
+		}
+
+		if err := executePolicySessionWithRevocationCheck(tpm.TPMContext, policySession, k.data.staticPolicyData, e.Policy.data(), nil, 0,
+			revocationIndex, e.ID, pinIndexAuthValue(pin), hmacSession); err != nil {
+			err = xerrors.Errorf("cannot complete authorization policy assertions for authorized PCR policy %d: %w", e.ID, err)
+			switch {
+			case isDynamicPolicyDataError(err):
+				// This policy isn't satisfied, has been revoked or has an invalid signature. Try the next one.
+				lastErr = InvalidKeyFileError{err.Error()}
+				continue
+			case isStaticPolicyDataError(err):
+				return nil, InvalidKeyFileError{err.Error()}
+			case isAuthFailError(err, tpm2.CommandPolicySecret, 1):
+				return nil, ErrPINFail
+			case tpm2.IsResourceUnavailableError(err, lockNVHandle):
+				return nil, ErrTPMProvisioning
+			case tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandPolicyNV):
+				return nil, ErrSealedKeyAccessLocked
+			}
+			return nil, err
+		}
+
+		if err := k.executePhysicalPresenceAssertion(tpm, policySession); err != nil {
+			return nil, err
+		}
+		if err := k.executeNetworkSecretAssertion(tpm, policySession, hmacSession, nil); err != nil {
+			return nil, err
+		}
+		if err := k.executeSingleUseAssertion(tpm, policySession, hmacSession); err != nil {
+			return nil, err
+		}
+		if err := k.executeAdminOverrideORAssertion(tpm, policySession); err != nil {
+			return nil, err
+		}
+
+		return k.unsealWithPolicySession(tpm, key, policySession, hmacSession)
+	}
+
+	return nil, lastErr
+}
@@ -0,0 +1,144 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestAuthorizedPCRPolicyList(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestAuthorizedPCRPolicyList_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	policyUpdateFile := filepath.Join(tmpDir, "keypolicyupdatedata")
+	listFile := filepath.Join(tmpDir, "policylist")
+
+	// Seal the key with a PCR profile that isn't satisfied, so that it can only be unsealed using the authorized PCR policy list.
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, make(tpm2.Digest, 32))
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: profile, PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	revocationHandle := tpm2.Handle(0x01810010)
+	if err := CreateAuthorizedPCRPolicyList(tpm, revocationHandle, listFile); err != nil {
+		t.Fatalf("CreateAuthorizedPCRPolicyList failed: %v", err)
+	}
+	defer func() {
+		index, err := tpm.CreateResourceContextFromTPM(revocationHandle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}()
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	id, err := AddAuthorizedPCRPolicy(tpm, keyFile, policyUpdateFile, listFile, getTestPCRProfile())
+	if err != nil {
+		t.Fatalf("AddAuthorizedPCRPolicy failed: %v", err)
+	}
+	if id != 0 {
+		t.Errorf("Unexpected ID: %d", id)
+	}
+
+	list, err := ReadAuthorizedPCRPolicyList(listFile)
+	if err != nil {
+		t.Fatalf("ReadAuthorizedPCRPolicyList failed: %v", err)
+	}
+
+	keyUnsealed, err := k.UnsealFromTPMWithAuthorizedPCRPolicyList(tpm, list, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithAuthorizedPCRPolicyList failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	// The policy in the key data file should still not be satisfied.
+	if _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+		t.Errorf("UnsealFromTPM should have failed")
+	}
+
+	if err := RevokeAuthorizedPCRPolicy(tpm, listFile, id); err != nil {
+		t.Fatalf("RevokeAuthorizedPCRPolicy failed: %v", err)
+	}
+
+	// The copy of the list read before the policy was revoked still contains it, but it should no longer work.
+	_, err = k.UnsealFromTPMWithAuthorizedPCRPolicyList(tpm, list, "")
+	if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: cannot complete authorization policy "+
+		"assertions for authorized PCR policy 0: the authorized PCR policy has been revoked" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	list, err = ReadAuthorizedPCRPolicyList(listFile)
+	if err != nil {
+		t.Fatalf("ReadAuthorizedPCRPolicyList failed: %v", err)
+	}
+	if len(list.IDs()) != 0 {
+		t.Errorf("Unexpected IDs: %v", list.IDs())
+	}
+
+	// Adding a new policy should work, and it should be assigned a new ID.
+	id, err = AddAuthorizedPCRPolicy(tpm, keyFile, policyUpdateFile, listFile, getTestPCRProfile())
+	if err != nil {
+		t.Fatalf("AddAuthorizedPCRPolicy failed: %v", err)
+	}
+	if id != 1 {
+		t.Errorf("Unexpected ID: %d", id)
+	}
+
+	list, err = ReadAuthorizedPCRPolicyList(listFile)
+	if err != nil {
+		t.Fatalf("ReadAuthorizedPCRPolicyList failed: %v", err)
+	}
+	keyUnsealed, err = k.UnsealFromTPMWithAuthorizedPCRPolicyList(tpm, list, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithAuthorizedPCRPolicyList failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
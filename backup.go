@@ -0,0 +1,139 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	sealedKeyBackupHeader uint32 = 0x55534b42
+)
+
+// sealedKeyBackupRaw_v0 is version 0 of the format written by SealedKeyObject.ExportForBackup.
+type sealedKeyBackupRaw_v0 struct {
+	PINIndexPublic *tpm2.NVPublic // The public area of the PIN NV index that the sealed key object is bound to
+	KeyData        []byte         // The serialized key data file
+}
+
+// ExportForBackup writes this sealed key object to w, along with the public area of the PIN NV index that it is bound to, for
+// escrow or backup purposes. The backup can be used with RestoreFromBackup to recreate a lost key data file on the same TPM. It
+// doesn't contain the authorization value of the PIN NV index (the PIN or passphrase), which is never stored by this package.
+//
+// The backup is only useful on the TPM on which the sealed key object was created, and only for as long as the storage root key
+// and the PIN NV index remain unchanged. It doesn't contain any secrets that aren't already in the key data file - the sealed key
+// can only be unsealed by the TPM.
+func (k *SealedKeyObject) ExportForBackup(w io.Writer) error {
+	keyData := new(bytes.Buffer)
+	if err := k.data.write(keyData); err != nil {
+		return xerrors.Errorf("cannot serialize key data: %w", err)
+	}
+
+	raw := sealedKeyBackupRaw_v0{
+		PINIndexPublic: computePinNVIndexPublic(k.data.staticPolicyData.PinIndexHandle, k.data.pinIndexAttrs,
+			k.data.pinIndexNameAlg, k.data.staticPolicyData.PinIndexAuthPolicies),
+		KeyData: keyData.Bytes()}
+	if _, err := tpm2.MarshalToWriter(w, sealedKeyBackupHeader, uint32(0), raw); err != nil {
+		return xerrors.Errorf("cannot write backup: %w", err)
+	}
+	return nil
+}
+
+// RestoreFromBackup reads a backup created by SealedKeyObject.ExportForBackup from r, and recreates the key data file at the path
+// specified by keyPath. The restored key data file is validated against the TPM before it is written, in the same way as
+// key data files are validated by UpdateKeyPCRProtectionPolicy.
+//
+// The PIN NV index that the sealed key object is bound to can't be recreated by design. It is initialized with an authorization
+// that is signed by an ephemeral key which is discarded, so that an adversary with knowledge of the owner authorization can't
+// undefine it and define a new NV index with the same name and a different PIN. The sealed key object's authorization policy
+// is bound to the name of the PIN NV index, so if the NV index has been undefined, the sealed key object can never be unsealed
+// again and it must be recreated with SealKeyToTPM. In this case, a PINIndexVerificationError error will be returned, as it will
+// if the NV index at the expected handle is not the one that the sealed key object was created with. A restored key data file
+// therefore uses the PIN or passphrase that is currently set on the PIN NV index. If this is not known, it must be re-established
+// out of band (eg, by recreating the sealed key object with the recovery key), as it can't be reset.
+//
+// If the PCR protection policy for the sealed key object was updated after the backup was created, the restored key data file
+// contains a revoked PCR protection policy, and a new one must be created with UpdateKeyPCRProtectionPolicy using the existing
+// private data file before it can be unsealed.
+//
+// If the backup can't be decoded, or the restored key data file fails validation, a InvalidKeyFileError error will be returned.
+func RestoreFromBackup(tpm *TPMConnection, r io.Reader, keyPath string) error {
+	var header, version uint32
+	if _, err := tpm2.UnmarshalFromReader(r, &header, &version); err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot unmarshal backup header: %v", err)}
+	}
+	if header != sealedKeyBackupHeader {
+		return InvalidKeyFileError{fmt.Sprintf("unexpected backup header (%d)", header)}
+	}
+	if version != 0 {
+		return InvalidKeyFileError{fmt.Sprintf("unexpected backup version (%d)", version)}
+	}
+
+	var raw sealedKeyBackupRaw_v0
+	if _, err := tpm2.UnmarshalFromReader(r, &raw); err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot unmarshal backup: %v", err)}
+	}
+	if raw.PINIndexPublic == nil || raw.PINIndexPublic.Index.Type() != tpm2.HandleTypeNVIndex {
+		return InvalidKeyFileError{"invalid PIN NV index public area in backup"}
+	}
+	expectedName, err := raw.PINIndexPublic.Name()
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot compute name of PIN NV index from backup: %v", err)}
+	}
+
+	// Check that the PIN NV index still exists before validating the key data, so that this case can be distinguished.
+	handle := raw.PINIndexPublic.Index
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return PINIndexVerificationError{fmt.Sprintf("no NV index is defined at %v, and it can't be recreated", handle)}
+	case err != nil:
+		return xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+	}
+	if !bytes.Equal(index.Name(), expectedName) {
+		return PINIndexVerificationError{fmt.Sprintf("the NV index at %v is not the one that the sealed key object was created with", handle)}
+	}
+
+	data, _, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, bytes.NewReader(raw.KeyData), nil, tpm.HmacSession())
+	if err != nil {
+		if isKeyFileError(err) {
+			return InvalidKeyFileError{err.Error()}
+		}
+		return xerrors.Errorf("cannot read and validate key data from backup: %w", err)
+	}
+	pinIndexName, err := pinIndexPublic.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of PIN NV index: %w", err)
+	}
+	if !bytes.Equal(pinIndexName, expectedName) {
+		return InvalidKeyFileError{"the PIN NV index public area in the backup is inconsistent with the key data"}
+	}
+
+	if err := data.writeToFileAtomic(keyPath); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+var benchmarkPCRSelection = tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+
+// BenchmarkUnseal estimates how long it takes to unseal a sealed key object on this TPM, which can vary significantly between TPM
+// vendors. This is intended to be used by user interfaces that want to display progress whilst unsealing rather than relying on a
+// fixed timeout. It creates a throwaway sealed object under the storage root key with an authorization policy containing
+// TPM2_PolicyPCR and TPM2_PolicyCommandCode assertions, and then measures the time taken to load it, execute the policy
+// assertions and unseal it. The throwaway object is flushed from the TPM afterwards, and no persistent resources are created.
+//
+// The result is cached, so subsequent calls on the same connection return the same estimate without accessing the TPM.
+//
+// If the TPM is not provisioned correctly, then a ErrTPMProvisioning error will be returned. If the storage root key has a template
+// authorization policy, the throwaway object can't be created and a ErrSRKTemplateAuthorizationRequired error will be returned.
+func (t *TPMConnection) BenchmarkUnseal() (time.Duration, error) {
+	if t.unsealBenchmark > 0 {
+		return t.unsealBenchmark, nil
+	}
+
+	session := t.HmacSession()
+
+	srk, err := t.storageRootKey(session)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, srkHandle):
+		return 0, ErrTPMProvisioning
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		return 0, AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return 0, xerrors.Errorf("cannot create context for SRK: %w", err)
+	}
+	required, err := srkRequiresTemplateAuthorization(t.TPMContext, srk)
+	switch {
+	case err != nil:
+		return 0, err
+	case required:
+		return 0, ErrSRKTemplateAuthorizationRequired
+	}
+
+	_, pcrValues, err := t.PCRRead(benchmarkPCRSelection)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot read PCR values: %w", err)
+	}
+	_, pcrDigest, err := tpm2.ComputePCRDigestSimple(tpm2.HashAlgorithmSHA256, pcrValues)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot compute PCR digest: %w", err)
+	}
+
+	template := makeSealedKeyTemplate()
+	trial, _ := tpm2.ComputeAuthPolicy(template.NameAlg)
+	trial.PolicyPCR(pcrDigest, benchmarkPCRSelection)
+	trial.PolicyCommandCode(tpm2.CommandUnseal)
+	template.AuthPolicy = trial.GetDigest()
+
+	sensitive := tpm2.SensitiveCreate{Data: make([]byte, 32)}
+	priv, pub, _, _, _, err := t.Create(srk, &sensitive, template, nil, nil, session)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot create throwaway sealed object: %w", err)
+	}
+
+	start := time.Now()
+
+	key, err := t.Load(srk, priv, pub, session)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot load throwaway sealed object: %w", err)
+	}
+	defer t.FlushContext(key)
+
+	policySession, err := t.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, template.NameAlg)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer t.FlushContext(policySession)
+
+	if err := t.PolicyPCR(policySession, nil, benchmarkPCRSelection); err != nil {
+		return 0, xerrors.Errorf("cannot execute PCR assertion: %w", err)
+	}
+	if err := t.PolicyCommandCode(policySession, tpm2.CommandUnseal); err != nil {
+		return 0, xerrors.Errorf("cannot execute command code assertion: %w", err)
+	}
+	if _, err := t.Unseal(key, policySession, session.IncludeAttrs(tpm2.AttrResponseEncrypt)); err != nil {
+		return 0, xerrors.Errorf("cannot unseal throwaway sealed object: %w", err)
+	}
+
+	t.unsealBenchmark = time.Since(start)
+	return t.unsealBenchmark, nil
+}
@@ -0,0 +1,66 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestBenchmarkUnseal(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+
+	d, err := tpm.BenchmarkUnseal()
+	if err != nil {
+		t.Fatalf("BenchmarkUnseal failed: %v", err)
+	}
+	if d <= 0 {
+		t.Errorf("Unexpected duration: %v", d)
+	}
+
+	handles2, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if len(handles2) != len(handles) {
+		t.Errorf("BenchmarkUnseal should flush the throwaway sealed object")
+	}
+
+	// The result should be cached.
+	d2, err := tpm.BenchmarkUnseal()
+	if err != nil {
+		t.Fatalf("BenchmarkUnseal failed: %v", err)
+	}
+	if d2 != d {
+		t.Errorf("BenchmarkUnseal should return the cached result")
+	}
+}
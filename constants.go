@@ -33,6 +33,12 @@ const (
 	lockNVHandle     tpm2.Handle = 0x01801100 // Global NV handle for locking access to sealed key objects
 	lockNVDataHandle tpm2.Handle = 0x01801101 // NV index containing policy data for lockNVHandle
 
+	srkTemplatePolicyNVHandle tpm2.Handle = 0x01801102 // NV index containing the name of the key that authorizes SRK child templates
+	srkTemplateUniqueNVHandle tpm2.Handle = 0x01801103 // NV index containing the unique value of the SRK template after rotation
+
+	// The number of PCRs on a PC-Client TPM, see section 4.6 of "TCG PC Client Platform TPM Profile (PTP) Specification"
+	maxPCR = 24
+
 	// SHA-256 is mandatory to exist on every PC-Client TPM
 	// XXX: Maybe dynamically select algorithms based on what's available on the device?
 	defaultSessionHashAlgorithm tpm2.HashAlgorithmId = tpm2.HashAlgorithmSHA256
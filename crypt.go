@@ -195,6 +195,33 @@ func getPassword(sourceDevicePath, description string, reader io.Reader) (string
 	return askPassword(sourceDevicePath, "Please enter the "+description+" for disk "+sourceDevicePath+":")
 }
 
+// RecoveryKey corresponds to a 16-byte fallback recovery key, as added to a LUKS2 container by AddRecoveryKeyToLUKS2Container.
+type RecoveryKey [16]byte
+
+// String returns the recovery key in the format that users are expected to enter it, which is 8 groups of 5 base-10 digits
+// separated by '-', with each group encoding a 2-byte little-endian number.
+func (k RecoveryKey) String() string {
+	var s []string
+	for i := 0; i < len(k); i += 2 {
+		s = append(s, fmt.Sprintf("%05d", binary.LittleEndian.Uint16(k[i:])))
+	}
+	return strings.Join(s, "-")
+}
+
+// ParseRecoveryKey parses a recovery key in the format returned by RecoveryKey.String. The groups of 5 digits may optionally be
+// separated by '-'. An error is returned if the supplied string is incorrectly formatted or doesn't encode exactly 16 bytes.
+func ParseRecoveryKey(s string) (out RecoveryKey, err error) {
+	key, err := decodeRecoveryKey(s)
+	if err != nil {
+		return RecoveryKey{}, err
+	}
+	if len(key) != len(out) {
+		return RecoveryKey{}, fmt.Errorf("incorrectly formatted (expected %d groups of 5 digits)", len(out)/2)
+	}
+	copy(out[:], key)
+	return out, nil
+}
+
 func decodeRecoveryKey(passphrase string) ([]byte, error) {
 	// The recovery key should be provided as 8 groups of 5 base-10 digits, with each 5 digits being converted to a 2-byte number to
 	// make a 16-byte key.
@@ -301,7 +328,9 @@ func unsealKeyFromTPM(tpm *TPMConnection, k *SealedKeyObject, pin string) ([]byt
 		// has a null authorization value, then this will allow us to unseal the key without requiring any type of manual recovery. If the
 		// storage hierarchy has a non-null authorization value, ProvionTPM will fail. If the TPM owner has changed, ProvisionTPM might
 		// succeed, but UnsealFromTPM will fail with InvalidKeyFileError when retried.
-		if pErr := ProvisionTPM(tpm, ProvisionModeWithoutLockout, nil); pErr == nil {
+		// This doesn't clear the TPM, and it only evicts a SRK that looks like it was created by us before recreating it from the same
+		// storage primary seed, so confirm the provisioning without asking.
+		if pErr := ProvisionTPM(tpm, ProvisionModeWithoutLockout, nil, true); pErr == nil {
 			key, err = k.UnsealFromTPM(tpm, pin)
 		}
 	}
@@ -310,6 +339,8 @@ func unsealKeyFromTPM(tpm *TPMConnection, k *SealedKeyObject, pin string) ([]byt
 
 var requiresPinErr = errors.New("no PIN tries permitted when a PIN is required")
 
+var requiresSecurityKeyErr = errors.New("a security key is required to unseal the key, which can't be obtained during activation")
+
 type lockAccessError struct {
 	err error
 }
@@ -322,12 +353,38 @@ func (e lockAccessError) Unwrap() error {
 	return e.err
 }
 
+// getVolumeIdentity returns the identity of the LUKS2 container at devicePath, which is its UUID.
+var getVolumeIdentity = func(devicePath string) (string, error) {
+	cmd := exec.Command("cryptsetup", "luksUUID", devicePath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", osutil.OutputErr(output, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// checkVolumeIdentity checks that the sealed key object can be used to activate the volume at sourceDevicePath, if it is bound
+// to the identity of a specific volume.
+func checkVolumeIdentity(k *SealedKeyObject, sourceDevicePath string) error {
+	if k.VolumeIdentity() == "" {
+		return nil
+	}
+	identity, err := getVolumeIdentity(sourceDevicePath)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain volume identity: %w", err)
+	}
+	if !strings.EqualFold(identity, k.VolumeIdentity()) {
+		return ErrVolumeIdentityMismatch
+	}
+	return nil
+}
+
 func isLockAccessError(err error) bool {
 	var e lockAccessError
 	return xerrors.As(err, &e)
 }
 
-func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPath string, pinReader io.Reader, pinTries int, lock bool, activateOptions []string) error {
+func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath string, readKey func() (*SealedKeyObject, error), pinReader io.Reader, pinTries int, lock bool, activateOptions []string) error {
 	var lockErr error
 	key, err := func() ([]byte, error) {
 		defer func() {
@@ -337,13 +394,20 @@ func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPat
 			lockErr = LockAccessToSealedKeys(tpm)
 		}()
 
-		k, err := ReadSealedKeyObject(keyPath)
+		k, err := readKey()
 		if err != nil {
 			return nil, xerrors.Errorf("cannot read sealed key object: %w", err)
 		}
 
+		if err := checkVolumeIdentity(k, sourceDevicePath); err != nil {
+			return nil, err
+		}
+
 		switch {
-		case pinTries == 0 && k.AuthMode2F() == AuthModePIN:
+		case k.AuthMode2F() == AuthModeSecurityKey:
+			// The secret from a security key can't be requested with systemd-ask-password.
+			return nil, requiresSecurityKeyErr
+		case pinTries == 0 && k.AuthMode2F() != AuthModeNone:
 			return nil, requiresPinErr
 		case pinTries == 0:
 			pinTries = 1
@@ -353,17 +417,21 @@ func activateWithTPMKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPat
 
 		for ; pinTries > 0; pinTries-- {
 			var pin string
-			if k.AuthMode2F() == AuthModePIN {
+			if k.AuthMode2F() != AuthModeNone {
+				description := "PIN"
+				if k.AuthMode2F() == AuthModePassphrase {
+					description = "passphrase"
+				}
 				r := pinReader
 				pinReader = nil
-				pin, err = getPassword(sourceDevicePath, "PIN", r)
+				pin, err = getPassword(sourceDevicePath, description, r)
 				if err != nil {
-					return nil, xerrors.Errorf("cannot obtain PIN: %w", err)
+					return nil, xerrors.Errorf("cannot obtain %s: %w", description, err)
 				}
 			}
 
 			key, err = unsealKeyFromTPM(tpm, k, pin)
-			if err != nil && (err != ErrPINFail || k.AuthMode2F() != AuthModePIN) {
+			if err != nil && (err != ErrPINFail || k.AuthMode2F() == AuthModeNone) {
 				break
 			}
 		}
@@ -418,6 +486,11 @@ type ActivateWithTPMSealedKeyOptions struct {
 	// LockSealedKeyAccess controls whether LockAccessToSealedKeys should be called after unsealing the TPM sealed key. It is called if
 	// this is set to true, and not called if this is set to false.
 	LockSealedKeyAccess bool
+
+	// LUKS2TokenType specifies the type of the LUKS2 token that contains the TPM sealed key object when used with
+	// ActivateVolumeWithTPMSealedKeyFromLUKS2Token. If empty, LUKS2TokenTypeSecboot is used. This is ignored by
+	// ActivateVolumeWithTPMSealedKey.
+	LUKS2TokenType string
 }
 
 // ActivateVolumeWithTPMSealedKey attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping with the
@@ -454,6 +527,38 @@ type ActivateWithTPMSealedKeyOptions struct {
 // If the volume is successfully activated, either with the TPM sealed key or the fallback recovery key, this function returns true.
 // If it is not successfully activated, then this function returns false.
 func ActivateVolumeWithTPMSealedKey(tpm *TPMConnection, volumeName, sourceDevicePath, keyPath string, pinReader io.Reader, options *ActivateWithTPMSealedKeyOptions) (bool, error) {
+	return activateVolumeWithTPMSealedKey(tpm, volumeName, sourceDevicePath, func() (*SealedKeyObject, error) {
+		return ReadSealedKeyObject(keyPath)
+	}, pinReader, options)
+}
+
+// ActivateVolumeWithTPMSealedKeyFromLUKS2Token behaves like ActivateVolumeWithTPMSealedKey, except that the TPM sealed key object
+// is read from a token in the LUKS2 header of the container at sourceDevicePath rather than from a separate file. The token must
+// have been created with MakeLUKS2TokenForSealedKey and imported in to the LUKS2 header. The type of the token is specified by the
+// LUKS2TokenType field of options, which defaults to LUKS2TokenTypeSecboot.
+//
+// If a valid token can't be found or the sealed key object that it references can't be read, activation with the TPM sealed key
+// is considered to have failed because of an invalid key file. If the metadata of the LUKS2 header can't be read with cryptsetup,
+// activation with the TPM sealed key is considered to have failed because of an unexpected error. In either case, this function
+// falls back to activating with the recovery key if the RecoveryKeyTries field of options is greater than zero. As with
+// ActivateVolumeWithTPMSealedKey, a failure to activate with the TPM sealed key is reported with a *ActivateWithTPMSealedKeyError
+// error, so that a caller that sets RecoveryKeyTries to zero can distinguish this case and request the recovery key itself.
+func ActivateVolumeWithTPMSealedKeyFromLUKS2Token(tpm *TPMConnection, volumeName, sourceDevicePath string, pinReader io.Reader, options *ActivateWithTPMSealedKeyOptions) (bool, error) {
+	tokenType := options.LUKS2TokenType
+	if tokenType == "" {
+		tokenType = LUKS2TokenTypeSecboot
+	}
+
+	return activateVolumeWithTPMSealedKey(tpm, volumeName, sourceDevicePath, func() (*SealedKeyObject, error) {
+		token, err := readLUKS2TokenFromHeader(sourceDevicePath, tokenType)
+		if err != nil {
+			return nil, err
+		}
+		return token.ReadSealedKeyObject()
+	}, pinReader, options)
+}
+
+func activateVolumeWithTPMSealedKey(tpm *TPMConnection, volumeName, sourceDevicePath string, readKey func() (*SealedKeyObject, error), pinReader io.Reader, options *ActivateWithTPMSealedKeyOptions) (bool, error) {
 	if options.PINTries < 0 {
 		return false, errors.New("invalid PINTries")
 	}
@@ -466,18 +571,22 @@ func ActivateVolumeWithTPMSealedKey(tpm *TPMConnection, volumeName, sourceDevice
 		return false, err
 	}
 
-	if err := activateWithTPMKey(tpm, volumeName, sourceDevicePath, keyPath, pinReader, options.PINTries, options.LockSealedKeyAccess, activateOptions); err != nil {
+	if err := activateWithTPMKey(tpm, volumeName, sourceDevicePath, readKey, pinReader, options.PINTries, options.LockSealedKeyAccess, activateOptions); err != nil {
 		reason := RecoveryKeyUsageReasonUnexpectedError
 		switch {
 		case isLockAccessError(err):
 			return false, LockAccessToSealedKeysError(err.Error())
 		case xerrors.Is(err, ErrTPMLockout):
 			reason = RecoveryKeyUsageReasonTPMLockout
-		case xerrors.Is(err, ErrTPMProvisioning):
+		case xerrors.Is(err, ErrTPMProvisioning), xerrors.Is(err, ErrOwnerHierarchyDisabled):
 			reason = RecoveryKeyUsageReasonTPMProvisioningError
 		case isInvalidKeyFileError(err):
 			reason = RecoveryKeyUsageReasonInvalidKeyFile
-		case xerrors.Is(err, requiresPinErr):
+		case xerrors.Is(err, ErrVolumeIdentityMismatch):
+			reason = RecoveryKeyUsageReasonInvalidKeyFile
+		case xerrors.Is(err, ErrKeyFileCorrupt):
+			reason = RecoveryKeyUsageReasonInvalidKeyFile
+		case xerrors.Is(err, requiresPinErr), xerrors.Is(err, requiresSecurityKeyErr):
 			reason = RecoveryKeyUsageReasonPINFail
 		case xerrors.Is(err, ErrPINFail):
 			reason = RecoveryKeyUsageReasonPINFail
@@ -530,6 +639,66 @@ func ActivateVolumeWithRecoveryKey(volumeName, sourceDevicePath string, keyReade
 	return activateWithRecoveryKey(volumeName, sourceDevicePath, keyReader, options.Tries, RecoveryKeyUsageReasonRequested, activateOptions)
 }
 
+// VerifyKeyAgainstLUKS2 tests whether the supplied key unlocks any keyslot of the LUKS2 container at devicePath, without
+// activating it. This makes use of the "--test-passphrase" option of cryptsetup. It can be used after unsealing a key to detect
+// that the sealed key file is stale (eg, because the keyslot has been changed) before relying on it, so that the caller can fall
+// back to the recovery key.
+//
+// This returns false without an error if the key doesn't unlock any keyslot. If cryptsetup fails for any other reason, such as the
+// device not being a valid LUKS2 container, an error containing the output of the cryptsetup command will be returned.
+func VerifyKeyAgainstLUKS2(devicePath string, key []byte) (bool, error) {
+	cmd := exec.Command("cryptsetup", "open", "--test-passphrase", "--key-file", "-", devicePath)
+	cmd.Stdin = bytes.NewReader(key)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	var e *exec.ExitError
+	// cryptsetup exits with status 2 if no keyslot could be unlocked with the supplied key.
+	if xerrors.As(err, &e) && e.ExitCode() == 2 {
+		return false, nil
+	}
+	return false, osutil.OutputErr(output, err)
+}
+
+// ActivateVolumeWithRecoveryKeyValue attempts to activate the LUKS encrypted volume at sourceDevicePath and create a mapping with
+// the name volumeName, using the supplied fallback recovery key. This is intended for callers that obtain the recovery key
+// themselves (eg, after ActivateVolumeWithTPMSealedKey fails with RecoveryKeyTries set to zero), rather than having
+// ActivateVolumeWithRecoveryKey request it using systemd-ask-password. Use ParseRecoveryKey to obtain a RecoveryKey from user
+// input, which validates its format. This makes use of systemd-cryptsetup.
+//
+// The activateOptions argument can be used to specify additional options to pass to systemd-cryptsetup. If it contains the "tries="
+// option, then an error will be returned.
+//
+// Before activating the volume, the recovery key is tested against the container with cryptsetup. If it is wrong,
+// ErrRecoveryKeyIncorrect is returned, which allows this to be distinguished from other errors, such as those caused by an
+// invalid device.
+//
+// If activation with the recovery key is successful, the recovery key will be added to the root user keyring in the kernel with a
+// description of the format "<argv[0]>:<volumeName>:reason=2".
+func ActivateVolumeWithRecoveryKeyValue(volumeName, sourceDevicePath string, recoveryKey RecoveryKey, activateOptions []string) error {
+	activateOptions, err := makeActivateOptions(activateOptions)
+	if err != nil {
+		return err
+	}
+
+	switch ok, err := VerifyKeyAgainstLUKS2(sourceDevicePath, recoveryKey[:]); {
+	case err != nil:
+		return xerrors.Errorf("cannot test recovery key: %w", err)
+	case !ok:
+		return ErrRecoveryKeyIncorrect
+	}
+
+	if err := activate(volumeName, sourceDevicePath, recoveryKey[:], activateOptions); err != nil {
+		return xerrors.Errorf("cannot activate volume: %w", err)
+	}
+
+	if _, err := unix.AddKey("user", fmt.Sprintf("%s:%s:reason=%d", filepath.Base(os.Args[0]), volumeName, RecoveryKeyUsageReasonRequested), recoveryKey[:], userKeyring); err != nil {
+		return xerrors.Errorf("cannot add recovery key to user keyring: %w", err)
+	}
+	return nil
+}
+
 func setLUKS2KeyslotPreferred(devicePath string, slot int) error {
 	cmd := exec.Command("cryptsetup", "config", "--priority", "prefer", "--key-slot", strconv.Itoa(slot), devicePath)
 	if output, err := cmd.CombinedOutput(); err != nil {
@@ -21,11 +21,13 @@ package secboot_test
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/canonical/go-tpm2"
@@ -242,7 +244,7 @@ type cryptTPMTestBase struct {
 func (ctb *cryptTPMTestBase) setUpTestBase(c *C, ttb *tpmTestBase) {
 	ctb.cryptTestBase.setUpTestBase(c, &ttb.BaseTest)
 
-	c.Assert(ProvisionTPM(ttb.tpm, ProvisionModeFull, nil), IsNil)
+	c.Assert(ProvisionTPM(ttb.tpm, ProvisionModeFull, nil, true), IsNil)
 
 	dir := c.MkDir()
 	ctb.keyFile = dir + "/keydata"
@@ -556,7 +558,7 @@ func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyErrorHandling4(c *C) {
 	// Test that recovery fallback works with the TPM in DA lockout mode.
 	c.Assert(s.tpm.DictionaryAttackParameters(s.tpm.LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
 	defer func() {
-		c.Check(ProvisionTPM(s.tpm, ProvisionModeFull, nil), IsNil)
+		c.Check(ProvisionTPM(s.tpm, ProvisionModeFull, nil, true), IsNil)
 	}()
 
 	s.testActivateVolumeWithTPMSealedKeyErrorHandling(c, &testActivateVolumeWithTPMSealedKeyErrorHandlingData{
@@ -618,7 +620,7 @@ func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyErrorHandling7(c *C) {
 	// Test that activation fails if RecoveryKeyTries is zero.
 	c.Assert(s.tpm.DictionaryAttackParameters(s.tpm.LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
 	defer func() {
-		c.Check(ProvisionTPM(s.tpm, ProvisionModeFull, nil), IsNil)
+		c.Check(ProvisionTPM(s.tpm, ProvisionModeFull, nil, true), IsNil)
 	}()
 
 	s.testActivateVolumeWithTPMSealedKeyErrorHandling(c, &testActivateVolumeWithTPMSealedKeyErrorHandlingData{
@@ -633,7 +635,7 @@ func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyErrorHandling8(c *C) {
 	// Test that activation fails if the wrong recovery key is provided.
 	c.Assert(s.tpm.DictionaryAttackParameters(s.tpm.LockoutHandleContext(), 0, 7200, 86400, nil), IsNil)
 	defer func() {
-		c.Check(ProvisionTPM(s.tpm, ProvisionModeFull, nil), IsNil)
+		c.Check(ProvisionTPM(s.tpm, ProvisionModeFull, nil, true), IsNil)
 	}()
 
 	s.testActivateVolumeWithTPMSealedKeyErrorHandling(c, &testActivateVolumeWithTPMSealedKeyErrorHandlingData{
@@ -682,6 +684,169 @@ func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyErrorHandling10(c *C)
 	})
 }
 
+func (s *cryptTPMSuite) mockLUKS2TokenExport(c *C, tokens ...[]byte) *testutil.MockCmd {
+	metadata := make(map[string]json.RawMessage)
+	for i, token := range tokens {
+		metadata[strconv.Itoa(i)] = token
+	}
+	b, err := json.Marshal(map[string]interface{}{"tokens": metadata})
+	c.Assert(err, IsNil)
+	metadataFile := filepath.Join(s.dir, "metadata")
+	c.Assert(ioutil.WriteFile(metadataFile, b, 0644), IsNil)
+
+	mock := testutil.MockCommand(c, "cryptsetup", fmt.Sprintf(`
+if [ "$1" = "luksDump" ] && [ "$2" = "--dump-json-metadata" ]; then
+    cat "%[1]s"
+    exit 0
+fi
+exit 1
+`, metadataFile))
+	s.AddCleanup(mock.Restore)
+	return mock
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2Token(c *C) {
+	token, err := MakeLUKS2TokenForSealedKey(s.keyFile, &LUKS2TokenParams{EmbedKeyData: true})
+	c.Assert(err, IsNil)
+	s.mockLUKS2TokenExport(c, token)
+	c.Assert(os.Remove(s.keyFile), IsNil)
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKeyFromLUKS2Token(s.tpm, "data", "/dev/sda1", nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Check(len(s.mockSdAskPassword.Calls()), Equals, 0)
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1"})
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2TokenNoToken(c *C) {
+	// Test that the error is distinguishable when there is no token and recovery is left to the caller.
+	mock := s.mockLUKS2TokenExport(c)
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKeyFromLUKS2Token(s.tpm, "data", "/dev/sda1", nil, &options)
+	c.Check(success, Equals, false)
+	c.Assert(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+	c.Check(err.(*ActivateWithTPMSealedKeyError).TPMErr, ErrorMatches, "cannot read sealed key object: invalid key data file: "+
+		"no token of type \"secboot-tpm2\" found in LUKS2 header")
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 0)
+	c.Check(mock.Calls(), DeepEquals, [][]string{{"cryptsetup", "luksDump", "--dump-json-metadata", "/dev/sda1"}})
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2TokenSelectsType(c *C) {
+	// Test that tokens of other types are skipped.
+	other, err := MakeLUKS2TokenForSealedKey(s.keyFile, &LUKS2TokenParams{Type: "foo", Keyslot: 1})
+	c.Assert(err, IsNil)
+	token, err := MakeLUKS2TokenForSealedKey(s.keyFile, &LUKS2TokenParams{EmbedKeyData: true})
+	c.Assert(err, IsNil)
+	s.mockLUKS2TokenExport(c, other, token)
+	c.Assert(os.Remove(s.keyFile), IsNil)
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKeyFromLUKS2Token(s.tpm, "data", "/dev/sda1", nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2TokenInvalidToken(c *C) {
+	// Test that a token of the requested type that can't be decoded isn't skipped.
+	token, err := MakeLUKS2TokenForSealedKey(s.keyFile, &LUKS2TokenParams{EmbedKeyData: true})
+	c.Assert(err, IsNil)
+	s.mockLUKS2TokenExport(c, []byte(`{"type":"secboot-tpm2","keyslots":[]}`), token)
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKeyFromLUKS2Token(s.tpm, "data", "/dev/sda1", nil, &options)
+	c.Check(success, Equals, false)
+	c.Assert(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+	c.Check(err.(*ActivateWithTPMSealedKeyError).TPMErr, ErrorMatches, "cannot read sealed key object: invalid key data file: "+
+		"cannot decode token 0: token must reference exactly one keyslot")
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2TokenCryptsetupError(c *C) {
+	// Test that a failure to read the LUKS2 header is propagated.
+	mock := testutil.MockCommand(c, "cryptsetup", "echo \"Device /dev/sda1 is not a valid LUKS device.\" >&2; exit 1")
+	s.AddCleanup(mock.Restore)
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKeyFromLUKS2Token(s.tpm, "data", "/dev/sda1", nil, &options)
+	c.Check(success, Equals, false)
+	c.Assert(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+	c.Check(err.(*ActivateWithTPMSealedKeyError).TPMErr, ErrorMatches, "cannot read sealed key object: cannot read LUKS2 header "+
+		"metadata: Device /dev/sda1 is not a valid LUKS device.")
+	c.Check(mock.Calls(), DeepEquals, [][]string{{"cryptsetup", "luksDump", "--dump-json-metadata", "/dev/sda1"}})
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyFromLUKS2TokenRecovery(c *C) {
+	// Test that recovery fallback works when the token has the wrong type.
+	token, err := MakeLUKS2TokenForSealedKey(s.keyFile, &LUKS2TokenParams{Type: "foo", EmbedKeyData: true})
+	c.Assert(err, IsNil)
+	s.mockLUKS2TokenExport(c, token)
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateWithTPMSealedKeyOptions{RecoveryKeyTries: 1}
+	success, err := ActivateVolumeWithTPMSealedKeyFromLUKS2Token(s.tpm, "data", "/dev/sda1", nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	s.checkRecoveryKeyKeyringEntry(c, RecoveryKeyUsageReasonInvalidKeyFile)
+}
+
+func (s *cryptTPMSuite) sealKeyWithVolumeIdentity(c *C, identity string) {
+	pinHandle := tpm2.Handle(0x0181fff1)
+	c.Assert(SealKeyToTPM(s.tpm, s.tpmKey, s.keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: pinHandle, VolumeIdentity: identity}), IsNil)
+	pinIndex, err := s.tpm.CreateResourceContextFromTPM(pinHandle)
+	c.Assert(err, IsNil)
+	s.addCleanupNVSpace(c, s.tpm.OwnerHandleContext(), pinIndex)
+
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	c.Check(k.VolumeIdentity(), Equals, identity)
+}
+
+func (s *cryptTPMSuite) mockLUKSUUID(c *C, uuid string) {
+	mock := testutil.MockCommand(c, "cryptsetup", fmt.Sprintf(`
+if [ "$1" = "luksUUID" ] && [ "$2" = "/dev/sda1" ]; then
+    echo "%s"
+    exit 0
+fi
+exit 1
+`, uuid))
+	s.AddCleanup(mock.Restore)
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyVolumeIdentity(c *C) {
+	s.sealKeyWithVolumeIdentity(c, "D0CBE8E7-1E7E-4A4C-A5B4-0AB1C0D2D6A5")
+	s.mockLUKSUUID(c, "d0cbe8e7-1e7e-4a4c-a5b4-0ab1c0d2d6a5")
+
+	options := ActivateWithTPMSealedKeyOptions{}
+	success, err := ActivateVolumeWithTPMSealedKey(s.tpm, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, true)
+	c.Check(err, IsNil)
+
+	c.Check(len(s.mockSdAskPassword.Calls()), Equals, 0)
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1"})
+}
+
+func (s *cryptTPMSuite) TestActivateVolumeWithTPMSealedKeyVolumeIdentityMismatch(c *C) {
+	// Test that the key isn't used against a different volume, and that recovery fallback works.
+	s.sealKeyWithVolumeIdentity(c, "d0cbe8e7-1e7e-4a4c-a5b4-0ab1c0d2d6a5")
+	s.mockLUKSUUID(c, "6f2e1b8c-93a4-4f0e-8d2b-7c1a5e9f3b20")
+	c.Assert(ioutil.WriteFile(s.passwordFile, []byte(strings.Join(s.recoveryKeyAscii, "-")+"\n"), 0644), IsNil)
+
+	options := ActivateWithTPMSealedKeyOptions{RecoveryKeyTries: 1}
+	success, err := ActivateVolumeWithTPMSealedKey(s.tpm, "data", "/dev/sda1", s.keyFile, nil, &options)
+	c.Check(success, Equals, true)
+	c.Assert(err, FitsTypeOf, &ActivateWithTPMSealedKeyError{})
+	c.Check(err.(*ActivateWithTPMSealedKeyError).TPMErr, Equals, ErrVolumeIdentityMismatch)
+
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	s.checkRecoveryKeyKeyringEntry(c, RecoveryKeyUsageReasonInvalidKeyFile)
+}
+
 type cryptTPMSimulatorSuite struct {
 	tpmSimulatorTestBase
 	cryptTPMTestBase
@@ -1062,6 +1227,90 @@ func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyErrorHandling7(c *C) {
 	})
 }
 
+func (s *cryptSuite) TestParseRecoveryKey(c *C) {
+	var expected RecoveryKey
+	copy(expected[:], s.recoveryKey)
+
+	key, err := ParseRecoveryKey(strings.Join(s.recoveryKeyAscii, "-"))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, expected)
+	c.Check(key.String(), Equals, strings.Join(s.recoveryKeyAscii, "-"))
+
+	key, err = ParseRecoveryKey(strings.Join(s.recoveryKeyAscii, ""))
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, expected)
+
+	_, err = ParseRecoveryKey("00000-00000")
+	c.Check(err, ErrorMatches, "incorrectly formatted \\(expected 8 groups of 5 digits\\)")
+	_, err = ParseRecoveryKey("1234")
+	c.Check(err, ErrorMatches, "incorrectly formatted \\(insufficient characters\\)")
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyValue(c *C) {
+	var key RecoveryKey
+	copy(key[:], s.recoveryKey)
+
+	c.Assert(ActivateVolumeWithRecoveryKeyValue("data", "/dev/sda1", key, nil), IsNil)
+
+	c.Check(len(s.mockSdAskPassword.Calls()), Equals, 0)
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{{"cryptsetup", "open", "--test-passphrase", "--key-file", "-", "/dev/sda1"}})
+	c.Assert(len(s.mockSdCryptsetup.Calls()), Equals, 1)
+	c.Check(s.mockSdCryptsetup.Calls()[0][0:4], DeepEquals, []string{"systemd-cryptsetup", "attach", "data", "/dev/sda1"})
+	c.Check(s.mockSdCryptsetup.Calls()[0][5], Equals, "tries=1")
+
+	// This should be done last because it may fail in some circumstances.
+	s.checkRecoveryKeyKeyringEntry(c, RecoveryKeyUsageReasonRequested)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyValueIncorrect(c *C) {
+	// Test that a wrong recovery key is distinguishable from other errors.
+	mock := testutil.MockCommand(c, "cryptsetup", "exit 2")
+	defer mock.Restore()
+
+	c.Check(ActivateVolumeWithRecoveryKeyValue("data", "/dev/sda1", RecoveryKey{}, nil), Equals, ErrRecoveryKeyIncorrect)
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 0)
+}
+
+func (s *cryptSuite) TestActivateVolumeWithRecoveryKeyValueDeviceError(c *C) {
+	mock := testutil.MockCommand(c, "cryptsetup", "echo \"Device /dev/sda1 does not exist\" >&2; exit 4")
+	defer mock.Restore()
+
+	err := ActivateVolumeWithRecoveryKeyValue("data", "/dev/sda1", RecoveryKey{}, nil)
+	c.Check(err, NotNil)
+	c.Check(err, Not(Equals), ErrRecoveryKeyIncorrect)
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 0)
+}
+
+func (s *cryptSuite) TestVerifyKeyAgainstLUKS2(c *C) {
+	ok, err := VerifyKeyAgainstLUKS2("/dev/sda1", s.tpmKey)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, true)
+
+	c.Check(s.mockCryptsetup.Calls(), DeepEquals, [][]string{{"cryptsetup", "open", "--test-passphrase", "--key-file", "-", "/dev/sda1"}})
+	key, err := ioutil.ReadFile(s.cryptsetupKey + ".1")
+	c.Assert(err, IsNil)
+	c.Check(key, DeepEquals, s.tpmKey)
+	c.Check(len(s.mockSdCryptsetup.Calls()), Equals, 0)
+}
+
+func (s *cryptSuite) TestVerifyKeyAgainstLUKS2Incorrect(c *C) {
+	mock := testutil.MockCommand(c, "cryptsetup", "exit 2")
+	defer mock.Restore()
+
+	ok, err := VerifyKeyAgainstLUKS2("/dev/sda1", s.tpmKey)
+	c.Check(err, IsNil)
+	c.Check(ok, Equals, false)
+}
+
+func (s *cryptSuite) TestVerifyKeyAgainstLUKS2Error(c *C) {
+	mock := testutil.MockCommand(c, "cryptsetup", "echo \"Device /dev/sda1 is not a valid LUKS device.\" >&2; exit 1")
+	defer mock.Restore()
+
+	ok, err := VerifyKeyAgainstLUKS2("/dev/sda1", s.tpmKey)
+	c.Check(err, ErrorMatches, "(?s).*Device /dev/sda1 is not a valid LUKS device.*")
+	c.Check(ok, Equals, false)
+}
+
 type testInitializeLUKS2ContainerData struct {
 	devicePath string
 	label      string
@@ -0,0 +1,114 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// IsPINIndexDAProtected indicates whether any of the NV indices that are used to authorize unsealing of the supplied sealed key
+// object with a PIN, passphrase or security key secret (the sealed key object's PIN NV index and any user PIN NV indices added
+// with AddUserPIN) are protected by the TPM's dictionary attack logic, by reading the TPMA_NV_NO_DA attribute from their public
+// areas. NV indices created by this package for PIN support are always protected.
+//
+// Only failed authorizations consume a dictionary attack attempt, so an index being protected doesn't mean that unsealing will
+// consume an attempt. Which operations can avoid consuming an attempt are as follows:
+//   - Unsealing a sealed key object with the correct PIN never consumes an attempt, even if the PIN NV index is protected.
+//   - Unsealing with an incorrect PIN consumes an attempt if the PIN NV index (or user PIN NV index) is protected.
+//   - Unsealing a sealed key object without a PIN uses the empty authorization value for the PIN NV index, which only fails (and
+//     consumes an attempt) if the authorization value has been changed without updating the key data file.
+//   - A PCR protection policy that doesn't match the current PCR values, a revoked policy, a missing network secret or an
+//     access lock (see LockAccessToSealedKeys) never consumes an attempt, as these are policy failures rather than authorization
+//     failures.
+//   - The network secret, single use and global lock NV indices are created with TPMA_NV_NO_DA, so they are never protected.
+//   - TPMConnection.CanLoadKey and SealedKeyObject.UnsealFromTPMWithAdminKey don't perform any authorization with a PIN NV index.
+func (t *TPMConnection) IsPINIndexDAProtected(k *SealedKeyObject) (bool, error) {
+	handles := append([]tpm2.Handle{k.data.staticPolicyData.PinIndexHandle}, k.data.userPINIndexHandles...)
+	for _, handle := range handles {
+		if handle.Type() != tpm2.HandleTypeNVIndex {
+			return false, InvalidKeyFileError{"invalid PIN NV index handle"}
+		}
+		index, err := t.CreateResourceContextFromTPM(handle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, handle):
+			return false, InvalidKeyFileError{"no PIN NV index found"}
+		case err != nil:
+			return false, xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+		}
+		pub, _, err := t.NVReadPublic(index)
+		if err != nil {
+			return false, xerrors.Errorf("cannot read public area of PIN NV index: %w", err)
+		}
+		if pub.Attrs&tpm2.AttrNVNoDA == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SelfTestUnsealOptions provides options to TPMConnection.SelfTestUnseal.
+type SelfTestUnsealOptions struct {
+	// RefuseDAConsumption indicates that the test should not proceed if it could consume a dictionary attack attempt. If this is
+	// set and any of the NV indices used to authorize unsealing of the sealed key object are protected by the TPM's dictionary
+	// attack logic according to their public areas (see TPMConnection.IsPINIndexDAProtected), a ErrWouldConsumeDAAttempt error
+	// is returned without sending any authorization to the TPM.
+	//
+	// This doesn't depend on the authorization mode hint in the key data file, which isn't protected by the TPM and may be stale.
+	// The TPM doesn't reveal whether a NV index has an authorization value, so a protected PIN NV index is refused even for a
+	// sealed key object that doesn't appear to have a PIN.
+	RefuseDAConsumption bool
+}
+
+// SelfTestUnseal checks that the supplied sealed key object can be unsealed with the supplied PIN in the TPM's current state,
+// without returning the unsealed key, which is discarded immediately. This is intended for health checks and monitoring. A nil
+// options argument is equivalent to the default options.
+//
+// Single use sealed key objects can't be tested because unsealing them revokes them, so an error will be returned for these.
+//
+// Otherwise, this returns the same errors as SealedKeyObject.UnsealFromTPM.
+func (t *TPMConnection) SelfTestUnseal(k *SealedKeyObject, pin string, options *SelfTestUnsealOptions) error {
+	if options == nil {
+		options = &SelfTestUnsealOptions{}
+	}
+
+	if k.IsSingleUse() {
+		return errors.New("cannot test a single use sealed key object")
+	}
+
+	if options.RefuseDAConsumption {
+		protected, err := t.IsPINIndexDAProtected(k)
+		if err != nil {
+			return err
+		}
+		if protected {
+			return ErrWouldConsumeDAAttempt
+		}
+	}
+
+	key, err := k.UnsealFromTPM(t, pin)
+	for i := range key {
+		key[i] = 0
+	}
+	return err
+}
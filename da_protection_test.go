@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestSelfTestUnseal(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+	defer func() {
+		if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), nil); err != nil {
+			t.Errorf("DictionaryAttackLockReset failed: %v", err)
+		}
+	}()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSelfTestUnseal_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	readLockoutCounter := func(t *testing.T) uint32 {
+		props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 1)
+		if err != nil {
+			t.Fatalf("GetCapability failed: %v", err)
+		}
+		return props[0].Value
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	protected, err := tpm.IsPINIndexDAProtected(k)
+	if err != nil {
+		t.Fatalf("IsPINIndexDAProtected failed: %v", err)
+	}
+	if !protected {
+		t.Errorf("PIN NV index should be protected by the dictionary attack logic")
+	}
+
+	t.Run("NoPIN", func(t *testing.T) {
+		if err := tpm.SelfTestUnseal(k, "", nil); err != nil {
+			t.Errorf("SelfTestUnseal failed: %v", err)
+		}
+	})
+
+	// The authorization mode hint can't be trusted, so a protected PIN NV index is refused even if the key data file claims that
+	// there is no PIN.
+	t.Run("RefuseDAConsumptionNoPIN", func(t *testing.T) {
+		if err := tpm.SelfTestUnseal(k, "", &SelfTestUnsealOptions{RefuseDAConsumption: true}); err != ErrWouldConsumeDAAttempt {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	if err := ChangePIN(tpm, keyFile, "", "1234"); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
+	}
+	staleK := k
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	t.Run("RefuseDAConsumptionStaleHint", func(t *testing.T) {
+		counter := readLockoutCounter(t)
+		if err := tpm.SelfTestUnseal(staleK, "", &SelfTestUnsealOptions{RefuseDAConsumption: true}); err != ErrWouldConsumeDAAttempt {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if readLockoutCounter(t) != counter {
+			t.Errorf("The dictionary attack counter should not have been incremented")
+		}
+	})
+
+	t.Run("RefuseDAConsumption", func(t *testing.T) {
+		counter := readLockoutCounter(t)
+		if err := tpm.SelfTestUnseal(k, "5678", &SelfTestUnsealOptions{RefuseDAConsumption: true}); err != ErrWouldConsumeDAAttempt {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if readLockoutCounter(t) != counter {
+			t.Errorf("The dictionary attack counter should not have been incremented")
+		}
+	})
+
+	t.Run("WithPIN", func(t *testing.T) {
+		if err := tpm.SelfTestUnseal(k, "1234", nil); err != nil {
+			t.Errorf("SelfTestUnseal failed: %v", err)
+		}
+	})
+
+	t.Run("WrongPIN", func(t *testing.T) {
+		counter := readLockoutCounter(t)
+		if err := tpm.SelfTestUnseal(k, "5678", nil); err != ErrPINFail {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if readLockoutCounter(t) != counter+1 {
+			t.Errorf("The dictionary attack counter should have been incremented")
+		}
+	})
+}
@@ -0,0 +1,177 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// DALockoutState describes the state of the TPM's dictionary attack protection.
+type DALockoutState struct {
+	InLockout       bool   `json:"in-lockout"`       // The TPM is in lockout mode
+	FailedTries     uint32 `json:"failed-tries"`     // The current value of the failed authorization counter (TPM_PT_LOCKOUT_COUNTER)
+	MaxTries        uint32 `json:"max-tries"`        // The number of failures before the TPM enters lockout mode (TPM_PT_MAX_AUTH_FAIL)
+	RecoveryTime    uint32 `json:"recovery-time"`    // The time in seconds to decrement the failure counter (TPM_PT_LOCKOUT_INTERVAL)
+	LockoutRecovery uint32 `json:"lockout-recovery"` // The time in seconds before lockout auth can be retried (TPM_PT_LOCKOUT_RECOVERY)
+}
+
+// Report contains non-sensitive information about the state of the TPM, suitable for inclusion in bug reports and support
+// bundles. It never contains authorization values, sealed secrets or any private key material. Each item of information is
+// obtained independently, and if an item cannot be obtained then its zero value is reported and the corresponding error field
+// contains a description of the error.
+type Report struct {
+	ProvisionStatus    ProvisionStatusAttributes `json:"provision-status"`
+	ProvisionStatusErr string                    `json:"provision-status-error,omitempty"`
+
+	// DeviceAttributes are the TPM device attributes obtained from the verified endorsement key certificate. This will be nil if
+	// the connection was not created with SecureConnectToDefaultTPM.
+	DeviceAttributes *TPMDeviceAttributes `json:"device-attributes,omitempty"`
+
+	FirmwareVersion    string `json:"firmware-version,omitempty"`
+	FirmwareVersionErr string `json:"firmware-version-error,omitempty"`
+
+	// PCRBanks are the PCR banks that currently have at least one PCR allocated.
+	PCRBanks    []tpm2.HashAlgorithmId `json:"pcr-banks,omitempty"`
+	PCRBanksErr string                 `json:"pcr-banks-error,omitempty"`
+
+	DALockout    *DALockoutState `json:"da-lockout,omitempty"`
+	DALockoutErr string          `json:"da-lockout-error,omitempty"`
+
+	// Handles are the handles managed by this package that currently exist on the TPM. This doesn't include the handles of
+	// PIN NV indices, as the locations of these are only recorded in sealed key data files.
+	Handles    []tpm2.Handle `json:"handles,omitempty"`
+	HandlesErr string        `json:"handles-error,omitempty"`
+}
+
+func readAllocatedPCRBanks(tpm *tpm2.TPMContext) ([]tpm2.HashAlgorithmId, error) {
+	pcrSelection, err := tpm.GetCapabilityPCRs()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine PCR allocation: %w", err)
+	}
+
+	var banks []tpm2.HashAlgorithmId
+	for _, s := range pcrSelection {
+		if len(s.Select) == 0 {
+			continue
+		}
+		banks = append(banks, s.Hash)
+	}
+	return banks, nil
+}
+
+func readDALockoutState(tpm *tpm2.TPMContext) (*DALockoutState, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyPermanent {
+		return nil, errors.New("TPM did not return the permanent properties")
+	}
+
+	var state DALockoutState
+	state.InLockout = tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0
+
+	props, err = tpm.GetCapabilityTPMProperties(tpm2.PropertyLockoutCounter, 4)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot fetch DA parameters: %w", err)
+	}
+	for _, prop := range props {
+		switch prop.Property {
+		case tpm2.PropertyLockoutCounter:
+			state.FailedTries = prop.Value
+		case tpm2.PropertyMaxAuthFail:
+			state.MaxTries = prop.Value
+		case tpm2.PropertyLockoutInterval:
+			state.RecoveryTime = prop.Value
+		case tpm2.PropertyLockoutRecovery:
+			state.LockoutRecovery = prop.Value
+		}
+	}
+
+	return &state, nil
+}
+
+func readManagedHandles(tpm *tpm2.TPMContext) ([]tpm2.Handle, error) {
+	var out []tpm2.Handle
+	for _, h := range []tpm2.Handle{ekHandle, srkHandle, lockNVHandle, lockNVDataHandle} {
+		handles, err := tpm.GetCapabilityHandles(h, 1)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot fetch handles from TPM: %w", err)
+		}
+		if len(handles) > 0 && handles[0] == h {
+			out = append(out, h)
+		}
+	}
+	return out, nil
+}
+
+// DiagnosticReport collects information about the state of the TPM for inclusion in bug reports and support bundles. The report
+// contains the provisioning status, the TPM device attributes from the verified endorsement key certificate, the firmware version,
+// the allocated PCR banks, the state of the dictionary attack protection and the list of handles managed by this package.
+//
+// This function will not fail if an individual item of information cannot be obtained. Instead, the corresponding error field in
+// the returned Report is set. An error is only returned if the TPM cannot be communicated with at all, in which case no information
+// can be obtained.
+//
+// No authorization values, secrets or private key material are ever included in the report, and obtaining it doesn't consume any
+// dictionary attack protection.
+func (t *TPMConnection) DiagnosticReport() (*Report, error) {
+	if err := t.Ping(); err != nil {
+		return nil, xerrors.Errorf("cannot communicate with TPM: %w", err)
+	}
+
+	report := &Report{DeviceAttributes: t.VerifiedDeviceAttributes()}
+
+	if status, err := ProvisionStatus(t); err != nil {
+		report.ProvisionStatusErr = err.Error()
+	} else {
+		report.ProvisionStatus = status
+	}
+
+	if version, err := t.FirmwareVersionString(); err != nil {
+		report.FirmwareVersionErr = err.Error()
+	} else {
+		report.FirmwareVersion = version
+	}
+
+	if banks, err := readAllocatedPCRBanks(t.TPMContext); err != nil {
+		report.PCRBanksErr = err.Error()
+	} else {
+		report.PCRBanks = banks
+	}
+
+	if state, err := readDALockoutState(t.TPMContext); err != nil {
+		report.DALockoutErr = err.Error()
+	} else {
+		report.DALockout = state
+	}
+
+	if handles, err := readManagedHandles(t.TPMContext); err != nil {
+		report.HandlesErr = err.Error()
+	} else {
+		report.Handles = handles
+	}
+
+	return report, nil
+}
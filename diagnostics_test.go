@@ -0,0 +1,102 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestDiagnosticReport(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+
+	report, err := tpm.DiagnosticReport()
+	if err != nil {
+		t.Fatalf("DiagnosticReport failed: %v", err)
+	}
+
+	for _, e := range []string{report.ProvisionStatusErr, report.FirmwareVersionErr, report.PCRBanksErr, report.DALockoutErr, report.HandlesErr} {
+		if e != "" {
+			t.Errorf("Unexpected error in report: %s", e)
+		}
+	}
+
+	if report.ProvisionStatus&(AttrValidEK|AttrValidSRK|AttrValidLockNVIndex) != AttrValidEK|AttrValidSRK|AttrValidLockNVIndex {
+		t.Errorf("Unexpected provision status: %d", report.ProvisionStatus)
+	}
+	if report.DeviceAttributes != tpm.VerifiedDeviceAttributes() {
+		t.Errorf("Unexpected device attributes")
+	}
+
+	version, err := tpm.FirmwareVersionString()
+	if err != nil {
+		t.Fatalf("FirmwareVersionString failed: %v", err)
+	}
+	if report.FirmwareVersion != version {
+		t.Errorf("Unexpected firmware version: %s", report.FirmwareVersion)
+	}
+
+	foundSHA256 := false
+	for _, alg := range report.PCRBanks {
+		if alg == tpm2.HashAlgorithmSHA256 {
+			foundSHA256 = true
+		}
+	}
+	if !foundSHA256 {
+		t.Errorf("Expected SHA-256 PCR bank to be reported (got %v)", report.PCRBanks)
+	}
+
+	if report.DALockout == nil {
+		t.Fatalf("Expected DA lockout state")
+	}
+	if report.DALockout.InLockout {
+		t.Errorf("TPM should not be in lockout mode")
+	}
+	if report.DALockout.MaxTries != 32 || report.DALockout.RecoveryTime != 7200 || report.DALockout.LockoutRecovery != 86400 {
+		t.Errorf("Unexpected DA parameters: %+v", report.DALockout)
+	}
+
+	expectedHandles := map[tpm2.Handle]bool{EkHandle: true, SrkHandle: true, LockNVHandle: true, LockNVDataHandle: true}
+	if len(report.Handles) != len(expectedHandles) {
+		t.Errorf("Unexpected handles: %v", report.Handles)
+	}
+	for _, h := range report.Handles {
+		if !expectedHandles[h] {
+			t.Errorf("Unexpected handle: %v", h)
+		}
+	}
+
+	if _, err := json.Marshal(report); err != nil {
+		t.Errorf("Cannot serialize report: %v", err)
+	}
+}
@@ -27,7 +27,8 @@ import (
 )
 
 const (
-	bootManagerCodePCR = 4 // Boot Manager Code and Boot Attempts PCR
+	platformFirmwarePCR = 0 // SRTM, POST BIOS, and Embedded Drivers PCR
+	bootManagerCodePCR  = 4 // Boot Manager Code and Boot Attempts PCR
 
 	certTableIndex = 4 // Index of the Certificate Table entry in the Data Directory of a PE image optional header
 )
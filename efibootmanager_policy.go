@@ -25,7 +25,6 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"os"
 	"sort"
 
 	"github.com/canonical/go-tpm2"
@@ -256,13 +255,9 @@ type EFIBootManagerProfileParams struct {
 // even if the successful boot attempt is of a sequence of binaries included in this PCR profile.
 func AddEFIBootManagerProfile(profile *PCRProtectionProfile, params *EFIBootManagerProfileParams) error {
 	// Load event log
-	eventLog, err := os.Open(eventLogPath)
+	log, err := openEventLog()
 	if err != nil {
-		return xerrors.Errorf("cannot open TCG event log: %w", err)
-	}
-	log, err := tcglog.NewLog(eventLog, tcglog.LogOptions{})
-	if err != nil {
-		return xerrors.Errorf("cannot parse TCG event log header: %w", err)
+		return err
 	}
 
 	if !log.Algorithms.Contains(tcglog.AlgorithmId(params.PCRAlgorithm)) {
@@ -0,0 +1,205 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const ekPublicHeader uint32 = 0x55534b45
+
+// ReadEKPublic reads an endorsement key public area previously serialized with WriteEKPublic from the supplied io.Reader. The
+// returned public area can be passed to TPMConnection.VerifyEK.
+func ReadEKPublic(r io.Reader) (*tpm2.Public, error) {
+	var header uint32
+	if _, err := tpm2.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != ekPublicHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var pub *tpm2.Public
+	if _, err := tpm2.UnmarshalFromReader(r, &pub); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal public area: %w", err)
+	}
+	if pub == nil {
+		return nil, errors.New("no public area")
+	}
+	return pub, nil
+}
+
+// WriteEKPublic serializes the supplied endorsement key public area to w, so that it can be recorded (eg, at enrollment time) and
+// later read back with ReadEKPublic in order to verify that the TPM hasn't been replaced.
+func WriteEKPublic(w io.Writer, pub *tpm2.Public) error {
+	if pub == nil {
+		return errors.New("no public area provided")
+	}
+	if _, err := tpm2.MarshalToWriter(w, ekPublicHeader, pub); err != nil {
+		return xerrors.Errorf("cannot marshal public area: %w", err)
+	}
+	return nil
+}
+
+// withEndorsementKey runs the supplied function with a ResourceContext for the TPM's endorsement key. If there isn't a persistent
+// endorsement key, a transient one is created from the EK template for this connection and flushed afterwards.
+func (t *TPMConnection) withEndorsementKey(fn func(ek tpm2.ResourceContext) error) error {
+	if t.ek != nil {
+		return fn(t.ek)
+	}
+
+	ek, err := t.CreateResourceContextFromTPM(ekHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, ekHandle):
+		ek, err = createTransientEk(t.TPMContext, t.endorsementKeyTemplate())
+		switch {
+		case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+			return AuthFailError{tpm2.HandleEndorsement}
+		case err != nil:
+			return xerrors.Errorf("cannot create transient endorsement key: %w", err)
+		}
+		defer t.FlushContext(ek)
+	case err != nil:
+		return xerrors.Errorf("cannot create context for endorsement key: %w", err)
+	default:
+		ok, err := isObjectPrimaryKeyWithTemplate(t.TPMContext, t.EndorsementHandleContext(), ek, t.endorsementKeyTemplate(), nil)
+		switch {
+		case err != nil:
+			return xerrors.Errorf("cannot determine if object is a primary key in the endorsement hierarchy: %w", err)
+		case !ok:
+			return ErrTPMProvisioning
+		}
+	}
+
+	return fn(ek)
+}
+
+// EndorsementKeyPublic returns the public area of the TPM's endorsement key. If there isn't a persistent endorsement key, a
+// transient one is created from the standard template, which requires knowledge of the authorization value for the endorsement
+// hierarchy. This can be recorded with WriteEKPublic at enrollment time for subsequent verification with TPMConnection.VerifyEK.
+//
+// If the object at the persistent handle reserved for the endorsement key isn't a valid endorsement key, a ErrTPMProvisioning error
+// will be returned.
+//
+// If a transient endorsement key needs to be created and the authorization value for the endorsement hierarchy is incorrect, a
+// AuthFailError error will be returned.
+func (t *TPMConnection) EndorsementKeyPublic() (*tpm2.Public, error) {
+	var pub *tpm2.Public
+	if err := t.withEndorsementKey(func(ek tpm2.ResourceContext) error {
+		p, _, _, err := t.ReadPublic(ek)
+		if err != nil {
+			return xerrors.Errorf("cannot read public area of endorsement key: %w", err)
+		}
+		pub = p
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return pub, nil
+}
+
+// VerifyEK verifies that the TPM has the expected endorsement key, which would normally have been recorded with
+// TPMConnection.EndorsementKeyPublic and WriteEKPublic when a key was enrolled. This provides a way to detect that the TPM or
+// motherboard has been replaced that is independent of the endorsement key certificate, which is useful on devices that don't have
+// one.
+//
+// As well as checking that the name of the endorsement key on the TPM matches the name of the expected public area, this performs a
+// proof-of-ownership check by creating a session that is salted with a value protected by the endorsement key, and using it to
+// integrity protect a command. Only the TPM with the private part of the expected endorsement key can complete this check.
+//
+// If the TPM's endorsement key doesn't match, or the proof-of-ownership check fails, a ErrTPMChanged error will be returned.
+//
+// If the object at the persistent handle reserved for the endorsement key isn't a valid endorsement key, a ErrTPMProvisioning error
+// will be returned.
+func (t *TPMConnection) VerifyEK(expected tpm2.Public) error {
+	expectedName, err := expected.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of expected endorsement key: %w", err)
+	}
+
+	return t.withEndorsementKey(func(ek tpm2.ResourceContext) error {
+		// go-tpm2 cross-checks that the name and public area returned from TPM2_ReadPublic match when initializing the
+		// ResourceContext, so comparing names is sufficient here.
+		if !bytes.Equal(ek.Name(), expectedName) {
+			return ErrTPMChanged
+		}
+
+		symmetric := tpm2.SymDef{
+			Algorithm: tpm2.SymAlgorithmAES,
+			KeyBits:   tpm2.SymKeyBitsU{Data: uint16(128)},
+			Mode:      tpm2.SymModeU{Data: tpm2.SymModeCFB}}
+		session, err := t.StartAuthSession(ek, nil, tpm2.SessionTypeHMAC, &symmetric, defaultSessionHashAlgorithm)
+		if err != nil {
+			return xerrors.Errorf("cannot create HMAC session: %w", err)
+		}
+		defer t.FlushContext(session)
+
+		if _, err := t.GetRandom(20, session.WithAttrs(tpm2.AttrContinueSession|tpm2.AttrAudit)); err != nil {
+			if isAuthFailError(err, tpm2.CommandGetRandom, 1) {
+				return ErrTPMChanged
+			}
+			return xerrors.Errorf("cannot execute command to complete endorsement key proof of ownership check: %w", err)
+		}
+		return nil
+	})
+}
+
+// VerifyEKCertMatchesTPM verifies that the supplied DER encoded endorsement key certificate was issued for the TPM associated with the
+// supplied connection, by creating a transient endorsement key from the standard template and checking that its public key matches
+// the one in the certificate. The transient endorsement key is flushed before this function returns. This doesn't modify any
+// persistent state on the TPM, and works on a TPM that hasn't been provisioned with ProvisionTPM. It doesn't verify that the
+// certificate was issued by a trusted CA.
+//
+// This requires knowledge of the authorization value for the endorsement hierarchy. If it is incorrect, a AuthFailError error will
+// be returned.
+//
+// If the public key in the certificate doesn't match the TPM's endorsement key, a EKCertificateMismatchError error will be returned.
+func VerifyEKCertMatchesTPM(tpm *TPMConnection, certDER []byte) error {
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return xerrors.Errorf("cannot parse certificate: %w", err)
+	}
+	if cert.PublicKeyAlgorithm != x509.RSA {
+		return EKCertificateMismatchError{"the certificate does not contain a RSA public key"}
+	}
+
+	template := tpm.endorsementKeyTemplate()
+	ek, err := createTransientEk(tpm.TPMContext, template)
+	switch {
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		return AuthFailError{tpm2.HandleEndorsement}
+	case err != nil:
+		return xerrors.Errorf("cannot create transient endorsement key: %w", err)
+	}
+	defer tpm.FlushContext(ek)
+
+	if err := verifyEk(cert, ek, template); err != nil {
+		return EKCertificateMismatchError{err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestVerifyEK(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	pub, err := tpm.EndorsementKeyPublic()
+	if err != nil {
+		t.Fatalf("EndorsementKeyPublic failed: %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteEKPublic(buf, pub); err != nil {
+		t.Fatalf("WriteEKPublic failed: %v", err)
+	}
+	data := buf.Bytes()
+
+	t.Run("Match", func(t *testing.T) {
+		expected, err := ReadEKPublic(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("ReadEKPublic failed: %v", err)
+		}
+		if err := tpm.VerifyEK(*expected); err != nil {
+			t.Errorf("VerifyEK failed: %v", err)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		expected, err := ReadEKPublic(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("ReadEKPublic failed: %v", err)
+		}
+		expected.Unique.RSA()[0] ^= 0xff
+		if err := tpm.VerifyEK(*expected); err != ErrTPMChanged {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidData", func(t *testing.T) {
+		if _, err := ReadEKPublic(bytes.NewReader(data[1:])); err == nil {
+			t.Errorf("ReadEKPublic should have failed")
+		}
+	})
+}
+
+func TestVerifyEKCertMatchesTPM(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if testEkCert == nil {
+		t.SkipNow()
+	}
+
+	t.Run("Match", func(t *testing.T) {
+		if err := VerifyEKCertMatchesTPM(tpm, testEkCert); err != nil {
+			t.Errorf("VerifyEKCertMatchesTPM failed: %v", err)
+		}
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		cert, err := createTestEkCertWithAttributes(testCACert, testCAKey, pkix.Name{}, nil)
+		if err != nil {
+			t.Fatalf("createTestEkCertWithAttributes failed: %v", err)
+		}
+		err = VerifyEKCertMatchesTPM(tpm, cert)
+		if _, ok := err.(EKCertificateMismatchError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidCert", func(t *testing.T) {
+		if err := VerifyEKCertMatchesTPM(tpm, testEkCert[1:]); err == nil {
+			t.Errorf("VerifyEKCertMatchesTPM should have failed")
+		}
+	})
+
+	t.Run("NoPersistentObjects", func(t *testing.T) {
+		before, err := tpm.GetCapabilityHandles(tpm2.HandleTypePersistent.BaseHandle(), tpm2.CapabilityMaxProperties)
+		if err != nil {
+			t.Fatalf("GetCapabilityHandles failed: %v", err)
+		}
+		if err := VerifyEKCertMatchesTPM(tpm, testEkCert); err != nil {
+			t.Errorf("VerifyEKCertMatchesTPM failed: %v", err)
+		}
+		after, err := tpm.GetCapabilityHandles(tpm2.HandleTypePersistent.BaseHandle(), tpm2.CapabilityMaxProperties)
+		if err != nil {
+			t.Fatalf("GetCapabilityHandles failed: %v", err)
+		}
+		if !reflect.DeepEqual(before, after) {
+			t.Errorf("VerifyEKCertMatchesTPM modified the persistent handles")
+		}
+		transient, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+		if err != nil {
+			t.Fatalf("GetCapabilityHandles failed: %v", err)
+		}
+		if len(transient) > 0 {
+			t.Errorf("VerifyEKCertMatchesTPM didn't flush the transient endorsement key")
+		}
+	})
+}
@@ -22,6 +22,7 @@ package secboot
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/canonical/go-tpm2"
 
@@ -33,6 +34,15 @@ var (
 	// the Physical Presence Interface.
 	ErrTPMClearRequiresPPI = errors.New("clearing the TPM requires the use of the Physical Presence Interface")
 
+	// ErrProvisioningNotConfirmed is returned from ProvisionTPM if the requested operation would clear the TPM or modify a TPM
+	// that has already been provisioned by this package, and the caller didn't acknowledge the possible loss of data.
+	ErrProvisioningNotConfirmed = errors.New("provisioning could result in data loss and has not been confirmed by the caller")
+
+	// ErrNoRecordedPCRValues is returned from UpdateKeyPCRProtectionPolicyIncremental if the sealed key file doesn't record the
+	// PCR values for each branch of its PCR protection policy, which is the case if it wasn't created with the
+	// AllowIncrementalPCRPolicyUpdates field of KeyCreationParams set.
+	ErrNoRecordedPCRValues = errors.New("the sealed key file does not record the PCR values for its PCR protection policy")
+
 	// ErrTPMProvisioning indicates that the TPM is not provisioned correctly for the requested operation. Please note that other errors
 	// that can be returned may also be caused by incomplete provisioning, as it is not always possible to detect incomplete or
 	// incorrect provisioning in all contexts.
@@ -52,6 +62,124 @@ var (
 
 	// ErrNoTPM2Device is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if no TPM2 device is avaiable.
 	ErrNoTPM2Device = errors.New("no TPM2 device is available")
+
+	// ErrTPMFailure is returned from ConnectToDefaultTPM, SecureConnectToDefaultTPM or TPMConnection.RunSelfTest if the TPM is in
+	// failure mode because of a failed self test or some other internal error. In this mode, the TPM will only execute
+	// TPM2_GetTestResult and TPM2_GetCapability, and cannot be used for any other purpose.
+	ErrTPMFailure = errors.New("the TPM is in failure mode")
+
+	// ErrTPMDisabled is returned from ConnectToDefaultTPM or SecureConnectToDefaultTPM if a TPM2 device is present but it has not
+	// been started by the platform firmware, which is normally the case when the TPM has been disabled in the firmware settings. In
+	// this case, the TPM needs to be enabled in the firmware setup before it can be used. This is distinct from the case where the
+	// platform firmware has only disabled the storage and endorsement hierarchies, which is detected by TPMConnection.IsEnabled.
+	ErrTPMDisabled = errors.New("the TPM has not been started by the platform firmware (it may be disabled in the firmware settings)")
+
+	// ErrTPMChanged is returned from TPMConnection.VerifyEK if the endorsement key of the TPM does not match the expected endorsement
+	// key, which indicates that the TPM has been replaced.
+	ErrTPMChanged = errors.New("the TPM does not have the expected endorsement key")
+
+	// ErrNoACPITPM2Table is returned from ReadACPITPM2Table if the platform does not provide an ACPI TPM2 table.
+	ErrNoACPITPM2Table = errors.New("no ACPI TPM2 table is available")
+
+	// ErrNoAdminOverride is returned from SealedKeyObject.UnsealFromTPMWithAdminKey if the sealed key object was not created with an
+	// admin override key.
+	ErrNoAdminOverride = errors.New("the sealed key object does not have an admin override")
+
+	// ErrAdminAuthFail is returned from SealedKeyObject.UnsealFromTPMWithAdminKey if the supplied key is not the sealed key
+	// object's admin override key.
+	ErrAdminAuthFail = errors.New("the supplied key is not the admin override key for the sealed key object")
+
+	// ErrPolicySessionNotSatisfied is returned from SealedKeyObject.UnsealFromTPMWithSession if the supplied policy session does not
+	// satisfy the authorization policy of the sealed key object.
+	ErrPolicySessionNotSatisfied = errors.New("the supplied policy session does not satisfy the authorization policy of the sealed key object")
+
+	// ErrPhysicalPresenceRequired is returned from SealedKeyObject.UnsealFromTPM if the sealed key object requires physical presence
+	// and physical presence has not been asserted to the TPM by the platform.
+	ErrPhysicalPresenceRequired = errors.New("physical presence must be asserted to the TPM in order to unseal the sealed key object")
+
+	// ErrNoNVCounterSupport is returned from SealKeyToTPM if the TPM does not support NV counter indices, which are required for PIN
+	// support and for revoking old PCR protection policies.
+	ErrNoNVCounterSupport = errors.New("the TPM does not support NV counter indices")
+
+	// ErrReadOnlyConnection is returned (wrapped) when a command that could modify the state of the TPM is attempted on a
+	// connection created with ConnectToDefaultTPMReadOnly.
+	ErrReadOnlyConnection = errors.New("the command is not permitted on a read-only connection")
+
+	// ErrTPMFirmwareVersionTooOld is returned from SealedKeyObject.UnsealFromTPM if the sealed key object was created with the
+	// MinFirmwareVersion field of KeyCreationParams set and the firmware version reported by the TPM is older than this.
+	ErrTPMFirmwareVersionTooOld = errors.New("the TPM firmware version is older than the minimum required by the sealed key object")
+
+	// ErrNetworkSecretRequired is returned from SealedKeyObject.UnsealFromTPM and SealedKeyObject.UnsealFromTPMWithNetworkSecret
+	// if the sealed key object is network-bound and no secret from the remote service was supplied.
+	ErrNetworkSecretRequired = errors.New("the sealed key object requires a secret from a remote service in order to unseal it")
+
+	// ErrNetworkSecretFail is returned from SealedKeyObject.UnsealFromTPMWithNetworkSecret if the supplied secret from the remote
+	// service is incorrect.
+	ErrNetworkSecretFail = errors.New("the provided network secret is incorrect")
+
+	// ErrNoVerifiedEKCertChain is returned from TPMConnection.ExportVerifiedEKCertChainPEM if the endorsement key certificate
+	// chain was not verified when the connection was created, which is the case if it wasn't created with
+	// SecureConnectToDefaultTPM.
+	ErrNoVerifiedEKCertChain = errors.New("no endorsement key certificate chain was verified for this connection")
+
+	// ErrUserPINRequired is returned from SealedKeyObject.UnsealFromTPM if the sealed key object has user PINs, in which case it
+	// must be unsealed with SealedKeyObject.UnsealFromTPMWithUserPIN.
+	ErrUserPINRequired = errors.New("the sealed key object must be unsealed with a user PIN")
+
+	// ErrRecoveryKeyIncorrect is returned from ActivateVolumeWithRecoveryKeyValue if the supplied recovery key does not unlock any
+	// keyslot of the LUKS2 container.
+	ErrRecoveryKeyIncorrect = errors.New("the supplied recovery key is incorrect")
+
+	// ErrSingleUseKeyConsumed is returned from SealedKeyObject.UnsealFromTPM and other unseal functions if the sealed key object
+	// was created with the SingleUseIndexHandle field of KeyCreationParams set and it has already been unsealed.
+	ErrSingleUseKeyConsumed = errors.New("the single use sealed key object has already been unsealed")
+
+	// ErrTPMClearRequired is returned from CheckProvisionPreconditions if the TPM cannot be provisioned in the requested mode
+	// without clearing it first, because the authorization value for the storage or endorsement hierarchy has been set and the
+	// supplied value is incorrect.
+	ErrTPMClearRequired = errors.New("the TPM must be cleared before it can be provisioned")
+
+	// ErrTPMClearDisabled is returned from CheckProvisionPreconditions if the TPM needs to be cleared, but clearing it with
+	// TPM2_Clear has been disabled. In this case, the TPM can only be cleared using the physical presence interface or the platform
+	// firmware settings.
+	ErrTPMClearDisabled = errors.New("the TPM must be cleared but clearing it from the OS has been disabled (it must be cleared " +
+		"using the physical presence interface or in the firmware settings)")
+
+	// ErrVolumeIdentityMismatch is returned from ActivateVolumeWithTPMSealedKey and ActivateVolumeWithTPMSealedKeyFromLUKS2Token
+	// (wrapped in a *ActivateWithTPMSealedKeyError) if the sealed key object is bound to the identity of a different volume to the
+	// one being activated.
+	ErrVolumeIdentityMismatch = errors.New("the sealed key object is bound to a different volume")
+
+	// ErrKeyFileCorrupt is returned from SealedKeyObject.UnsealFromTPM and other functions that load a sealed key object in to the
+	// TPM if the object loads successfully but its authorization policy is inconsistent with the policy metadata stored in the key
+	// file. This indicates that the key file has been corrupted or tampered with.
+	ErrKeyFileCorrupt = errors.New("the sealed key object's authorization policy is inconsistent with its metadata")
+
+	// ErrUnsupportedTPMVendor is returned from SecureConnectToDefaultTPMWithOptions if the AllowedManufacturers field of
+	// SecureConnectOptions is set and the manufacturer obtained from the verified endorsement key certificate is not in it.
+	ErrUnsupportedTPMVendor = errors.New("the TPM manufacturer is not supported")
+
+	// ErrWouldConsumeDAAttempt is returned from TPMConnection.SelfTestUnseal if the RefuseDAConsumption field of
+	// SelfTestUnsealOptions is set and the sealed key object requires authorization with a NV index that is protected by the TPM's
+	// dictionary attack logic, so an incorrect PIN would consume a dictionary attack attempt.
+	ErrWouldConsumeDAAttempt = errors.New("unsealing the sealed key object could consume a dictionary attack attempt")
+
+	// ErrNVIndexRequiresPlatformAuth is returned from TPMConnection.UndefineNVIndex if the NV index was created by the platform
+	// and can't be undefined because the platform hierarchy is disabled or its authorization value is not known.
+	ErrNVIndexRequiresPlatformAuth = errors.New("the NV index was created by the platform and requires platform hierarchy " +
+		"authorization to undefine")
+
+	// ErrOwnerHierarchyDisabled is returned from SealedKeyObject.UnsealFromTPM and other functions that load a sealed key object
+	// if the owner (storage) hierarchy of the TPM has been disabled, which could be a sign of tampering. Unsealing whilst it is
+	// disabled is prevented by the TPM, as the storage root key and the NV indices that the authorization policy of every sealed
+	// key object depends on are inaccessible.
+	ErrOwnerHierarchyDisabled = errors.New("the owner hierarchy of the TPM is disabled")
+
+	// ErrSRKTemplateAuthorizationRequired is returned from SealKeyToTPM and other functions that create objects in the storage
+	// hierarchy if the storage root key was provisioned with a template authorization policy (see the SRKTemplatePolicyKey field of
+	// ProvisionParams), and either the key required to authorize the template of the new object was not supplied, or the
+	// function doesn't support creating objects under such a storage root key.
+	ErrSRKTemplateAuthorizationRequired = errors.New("creating objects under the storage root key requires an authorized template")
 )
 
 // TPMResourceExistsError is returned from any function that creates a persistent TPM resource if a resource already exists
@@ -64,6 +192,18 @@ func (e TPMResourceExistsError) Error() string {
 	return fmt.Sprintf("a resource already exists on the TPM at handle %v", e.Handle)
 }
 
+// PersistentHandleInUseError is returned from ProvisionTPM and any other function that creates a persistent primary key if there is
+// already an object persisted at the handle required for the key, and that object doesn't look like it was created by this package.
+// The object may belong to another application. The name of the conflicting object is provided.
+type PersistentHandleInUseError struct {
+	Handle tpm2.Handle
+	Name   tpm2.Name
+}
+
+func (e PersistentHandleInUseError) Error() string {
+	return fmt.Sprintf("the persistent handle %v is in use by another object with name %x", e.Handle, e.Name)
+}
+
 // AuthFailError is returned when an authorization check fails. The provided handle indicates the resource for which authorization
 // failed. Whilst the error normally indicates that the provided authorization value is incorrect, it may also be returned
 // for other reasons that would cause a HMAC check failure, such as a communication failure between the host CPU and the TPM
@@ -125,6 +265,26 @@ func isInvalidKeyFileError(err error) bool {
 	return xerrors.As(err, &e)
 }
 
+// PINIndexVerificationError is returned from TPMConnection.VerifyPINIndex if the NV index used for PIN support by a sealed key object
+// doesn't have the expected properties, which may indicate that it has been recreated with weaker protection.
+type PINIndexVerificationError struct {
+	msg string
+}
+
+func (e PINIndexVerificationError) Error() string {
+	return fmt.Sprintf("cannot verify the PIN NV index: %s", e.msg)
+}
+
+// EKCertificateMismatchError is returned from VerifyEKCertMatchesTPM if the supplied endorsement key certificate was not issued for
+// the endorsement key of the TPM.
+type EKCertificateMismatchError struct {
+	msg string
+}
+
+func (e EKCertificateMismatchError) Error() string {
+	return fmt.Sprintf("the endorsement key certificate does not match the TPM: %s", e.msg)
+}
+
 // LockAccessToSealedKeysError is returned from ActivateVolumeWithTPMSealedKey if an error occurred whilst trying to lock access
 // to sealed keys created by this package.
 type LockAccessToSealedKeysError string
@@ -149,3 +309,42 @@ func (e *ActivateWithTPMSealedKeyError) Error() string {
 	}
 	return fmt.Sprintf("cannot activate with TPM sealed key (%v) but activation with recovery key was successful", e.TPMErr)
 }
+
+// InvalidKeyCreationParamsError is returned from KeyCreationParams.Validate and SealKeyToTPM if the supplied KeyCreationParams are
+// invalid. It contains a description of every problem that was detected.
+type InvalidKeyCreationParamsError struct {
+	Problems []string
+}
+
+func (e InvalidKeyCreationParamsError) Error() string {
+	return strings.Join(e.Problems, "; ")
+}
+
+// SingleUseRevocationError is returned from SealedKeyObject.UnsealFromTPM and other unseal functions along with the unsealed key if
+// the sealed key object was created with the SingleUseIndexHandle field of KeyCreationParams set and it was unsealed successfully,
+// but the NV counter index that revokes it could not be incremented. In this case, the sealed key object may still be usable.
+type SingleUseRevocationError struct {
+	err error
+}
+
+func (e SingleUseRevocationError) Error() string {
+	return "cannot revoke single use sealed key object: " + e.err.Error()
+}
+
+func (e SingleUseRevocationError) Unwrap() error {
+	return e.err
+}
+
+// EKCertChainRejectedError is returned from SecureConnectToDefaultTPMWithOptions if the verified endorsement key certificate chain
+// was rejected by the ApproveEKCertChain callback of SecureConnectOptions. The error returned from the callback is wrapped.
+type EKCertChainRejectedError struct {
+	err error
+}
+
+func (e EKCertChainRejectedError) Error() string {
+	return "the endorsement key certificate chain was rejected: " + e.err.Error()
+}
+
+func (e EKCertChainRejectedError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,328 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// Types for the top-level TLV fields of a record in a log in the TCG Canonical Event Log (CEL) format, see section 5 of the
+// "TCG Canonical Event Log Format" specification.
+const (
+	celTypeRecnum      uint8 = 0
+	celTypePCR         uint8 = 1
+	celTypeNVIndex     uint8 = 2
+	celTypeDigests     uint8 = 3
+	celTypeMgt         uint8 = 4
+	celTypePCClientStd uint8 = 5
+	celTypeIMATemplate uint8 = 7
+	celTypeIMATLV      uint8 = 8
+)
+
+// Types for the fields of the content of a pcclient_std record.
+const (
+	celPCClientStdType    uint8 = 0
+	celPCClientStdContent uint8 = 1
+)
+
+// maxCELValueLength is the maximum length of the value of a TLV field in a CEL log. This is much larger than any legitimate event
+// data, and exists to avoid allocating an arbitrary amount of memory when decoding a corrupt log.
+const maxCELValueLength = 16 * 1024 * 1024
+
+// specIdEventSignature is the signature of the TCG_EfiSpecIDEvent structure that appears in the header of a crypto-agile TCG
+// event log.
+var specIdEventSignature = []byte("Spec ID Event03\x00")
+
+// celTLV corresponds to a single TLV field in a CEL log.
+type celTLV struct {
+	typ   uint8
+	value []byte
+}
+
+// readCELTLV reads a single TLV field from the supplied CEL log. The length of the value is checked against the remaining input
+// if this can be determined from the supplied reader, and against maxCELValueLength otherwise, before the value is allocated.
+func readCELTLV(r io.Reader) (*celTLV, error) {
+	var hdr struct {
+		Type   uint8
+		Length uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+	if lr, ok := r.(interface{ Len() int }); ok && int64(hdr.Length) > int64(lr.Len()) {
+		return nil, fmt.Errorf("value length (%d bytes) exceeds the remaining input (%d bytes)", hdr.Length, lr.Len())
+	}
+	if hdr.Length > maxCELValueLength {
+		return nil, fmt.Errorf("value length (%d bytes) is too large", hdr.Length)
+	}
+	value := make([]byte, hdr.Length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, xerrors.Errorf("cannot read value: %w", err)
+	}
+	return &celTLV{typ: hdr.Type, value: value}, nil
+}
+
+func readCELTLVs(data []byte) ([]*celTLV, error) {
+	r := bytes.NewReader(data)
+	var out []*celTLV
+	for r.Len() > 0 {
+		tlv, err := readCELTLV(r)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, tlv)
+	}
+	return out, nil
+}
+
+// uint returns the value of this TLV field decoded as a big-endian unsigned integer of up to 8 bytes.
+func (t *celTLV) uint() (uint64, error) {
+	if len(t.value) == 0 || len(t.value) > 8 {
+		return 0, fmt.Errorf("invalid integer length (%d bytes)", len(t.value))
+	}
+	var v uint64
+	for _, b := range t.value {
+		v = (v << 8) | uint64(b)
+	}
+	return v, nil
+}
+
+// celEvent corresponds to a pcclient_std record in a CEL log.
+type celEvent struct {
+	recnum    uint64
+	pcr       uint32
+	eventType tcglog.EventType
+	digests   map[tpm2.HashAlgorithmId]tpm2.Digest
+	data      []byte
+}
+
+// readCELEvent reads the next record from the supplied CEL log. Records that aren't pcclient_std records, and records that aren't
+// associated with a PCR, are skipped.
+func readCELEvent(r io.Reader) (*celEvent, error) {
+	for {
+		recnumField, err := readCELTLV(r)
+		if err != nil {
+			if err == io.EOF {
+				return nil, err
+			}
+			return nil, xerrors.Errorf("cannot read record number field: %w", err)
+		}
+		if recnumField.typ != celTypeRecnum {
+			return nil, fmt.Errorf("unexpected field type %d (expected record number)", recnumField.typ)
+		}
+		recnum, err := recnumField.uint()
+		if err != nil {
+			return nil, xerrors.Errorf("invalid record number: %w", err)
+		}
+
+		var fields [3]*celTLV
+		for i := range fields {
+			f, err := readCELTLV(r)
+			if err != nil {
+				return nil, xerrors.Errorf("cannot read field for record %d: %w", recnum, unexpectedEOF(err))
+			}
+			fields[i] = f
+		}
+		handleField, digestsField, contentField := fields[0], fields[1], fields[2]
+
+		switch handleField.typ {
+		case celTypePCR:
+		case celTypeNVIndex:
+			// Measurements to NV indices aren't relevant to PCR profile generation.
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected field type %d for record %d (expected PCR or NV index)", handleField.typ, recnum)
+		}
+		pcr, err := handleField.uint()
+		if err != nil || pcr > 0xffffffff {
+			return nil, fmt.Errorf("invalid PCR for record %d", recnum)
+		}
+
+		if digestsField.typ != celTypeDigests {
+			return nil, fmt.Errorf("unexpected field type %d for record %d (expected digests)", digestsField.typ, recnum)
+		}
+		digestFields, err := readCELTLVs(digestsField.value)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode digests for record %d: %w", recnum, unexpectedEOF(err))
+		}
+		digests := make(map[tpm2.HashAlgorithmId]tpm2.Digest)
+		for _, d := range digestFields {
+			alg := tpm2.HashAlgorithmId(d.typ)
+			if !alg.Supported() || len(d.value) != alg.Size() {
+				return nil, fmt.Errorf("invalid digest for record %d", recnum)
+			}
+			digests[alg] = d.value
+		}
+
+		switch contentField.typ {
+		case celTypePCClientStd:
+		case celTypeMgt, celTypeIMATemplate, celTypeIMATLV:
+			// Management records and records produced by IMA aren't relevant to PCR profile generation.
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected content type %d for record %d", contentField.typ, recnum)
+		}
+		contentFields, err := readCELTLVs(contentField.value)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode content for record %d: %w", recnum, unexpectedEOF(err))
+		}
+		if len(contentFields) != 2 || contentFields[0].typ != celPCClientStdType || contentFields[1].typ != celPCClientStdContent {
+			return nil, fmt.Errorf("invalid content for record %d", recnum)
+		}
+		eventType, err := contentFields[0].uint()
+		if err != nil || eventType > 0xffffffff {
+			return nil, fmt.Errorf("invalid event type for record %d", recnum)
+		}
+
+		return &celEvent{
+			recnum:    recnum,
+			pcr:       uint32(pcr),
+			eventType: tcglog.EventType(eventType),
+			digests:   digests,
+			data:      contentFields[1].value}, nil
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// convertCELLogToTCGLog decodes the supplied log in the CEL format and re-encodes the PC Client events in it in the crypto-agile
+// TCG log format, with a synthesized header that describes the digest algorithms present in the log. This allows the PCR profile
+// generation code to consume events from both formats via the same representation.
+func convertCELLogToTCGLog(r io.Reader) ([]byte, error) {
+	var events []*celEvent
+	algs := make(map[tpm2.HashAlgorithmId]bool)
+	for {
+		event, err := readCELEvent(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+		for alg := range event.digests {
+			algs[alg] = true
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New("no PC Client events")
+	}
+
+	var sortedAlgs []tpm2.HashAlgorithmId
+	for alg := range algs {
+		sortedAlgs = append(sortedAlgs, alg)
+	}
+	sort.Slice(sortedAlgs, func(i, j int) bool { return sortedAlgs[i] < sortedAlgs[j] })
+
+	w := new(bytes.Buffer)
+
+	// Write the header, which is a TCG_PCClientPCREvent containing a TCG_EfiSpecIDEvent structure.
+	specId := new(bytes.Buffer)
+	specId.Write(specIdEventSignature)
+	binary.Write(specId, binary.LittleEndian, uint32(0)) // platformClass
+	specId.Write([]byte{0, 2, 0, 2})                     // specVersionMinor, specVersionMajor, specErrata, uintnSize
+	binary.Write(specId, binary.LittleEndian, uint32(len(sortedAlgs)))
+	for _, alg := range sortedAlgs {
+		binary.Write(specId, binary.LittleEndian, uint16(alg))
+		binary.Write(specId, binary.LittleEndian, uint16(alg.Size()))
+	}
+	specId.WriteByte(0) // vendorInfoSize
+
+	binary.Write(w, binary.LittleEndian, uint32(0))
+	binary.Write(w, binary.LittleEndian, uint32(tcglog.EventTypeNoAction))
+	w.Write(make([]byte, 20))
+	binary.Write(w, binary.LittleEndian, uint32(specId.Len()))
+	w.Write(specId.Bytes())
+
+	// Write each event as a TCG_PCR_EVENT2 structure.
+	for _, event := range events {
+		binary.Write(w, binary.LittleEndian, event.pcr)
+		binary.Write(w, binary.LittleEndian, uint32(event.eventType))
+		binary.Write(w, binary.LittleEndian, uint32(len(sortedAlgs)))
+		for _, alg := range sortedAlgs {
+			digest, ok := event.digests[alg]
+			if !ok {
+				if event.eventType != tcglog.EventTypeNoAction {
+					return nil, fmt.Errorf("record %d has no digest for algorithm %v", event.recnum, alg)
+				}
+				// EV_NO_ACTION events aren't measured, so their digests are zero.
+				digest = make(tpm2.Digest, alg.Size())
+			}
+			binary.Write(w, binary.LittleEndian, uint16(alg))
+			w.Write(digest)
+		}
+		binary.Write(w, binary.LittleEndian, uint32(len(event.data)))
+		w.Write(event.data)
+	}
+
+	return w.Bytes(), nil
+}
+
+// isCELLog determines whether the supplied log is in the CEL format rather than the TCG format. A TCG log always begins with a
+// TCG_PCClientPCREvent structure containing a TCG_EfiSpecIDEvent or TCG_EfiSpecIdEventStruct structure, which have a signature at
+// offset 32. A CEL log begins with a record number field.
+func isCELLog(data []byte) bool {
+	if len(data) >= 45 && bytes.Equal(data[32:45], specIdEventSignature[:13]) {
+		return false
+	}
+	return len(data) > 0 && data[0] == celTypeRecnum
+}
+
+// openEventLog opens the event log for the default TPM, automatically detecting whether it is in the TCG or CEL format.
+func openEventLog() (*tcglog.Log, error) {
+	data, err := ioutil.ReadFile(eventLogPath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open TCG event log: %w", err)
+	}
+	return decodeEventLog(data)
+}
+
+// decodeEventLog decodes the supplied event log, automatically detecting whether it is in the TCG or CEL format.
+func decodeEventLog(data []byte) (*tcglog.Log, error) {
+	if isCELLog(data) {
+		var err error
+		data, err = convertCELLogToTCGLog(bytes.NewReader(data))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode CEL event log: %w", err)
+		}
+	}
+
+	log, err := tcglog.NewLog(bytes.NewReader(data), tcglog.LogOptions{})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse TCG event log header: %w", err)
+	}
+	return log, nil
+}
@@ -0,0 +1,178 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type eventLogSuite struct{}
+
+var _ = Suite(&eventLogSuite{})
+
+func writeCELTLV(w io.Writer, typ uint8, value []byte) {
+	w.Write([]byte{typ})
+	binary.Write(w, binary.BigEndian, uint32(len(value)))
+	w.Write(value)
+}
+
+func writeCELUint(w io.Writer, typ uint8, v uint64) {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, v)
+	writeCELTLV(w, typ, value)
+}
+
+// writeCELLogFromTCGLog re-encodes the events in the supplied TCG log as a CEL log, and returns the path of the new log.
+func writeCELLogFromTCGLog(c *C, path string) string {
+	f, err := os.Open(path)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	log, err := tcglog.NewLog(f, tcglog.LogOptions{})
+	c.Assert(err, IsNil)
+
+	w := new(bytes.Buffer)
+	for i := 0; ; i++ {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		if i == 0 {
+			// Skip the log header
+			continue
+		}
+
+		var algs []int
+		for alg := range event.Digests {
+			algs = append(algs, int(alg))
+		}
+		sort.Ints(algs)
+		digests := new(bytes.Buffer)
+		for _, alg := range algs {
+			writeCELTLV(digests, uint8(alg), event.Digests[tcglog.AlgorithmId(alg)])
+		}
+
+		content := new(bytes.Buffer)
+		writeCELUint(content, 0, uint64(event.EventType))
+		writeCELTLV(content, 1, event.Data.Bytes())
+
+		writeCELUint(w, 0, uint64(i))
+		writeCELUint(w, 1, uint64(event.PCRIndex))
+		writeCELTLV(w, 3, digests.Bytes())
+		writeCELTLV(w, 5, content.Bytes())
+	}
+
+	out := filepath.Join(c.MkDir(), "eventlog.cel")
+	c.Assert(ioutil.WriteFile(out, w.Bytes(), 0644), IsNil)
+	return out
+}
+
+func (s *eventLogSuite) readEvents(c *C, path string) (*tcglog.Log, []*tcglog.Event) {
+	restore := MockEventLogPath(path)
+	defer restore()
+
+	log, err := OpenEventLog()
+	c.Assert(err, IsNil)
+
+	var events []*tcglog.Event
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		events = append(events, event)
+	}
+	return log, events
+}
+
+func (s *eventLogSuite) TestOpenCELLog(c *C) {
+	_, expected := s.readEvents(c, "testdata/eventlog1.bin")
+	log, events := s.readEvents(c, writeCELLogFromTCGLog(c, "testdata/eventlog1.bin"))
+
+	c.Check(log.Algorithms.Contains(tcglog.AlgorithmId(tpm2.HashAlgorithmSHA1)), Equals, true)
+	c.Check(log.Algorithms.Contains(tcglog.AlgorithmId(tpm2.HashAlgorithmSHA256)), Equals, true)
+	c.Assert(events, HasLen, len(expected))
+	// The first event is the log header, which is synthesized for CEL logs.
+	for i := 1; i < len(events); i++ {
+		c.Check(events[i].PCRIndex, Equals, expected[i].PCRIndex)
+		c.Check(events[i].EventType, Equals, expected[i].EventType)
+		c.Check(events[i].Digests, DeepEquals, expected[i].Digests)
+		c.Check(events[i].Data.Bytes(), DeepEquals, expected[i].Data.Bytes())
+	}
+}
+
+func (s *eventLogSuite) TestOpenCELLogInvalid(c *C) {
+	w := new(bytes.Buffer)
+	writeCELUint(w, 0, 0)
+	writeCELUint(w, 1, 7)
+	writeCELTLV(w, 3, nil)
+
+	path := filepath.Join(c.MkDir(), "eventlog.cel")
+	c.Assert(ioutil.WriteFile(path, w.Bytes(), 0644), IsNil)
+
+	restore := MockEventLogPath(path)
+	defer restore()
+
+	_, err := OpenEventLog()
+	c.Check(err, ErrorMatches, "cannot decode CEL event log: cannot read field for record 0: unexpected EOF")
+}
+
+func (s *eventLogSuite) TestOpenCELLogInvalidLength(c *C) {
+	w := new(bytes.Buffer)
+	writeCELUint(w, 0, 0)
+	writeCELUint(w, 1, 7)
+	// A digests field that claims to be much longer than the log.
+	w.Write([]byte{3, 0xff, 0xff, 0xff, 0xff})
+
+	path := filepath.Join(c.MkDir(), "eventlog.cel")
+	c.Assert(ioutil.WriteFile(path, w.Bytes(), 0644), IsNil)
+
+	restore := MockEventLogPath(path)
+	defer restore()
+
+	_, err := OpenEventLog()
+	c.Check(err, ErrorMatches, `cannot decode CEL event log: cannot read field for record 0: value length \(4294967295 bytes\) exceeds the remaining input \(0 bytes\)`)
+}
+
+func (s *eventLogSuite) TestAddPlatformFirmwareProfileFromCELLog(c *C) {
+	restore := MockEventLogPath(writeCELLogFromTCGLog(c, "testdata/eventlog1.bin"))
+	defer restore()
+
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddPlatformFirmwareProfile(profile, &PlatformFirmwareProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256}), IsNil)
+
+	expected := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 0,
+		decodeHexString(c, "7e77f6ab3fa1cf5c24a9787ec2812f33cc2abf196822fe34ee042a89ee717497"))
+	c.Check(profile.String(), Equals, expected.String())
+}
@@ -0,0 +1,184 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// EventLogPCRMismatch describes a PCR for which the value computed by replaying the TCG event log doesn't match the current value
+// of the PCR.
+type EventLogPCRMismatch struct {
+	Alg      tpm2.HashAlgorithmId // The PCR bank
+	PCR      int                  // The PCR index
+	Expected tpm2.Digest          // The value computed by replaying the event log
+	Current  tpm2.Digest          // The current value of the PCR
+}
+
+// EventLogVerificationError is returned from VerifyEventLog if the TCG event log doesn't replay to the current PCR values.
+type EventLogVerificationError struct {
+	Mismatches []EventLogPCRMismatch
+}
+
+func (e EventLogVerificationError) Error() string {
+	var s []string
+	for _, m := range e.Mismatches {
+		s = append(s, fmt.Sprintf("%v:%d", m.Alg, m.PCR))
+	}
+	return "the TCG event log is not consistent with the current values of PCRs " + strings.Join(s, ", ")
+}
+
+// replayEventLog computes the PCR values for the specified digest algorithm by replaying all of the events in the supplied log. Only
+// PCRs that have events measured to them are included in the result. If the log indicates that TPM2_Startup was executed from a
+// locality other than 0, the initial value of PCR 0 reflects this.
+func replayEventLog(log *tcglog.Log, alg tpm2.HashAlgorithmId) (map[int]tpm2.Digest, error) {
+	values := make(map[int]tpm2.Digest)
+	value := func(pcr int) tpm2.Digest {
+		if _, ok := values[pcr]; !ok {
+			values[pcr] = make(tpm2.Digest, alg.Size())
+		}
+		return values[pcr]
+	}
+
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+		}
+
+		pcr := int(event.PCRIndex)
+
+		if event.EventType == tcglog.EventTypeNoAction {
+			// EV_NO_ACTION events aren't measured, but the StartupLocality event determines the initial value of PCR 0.
+			data := event.Data.Bytes()
+			if pcr == platformFirmwarePCR && len(data) == len(startupLocalitySignature)+1 && bytes.HasPrefix(data, startupLocalitySignature) {
+				value(pcr)[alg.Size()-1] = data[len(data)-1]
+			}
+			continue
+		}
+
+		digest, ok := event.Digests[tcglog.AlgorithmId(alg)]
+		if !ok || len(digest) != alg.Size() {
+			return nil, fmt.Errorf("event %d in TCG event log has an invalid digest for algorithm %v", event.Index, alg)
+		}
+
+		h := alg.NewHash()
+		h.Write(value(pcr))
+		h.Write(digest)
+		values[pcr] = h.Sum(nil)
+	}
+
+	return values, nil
+}
+
+// VerifyEventLog checks that the supplied TCG event log is consistent with the current PCR values of the TPM, by replaying all of the
+// events in the log for each PCR bank and comparing the computed values with the current values of the PCRs. This can be used to
+// detect a truncated or modified event log before using it to generate PCR profiles. The log may be in either the TCG or the CEL
+// format.
+//
+// The SHA-1 and SHA-256 banks are verified if they are present in the log and active on the TPM. Only PCRs that have events measured
+// to them in the log are checked. PCRs that are extended after the event log is read (eg, by the OS) may cause this to fail, so it
+// should be called before any further measurements are made to the PCRs recorded in the log.
+//
+// If any PCR values are inconsistent with the log, a EventLogVerificationError error will be returned, which identifies each
+// PCR that diverges.
+func VerifyEventLog(log io.Reader, tpm *TPMConnection) error {
+	data, err := ioutil.ReadAll(log)
+	if err != nil {
+		return xerrors.Errorf("cannot read event log: %w", err)
+	}
+
+	pcrBanks, err := tpm.GetCapabilityPCRs(tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return xerrors.Errorf("cannot determine active PCR banks: %w", err)
+	}
+	isBankActive := func(alg tpm2.HashAlgorithmId) bool {
+		for _, s := range pcrBanks {
+			if s.Hash == alg && len(s.Select) > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var mismatches []EventLogPCRMismatch
+	verified := false
+
+	for _, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+		if !isBankActive(alg) {
+			continue
+		}
+
+		// The log can only be iterated once, so decode it again for each bank.
+		l, err := decodeEventLog(data)
+		if err != nil {
+			return xerrors.Errorf("cannot decode event log: %w", err)
+		}
+		if !l.Algorithms.Contains(tcglog.AlgorithmId(alg)) {
+			continue
+		}
+
+		expected, err := replayEventLog(l, alg)
+		if err != nil {
+			return xerrors.Errorf("cannot replay event log for %v bank: %w", alg, err)
+		}
+
+		var pcrs []int
+		for pcr := range expected {
+			pcrs = append(pcrs, pcr)
+		}
+		sort.Ints(pcrs)
+
+		current, err := readPCRs(tpm.TPMContext, tpm2.PCRSelectionList{{Hash: alg, Select: pcrs}})
+		if err != nil {
+			return xerrors.Errorf("cannot read current PCR values: %w", err)
+		}
+
+		for _, pcr := range pcrs {
+			if bytes.Equal(expected[pcr], current[alg][pcr]) {
+				continue
+			}
+			mismatches = append(mismatches, EventLogPCRMismatch{Alg: alg, PCR: pcr, Expected: expected[pcr], Current: current[alg][pcr]})
+		}
+		verified = true
+	}
+
+	if !verified {
+		return errors.New("the event log does not contain any PCR banks that are active on the TPM")
+	}
+	if len(mismatches) > 0 {
+		return EventLogVerificationError{Mismatches: mismatches}
+	}
+	return nil
+}
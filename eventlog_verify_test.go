@@ -0,0 +1,107 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+	. "github.com/snapcore/secboot"
+
+	"golang.org/x/xerrors"
+)
+
+func TestVerifyEventLog(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	logData, err := ioutil.ReadFile("testdata/eventlog1.bin")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	resetTPMSimulator(t, tpm, tcti)
+
+	// Extend the measurements from the log to the simulator's PCRs so that they are consistent.
+	log, err := DecodeEventLog(logData)
+	if err != nil {
+		t.Fatalf("DecodeEventLog failed: %v", err)
+	}
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("NextEvent failed: %v", err)
+		}
+		if event.EventType == tcglog.EventTypeNoAction {
+			if bytes.HasPrefix(event.Data.Bytes(), []byte("StartupLocality\x00")) {
+				t.Skip("cannot test with a log that indicates a non-zero startup locality")
+			}
+			continue
+		}
+		var digests tpm2.TaggedHashList
+		for _, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+			if d, ok := event.Digests[tcglog.AlgorithmId(alg)]; ok {
+				digests = append(digests, tpm2.TaggedHash{HashAlg: alg, Digest: tpm2.Digest(d)})
+			}
+		}
+		if err := tpm.PCRExtend(tpm.PCRHandleContext(int(event.PCRIndex)), digests, nil); err != nil {
+			t.Fatalf("PCRExtend failed: %v", err)
+		}
+	}
+
+	t.Run("Consistent", func(t *testing.T) {
+		if err := VerifyEventLog(bytes.NewReader(logData), tpm); err != nil {
+			t.Errorf("VerifyEventLog failed: %v", err)
+		}
+	})
+
+	t.Run("Inconsistent", func(t *testing.T) {
+		if err := tpm.PCRExtend(tpm.PCRHandleContext(7), tpm2.TaggedHashList{
+			{HashAlg: tpm2.HashAlgorithmSHA1, Digest: make(tpm2.Digest, tpm2.HashAlgorithmSHA1.Size())},
+			{HashAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, tpm2.HashAlgorithmSHA256.Size())}}, nil); err != nil {
+			t.Fatalf("PCRExtend failed: %v", err)
+		}
+
+		err := VerifyEventLog(bytes.NewReader(logData), tpm)
+		var e EventLogVerificationError
+		if !xerrors.As(err, &e) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(e.Mismatches) != 2 {
+			t.Fatalf("Unexpected number of mismatches: %d", len(e.Mismatches))
+		}
+		for i, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+			m := e.Mismatches[i]
+			if m.Alg != alg || m.PCR != 7 {
+				t.Errorf("Unexpected mismatch (alg: %v, pcr: %d)", m.Alg, m.PCR)
+			}
+			if bytes.Equal(m.Expected, m.Current) {
+				t.Errorf("Mismatch has identical digests")
+			}
+		}
+	})
+}
@@ -22,6 +22,7 @@ package secboot
 import (
 	"bytes"
 	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
 	"io"
 	"os"
@@ -32,25 +33,29 @@ import (
 
 // Export constants for testing
 const (
-	CurrentMetadataVersion = currentMetadataVersion
-	EkCertHandle           = ekCertHandle
-	EkHandle               = ekHandle
-	LockNVDataHandle       = lockNVDataHandle
-	LockNVHandle           = lockNVHandle
-	SanDirectoryNameTag    = sanDirectoryNameTag
-	SrkHandle              = srkHandle
+	CurrentMetadataVersion    = currentMetadataVersion
+	EkCertHandle              = ekCertHandle
+	EkHandle                  = ekHandle
+	LockNVDataHandle          = lockNVDataHandle
+	LockNVHandle              = lockNVHandle
+	SanDirectoryNameTag       = sanDirectoryNameTag
+	SrkHandle                 = srkHandle
+	SrkTemplatePolicyNVHandle = srkTemplatePolicyNVHandle
 )
 
 // Export variables and unexported functions for testing
 var (
+	CompareFirmwareBaselines                 = compareFirmwareBaselines
 	ComputeDbUpdate                          = computeDbUpdate
 	ComputeDynamicPolicy                     = computeDynamicPolicy
+	ComputePassphraseAuthValue               = computePassphraseAuthValue
 	ComputePeImageDigest                     = computePeImageDigest
 	ComputePolicyORData                      = computePolicyORData
 	ComputeSnapModelDigest                   = computeSnapModelDigest
 	ComputeStaticPolicy                      = computeStaticPolicy
 	CreatePinNVIndex                         = createPinNVIndex
 	CreatePublicAreaForRSASigningKey         = createPublicAreaForRSASigningKey
+	DecodeEventLog                           = decodeEventLog
 	DecodeSecureBootDb                       = decodeSecureBootDb
 	DecodeWinCertificate                     = decodeWinCertificate
 	EkTemplate                               = ekTemplate
@@ -58,6 +63,7 @@ var (
 	EFICertX509Guid                          = efiCertX509Guid
 	EnsureLockNVIndex                        = ensureLockNVIndex
 	ExecutePolicySession                     = executePolicySession
+	HkdfExpand                               = hkdfExpand
 	IdentifyInitialOSLaunchVerificationEvent = identifyInitialOSLaunchVerificationEvent
 	IncrementDynamicPolicyCounter            = incrementDynamicPolicyCounter
 	IsDynamicPolicyDataError                 = isDynamicPolicyDataError
@@ -65,12 +71,17 @@ var (
 	LockNVIndexAttrs                         = lockNVIndexAttrs
 	MakeDefaultEKTemplate                    = makeDefaultEKTemplate
 	MakeDefaultSRKTemplate                   = makeDefaultSRKTemplate
+	NVRead                                   = nvRead
+	NVWrite                                  = nvWrite
 	OidExtensionSubjectAltName               = oidExtensionSubjectAltName
 	OidTcgAttributeTpmManufacturer           = oidTcgAttributeTpmManufacturer
 	OidTcgAttributeTpmModel                  = oidTcgAttributeTpmModel
 	OidTcgAttributeTpmVersion                = oidTcgAttributeTpmVersion
 	OidTcgKpEkCertificate                    = oidTcgKpEkCertificate
+	OpenEventLog                             = openEventLog
+	ParseCRTMVersion                         = parseCRTMVersion
 	PerformPinChange                         = performPinChange
+	PinIndexAuthValue                        = pinIndexAuthValue
 	ReadAndValidateLockNVIndexPublic         = readAndValidateLockNVIndexPublic
 	ReadDynamicPolicyCounter                 = readDynamicPolicyCounter
 	ReadShimVendorCert                       = readShimVendorCert
@@ -139,6 +150,20 @@ func AppendRootCAHash(h []byte) {
 	rootCAHashes = append(rootCAHashes, h)
 }
 
+func MergePCRValues(current, update []tpm2.PCRValues) []tpm2.PCRValues {
+	return mergePCRValues(current, update)
+}
+
+func ResetEKCertAttributeOIDs() {
+	extraTpmManufacturerOIDs = nil
+	extraTpmModelOIDs = nil
+	extraTpmVersionOIDs = nil
+}
+
+func VerifyEkCertificate(cert []byte, parents [][]byte) ([]*x509.Certificate, *TPMDeviceAttributes, error) {
+	return verifyEkCertificate(&ekCertData{Cert: cert, Parents: parents})
+}
+
 func GetWinCertificateType(cert winCertificate) uint16 {
 	return cert.wCertificateType()
 }
@@ -188,6 +213,14 @@ func MakeMockPolicyPCRValuesFull(params []MockPolicyPCRParam) (out []tpm2.PCRVal
 	return
 }
 
+func MockACPITPM2TablePath(path string) (restore func()) {
+	origPath := acpiTPM2TablePath
+	acpiTPM2TablePath = path
+	return func() {
+		acpiTPM2TablePath = origPath
+	}
+}
+
 func MockEfivarsPath(path string) (restore func()) {
 	origPath := efivarsPath
 	efivarsPath = path
@@ -204,6 +237,24 @@ func MockEKTemplate(mock *tpm2.Public) (restore func()) {
 	}
 }
 
+func MockLinkFile(fn func(oldname, newname string) error) (restore func()) {
+	orig := linkFile
+	linkFile = fn
+	return func() {
+		linkFile = orig
+	}
+}
+
+func MockNVBufferMax(max int) (restore func()) {
+	orig := readNVBufferMax
+	readNVBufferMax = func(_ *tpm2.TPMContext) (int, error) {
+		return max, nil
+	}
+	return func() {
+		readNVBufferMax = orig
+	}
+}
+
 func MockEventLogPath(path string) (restore func()) {
 	origPath := eventLogPath
 	eventLogPath = path
@@ -243,11 +294,11 @@ func NewStaticPolicyComputeParams(key *tpm2.Public, pinIndexPub *tpm2.NVPublic,
 }
 
 func (p *PCRProtectionProfile) ComputePCRDigests(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
-	return p.computePCRDigests(tpm, alg)
+	return p.computePCRDigests(newPCRSourceFromTPMContext(tpm), alg)
 }
 
 func (p *PCRProtectionProfile) DumpValues(tpm *tpm2.TPMContext) string {
-	values, err := p.computePCRValues(tpm)
+	values, err := p.computePCRValues(newPCRSourceFromTPMContext(tpm))
 	if err != nil {
 		return ""
 	}
@@ -264,6 +315,21 @@ func (p *PCRProtectionProfile) DumpValues(tpm *tpm2.TPMContext) string {
 	return s.String()
 }
 
+func (k *SealedKeyObject) ExecutePolicySession(tpm *TPMConnection, session tpm2.SessionContext, pin string) error {
+	return executePolicySession(tpm.TPMContext, session, k.data.staticPolicyData, k.data.dynamicPolicyData, nil,
+		k.data.pcrGracePeriodExpiry, pin, tpm.HmacSession())
+}
+
+// SetRequirePhysicalPresence modifies the metadata of the sealed key object without changing the sealed object, in order to
+// simulate a corrupted key file.
+func (k *SealedKeyObject) SetRequirePhysicalPresence(require bool) {
+	k.data.requirePhysicalPresence = require
+}
+
+func (t *TPMConnection) EndorsementKeyTemplate() *tpm2.Public {
+	return t.endorsementKeyTemplate()
+}
+
 func SetOpenDefaultTctiFn(fn func() (io.ReadWriteCloser, error)) {
 	openDefaultTcti = fn
 }
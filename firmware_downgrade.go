@@ -0,0 +1,266 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"unicode/utf16"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// FirmwareBaseline records details about the TPM and platform firmware, so that they can be compared against the current state
+// with CheckFirmwareDowngrade. A baseline should be obtained with ReadFirmwareBaseline when a key is enrolled and stored alongside
+// the sealed key data file. It can be serialized with encoding/json.
+type FirmwareBaseline struct {
+	// TPMFirmwareVersion is the firmware version reported by the TPM. The value of TPM_PT_FIRMWARE_VERSION_1 is in the most
+	// significant 32 bits and the value of TPM_PT_FIRMWARE_VERSION_2 is in the least significant 32 bits.
+	TPMFirmwareVersion uint64 `json:"tpm-firmware-version"`
+
+	// CRTMVersion is the data of the EV_S_CRTM_VERSION event from the TCG event log, if there is one.
+	CRTMVersion []byte `json:"crtm-version,omitempty"`
+
+	// PlatformFirmwareDigest is the value of PCR 0 in the SHA-256 bank, computed by replaying the TCG event log. This is empty if
+	// the log doesn't contain SHA-256 digests.
+	PlatformFirmwareDigest tpm2.Digest `json:"platform-firmware-digest,omitempty"`
+}
+
+// FirmwareDowngradeReport is the result of CheckFirmwareDowngrade.
+type FirmwareDowngradeReport struct {
+	// LikelyDowngrade indicates that at least one of the checks indicates that the TPM or platform firmware is older than it was
+	// when the baseline was obtained.
+	LikelyDowngrade bool `json:"likely-downgrade"`
+
+	// TPMFirmwareDowngraded indicates that the firmware version reported by the TPM is older than the one in the baseline.
+	TPMFirmwareDowngraded bool `json:"tpm-firmware-downgraded"`
+
+	// TPMFirmwareOlderThanCertified indicates that the firmware version reported by the TPM is older than the one recorded in the
+	// verified endorsement key certificate. This is only checked if the connection was created with SecureConnectToDefaultTPM.
+	TPMFirmwareOlderThanCertified bool `json:"tpm-firmware-older-than-certified"`
+
+	// CRTMVersionChanged indicates that the platform firmware version recorded in the TCG event log is different to the one in the
+	// baseline.
+	CRTMVersionChanged bool `json:"crtm-version-changed"`
+
+	// CRTMVersionDowngraded indicates that the platform firmware version recorded in the TCG event log appears to be older than the
+	// one in the baseline. The format of this version is vendor specific, so this is only set if both versions can be interpreted
+	// as a sequence of numeric components.
+	CRTMVersionDowngraded bool `json:"crtm-version-downgraded"`
+
+	// PlatformFirmwareChanged indicates that the measurements of the platform firmware recorded to PCR 0 are different to those in
+	// the baseline. This happens after any firmware update or downgrade, and on its own doesn't indicate a downgrade.
+	PlatformFirmwareChanged bool `json:"platform-firmware-changed"`
+
+	Baseline *FirmwareBaseline `json:"baseline"`
+	Current  *FirmwareBaseline `json:"current"`
+}
+
+// readTPMFirmwareVersion returns the values of TPM_PT_FIRMWARE_VERSION_1 and TPM_PT_FIRMWARE_VERSION_2 combined in to a single
+// 64-bit value.
+func readTPMFirmwareVersion(tpm *tpm2.TPMContext, session tpm2.SessionContext) (uint64, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyFirmwareVersion1, 2, session)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot request firmware version properties from TPM: %w", err)
+	}
+
+	var v1, v2 uint32
+	found := false
+	for _, prop := range props {
+		switch prop.Property {
+		case tpm2.PropertyFirmwareVersion1:
+			v1 = prop.Value
+			found = true
+		case tpm2.PropertyFirmwareVersion2:
+			v2 = prop.Value
+		}
+	}
+	if !found {
+		return 0, errors.New("TPM did not return the firmware version")
+	}
+	return uint64(v1)<<32 | uint64(v2), nil
+}
+
+// readCRTMVersionFromEventLog returns the data of the EV_S_CRTM_VERSION event from the supplied log, or nil if there isn't one.
+func readCRTMVersionFromEventLog(log *tcglog.Log) ([]byte, error) {
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+		}
+		if event.PCRIndex == platformFirmwarePCR && event.EventType == tcglog.EventTypeSCRTMVersion {
+			return event.Data.Bytes(), nil
+		}
+	}
+}
+
+// parseCRTMVersion attempts to interpret the data of a EV_S_CRTM_VERSION event as a sequence of numeric version components. The
+// data is normally a NULL terminated UCS-2 string, although some firmware uses ASCII. Any non-digit characters are treated as
+// separators. If the data doesn't contain any digits, nil is returned.
+func parseCRTMVersion(data []byte) []uint64 {
+	var s string
+	if len(data) > 0 && len(data)%2 == 0 && data[1] == 0 {
+		u := make([]uint16, len(data)/2)
+		for i := range u {
+			u[i] = uint16(data[i*2]) | uint16(data[i*2+1])<<8
+		}
+		s = string(utf16.Decode(u))
+	} else {
+		s = string(data)
+	}
+
+	var components []uint64
+	inNumber := false
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			inNumber = false
+			continue
+		}
+		if !inNumber {
+			components = append(components, 0)
+			inNumber = true
+		}
+		components[len(components)-1] = components[len(components)-1]*10 + uint64(c-'0')
+	}
+	return components
+}
+
+// compareVersionComponents compares the version components a and b, returning -1 if a is older than b, 1 if a is newer than b and
+// 0 if they are the same. Missing components are treated as zero.
+func compareVersionComponents(a, b []uint64) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y uint64
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+	}
+	return 0
+}
+
+// compareFirmwareBaselines compares the current firmware details against the baseline. It doesn't perform the checks that
+// require a TPM.
+func compareFirmwareBaselines(baseline, current *FirmwareBaseline) *FirmwareDowngradeReport {
+	report := &FirmwareDowngradeReport{Baseline: baseline, Current: current}
+
+	report.TPMFirmwareDowngraded = current.TPMFirmwareVersion < baseline.TPMFirmwareVersion
+
+	if !bytes.Equal(current.CRTMVersion, baseline.CRTMVersion) {
+		report.CRTMVersionChanged = true
+		currentVersion := parseCRTMVersion(current.CRTMVersion)
+		baselineVersion := parseCRTMVersion(baseline.CRTMVersion)
+		if len(currentVersion) > 0 && len(baselineVersion) > 0 {
+			report.CRTMVersionDowngraded = compareVersionComponents(currentVersion, baselineVersion) < 0
+		}
+	}
+
+	if len(current.PlatformFirmwareDigest) > 0 && len(baseline.PlatformFirmwareDigest) > 0 {
+		report.PlatformFirmwareChanged = !bytes.Equal(current.PlatformFirmwareDigest, baseline.PlatformFirmwareDigest)
+	}
+
+	report.LikelyDowngrade = report.TPMFirmwareDowngraded || report.CRTMVersionDowngraded
+	return report
+}
+
+// ReadFirmwareBaseline obtains the current TPM firmware version from the TPM and the platform firmware details from the supplied
+// TCG event log, for storing at enrollment time and later use with CheckFirmwareDowngrade. The log may be in either the TCG or
+// the CEL format.
+//
+// Note that the TPM firmware version is not authenticated, and the event log isn't verified against the TPM's PCR values. The log
+// can be verified with VerifyEventLog first if required.
+func ReadFirmwareBaseline(tpm *TPMConnection, log io.Reader) (*FirmwareBaseline, error) {
+	data, err := ioutil.ReadAll(log)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read event log: %w", err)
+	}
+
+	version, err := readTPMFirmwareVersion(tpm.TPMContext, tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, err
+	}
+	baseline := &FirmwareBaseline{TPMFirmwareVersion: version}
+
+	// The log can only be iterated once, so decode it again for each pass.
+	l, err := decodeEventLog(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode event log: %w", err)
+	}
+	baseline.CRTMVersion, err = readCRTMVersionFromEventLog(l)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err = decodeEventLog(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode event log: %w", err)
+	}
+	if l.Algorithms.Contains(tcglog.AlgorithmId(tpm2.HashAlgorithmSHA256)) {
+		values, err := replayEventLog(l, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot replay event log: %w", err)
+		}
+		baseline.PlatformFirmwareDigest = values[platformFirmwarePCR]
+	}
+
+	return baseline, nil
+}
+
+// CheckFirmwareDowngrade heuristically detects whether the TPM or platform firmware has been downgraded since the supplied baseline
+// was obtained with ReadFirmwareBaseline, by comparing it against the current TPM firmware version and the supplied TCG event log.
+// If the connection was created with SecureConnectToDefaultTPM, the current TPM firmware version is also compared against the
+// version recorded in the verified endorsement key certificate.
+//
+// This is a read-only and advisory check intended for security monitoring. It doesn't affect the ability to unseal keys, and a
+// downgrade that doesn't change any of the reported versions cannot be detected. The LikelyDowngrade field of the returned report
+// is set if any of the checks indicate a downgrade. A change to the platform firmware measurements without a change to any version
+// is reported via the PlatformFirmwareChanged field, but is not considered to be a downgrade.
+func CheckFirmwareDowngrade(tpm *TPMConnection, log io.Reader, baseline *FirmwareBaseline) (*FirmwareDowngradeReport, error) {
+	if baseline == nil {
+		return nil, errors.New("no baseline provided")
+	}
+
+	current, err := ReadFirmwareBaseline(tpm, log)
+	if err != nil {
+		return nil, err
+	}
+
+	report := compareFirmwareBaselines(baseline, current)
+	if attrs := tpm.VerifiedDeviceAttributes(); attrs != nil && attrs.FirmwareVersion != 0 {
+		report.TPMFirmwareOlderThanCertified = uint32(current.TPMFirmwareVersion>>32) < attrs.FirmwareVersion
+		report.LikelyDowngrade = report.LikelyDowngrade || report.TPMFirmwareOlderThanCertified
+	}
+	return report, nil
+}
@@ -0,0 +1,177 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	. "github.com/snapcore/secboot"
+)
+
+func encodeUCS2(s string) []byte {
+	var out []byte
+	for _, c := range utf16.Encode([]rune(s + "\x00")) {
+		out = append(out, byte(c), byte(c>>8))
+	}
+	return out
+}
+
+func TestParseCRTMVersion(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		data     []byte
+		expected []uint64
+	}{
+		{desc: "UCS2", data: encodeUCS2("1.23.4"), expected: []uint64{1, 23, 4}},
+		{desc: "ASCII", data: []byte("V2.10\x00"), expected: []uint64{2, 10}},
+		{desc: "VendorPrefix", data: encodeUCS2("N1ET 52W (1.27)"), expected: []uint64{1, 52, 1, 27}},
+		{desc: "NoDigits", data: encodeUCS2("unknown"), expected: nil},
+		{desc: "Empty", data: nil, expected: nil},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			version := ParseCRTMVersion(data.data)
+			if !reflect.DeepEqual(version, data.expected) {
+				t.Errorf("Unexpected version %v", version)
+			}
+		})
+	}
+}
+
+func TestCompareFirmwareBaselines(t *testing.T) {
+	baseline := &FirmwareBaseline{
+		TPMFirmwareVersion:     0x0001000200000000,
+		CRTMVersion:            encodeUCS2("1.20"),
+		PlatformFirmwareDigest: bytes.Repeat([]byte{0x01}, 32)}
+
+	for _, data := range []struct {
+		desc     string
+		current  *FirmwareBaseline
+		expected FirmwareDowngradeReport
+	}{
+		{
+			desc: "Unchanged",
+			current: &FirmwareBaseline{
+				TPMFirmwareVersion:     0x0001000200000000,
+				CRTMVersion:            encodeUCS2("1.20"),
+				PlatformFirmwareDigest: bytes.Repeat([]byte{0x01}, 32)},
+		},
+		{
+			desc: "Upgraded",
+			current: &FirmwareBaseline{
+				TPMFirmwareVersion:     0x0001000300000000,
+				CRTMVersion:            encodeUCS2("1.21"),
+				PlatformFirmwareDigest: bytes.Repeat([]byte{0x02}, 32)},
+			expected: FirmwareDowngradeReport{CRTMVersionChanged: true, PlatformFirmwareChanged: true},
+		},
+		{
+			desc: "TPMFirmwareDowngraded",
+			current: &FirmwareBaseline{
+				TPMFirmwareVersion:     0x0001000100000000,
+				CRTMVersion:            encodeUCS2("1.20"),
+				PlatformFirmwareDigest: bytes.Repeat([]byte{0x01}, 32)},
+			expected: FirmwareDowngradeReport{LikelyDowngrade: true, TPMFirmwareDowngraded: true},
+		},
+		{
+			desc: "CRTMVersionDowngraded",
+			current: &FirmwareBaseline{
+				TPMFirmwareVersion:     0x0001000200000000,
+				CRTMVersion:            encodeUCS2("1.9"),
+				PlatformFirmwareDigest: bytes.Repeat([]byte{0x02}, 32)},
+			expected: FirmwareDowngradeReport{LikelyDowngrade: true, CRTMVersionChanged: true, CRTMVersionDowngraded: true,
+				PlatformFirmwareChanged: true},
+		},
+		{
+			desc: "CRTMVersionNotNumeric",
+			current: &FirmwareBaseline{
+				TPMFirmwareVersion:     0x0001000200000000,
+				CRTMVersion:            encodeUCS2("unknown"),
+				PlatformFirmwareDigest: bytes.Repeat([]byte{0x02}, 32)},
+			expected: FirmwareDowngradeReport{CRTMVersionChanged: true, PlatformFirmwareChanged: true},
+		},
+		{
+			desc: "NoPlatformFirmwareDigest",
+			current: &FirmwareBaseline{
+				TPMFirmwareVersion: 0x0001000200000000,
+				CRTMVersion:        encodeUCS2("1.20")},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			report := CompareFirmwareBaselines(baseline, data.current)
+			if report.Baseline != baseline || report.Current != data.current {
+				t.Errorf("Unexpected baseline or current details")
+			}
+			report.Baseline = nil
+			report.Current = nil
+			if !reflect.DeepEqual(*report, data.expected) {
+				t.Errorf("Unexpected report %+v", report)
+			}
+		})
+	}
+}
+
+func TestCheckFirmwareDowngrade(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	logData, err := ioutil.ReadFile("testdata/eventlog1.bin")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+
+	baseline, err := ReadFirmwareBaseline(tpm, bytes.NewReader(logData))
+	if err != nil {
+		t.Fatalf("ReadFirmwareBaseline failed: %v", err)
+	}
+	if len(baseline.PlatformFirmwareDigest) != 32 {
+		t.Errorf("Unexpected platform firmware digest")
+	}
+
+	t.Run("Unchanged", func(t *testing.T) {
+		report, err := CheckFirmwareDowngrade(tpm, bytes.NewReader(logData), baseline)
+		if err != nil {
+			t.Fatalf("CheckFirmwareDowngrade failed: %v", err)
+		}
+		if report.LikelyDowngrade || report.TPMFirmwareDowngraded || report.CRTMVersionChanged || report.PlatformFirmwareChanged {
+			t.Errorf("Unexpected report %+v", report)
+		}
+	})
+
+	t.Run("TPMFirmwareDowngraded", func(t *testing.T) {
+		newer := *baseline
+		newer.TPMFirmwareVersion++
+		report, err := CheckFirmwareDowngrade(tpm, bytes.NewReader(logData), &newer)
+		if err != nil {
+			t.Fatalf("CheckFirmwareDowngrade failed: %v", err)
+		}
+		if !report.LikelyDowngrade || !report.TPMFirmwareDowngraded {
+			t.Errorf("Unexpected report %+v", report)
+		}
+	})
+
+	t.Run("NoBaseline", func(t *testing.T) {
+		if _, err := CheckFirmwareDowngrade(tpm, bytes.NewReader(logData), nil); err == nil || err.Error() != "no baseline provided" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
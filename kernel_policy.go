@@ -0,0 +1,165 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// KernelMeasurementScheme describes how a kernel image is measured to its dedicated PCR by the component that loads it.
+type KernelMeasurementScheme int
+
+const (
+	// KernelMeasurementSchemeAuthenticode indicates that the kernel image is a PE image and is measured using its Authenticode
+	// digest, as computed in accordance with the "Windows Authenticode Portable Executable Signature Format" specification. This is
+	// the scheme used for signed kernels that are loaded as EFI applications.
+	KernelMeasurementSchemeAuthenticode KernelMeasurementScheme = iota
+
+	// KernelMeasurementSchemeFlat indicates that the kernel image is measured using a digest of the entire contents of the file.
+	// This is the scheme typically used by bootloaders that measure unsigned kernel images.
+	KernelMeasurementSchemeFlat
+)
+
+// KernelImageProfileParams provides the parameters to AddKernelImageProfile and ResealKeyToKernelImage.
+type KernelImageProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// PCRIndex is the PCR that the kernel image and initrd are measured to.
+	PCRIndex int
+
+	// Scheme specifies how the kernel image is measured.
+	Scheme KernelMeasurementScheme
+
+	// Kernel is the kernel image.
+	Kernel EFIImage
+
+	// Initrd is the optional initrd image, which is measured to the same PCR after the kernel image using a digest of the entire
+	// contents of the file.
+	Initrd EFIImage
+}
+
+// computeFlatImageDigest computes a digest of the entire contents of the supplied image.
+func computeFlatImageDigest(alg tpm2.HashAlgorithmId, image EFIImage) (tpm2.Digest, error) {
+	r, err := image.Open()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot open image: %w", err)
+	}
+	defer r.Close()
+
+	h := alg.NewHash()
+	var buf [4096]byte
+	var off int64
+	for {
+		n, err := r.ReadAt(buf[:], off)
+		h.Write(buf[:n])
+		off += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read image: %w", err)
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+// computeKernelImageMeasurements computes the ordered list of digests that are measured to the kernel PCR for the specified
+// parameters.
+func computeKernelImageMeasurements(params *KernelImageProfileParams) (tpm2.DigestList, error) {
+	if params.PCRIndex < 0 {
+		return nil, errors.New("invalid PCR index")
+	}
+	if params.Kernel == nil {
+		return nil, errors.New("no kernel image specified")
+	}
+	if !params.PCRAlgorithm.Supported() {
+		return nil, errors.New("unsupported PCR algorithm")
+	}
+
+	var digests tpm2.DigestList
+
+	var kernelDigest tpm2.Digest
+	var err error
+	switch params.Scheme {
+	case KernelMeasurementSchemeAuthenticode:
+		kernelDigest, err = computePeImageDigest(params.PCRAlgorithm, params.Kernel)
+	case KernelMeasurementSchemeFlat:
+		kernelDigest, err = computeFlatImageDigest(params.PCRAlgorithm, params.Kernel)
+	default:
+		return nil, errors.New("invalid kernel measurement scheme")
+	}
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute digest of kernel image %s: %w", params.Kernel, err)
+	}
+	digests = append(digests, kernelDigest)
+
+	if params.Initrd != nil {
+		initrdDigest, err := computeFlatImageDigest(params.PCRAlgorithm, params.Initrd)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute digest of initrd image %s: %w", params.Initrd, err)
+		}
+		digests = append(digests, initrdDigest)
+	}
+
+	return digests, nil
+}
+
+// AddKernelImageProfile adds a profile for a specific kernel image to the PCR protection profile, in order to generate a PCR policy
+// that restricts access to a key to a system booted with that kernel image (and optionally, a specific initrd). This is intended
+// for systems where the kernel is measured to a dedicated PCR, and is a focused alternative to AddEFIBootManagerProfile for when
+// only the kernel component needs to be bound.
+//
+// The PCR that the kernel is measured to is specified via the PCRIndex field of params, and the scheme used to measure the kernel
+// image is specified via the Scheme field. The expected PCR value is computed by extending the digest of the kernel image followed
+// by the digest of the initrd image, if one is specified.
+func AddKernelImageProfile(profile *PCRProtectionProfile, params *KernelImageProfileParams) error {
+	digests, err := computeKernelImageMeasurements(params)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range digests {
+		profile.ExtendPCR(params.PCRAlgorithm, params.PCRIndex, d)
+	}
+	return nil
+}
+
+// ResealKeyToKernelImage updates the PCR protection policy for the sealed key at the path specified by the keyPath argument so that
+// it is bound to the kernel image (and optional initrd) specified by params, leaving the values for all other PCRs unchanged. This
+// should be called when installing a new kernel image. In order to do this, the caller must also specify the path to the policy
+// update data file that was saved by SealKeyToTPM.
+//
+// This only works for sealed key files that were created with the AllowIncrementalPCRPolicyUpdates field of KeyCreationParams
+// set, and returns the same errors as UpdateKeyPCRProtectionPolicyIncremental.
+func ResealKeyToKernelImage(tpm *TPMConnection, keyPath, policyUpdatePath string, params *KernelImageProfileParams) error {
+	profile := NewPCRProtectionProfile()
+	if err := AddKernelImageProfile(profile, params); err != nil {
+		return xerrors.Errorf("cannot compute PCR profile for kernel image: %w", err)
+	}
+	return UpdateKeyPCRProtectionPolicyIncremental(tpm, keyPath, policyUpdatePath, profile)
+}
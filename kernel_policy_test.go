@@ -0,0 +1,143 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestAddKernelImageProfile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "_TestAddKernelImageProfile_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	initrdPath := filepath.Join(tmpDir, "initrd.img")
+	if err := ioutil.WriteFile(initrdPath, []byte("mock initrd"), 0644); err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+
+	flatDigest := func(t *testing.T, alg tpm2.HashAlgorithmId, path string) tpm2.Digest {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		h := alg.NewHash()
+		h.Write(b)
+		return h.Sum(nil)
+	}
+	authenticodeDigest := func(t *testing.T, alg tpm2.HashAlgorithmId, path string) tpm2.Digest {
+		d, err := ComputePeImageDigest(alg, FileEFIImage(path))
+		if err != nil {
+			t.Fatalf("ComputePeImageDigest failed: %v", err)
+		}
+		return d
+	}
+	extend := func(alg tpm2.HashAlgorithmId, digests ...tpm2.Digest) tpm2.Digest {
+		v := make(tpm2.Digest, alg.Size())
+		for _, d := range digests {
+			h := alg.NewHash()
+			h.Write(v)
+			h.Write(d)
+			v = h.Sum(nil)
+		}
+		return v
+	}
+
+	for _, data := range []struct {
+		desc     string
+		params   KernelImageProfileParams
+		expected func(t *testing.T) tpm2.Digest
+	}{
+		{
+			desc: "Authenticode",
+			params: KernelImageProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				PCRIndex:     9,
+				Scheme:       KernelMeasurementSchemeAuthenticode,
+				Kernel:       FileEFIImage("testdata/mockkernel1.efi.signed.shim")},
+			expected: func(t *testing.T) tpm2.Digest {
+				return extend(tpm2.HashAlgorithmSHA256, authenticodeDigest(t, tpm2.HashAlgorithmSHA256, "testdata/mockkernel1.efi.signed.shim"))
+			},
+		},
+		{
+			desc: "Flat",
+			params: KernelImageProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				PCRIndex:     9,
+				Scheme:       KernelMeasurementSchemeFlat,
+				Kernel:       FileEFIImage("testdata/mockkernel1.efi")},
+			expected: func(t *testing.T) tpm2.Digest {
+				return extend(tpm2.HashAlgorithmSHA256, flatDigest(t, tpm2.HashAlgorithmSHA256, "testdata/mockkernel1.efi"))
+			},
+		},
+		{
+			desc: "FlatWithInitrdSHA1",
+			params: KernelImageProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA1,
+				PCRIndex:     8,
+				Scheme:       KernelMeasurementSchemeFlat,
+				Kernel:       FileEFIImage("testdata/mockkernel1.efi"),
+				Initrd:       FileEFIImage(initrdPath)},
+			expected: func(t *testing.T) tpm2.Digest {
+				return extend(tpm2.HashAlgorithmSHA1,
+					flatDigest(t, tpm2.HashAlgorithmSHA1, "testdata/mockkernel1.efi"),
+					flatDigest(t, tpm2.HashAlgorithmSHA1, initrdPath))
+			},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			expectedPcrs := tpm2.PCRSelectionList{{Hash: data.params.PCRAlgorithm, Select: []int{data.params.PCRIndex}}}
+			expectedDigest, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs,
+				tpm2.PCRValues{data.params.PCRAlgorithm: {data.params.PCRIndex: data.expected(t)}})
+
+			profile := NewPCRProtectionProfile()
+			if err := AddKernelImageProfile(profile, &data.params); err != nil {
+				t.Fatalf("AddKernelImageProfile failed: %v", err)
+			}
+			pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			if !pcrs.Equal(expectedPcrs) {
+				t.Errorf("ComputePCRDigests returned the wrong PCR selection")
+			}
+			if !reflect.DeepEqual(digests, tpm2.DigestList{expectedDigest}) {
+				t.Errorf("ComputePCRDigests returned unexpected values")
+				t.Logf("Profile:\n%s", profile)
+			}
+		})
+	}
+
+	t.Run("NoKernel", func(t *testing.T) {
+		err := AddKernelImageProfile(NewPCRProtectionProfile(), &KernelImageProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256, PCRIndex: 9})
+		if err == nil || err.Error() != "no kernel image specified" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -27,8 +27,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"path/filepath"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/canonical/go-tpm2"
 	"github.com/snapcore/snapd/osutil"
@@ -41,6 +46,14 @@ const (
 	currentMetadataVersion    uint32 = 0
 	keyDataHeader             uint32 = 0x55534b24
 	keyPolicyUpdateDataHeader uint32 = 0x55534b50
+
+	// keyDataOptionalFieldsVersion is the version of the on-disk format of keyData that is used for sealed key objects with
+	// metadata for optional features, which is stored in a list of tagged fields (see keyDataRaw_v1). keyData is written in this
+	// format whenever any of these fields are set. It shares the same authorization policy format as currentMetadataVersion.
+	keyDataOptionalFieldsVersion uint32 = 1
+
+	// MaxKeyLabelLength is the maximum length in bytes of a label that can be stored in a sealed key data file.
+	MaxKeyLabelLength = 128
 )
 
 // AuthMode corresponds to an authentication mechanism.
@@ -49,8 +62,25 @@ type AuthMode uint8
 const (
 	AuthModeNone AuthMode = iota
 	AuthModePIN
+	AuthModePassphrase
+	AuthModeSecurityKey
 )
 
+func (m AuthMode) String() string {
+	switch m {
+	case AuthModeNone:
+		return "none"
+	case AuthModePIN:
+		return "pin"
+	case AuthModePassphrase:
+		return "passphrase"
+	case AuthModeSecurityKey:
+		return "security-key"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint8(m))
+	}
+}
+
 // keyPolicyUpdateDataRaw_v0 is version 0 of the on-disk format of keyPolicyUpdateData.
 type keyPolicyUpdateDataRaw_v0 struct {
 	AuthKey        []byte
@@ -128,6 +158,25 @@ func (d *keyPolicyUpdateData) write(buf io.Writer) error {
 	return nil
 }
 
+// writeToFileAtomic serializes keyPolicyUpdateData and writes it atomically to the file at the specified path.
+func (d *keyPolicyUpdateData) writeToFileAtomic(dest string) error {
+	f, err := osutil.NewAtomicFile(dest, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+	if err != nil {
+		return xerrors.Errorf("cannot create new atomic file: %w", err)
+	}
+	defer f.Cancel()
+
+	if err := d.write(f); err != nil {
+		return xerrors.Errorf("cannot write to temporary file: %w", err)
+	}
+
+	if err := f.Commit(); err != nil {
+		return xerrors.Errorf("cannot atomically replace file: %w", err)
+	}
+
+	return nil
+}
+
 // decodeKeyPolicyUpdateData deserializes keyPolicyUpdateData from the provided io.Reader.
 func decodeKeyPolicyUpdateData(r io.Reader) (*keyPolicyUpdateData, error) {
 	var header uint32
@@ -146,6 +195,22 @@ func decodeKeyPolicyUpdateData(r io.Reader) (*keyPolicyUpdateData, error) {
 	return &d, nil
 }
 
+// validateKeyLabel checks that the supplied label is suitable for storing in a key data file.
+func validateKeyLabel(label string) error {
+	if len(label) > MaxKeyLabelLength {
+		return fmt.Errorf("label is too long (maximum length is %d bytes)", MaxKeyLabelLength)
+	}
+	if !utf8.ValidString(label) {
+		return errors.New("label is not valid UTF-8")
+	}
+	for _, r := range label {
+		if unicode.IsControl(r) {
+			return errors.New("label contains control characters")
+		}
+	}
+	return nil
+}
+
 // keyDataRaw_v0 is version 0 of the on-disk format of keyDataRaw.
 type keyDataRaw_v0 struct {
 	KeyPrivate        tpm2.Private
@@ -155,25 +220,257 @@ type keyDataRaw_v0 struct {
 	DynamicPolicyData *dynamicPolicyDataRaw_v0
 }
 
+// keyDataRaw_v1 is version 1 of the on-disk format of keyDataRaw. It is the same as version 0, with the addition of a list of
+// optional fields. Metadata for features that aren't used by every sealed key object is stored in these fields, so that new
+// features don't require a new version of the on-disk format.
+type keyDataRaw_v1 struct {
+	KeyPrivate        tpm2.Private
+	KeyPublic         *tpm2.Public
+	AuthModeHint      AuthMode
+	StaticPolicyData  *staticPolicyDataRaw_v0
+	DynamicPolicyData *dynamicPolicyDataRaw_v0
+	Fields            []keyDataFieldRaw
+}
+
+// keyDataFieldTag identifies the type of an optional field in version 1 of the on-disk format of keyDataRaw.
+type keyDataFieldTag uint16
+
+const (
+	keyDataFieldLabel                   keyDataFieldTag = 1  // The label supplied when the key was created
+	keyDataFieldAdminPolicyData         keyDataFieldTag = 2  // Metadata for the admin override branch of the authorization policy
+	keyDataFieldPINIndexAttrs           keyDataFieldTag = 3  // The attributes of the PIN NV index, if not pinNVIndexAttrs
+	keyDataFieldRequirePhysicalPresence keyDataFieldTag = 4  // Present if the static policy has a TPM2_PolicyPhysicalPresence assertion
+	keyDataFieldPCRBranchValues         keyDataFieldTag = 5  // The PCR values for one branch of the PCR policy
+	keyDataFieldMinFirmwareVersion      keyDataFieldTag = 6  // The minimum TPM firmware version required to unseal
+	keyDataFieldNetworkSecretIndex      keyDataFieldTag = 7  // The handle and name of the network secret NV index
+	keyDataFieldUserPINIndices          keyDataFieldTag = 8  // The user PIN NV index handles and TPM2_PolicyOR digests
+	keyDataFieldSingleUseIndex          keyDataFieldTag = 9  // The handle and name of the single use NV index, and the count
+	keyDataFieldVolumeIdentity          keyDataFieldTag = 10 // The identity of the encrypted volume that the key is bound to
+	keyDataFieldPCRGracePeriodExpiry    keyDataFieldTag = 11 // The TPM clock value at which the PCR grace period expires, and the PCR digests accepted during it
+	keyDataFieldPINIndexNameAlg         keyDataFieldTag = 12 // The name algorithm of the PIN NV index, if not SHA-256
+)
+
+// keyDataFieldRaw is an optional field in version 1 of the on-disk format of keyDataRaw. The contents of Data depend on Tag.
+// Only keyDataFieldPCRBranchValues may appear more than once, with one field for each branch of the PCR policy, in order.
+type keyDataFieldRaw struct {
+	Tag  keyDataFieldTag
+	Data []byte
+}
+
+// marshalKeyDataField creates an optional field with the specified tag, containing the supplied values.
+func marshalKeyDataField(tag keyDataFieldTag, vals ...interface{}) keyDataFieldRaw {
+	data, err := tpm2.MarshalToBytes(vals...)
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal field %d: %v", tag, err))
+	}
+	return keyDataFieldRaw{Tag: tag, Data: data}
+}
+
+// unmarshalValues unmarshals the contents of this field in to the supplied values. It is an error for the field to contain any
+// trailing bytes.
+func (f *keyDataFieldRaw) unmarshalValues(vals ...interface{}) error {
+	n, err := tpm2.UnmarshalFromBytes(f.Data, vals...)
+	if err != nil {
+		return xerrors.Errorf("cannot unmarshal field %d: %w", f.Tag, err)
+	}
+	if n != len(f.Data) {
+		return fmt.Errorf("field %d has %d trailing bytes", f.Tag, len(f.Data)-n)
+	}
+	return nil
+}
+
 // keyData corresponds to the part of a sealed key object that contains the TPM sealed object and associated metadata required
 // for executing authorization policy assertions.
 type keyData struct {
-	version           uint32
-	keyPrivate        tpm2.Private
-	keyPublic         *tpm2.Public
-	authModeHint      AuthMode
-	staticPolicyData  *staticPolicyData
-	dynamicPolicyData *dynamicPolicyData
+	version                 uint32
+	keyPrivate              tpm2.Private
+	keyPublic               *tpm2.Public
+	authModeHint            AuthMode
+	staticPolicyData        *staticPolicyData
+	dynamicPolicyData       *dynamicPolicyData
+	label                   string
+	adminPolicyData         *adminPolicyData
+	pinIndexAttrs           tpm2.NVAttributes
+	pinIndexNameAlg         tpm2.HashAlgorithmId
+	requirePhysicalPresence bool
+	pcrBranchValues         []tpm2.DigestList
+	minFirmwareVersion      uint32
+
+	networkSecretIndexHandle tpm2.Handle // The handle of the NV index used for network-bound unlocking, or zero if there isn't one
+	networkSecretIndexName   tpm2.Name   // The name of the NV index used for network-bound unlocking
+
+	userPINIndexHandles    []tpm2.Handle   // The handles of the NV indices used for user PINs
+	userPINPolicyORDigests tpm2.DigestList // The digests for the TPM2_PolicyOR assertion that authorizes the user PIN NV indices
+
+	singleUseIndexHandle tpm2.Handle // The handle of the NV counter index used to revoke a single use key, or zero if there isn't one
+	singleUseIndexName   tpm2.Name   // The name of the NV counter index used to revoke a single use key
+	singleUseCount       uint64      // The value of the NV counter index that the key is bound to
+
+	volumeIdentity string // The identity of the encrypted volume that the key is bound to, or empty if it isn't bound to one
+
+	// pcrGracePeriodExpiry is the value of the TPM's clock at which the grace period for the previous PCR values in the dynamic
+	// authorization policy expires, or zero if there is no grace period.
+	pcrGracePeriodExpiry uint64
+
+	pcrGracePeriodDigests tpm2.DigestList // The PCR digests that are only accepted until pcrGracePeriodExpiry
+}
+
+// fields returns the optional fields for version 1 of the on-disk format of this keyData.
+func (d *keyData) fields() (out []keyDataFieldRaw) {
+	if d.label != "" {
+		out = append(out, keyDataFieldRaw{Tag: keyDataFieldLabel, Data: []byte(d.label)})
+	}
+	if d.adminPolicyData != nil {
+		out = append(out, marshalKeyDataField(keyDataFieldAdminPolicyData, makeAdminPolicyDataRaw_v0(d.adminPolicyData)))
+	}
+	if d.pinIndexAttrs != pinNVIndexAttrs {
+		out = append(out, marshalKeyDataField(keyDataFieldPINIndexAttrs, d.pinIndexAttrs))
+	}
+	if d.pinIndexNameAlg != tpm2.HashAlgorithmSHA256 {
+		out = append(out, marshalKeyDataField(keyDataFieldPINIndexNameAlg, d.pinIndexNameAlg))
+	}
+	if d.requirePhysicalPresence {
+		out = append(out, keyDataFieldRaw{Tag: keyDataFieldRequirePhysicalPresence})
+	}
+	for _, branch := range d.pcrBranchValues {
+		out = append(out, marshalKeyDataField(keyDataFieldPCRBranchValues, branch))
+	}
+	if d.minFirmwareVersion != 0 {
+		out = append(out, marshalKeyDataField(keyDataFieldMinFirmwareVersion, d.minFirmwareVersion))
+	}
+	if d.networkSecretIndexHandle != 0 {
+		out = append(out, marshalKeyDataField(keyDataFieldNetworkSecretIndex, d.networkSecretIndexHandle, d.networkSecretIndexName))
+	}
+	if len(d.userPINIndexHandles) > 0 {
+		out = append(out, marshalKeyDataField(keyDataFieldUserPINIndices, d.userPINIndexHandles, d.userPINPolicyORDigests))
+	}
+	if d.singleUseIndexHandle != 0 {
+		out = append(out, marshalKeyDataField(keyDataFieldSingleUseIndex, d.singleUseIndexHandle, d.singleUseIndexName, d.singleUseCount))
+	}
+	if d.volumeIdentity != "" {
+		out = append(out, keyDataFieldRaw{Tag: keyDataFieldVolumeIdentity, Data: []byte(d.volumeIdentity)})
+	}
+	if d.pcrGracePeriodExpiry != 0 {
+		out = append(out, marshalKeyDataField(keyDataFieldPCRGracePeriodExpiry, d.pcrGracePeriodExpiry, d.pcrGracePeriodDigests))
+	}
+	return out
+}
+
+// setFields populates this keyData from the supplied optional fields from version 1 of the on-disk format, and validates them.
+func (d *keyData) setFields(fields []keyDataFieldRaw) error {
+	d.pinIndexAttrs = pinNVIndexAttrs
+	d.pinIndexNameAlg = tpm2.HashAlgorithmSHA256
+
+	seen := make(map[keyDataFieldTag]bool)
+	for _, f := range fields {
+		if seen[f.Tag] && f.Tag != keyDataFieldPCRBranchValues {
+			return fmt.Errorf("duplicate field %d", f.Tag)
+		}
+		seen[f.Tag] = true
+
+		switch f.Tag {
+		case keyDataFieldLabel:
+			if err := validateKeyLabel(string(f.Data)); err != nil {
+				return xerrors.Errorf("invalid label: %w", err)
+			}
+			d.label = string(f.Data)
+		case keyDataFieldAdminPolicyData:
+			var raw adminPolicyDataRaw_v0
+			if err := f.unmarshalValues(&raw); err != nil {
+				return err
+			}
+			d.adminPolicyData = raw.data()
+		case keyDataFieldPINIndexAttrs:
+			if err := f.unmarshalValues(&d.pinIndexAttrs); err != nil {
+				return err
+			}
+			if d.pinIndexAttrs != pinNVIndexAttrs && d.pinIndexAttrs != pinNVIndexAttrs|tpm2.AttrNVPlatformCreate {
+				return fmt.Errorf("invalid PIN NV index attributes (0x%08x)", uint32(d.pinIndexAttrs))
+			}
+		case keyDataFieldPINIndexNameAlg:
+			if err := f.unmarshalValues(&d.pinIndexNameAlg); err != nil {
+				return err
+			}
+			if !isSupportedNameAlg(d.pinIndexNameAlg) {
+				return fmt.Errorf("invalid PIN NV index name algorithm (%v)", d.pinIndexNameAlg)
+			}
+		case keyDataFieldRequirePhysicalPresence:
+			if len(f.Data) > 0 {
+				return errors.New("unexpected data for physical presence field")
+			}
+			d.requirePhysicalPresence = true
+		case keyDataFieldPCRBranchValues:
+			var branch tpm2.DigestList
+			if err := f.unmarshalValues(&branch); err != nil {
+				return err
+			}
+			d.pcrBranchValues = append(d.pcrBranchValues, branch)
+		case keyDataFieldMinFirmwareVersion:
+			if err := f.unmarshalValues(&d.minFirmwareVersion); err != nil {
+				return err
+			}
+		case keyDataFieldNetworkSecretIndex:
+			if err := f.unmarshalValues(&d.networkSecretIndexHandle, &d.networkSecretIndexName); err != nil {
+				return err
+			}
+			if d.networkSecretIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+				return fmt.Errorf("invalid network secret NV index handle (%v)", d.networkSecretIndexHandle)
+			}
+		case keyDataFieldUserPINIndices:
+			if err := f.unmarshalValues(&d.userPINIndexHandles, &d.userPINPolicyORDigests); err != nil {
+				return err
+			}
+			if len(d.userPINIndexHandles) > MaxUserPINs {
+				return fmt.Errorf("too many user PIN NV indices (%d)", len(d.userPINIndexHandles))
+			}
+			if len(d.userPINPolicyORDigests) != len(d.userPINIndexHandles) {
+				return errors.New("unexpected number of user PIN OR policy digests")
+			}
+			for _, h := range d.userPINIndexHandles {
+				if h.Type() != tpm2.HandleTypeNVIndex {
+					return fmt.Errorf("invalid user PIN NV index handle (%v)", h)
+				}
+			}
+		case keyDataFieldSingleUseIndex:
+			if err := f.unmarshalValues(&d.singleUseIndexHandle, &d.singleUseIndexName, &d.singleUseCount); err != nil {
+				return err
+			}
+			if d.singleUseIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+				return fmt.Errorf("invalid single use NV index handle (%v)", d.singleUseIndexHandle)
+			}
+		case keyDataFieldVolumeIdentity:
+			d.volumeIdentity = string(f.Data)
+		case keyDataFieldPCRGracePeriodExpiry:
+			if err := f.unmarshalValues(&d.pcrGracePeriodExpiry, &d.pcrGracePeriodDigests); err != nil {
+				return err
+			}
+			if d.pcrGracePeriodExpiry == 0 {
+				return errors.New("invalid PCR grace period expiry")
+			}
+		default:
+			// Fields may affect how the authorization policy is executed, so ignoring unknown ones isn't safe.
+			return fmt.Errorf("unknown field %d", f.Tag)
+		}
+	}
+
+	return nil
 }
 
 func (d *keyData) Marshal(w io.Writer) (nbytes int, err error) {
-	n, err := tpm2.MarshalToWriter(w, d.version)
+	// Version 0 can't represent any of the optional fields, so use version 1 if there are any.
+	version := d.version
+	fields := d.fields()
+	if version == 0 && len(fields) > 0 {
+		version = keyDataOptionalFieldsVersion
+	}
+
+	n, err := tpm2.MarshalToWriter(w, version)
 	nbytes += n
 	if err != nil {
 		return nbytes, xerrors.Errorf("cannot marshal version number: %w", err)
 	}
 
-	switch d.version {
+	switch version {
 	case 0:
 		raw := keyDataRaw_v0{
 			KeyPrivate:        d.keyPrivate,
@@ -186,6 +483,19 @@ func (d *keyData) Marshal(w io.Writer) (nbytes int, err error) {
 		if err != nil {
 			return nbytes, xerrors.Errorf("cannot marshal raw data: %w", err)
 		}
+	case 1:
+		raw := keyDataRaw_v1{
+			KeyPrivate:        d.keyPrivate,
+			KeyPublic:         d.keyPublic,
+			AuthModeHint:      d.authModeHint,
+			StaticPolicyData:  makeStaticPolicyDataRaw_v0(d.staticPolicyData),
+			DynamicPolicyData: makeDynamicPolicyDataRaw_v0(d.dynamicPolicyData),
+			Fields:            fields}
+		n, err := tpm2.MarshalToWriter(w, raw)
+		nbytes += n
+		if err != nil {
+			return nbytes, xerrors.Errorf("cannot marshal raw data: %w", err)
+		}
 	default:
 		return nbytes, fmt.Errorf("unexpected version number (%d)", d.version)
 	}
@@ -214,22 +524,44 @@ func (d *keyData) Unmarshal(r io.Reader) (nbytes int, err error) {
 			keyPublic:         raw.KeyPublic,
 			authModeHint:      raw.AuthModeHint,
 			staticPolicyData:  raw.StaticPolicyData.data(),
+			dynamicPolicyData: raw.DynamicPolicyData.data(),
+			pinIndexAttrs:     pinNVIndexAttrs,
+			pinIndexNameAlg:   tpm2.HashAlgorithmSHA256}
+	case 1:
+		var raw keyDataRaw_v1
+		n, err := tpm2.UnmarshalFromReader(r, &raw)
+		nbytes += n
+		if err != nil {
+			return nbytes, xerrors.Errorf("cannot unmarshal data: %w", err)
+		}
+		*d = keyData{
+			version:           1,
+			keyPrivate:        raw.KeyPrivate,
+			keyPublic:         raw.KeyPublic,
+			authModeHint:      raw.AuthModeHint,
+			staticPolicyData:  raw.StaticPolicyData.data(),
 			dynamicPolicyData: raw.DynamicPolicyData.data()}
+		if err := d.setFields(raw.Fields); err != nil {
+			return nbytes, xerrors.Errorf("invalid fields: %w", err)
+		}
 	default:
 		return nbytes, fmt.Errorf("unexpected version number (%d)", version)
 	}
 	return
 }
 
-// load loads the TPM sealed object associated with this keyData in to the storage hierarchy of the TPM, and returns the newly
-// created tpm2.ResourceContext.
-func (d *keyData) load(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
-	srkContext, err := tpm.CreateResourceContextFromTPM(srkHandle)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+// policyVersion returns the version of the authorization policy format associated with this keyData.
+func (d *keyData) policyVersion() uint32 {
+	if d.version == keyDataOptionalFieldsVersion {
+		return currentMetadataVersion
 	}
+	return d.version
+}
 
-	keyContext, err := tpm.Load(srkContext, d.keyPrivate, d.keyPublic, session)
+// load loads the TPM sealed object associated with this keyData in to the storage hierarchy of the TPM as a child of the supplied
+// SRK, and returns the newly created tpm2.ResourceContext.
+func (d *keyData) load(tpm *tpm2.TPMContext, srkContext tpm2.ResourceContext, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	keyContext, err := loadUnderSRK(tpm, srkContext, d.keyPrivate, d.keyPublic, session)
 	if err != nil {
 		invalidObject := false
 		switch {
@@ -247,6 +579,38 @@ func (d *keyData) load(tpm *tpm2.TPMContext, session tpm2.SessionContext) (tpm2.
 	return keyContext, nil
 }
 
+// computeAuthPolicy computes the authorization policy that the sealed key object should have from the static metadata in this
+// key data, and the names of the PIN NV index and global lock NV index on the TPM.
+func (d *keyData) computeAuthPolicy(pinIndexName, lockIndexName tpm2.Name) (tpm2.Digest, error) {
+	authKeyName, err := d.staticPolicyData.AuthPublicKey.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of dynamic authorization policy key: %w", err)
+	}
+
+	trial, err := tpm2.ComputeAuthPolicy(d.keyPublic.NameAlg)
+	if err != nil {
+		return nil, err
+	}
+	trial.PolicyAuthorize(nil, authKeyName)
+	trial.PolicySecret(pinIndexName, nil)
+	trial.PolicyNV(lockIndexName, nil, 0, tpm2.OpEq)
+	if d.requirePhysicalPresence {
+		trial.PolicyPhysicalPresence()
+	}
+	if d.networkSecretIndexHandle != 0 {
+		trial.PolicySecret(d.networkSecretIndexName, nil)
+	}
+	if d.singleUseIndexHandle != 0 {
+		trial.PolicyNV(d.singleUseIndexName, makeSingleUseOperand(d.singleUseCount), 0, tpm2.OpEq)
+	}
+
+	authPolicy, err := computeExpectedSealedKeyAuthPolicy(d.keyPublic.NameAlg, trial.GetDigest(), d.adminPolicyData, lockIndexName)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid admin override metadata: %w", err)
+	}
+	return authPolicy, nil
+}
+
 // validate performs some correctness checking on the provided keyData and keyPolicyUpdateData. On success, it returns the validated
 // public area for the PIN NV index.
 func (d *keyData) validate(tpm *tpm2.TPMContext, policyUpdateData *keyPolicyUpdateData, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
@@ -268,7 +632,7 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, policyUpdateData *keyPolicyUpda
 	}
 
 	// Load the sealed data object in to the TPM for integrity checking
-	keyContext, err := tpm.Load(srkContext, d.keyPrivate, keyPublic, session)
+	keyContext, err := loadUnderSRK(tpm, srkContext, d.keyPrivate, keyPublic, session)
 	if err != nil {
 		invalidObject := false
 		switch {
@@ -322,15 +686,36 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, policyUpdateData *keyPolicyUpda
 	}
 
 	// Make sure that the static authorization policy data is consistent with the sealed key object's policy.
-	trial, err := tpm2.ComputeAuthPolicy(keyPublic.NameAlg)
+	if d.networkSecretIndexHandle != 0 {
+		networkSecretIndex, err := tpm.CreateResourceContextFromTPM(d.networkSecretIndexHandle, session.IncludeAttrs(tpm2.AttrAudit))
+		switch {
+		case tpm2.IsResourceUnavailableError(err, d.networkSecretIndexHandle):
+			return nil, keyFileError{errors.New("network secret NV index is unavailable")}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for network secret NV index: %w", err)
+		}
+		if !bytes.Equal(networkSecretIndex.Name(), d.networkSecretIndexName) {
+			return nil, keyFileError{errors.New("network secret NV index has an unexpected name")}
+		}
+	}
+	if d.singleUseIndexHandle != 0 {
+		singleUseIndex, err := tpm.CreateResourceContextFromTPM(d.singleUseIndexHandle, session.IncludeAttrs(tpm2.AttrAudit))
+		switch {
+		case tpm2.IsResourceUnavailableError(err, d.singleUseIndexHandle):
+			return nil, keyFileError{errors.New("single use NV index is unavailable")}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for single use NV index: %w", err)
+		}
+		if !bytes.Equal(singleUseIndex.Name(), d.singleUseIndexName) {
+			return nil, keyFileError{errors.New("single use NV index has an unexpected name")}
+		}
+	}
+
+	authPolicy, err := d.computeAuthPolicy(pinIndex.Name(), lockIndex.Name())
 	if err != nil {
 		return nil, keyFileError{xerrors.Errorf("cannot determine if static authorization policy matches sealed key object: %w", err)}
 	}
-	trial.PolicyAuthorize(nil, authKeyName)
-	trial.PolicySecret(pinIndex.Name(), nil)
-	trial.PolicyNV(lockIndex.Name(), nil, 0, tpm2.OpEq)
-
-	if !bytes.Equal(trial.GetDigest(), keyPublic.AuthPolicy) {
+	if !bytes.Equal(authPolicy, keyPublic.AuthPolicy) {
 		return nil, keyFileError{errors.New("the sealed key object's authorization policy is inconsistent with the associatedc metadata or persistent TPM resources")}
 	}
 
@@ -339,6 +724,10 @@ func (d *keyData) validate(tpm *tpm2.TPMContext, policyUpdateData *keyPolicyUpda
 		return nil, xerrors.Errorf("cannot read public area of PIN NV index: %w", err)
 	}
 
+	if pinIndexPublic.NameAlg != d.pinIndexNameAlg {
+		return nil, keyFileError{errors.New("PIN NV index has an unexpected name algorithm")}
+	}
+
 	pinIndexAuthPolicies := d.staticPolicyData.PinIndexAuthPolicies
 	expectedPinIndexAuthPolicies, err := computePinNVIndexPostInitAuthPolicies(pinIndexPublic.NameAlg, authKeyName)
 	if err != nil {
@@ -500,6 +889,26 @@ func (k *SealedKeyObject) PINIndexHandle() tpm2.Handle {
 	return k.data.staticPolicyData.PinIndexHandle
 }
 
+// MinFirmwareVersion returns the minimum TPM firmware version required to unseal this sealed key object, in the format of the
+// TPM_PT_FIRMWARE_VERSION_1 property. A value of zero indicates that there is no minimum firmware version requirement.
+func (k *SealedKeyObject) MinFirmwareVersion() uint32 {
+	return k.data.minFirmwareVersion
+}
+
+// Label returns the label supplied via the Label field of KeyCreationParams when this sealed key object was created, or an empty
+// string if no label was supplied. The label is not protected by the TPM and does not form part of the sealed key object's
+// authorization policy, and so it should not be trusted.
+func (k *SealedKeyObject) Label() string {
+	return k.data.label
+}
+
+// VolumeIdentity returns the identity of the encrypted volume that this sealed key object is bound to, as supplied via the
+// VolumeIdentity field of KeyCreationParams when it was created, or an empty string if it isn't bound to a volume. The volume
+// identity is not protected by the TPM and does not form part of the sealed key object's authorization policy.
+func (k *SealedKeyObject) VolumeIdentity() string {
+	return k.data.volumeIdentity
+}
+
 // ReadSealedKeyObject loads a sealed key data file created by SealKeyToTPM from the specified path. If the file cannot be opened,
 // a wrapped *os.PathError error is returned. If the key data file cannot be deserialized successfully, a InvalidKeyFileError error
 // will be returned.
@@ -518,3 +927,89 @@ func ReadSealedKeyObject(path string) (*SealedKeyObject, error) {
 
 	return &SealedKeyObject{data: data}, nil
 }
+
+// linkFile creates newname as a hard link to oldname. It can be mocked in tests.
+var linkFile = os.Link
+
+// syncDir flushes the directory at the specified path to storage, so that any entries added to or removed from it are durable.
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// copyFileExclusive copies the file at src to a temporary file in the same directory as dest, flushes it to storage and then links
+// it to dest. This fails with an error for which os.IsExist returns true if dest already exists.
+func copyFileExclusive(src, dest string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+"~")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Link(f.Name(), dest)
+}
+
+// MoveKeyFile moves the sealed key data file at oldPath to newPath, after verifying that the PIN NV index referenced by the key
+// data file is still the NV index that its authorization policy is bound to using TPMConnection.VerifyPINIndex. Errors returned
+// from VerifyPINIndex are returned unwrapped, and the file is not moved in this case.
+//
+// The file is hard linked to newPath if both paths are on the same filesystem. Otherwise, it is copied to a temporary file in the
+// destination directory that is flushed to storage and then linked to newPath. In both cases, the file at newPath is never
+// replaced - if a file already exists at newPath, an error will be returned. The file at oldPath is only removed once the file
+// at newPath has been flushed to storage.
+//
+// If the file at oldPath cannot be deserialized successfully, a InvalidKeyFileError error will be returned. If the file cannot be
+// moved, a wrapped *os.LinkError or *os.PathError error will be returned.
+func MoveKeyFile(oldPath, newPath string, tpm *TPMConnection) error {
+	k, err := ReadSealedKeyObject(oldPath)
+	if err != nil {
+		return err
+	}
+	if err := tpm.VerifyPINIndex(k); err != nil {
+		return err
+	}
+
+	// Use a hard link rather than os.Rename, as this doesn't replace an existing file. If the destination is on a different
+	// filesystem, copy the file instead.
+	err = linkFile(oldPath, newPath)
+	var linkErr *os.LinkError
+	if xerrors.As(err, &linkErr) && linkErr.Err == syscall.EXDEV {
+		err = copyFileExclusive(oldPath, newPath)
+	}
+	switch {
+	case os.IsExist(err):
+		return fmt.Errorf("cannot move key data file: %s already exists", newPath)
+	case err != nil:
+		return xerrors.Errorf("cannot move key data file: %w", err)
+	}
+
+	if err := syncDir(filepath.Dir(newPath)); err != nil {
+		return xerrors.Errorf("cannot flush destination directory: %w", err)
+	}
+
+	if err := os.Remove(oldPath); err != nil {
+		return xerrors.Errorf("cannot remove original key data file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"math/rand"
+	"os"
+	"syscall"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type moveKeyFileSuite struct {
+	tpmTestBase
+	key       []byte
+	pinHandle tpm2.Handle
+	keyFile   string
+}
+
+var _ = Suite(&moveKeyFileSuite{})
+
+func (s *moveKeyFileSuite) SetUpSuite(c *C) {
+	s.key = make([]byte, 64)
+	rand.Read(s.key)
+	s.pinHandle = tpm2.Handle(0x0181fff0)
+}
+
+func (s *moveKeyFileSuite) SetUpTest(c *C) {
+	s.tpmTestBase.SetUpTest(c)
+	c.Assert(ProvisionTPM(s.tpm, ProvisionModeFull, nil, true), IsNil)
+
+	s.keyFile = c.MkDir() + "/keydata"
+
+	c.Assert(SealKeyToTPM(s.tpm, s.key, s.keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: s.pinHandle}), IsNil)
+	pinIndex, err := s.tpm.CreateResourceContextFromTPM(s.pinHandle)
+	c.Assert(err, IsNil)
+	s.addCleanupNVSpace(c, s.tpm.OwnerHandleContext(), pinIndex)
+}
+
+func (s *moveKeyFileSuite) TestMoveKeyFile(c *C) {
+	newPath := c.MkDir() + "/keydata"
+	c.Check(MoveKeyFile(s.keyFile, newPath, s.tpm), IsNil)
+
+	_, err := os.Stat(s.keyFile)
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	k, err := ReadSealedKeyObject(newPath)
+	c.Assert(err, IsNil)
+	c.Check(k.PINIndexHandle(), Equals, s.pinHandle)
+	key, err := k.UnsealFromTPM(s.tpm, "")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+}
+
+func (s *moveKeyFileSuite) TestMoveKeyFileDestinationExists(c *C) {
+	newPath := c.MkDir() + "/keydata"
+	f, err := os.Create(newPath)
+	c.Assert(err, IsNil)
+	f.Close()
+
+	c.Check(MoveKeyFile(s.keyFile, newPath, s.tpm), ErrorMatches, "cannot move key data file: .* already exists")
+	_, err = os.Stat(s.keyFile)
+	c.Check(err, IsNil)
+	fi, err := os.Stat(newPath)
+	c.Assert(err, IsNil)
+	c.Check(fi.Size(), Equals, int64(0))
+}
+
+func (s *moveKeyFileSuite) TestMoveKeyFileCrossDevice(c *C) {
+	// Simulate a destination on a different filesystem, where hard links fail with EXDEV.
+	restore := MockLinkFile(func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	})
+	defer restore()
+
+	dir := c.MkDir()
+	newPath := dir + "/keydata"
+	c.Check(MoveKeyFile(s.keyFile, newPath, s.tpm), IsNil)
+
+	_, err := os.Stat(s.keyFile)
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// No temporary files should be left behind.
+	d, err := os.Open(dir)
+	c.Assert(err, IsNil)
+	names, err := d.Readdirnames(0)
+	d.Close()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"keydata"})
+
+	k, err := ReadSealedKeyObject(newPath)
+	c.Assert(err, IsNil)
+	key, err := k.UnsealFromTPM(s.tpm, "")
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+}
+
+func (s *moveKeyFileSuite) TestMoveKeyFileCrossDeviceDestinationExists(c *C) {
+	restore := MockLinkFile(func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	})
+	defer restore()
+
+	dir := c.MkDir()
+	newPath := dir + "/keydata"
+	f, err := os.Create(newPath)
+	c.Assert(err, IsNil)
+	f.Close()
+
+	c.Check(MoveKeyFile(s.keyFile, newPath, s.tpm), ErrorMatches, "cannot move key data file: .* already exists")
+	_, err = os.Stat(s.keyFile)
+	c.Check(err, IsNil)
+	fi, err := os.Stat(newPath)
+	c.Assert(err, IsNil)
+	c.Check(fi.Size(), Equals, int64(0))
+
+	d, err := os.Open(dir)
+	c.Assert(err, IsNil)
+	names, err := d.Readdirnames(0)
+	d.Close()
+	c.Assert(err, IsNil)
+	c.Check(names, DeepEquals, []string{"keydata"})
+}
+
+func (s *moveKeyFileSuite) TestMoveKeyFileVerificationFailure(c *C) {
+	pinIndex, err := s.tpm.CreateResourceContextFromTPM(s.pinHandle)
+	c.Assert(err, IsNil)
+	c.Assert(s.tpm.NVUndefineSpace(s.tpm.OwnerHandleContext(), pinIndex, nil), IsNil)
+
+	// Define a NV counter index at the PIN handle without dictionary attack protection. It is undefined by the cleanup
+	// registered in SetUpTest.
+	pub := tpm2.NVPublic{
+		Index:   s.pinHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+	_, err = s.tpm.NVDefineSpace(s.tpm.OwnerHandleContext(), nil, &pub, nil)
+	c.Assert(err, IsNil)
+
+	newPath := c.MkDir() + "/keydata"
+	err = MoveKeyFile(s.keyFile, newPath, s.tpm)
+	c.Check(err, FitsTypeOf, PINIndexVerificationError{})
+
+	_, err = os.Stat(s.keyFile)
+	c.Check(err, IsNil)
+	_, err = os.Stat(newPath)
+	c.Check(os.IsNotExist(err), Equals, true)
+}
@@ -0,0 +1,274 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/snapcore/snapd/osutil"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// LUKS2TokenTypeSecboot is the default LUKS2 token type used for tokens created by MakeLUKS2TokenForSealedKey.
+	LUKS2TokenTypeSecboot = "secboot-tpm2"
+
+	luks2TokenTypeMaxLen = 64   // Maximum length of a LUKS2 token type string, as defined by cryptsetup (LUKS2_TOKEN_NAME_MAX)
+	luks2NumKeyslots     = 32   // Number of keyslots supported in a LUKS2 header
+	luks2NumTokens       = 32   // Number of tokens supported in a LUKS2 header
+	maxLUKS2TokenSize    = 8192 // Maximum size of an encoded token, leaving space in the default 12KiB JSON area for other metadata
+)
+
+// luks2TokenData is the JSON representation of a LUKS2 token that references a sealed key object. The "type" and "keyslots" fields
+// are required by the LUKS2 token schema, and the remaining fields are specific to this package. Binary data is encoded as base64.
+type luks2TokenData struct {
+	Type     string   `json:"type"`
+	Keyslots []string `json:"keyslots"`
+	KeyFile  string   `json:"secboot-key-file,omitempty"`
+	KeyData  []byte   `json:"secboot-key-data,omitempty"`
+}
+
+// validateLUKS2TokenType checks that the supplied string is a valid LUKS2 token type. It must be a non-empty string of printable
+// ASCII characters without whitespace, and must not use the "luks2-" prefix that is reserved for tokens handled internally by
+// cryptsetup.
+func validateLUKS2TokenType(t string) error {
+	if t == "" {
+		return errors.New("empty token type")
+	}
+	if len(t) > luks2TokenTypeMaxLen {
+		return fmt.Errorf("token type is too long (max %d bytes)", luks2TokenTypeMaxLen)
+	}
+	for _, c := range t {
+		if c <= ' ' || c > '~' {
+			return errors.New("token type contains invalid characters")
+		}
+	}
+	if strings.HasPrefix(t, "luks2-") {
+		return errors.New("token type uses a reserved prefix")
+	}
+	return nil
+}
+
+// LUKS2TokenParams provides the parameters to MakeLUKS2TokenForSealedKey.
+type LUKS2TokenParams struct {
+	// Type is the LUKS2 token type. If empty, LUKS2TokenTypeSecboot is used.
+	Type string
+
+	// Keyslot is the LUKS2 keyslot that the sealed key unlocks.
+	Keyslot int
+
+	// EmbedKeyData indicates that the sealed key data should be embedded in the token. If not set, the token references the
+	// sealed key data file by its path instead.
+	EmbedKeyData bool
+}
+
+// MakeLUKS2TokenForSealedKey produces a JSON encoded LUKS2 token that conforms to the LUKS2 token schema, for the sealed key data
+// file created by SealKeyToTPM at the path specified by keyPath. The token can be imported in to a LUKS2 header, eg, with
+// "cryptsetup token import", so that the sealed key travels inside of the LUKS2 header rather than in a separate file.
+//
+// If the EmbedKeyData field of params is set, the contents of the sealed key data file are embedded in the token. Note that an
+// embedded copy of the sealed key data isn't updated by functions that update the sealed key data file (such as
+// UpdateKeyPCRProtectionPolicy), and so the token must be recreated after the file has been updated. If EmbedKeyData is not set,
+// the token records the absolute path of the sealed key data file.
+//
+// If the sealed key data file cannot be deserialized successfully, a InvalidKeyFileError error will be returned. An error will be
+// returned if the token type is invalid, if the keyslot is out of range or if the encoded token exceeds the size limit of 8KiB.
+func MakeLUKS2TokenForSealedKey(keyPath string, params *LUKS2TokenParams) ([]byte, error) {
+	if params == nil {
+		params = &LUKS2TokenParams{}
+	}
+
+	tokenType := params.Type
+	if tokenType == "" {
+		tokenType = LUKS2TokenTypeSecboot
+	}
+	if err := validateLUKS2TokenType(tokenType); err != nil {
+		return nil, xerrors.Errorf("invalid token type: %w", err)
+	}
+	if params.Keyslot < 0 || params.Keyslot >= luks2NumKeyslots {
+		return nil, errors.New("invalid keyslot")
+	}
+
+	keyData, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read key data file: %w", err)
+	}
+	if _, err := decodeKeyData(bytes.NewReader(keyData)); err != nil {
+		return nil, InvalidKeyFileError{err.Error()}
+	}
+
+	token := luks2TokenData{
+		Type:     tokenType,
+		Keyslots: []string{strconv.Itoa(params.Keyslot)}}
+	if params.EmbedKeyData {
+		token.KeyData = keyData
+	} else {
+		token.KeyFile, err = filepath.Abs(keyPath)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine absolute path of key data file: %w", err)
+		}
+	}
+
+	b, err := json.Marshal(&token)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot encode token: %w", err)
+	}
+	if len(b) > maxLUKS2TokenSize {
+		return nil, fmt.Errorf("encoded token is too large (%d bytes, max %d bytes)", len(b), maxLUKS2TokenSize)
+	}
+	return b, nil
+}
+
+// LUKS2Token corresponds to a decoded LUKS2 token that references a sealed key object.
+type LUKS2Token struct {
+	Type    string // The LUKS2 token type
+	Keyslot int    // The LUKS2 keyslot that the sealed key unlocks
+	KeyPath string // The path of the sealed key data file, if the token references one
+	KeyData []byte // The embedded sealed key data, if the token embeds it
+}
+
+// DecodeLUKS2Token decodes the supplied JSON encoded LUKS2 token, as produced by MakeLUKS2TokenForSealedKey. An error will be
+// returned if the token exceeds the size limit, if it has an invalid type, if it doesn't reference exactly one valid keyslot, or if
+// it doesn't either reference or embed sealed key data.
+func DecodeLUKS2Token(data []byte) (*LUKS2Token, error) {
+	if len(data) > maxLUKS2TokenSize {
+		return nil, fmt.Errorf("token is too large (%d bytes, max %d bytes)", len(data), maxLUKS2TokenSize)
+	}
+
+	var token luks2TokenData
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, xerrors.Errorf("cannot decode token: %w", err)
+	}
+
+	if err := validateLUKS2TokenType(token.Type); err != nil {
+		return nil, xerrors.Errorf("invalid token type: %w", err)
+	}
+	if len(token.Keyslots) != 1 {
+		return nil, errors.New("token must reference exactly one keyslot")
+	}
+	keyslot, err := strconv.Atoi(token.Keyslots[0])
+	if err != nil || keyslot < 0 || keyslot >= luks2NumKeyslots {
+		return nil, errors.New("token references an invalid keyslot")
+	}
+
+	switch {
+	case token.KeyFile != "" && len(token.KeyData) > 0:
+		return nil, errors.New("token both references and embeds sealed key data")
+	case token.KeyFile == "" && len(token.KeyData) == 0:
+		return nil, errors.New("token doesn't contain a reference to sealed key data")
+	}
+
+	return &LUKS2Token{Type: token.Type, Keyslot: keyslot, KeyPath: token.KeyFile, KeyData: token.KeyData}, nil
+}
+
+// ReadSealedKeyObject returns the sealed key object associated with this token. If the token embeds the sealed key data, it is
+// decoded directly from the token. Otherwise, it is loaded from the referenced file with ReadSealedKeyObject. If the key data
+// cannot be deserialized successfully, a InvalidKeyFileError error will be returned.
+func (t *LUKS2Token) ReadSealedKeyObject() (*SealedKeyObject, error) {
+	if len(t.KeyData) == 0 {
+		return ReadSealedKeyObject(t.KeyPath)
+	}
+
+	data, err := decodeKeyData(bytes.NewReader(t.KeyData))
+	if err != nil {
+		return nil, InvalidKeyFileError{err.Error()}
+	}
+	return &SealedKeyObject{data: data}, nil
+}
+
+// ReadSealedKeyObjectFromLUKS2Token decodes the supplied JSON encoded LUKS2 token with DecodeLUKS2Token, and then returns the
+// sealed key object that it references or embeds.
+func ReadSealedKeyObjectFromLUKS2Token(data []byte) (*SealedKeyObject, error) {
+	token, err := DecodeLUKS2Token(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode LUKS2 token: %w", err)
+	}
+	return token.ReadSealedKeyObject()
+}
+
+// luks2Metadata is the part of the JSON metadata area of a LUKS2 header that is used by this package, as produced by
+// "cryptsetup luksDump --dump-json-metadata".
+type luks2Metadata struct {
+	Tokens map[string]json.RawMessage `json:"tokens"`
+}
+
+// readLUKS2TokenFromHeader searches the LUKS2 header of the container at the specified device path for a token of the specified
+// type that references a sealed key object. The JSON metadata of the header is obtained with a single invocation of
+// "cryptsetup luksDump --dump-json-metadata", and the token of the specified type with the lowest ID is decoded with
+// DecodeLUKS2Token.
+//
+// If there is no token of the specified type or the token can't be decoded, a InvalidKeyFileError error will be returned. If the
+// header metadata cannot be obtained or parsed, an error describing the failure will be returned.
+func readLUKS2TokenFromHeader(devicePath, tokenType string) (*LUKS2Token, error) {
+	cmd := exec.Command("cryptsetup", "luksDump", "--dump-json-metadata", devicePath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read LUKS2 header metadata: %w", osutil.OutputErr(stderr.Bytes(), err))
+	}
+
+	var metadata luks2Metadata
+	if err := json.Unmarshal(output, &metadata); err != nil {
+		return nil, xerrors.Errorf("cannot decode LUKS2 header metadata: %w", err)
+	}
+
+	var ids []int
+	for k := range metadata.Tokens {
+		id, err := strconv.Atoi(k)
+		if err != nil || id < 0 || id >= luks2NumTokens {
+			return nil, fmt.Errorf("invalid token ID %q in LUKS2 header metadata", k)
+		}
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		data := metadata.Tokens[strconv.Itoa(id)]
+
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(data, &header); err != nil {
+			return nil, xerrors.Errorf("cannot decode token %d in LUKS2 header metadata: %w", id, err)
+		}
+		if header.Type != tokenType {
+			continue
+		}
+
+		token, err := DecodeLUKS2Token(data)
+		if err != nil {
+			return nil, InvalidKeyFileError{fmt.Sprintf("cannot decode token %d: %v", id, err)}
+		}
+		return token, nil
+	}
+
+	return nil, InvalidKeyFileError{fmt.Sprintf("no token of type %q found in LUKS2 header", tokenType)}
+}
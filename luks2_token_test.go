@@ -0,0 +1,131 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestLUKS2Token(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestLUKS2Token_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0, Label: "foo"}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	for _, data := range []struct {
+		desc   string
+		params *LUKS2TokenParams
+		typ    string
+		slot   int
+	}{
+		{
+			desc: "Reference",
+			typ:  LUKS2TokenTypeSecboot,
+		},
+		{
+			desc:   "Embedded",
+			params: &LUKS2TokenParams{Type: "ubuntu-fde", Keyslot: 3, EmbedKeyData: true},
+			typ:    "ubuntu-fde",
+			slot:   3,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			b, err := MakeLUKS2TokenForSealedKey(keyFile, data.params)
+			if err != nil {
+				t.Fatalf("MakeLUKS2TokenForSealedKey failed: %v", err)
+			}
+
+			var raw map[string]interface{}
+			if err := json.Unmarshal(b, &raw); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if raw["type"] != data.typ {
+				t.Errorf("Unexpected token type: %v", raw["type"])
+			}
+
+			token, err := DecodeLUKS2Token(b)
+			if err != nil {
+				t.Fatalf("DecodeLUKS2Token failed: %v", err)
+			}
+			if token.Type != data.typ || token.Keyslot != data.slot {
+				t.Errorf("Unexpected token (type: %s, keyslot: %d)", token.Type, token.Keyslot)
+			}
+
+			k, err := ReadSealedKeyObjectFromLUKS2Token(b)
+			if err != nil {
+				t.Fatalf("ReadSealedKeyObjectFromLUKS2Token failed: %v", err)
+			}
+			if k.Label() != "foo" {
+				t.Errorf("Unexpected sealed key object")
+			}
+		})
+	}
+
+	t.Run("InvalidType", func(t *testing.T) {
+		for _, typ := range []string{"luks2-keyring", "foo bar"} {
+			if _, err := MakeLUKS2TokenForSealedKey(keyFile, &LUKS2TokenParams{Type: typ}); err == nil {
+				t.Errorf("MakeLUKS2TokenForSealedKey should have failed for type %q", typ)
+			}
+		}
+	})
+
+	t.Run("InvalidKeyslot", func(t *testing.T) {
+		if _, err := MakeLUKS2TokenForSealedKey(keyFile, &LUKS2TokenParams{Keyslot: 32}); err == nil || err.Error() != "invalid keyslot" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DecodeInvalid", func(t *testing.T) {
+		for _, s := range []string{
+			`{"type":"secboot-tpm2","keyslots":[]}`,
+			`{"type":"secboot-tpm2","keyslots":["0"]}`,
+			`{"type":"","keyslots":["0"],"secboot-key-file":"/foo"}`,
+			`{"type":"secboot-tpm2","keyslots":["x"],"secboot-key-file":"/foo"}`,
+		} {
+			if _, err := DecodeLUKS2Token([]byte(s)); err == nil {
+				t.Errorf("DecodeLUKS2Token should have failed for %s", s)
+			}
+		}
+	})
+}
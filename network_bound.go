@@ -0,0 +1,206 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	// networkSecretNVIndexAttrs are the attributes for a NV index created by createNetworkSecretNVIndex. The index is exempt from
+	// dictionary attack protection because its authorization value is a high entropy secret provided by a remote service, and
+	// failing to obtain the correct secret from the service shouldn't lock out the TPM.
+	networkSecretNVIndexAttrs = tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA)
+)
+
+// createNetworkSecretNVIndex creates a NV index at the specified handle with the specified authorization value, for use with a
+// TPM2_PolicySecret assertion in the authorization policy of a sealed key object that requires a secret provided by a remote
+// service in order to unseal it (network-bound unlocking). The authorization value is provided by the remote service when the key
+// is sealed, and again each time the key is unsealed.
+//
+// In order to stop an adversary with knowledge of the owner authorization from undefining the index and recreating it with the
+// same name and a different authorization value, the index is created with an authorization policy that only permits the initial
+// write with an assertion signed by an ephemeral key, which is discarded once the index has been initialized. This is the same
+// approach used for the PIN NV index - see createPinNVIndex.
+//
+// On success, the public area of the initialized index is returned.
+func createNetworkSecretNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, nameAlg tpm2.HashAlgorithmId, authValue []byte, session tpm2.SessionContext) (*tpm2.NVPublic, error) {
+	initKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot create signing key for initializing NV index: %w", err)
+	}
+
+	initKeyPublic := createPublicAreaForRSASigningKey(&initKey.PublicKey)
+	initKeyName, err := initKeyPublic.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of signing key for initializing NV index: %w", err)
+	}
+
+	// Compute a policy for initialization which requires an assertion signed with an ephemeral key (initKey).
+	trial, _ := tpm2.ComputeAuthPolicy(nameAlg)
+	trial.PolicyCommandCode(tpm2.CommandNVWrite)
+	trial.PolicyNvWritten(false)
+	trial.PolicySigned(initKeyName, nil)
+
+	// Define the NV index. Parameter encryption is used to protect the authorization value.
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      networkSecretNVIndexAttrs,
+		AuthPolicy: trial.GetDigest(),
+		Size:       0}
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), authValue, public, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot define NV space: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+	}()
+
+	// Begin a session to initialize the index.
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, nameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot begin policy session to initialize NV index: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	// Compute a digest for signing with our key
+	signDigest := tpm2.HashAlgorithmSHA256
+	h := signDigest.NewHash()
+	h.Write(policySession.NonceTPM())
+	binary.Write(h, binary.BigEndian, int32(0))
+
+	// Sign the digest
+	sig, err := rsa.SignPSS(rand.Reader, initKey, signDigest.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
+	}
+
+	// Load the public part of the key in to the TPM. There's no integrity protection for this command as if it's altered in
+	// transit then either the signature verification fails or the policy digest will not match the one associated with the NV
+	// index.
+	initKeyContext, err := tpm.LoadExternal(nil, initKeyPublic, tpm2.HandleEndorsement)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot load public part of key used to initialize NV index to the TPM: %w", err)
+	}
+	defer tpm.FlushContext(initKeyContext)
+
+	signature := tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgRSAPSS,
+		Signature: tpm2.SignatureU{
+			Data: &tpm2.SignatureRSAPSS{
+				Hash: signDigest,
+				Sig:  tpm2.PublicKeyRSA(sig)}}}
+
+	// Execute the policy assertions
+	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandNVWrite); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion to initialize NV index: %w", err)
+	}
+	if err := tpm.PolicyNvWritten(policySession, false); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion to initialize NV index: %w", err)
+	}
+	if _, _, err := tpm.PolicySigned(initKeyContext, policySession, true, nil, nil, 0, &signature); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion to initialize NV index: %w", err)
+	}
+
+	// Initialize the index
+	if err := tpm.NVWrite(index, index, nil, 0, policySession, session.IncludeAttrs(tpm2.AttrAudit)); err != nil {
+		return nil, xerrors.Errorf("cannot initialize NV index: %w", err)
+	}
+
+	// The index has a different name now that it has been written, so update the public area we return so that it can be used
+	// to construct an authorization policy.
+	public.Attrs |= tpm2.AttrNVWritten
+
+	succeeded = true
+	return public, nil
+}
+
+// executeNetworkSecretAssertion executes the TPM2_PolicySecret assertion for the network secret NV index in the supplied policy
+// session if the sealed key object is network-bound, converting errors in to the errors documented for
+// UnsealFromTPMWithNetworkSecret.
+func (k *SealedKeyObject) executeNetworkSecretAssertion(tpm *TPMConnection, policySession, hmacSession tpm2.SessionContext, secret []byte) error {
+	if k.data.networkSecretIndexHandle == 0 {
+		return nil
+	}
+	if len(secret) == 0 {
+		return ErrNetworkSecretRequired
+	}
+
+	handle := k.data.networkSecretIndexHandle
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return InvalidKeyFileError{"network secret NV index handle is invalid"}
+	}
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return InvalidKeyFileError{"network secret NV index is unavailable"}
+	case err != nil:
+		return xerrors.Errorf("cannot create context for network secret NV index: %w", err)
+	}
+
+	index.SetAuthValue(secret)
+	_, _, err = tpm.PolicySecret(index, policySession, nil, nil, 0, hmacSession)
+	switch {
+	case isAuthFailError(err, tpm2.CommandPolicySecret, 1):
+		return ErrNetworkSecretFail
+	case err != nil:
+		return xerrors.Errorf("cannot execute network secret assertion: %w", err)
+	}
+	return nil
+}
+
+// IsNetworkBound indicates whether this sealed key object was created with the NetworkSecretIndexHandle field of
+// KeyCreationParams set, in which case it can only be unsealed with UnsealFromTPMWithNetworkSecret.
+func (k *SealedKeyObject) IsNetworkBound() bool {
+	return k.data.networkSecretIndexHandle != 0
+}
+
+// UnsealFromTPMWithNetworkSecret will unseal a network-bound sealed key object in the same way as UnsealFromTPM, using the secret
+// provided by the remote service to satisfy the TPM2_PolicySecret assertion for the network secret NV index. The network secret
+// assertion is in addition to the PCR, PIN and other assertions of the authorization policy, so the key can only be unsealed if
+// all of these are satisfied and the remote service has provided the correct secret. It is not required for the admin override.
+//
+// If the sealed key object is not network-bound, the supplied secret is ignored.
+//
+// If no secret is supplied, a ErrNetworkSecretRequired error will be returned. If the supplied secret is incorrect, a
+// ErrNetworkSecretFail error will be returned. The network secret NV index is not protected by the TPM's dictionary attack logic.
+//
+// If the network secret NV index is missing, a InvalidKeyFileError error will be returned.
+//
+// Otherwise, this returns the same errors as UnsealFromTPM.
+func (k *SealedKeyObject) UnsealFromTPMWithNetworkSecret(tpm *TPMConnection, pin string, secret []byte) ([]byte, error) {
+	if !k.IsNetworkBound() {
+		secret = nil
+	}
+	return k.unsealFromTPM(tpm, pin, secret, 0)
+}
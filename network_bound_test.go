@@ -0,0 +1,114 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestUnsealWithNetworkSecret(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithNetworkSecret_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:               NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23),
+		PINHandle:                0x01810000,
+		NetworkSecretIndexHandle: 0x01810001,
+		NetworkSecret:            secret}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+	defer func() {
+		index, err := tpm.CreateResourceContextFromTPM(0x01810001)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}()
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.IsNetworkBound() {
+		t.Errorf("Sealed key object should be network-bound")
+	}
+	if err := tpm.VerifyPINIndex(k); err != nil {
+		t.Errorf("VerifyPINIndex failed: %v", err)
+	}
+
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrNetworkSecretRequired {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := k.UnsealFromTPMWithNetworkSecret(tpm, "", []byte("foo")); err != ErrNetworkSecretFail {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	keyUnsealed, err := k.UnsealFromTPMWithNetworkSecret(tpm, "", secret)
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithNetworkSecret failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	// The network secret assertion is in addition to the PCR policy.
+	defer func() {
+		if err := tpm.PCRReset(tpm.PCRHandleContext(23), nil); err != nil {
+			t.Errorf("PCRReset failed: %v", err)
+		}
+	}()
+	if err := tpm.PCRExtend(tpm.PCRHandleContext(23), tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}}, nil); err != nil {
+		t.Fatalf("PCRExtend failed: %v", err)
+	}
+	if _, err := k.UnsealFromTPMWithNetworkSecret(tpm, "", secret); err == nil {
+		t.Errorf("UnsealFromTPMWithNetworkSecret should have failed")
+	}
+}
@@ -0,0 +1,187 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// NVCapabilities describes the NV index capabilities of a TPM.
+type NVCapabilities struct {
+	// MaxIndexSize is the maximum size of a NV index's data area, obtained from the TPM_PT_NV_INDEX_MAX property.
+	MaxIndexSize uint32
+
+	// SupportedTypes contains the NV index types that the TPM supports. Ordinary indices are always supported. Support for the
+	// other types is determined from whether the TPM implements the commands required to write to them (TPM2_NV_Increment for
+	// counter indices, TPM2_NV_SetBits for bit field indices and TPM2_NV_Extend for extend indices). The TPM doesn't indicate
+	// support for PIN pass and PIN fail indices, so these are never included.
+	SupportedTypes []tpm2.NVType
+}
+
+// SupportsType indicates whether the TPM supports NV indices of the specified type.
+func (c *NVCapabilities) SupportsType(t tpm2.NVType) bool {
+	for _, s := range c.SupportedTypes {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// isCommandSupported indicates whether the TPM implements the specified command.
+func isCommandSupported(tpm *tpm2.TPMContext, command tpm2.CommandCode, session tpm2.SessionContext) (bool, error) {
+	cmds, err := tpm.GetCapabilityCommands(command, 1, session)
+	if err != nil {
+		return false, err
+	}
+	return len(cmds) > 0 && cmds[0].CommandCode() == command, nil
+}
+
+// readNVCapabilities obtains the NV index capabilities of the TPM.
+func readNVCapabilities(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*NVCapabilities, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyNVIndexMax, 1, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot request NV index properties from TPM: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyNVIndexMax {
+		return nil, fmt.Errorf("TPM did not return the %v property", tpm2.PropertyNVIndexMax)
+	}
+
+	caps := &NVCapabilities{MaxIndexSize: props[0].Value, SupportedTypes: []tpm2.NVType{tpm2.NVTypeOrdinary}}
+
+	for _, t := range []struct {
+		command tpm2.CommandCode
+		nvType  tpm2.NVType
+	}{
+		{command: tpm2.CommandNVIncrement, nvType: tpm2.NVTypeCounter},
+		{command: tpm2.CommandNVSetBits, nvType: tpm2.NVTypeBits},
+		{command: tpm2.CommandNVExtend, nvType: tpm2.NVTypeExtend},
+	} {
+		supported, err := isCommandSupported(tpm, t.command, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot determine if %v is supported: %w", t.command, err)
+		}
+		if supported {
+			caps.SupportedTypes = append(caps.SupportedTypes, t.nvType)
+		}
+	}
+
+	return caps, nil
+}
+
+// checkNVIndexFits checks that the TPM supports NV indices of the specified type and size. If the TPM doesn't support NV counter
+// indices, a ErrNoNVCounterSupport error is returned.
+func checkNVIndexFits(tpm *tpm2.TPMContext, nvType tpm2.NVType, size uint16, session tpm2.SessionContext) error {
+	caps, err := readNVCapabilities(tpm, session)
+	if err != nil {
+		return err
+	}
+	if !caps.SupportsType(nvType) {
+		if nvType == tpm2.NVTypeCounter {
+			return ErrNoNVCounterSupport
+		}
+		return fmt.Errorf("the TPM does not support NV indices of type %v", nvType)
+	}
+	if uint32(size) > caps.MaxIndexSize {
+		return fmt.Errorf("the TPM does not support NV indices of %d bytes (maximum size is %d bytes)", size, caps.MaxIndexSize)
+	}
+	return nil
+}
+
+// NVCapabilities returns the NV index capabilities of the TPM, which can be used to determine whether the TPM supports the NV
+// indices that SealKeyToTPM needs to create.
+func (t *TPMConnection) NVCapabilities() (*NVCapabilities, error) {
+	return readNVCapabilities(t.TPMContext, t.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+}
+
+// readNVBufferMax obtains the maximum size of the data buffer for a single TPM2_NV_Read or TPM2_NV_Write command from the
+// TPM_PT_NV_BUFFER_MAX property. This can be overridden in tests to simulate a TPM with a small command buffer.
+var readNVBufferMax = func(tpm *tpm2.TPMContext) (int, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyNVBufferMax, 1)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot request NV buffer size from TPM: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyNVBufferMax || props[0].Value == 0 {
+		return 0, fmt.Errorf("TPM did not return the %v property", tpm2.PropertyNVBufferMax)
+	}
+	return int(props[0].Value), nil
+}
+
+// nvWrite writes the supplied data to the NV index associated with index at the specified offset, splitting it in to multiple
+// TPM2_NV_Write commands that are each no larger than the TPM's maximum NV buffer size. This allows arbitrary length data to be
+// written on TPMs with a small command buffer.
+//
+// The same authorization session is used for each command, so it must not be a policy session if more than one command is
+// required. HMAC sessions must have the AttrContinueSession attribute set.
+func nvWrite(tpm *tpm2.TPMContext, authContext, index tpm2.ResourceContext, data []byte, offset uint16, authContextAuthSession tpm2.SessionContext, sessions ...tpm2.SessionContext) error {
+	if len(data) == 0 {
+		return tpm.NVWrite(authContext, index, nil, offset, authContextAuthSession, sessions...)
+	}
+
+	max, err := readNVBufferMax(tpm)
+	if err != nil {
+		return err
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > max {
+			n = max
+		}
+		if err := tpm.NVWrite(authContext, index, data[:n], offset, authContextAuthSession, sessions...); err != nil {
+			return err
+		}
+		data = data[n:]
+		offset += uint16(n)
+	}
+	return nil
+}
+
+// nvRead reads size bytes from the NV index associated with index at the specified offset, splitting the read in to multiple
+// TPM2_NV_Read commands that are each no larger than the TPM's maximum NV buffer size.
+//
+// The same authorization session is used for each command, so it must not be a policy session if more than one command is
+// required. HMAC sessions must have the AttrContinueSession attribute set.
+func nvRead(tpm *tpm2.TPMContext, authContext, index tpm2.ResourceContext, size, offset uint16, authContextAuthSession tpm2.SessionContext, sessions ...tpm2.SessionContext) ([]byte, error) {
+	max, err := readNVBufferMax(tpm)
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for size > 0 {
+		n := size
+		if int(n) > max {
+			n = uint16(max)
+		}
+		chunk, err := tpm.NVRead(authContext, index, n, offset, authContextAuthSession, sessions...)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+		size -= n
+		offset += n
+	}
+	return data, nil
+}
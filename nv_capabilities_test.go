@@ -0,0 +1,111 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestNVCapabilities(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	caps, err := tpm.NVCapabilities()
+	if err != nil {
+		t.Fatalf("NVCapabilities failed: %v", err)
+	}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyNVIndexMax, 1)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if caps.MaxIndexSize != props[0].Value {
+		t.Errorf("Unexpected maximum index size (got %d, expected %d)", caps.MaxIndexSize, props[0].Value)
+	}
+	if caps.MaxIndexSize < 8 {
+		t.Errorf("Maximum index size is too small: %d", caps.MaxIndexSize)
+	}
+
+	for _, nvType := range []tpm2.NVType{tpm2.NVTypeOrdinary, tpm2.NVTypeCounter, tpm2.NVTypeBits, tpm2.NVTypeExtend} {
+		if !caps.SupportsType(nvType) {
+			t.Errorf("Expected NV index type %v to be supported", nvType)
+		}
+	}
+	if caps.SupportsType(tpm2.NVTypePinFail) {
+		t.Errorf("NV PIN fail indices should not be reported as supported")
+	}
+}
+
+func TestNVWriteAndReadWithSmallBuffer(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	restore := MockNVBufferMax(16)
+	defer restore()
+
+	data := make([]byte, 100)
+	rand.Read(data)
+
+	public := tpm2.NVPublic{
+		Index:   0x01810000,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    uint16(len(data))}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+	if err != nil {
+		t.Fatalf("NVDefineSpace failed: %v", err)
+	}
+	defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+
+	var writes, reads int
+	tpm.SetCommandObserver(func(command tpm2.CommandCode, _ time.Duration, _ tpm2.ResponseCode) {
+		switch command {
+		case tpm2.CommandNVWrite:
+			writes++
+		case tpm2.CommandNVRead:
+			reads++
+		}
+	})
+	defer tpm.SetCommandObserver(nil)
+
+	if err := NVWrite(tpm.TPMContext, index, index, data, 0, nil); err != nil {
+		t.Fatalf("NVWrite failed: %v", err)
+	}
+	if writes != 7 {
+		t.Errorf("Unexpected number of TPM2_NV_Write commands (%d)", writes)
+	}
+
+	readData, err := NVRead(tpm.TPMContext, index, index, public.Size, 0, nil)
+	if err != nil {
+		t.Fatalf("NVRead failed: %v", err)
+	}
+	if reads != 7 {
+		t.Errorf("Unexpected number of TPM2_NV_Read commands (%d)", reads)
+	}
+	if !bytes.Equal(readData, data) {
+		t.Errorf("Unexpected data read back from NV index")
+	}
+}
@@ -0,0 +1,130 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	nvUndefineRetryInterval = 100 * time.Millisecond
+	nvUndefineRetryTimeout  = 10 * time.Second
+)
+
+// isTransientNVError indicates whether err is a TPM warning that indicates that the command may succeed if it is retried.
+func isTransientNVError(err error) bool {
+	for _, code := range []tpm2.WarningCode{tpm2.WarningRetry, tpm2.WarningYielded, tpm2.WarningTesting, tpm2.WarningNVRate,
+		tpm2.WarningNVUnavailable} {
+		if tpm2.IsTPMWarning(err, code, tpm2.AnyCommandCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// undefineNVIndex makes a single attempt to undefine the NV index at the specified handle, using the authorization of the
+// hierarchy that created it.
+func (t *TPMConnection) undefineNVIndex(handle tpm2.Handle) error {
+	index, err := t.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil
+	case err != nil:
+		return xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+
+	pub, _, err := t.NVReadPublic(index)
+	if err != nil {
+		return xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	if pub.Attrs&tpm2.AttrNVPolicyDelete != 0 {
+		return errors.New("the NV index can only be undefined with TPM2_NV_UndefineSpaceSpecial")
+	}
+
+	hierarchy := t.OwnerHandleContext()
+	if pub.Attrs&tpm2.AttrNVPlatformCreate != 0 {
+		hierarchy = t.PlatformHandleContext()
+	}
+
+	err = t.NVUndefineSpace(hierarchy, index, t.HmacSession())
+	switch {
+	case err == nil:
+		return nil
+	case tpm2.IsTPMHandleError(err, tpm2.ErrorHandle, tpm2.CommandNVUndefineSpace, 2):
+		// The NV index was undefined by someone else after we created the context for it.
+		return nil
+	case hierarchy.Handle() == tpm2.HandlePlatform &&
+		(isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1) ||
+			tpm2.IsTPMHandleError(err, tpm2.ErrorHierarchy, tpm2.CommandNVUndefineSpace, 1)):
+		return ErrNVIndexRequiresPlatformAuth
+	case isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1):
+		return AuthFailError{hierarchy.Handle()}
+	default:
+		return xerrors.Errorf("cannot undefine NV index: %w", err)
+	}
+}
+
+// UndefineNVIndex undefines the NV index at the specified handle. It is intended for cleanup and decommissioning tools that need to
+// reliably remove NV indices created by this package (eg, PIN NV indices that are no longer used by any sealed key object), and is
+// more robust than calling TPMConnection.NVUndefineSpace directly.
+//
+// The NV index is undefined with the authorization of the hierarchy that created it - the platform hierarchy if it has the
+// TPMA_NV_PLATFORMCREATE attribute, or the owner hierarchy otherwise. The authorization value of the NV index itself is never
+// used, so NV indices that are read or write locked (for which commands authorized by the NV index would fail with
+// TPM_RC_NV_LOCKED) can still be undefined. The authorization value for the owner hierarchy is the one set on the
+// ResourceContext returned from TPMConnection.OwnerHandleContext.
+//
+// If the TPM responds with a warning that indicates that the command may succeed if it is retried (TPM_RC_RETRY, TPM_RC_YIELDED,
+// TPM_RC_TESTING, TPM_RC_NV_RATE or TPM_RC_NV_UNAVAILABLE), the operation is retried until it succeeds, or until a timeout is
+// reached in which case an error is returned. Any other error is returned immediately.
+//
+// If there is no NV index at the specified handle, it is considered to be already undefined and no error is returned.
+//
+// If the NV index was created by the platform and the platform hierarchy is disabled or its authorization value is not known,
+// a ErrNVIndexRequiresPlatformAuth error will be returned. This generally means that the NV index can only be undefined by the
+// platform firmware, or by clearing the TPM.
+//
+// If the NV index was created by the owner and the authorization value for the owner hierarchy is incorrect, a AuthFailError
+// error will be returned.
+func (t *TPMConnection) UndefineNVIndex(handle tpm2.Handle) error {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return fmt.Errorf("invalid NV index handle %v", handle)
+	}
+
+	for start := time.Now(); ; time.Sleep(nvUndefineRetryInterval) {
+		err := t.undefineNVIndex(handle)
+		switch {
+		case err == nil:
+			return nil
+		case isTransientNVError(err) && time.Since(start) < nvUndefineRetryTimeout:
+			continue
+		case isTransientNVError(err):
+			return xerrors.Errorf("timeout waiting for the TPM to undefine NV index: %w", err)
+		default:
+			return err
+		}
+	}
+}
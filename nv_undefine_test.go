@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestUndefineNVIndex(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	define := func(t *testing.T, auth tpm2.ResourceContext, attrs tpm2.NVAttributes) tpm2.ResourceContext {
+		public := tpm2.NVPublic{
+			Index:   0x01810000,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA | attrs),
+			Size:    8}
+		index, err := tpm.NVDefineSpace(auth, nil, &public, nil)
+		if err != nil {
+			t.Fatalf("NVDefineSpace failed: %v", err)
+		}
+		return index
+	}
+
+	checkUndefined := func(t *testing.T) {
+		if _, err := tpm.CreateResourceContextFromTPM(0x01810000); !tpm2.IsResourceUnavailableError(err, 0x01810000) {
+			t.Errorf("NV index should have been undefined (error: %v)", err)
+		}
+	}
+
+	t.Run("WriteLocked", func(t *testing.T) {
+		index := define(t, tpm.OwnerHandleContext(), tpm2.AttrNVWriteDefine)
+		if err := tpm.NVWrite(index, index, make([]byte, 8), 0, nil); err != nil {
+			t.Fatalf("NVWrite failed: %v", err)
+		}
+		if err := tpm.NVWriteLock(index, index, nil); err != nil {
+			t.Fatalf("NVWriteLock failed: %v", err)
+		}
+
+		if err := tpm.UndefineNVIndex(0x01810000); err != nil {
+			t.Fatalf("UndefineNVIndex failed: %v", err)
+		}
+		checkUndefined(t)
+	})
+
+	t.Run("AlreadyUndefined", func(t *testing.T) {
+		if err := tpm.UndefineNVIndex(0x01810000); err != nil {
+			t.Errorf("UndefineNVIndex failed: %v", err)
+		}
+	})
+
+	t.Run("InvalidHandle", func(t *testing.T) {
+		if err := tpm.UndefineNVIndex(0x81000001); err == nil {
+			t.Errorf("UndefineNVIndex should have failed")
+		}
+	})
+
+	t.Run("PlatformCreated", func(t *testing.T) {
+		define(t, tpm.PlatformHandleContext(), tpm2.AttrNVPlatformCreate)
+
+		if err := tpm.UndefineNVIndex(0x01810000); err != nil {
+			t.Fatalf("UndefineNVIndex failed: %v", err)
+		}
+		checkUndefined(t)
+	})
+
+	t.Run("PlatformHierarchyDisabled", func(t *testing.T) {
+		index := define(t, tpm.PlatformHandleContext(), tpm2.AttrNVPlatformCreate)
+		defer func() {
+			resetTPMSimulator(t, tpm, tcti)
+			undefineNVSpace(t, tpm, index, tpm.PlatformHandleContext())
+		}()
+
+		if err := tpm.HierarchyControl(tpm.PlatformHandleContext(), tpm2.HandlePlatform, false, nil); err != nil {
+			t.Fatalf("HierarchyControl failed: %v", err)
+		}
+
+		if err := tpm.UndefineNVIndex(0x01810000); err != ErrNVIndexRequiresPlatformAuth {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("OwnerAuthFail", func(t *testing.T) {
+		index := define(t, tpm.OwnerHandleContext(), 0)
+		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+
+		setHierarchyAuthForTest(t, tpm, tpm.OwnerHandleContext())
+		defer resetHierarchyAuth(t, tpm, tpm.OwnerHandleContext())
+		tpm.OwnerHandleContext().SetAuthValue(nil)
+		defer tpm.OwnerHandleContext().SetAuthValue(testAuth)
+
+		err := tpm.UndefineNVIndex(0x01810000)
+		if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleOwner {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// efiImagePathRE matches a path to an EFI executable in the string representation of an EFI device path.
+var efiImagePathRE = regexp.MustCompile(`(?i)((?:\\[^\\()\s,]+)+\.efi)`)
+
+// PCRChangeAttribution describes the measured event that is responsible for a PCR having a different value in the current boot
+// to the value it had in a reference boot (eg, the boot during which a sealed key's PCR protection policy was computed).
+type PCRChangeAttribution struct {
+	PCR int // The PCR that has a different value
+
+	// EventIndex is the index of the first event measured to PCR that differs from the reference boot, counting only the events
+	// measured to PCR.
+	EventIndex int
+
+	EventType   tcglog.EventType // The type of the responsible event
+	Description string           // The string representation of the responsible event's data
+
+	// ImagePath is the path of the measured EFI executable, for events that correspond to an EFI image load. It is empty for
+	// other events.
+	ImagePath string
+
+	// Component is a short name for the measured component. This is the base name of ImagePath for events that correspond to an
+	// EFI image load, or the event type for other events.
+	Component string
+
+	// ReferenceDigest is the digest of the event at EventIndex in the reference boot. It is nil if the current boot has more
+	// events measured to PCR than the reference boot.
+	ReferenceDigest tpm2.Digest
+
+	// CurrentDigest is the digest of the event at EventIndex in the current boot. It is nil if the current boot has fewer events
+	// measured to PCR than the reference boot, in which case the other fields describe the missing event from the reference boot.
+	CurrentDigest tpm2.Digest
+}
+
+func (a *PCRChangeAttribution) String() string {
+	switch {
+	case a.CurrentDigest == nil:
+		return fmt.Sprintf("PCR %d changed because %s event %d (%s) was not measured", a.PCR, a.EventType, a.EventIndex, a.Component)
+	case a.ReferenceDigest == nil:
+		return fmt.Sprintf("PCR %d changed because of an additional %s event %d (%s)", a.PCR, a.EventType, a.EventIndex, a.Component)
+	default:
+		return fmt.Sprintf("PCR %d changed because %s event %d (%s) has a different digest", a.PCR, a.EventType, a.EventIndex, a.Component)
+	}
+}
+
+// readPCREvents returns the events measured to the specified PCR from the supplied log.
+func readPCREvents(log *tcglog.Log, alg tpm2.HashAlgorithmId, pcr int) ([]*tcglog.Event, error) {
+	if !log.Algorithms.Contains(tcglog.AlgorithmId(alg)) {
+		return nil, errors.New("the TCG event log does not have the requested algorithm")
+	}
+
+	var events []*tcglog.Event
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse TCG event log: %w", err)
+		}
+		if event.EventType == tcglog.EventTypeNoAction || int(event.PCRIndex) != pcr {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// makePCRChangeAttribution creates a PCRChangeAttribution for the supplied event.
+func makePCRChangeAttribution(pcr, index int, event *tcglog.Event) *PCRChangeAttribution {
+	a := &PCRChangeAttribution{
+		PCR:         pcr,
+		EventIndex:  index,
+		EventType:   event.EventType,
+		Description: event.Data.String(),
+		Component:   event.EventType.String()}
+
+	switch event.EventType {
+	case tcglog.EventTypeEFIBootServicesApplication, tcglog.EventTypeEFIBootServicesDriver, tcglog.EventTypeEFIRuntimeServicesDriver:
+		if m := efiImagePathRE.FindStringSubmatch(a.Description); m != nil {
+			a.ImagePath = m[1]
+			a.Component = path.Base(strings.Replace(m[1], "\\", "/", -1))
+		}
+	}
+
+	return a
+}
+
+// attributePCRChange identifies the first event measured to the specified PCR in current that differs from the events measured to
+// the same PCR in reference. It returns nil if the events are the same.
+func attributePCRChange(reference, current *tcglog.Log, alg tpm2.HashAlgorithmId, pcr int) (*PCRChangeAttribution, error) {
+	refEvents, err := readPCREvents(reference, alg, pcr)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read reference event log: %w", err)
+	}
+	curEvents, err := readPCREvents(current, alg, pcr)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read current event log: %w", err)
+	}
+
+	for i := 0; i < len(refEvents) || i < len(curEvents); i++ {
+		switch {
+		case i >= len(curEvents):
+			a := makePCRChangeAttribution(pcr, i, refEvents[i])
+			a.ReferenceDigest = tpm2.Digest(refEvents[i].Digests[tcglog.AlgorithmId(alg)])
+			return a, nil
+		case i >= len(refEvents):
+			a := makePCRChangeAttribution(pcr, i, curEvents[i])
+			a.CurrentDigest = tpm2.Digest(curEvents[i].Digests[tcglog.AlgorithmId(alg)])
+			return a, nil
+		}
+
+		refDigest := tpm2.Digest(refEvents[i].Digests[tcglog.AlgorithmId(alg)])
+		curDigest := tpm2.Digest(curEvents[i].Digests[tcglog.AlgorithmId(alg)])
+		if bytes.Equal(refDigest, curDigest) {
+			continue
+		}
+
+		a := makePCRChangeAttribution(pcr, i, curEvents[i])
+		a.ReferenceDigest = refDigest
+		a.CurrentDigest = curDigest
+		return a, nil
+	}
+
+	return nil, nil
+}
+
+// AttributePCRChange identifies the boot component that is responsible for the specified PCR having a different value in the current
+// boot to the value it had in a reference boot, by replaying the events measured to the PCR in the current boot's event log and
+// comparing them with those in the reference event log supplied via the reference argument (eg, a copy of the event log that was
+// saved when a sealed key's PCR protection policy was computed). Both logs may be in either the TCG or the CEL format. The divergence
+// is attributed to the first event measured to the PCR with a different digest for the specified algorithm, or to the first event
+// that is present in one log but not the other.
+//
+// This is useful for reporting why a sealed key could not be unsealed (eg, "PCR 4 changed because EV_EFI_BOOT_SERVICES_APPLICATION
+// event 2 (grubx64.efi) has a different digest" rather than "PCR 4 mismatch").
+//
+// If the events measured to the PCR are the same in both logs, nil is returned.
+func AttributePCRChange(reference io.Reader, alg tpm2.HashAlgorithmId, pcr int) (*PCRChangeAttribution, error) {
+	data, err := ioutil.ReadAll(reference)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read reference event log: %w", err)
+	}
+	refLog, err := decodeEventLog(data)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode reference event log: %w", err)
+	}
+
+	curLog, err := openEventLog()
+	if err != nil {
+		return nil, err
+	}
+
+	return attributePCRChange(refLog, curLog, alg, pcr)
+}
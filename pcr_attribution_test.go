@@ -0,0 +1,84 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"os"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type pcrAttributionSuite struct{}
+
+var _ = Suite(&pcrAttributionSuite{})
+
+func (s *pcrAttributionSuite) attribute(c *C, referencePath, currentPath string, pcr int) (*PCRChangeAttribution, error) {
+	restore := MockEventLogPath(currentPath)
+	defer restore()
+
+	f, err := os.Open(referencePath)
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	return AttributePCRChange(f, tpm2.HashAlgorithmSHA256, pcr)
+}
+
+func (s *pcrAttributionSuite) TestNoChange(c *C) {
+	a, err := s.attribute(c, "testdata/eventlog1.bin", "testdata/eventlog1.bin", 7)
+	c.Check(err, IsNil)
+	c.Check(a, IsNil)
+}
+
+func (s *pcrAttributionSuite) TestNoChangeCELLog(c *C) {
+	a, err := s.attribute(c, "testdata/eventlog1.bin", writeCELLogFromTCGLog(c, "testdata/eventlog1.bin"), 4)
+	c.Check(err, IsNil)
+	c.Check(a, IsNil)
+}
+
+func (s *pcrAttributionSuite) TestSecureBootDisabled(c *C) {
+	// eventlog3.bin is from the same machine as eventlog1.bin, but with secure boot disabled, which changes the value of the
+	// SecureBoot variable measured to PCR 7.
+	a, err := s.attribute(c, "testdata/eventlog1.bin", "testdata/eventlog3.bin", 7)
+	c.Assert(err, IsNil)
+	c.Assert(a, NotNil)
+	c.Check(a.PCR, Equals, 7)
+	c.Check(a.EventType, Equals, tcglog.EventTypeEFIVariableDriverConfig)
+	c.Check(a.Component, Equals, a.EventType.String())
+	c.Check(a.ImagePath, Equals, "")
+	c.Check(a.ReferenceDigest, NotNil)
+	c.Check(a.CurrentDigest, NotNil)
+	c.Check(a.ReferenceDigest, Not(DeepEquals), a.CurrentDigest)
+}
+
+func (s *pcrAttributionSuite) TestInvalidAlgorithm(c *C) {
+	restore := MockEventLogPath("testdata/eventlog1.bin")
+	defer restore()
+
+	f, err := os.Open("testdata/eventlog1.bin")
+	c.Assert(err, IsNil)
+	defer f.Close()
+
+	_, err = AttributePCRChange(f, tpm2.HashAlgorithmSHA512, 7)
+	c.Check(err, ErrorMatches, "cannot read reference event log: the TCG event log does not have the requested algorithm")
+}
@@ -0,0 +1,171 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// UpdateKeyPCRProtectionPolicyWithGracePeriod updates the PCR protection policy for the sealed key at the path specified by the
+// keyPath argument to the profile defined by the newProfile argument, whilst continuing to accept the PCR values defined by the
+// currentProfile argument for the duration specified by the gracePeriod argument. This is useful for staged rollouts of updates
+// that change PCR values, where a device may still need to boot with the old values for a short time (eg, if the update is rolled
+// back). In order to do this, the caller must also specify the path to the policy update data file that was saved by SealKeyToTPM.
+//
+// Both profiles must contain values for the same set of PCRs, and gracePeriod must be greater than zero.
+//
+// The grace period is measured using the TPM's clock, which only advances whilst the TPM is powered on and which may lag behind
+// slightly after an unorderly shutdown. The grace period is therefore an upper bound on the time during which the PCR values
+// defined by currentProfile are accepted, in terms of the time that the device is powered on, rather than a wall clock deadline.
+// The TPM's clock can be advanced by the owner with TPM2_ClockSet, but it can't be set back, so this can only shorten the grace
+// period. Clearing the TPM makes the sealed key file unusable anyway.
+//
+// A subsequent call to UpdateKeyPCRProtectionPolicy or UpdateKeyPCRProtectionPolicyIncremental removes the PCR values that are
+// accepted during the grace period from the policy.
+//
+// If either file cannot be opened, a wrapped *os.PathError error will be returned.
+//
+// If either file cannot be deserialized correctly or validation of the files fails, a InvalidKeyFileError error will be returned.
+//
+// On success, the sealed key data file is updated atomically with an updated authorization policy, and all previous dynamic
+// authorization policies are revoked.
+func UpdateKeyPCRProtectionPolicyWithGracePeriod(tpm *TPMConnection, keyPath, policyUpdatePath string, currentProfile, newProfile *PCRProtectionProfile, gracePeriod time.Duration) error {
+	if currentProfile == nil || newProfile == nil {
+		return errors.New("no PCR protection profile provided")
+	}
+	if gracePeriod <= 0 {
+		return errors.New("invalid grace period")
+	}
+
+	// Use the HMAC session created when the connection was opened rather than creating a new one.
+	session := tpm.HmacSession()
+
+	// Open the key data file
+	keyFile, err := os.Open(keyPath)
+	if err != nil {
+		return xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer keyFile.Close()
+
+	// Open the policy update data file
+	policyUpdateFile, err := os.Open(policyUpdatePath)
+	if err != nil {
+		return xerrors.Errorf("cannot open private data file: %w", err)
+	}
+	defer policyUpdateFile.Close()
+
+	data, policyUpdateData, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, policyUpdateFile, session)
+	if err != nil {
+		if isKeyFileError(err) {
+			return InvalidKeyFileError{err.Error()}
+		}
+		return xerrors.Errorf("cannot read and validate key data file: %w", err)
+	}
+
+	authKey := policyUpdateData.authKey
+	authPublicKey := data.staticPolicyData.AuthPublicKey
+	pinIndexAuthPolicies := data.staticPolicyData.PinIndexAuthPolicies
+
+	values, err := newProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR values from new protection profile: %w", err)
+	}
+
+	pcrs, pcrDigests, err := computePCRPolicyDigests(tpm.TPMContext, data.keyPublic.NameAlg, makePCRProtectionProfileFromValues(values), session)
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR digests from new protection profile: %w", err)
+	}
+	if len(pcrs) == 0 {
+		return errors.New("the new PCR protection profile does not contain any PCR values")
+	}
+	currentValues, err := currentProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR values from current protection profile: %w", err)
+	}
+	currentPcrs, currentPcrDigests, err := computePCRPolicyDigests(tpm.TPMContext, data.keyPublic.NameAlg,
+		makePCRProtectionProfileFromValues(currentValues), session)
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR digests from current protection profile: %w", err)
+	}
+	if !currentPcrs.Equal(pcrs) {
+		return errors.New("the current and new PCR protection profiles do not contain values for the same set of PCRs")
+	}
+
+	// Compute the value of the TPM's clock at which the grace period expires
+	timeInfo, err := tpm.ReadClock()
+	if err != nil {
+		return xerrors.Errorf("cannot read current time: %w", err)
+	}
+	expiry := timeInfo.ClockInfo.Clock + uint64(gracePeriod.Milliseconds())
+
+	// Obtain the count for the new dynamic authorization policy
+	policyCount, err := readDynamicPolicyCounter(tpm.TPMContext, pinIndexPublic, pinIndexAuthPolicies, session)
+	if err != nil {
+		return xerrors.Errorf("cannot read dynamic policy counter: %w", err)
+	}
+	countIndexName, err := pinIndexPublic.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of dynamic policy counter: %w", err)
+	}
+
+	// Compute a new dynamic authorization policy
+	policyData, err := computeDynamicPolicy(data.policyVersion(), data.keyPublic.NameAlg, &dynamicPolicyComputeParams{
+		key:                    authKey,
+		signAlg:                authPublicKey.NameAlg,
+		pcrs:                   pcrs,
+		pcrDigests:             pcrDigests,
+		policyCountIndexName:   countIndexName,
+		policyCount:            policyCount + 1,
+		userPINPolicyORDigests: data.userPINPolicyORDigests,
+		pcrGracePeriodDigests:  currentPcrDigests,
+		pcrGracePeriodExpiry:   expiry})
+	if err != nil {
+		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+
+	// Make sure that the new dynamic authorization policy is authorized by the key that the static authorization policy's
+	// TPM2_PolicyAuthorize assertion is bound to, before replacing the existing one.
+	if err := verifyDynamicPolicyAuthorization(tpm.TPMContext, data.staticPolicyData, policyData, session); err != nil {
+		return xerrors.Errorf("cannot verify new dynamic authorization policy: %w", err)
+	}
+
+	// Atomically update the key data file. Only the PCR values for the new profile are recorded, as the values accepted during the
+	// grace period are discarded by the next update.
+	data.dynamicPolicyData = policyData
+	data.pcrGracePeriodExpiry = expiry
+	data.pcrGracePeriodDigests = currentPcrDigests
+	if len(data.pcrBranchValues) > 0 {
+		data.pcrBranchValues = encodePCRBranchValues(policyData.PCRSelection, values)
+	}
+
+	if err := data.writeToFileAtomic(keyPath); err != nil {
+		return xerrors.Errorf("cannot write key data file: %v", err)
+	}
+
+	if err := incrementDynamicPolicyCounter(tpm.TPMContext, pinIndexPublic, pinIndexAuthPolicies, authKey, authPublicKey, session); err != nil {
+		return xerrors.Errorf("cannot revoke old dynamic authorization policies: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestUpdateKeyPCRProtectionPolicyWithGracePeriod(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	resetPCR := func() {
+		if err := tpm.PCRReset(tpm.PCRHandleContext(23), nil); err != nil {
+			t.Errorf("PCRReset failed: %v", err)
+		}
+	}
+	extendPCR := func() {
+		if err := tpm.PCRExtend(tpm.PCRHandleContext(23), tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}}, nil); err != nil {
+			t.Fatalf("PCRExtend failed: %v", err)
+		}
+	}
+	resetPCR()
+	defer resetPCR()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyWithGracePeriod_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	currentProfile := NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23)
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: currentProfile, PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	unseal := func() error {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		_, err = k.UnsealFromTPM(tpm, "")
+		return err
+	}
+
+	// Compute the value of PCR 23 after the next extend, and update the policy to it whilst retaining the current value for an hour.
+	h := sha256.New()
+	h.Write(make([]byte, 64))
+	newProfile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 23, h.Sum(nil))
+
+	if err := UpdateKeyPCRProtectionPolicyWithGracePeriod(tpm, keyFile, policyUpdateFile, currentProfile, newProfile, time.Hour); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicyWithGracePeriod failed: %v", err)
+	}
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	if err := unseal(); err != nil {
+		t.Errorf("UnsealFromTPM with previous PCR values failed: %v", err)
+	}
+	extendPCR()
+	if err := unseal(); err != nil {
+		t.Errorf("UnsealFromTPM with new PCR values failed: %v", err)
+	}
+
+	// Advance the TPM's clock beyond the end of the grace period.
+	timeInfo, err := tpm.ReadClock()
+	if err != nil {
+		t.Fatalf("ReadClock failed: %v", err)
+	}
+	if err := tpm.ClockSet(tpm.OwnerHandleContext(), timeInfo.ClockInfo.Clock+uint64((2*time.Hour).Milliseconds()), nil); err != nil {
+		t.Fatalf("ClockSet failed: %v", err)
+	}
+
+	if err := unseal(); err != nil {
+		t.Errorf("UnsealFromTPM with new PCR values failed: %v", err)
+	}
+	resetPCR()
+	if err := unseal(); err == nil {
+		t.Errorf("UnsealFromTPM with previous PCR values should have failed")
+	}
+
+	// A subsequent update removes the previous PCR values from the policy.
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, newProfile); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+	extendPCR()
+	if err := unseal(); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+}
+
+func TestUpdateKeyPCRProtectionPolicyWithGracePeriodMismatchedProfiles(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyWithGracePeriodMismatchedProfiles_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	err = UpdateKeyPCRProtectionPolicyWithGracePeriod(tpm, keyFile, policyUpdateFile,
+		NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+		NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23), time.Hour)
+	if err == nil || err.Error() != "the current and new PCR protection profiles do not contain values for the same set of PCRs" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,253 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// encodePCRBranchValues converts the PCR values for each branch of a PCR policy in to the on-disk format, where the values in each
+// branch are in the order defined by the supplied PCR selection.
+func encodePCRBranchValues(pcrs tpm2.PCRSelectionList, values pcrValuesList) []tpm2.DigestList {
+	out := make([]tpm2.DigestList, 0, len(values))
+	for _, v := range values {
+		var branch tpm2.DigestList
+		for _, s := range pcrs {
+			for _, pcr := range s.Select {
+				branch = append(branch, v[s.Hash][pcr])
+			}
+		}
+		out = append(out, branch)
+	}
+	return out
+}
+
+// decodePCRBranchValues converts the on-disk format of the PCR values for each branch of a PCR policy back to a set of
+// tpm2.PCRValues, using the supplied PCR selection.
+func decodePCRBranchValues(pcrs tpm2.PCRSelectionList, encoded []tpm2.DigestList) (pcrValuesList, error) {
+	if len(encoded) == 0 {
+		return nil, errors.New("no branches")
+	}
+
+	var out pcrValuesList
+	for i, branch := range encoded {
+		v := make(tpm2.PCRValues)
+		n := 0
+		for _, s := range pcrs {
+			if !s.Hash.Supported() {
+				return nil, fmt.Errorf("unsupported PCR bank %v", s.Hash)
+			}
+			for _, pcr := range s.Select {
+				if n >= len(branch) {
+					return nil, fmt.Errorf("branch %d has too few values", i)
+				}
+				if len(branch[n]) != s.Hash.Size() {
+					return nil, fmt.Errorf("branch %d has a value with the wrong size for PCR %d in bank %v", i, pcr, s.Hash)
+				}
+				v.SetValue(s.Hash, pcr, branch[n])
+				n++
+			}
+		}
+		if n != len(branch) {
+			return nil, fmt.Errorf("branch %d has too many values", i)
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// makePCRProtectionProfileFromValues creates a PCRProtectionProfile with a branch for each of the supplied sets of PCR values.
+func makePCRProtectionProfileFromValues(values pcrValuesList) *PCRProtectionProfile {
+	if len(values) == 0 {
+		return &PCRProtectionProfile{}
+	}
+
+	var branches []*PCRProtectionProfile
+	for _, v := range values {
+		branch := NewPCRProtectionProfile()
+		for alg, pcrs := range v {
+			for pcr, digest := range pcrs {
+				branch.AddPCRValue(alg, pcr, digest)
+			}
+		}
+		branches = append(branches, branch)
+	}
+	if len(branches) == 1 {
+		return branches[0]
+	}
+	return NewPCRProtectionProfile().AddProfileOR(branches...)
+}
+
+func pcrValuesEqual(a, b tpm2.PCRValues) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for alg, pcrsA := range a {
+		pcrsB, ok := b[alg]
+		if !ok || len(pcrsA) != len(pcrsB) {
+			return false
+		}
+		for pcr, digestA := range pcrsA {
+			digestB, ok := pcrsB[pcr]
+			if !ok || !bytes.Equal(digestA, digestB) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// mergePCRValues merges the PCR values for each branch of an existing PCR policy with the PCR values for each branch of an update
+// that applies to a subset of PCRs. Values in the existing branches for any PCR that is included in the update are discarded, and
+// the resulting set of branches is the product of the remaining unique existing branches and the update branches.
+func mergePCRValues(current, update pcrValuesList) pcrValuesList {
+	updated := make(map[tpm2.HashAlgorithmId]map[int]bool)
+	for _, v := range update {
+		for alg, pcrs := range v {
+			if _, ok := updated[alg]; !ok {
+				updated[alg] = make(map[int]bool)
+			}
+			for pcr := range pcrs {
+				updated[alg][pcr] = true
+			}
+		}
+	}
+
+	var unchanged pcrValuesList
+	for _, v := range current {
+		r := make(tpm2.PCRValues)
+		for alg, pcrs := range v {
+			for pcr, digest := range pcrs {
+				if updated[alg][pcr] {
+					continue
+				}
+				r.SetValue(alg, pcr, digest)
+			}
+		}
+
+		found := false
+		for _, u := range unchanged {
+			if pcrValuesEqual(r, u) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unchanged = append(unchanged, r)
+		}
+	}
+
+	var out pcrValuesList
+	for _, u := range unchanged {
+		for _, v := range update {
+			m := make(tpm2.PCRValues)
+			for _, src := range []tpm2.PCRValues{u, v} {
+				for alg, pcrs := range src {
+					for pcr, digest := range pcrs {
+						m.SetValue(alg, pcr, digest)
+					}
+				}
+			}
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// verifyDynamicPolicyAuthorization verifies that the supplied dynamic authorization policy has a valid signature from the key that
+// the TPM2_PolicyAuthorize assertion in the supplied static authorization policy is bound to, by having the TPM produce the
+// verification ticket that would be consumed by TPM2_PolicyAuthorize during unsealing.
+func verifyDynamicPolicyAuthorization(tpm *tpm2.TPMContext, staticInput *staticPolicyData, dynamicInput *dynamicPolicyData, session tpm2.SessionContext) error {
+	if dynamicInput.AuthorizedPolicySignature == nil || dynamicInput.AuthorizedPolicySignature.SigAlg == tpm2.SigSchemeAlgNull {
+		return errors.New("the dynamic authorization policy has not been authorized")
+	}
+
+	authPublicKey := staticInput.AuthPublicKey
+	authorizeKey, err := tpm.LoadExternal(nil, authPublicKey, tpm2.HandleOwner)
+	if err != nil {
+		return xerrors.Errorf("cannot load public area for dynamic authorization policy signature verification key: %w", err)
+	}
+	defer tpm.FlushContext(authorizeKey)
+
+	h := authPublicKey.NameAlg.NewHash()
+	h.Write(dynamicInput.AuthorizedPolicy)
+
+	if _, err := tpm.VerifySignature(authorizeKey, h.Sum(nil), dynamicInput.AuthorizedPolicySignature, session.IncludeAttrs(tpm2.AttrAudit)); err != nil {
+		return xerrors.Errorf("cannot verify dynamic authorization policy signature: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateKeyPCRProtectionPolicyIncremental updates the PCR protection policy for the sealed key at the path specified by the keyPath
+// argument for the subset of PCRs defined by the pcrProfile argument, without requiring a profile for the PCRs that haven't changed.
+// This is useful when only some PCR values are changing, eg, PCR 7 after an update to the UEFI signature database. The values in
+// the existing policy for each PCR that the supplied profile contains values for are discarded, and the remaining values are
+// combined with each branch of the supplied profile. All branches of the supplied profile must contain values for the same set of
+// PCRs. In order to do this, the caller must also specify the path to the policy update data file that was saved by SealKeyToTPM.
+//
+// This only works for sealed key files that were created with the AllowIncrementalPCRPolicyUpdates field of KeyCreationParams
+// set. For other sealed key files, a ErrNoRecordedPCRValues error will be returned, and UpdateKeyPCRProtectionPolicy must be
+// used instead.
+//
+// Before the sealed key file is updated, the new dynamic authorization policy is checked against the key that the sealed key
+// object's authorization policy uses to authorize dynamic authorization policies with the TPM2_PolicyAuthorize assertion.
+//
+// This returns the same errors as UpdateKeyPCRProtectionPolicy.
+func UpdateKeyPCRProtectionPolicyIncremental(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile) error {
+	if pcrProfile == nil {
+		return errors.New("no PCR protection profile provided")
+	}
+
+	// Fail early if the key data file doesn't record the PCR values, before performing any validation with the TPM.
+	k, err := ReadSealedKeyObject(keyPath)
+	if err != nil {
+		return err
+	}
+	if len(k.data.pcrBranchValues) == 0 {
+		return ErrNoRecordedPCRValues
+	}
+
+	return updateKeyPCRProtectionPolicy(tpm, keyPath, policyUpdatePath, func(data *keyData) (pcrValuesList, error) {
+		current, err := decodePCRBranchValues(data.dynamicPolicyData.PCRSelection, data.pcrBranchValues)
+		if err != nil {
+			return nil, InvalidKeyFileError{fmt.Sprintf("cannot decode recorded PCR values: %v", err)}
+		}
+
+		update, err := pcrProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+		}
+		selection := update[0].SelectionList()
+		for _, v := range update[1:] {
+			if !v.SelectionList().Equal(selection) {
+				return nil, errors.New("not all branches of the PCR protection profile contain values for the same sets of PCRs")
+			}
+		}
+
+		return mergePCRValues(current, update), nil
+	})
+}
@@ -0,0 +1,224 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestMergePCRValues(t *testing.T) {
+	digest := func(b byte) tpm2.Digest {
+		d := make(tpm2.Digest, 32)
+		d[0] = b
+		return d
+	}
+	values := func(pcrs map[int]tpm2.Digest) tpm2.PCRValues {
+		return tpm2.PCRValues{tpm2.HashAlgorithmSHA256: pcrs}
+	}
+
+	current := []tpm2.PCRValues{
+		values(map[int]tpm2.Digest{4: digest(1), 7: digest(2), 12: digest(3)}),
+		values(map[int]tpm2.Digest{4: digest(1), 7: digest(4), 12: digest(3)}),
+		values(map[int]tpm2.Digest{4: digest(5), 7: digest(2), 12: digest(3)})}
+	update := []tpm2.PCRValues{
+		values(map[int]tpm2.Digest{7: digest(6)}),
+		values(map[int]tpm2.Digest{7: digest(7)})}
+
+	expected := []tpm2.PCRValues{
+		values(map[int]tpm2.Digest{4: digest(1), 7: digest(6), 12: digest(3)}),
+		values(map[int]tpm2.Digest{4: digest(1), 7: digest(7), 12: digest(3)}),
+		values(map[int]tpm2.Digest{4: digest(5), 7: digest(6), 12: digest(3)}),
+		values(map[int]tpm2.Digest{4: digest(5), 7: digest(7), 12: digest(3)})}
+
+	if merged := MergePCRValues(current, update); !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Unexpected merged values: %v", merged)
+	}
+}
+
+func TestUpdateKeyPCRProtectionPolicyIncremental(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	resetPCRs := func() {
+		for _, pcr := range []int{16, 23} {
+			if err := tpm.PCRReset(tpm.PCRHandleContext(pcr), nil); err != nil {
+				t.Errorf("PCRReset failed: %v", err)
+			}
+		}
+	}
+	extendPCR := func(pcr int) {
+		if err := tpm.PCRExtend(tpm.PCRHandleContext(pcr), tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}}, nil); err != nil {
+			t.Fatalf("PCRExtend failed: %v", err)
+		}
+	}
+	resetPCRs()
+	defer resetPCRs()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyIncremental_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	profile := NewPCRProtectionProfile().
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 16).
+		AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23)
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:                       profile,
+		PINHandle:                        0x01810000,
+		AllowIncrementalPCRPolicyUpdates: true}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	unseal := func() error {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		_, err = k.UnsealFromTPM(tpm, "")
+		return err
+	}
+
+	if err := unseal(); err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+
+	// Change PCR 23 so that the key can't be unsealed, and then update the policy for just that PCR.
+	extendPCR(23)
+	if err := unseal(); err == nil {
+		t.Fatalf("UnsealFromTPM should have failed")
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyIncremental(tpm, keyFile, policyUpdateFile,
+		NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 23)); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicyIncremental failed: %v", err)
+	}
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+	if err := unseal(); err != nil {
+		t.Errorf("UnsealFromTPM failed: %v", err)
+	}
+
+	// The assertion for PCR 16 should have been retained.
+	extendPCR(16)
+	if err := unseal(); err == nil {
+		t.Errorf("UnsealFromTPM should have failed")
+	}
+}
+
+func TestUpdateKeyPCRProtectionPolicyIncrementalNoRecordedValues(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyIncrementalNoRecordedValues_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := UpdateKeyPCRProtectionPolicyIncremental(tpm, keyFile, policyUpdateFile,
+		NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7)); err != ErrNoRecordedPCRValues {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUpdateKeyPCRProtectionPolicyDoesNotRecordPCRValues(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyDoesNotRecordPCRValues_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	// A sealed key file with other optional metadata should not start recording PCR values when its policy is updated.
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:     getTestPCRProfile(),
+		PINHandle:      0x01810000,
+		Label:          "foo",
+		VolumeIdentity: "bar"}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+	if err := UpdateKeyPCRProtectionPolicyIncremental(tpm, keyFile, policyUpdateFile,
+		NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7)); err != ErrNoRecordedPCRValues {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.Label() != "foo" {
+		t.Errorf("Unexpected label: %s", k.Label())
+	}
+	if k.VolumeIdentity() != "bar" {
+		t.Errorf("Unexpected volume identity: %s", k.VolumeIdentity())
+	}
+}
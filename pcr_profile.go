@@ -21,6 +21,7 @@ package secboot
 
 import (
 	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 
@@ -76,8 +77,9 @@ type pcrProtectionProfileAddPCRValueInstr struct {
 }
 
 type pcrProtectionProfileAddPCRValueFromTPMInstr struct {
-	alg tpm2.HashAlgorithmId
-	pcr int
+	source PCRSource // If nil, the value is read from the PCRSource supplied when computing PCR values
+	alg    tpm2.HashAlgorithmId
+	pcr    int
 }
 
 type pcrProtectionProfileExtendPCRInstr struct {
@@ -98,14 +100,86 @@ type pcrProtectionProfileInstr interface{}
 
 // PCRProtectionProfile defines the PCR profile used to protect a key sealed with SealKeyToTPM. It contains a sequence of instructions
 // for computing combinations of PCR values that a key will be protected against. The profile is built using the methods of this type.
+//
+// Each PCR is identified by both its index and its PCR bank, and a single profile can contain values for different PCRs in different
+// banks (eg, PCR 0 in the SHA-1 bank and PCR 7 in the SHA-256 bank on a platform that only measures some events to one bank). The
+// PCR digest for each branch is computed from the selected PCRs of every bank, in the order that TPM2_PolicyPCR expects, and the
+// TPM reads the current value of each PCR from its respective bank during unsealing. Every branch must still contain values for
+// the same set of PCRs in each bank.
 type PCRProtectionProfile struct {
-	instrs []pcrProtectionProfileInstr
+	instrs  []pcrProtectionProfileInstr
+	digests *pcrProtectionProfileDigests // Set if this profile was created with NewPCRProtectionProfileFromDigests
+}
+
+// pcrProtectionProfileDigests contains a set of precomputed PCR digests for a PCRProtectionProfile.
+type pcrProtectionProfileDigests struct {
+	alg     tpm2.HashAlgorithmId
+	pcrs    tpm2.PCRSelectionList
+	digests tpm2.DigestList
 }
 
 func NewPCRProtectionProfile() *PCRProtectionProfile {
 	return &PCRProtectionProfile{}
 }
 
+// PCRDigestEntry describes an acceptable combination of PCR values as a PCR digest, for use with
+// NewPCRProtectionProfileFromDigests.
+type PCRDigestEntry struct {
+	// Selection is the set of PCRs that the digest is computed from.
+	Selection tpm2.PCRSelectionList
+
+	// Digest is the hex encoded digest of the concatenation of the values of the selected PCRs, in the order that TPM2_PolicyPCR
+	// expects.
+	Digest string
+}
+
+// NewPCRProtectionProfileFromDigests returns a new PCRProtectionProfile from a set of externally computed PCR digests, rather than
+// from individual PCR values. This is intended for callers that compute the acceptable PCR digests themselves. When a key is sealed
+// with the returned profile, the PCR protection policy is a TPM2_PolicyOR over exactly the supplied digests.
+//
+// The digests must have been computed with the name algorithm of the sealed key object, which is specified by the alg argument and
+// must match the NameAlg field of KeyCreationParams. Every entry must have the same PCR selection, as the PCR protection policy only
+// supports a single PCR selection.
+//
+// As the individual PCR values are not known, the returned profile cannot be combined with other profiles and cannot be used with
+// functions that require PCR values, such as NewNormalAndRecoveryPCRProtectionProfile or SealKeyToTPM with
+// AllowIncrementalPCRPolicyUpdates set.
+func NewPCRProtectionProfileFromDigests(alg tpm2.HashAlgorithmId, entries []PCRDigestEntry) (*PCRProtectionProfile, error) {
+	if !alg.Supported() {
+		return nil, fmt.Errorf("unsupported digest algorithm %v", alg)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("no PCR digests supplied")
+	}
+
+	digests := &pcrProtectionProfileDigests{alg: alg, pcrs: entries[0].Selection}
+	for i, e := range entries {
+		if !e.Selection.Equal(digests.pcrs) {
+			return nil, fmt.Errorf("entry %d has a different PCR selection to the first entry", i)
+		}
+		d, err := hex.DecodeString(e.Digest)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot decode digest for entry %d: %w", i, err)
+		}
+		if len(d) != alg.Size() {
+			return nil, fmt.Errorf("digest for entry %d has the wrong length for %v", i, alg)
+		}
+
+		found := false
+		for _, d2 := range digests.digests {
+			if bytes.Equal(d, d2) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			digests.digests = append(digests.digests, d)
+		}
+	}
+
+	return &PCRProtectionProfile{digests: digests}, nil
+}
+
 // AddPCRValue adds the supplied value to this profile for the specified PCR. This action replaces any value set previously in this
 // profile. The function returns the same PCRProtectionProfile so that calls may be chained.
 func (p *PCRProtectionProfile) AddPCRValue(alg tpm2.HashAlgorithmId, pcr int, value tpm2.Digest) *PCRProtectionProfile {
@@ -124,6 +198,16 @@ func (p *PCRProtectionProfile) AddPCRValueFromTPM(alg tpm2.HashAlgorithmId, pcr
 	return p
 }
 
+// AddPCRValueFromSource adds the current value of the specified PCR, obtained from the supplied PCRSource, to this profile. This
+// action replaces any value set previously in this profile. The current value is read from source when the PCR values generated by
+// this profile are computed. This is the same as AddPCRValueFromTPM, but can be used to supply PCR values from somewhere other than
+// the TPM that a key is sealed with, such as a StaticPCRSource. The function returns the same PCRProtectionProfile so that calls may
+// be chained.
+func (p *PCRProtectionProfile) AddPCRValueFromSource(source PCRSource, alg tpm2.HashAlgorithmId, pcr int) *PCRProtectionProfile {
+	p.instrs = append(p.instrs, &pcrProtectionProfileAddPCRValueFromTPMInstr{source: source, alg: alg, pcr: pcr})
+	return p
+}
+
 // ExtendPCR extends the value of the specified PCR in this profile with the supplied value. If this profile doesn't yet have a
 // value for the specified PCR, an initial value of all zeroes will be added first. The function returns the same PCRProtectionProfile
 // so that calls may be chained.
@@ -138,13 +222,53 @@ func (p *PCRProtectionProfile) ExtendPCR(alg tpm2.HashAlgorithmId, pcr int, valu
 // AddProfileOR adds one or more sub-profiles that can be used to define PCR policies for multiple conditions. Note that each
 // branch must explicitly define values for the same set of PCRs. It is not possible to generate policies where each branch
 // defines values for a different set of PCRs. When computing the PCR values for this profile, the sub-profiles added by this command
-// will inherit the PCR values computed by this profile. The function returns the same PCRProtectionProfile so that calls may be
-// chained.
+// will inherit the PCR values computed by this profile. Profiles created with NewPCRProtectionProfileFromDigests can't be used as
+// sub-profiles, and computing the PCR values for this profile will fail if any are supplied. The function returns the same
+// PCRProtectionProfile so that calls may be chained.
 func (p *PCRProtectionProfile) AddProfileOR(profiles ...*PCRProtectionProfile) *PCRProtectionProfile {
 	p.instrs = append(p.instrs, &pcrProtectionProfileAddProfileORInstr{profiles: profiles})
 	return p
 }
 
+// checkPCRSelections returns a description of each problem with the PCR selections in this profile and its sub-profiles that
+// can be detected without computing the PCR values, such as PCR indices that are out of range or unsupported digest algorithms.
+func (p *PCRProtectionProfile) checkPCRSelections() (problems []string) {
+	check := func(alg tpm2.HashAlgorithmId, pcr int) {
+		if !alg.Supported() {
+			problems = append(problems, fmt.Sprintf("PCR profile contains unsupported digest algorithm %v", alg))
+		}
+		if pcr < 0 || pcr >= maxPCR {
+			problems = append(problems, fmt.Sprintf("PCR profile contains invalid PCR index %d", pcr))
+		}
+	}
+
+	if p.digests != nil {
+		for _, s := range p.digests.pcrs {
+			for _, pcr := range s.Select {
+				check(s.Hash, pcr)
+			}
+		}
+	}
+	for _, instr := range p.instrs {
+		switch i := instr.(type) {
+		case *pcrProtectionProfileAddPCRValueInstr:
+			check(i.alg, i.pcr)
+		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
+			check(i.alg, i.pcr)
+		case *pcrProtectionProfileExtendPCRInstr:
+			check(i.alg, i.pcr)
+		case *pcrProtectionProfileAddProfileORInstr:
+			for _, sub := range i.profiles {
+				if sub.digests != nil {
+					problems = append(problems, "PCR profile contains a sub-profile created from PCR digests")
+				}
+				problems = append(problems, sub.checkPCRSelections()...)
+			}
+		}
+	}
+	return problems
+}
+
 // pcrProtectionProfileIterator provides a mechanism to perform a depth first traversal of instructions in a PCRProtectionProfile.
 type pcrProtectionProfileIterator struct {
 	instrs [][]pcrProtectionProfileInstr
@@ -209,6 +333,14 @@ type pcrProtectionProfileStringifyBranchContext struct {
 func (p *PCRProtectionProfile) String() string {
 	var b bytes.Buffer
 
+	if p.digests != nil {
+		fmt.Fprintf(&b, "\n PCRDigests(%v, %v) {", p.digests.alg, p.digests.pcrs)
+		for _, d := range p.digests.digests {
+			fmt.Fprintf(&b, "\n  %x", d)
+		}
+		fmt.Fprintf(&b, "\n }\n")
+	}
+
 	contexts := []*pcrProtectionProfileStringifyBranchContext{{index: 0, total: 1}}
 	branchStart := false
 
@@ -225,7 +357,11 @@ func (p *PCRProtectionProfile) String() string {
 		case *pcrProtectionProfileAddPCRValueInstr:
 			fmt.Fprintf(&b, "%*s AddPCRValue(%v, %d, %x)", depth*3, "", i.alg, i.pcr, i.value)
 		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
-			fmt.Fprintf(&b, "%*s AddPCRValueFromTPM(%v, %d)", depth*3, "", i.alg, i.pcr)
+			if i.source != nil {
+				fmt.Fprintf(&b, "%*s AddPCRValueFromSource(%v, %d)", depth*3, "", i.alg, i.pcr)
+			} else {
+				fmt.Fprintf(&b, "%*s AddPCRValueFromTPM(%v, %d)", depth*3, "", i.alg, i.pcr)
+			}
 		case *pcrProtectionProfileExtendPCRInstr:
 			fmt.Fprintf(&b, "%*s ExtendPCR(%v, %d, %x)", depth*3, "", i.alg, i.pcr, i.value)
 		case *pcrProtectionProfileAddProfileORInstr:
@@ -314,8 +450,13 @@ func (s pcrProtectionProfileComputeContextStack) top() *pcrProtectionProfileComp
 	return s[0]
 }
 
-// computePCRValues computes a list of different PCR value combinations from this PCRProtectionProfile.
-func (p *PCRProtectionProfile) computePCRValues(tpm *tpm2.TPMContext) (pcrValuesList, error) {
+// computePCRValues computes a list of different PCR value combinations from this PCRProtectionProfile. Values added with
+// AddPCRValueFromTPM are read from the supplied source.
+func (p *PCRProtectionProfile) computePCRValues(source PCRSource) (pcrValuesList, error) {
+	if p.digests != nil {
+		return nil, errors.New("cannot compute PCR values from a profile created from PCR digests")
+	}
+
 	contexts := pcrProtectionProfileComputeContextStack{{values: pcrValuesList{make(tpm2.PCRValues)}}}
 
 	iter := p.traverseInstructions()
@@ -324,10 +465,14 @@ func (p *PCRProtectionProfile) computePCRValues(tpm *tpm2.TPMContext) (pcrValues
 		case *pcrProtectionProfileAddPCRValueInstr:
 			contexts.top().values.setValue(i.alg, i.pcr, i.value)
 		case *pcrProtectionProfileAddPCRValueFromTPMInstr:
-			if tpm == nil {
+			s := i.source
+			if s == nil {
+				s = source
+			}
+			if s == nil {
 				return nil, fmt.Errorf("cannot read current value of PCR %d from bank %v: no TPM context", i.pcr, i.alg)
 			}
-			_, v, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: i.alg, Select: []int{i.pcr}}})
+			v, err := s.ReadPCRs(tpm2.PCRSelectionList{{Hash: i.alg, Select: []int{i.pcr}}})
 			if err != nil {
 				return nil, xerrors.Errorf("cannot read current value of PCR %d from bank %v: %w", i.pcr, i.alg, err)
 			}
@@ -335,6 +480,12 @@ func (p *PCRProtectionProfile) computePCRValues(tpm *tpm2.TPMContext) (pcrValues
 		case *pcrProtectionProfileExtendPCRInstr:
 			contexts.top().values.extendValue(i.alg, i.pcr, i.value)
 		case *pcrProtectionProfileAddProfileORInstr:
+			// Sub-profiles created from PCR digests have no instructions, so they would otherwise be treated as empty branches.
+			for _, sub := range i.profiles {
+				if sub.digests != nil {
+					return nil, errors.New("cannot compute PCR values from a sub-profile created from PCR digests")
+				}
+			}
 			// As this is a depth-first traversal, processing of this branch is parked when a AddProfileOR instruction is encountered.
 			// Subsequent instructions will be from each of the sub-branches in turn.
 			contexts = contexts.handleBranches(len(i.profiles))
@@ -350,9 +501,19 @@ func (p *PCRProtectionProfile) computePCRValues(tpm *tpm2.TPMContext) (pcrValues
 
 // computePCRDigests computes a PCR selection and list of PCR digests from this PCRProtectionProfile. The returned list of PCR digests
 // is de-duplicated.
-func (p *PCRProtectionProfile) computePCRDigests(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
+func (p *PCRProtectionProfile) computePCRDigests(source PCRSource, alg tpm2.HashAlgorithmId) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
+	if p.digests != nil {
+		if len(p.instrs) > 0 {
+			return nil, nil, errors.New("cannot add PCR values to a profile created from PCR digests")
+		}
+		if p.digests.alg != alg {
+			return nil, nil, fmt.Errorf("PCR digests were computed with %v rather than %v", p.digests.alg, alg)
+		}
+		return p.digests.pcrs, p.digests.digests, nil
+	}
+
 	// Compute the sets of PCR values for all branches
-	values, err := p.computePCRValues(tpm)
+	values, err := p.computePCRValues(source)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -387,3 +548,44 @@ func (p *PCRProtectionProfile) computePCRDigests(tpm *tpm2.TPMContext, alg tpm2.
 
 	return pcrs, uniquePcrDigests, nil
 }
+
+// NewNormalAndRecoveryPCRProtectionProfile returns a new PCRProtectionProfile that is satisfied by either the normalBoot profile or
+// the recoveryBoot profile. This is intended for the common case where a key must be unsealable both during a normal boot and when
+// booting in to a recovery environment, which has different measurements, with a distinct set of PCR values for each environment.
+// It is equivalent to calling AddProfileOR with both profiles on an empty profile, but additionally checks that every branch of
+// both profiles contains values for the same set of PCRs, which is required for them to be combined in to a single PCR protection
+// policy.
+//
+// Values added to either profile with AddPCRValueFromTPM are read from the supplied source in order to perform this check. The
+// source can be nil if neither profile reads values from the TPM.
+func NewNormalAndRecoveryPCRProtectionProfile(normalBoot, recoveryBoot *PCRProtectionProfile, source PCRSource) (*PCRProtectionProfile, error) {
+	if normalBoot == nil || recoveryBoot == nil {
+		return nil, errors.New("both a normal boot and a recovery boot profile must be supplied")
+	}
+
+	var pcrs tpm2.PCRSelectionList
+	for _, p := range []struct {
+		name    string
+		profile *PCRProtectionProfile
+	}{
+		{name: "normal boot", profile: normalBoot},
+		{name: "recovery boot", profile: recoveryBoot},
+	} {
+		values, err := p.profile.computePCRValues(source)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR values for %s profile: %w", p.name, err)
+		}
+		for _, v := range values {
+			s := v.SelectionList()
+			if pcrs == nil {
+				pcrs = s
+				continue
+			}
+			if !s.Equal(pcrs) {
+				return nil, fmt.Errorf("the %s profile contains values for a different set of PCRs", p.name)
+			}
+		}
+	}
+
+	return NewPCRProtectionProfile().AddProfileOR(normalBoot, recoveryBoot), nil
+}
@@ -0,0 +1,166 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// PCRProfileValueChange describes how the set of acceptable values for a single PCR differs between 2 PCR protection profiles.
+type PCRProfileValueChange struct {
+	Alg     tpm2.HashAlgorithmId // The PCR bank
+	PCR     int                  // The PCR index
+	Added   []string             // Hex encoded values that are only acceptable in the new profile, sorted
+	Removed []string             // Hex encoded values that are only acceptable in the old profile, sorted
+}
+
+func (c PCRProfileValueChange) String() string {
+	var s []string
+	for _, v := range c.Added {
+		s = append(s, "+"+v)
+	}
+	for _, v := range c.Removed {
+		s = append(s, "-"+v)
+	}
+	return fmt.Sprintf("PCR %d, bank %v: %s", c.PCR, c.Alg, strings.Join(s, " "))
+}
+
+// PCRProfileDiff describes the difference between 2 PCR protection profiles, as returned from ProfileDiff.
+type PCRProfileDiff struct {
+	Changes     []PCRProfileValueChange // PCRs for which the set of acceptable values differs, sorted by PCR bank and then by PCR index
+	OldBranches int                     // The number of branches in the old profile
+	NewBranches int                     // The number of branches in the new profile
+}
+
+func (d *PCRProfileDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "branches: %d -> %d\n", d.OldBranches, d.NewBranches)
+	for _, c := range d.Changes {
+		fmt.Fprintf(&b, "%s\n", c)
+	}
+	return b.String()
+}
+
+// pcrProfileAcceptableValues returns the set of hex encoded values that are acceptable for each PCR in any branch of the supplied
+// list of PCR values.
+func pcrProfileAcceptableValues(values pcrValuesList) map[tpm2.HashAlgorithmId]map[int]map[string]bool {
+	out := make(map[tpm2.HashAlgorithmId]map[int]map[string]bool)
+	for _, v := range values {
+		for alg := range v {
+			if _, ok := out[alg]; !ok {
+				out[alg] = make(map[int]map[string]bool)
+			}
+			for pcr, digest := range v[alg] {
+				if _, ok := out[alg][pcr]; !ok {
+					out[alg][pcr] = make(map[string]bool)
+				}
+				out[alg][pcr][hex.EncodeToString(digest)] = true
+			}
+		}
+	}
+	return out
+}
+
+// ProfileDiff compares 2 PCR protection profiles and reports which PCRs gained or lost acceptable values in each PCR bank, and how
+// the number of branches changed. This is intended for reviewing changes to the PCR protection policy for a sealed key object,
+// such as those caused by a firmware or kernel update.
+//
+// The comparison is performed entirely in software, so neither profile can contain values that are read from a TPM. Profiles
+// created with NewPCRProtectionProfileFromDigests can't be compared because they don't contain individual PCR values. A nil profile
+// is treated as an empty profile. The returned changes are sorted so that the output is deterministic.
+func ProfileDiff(before, after *PCRProtectionProfile) (*PCRProfileDiff, error) {
+	if before == nil {
+		before = NewPCRProtectionProfile()
+	}
+	if after == nil {
+		after = NewPCRProtectionProfile()
+	}
+
+	beforeValues, err := before.computePCRValues(nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values for old profile: %w", err)
+	}
+	afterValues, err := after.computePCRValues(nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR values for new profile: %w", err)
+	}
+
+	beforeSet := pcrProfileAcceptableValues(beforeValues)
+	afterSet := pcrProfileAcceptableValues(afterValues)
+
+	type pcrKey struct {
+		alg tpm2.HashAlgorithmId
+		pcr int
+	}
+
+	var keys []pcrKey
+	seen := make(map[pcrKey]bool)
+	for _, set := range []map[tpm2.HashAlgorithmId]map[int]map[string]bool{beforeSet, afterSet} {
+		for alg := range set {
+			for pcr := range set[alg] {
+				k := pcrKey{alg, pcr}
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].alg != keys[j].alg {
+			return keys[i].alg < keys[j].alg
+		}
+		return keys[i].pcr < keys[j].pcr
+	})
+
+	diff := &PCRProfileDiff{OldBranches: len(beforeValues), NewBranches: len(afterValues)}
+	for _, k := range keys {
+		b := beforeSet[k.alg][k.pcr]
+		a := afterSet[k.alg][k.pcr]
+
+		change := PCRProfileValueChange{Alg: k.alg, PCR: k.pcr}
+		for v := range a {
+			if !b[v] {
+				change.Added = append(change.Added, v)
+			}
+		}
+		for v := range b {
+			if !a[v] {
+				change.Removed = append(change.Removed, v)
+			}
+		}
+		if len(change.Added) == 0 && len(change.Removed) == 0 {
+			continue
+		}
+		sort.Strings(change.Added)
+		sort.Strings(change.Removed)
+		diff.Changes = append(diff.Changes, change)
+	}
+
+	return diff, nil
+}
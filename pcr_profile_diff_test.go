@@ -0,0 +1,104 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestProfileDiff(t *testing.T) {
+	digest := func(b byte) tpm2.Digest {
+		d := make(tpm2.Digest, 32)
+		d[0] = b
+		return d
+	}
+	hexDigest := func(b byte) string {
+		return hex.EncodeToString(digest(b))
+	}
+
+	before := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digest(1)).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 8, digest(2)),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 8, digest(3)))
+	after := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digest(1)).
+		AddPCRValue(tpm2.HashAlgorithmSHA1, 4, make(tpm2.Digest, 20)).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 8, digest(5)),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 8, digest(3)),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 8, digest(4)))
+
+	expected := &PCRProfileDiff{
+		Changes: []PCRProfileValueChange{
+			{Alg: tpm2.HashAlgorithmSHA1, PCR: 4, Added: []string{hex.EncodeToString(make([]byte, 20))}},
+			{Alg: tpm2.HashAlgorithmSHA256, PCR: 8, Added: []string{hexDigest(4), hexDigest(5)}, Removed: []string{hexDigest(2)}},
+		},
+		OldBranches: 2,
+		NewBranches: 3}
+
+	t.Run("Changes", func(t *testing.T) {
+		diff, err := ProfileDiff(before, after)
+		if err != nil {
+			t.Fatalf("ProfileDiff failed: %v", err)
+		}
+		if !reflect.DeepEqual(diff, expected) {
+			t.Errorf("Unexpected diff: %v", diff)
+		}
+
+		expectedString := "PCR 8, bank " + tpm2.HashAlgorithmSHA256.String() + ": +" + hexDigest(4) + " +" + hexDigest(5) + " -" + hexDigest(2)
+		if diff.Changes[1].String() != expectedString {
+			t.Errorf("Unexpected string: %s", diff.Changes[1])
+		}
+	})
+
+	t.Run("NoChanges", func(t *testing.T) {
+		diff, err := ProfileDiff(before, before)
+		if err != nil {
+			t.Fatalf("ProfileDiff failed: %v", err)
+		}
+		if len(diff.Changes) != 0 || diff.OldBranches != 2 || diff.NewBranches != 2 {
+			t.Errorf("Unexpected diff: %v", diff)
+		}
+	})
+
+	t.Run("NilProfile", func(t *testing.T) {
+		diff, err := ProfileDiff(nil, before)
+		if err != nil {
+			t.Fatalf("ProfileDiff failed: %v", err)
+		}
+		if len(diff.Changes) != 2 || diff.OldBranches != 1 || diff.NewBranches != 2 {
+			t.Errorf("Unexpected diff: %v", diff)
+		}
+	})
+
+	t.Run("ValueFromTPM", func(t *testing.T) {
+		_, err := ProfileDiff(before, NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7))
+		if err == nil || err.Error() != "cannot compute PCR values for new profile: cannot read current value of PCR 7 from bank "+
+			"TPM_ALG_SHA256: no TPM context" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
@@ -21,6 +21,7 @@ package secboot_test
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"reflect"
 	"testing"
@@ -302,6 +303,26 @@ func TestPCRProtectionProfile(t *testing.T) {
 				},
 			},
 		},
+		{
+			// Verify that PCRs from different banks can be combined in a single branch
+			desc: "MixedBanks",
+			alg:  tpm2.HashAlgorithmSHA256,
+			profile: func() *PCRProtectionProfile {
+				return NewPCRProtectionProfile().
+					AddPCRValue(tpm2.HashAlgorithmSHA1, 0, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA1, "foo")).
+					AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar"))
+			}(),
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA1: {
+						0: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA1, "foo"),
+					},
+					tpm2.HashAlgorithmSHA256: {
+						7: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar"),
+					},
+				},
+			},
+		},
 		{
 			desc: "EmptyProfileOR",
 			alg:  tpm2.HashAlgorithmSHA256,
@@ -412,3 +433,146 @@ func TestPCRProtectionProfileAddValueFromTPM(t *testing.T) {
 		t.Errorf("ComputePCRDigests returned unexpected values")
 	}
 }
+
+func TestPCRProtectionProfileMixedBanksDigest(t *testing.T) {
+	// The PCR digest is computed over the selected PCRs of each bank in the order that they appear in the selection, which
+	// go-tpm2 sorts by algorithm, so the SHA-1 value of PCR 0 precedes the SHA-256 value of PCR 7.
+	pcr0 := makePCRDigestFromEvents(tpm2.HashAlgorithmSHA1, "foo")
+	pcr7 := makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar")
+
+	p := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, pcr7).
+		AddPCRValue(tpm2.HashAlgorithmSHA1, 0, pcr0)
+	pcrs, digests, err := p.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("ComputePCRDigests failed: %v", err)
+	}
+
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA1, Select: []int{0}}, {Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	if !pcrs.Equal(expectedPcrs) {
+		t.Errorf("ComputePCRDigests returned the wrong selection: %v", pcrs)
+	}
+
+	h := tpm2.HashAlgorithmSHA256.NewHash()
+	h.Write(pcr0)
+	h.Write(pcr7)
+	if !reflect.DeepEqual(digests, tpm2.DigestList{h.Sum(nil)}) {
+		t.Errorf("ComputePCRDigests returned unexpected digests")
+	}
+}
+
+func TestNewNormalAndRecoveryPCRProtectionProfile(t *testing.T) {
+	normal := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 12, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "run"))
+	recovery := NewPCRProtectionProfile().
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+		AddPCRValue(tpm2.HashAlgorithmSHA256, 12, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "recover"))
+
+	t.Run("Valid", func(t *testing.T) {
+		profile, err := NewNormalAndRecoveryPCRProtectionProfile(normal, recovery, nil)
+		if err != nil {
+			t.Fatalf("NewNormalAndRecoveryPCRProtectionProfile failed: %v", err)
+		}
+
+		expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}}
+		var expectedDigests tpm2.DigestList
+		for _, v := range []tpm2.PCRValues{
+			{tpm2.HashAlgorithmSHA256: {7: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"), 12: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "run")}},
+			{tpm2.HashAlgorithmSHA256: {7: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"), 12: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "recover")}},
+		} {
+			d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+			expectedDigests = append(expectedDigests, d)
+		}
+
+		pcrs, pcrDigests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatalf("ComputePCRDigests failed: %v", err)
+		}
+		if !pcrs.Equal(expectedPcrs) {
+			t.Errorf("Unexpected PCRSelectionList")
+		}
+		if !reflect.DeepEqual(pcrDigests, expectedDigests) {
+			t.Errorf("ComputePCRDigests returned unexpected digests")
+		}
+	})
+
+	t.Run("MismatchedPCRs", func(t *testing.T) {
+		recovery := NewPCRProtectionProfile().
+			AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"))
+		if _, err := NewNormalAndRecoveryPCRProtectionProfile(normal, recovery, nil); err == nil {
+			t.Errorf("NewNormalAndRecoveryPCRProtectionProfile should have failed")
+		}
+	})
+}
+
+func TestNewPCRProtectionProfileFromDigests(t *testing.T) {
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7, 12}}}
+	var digests tpm2.DigestList
+	var entries []PCRDigestEntry
+	for _, v := range []tpm2.PCRValues{
+		{tpm2.HashAlgorithmSHA256: {7: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"), 12: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "run")}},
+		{tpm2.HashAlgorithmSHA256: {7: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"), 12: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "recover")}},
+	} {
+		d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, v)
+		digests = append(digests, d)
+		entries = append(entries, PCRDigestEntry{Selection: pcrs, Digest: hex.EncodeToString(d)})
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		profile, err := NewPCRProtectionProfileFromDigests(tpm2.HashAlgorithmSHA256, append(entries, entries[0]))
+		if err != nil {
+			t.Fatalf("NewPCRProtectionProfileFromDigests failed: %v", err)
+		}
+
+		pcrsOut, digestsOut, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatalf("ComputePCRDigests failed: %v", err)
+		}
+		if !pcrsOut.Equal(pcrs) {
+			t.Errorf("Unexpected PCRSelectionList")
+		}
+		if !reflect.DeepEqual(digestsOut, digests) {
+			t.Errorf("ComputePCRDigests returned unexpected digests")
+		}
+
+		if _, _, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA1); err == nil {
+			t.Errorf("ComputePCRDigests should have failed with a different algorithm")
+		}
+	})
+
+	t.Run("WrongLength", func(t *testing.T) {
+		_, err := NewPCRProtectionProfileFromDigests(tpm2.HashAlgorithmSHA1, entries)
+		if err == nil || err.Error() != "digest for entry 0 has the wrong length for TPM_ALG_SHA1" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidHex", func(t *testing.T) {
+		_, err := NewPCRProtectionProfileFromDigests(tpm2.HashAlgorithmSHA256, []PCRDigestEntry{{Selection: pcrs, Digest: "foo"}})
+		if err == nil {
+			t.Errorf("NewPCRProtectionProfileFromDigests should have failed")
+		}
+	})
+
+	t.Run("MismatchedSelection", func(t *testing.T) {
+		_, err := NewPCRProtectionProfileFromDigests(tpm2.HashAlgorithmSHA256, []PCRDigestEntry{
+			entries[0],
+			{Selection: tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}, Digest: entries[1].Digest}})
+		if err == nil || err.Error() != "entry 1 has a different PCR selection to the first entry" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SubProfile", func(t *testing.T) {
+		sub, err := NewPCRProtectionProfileFromDigests(tpm2.HashAlgorithmSHA256, entries)
+		if err != nil {
+			t.Fatalf("NewPCRProtectionProfileFromDigests failed: %v", err)
+		}
+		profile := NewPCRProtectionProfile().AddProfileOR(sub)
+		_, _, err = profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+		if err == nil || err.Error() != "cannot compute PCR values from a sub-profile created from PCR digests" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
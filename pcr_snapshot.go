@@ -0,0 +1,95 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// ReadPCRs reads the current values of the PCRs specified by the selection argument. This is a read-only operation which is intended
+// to be used for diagnostic purposes, such as capturing a snapshot of the PCR values before an update so that it can be compared
+// with the PCR values after the update with DiffPCRs.
+func (t *TPMConnection) ReadPCRs(selection tpm2.PCRSelectionList) (tpm2.PCRValues, error) {
+	return readPCRs(t.TPMContext, selection)
+}
+
+// PCRChange describes a PCR for which the value differs between 2 sets of PCR values.
+type PCRChange struct {
+	Alg    tpm2.HashAlgorithmId // The PCR bank
+	PCR    int                  // The PCR index
+	Before tpm2.Digest          // The original value, or nil if the original set of values didn't contain a value for this PCR
+	After  tpm2.Digest          // The new value, or nil if the new set of values doesn't contain a value for this PCR
+}
+
+func (c PCRChange) String() string {
+	format := func(d tpm2.Digest) string {
+		if d == nil {
+			return "<none>"
+		}
+		return fmt.Sprintf("%x", d)
+	}
+	return fmt.Sprintf("PCR %d, bank %v: %s -> %s", c.PCR, c.Alg, format(c.Before), format(c.After))
+}
+
+// DiffPCRs compares 2 sets of PCR values (eg, obtained from TPMConnection.ReadPCRs before and after an update) and returns a list of
+// PCRs for which the value has changed, or which only have a value in one of the sets. The returned list is sorted by PCR bank and
+// then by PCR index, so that the output is stable.
+func DiffPCRs(before, after tpm2.PCRValues) []PCRChange {
+	type pcrKey struct {
+		alg tpm2.HashAlgorithmId
+		pcr int
+	}
+
+	var keys []pcrKey
+	seen := make(map[pcrKey]bool)
+	for _, v := range []tpm2.PCRValues{before, after} {
+		for alg := range v {
+			for pcr := range v[alg] {
+				k := pcrKey{alg, pcr}
+				if seen[k] {
+					continue
+				}
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].alg != keys[j].alg {
+			return keys[i].alg < keys[j].alg
+		}
+		return keys[i].pcr < keys[j].pcr
+	})
+
+	var out []PCRChange
+	for _, k := range keys {
+		b := before[k.alg][k.pcr]
+		a := after[k.alg][k.pcr]
+		if b != nil && a != nil && bytes.Equal(b, a) {
+			continue
+		}
+		out = append(out, PCRChange{Alg: k.alg, PCR: k.pcr, Before: b, After: a})
+	}
+	return out
+}
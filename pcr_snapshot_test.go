@@ -0,0 +1,121 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestReadPCRs(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(23), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	selection := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA1, Select: []int{7, 23}}, {Hash: tpm2.HashAlgorithmSHA256, Select: []int{0, 7, 23}}}
+	values, err := tpm.ReadPCRs(selection)
+	if err != nil {
+		t.Fatalf("ReadPCRs failed: %v", err)
+	}
+
+	for _, s := range selection {
+		for _, pcr := range s.Select {
+			_, expected, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: s.Hash, Select: []int{pcr}}})
+			if err != nil {
+				t.Fatalf("PCRRead failed: %v", err)
+			}
+			if !reflect.DeepEqual(values[s.Hash][pcr], expected[s.Hash][pcr]) {
+				t.Errorf("Unexpected value for PCR %d, bank %v", pcr, s.Hash)
+			}
+		}
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(23), []byte("bar"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+
+	after, err := tpm.ReadPCRs(selection)
+	if err != nil {
+		t.Fatalf("ReadPCRs failed: %v", err)
+	}
+
+	diff := DiffPCRs(values, after)
+	if len(diff) != 2 {
+		t.Fatalf("Unexpected number of changes: %v", diff)
+	}
+	for i, alg := range []tpm2.HashAlgorithmId{tpm2.HashAlgorithmSHA1, tpm2.HashAlgorithmSHA256} {
+		if diff[i].Alg != alg || diff[i].PCR != 23 {
+			t.Errorf("Unexpected change: %v", diff[i])
+		}
+	}
+}
+
+func TestDiffPCRs(t *testing.T) {
+	digest := func(b byte) tpm2.Digest {
+		d := make(tpm2.Digest, 32)
+		d[0] = b
+		return d
+	}
+
+	before := tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {
+			0: digest(0),
+			4: digest(1),
+			7: digest(2),
+			8: digest(3)}}
+	after := tpm2.PCRValues{
+		tpm2.HashAlgorithmSHA256: {
+			0: digest(0),
+			4: digest(5),
+			7: digest(6),
+			9: digest(7)}}
+
+	expected := []PCRChange{
+		{Alg: tpm2.HashAlgorithmSHA256, PCR: 4, Before: digest(1), After: digest(5)},
+		{Alg: tpm2.HashAlgorithmSHA256, PCR: 7, Before: digest(2), After: digest(6)},
+		{Alg: tpm2.HashAlgorithmSHA256, PCR: 8, Before: digest(3)},
+		{Alg: tpm2.HashAlgorithmSHA256, PCR: 9, After: digest(7)},
+	}
+
+	diff := DiffPCRs(before, after)
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Unexpected diff: %v", diff)
+	}
+
+	if len(DiffPCRs(before, before)) != 0 {
+		t.Errorf("Expected no changes")
+	}
+
+	expectedString := fmt.Sprintf("PCR 4, bank %v: %x -> %x", tpm2.HashAlgorithmSHA256, digest(1), digest(5))
+	if diff[0].String() != expectedString {
+		t.Errorf("Unexpected string: %s", diff[0])
+	}
+	expectedString = fmt.Sprintf("PCR 8, bank %v: %x -> <none>", tpm2.HashAlgorithmSHA256, digest(3))
+	if diff[2].String() != expectedString {
+		t.Errorf("Unexpected string: %s", diff[2])
+	}
+}
@@ -0,0 +1,146 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// PCRSource is a source of PCR values. It is implemented by TPMConnection, and by StaticPCRSource which can be used to supply
+// synthetic PCR values, eg, for testing code that generates PCR protection profiles without a TPM.
+type PCRSource interface {
+	// ReadPCRs returns the current values of the PCRs specified by the selection argument.
+	ReadPCRs(selection tpm2.PCRSelectionList) (tpm2.PCRValues, error)
+}
+
+// readPCRs reads the current values of the PCRs specified by the selection argument from the supplied TPM.
+func readPCRs(tpm *tpm2.TPMContext, selection tpm2.PCRSelectionList) (tpm2.PCRValues, error) {
+	out := make(tpm2.PCRValues)
+	for _, s := range selection {
+		if _, ok := out[s.Hash]; !ok {
+			out[s.Hash] = make(map[int]tpm2.Digest)
+		}
+		for _, pcr := range s.Select {
+			_, v, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: s.Hash, Select: []int{pcr}}})
+			if err != nil {
+				return nil, xerrors.Errorf("cannot read current value of PCR %d from bank %v: %w", pcr, s.Hash, err)
+			}
+			d, ok := v[s.Hash][pcr]
+			if !ok {
+				return nil, fmt.Errorf("the TPM did not return a value for PCR %d from bank %v", pcr, s.Hash)
+			}
+			out[s.Hash][pcr] = d
+		}
+	}
+	return out, nil
+}
+
+// tpmContextPCRSource is an implementation of PCRSource for *tpm2.TPMContext.
+type tpmContextPCRSource struct {
+	tpm *tpm2.TPMContext
+}
+
+func (s *tpmContextPCRSource) ReadPCRs(selection tpm2.PCRSelectionList) (tpm2.PCRValues, error) {
+	return readPCRs(s.tpm, selection)
+}
+
+// newPCRSourceFromTPMContext returns a PCRSource for the supplied TPM, or nil if tpm is nil.
+func newPCRSourceFromTPMContext(tpm *tpm2.TPMContext) PCRSource {
+	if tpm == nil {
+		return nil
+	}
+	return &tpmContextPCRSource{tpm}
+}
+
+// StaticPCRSource is an in-memory implementation of PCRSource that returns PCR values from a fixed set. It can be used to supply
+// synthetic PCR values to PCRProtectionProfile.AddPCRValueFromSource and CheckPCRProfileSatisfiable.
+type StaticPCRSource tpm2.PCRValues
+
+// ReadPCRs returns the values of the PCRs specified by the selection argument. An error is returned if this StaticPCRSource does
+// not contain a value for any of the selected PCRs.
+func (s StaticPCRSource) ReadPCRs(selection tpm2.PCRSelectionList) (tpm2.PCRValues, error) {
+	out := make(tpm2.PCRValues)
+	for _, sel := range selection {
+		for _, pcr := range sel.Select {
+			d, ok := s[sel.Hash][pcr]
+			if !ok {
+				return nil, fmt.Errorf("no value for PCR %d from bank %v", pcr, sel.Hash)
+			}
+			out.SetValue(sel.Hash, pcr, d)
+		}
+	}
+	return out, nil
+}
+
+// CheckPCRProfileSatisfiable determines whether the current PCR values obtained from the supplied source satisfy any of the
+// combinations of PCR values computed from the supplied PCR protection profile, which indicates whether a key sealed with this
+// profile could be unsealed in the current state. Any values added to the profile with PCRProtectionProfile.AddPCRValueFromTPM are
+// read from source.
+//
+// An empty profile is always satisfiable.
+func CheckPCRProfileSatisfiable(source PCRSource, profile *PCRProtectionProfile) (bool, error) {
+	if source == nil {
+		return false, errors.New("no PCR source provided")
+	}
+	if profile == nil {
+		profile = &PCRProtectionProfile{}
+	}
+
+	values, err := profile.computePCRValues(source)
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute PCR values from profile: %w", err)
+	}
+
+	// Branches can contain values for different sets of PCRs, so read the union of the PCRs from every branch.
+	selection := make(tpm2.PCRValues)
+	for _, v := range values {
+		for alg := range v {
+			for pcr := range v[alg] {
+				selection.SetValue(alg, pcr, nil)
+			}
+		}
+	}
+
+	current, err := source.ReadPCRs(selection.SelectionList())
+	if err != nil {
+		return false, xerrors.Errorf("cannot read current PCR values: %w", err)
+	}
+
+	for _, v := range values {
+		match := true
+		for alg := range v {
+			for pcr, d := range v[alg] {
+				if !bytes.Equal(d, current[alg][pcr]) {
+					match = false
+				}
+			}
+		}
+		if match {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,138 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestStaticPCRSource(t *testing.T) {
+	source := StaticPCRSource{
+		tpm2.HashAlgorithmSHA256: {
+			7:  makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+			12: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar")}}
+
+	values, err := source.ReadPCRs(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+	if err != nil {
+		t.Fatalf("ReadPCRs failed: %v", err)
+	}
+	if len(values[tpm2.HashAlgorithmSHA256]) != 1 {
+		t.Errorf("ReadPCRs returned the wrong number of values")
+	}
+	if !bytes.Equal(values[tpm2.HashAlgorithmSHA256][7], makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")) {
+		t.Errorf("ReadPCRs returned the wrong value")
+	}
+
+	_, err = source.ReadPCRs(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA1, Select: []int{7}}})
+	if err == nil || err.Error() != "no value for PCR 7 from bank TPM_ALG_SHA1" {
+		t.Errorf("ReadPCRs returned an unexpected error: %v", err)
+	}
+}
+
+func TestAddPCRValueFromSource(t *testing.T) {
+	source := StaticPCRSource{tpm2.HashAlgorithmSHA256: {7: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")}}
+
+	profile := NewPCRProtectionProfile().
+		AddPCRValueFromSource(source, tpm2.HashAlgorithmSHA256, 7).
+		ExtendPCR(tpm2.HashAlgorithmSHA256, 7, makePCREventDigest(tpm2.HashAlgorithmSHA256, "bar"))
+
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("ComputePCRDigests failed: %v", err)
+	}
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	if !pcrs.Equal(expectedPcrs) {
+		t.Errorf("ComputePCRDigests returned the wrong selection")
+	}
+	expected, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs,
+		tpm2.PCRValues{tpm2.HashAlgorithmSHA256: {7: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo", "bar")}})
+	if len(digests) != 1 || !bytes.Equal(digests[0], expected) {
+		t.Errorf("ComputePCRDigests returned unexpected values")
+	}
+}
+
+func TestCheckPCRProfileSatisfiable(t *testing.T) {
+	source := StaticPCRSource{
+		tpm2.HashAlgorithmSHA256: {
+			7:  makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"),
+			12: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar")}}
+
+	for _, data := range []struct {
+		desc     string
+		profile  *PCRProtectionProfile
+		expected bool
+	}{
+		{
+			desc:     "Empty",
+			profile:  NewPCRProtectionProfile(),
+			expected: true,
+		},
+		{
+			desc:     "FromTPM",
+			profile:  NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7),
+			expected: true,
+		},
+		{
+			desc: "Match",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 12, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar")),
+			expected: true,
+		},
+		{
+			desc: "NoMatch",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 12, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+			expected: false,
+		},
+		{
+			desc: "MatchOneBranch",
+			profile: NewPCRProtectionProfile().
+				AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")).
+				AddProfileOR(
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo")),
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar"))),
+			expected: true,
+		},
+		{
+			desc: "MatchBranchWithDifferentPCRs",
+			profile: NewPCRProtectionProfile().
+				AddProfileOR(
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar")),
+					NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar"))),
+			expected: true,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			ok, err := CheckPCRProfileSatisfiable(source, data.profile)
+			if err != nil {
+				t.Fatalf("CheckPCRProfileSatisfiable failed: %v", err)
+			}
+			if ok != data.expected {
+				t.Errorf("CheckPCRProfileSatisfiable returned the wrong result")
+			}
+		})
+	}
+}
@@ -20,9 +20,15 @@
 package secboot
 
 import (
+	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	_ "crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 
 	"github.com/canonical/go-tpm2"
@@ -30,6 +36,57 @@ import (
 	"golang.org/x/xerrors"
 )
 
+var (
+	// pinNVIndexAttrs are the attributes for a NV index created by createPinNVIndex.
+	pinNVIndexAttrs = tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVPolicyRead)
+)
+
+const (
+	// pinNVIndexSize is the size of a NV index created by createPinNVIndex.
+	pinNVIndexSize = 8
+)
+
+// computePassphraseAuthValue computes the authorization value for a PIN NV index from the supplied passphrase. Authorization
+// values can't be longer than the size of the digest of the NV index's name algorithm, so passphrases of arbitrary length are
+// hashed with SHA-256 to produce a fixed length value. The TPM removes trailing zeroes from authorization values, so these are
+// removed from the digest as well to ensure that the same passphrase always produces the same authorization value. An empty
+// passphrase produces an empty authorization value.
+func computePassphraseAuthValue(passphrase string) []byte {
+	if passphrase == "" {
+		return nil
+	}
+	h := crypto.SHA256.New()
+	h.Write([]byte(passphrase))
+	return bytes.TrimRight(h.Sum(nil), "\x00")
+}
+
+// pinIndexAuthValue converts the PIN, passphrase or security key secret supplied by the user in to the authorization value for a PIN
+// NV index. The conversion only depends on the input and not on the authentication mode hint in the key data file, as the hint isn't
+// authenticated and isn't updated in other key data files that share the same PIN NV index. Inputs that fit in an authorization
+// value are used unmodified, which is compatible with PINs set by previous versions of this package. Longer inputs are hashed with
+// computePassphraseAuthValue.
+func pinIndexAuthValue(input string) string {
+	if len(input) <= crypto.SHA256.Size() {
+		return input
+	}
+	return string(computePassphraseAuthValue(input))
+}
+
+// computePinNVIndexPublic computes the public area of an initialized NV index created by createPinNVIndex at the specified handle,
+// using the attributes and name algorithm the index was defined with and the authorization policy digests returned from
+// createPinNVIndex. This makes it possible to compute the name of the NV index without access to the TPM on which it was created.
+func computePinNVIndexPublic(handle tpm2.Handle, attrs tpm2.NVAttributes, nameAlg tpm2.HashAlgorithmId, authPolicies tpm2.DigestList) *tpm2.NVPublic {
+	trial, _ := tpm2.ComputeAuthPolicy(nameAlg)
+	trial.PolicyOR(authPolicies)
+
+	return &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      attrs | tpm2.AttrNVWritten,
+		AuthPolicy: trial.GetDigest(),
+		Size:       pinNVIndexSize}
+}
+
 // computePinNVIndexPostInitAuthPolicies computes the authorization policy digests associated with the post-initialization
 // actions on a NV index created with createPinNVIndex. These are:
 // - A policy for updating the index to revoke old dynamic authorization policies, requiring an assertion signed by the key
@@ -93,8 +150,28 @@ func computePinNVIndexPostInitAuthPolicies(alg tpm2.HashAlgorithmId, updateKeyNa
 // The NV index will be created with an authorization policy that permits TPM2_NV_Read and TPM2_PolicyNV without knowing the PIN,
 // and an authorization policy that permits TPM2_NV_Increment with a signed authorization policy, signed by the key associated with
 // updateKeyName.
+//
+// The NV index is created in the owner hierarchy. Use createPinNVIndexInHierarchy to create it in the platform hierarchy instead.
 func createPinNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tpm2.Name, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, tpm2.DigestList, error) {
-	initKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	return createPinNVIndexInHierarchy(tpm, tpm.OwnerHandleContext(), handle, tpm2.HashAlgorithmSHA256, updateKeyName, rand.Reader, hmacSession)
+}
+
+// createPinNVIndexInHierarchy is like createPinNVIndex, but defines the NV index with the authorization of the supplied hierarchy,
+// which must be either the owner or the platform hierarchy. If it is the platform hierarchy, the NV index is created with the
+// TPMA_NV_PLATFORMCREATE attribute, which means that it cannot be undefined with the owner authorization and it is not removed by
+// TPM2_Clear. The NV index is created with the specified name algorithm, which is also used to compute its authorization policies.
+// The ephemeral key used to initialize the NV index is generated from the supplied source of randomness.
+func createPinNVIndexInHierarchy(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, handle tpm2.Handle, nameAlg tpm2.HashAlgorithmId, updateKeyName tpm2.Name, random io.Reader, hmacSession tpm2.SessionContext) (*tpm2.NVPublic, tpm2.DigestList, error) {
+	attrs := pinNVIndexAttrs
+	switch hierarchy.Handle() {
+	case tpm2.HandleOwner:
+	case tpm2.HandlePlatform:
+		attrs |= tpm2.AttrNVPlatformCreate
+	default:
+		return nil, nil, fmt.Errorf("invalid hierarchy %v", hierarchy.Handle())
+	}
+
+	initKey, err := rsa.GenerateKey(random, 2048)
 	if err != nil {
 		return nil, nil, xerrors.Errorf("cannot create signing key for initializing NV index: %w", err)
 	}
@@ -105,8 +182,6 @@ func createPinNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tp
 		return nil, nil, xerrors.Errorf("cannot compute name of signing key for initializing NV index: %w", err)
 	}
 
-	nameAlg := tpm2.HashAlgorithmSHA256
-
 	// The NV index requires 5 policies:
 	// - A policy for initializing the index, requiring an assertion signed with an ephemeral key so that the index cannot be recreated.
 	// - A policy for updating the index to revoke old dynamic authorization policies, requiring a signed assertion.
@@ -136,11 +211,11 @@ func createPinNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tp
 	public := &tpm2.NVPublic{
 		Index:      handle,
 		NameAlg:    nameAlg,
-		Attrs:      tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVPolicyRead),
+		Attrs:      attrs,
 		AuthPolicy: trial.GetDigest(),
-		Size:       8}
+		Size:       pinNVIndexSize}
 
-	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, hmacSession)
+	index, err := tpm.NVDefineSpace(hierarchy, nil, public, hmacSession)
 	if err != nil {
 		return nil, nil, xerrors.Errorf("cannot define NV space: %w", err)
 	}
@@ -153,7 +228,7 @@ func createPinNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tp
 		if succeeded {
 			return
 		}
-		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, hmacSession)
+		tpm.NVUndefineSpace(hierarchy, index, hmacSession)
 	}()
 
 	// Begin a session to initialize the index.
@@ -170,7 +245,7 @@ func createPinNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, updateKeyName tp
 	binary.Write(h, binary.BigEndian, int32(0))
 
 	// Sign the digest
-	sig, err := rsa.SignPSS(rand.Reader, initKey, signDigest.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	sig, err := rsa.SignPSS(random, initKey, signDigest.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
 	if err != nil {
 		return nil, nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
 	}
@@ -253,17 +328,10 @@ func performPinChange(tpm *tpm2.TPMContext, public *tpm2.NVPublic, authPolicies
 	return nil
 }
 
-// ChangePIN changes the PIN for the key data file at the specified path. The existing PIN must be supplied via the oldPIN argument.
-// Setting newPIN to an empty string will clear the PIN and set a hint on the key data file that no PIN is set.
-//
-// If the TPM's dictionary attack logic has been triggered, a ErrTPMLockout error will be returned.
-//
-// If the file at the specified path cannot be opened, then a wrapped *os.PathError error will be returned.
-//
-// If the supplied key data file fails validation checks, an InvalidKeyFileError error will be returned.
-//
-// If oldPIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be incremented.
-func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
+// changePINIndexAuth changes the authorization value of the PIN NV index for the key data file at the specified path. The current PIN
+// or passphrase is supplied via the oldInput argument and the new one via the newInput argument, and both are converted to
+// authorization values with pinIndexAuthValue. The authentication mode hint in the key data file is updated to newMode.
+func changePINIndexAuth(tpm *TPMConnection, path string, oldInput, newInput string, newMode AuthMode) error {
 	// Check if the TPM is in lockout mode
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
 	if err != nil {
@@ -290,9 +358,17 @@ func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
 		}
 		return xerrors.Errorf("cannot read and validate key data file: %w", err)
 	}
+	if len(data.userPINIndexHandles) > 0 {
+		return errors.New("cannot set a PIN or passphrase on a sealed key object that has user PINs")
+	}
+
+	if newInput == "" {
+		newMode = AuthModeNone
+	}
 
 	// Change the PIN
-	if err := performPinChange(tpm.TPMContext, pinIndexPublic, data.staticPolicyData.PinIndexAuthPolicies, oldPIN, newPIN, tpm.HmacSession()); err != nil {
+	if err := performPinChange(tpm.TPMContext, pinIndexPublic, data.staticPolicyData.PinIndexAuthPolicies,
+		pinIndexAuthValue(oldInput), pinIndexAuthValue(newInput), tpm.HmacSession()); err != nil {
 		if isAuthFailError(err, tpm2.CommandNVChangeAuth, 1) {
 			return ErrPINFail
 		}
@@ -300,16 +376,10 @@ func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
 	}
 
 	// Update the metadata and write a new key data file
-	origAuthModeHint := data.authModeHint
-	if newPIN == "" {
-		data.authModeHint = AuthModeNone
-	} else {
-		data.authModeHint = AuthModePIN
-	}
-
-	if origAuthModeHint == data.authModeHint {
+	if data.authModeHint == newMode {
 		return nil
 	}
+	data.authModeHint = newMode
 
 	if err := data.writeToFileAtomic(path); err != nil {
 		return xerrors.Errorf("cannot write key data file: %v", err)
@@ -317,3 +387,134 @@ func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
 
 	return nil
 }
+
+// ChangePIN changes the PIN for the key data file at the specified path. The existing PIN must be supplied via the oldPIN argument.
+// If a passphrase is currently set, it must be supplied via the oldPIN argument instead. Setting newPIN to an empty string will clear
+// the PIN and set a hint on the key data file that no PIN is set.
+//
+// If the TPM's dictionary attack logic has been triggered, a ErrTPMLockout error will be returned.
+//
+// If the file at the specified path cannot be opened, then a wrapped *os.PathError error will be returned.
+//
+// If the supplied key data file fails validation checks, an InvalidKeyFileError error will be returned.
+//
+// If oldPIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be incremented.
+func ChangePIN(tpm *TPMConnection, path string, oldPIN, newPIN string) error {
+	return changePINIndexAuth(tpm, path, oldPIN, newPIN, AuthModePIN)
+}
+
+// ChangePassphrase changes the passphrase for the key data file at the specified path. This is the same as ChangePIN, except that
+// the passphrase can be of any length. Passphrases that are longer than a SHA-256 digest are hashed to produce the authorization
+// value for the PIN NV index, so the check is still performed by the TPM and is subject to its dictionary attack protection. The
+// existing passphrase or PIN must be supplied via the oldPassphrase argument. Setting newPassphrase to an empty string will clear
+// the passphrase and set a hint on the key data file that no passphrase is set. Once a passphrase is set,
+// SealedKeyObject.UnsealFromTPM expects the passphrase to be supplied via its pin argument.
+//
+// The passphrase is only used as the authorization value of the PIN NV index. The key data file is not encrypted with it, so
+// rotating the passphrase doesn't modify the sealed key object or re-encrypt the key data file.
+//
+// This returns the same errors as ChangePIN.
+func ChangePassphrase(tpm *TPMConnection, path string, oldPassphrase, newPassphrase string) error {
+	return changePINIndexAuth(tpm, path, oldPassphrase, newPassphrase, AuthModePassphrase)
+}
+
+// VerifyPINIndex verifies that the NV index used for PIN support by the supplied sealed key object has the attributes, name
+// algorithm and authorization policy that it was created with by SealKeyToTPM, and that it is the NV index that the sealed key
+// object's authorization policy is bound to. This can be used to detect a NV index that has been recreated with weaker protection
+// (eg, without dictionary attack protection). If any of the checks fail, a PINIndexVerificationError error will be returned which
+// details the mismatch.
+//
+// If the metadata in the sealed key object is inconsistent, a InvalidKeyFileError error will be returned.
+func (t *TPMConnection) VerifyPINIndex(k *SealedKeyObject) error {
+	session := t.HmacSession()
+	if session != nil {
+		session = session.IncludeAttrs(tpm2.AttrAudit)
+	}
+
+	staticData := k.data.staticPolicyData
+
+	handle := staticData.PinIndexHandle
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return InvalidKeyFileError{"PIN NV index handle is invalid"}
+	}
+
+	// Make sure that the authorization policy metadata is consistent with the key used to authorize dynamic authorization policies.
+	authKeyName, err := staticData.AuthPublicKey.Name()
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot compute name of dynamic authorization policy key: %v", err)}
+	}
+	expectedPostInitAuthPolicies, err := computePinNVIndexPostInitAuthPolicies(k.data.pinIndexNameAlg, authKeyName)
+	if err != nil {
+		return xerrors.Errorf("cannot compute expected authorization policies for PIN NV index: %w", err)
+	}
+	if len(staticData.PinIndexAuthPolicies)-1 != len(expectedPostInitAuthPolicies) {
+		return InvalidKeyFileError{"unexpected number of OR policy digests for PIN NV index"}
+	}
+	for i, expected := range expectedPostInitAuthPolicies {
+		if !bytes.Equal(expected, staticData.PinIndexAuthPolicies[i+1]) {
+			return InvalidKeyFileError{"unexpected OR policy digest for PIN NV index"}
+		}
+	}
+
+	index, err := t.CreateResourceContextFromTPM(handle, session)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return PINIndexVerificationError{fmt.Sprintf("no NV index is defined at %v", handle)}
+	case err != nil:
+		return xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+	}
+
+	pub, _, err := t.NVReadPublic(index, session)
+	if err != nil {
+		return xerrors.Errorf("cannot read public area of PIN NV index: %w", err)
+	}
+
+	expected := computePinNVIndexPublic(handle, k.data.pinIndexAttrs, k.data.pinIndexNameAlg, staticData.PinIndexAuthPolicies)
+	if pub.NameAlg != expected.NameAlg {
+		return PINIndexVerificationError{fmt.Sprintf("unexpected name algorithm (got %v, expected %v)", pub.NameAlg, expected.NameAlg)}
+	}
+	if pub.Attrs != expected.Attrs {
+		return PINIndexVerificationError{fmt.Sprintf("unexpected attributes (got 0x%08x, expected 0x%08x)", uint32(pub.Attrs), uint32(expected.Attrs))}
+	}
+	if !bytes.Equal(pub.AuthPolicy, expected.AuthPolicy) {
+		return PINIndexVerificationError{fmt.Sprintf("unexpected authorization policy (got %x, expected %x)", pub.AuthPolicy, expected.AuthPolicy)}
+	}
+	if pub.Size != expected.Size {
+		return PINIndexVerificationError{fmt.Sprintf("unexpected size (got %d, expected %d)", pub.Size, expected.Size)}
+	}
+
+	// Make sure that the sealed key object's authorization policy is bound to this NV index.
+	lockIndex, err := t.CreateResourceContextFromTPM(lockNVHandle, session)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, lockNVHandle):
+		return ErrTPMProvisioning
+	case err != nil:
+		return xerrors.Errorf("cannot create context for lock NV index: %w", err)
+	}
+
+	trial, err := tpm2.ComputeAuthPolicy(k.data.keyPublic.NameAlg)
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("cannot compute expected authorization policy for sealed key object: %v", err)}
+	}
+	trial.PolicyAuthorize(nil, authKeyName)
+	trial.PolicySecret(index.Name(), nil)
+	trial.PolicyNV(lockIndex.Name(), nil, 0, tpm2.OpEq)
+	if k.data.requirePhysicalPresence {
+		trial.PolicyPhysicalPresence()
+	}
+	if k.data.networkSecretIndexHandle != 0 {
+		trial.PolicySecret(k.data.networkSecretIndexName, nil)
+	}
+	if k.data.singleUseIndexHandle != 0 {
+		trial.PolicyNV(k.data.singleUseIndexName, makeSingleUseOperand(k.data.singleUseCount), 0, tpm2.OpEq)
+	}
+	authPolicy, err := computeExpectedSealedKeyAuthPolicy(k.data.keyPublic.NameAlg, trial.GetDigest(), k.data.adminPolicyData, lockIndex.Name())
+	if err != nil {
+		return InvalidKeyFileError{fmt.Sprintf("invalid admin override metadata: %v", err)}
+	}
+	if !bytes.Equal(authPolicy, k.data.keyPublic.AuthPolicy) {
+		return PINIndexVerificationError{"the sealed key object's authorization policy is not bound to the NV index"}
+	}
+
+	return nil
+}
@@ -171,7 +171,7 @@ func (s *pinSuite) SetUpSuite(c *C) {
 
 func (s *pinSuite) SetUpTest(c *C) {
 	s.tpmTestBase.SetUpTest(c)
-	c.Assert(ProvisionTPM(s.tpm, ProvisionModeFull, nil), IsNil)
+	c.Assert(ProvisionTPM(s.tpm, ProvisionModeFull, nil, true), IsNil)
 
 	dir := c.MkDir()
 	s.keyFile = dir + "/keydata"
@@ -225,6 +225,66 @@ func (s *pinSuite) TestChangePINDoesntUpdateFileIfAuthModeDoesntChange(c *C) {
 	c.Check(fi2.ModTime(), DeepEquals, fi1.ModTime())
 }
 
+func (s *pinSuite) TestSetAndClearPassphrase(c *C) {
+	passphrase := "correct horse battery staple, which is much longer than the digest size of the PIN NV index name algorithm"
+	c.Check(ChangePassphrase(s.tpm, s.keyFile, "", passphrase), IsNil)
+
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	c.Check(k.AuthMode2F(), Equals, AuthModePassphrase)
+
+	key, err := k.UnsealFromTPM(s.tpm, passphrase)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+
+	_, err = k.UnsealFromTPM(s.tpm, "wrong passphrase")
+	c.Check(err, Equals, ErrPINFail)
+
+	c.Check(ChangePassphrase(s.tpm, s.keyFile, passphrase, ""), IsNil)
+	s.checkPIN(c, "")
+}
+
+func (s *pinSuite) TestChangePassphraseToPIN(c *C) {
+	passphrase := "foo bar baz"
+	c.Check(ChangePassphrase(s.tpm, s.keyFile, "", passphrase), IsNil)
+
+	testPIN := "1234"
+	c.Check(ChangePIN(s.tpm, s.keyFile, passphrase, testPIN), IsNil)
+	s.checkPIN(c, testPIN)
+}
+
+func (s *pinSuite) TestComputePassphraseAuthValue(c *C) {
+	c.Check(ComputePassphraseAuthValue(""), IsNil)
+
+	a := ComputePassphraseAuthValue("foo")
+	c.Check(a, DeepEquals, ComputePassphraseAuthValue("foo"))
+	c.Check(a, Not(DeepEquals), ComputePassphraseAuthValue("bar"))
+	c.Check(len(a) <= 32, Equals, true)
+}
+
+func (s *pinSuite) TestPinIndexAuthValue(c *C) {
+	c.Check(PinIndexAuthValue("1234"), Equals, "1234")
+	c.Check(PinIndexAuthValue("foo bar baz"), Equals, "foo bar baz")
+
+	passphrase := "correct horse battery staple, which is much longer than the digest size of the PIN NV index name algorithm"
+	c.Check(PinIndexAuthValue(passphrase), Equals, string(ComputePassphraseAuthValue(passphrase)))
+}
+
+func (s *pinSuite) TestUnsealWithPassphraseIgnoresAuthModeHint(c *C) {
+	// Keep a copy of the key data file with the original hint, as another key data file that shares the same PIN NV index would
+	// have after the passphrase is changed.
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	c.Check(k.AuthMode2F(), Equals, AuthModeNone)
+
+	passphrase := "correct horse battery staple, which is much longer than the digest size of the PIN NV index name algorithm"
+	c.Check(ChangePassphrase(s.tpm, s.keyFile, "", passphrase), IsNil)
+
+	key, err := k.UnsealFromTPM(s.tpm, passphrase)
+	c.Check(err, IsNil)
+	c.Check(key, DeepEquals, s.key)
+}
+
 type testChangePINErrorHandlingData struct {
 	keyFile        string
 	errChecker     Checker
@@ -272,3 +332,56 @@ func (s *pinSuite) TestChangePINErrorHandling4(c *C) {
 		errCheckerArgs: []interface{}{"invalid key data file: cannot validate key data: PIN NV index is unavailable"},
 	})
 }
+
+func (s *pinSuite) TestVerifyPINIndex(c *C) {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	c.Check(s.tpm.VerifyPINIndex(k), IsNil)
+
+	c.Check(ChangePIN(s.tpm, s.keyFile, "", "1234"), IsNil)
+	k, err = ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+	c.Check(s.tpm.VerifyPINIndex(k), IsNil)
+}
+
+func (s *pinSuite) TestVerifyPINIndexMissing(c *C) {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+
+	pinIndex, err := s.tpm.CreateResourceContextFromTPM(s.pinHandle)
+	c.Assert(err, IsNil)
+	c.Assert(s.tpm.NVUndefineSpace(s.tpm.OwnerHandleContext(), pinIndex, nil), IsNil)
+
+	err = s.tpm.VerifyPINIndex(k)
+	c.Check(err, ErrorMatches, "cannot verify the PIN NV index: no NV index is defined at 0x0181fff0")
+	c.Check(err, FitsTypeOf, PINIndexVerificationError{})
+
+	// Define something at the PIN handle so that the cleanup registered in SetUpTest succeeds.
+	s.defineWeakPINIndex(c)
+}
+
+func (s *pinSuite) TestVerifyPINIndexWeakerAttributes(c *C) {
+	k, err := ReadSealedKeyObject(s.keyFile)
+	c.Assert(err, IsNil)
+
+	pinIndex, err := s.tpm.CreateResourceContextFromTPM(s.pinHandle)
+	c.Assert(err, IsNil)
+	c.Assert(s.tpm.NVUndefineSpace(s.tpm.OwnerHandleContext(), pinIndex, nil), IsNil)
+	s.defineWeakPINIndex(c)
+
+	err = s.tpm.VerifyPINIndex(k)
+	c.Check(err, ErrorMatches, "cannot verify the PIN NV index: unexpected attributes .*")
+	c.Check(err, FitsTypeOf, PINIndexVerificationError{})
+}
+
+// defineWeakPINIndex defines a NV counter index at the PIN handle without dictionary attack protection. It is undefined by the
+// cleanup registered in SetUpTest.
+func (s *pinSuite) defineWeakPINIndex(c *C) {
+	pub := tpm2.NVPublic{
+		Index:   s.pinHandle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+	_, err := s.tpm.NVDefineSpace(s.tpm.OwnerHandleContext(), nil, &pub, nil)
+	c.Assert(err, IsNil)
+}
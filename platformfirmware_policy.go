@@ -0,0 +1,137 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+// startupLocalitySignature is the signature of the EV_NO_ACTION event that indicates the locality from which TPM2_Startup was
+// executed, see section 9.4.5.3 of the "TCG PC Client Platform Firmware Profile Specification".
+var startupLocalitySignature = []byte("StartupLocality\x00")
+
+// PlatformFirmwareProfileMode specifies how AddPlatformFirmwareProfile generates the PCR value for the platform firmware PCR.
+type PlatformFirmwareProfileMode int
+
+const (
+	// PlatformFirmwareProfileModeReplay indicates that the PCR value should be computed by replaying the measurements recorded to
+	// PCR 0 in the TCG event log.
+	PlatformFirmwareProfileModeReplay PlatformFirmwareProfileMode = iota
+
+	// PlatformFirmwareProfileModeCopyCurrent indicates that the current PCR value should be read back from the TPM when the PCR
+	// values for the profile are computed. This does not require the TCG event log to be parsed, and is useful on platforms where
+	// the event log contains vendor specific events that cannot be replayed.
+	PlatformFirmwareProfileModeCopyCurrent
+)
+
+// PlatformFirmwareProfileParams provides the parameters to AddPlatformFirmwareProfile.
+type PlatformFirmwareProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Mode specifies how the PCR value is generated.
+	Mode PlatformFirmwareProfileMode
+}
+
+// AddPlatformFirmwareProfile adds the platform firmware profile to the provided PCR protection profile, in order to generate a PCR
+// policy that restricts access to a sealed key to the current platform firmware, as measured to PCR 0. Events that are measured to
+// this PCR are detailed in section 2.3.4.1 of the "TCG PC Client Platform Firmware Profile Specification".
+//
+// The contents of PCR 0 are determined by the platform manufacturer and often contain vendor specific events, which makes it
+// impractical to predict the value of this PCR for a firmware version other than the one that is currently running. This function
+// therefore only supports generating a profile for the current platform firmware, and the generated profile will not be satisfied
+// after any update to the platform firmware. Callers that use this profile must arrange to reseal keys after a firmware update,
+// eg, by creating a new PCR profile with this function during the first boot after the update has been applied and then calling
+// UpdateKeyPCRProtectionPolicy.
+//
+// If the Mode field of params is PlatformFirmwareProfileModeReplay, the PCR value is computed by replaying the events recorded to
+// PCR 0 in the TCG event log. The contents of each event are not interpreted, so events with vendor specific formats are supported.
+// If the event log indicates that TPM2_Startup was executed from a locality other than 0, the initial PCR value will reflect this.
+//
+// If the Mode field of params is PlatformFirmwareProfileModeCopyCurrent, the current value of PCR 0 is read back from the TPM when
+// the PCR values for the profile are computed.
+func AddPlatformFirmwareProfile(profile *PCRProtectionProfile, params *PlatformFirmwareProfileParams) error {
+	switch params.Mode {
+	case PlatformFirmwareProfileModeReplay:
+	case PlatformFirmwareProfileModeCopyCurrent:
+		profile.AddPCRValueFromTPM(params.PCRAlgorithm, platformFirmwarePCR)
+		return nil
+	default:
+		return errors.New("invalid mode")
+	}
+
+	// Load event log
+	log, err := openEventLog()
+	if err != nil {
+		return err
+	}
+
+	if !log.Algorithms.Contains(tcglog.AlgorithmId(params.PCRAlgorithm)) {
+		return errors.New("cannot compute platform firmware policy digests: the TCG event log does not have the requested algorithm")
+	}
+
+	value := make(tpm2.Digest, params.PCRAlgorithm.Size())
+
+	for {
+		event, err := log.NextEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return xerrors.Errorf("cannot parse TCG event log: %w", err)
+		}
+
+		if event.PCRIndex != platformFirmwarePCR {
+			continue
+		}
+
+		if event.EventType == tcglog.EventTypeNoAction {
+			// EV_NO_ACTION events aren't measured, but the StartupLocality event determines the initial value of PCR 0.
+			data := event.Data.Bytes()
+			if len(data) == len(startupLocalitySignature)+1 && bytes.HasPrefix(data, startupLocalitySignature) {
+				value[len(value)-1] = data[len(data)-1]
+			}
+			continue
+		}
+
+		digest, ok := event.Digests[tcglog.AlgorithmId(params.PCRAlgorithm)]
+		if !ok || len(digest) != params.PCRAlgorithm.Size() {
+			return fmt.Errorf("event %d in TCG event log has an invalid digest for the requested algorithm", event.Index)
+		}
+
+		h := params.PCRAlgorithm.NewHash()
+		h.Write(value)
+		h.Write(digest)
+		value = h.Sum(nil)
+	}
+
+	profile.AddPCRValue(params.PCRAlgorithm, platformFirmwarePCR, value)
+	return nil
+}
@@ -0,0 +1,86 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package secboot_test
+
+import (
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+
+	. "gopkg.in/check.v1"
+)
+
+type platformFirmwarePolicySuite struct{}
+
+var _ = Suite(&platformFirmwarePolicySuite{})
+
+type testAddPlatformFirmwareProfileData struct {
+	eventLogPath string
+	alg          tpm2.HashAlgorithmId
+	value        tpm2.Digest
+}
+
+func (s *platformFirmwarePolicySuite) testAddPlatformFirmwareProfile(c *C, data *testAddPlatformFirmwareProfileData) {
+	restoreEventLogPath := MockEventLogPath(data.eventLogPath)
+	defer restoreEventLogPath()
+
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddPlatformFirmwareProfile(profile, &PlatformFirmwareProfileParams{PCRAlgorithm: data.alg}), IsNil)
+
+	expectedPcrs := tpm2.PCRSelectionList{{Hash: data.alg, Select: []int{0}}}
+	expectedDigest, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, tpm2.PCRValues{data.alg: {0: data.value}})
+
+	pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+	c.Assert(err, IsNil)
+	c.Check(pcrs.Equal(expectedPcrs), Equals, true)
+	c.Check(digests, DeepEquals, tpm2.DigestList{expectedDigest})
+	if c.Failed() {
+		c.Logf("Profile:\n%s", profile)
+		c.Logf("Values:\n%s", profile.DumpValues(nil))
+	}
+}
+
+func (s *platformFirmwarePolicySuite) TestAddPlatformFirmwareProfile1(c *C) {
+	s.testAddPlatformFirmwareProfile(c, &testAddPlatformFirmwareProfileData{
+		eventLogPath: "testdata/eventlog1.bin",
+		alg:          tpm2.HashAlgorithmSHA256,
+		value:        decodeHexString(c, "7e77f6ab3fa1cf5c24a9787ec2812f33cc2abf196822fe34ee042a89ee717497"),
+	})
+}
+
+func (s *platformFirmwarePolicySuite) TestAddPlatformFirmwareProfile2(c *C) {
+	s.testAddPlatformFirmwareProfile(c, &testAddPlatformFirmwareProfileData{
+		eventLogPath: "testdata/eventlog1.bin",
+		alg:          tpm2.HashAlgorithmSHA1,
+		value:        decodeHexString(c, "8b5be72c691d78ced9e6941a89bd8afb6f1a8dcd"),
+	})
+}
+
+func (s *platformFirmwarePolicySuite) TestAddPlatformFirmwareProfileCopyCurrent(c *C) {
+	profile := NewPCRProtectionProfile()
+	c.Assert(AddPlatformFirmwareProfile(profile, &PlatformFirmwareProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Mode:         PlatformFirmwareProfileModeCopyCurrent}), IsNil)
+	c.Check(profile.String(), Equals, NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 0).String())
+}
+
+func (s *platformFirmwarePolicySuite) TestAddPlatformFirmwareProfileInvalidMode(c *C) {
+	c.Check(AddPlatformFirmwareProfile(NewPCRProtectionProfile(), &PlatformFirmwareProfileParams{
+		PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+		Mode:         10}), ErrorMatches, "invalid mode")
+}
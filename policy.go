@@ -26,6 +26,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 
 	"github.com/canonical/go-tpm2"
 
@@ -44,7 +45,7 @@ var (
 
 // dynamicPolicyComputeParams provides the parameters to computeDynamicPolicy.
 type dynamicPolicyComputeParams struct {
-	key *rsa.PrivateKey // Key used to authorize the generated dynamic authorization policy
+	key *rsa.PrivateKey // Key used to authorize the generated dynamic authorization policy. If this is nil, the policy is not signed
 
 	// signAlg is the digest algorithm for the signature used to authorize the generated dynamic authorization policy. It must
 	// match the name algorithm of the public part of key that will be loaded in to the TPM for verification.
@@ -56,6 +57,46 @@ type dynamicPolicyComputeParams struct {
 	// policyCount is the maximum permitted value of the NV index associated with policyCountIndexName, beyond which, this authorization
 	// policy will not be satisfied.
 	policyCount uint64
+
+	// revocationCheck optionally identifies a bit in a NV bit field index which, when set, will cause this authorization policy to not
+	// be satisfied. This is used for individually revocable authorized PCR policies.
+	revocationCheck *pcrPolicyRevocationCheck
+
+	// random is the source of randomness for the signature used to authorize the generated dynamic authorization policy. If
+	// this is nil, crypto/rand is used.
+	random io.Reader
+
+	// userPINPolicyORDigests are the digests for a TPM2_PolicyOR assertion that authorizes one of a set of user PIN NV indices with
+	// a TPM2_PolicySecret assertion. If this is empty, the policy has no user PIN assertions.
+	userPINPolicyORDigests tpm2.DigestList
+
+	// pcrGracePeriodDigests are additional approved PCR digests for the same PCR selection as pcrDigests, which are only accepted
+	// whilst the TPM's clock is less than pcrGracePeriodExpiry. Each of these conditions has a TPM2_PolicyCounterTimer assertion
+	// after its TPM2_PolicyPCR assertion.
+	pcrGracePeriodDigests tpm2.DigestList
+	pcrGracePeriodExpiry  uint64
+}
+
+// makePCRGracePeriodOperand returns the operand for the TPM2_PolicyCounterTimer assertion that limits the PCR digests that are
+// only accepted during a grace period to the period before the TPM's clock reaches the supplied expiry.
+func makePCRGracePeriodOperand(expiry uint64) tpm2.Operand {
+	operand := make(tpm2.Operand, binary.Size(expiry))
+	binary.BigEndian.PutUint64(operand, expiry)
+	return operand
+}
+
+// pcrPolicyRevocationCheck identifies a bit in a NV bit field index that is used to revoke an individual dynamic authorization
+// policy.
+type pcrPolicyRevocationCheck struct {
+	indexName tpm2.Name // Name of the NV bit field index
+	bit       uint32    // The bit that is set when the policy is revoked
+}
+
+// operand returns the operand for the TPM2_PolicyNV assertion used to check that this policy hasn't been revoked.
+func (c *pcrPolicyRevocationCheck) operand() []byte {
+	operandB := make([]byte, 8)
+	binary.BigEndian.PutUint64(operandB, uint64(1)<<c.bit)
+	return operandB
 }
 
 // policyOrDataNode represents a collection of up to 8 digests used in a single TPM2_PolicyOR invocation, and forms part of a tree
@@ -95,6 +136,11 @@ type staticPolicyComputeParams struct {
 	pinIndexPub          *tpm2.NVPublic  // Public area of the NV index used for the PIN
 	pinIndexAuthPolicies tpm2.DigestList // Metadata for executing policy sessions to interact with the PIN NV index
 	lockIndexName        tpm2.Name       // Name of the global NV index for locking access to sealed key objects
+
+	requirePhysicalPresence bool      // Whether to include a TPM2_PolicyPhysicalPresence assertion
+	networkSecretIndexName  tpm2.Name // Name of the NV index for network-bound unlocking, if there is one
+	singleUseIndexName      tpm2.Name // Name of the NV counter index for revoking a single use key, if there is one
+	singleUseCount          uint64    // Value of the NV counter index for revoking a single use key that the key is bound to
 }
 
 // staticPolicyData is an output of computeStaticPolicy and provides metadata for executing a policy session.
@@ -398,7 +444,7 @@ func ensureLockNVIndex(tpm *tpm2.TPMContext, session tpm2.SessionContext) error
 	}()
 
 	// Initialize the index
-	if err := tpm.NVWrite(dataIndex, dataIndex, data, 0, session); err != nil {
+	if err := nvWrite(tpm, dataIndex, dataIndex, data, 0, session); err != nil {
 		return xerrors.Errorf("cannot initialize policy data NV index: %w", err)
 	}
 	if err := tpm.NVWriteLock(dataIndex, dataIndex, session); err != nil {
@@ -421,7 +467,7 @@ func readAndValidateLockNVIndexPublic(tpm *tpm2.TPMContext, index tpm2.ResourceC
 	if err != nil {
 		return nil, xerrors.Errorf("cannot read public area of policy data NV index: %w", err)
 	}
-	data, err := tpm.NVRead(dataIndex, dataIndex, dataPub.Size, 0, nil)
+	data, err := nvRead(tpm, dataIndex, dataIndex, dataPub.Size, 0, nil)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot read policy data: %w", err)
 	}
@@ -511,6 +557,15 @@ func computeStaticPolicy(alg tpm2.HashAlgorithmId, input *staticPolicyComputePar
 	trial.PolicyAuthorize(nil, keyName)
 	trial.PolicySecret(pinIndexName, nil)
 	trial.PolicyNV(input.lockIndexName, nil, 0, tpm2.OpEq)
+	if input.requirePhysicalPresence {
+		trial.PolicyPhysicalPresence()
+	}
+	if len(input.networkSecretIndexName) > 0 {
+		trial.PolicySecret(input.networkSecretIndexName, nil)
+	}
+	if len(input.singleUseIndexName) > 0 {
+		trial.PolicyNV(input.singleUseIndexName, makeSingleUseOperand(input.singleUseCount), 0, tpm2.OpEq)
+	}
 
 	return &staticPolicyData{
 		AuthPublicKey:        input.key,
@@ -580,48 +635,85 @@ func computePolicyORData(alg tpm2.HashAlgorithmId, trial *tpm2.TrialAuthPolicy,
 // computeDynamicPolicy computes the part of an authorization policy associated with a sealed key object that can change and be
 // updated.
 func computeDynamicPolicy(version uint32, alg tpm2.HashAlgorithmId, input *dynamicPolicyComputeParams) (*dynamicPolicyData, error) {
-	// We only have a single metadata version at the moment (version 0)
+	// We only have a single policy version at the moment (version 0)
 	if version != 0 {
 		return nil, errors.New("invalid version")
 	}
-	if len(input.pcrDigests) == 0 {
+	if len(input.pcrs) > 0 && len(input.pcrDigests) == 0 {
 		return nil, errors.New("no PCR digests specified")
 	}
 
-	// Compute the policy digest that would result from a TPM2_PolicyPCR assertion for each condition
-	var pcrOrDigests tpm2.DigestList
-	for _, d := range input.pcrDigests {
-		trial, _ := tpm2.ComputeAuthPolicy(alg)
-		trial.PolicyPCR(d, input.pcrs)
-		pcrOrDigests = append(pcrOrDigests, trial.GetDigest())
-	}
-
 	trial, _ := tpm2.ComputeAuthPolicy(alg)
-	pcrOrData := computePolicyORData(alg, trial, pcrOrDigests)
+
+	// If there are user PINs, the policy begins with a TPM2_PolicyOR assertion that authorizes any one of the user PIN NV indices.
+	// This replaces the session digest, so each PCR condition below is computed on top of it.
+	if len(input.userPINPolicyORDigests) > 0 {
+		trial.PolicyOR(ensureSufficientORDigests(input.userPINPolicyORDigests))
+	}
+
+	// If the PCR selection is empty, the policy has no TPM2_PolicyPCR or TPM2_PolicyOR assertions and is not bound to any PCR
+	// values.
+	var pcrOrData policyOrDataTree
+	if len(input.pcrs) > 0 {
+		// Compute the policy digest that would result from a TPM2_PolicyPCR assertion for each condition
+		var pcrOrDigests tpm2.DigestList
+		for _, d := range input.pcrDigests {
+			trial, _ := tpm2.ComputeAuthPolicy(alg)
+			if len(input.userPINPolicyORDigests) > 0 {
+				trial.PolicyOR(ensureSufficientORDigests(input.userPINPolicyORDigests))
+			}
+			trial.PolicyPCR(d, input.pcrs)
+			pcrOrDigests = append(pcrOrDigests, trial.GetDigest())
+		}
+		for _, d := range input.pcrGracePeriodDigests {
+			trial, _ := tpm2.ComputeAuthPolicy(alg)
+			if len(input.userPINPolicyORDigests) > 0 {
+				trial.PolicyOR(ensureSufficientORDigests(input.userPINPolicyORDigests))
+			}
+			trial.PolicyPCR(d, input.pcrs)
+			trial.PolicyCounterTimer(makePCRGracePeriodOperand(input.pcrGracePeriodExpiry), 8, tpm2.OpUnsignedLT)
+			pcrOrDigests = append(pcrOrDigests, trial.GetDigest())
+		}
+
+		pcrOrData = computePolicyORData(alg, trial, pcrOrDigests)
+	}
 
 	operandB := make([]byte, 8)
 	binary.BigEndian.PutUint64(operandB, input.policyCount)
 	trial.PolicyNV(input.policyCountIndexName, operandB, 0, tpm2.OpUnsignedLE)
 
+	if input.revocationCheck != nil {
+		trial.PolicyNV(input.revocationCheck.indexName, input.revocationCheck.operand(), 0, tpm2.OpBitClear)
+	}
+
 	authorizedPolicy := trial.GetDigest()
 
-	// Create a digest to sign
-	h := input.signAlg.NewHash()
-	h.Write(authorizedPolicy)
+	// If there's no key, then the authorized policy is left unsigned. It will need to be signed later on by the holder of the
+	// private part of the key used to authorize dynamic authorization policies.
+	signature := tpm2.Signature{SigAlg: tpm2.SigSchemeAlgNull}
+	if input.key != nil {
+		// Create a digest to sign
+		h := input.signAlg.NewHash()
+		h.Write(authorizedPolicy)
+
+		// Sign the digest
+		random := input.random
+		if random == nil {
+			random = rand.Reader
+		}
+		sig, err := rsa.SignPSS(random, input.key, input.signAlg.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		if err != nil {
+			return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
+		}
 
-	// Sign the digest
-	sig, err := rsa.SignPSS(rand.Reader, input.key, input.signAlg.GetHash(), h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
-	if err != nil {
-		return nil, xerrors.Errorf("cannot provide signature for initializing NV index: %w", err)
+		signature = tpm2.Signature{
+			SigAlg: tpm2.SigSchemeAlgRSAPSS,
+			Signature: tpm2.SignatureU{
+				Data: &tpm2.SignatureRSAPSS{
+					Hash: input.signAlg,
+					Sig:  tpm2.PublicKeyRSA(sig)}}}
 	}
 
-	signature := tpm2.Signature{
-		SigAlg: tpm2.SigSchemeAlgRSAPSS,
-		Signature: tpm2.SignatureU{
-			Data: &tpm2.SignatureRSAPSS{
-				Hash: input.signAlg,
-				Sig:  tpm2.PublicKeyRSA(sig)}}}
-
 	return &dynamicPolicyData{
 		PCRSelection:              input.pcrs,
 		PCROrData:                 pcrOrData,
@@ -710,23 +802,110 @@ func executePolicyORAssertions(tpm *tpm2.TPMContext, session tpm2.SessionContext
 	return nil
 }
 
+// executePCRGracePeriodAssertion executes the TPM2_PolicyCounterTimer assertion for PCR digests that are only accepted during a
+// grace period, if the current session digest after the TPM2_PolicyPCR assertion isn't one of the conditions in the supplied
+// policy data. If the grace period has expired, a dynamicPolicyDataError error is returned.
+func executePCRGracePeriodAssertion(tpm *tpm2.TPMContext, session tpm2.SessionContext, data policyOrDataTree, expiry uint64) error {
+	currentDigest, err := tpm.PolicyGetDigest(session)
+	if err != nil {
+		return xerrors.Errorf("cannot obtain current session digest: %w", err)
+	}
+	if digestListContains(data.leafDigests(), currentDigest) {
+		return nil
+	}
+
+	if err := tpm.PolicyCounterTimer(session, makePCRGracePeriodOperand(expiry), 8, tpm2.OpUnsignedLT); err != nil {
+		if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyCounterTimer) {
+			return dynamicPolicyDataError{errors.New("the current PCR values are not authorized, or the grace period for the previous PCR values has expired")}
+		}
+		return xerrors.Errorf("cannot execute grace period assertion: %w", err)
+	}
+	return nil
+}
+
+// dynamicPolicyAuthorization contains the result of verifying the signature of a dynamic authorization policy with the TPM, which
+// is required for the TPM2_PolicyAuthorize assertion. The verification ticket isn't bound to a policy session, so it can be reused
+// in multiple policy sessions for the same dynamic authorization policy.
+type dynamicPolicyAuthorization struct {
+	keyName tpm2.Name        // Name of the key used to verify the signature
+	ticket  *tpm2.TkVerified // Verification ticket
+}
+
+// authorizeDynamicPolicy verifies the signature of the supplied dynamic authorization policy with the key in the supplied static
+// policy metadata, returning the ticket required by the TPM2_PolicyAuthorize assertion.
+func authorizeDynamicPolicy(tpm *tpm2.TPMContext, staticInput *staticPolicyData, dynamicInput *dynamicPolicyData) (*dynamicPolicyAuthorization, error) {
+	authPublicKey := staticInput.AuthPublicKey
+	if !authPublicKey.NameAlg.Supported() {
+		return nil, staticPolicyDataError{errors.New("public area of dynamic authorization policy signature verification key has an unsupported name algorithm")}
+	}
+	authorizeKey, err := tpm.LoadExternal(nil, authPublicKey, tpm2.HandleOwner)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoadExternal, 2) {
+			// staticInput.AuthPublicKey is invalid
+			return nil, staticPolicyDataError{errors.New("public area of dynamic authorization policy signature verification key is invalid")}
+		}
+		return nil, xerrors.Errorf("cannot load public area for dynamic authorization policy signature verification key: %w", err)
+	}
+	defer tpm.FlushContext(authorizeKey)
+
+	if dynamicInput.AuthorizedPolicySignature == nil || dynamicInput.AuthorizedPolicySignature.SigAlg == tpm2.SigSchemeAlgNull {
+		// The dynamic authorization policy hasn't been signed yet.
+		return nil, dynamicPolicyDataError{errors.New("the dynamic authorization policy has not been authorized")}
+	}
+
+	h := authPublicKey.NameAlg.NewHash()
+	h.Write(dynamicInput.AuthorizedPolicy)
+
+	authorizeTicket, err := tpm.VerifySignature(authorizeKey, h.Sum(nil), dynamicInput.AuthorizedPolicySignature)
+	if err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandVerifySignature, 2) {
+			// dynamicInput.AuthorizedPolicySignature is invalid.
+			return nil, dynamicPolicyDataError{errors.New("cannot verify dynamic authorization policy signature")}
+		}
+		return nil, xerrors.Errorf("cannot verify dynamic authorization policy signature: %w", err)
+	}
+
+	return &dynamicPolicyAuthorization{keyName: authorizeKey.Name(), ticket: authorizeTicket}, nil
+}
+
 // executePolicySession executes an authorization policy session using the supplied metadata. On success, the supplied policy
-// session can be used for authorization.
+// session can be used for authorization. If pcrGracePeriodExpiry is not zero, the dynamic authorization policy accepts some PCR
+// digests only whilst the TPM's clock is less than it. If authorization is not nil, it must have been obtained from
+// authorizeDynamicPolicy for the supplied metadata. Otherwise, the signature of the dynamic authorization policy is verified.
 func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, staticInput *staticPolicyData,
-	dynamicInput *dynamicPolicyData, pin string, hmacSession tpm2.SessionContext) error {
-	if err := tpm.PolicyPCR(policySession, nil, dynamicInput.PCRSelection); err != nil {
-		return xerrors.Errorf("cannot execute PCR assertion: %w", err)
-	}
+	dynamicInput *dynamicPolicyData, authorization *dynamicPolicyAuthorization, pcrGracePeriodExpiry uint64, pin string,
+	hmacSession tpm2.SessionContext) error {
+	return executePolicySessionWithRevocationCheck(tpm, policySession, staticInput, dynamicInput, authorization, pcrGracePeriodExpiry,
+		nil, 0, pin, hmacSession)
+}
 
-	if err := executePolicyORAssertions(tpm, policySession, dynamicInput.PCROrData); err != nil {
-		switch {
-		case tpm2.IsTPMError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyGetDigest):
-			return xerrors.Errorf("cannot execute OR assertions: %w", err)
-		case tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1):
-			// The dynamic authorization policy data is invalid.
-			return dynamicPolicyDataError{errors.New("cannot complete OR assertions: invalid data")}
+// executePolicySessionWithRevocationCheck is the same as executePolicySession, but for dynamic authorization policies that were
+// computed with a revocation check (see pcrPolicyRevocationCheck). If revocationIndex is nil, no revocation check is executed.
+func executePolicySessionWithRevocationCheck(tpm *tpm2.TPMContext, policySession tpm2.SessionContext, staticInput *staticPolicyData,
+	dynamicInput *dynamicPolicyData, authorization *dynamicPolicyAuthorization, pcrGracePeriodExpiry uint64, revocationIndex tpm2.ResourceContext, revocationBit uint32, pin string,
+	hmacSession tpm2.SessionContext) error {
+	// A policy with an empty PCR selection isn't bound to any PCR values and has no TPM2_PolicyPCR or TPM2_PolicyOR assertions.
+	if len(dynamicInput.PCRSelection) > 0 {
+		if err := tpm.PolicyPCR(policySession, nil, dynamicInput.PCRSelection); err != nil {
+			return xerrors.Errorf("cannot execute PCR assertion: %w", err)
+		}
+
+		if pcrGracePeriodExpiry != 0 {
+			if err := executePCRGracePeriodAssertion(tpm, policySession, dynamicInput.PCROrData, pcrGracePeriodExpiry); err != nil {
+				return err
+			}
+		}
+
+		if err := executePolicyORAssertions(tpm, policySession, dynamicInput.PCROrData); err != nil {
+			switch {
+			case tpm2.IsTPMError(err, tpm2.AnyErrorCode, tpm2.CommandPolicyGetDigest):
+				return xerrors.Errorf("cannot execute OR assertions: %w", err)
+			case tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1):
+				// The dynamic authorization policy data is invalid.
+				return dynamicPolicyDataError{errors.New("cannot complete OR assertions: invalid data")}
+			}
+			return dynamicPolicyDataError{xerrors.Errorf("cannot complete OR assertions: %w", err)}
 		}
-		return dynamicPolicyDataError{xerrors.Errorf("cannot complete OR assertions: %w", err)}
 	}
 
 	pinIndexHandle := staticInput.PinIndexHandle
@@ -781,33 +960,24 @@ func executePolicySession(tpm *tpm2.TPMContext, policySession tpm2.SessionContex
 		return xerrors.Errorf("dynamic authorization policy revocation check failed: %w", err)
 	}
 
-	authPublicKey := staticInput.AuthPublicKey
-	if !authPublicKey.NameAlg.Supported() {
-		return staticPolicyDataError{errors.New("public area of dynamic authorization policy signature verification key has an unsupported name algorithm")}
-	}
-	authorizeKey, err := tpm.LoadExternal(nil, authPublicKey, tpm2.HandleOwner)
-	if err != nil {
-		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandLoadExternal, 2) {
-			// staticInput.AuthPublicKey is invalid
-			return staticPolicyDataError{errors.New("public area of dynamic authorization policy signature verification key is invalid")}
+	if revocationIndex != nil {
+		check := pcrPolicyRevocationCheck{bit: revocationBit}
+		if err := tpm.PolicyNV(revocationIndex, revocationIndex, policySession, check.operand(), 0, tpm2.OpBitClear, nil); err != nil {
+			if tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV) {
+				return dynamicPolicyDataError{errors.New("the authorized PCR policy has been revoked")}
+			}
+			return xerrors.Errorf("authorized PCR policy revocation check failed: %w", err)
 		}
-		return xerrors.Errorf("cannot load public area for dynamic authorization policy signature verification key: %w", err)
 	}
-	defer tpm.FlushContext(authorizeKey)
-
-	h := authPublicKey.NameAlg.NewHash()
-	h.Write(dynamicInput.AuthorizedPolicy)
 
-	authorizeTicket, err := tpm.VerifySignature(authorizeKey, h.Sum(nil), dynamicInput.AuthorizedPolicySignature)
-	if err != nil {
-		if tpm2.IsTPMParameterError(err, tpm2.AnyErrorCode, tpm2.CommandVerifySignature, 2) {
-			// dynamicInput.AuthorizedPolicySignature is invalid.
-			return dynamicPolicyDataError{errors.New("cannot verify dynamic authorization policy signature")}
+	if authorization == nil {
+		authorization, err = authorizeDynamicPolicy(tpm, staticInput, dynamicInput)
+		if err != nil {
+			return err
 		}
-		return xerrors.Errorf("cannot verify dynamic authorization policy signature: %w", err)
 	}
 
-	if err := tpm.PolicyAuthorize(policySession, dynamicInput.AuthorizedPolicy, nil, authorizeKey.Name(), authorizeTicket); err != nil {
+	if err := tpm.PolicyAuthorize(policySession, dynamicInput.AuthorizedPolicy, nil, authorization.keyName, authorization.ticket); err != nil {
 		if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyAuthorize, 1) {
 			// dynamicInput.AuthorizedPolicy is invalid.
 			return dynamicPolicyDataError{errors.New("the dynamic authorization policy is invalid")}
@@ -0,0 +1,96 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+)
+
+// checkPolicyORDigests checks that the supplied digests are suitable for computing a TPM2_PolicyOR assertion with the specified
+// digest algorithm.
+func checkPolicyORDigests(alg tpm2.HashAlgorithmId, digests tpm2.DigestList) error {
+	if !alg.Supported() {
+		return fmt.Errorf("unsupported digest algorithm %v", alg)
+	}
+	if len(digests) == 0 {
+		return errors.New("no digests")
+	}
+	for i, d := range digests {
+		if len(d) != alg.Size() {
+			return fmt.Errorf("digest at index %d has the wrong size", i)
+		}
+	}
+	return nil
+}
+
+// ComputePolicyORDigest computes the policy digest that results from a single TPM2_PolicyOR assertion with the supplied digests,
+// using the specified digest algorithm. A TPM2_PolicyOR assertion replaces the current policy digest, so the result doesn't depend
+// on any assertions that precede it.
+//
+// The result is H(0x00..00 || TPM_CC_PolicyOR || digests[0] || ... || digests[n-1]), where H is the specified digest algorithm,
+// 0x00..00 is a zero digest of the size of the digest algorithm, TPM_CC_PolicyOR is the big-endian 32-bit command code 0x00000171
+// and the digests are concatenated in the order supplied. The order of the digests is significant.
+//
+// Between 1 and 8 digests can be supplied, each of which must be the same size as the digest algorithm. A single digest is treated
+// as a pair of identical digests, because the TPM requires at least 2 digests for a TPM2_PolicyOR assertion. This is consistent
+// with how this package computes authorization policies.
+func ComputePolicyORDigest(alg tpm2.HashAlgorithmId, digests tpm2.DigestList) (tpm2.Digest, error) {
+	if err := checkPolicyORDigests(alg, digests); err != nil {
+		return nil, err
+	}
+	if len(digests) > 8 {
+		return nil, errors.New("too many digests for a single TPM2_PolicyOR assertion")
+	}
+
+	trial, err := tpm2.ComputeAuthPolicy(alg)
+	if err != nil {
+		return nil, err
+	}
+	trial.PolicyOR(ensureSufficientORDigests(digests))
+	return trial.GetDigest(), nil
+}
+
+// ComputePolicyORTreeDigest computes the policy digest that results from the sequence of TPM2_PolicyOR assertions used by this
+// package to combine an arbitrary number of digests, using the specified digest algorithm. This is the same computation that is
+// used for the PCR conditions of a PCR protection policy.
+//
+// The digests are combined in to a tree as follows. If there are 8 or fewer digests, the result is ComputePolicyORDigest applied
+// to all of them. Otherwise, the digests are split in to consecutive groups of 8 in the order supplied, with the last group
+// containing the remainder. ComputePolicyORDigest is applied to each group, and the resulting digests, in the same order as the
+// groups, form the input to the next level of the tree. This is repeated until there are 8 or fewer digests remaining, at which
+// point the result is ComputePolicyORDigest applied to those.
+//
+// Because each level of the tree only depends on the digests in the level below it, callers can cache the digests for groups of 8
+// conditions and combine them with ComputePolicyORDigest in order to obtain the same result without recomputing the whole tree.
+func ComputePolicyORTreeDigest(alg tpm2.HashAlgorithmId, digests tpm2.DigestList) (tpm2.Digest, error) {
+	if err := checkPolicyORDigests(alg, digests); err != nil {
+		return nil, err
+	}
+
+	trial, err := tpm2.ComputeAuthPolicy(alg)
+	if err != nil {
+		return nil, err
+	}
+	computePolicyORData(alg, trial, digests)
+	return trial.GetDigest(), nil
+}
@@ -0,0 +1,146 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"strconv"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func makePolicyORTestDigests(n int) (out tpm2.DigestList) {
+	for i := 1; i <= n; i++ {
+		h := sha256.Sum256([]byte(strconv.Itoa(i)))
+		out = append(out, h[:])
+	}
+	return
+}
+
+func TestComputePolicyORDigest(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		digests  tpm2.DigestList
+		expected tpm2.Digest
+	}{
+		{
+			desc:     "Single",
+			digests:  makePolicyORTestDigests(1),
+			expected: decodeHexStringT(t, "929fd9d445957ae4d7423f6aa16376bfcd84e06e33e620775fa48cddd11deb16"),
+		},
+		{
+			desc:     "Pair",
+			digests:  makePolicyORTestDigests(2),
+			expected: decodeHexStringT(t, "d1c172a59b74b91d9c6e2e9b638ee7f0028e2ed6191e8ef62b978c52690c63e5"),
+		},
+		{
+			desc:     "Eight",
+			digests:  makePolicyORTestDigests(8),
+			expected: decodeHexStringT(t, "59bd3262b4de199a4feb35706856b0498f0201494a28449a4264753e59d9c1e5"),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			digest, err := ComputePolicyORDigest(tpm2.HashAlgorithmSHA256, data.digests)
+			if err != nil {
+				t.Fatalf("ComputePolicyORDigest failed: %v", err)
+			}
+			if !bytes.Equal(digest, data.expected) {
+				t.Errorf("Unexpected digest (got %x, expected %x)", digest, data.expected)
+			}
+		})
+	}
+
+	t.Run("TooMany", func(t *testing.T) {
+		if _, err := ComputePolicyORDigest(tpm2.HashAlgorithmSHA256, makePolicyORTestDigests(9)); err == nil {
+			t.Errorf("ComputePolicyORDigest should have failed")
+		}
+	})
+
+	t.Run("WrongSize", func(t *testing.T) {
+		if _, err := ComputePolicyORDigest(tpm2.HashAlgorithmSHA1, makePolicyORTestDigests(2)); err == nil {
+			t.Errorf("ComputePolicyORDigest should have failed")
+		}
+	})
+}
+
+func TestComputePolicyORTreeDigest(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		digests  tpm2.DigestList
+		expected tpm2.Digest
+	}{
+		{
+			desc:     "SingleNode",
+			digests:  makePolicyORTestDigests(8),
+			expected: decodeHexStringT(t, "59bd3262b4de199a4feb35706856b0498f0201494a28449a4264753e59d9c1e5"),
+		},
+		{
+			desc:     "Nine",
+			digests:  makePolicyORTestDigests(9),
+			expected: decodeHexStringT(t, "5b62c8311e19c749bfa41c879a476d43340c44f7dff35b2e3e4318351492c979"),
+		},
+		{
+			desc:     "Twenty",
+			digests:  makePolicyORTestDigests(20),
+			expected: decodeHexStringT(t, "fe56eece09e913d2d29aff2fef45577682ea3b17f2c2f7187f8c8f61a421abb6"),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			digest, err := ComputePolicyORTreeDigest(tpm2.HashAlgorithmSHA256, data.digests)
+			if err != nil {
+				t.Fatalf("ComputePolicyORTreeDigest failed: %v", err)
+			}
+			if !bytes.Equal(digest, data.expected) {
+				t.Errorf("Unexpected digest (got %x, expected %x)", digest, data.expected)
+			}
+		})
+	}
+
+	t.Run("CachedGroups", func(t *testing.T) {
+		// Combining cached digests for each group of 8 must produce the same result as computing the whole tree.
+		digests := makePolicyORTestDigests(20)
+		var groups tpm2.DigestList
+		for i := 0; i < len(digests); i += 8 {
+			end := i + 8
+			if end > len(digests) {
+				end = len(digests)
+			}
+			d, err := ComputePolicyORDigest(tpm2.HashAlgorithmSHA256, digests[i:end])
+			if err != nil {
+				t.Fatalf("ComputePolicyORDigest failed: %v", err)
+			}
+			groups = append(groups, d)
+		}
+		digest, err := ComputePolicyORDigest(tpm2.HashAlgorithmSHA256, groups)
+		if err != nil {
+			t.Fatalf("ComputePolicyORDigest failed: %v", err)
+		}
+		expected, err := ComputePolicyORTreeDigest(tpm2.HashAlgorithmSHA256, digests)
+		if err != nil {
+			t.Fatalf("ComputePolicyORTreeDigest failed: %v", err)
+		}
+		if !bytes.Equal(digest, expected) {
+			t.Errorf("Unexpected digest (got %x, expected %x)", digest, expected)
+		}
+	})
+}
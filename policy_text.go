@@ -0,0 +1,227 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// leafDigests returns the digests from the leaf nodes of this tree, which correspond to the OR conditions that the tree was
+// computed from. A node is a leaf node if no other node in the tree refers to it as its parent.
+func (t policyOrDataTree) leafDigests() (out tpm2.DigestList) {
+	parents := make(map[int]bool)
+	for i, n := range t {
+		if n.Next != 0 {
+			parents[i+int(n.Next)] = true
+		}
+	}
+	for i, n := range t {
+		if parents[i] {
+			continue
+		}
+		out = append(out, n.Digests...)
+	}
+	return
+}
+
+// ExportPolicyText returns the authorization policy metadata for this sealed key object in a canonical, human readable text
+// form, which can be stored in version control and compared with DiffPolicyText in order to review changes to the policy. The
+// output is YAML compatible, and contains the PCR selection, the accepted PCR digests, the dynamic authorization policy count, the
+// authorization mode hint and the names of the keys and NV indices that form part of the policy. It does not contain the sealed
+// secret or any other sensitive data. The output is deterministic - the same sealed key object always produces the same output.
+func (k *SealedKeyObject) ExportPolicyText() ([]byte, error) {
+	w := new(bytes.Buffer)
+
+	fmt.Fprintf(w, "version: %d\n", k.data.version)
+	fmt.Fprintf(w, "name-algorithm: %v\n", k.data.keyPublic.NameAlg)
+	fmt.Fprintf(w, "auth-policy: %x\n", []byte(k.data.keyPublic.AuthPolicy))
+	fmt.Fprintf(w, "auth-mode-hint: %v\n", k.data.authModeHint)
+	fmt.Fprintf(w, "label: %s\n", strconv.Quote(k.data.label))
+	fmt.Fprintf(w, "pin-index: %#08x\n", k.data.staticPolicyData.PinIndexHandle)
+
+	authKeyName, err := k.data.staticPolicyData.AuthPublicKey.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of dynamic authorization policy key: %w", err)
+	}
+	fmt.Fprintf(w, "policy-auth-key: %x\n", []byte(authKeyName))
+
+	if k.data.adminPolicyData != nil {
+		adminKeyName, err := k.data.adminPolicyData.AdminPublicKey.Name()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of admin key: %w", err)
+		}
+		fmt.Fprintf(w, "admin-override-key: %x\n", []byte(adminKeyName))
+	}
+
+	dynamicPolicyData := k.data.dynamicPolicyData
+
+	selection := make(tpm2.PCRSelectionList, len(dynamicPolicyData.PCRSelection))
+	copy(selection, dynamicPolicyData.PCRSelection)
+	sort.Slice(selection, func(i, j int) bool { return selection[i].Hash < selection[j].Hash })
+	fmt.Fprintf(w, "pcr-selection:\n")
+	for _, s := range selection {
+		pcrs := make([]int, len(s.Select))
+		copy(pcrs, s.Select)
+		sort.Ints(pcrs)
+		var strs []string
+		for _, p := range pcrs {
+			strs = append(strs, strconv.Itoa(p))
+		}
+		fmt.Fprintf(w, "  - %v: [%s]\n", s.Hash, strings.Join(strs, ", "))
+	}
+
+	var digests []string
+	seen := make(map[string]bool)
+	for _, d := range dynamicPolicyData.PCROrData.leafDigests() {
+		s := hex.EncodeToString(d)
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		digests = append(digests, s)
+	}
+	sort.Strings(digests)
+	fmt.Fprintf(w, "pcr-digests:\n")
+	for _, d := range digests {
+		fmt.Fprintf(w, "  - %s\n", d)
+	}
+
+	fmt.Fprintf(w, "policy-count: %d\n", dynamicPolicyData.PolicyCount)
+	if k.data.pcrGracePeriodExpiry != 0 {
+		fmt.Fprintf(w, "pcr-grace-period-expiry: %d\n", k.data.pcrGracePeriodExpiry)
+	}
+	fmt.Fprintf(w, "authorized-policy: %x\n", []byte(dynamicPolicyData.AuthorizedPolicy))
+	authorized := dynamicPolicyData.AuthorizedPolicySignature != nil && dynamicPolicyData.AuthorizedPolicySignature.SigAlg != tpm2.SigSchemeAlgNull
+	fmt.Fprintf(w, "authorized: %t\n", authorized)
+
+	return w.Bytes(), nil
+}
+
+// policyTextEntry corresponds to a single top-level key in the output of SealedKeyObject.ExportPolicyText.
+type policyTextEntry struct {
+	value string   // The value for scalar keys
+	items []string // The items for list keys
+}
+
+// parsePolicyText parses the output of SealedKeyObject.ExportPolicyText, returning the keys in the order that they appear in the
+// input and a map of keys to values.
+func parsePolicyText(data []byte) ([]string, map[string]*policyTextEntry, error) {
+	var keys []string
+	entries := make(map[string]*policyTextEntry)
+	var current *policyTextEntry
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "  - "):
+			if current == nil {
+				return nil, nil, fmt.Errorf("line %d: list item without a key", n)
+			}
+			current.items = append(current.items, strings.TrimPrefix(line, "  - "))
+		default:
+			i := strings.Index(line, ":")
+			if i < 0 {
+				return nil, nil, fmt.Errorf("line %d: invalid syntax", n)
+			}
+			key := line[:i]
+			if _, exists := entries[key]; exists {
+				return nil, nil, fmt.Errorf("line %d: duplicate key %q", n, key)
+			}
+			current = &policyTextEntry{value: strings.TrimSpace(line[i+1:])}
+			keys = append(keys, key)
+			entries[key] = current
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return keys, entries, nil
+}
+
+// DiffPolicyText compares 2 sets of authorization policy metadata produced by SealedKeyObject.ExportPolicyText, and returns a
+// list of human readable differences. Each difference is prefixed with the key that it applies to. Scalar values that differ are
+// reported as "key: old -> new", and items that have been removed from or added to a list are reported as "key: -item" and
+// "key: +item" respectively. An empty list indicates that the policies are the same.
+func DiffPolicyText(before, after []byte) ([]string, error) {
+	beforeKeys, beforeEntries, err := parsePolicyText(before)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse original policy: %w", err)
+	}
+	afterKeys, afterEntries, err := parsePolicyText(after)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot parse new policy: %w", err)
+	}
+
+	keys := beforeKeys
+	for _, k := range afterKeys {
+		if _, ok := beforeEntries[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+
+	var out []string
+	for _, k := range keys {
+		b, a := beforeEntries[k], afterEntries[k]
+		switch {
+		case b == nil:
+			b = &policyTextEntry{value: "<none>"}
+		case a == nil:
+			a = &policyTextEntry{value: "<none>"}
+		}
+
+		if b.value != a.value {
+			out = append(out, fmt.Sprintf("%s: %s -> %s", k, b.value, a.value))
+		}
+
+		beforeItems := make(map[string]bool)
+		for _, i := range b.items {
+			beforeItems[i] = true
+		}
+		afterItems := make(map[string]bool)
+		for _, i := range a.items {
+			afterItems[i] = true
+		}
+		for _, i := range b.items {
+			if !afterItems[i] {
+				out = append(out, fmt.Sprintf("%s: -%s", k, i))
+			}
+		}
+		for _, i := range a.items {
+			if !beforeItems[i] {
+				out = append(out, fmt.Sprintf("%s: +%s", k, i))
+			}
+		}
+	}
+
+	return out, nil
+}
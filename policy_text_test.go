@@ -0,0 +1,159 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestExportPolicyText(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestExportPolicyText_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	digest1 := make(tpm2.Digest, 32)
+	rand.Read(digest1)
+	digest2 := make(tpm2.Digest, 32)
+	rand.Read(digest2)
+
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digest1)
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: profile, PINHandle: 0x01810000, Label: "foo"}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	before, err := k.ExportPolicyText()
+	if err != nil {
+		t.Fatalf("ExportPolicyText failed: %v", err)
+	}
+	before2, err := k.ExportPolicyText()
+	if err != nil {
+		t.Fatalf("ExportPolicyText failed: %v", err)
+	}
+	if !bytes.Equal(before, before2) {
+		t.Errorf("ExportPolicyText is not deterministic")
+	}
+
+	for _, expected := range []string{
+		"auth-mode-hint: none\n",
+		"label: \"foo\"\n",
+		"pin-index: 0x01810000\n",
+		"pcr-selection:\n  - TPM_ALG_SHA256: [7]\n",
+		"authorized: true\n",
+	} {
+		if !strings.Contains(string(before), expected) {
+			t.Errorf("ExportPolicyText output doesn't contain %q:\n%s", expected, before)
+		}
+	}
+	if strings.Contains(string(before), fmt.Sprintf("%x", key)) {
+		t.Errorf("ExportPolicyText output contains the sealed key")
+	}
+
+	diff, err := DiffPolicyText(before, before2)
+	if err != nil {
+		t.Fatalf("DiffPolicyText failed: %v", err)
+	}
+	if len(diff) != 0 {
+		t.Errorf("Unexpected differences: %v", diff)
+	}
+
+	profile = NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, digest1).
+		AddProfileOR(
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, digest1),
+			NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 12, digest2))
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, profile); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	after, err := k.ExportPolicyText()
+	if err != nil {
+		t.Fatalf("ExportPolicyText failed: %v", err)
+	}
+
+	diff, err = DiffPolicyText(before, after)
+	if err != nil {
+		t.Fatalf("DiffPolicyText failed: %v", err)
+	}
+
+	var diffPcrs []string
+	var diffDigests int
+	var diffCount bool
+	for _, d := range diff {
+		switch {
+		case strings.HasPrefix(d, "pcr-selection: "):
+			diffPcrs = append(diffPcrs, d)
+		case strings.HasPrefix(d, "pcr-digests: -"):
+			diffDigests--
+		case strings.HasPrefix(d, "pcr-digests: +"):
+			diffDigests += 2
+		case strings.HasPrefix(d, "policy-count: "):
+			diffCount = true
+		}
+	}
+	if !reflect.DeepEqual(diffPcrs, []string{"pcr-selection: -TPM_ALG_SHA256: [7]", "pcr-selection: +TPM_ALG_SHA256: [7, 12]"}) {
+		t.Errorf("Unexpected PCR selection differences: %v", diffPcrs)
+	}
+	if diffDigests != 3 {
+		t.Errorf("Unexpected PCR digest differences: %v", diff)
+	}
+	if !diffCount {
+		t.Errorf("Missing policy count difference: %v", diff)
+	}
+}
+
+func TestDiffPolicyTextInvalid(t *testing.T) {
+	_, err := DiffPolicyText([]byte("foo\n"), nil)
+	if err == nil || err.Error() != "cannot parse original policy: line 1: invalid syntax" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
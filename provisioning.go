@@ -21,6 +21,8 @@ package secboot
 
 import (
 	"bytes"
+	"crypto/rsa"
+	"errors"
 	"fmt"
 	"os"
 
@@ -85,7 +87,37 @@ const (
 	ProvisionModeFull
 )
 
-func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, template *tpm2.Public, handle tpm2.Handle, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+// HierarchyAuthValues contains the authorization values for the TPM's storage, endorsement and lockout hierarchies. This can be
+// supplied to functions that require knowledge of these on TPMs where the authorization values are managed externally, as an
+// alternative to calling SetAuthValue on the corresponding tpm2.ResourceContext for each hierarchy. A nil field indicates that the
+// authorization value for the corresponding hierarchy isn't supplied, in which case the value already associated with the
+// TPMConnection is retained. An empty authorization value can be supplied explicitly with a non-nil, zero length slice.
+type HierarchyAuthValues struct {
+	Owner       []byte // The authorization value for the storage hierarchy
+	Endorsement []byte // The authorization value for the endorsement hierarchy
+	Lockout     []byte // The authorization value for the lockout hierarchy
+}
+
+// apply sets the supplied authorization values for each hierarchy on the supplied TPMConnection. Hierarchies for which no
+// authorization value is supplied are left unchanged.
+func (a *HierarchyAuthValues) apply(tpm *TPMConnection) {
+	if a.Owner != nil {
+		tpm.OwnerHandleContext().SetAuthValue(a.Owner)
+	}
+	if a.Endorsement != nil {
+		tpm.EndorsementHandleContext().SetAuthValue(a.Endorsement)
+	}
+	if a.Lockout != nil {
+		tpm.LockoutHandleContext().SetAuthValue(a.Lockout)
+	}
+}
+
+// provisionPrimaryKey creates a primary key in the specified hierarchy with the supplied template, and persists it at the specified
+// handle. If there is already an object at the specified handle, it is evicted first. If the existing object does not look like a
+// primary key in the specified hierarchy created with the supplied template, then a PersistentHandleInUseError error is returned
+// unless evictConflicting is true.
+func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, template *tpm2.Public, handle tpm2.Handle, evictConflicting bool,
+	session tpm2.SessionContext) (tpm2.ResourceContext, error) {
 	obj, err := tpm.CreateResourceContextFromTPM(handle)
 	switch {
 	case err != nil && !tpm2.IsResourceUnavailableError(err, handle):
@@ -94,6 +126,17 @@ func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, t
 	case tpm2.IsResourceUnavailableError(err, handle):
 		// No existing object to evict
 	default:
+		// Make sure that the current object is one that we created, unless we've been asked to evict it regardless.
+		if !evictConflicting {
+			ok, err := isObjectPrimaryKeyWithTemplate(tpm, hierarchy, obj, template, session)
+			switch {
+			case err != nil:
+				return nil, xerrors.Errorf("cannot determine if the object at the persistent handle is a primary key with the expected template: %w", err)
+			case !ok:
+				return nil, PersistentHandleInUseError{Handle: handle, Name: obj.Name()}
+			}
+		}
+
 		// Evict the current object
 		if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), obj, handle, session); err != nil {
 			return nil, xerrors.Errorf("cannot evict existing object at persistent handle: %w", err)
@@ -114,9 +157,33 @@ func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, t
 	return obj, nil
 }
 
+// stirRandom mixes the supplied data in to the state of the TPM's random number generator. TPM2_StirRandom accepts a maximum of
+// 128 bytes at a time, so larger amounts of data are supplied in multiple commands.
+func stirRandom(tpm *tpm2.TPMContext, data []byte) error {
+	const maxStirRandomSize = 128
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxStirRandomSize {
+			n = maxStirRandomSize
+		}
+		if err := tpm.StirRandom(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
 // ProvisionTPM prepares the TPM associated with the tpm parameter for full disk encryption. The mode parameter specifies the
 // behaviour of this function.
 //
+// As this function can result in the loss of existing keys, the caller must acknowledge this by setting confirmDataLoss to true
+// if mode is ProvisionModeClear, or if the TPM has already been provisioned by this package (indicated by the presence of the NV
+// index used for locking access to sealed key objects), regardless of mode. If confirmDataLoss is false in either case, a
+// ErrProvisioningNotConfirmed error will be returned before any changes are made to the TPM. This is a safety interlock to prevent
+// a TPM containing keys from being cleared or reprovisioned accidentally, and callers should only set it in response to an
+// explicit request to do so.
+//
 // If mode is ProvisionModeClear, this function will attempt to clear the TPM before provisioning it. If owner clear has been
 // disabled (which will be the case if the TPM has previously been provisioned with this function), then ErrTPMClearRequiresPPI
 // will be returned. In this case, the TPM must be cleared via the physical presence interface by calling RequestTPMClearUsingPPI
@@ -143,18 +210,94 @@ func provisionPrimaryKey(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, t
 // In all modes, this function will create and persist both a storage root key and an endorsement key. Both of these will be created
 // using the RSA templates defined in and persisted at the handles specified in the "TCG EK Credential Profile for TPM Family 2.0"
 // and "TCG TPM v2.0 Provisioning Guidance" specifications. If there are any objects already stored at the locations required for
-// either primary key, then this function will evict them automatically from the TPM.
+// either primary key that look like they were created by a previous call to this function, then this function will evict them
+// automatically from the TPM. If there is an object at either location that doesn't look like it was created by this function
+// (eg, because it belongs to another application), then a PersistentHandleInUseError error will be returned. In this case, the
+// conflicting object can be evicted by calling ProvisionTPMWithParams with the EvictConflictingObjects field of the params argument
+// set to true.
 //
 // In all modes, this function will also create a pair of NV indices used for locking access to sealed key objects, if necessary.
 // These indices will be created at handles 0x01801100 and 0x01801101. If there are already NV indices defined at either of the
 // required handles but they don't meet the requirements of this function, a TPMResourceExistsError error will be returned. In this
 // case, the caller will either need to manually undefine these using TPMConnection.NVUndefineSpace, or clear the TPM.
-func ProvisionTPM(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte) error {
+func ProvisionTPM(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte, confirmDataLoss bool) error {
+	return ProvisionTPMWithParams(tpm, mode, newLockoutAuth, confirmDataLoss, nil)
+}
+
+// ProvisionParams provides optional arguments for ProvisionTPMWithParams.
+type ProvisionParams struct {
+	// HierarchyAuth can be used to supply the authorization values for the storage, endorsement and lockout hierarchies, rather than
+	// them being provided by calling SetAuthValue on the corresponding tpm2.ResourceContext for each hierarchy prior to calling
+	// ProvisionTPMWithParams. This is useful on TPMs where the hierarchy authorization values are managed externally. The supplied
+	// authorization values are retained by the TPMConnection for use in subsequent operations. Note that on successful completion
+	// with mode set to ProvisionModeClear or ProvisionModeFull, the authorization value for the lockout hierarchy will be
+	// newLockoutAuth.
+	HierarchyAuth *HierarchyAuthValues
+
+	// EvictConflictingObjects indicates that objects stored at the locations required for the storage root key or endorsement key
+	// should be evicted even if they don't look like they were created by ProvisionTPM. These objects might belong to another
+	// application, so this should only be set in response to a PersistentHandleInUseError error after confirming that the
+	// conflicting object is not required.
+	EvictConflictingObjects bool
+
+	// AdditionalEntropy can be used to supply additional entropy from the caller, which is mixed in to the state of the TPM's random
+	// number generator with TPM2_StirRandom before any keys are created. This supplements the TPM's internal entropy source - it does
+	// not replace it, and the TPM's random number generator is never less secure as a result of this. Note that the endorsement key
+	// and storage root key are derived deterministically from the TPM's primary seeds, so this only has an effect on primary keys if
+	// a new primary seed is generated during provisioning (eg, when the storage primary seed is regenerated as a result of
+	// ProvisionModeClear).
+	AdditionalEntropy []byte
+
+	// EKTemplate can be used to supply a custom template from which the endorsement key is created, rather than the default RSA2048
+	// template defined in the TCG EK Credential Profile. Only RSA templates are supported. The template is retained by the
+	// TPMConnection and used for subsequent operations that require the endorsement key. Note that changing the template changes
+	// the endorsement key, so an endorsement key certificate issued for a key created from the default template will not match.
+	EKTemplate *tpm2.Public
+
+	// SRKTemplatePolicyKey can be used to supply the public part of a key that authorizes the templates of objects created under
+	// the storage root key. If this is set, the storage root key is created with a template authorization policy, which only
+	// permits the creation of child objects with a TPM2_PolicyTemplate assertion for a template that is authorized by the private
+	// part of this key. This provides defense in depth by constraining what can be created under the storage root key. The name
+	// of this key is recorded in a NV index so that the authorization policy for loading objects can be satisfied without it.
+	// SealKeyToTPM requires the private part of this key via the SRKTemplatePolicyKey field of KeyCreationParams, and RotateSRK,
+	// MoveKeyToNewPINIndex and TPMConnection.BenchmarkUnseal are not supported. Once the TPM has been provisioned with a template
+	// authorization policy, it is retained by subsequent calls that don't set this, until the TPM is cleared.
+	//
+	// Changing the template authorization policy changes the storage root key, so sealed key files created under a storage root
+	// key that was provisioned without this policy cannot be loaded under the new one. An existing storage root key created from a
+	// different template is only replaced if EvictConflictingObjects is also set, and a PersistentHandleInUseError error is
+	// returned otherwise. To migrate, unseal each key before re-provisioning with this set, and then seal it again with
+	// SealKeyToTPM.
+	SRKTemplatePolicyKey *rsa.PublicKey
+}
+
+// ProvisionTPMWithParams behaves the same as ProvisionTPM, but accepts some optional arguments via the params argument. If params
+// is nil, this function behaves exactly like ProvisionTPM.
+func ProvisionTPMWithParams(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte, confirmDataLoss bool, params *ProvisionParams) error {
+	if params == nil {
+		params = &ProvisionParams{}
+	}
+	if params.EKTemplate != nil && params.EKTemplate.Type != tpm2.ObjectTypeRSA {
+		return errors.New("unsupported EK template type")
+	}
+
 	status, err := ProvisionStatus(tpm)
 	if err != nil {
 		return xerrors.Errorf("cannot determine the current TPM status: %w", err)
 	}
 
+	if !confirmDataLoss && (mode == ProvisionModeClear || status&AttrValidLockNVIndex > 0) {
+		return ErrProvisioningNotConfirmed
+	}
+
+	// Only modify the connection once the caller has confirmed that provisioning can proceed.
+	if params.HierarchyAuth != nil {
+		params.HierarchyAuth.apply(tpm)
+	}
+	if params.EKTemplate != nil {
+		tpm.ekTemplate = params.EKTemplate
+	}
+
 	// Create an initial session for HMAC authorizations
 	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypeHMAC, nil, defaultSessionHashAlgorithm, nil)
 	if err != nil {
@@ -164,6 +307,12 @@ func ProvisionTPM(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte)
 
 	session.SetAttrs(tpm2.AttrContinueSession)
 
+	if len(params.AdditionalEntropy) > 0 {
+		if err := stirRandom(tpm.TPMContext, params.AdditionalEntropy); err != nil {
+			return xerrors.Errorf("cannot mix additional entropy in to the TPM's random number generator: %w", err)
+		}
+	}
+
 	if mode == ProvisionModeClear {
 		if status&AttrOwnerClearDisabled > 0 {
 			return ErrTPMClearRequiresPPI
@@ -183,8 +332,11 @@ func ProvisionTPM(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte)
 	}
 
 	// Provision an endorsement key
-	if _, err := provisionPrimaryKey(tpm.TPMContext, tpm.EndorsementHandleContext(), ekTemplate, ekHandle, session); err != nil {
+	if _, err := provisionPrimaryKey(tpm.TPMContext, tpm.EndorsementHandleContext(), tpm.endorsementKeyTemplate(), ekHandle, params.EvictConflictingObjects, session); err != nil {
+		var e PersistentHandleInUseError
 		switch {
+		case xerrors.As(err, &e):
+			return e
 		case isAuthFailError(err, tpm2.CommandEvictControl, 1):
 			return AuthFailError{tpm2.HandleOwner}
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
@@ -206,10 +358,36 @@ func ProvisionTPM(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte)
 	}
 	session = tpm.HmacSession()
 
-	// Provision a storage root key
-	srk, err := provisionPrimaryKey(tpm.TPMContext, tpm.OwnerHandleContext(), srkTemplate, srkHandle, session)
+	// Provision a storage root key. If a key for authorizing the templates of child objects is supplied, use a template with a
+	// template authorization policy. Otherwise, any existing template authorization policy is retained.
+	template, currentSRKTemplatePolicyKeyName, err := readStorageRootKeyTemplate(tpm.TPMContext)
 	if err != nil {
+		return xerrors.Errorf("cannot determine storage root key template: %w", err)
+	}
+	var newSRKTemplatePolicyKeyName tpm2.Name
+	if params.SRKTemplatePolicyKey != nil {
+		keyName, err := computeSRKTemplatePolicyKeyName(params.SRKTemplatePolicyKey)
+		if err != nil {
+			return xerrors.Errorf("cannot compute name of SRK template policy key: %w", err)
+		}
+		if !bytes.Equal(keyName, currentSRKTemplatePolicyKeyName) {
+			unique, err := readSRKTemplateUnique(tpm.TPMContext)
+			if err != nil {
+				return xerrors.Errorf("cannot determine storage root key template: %w", err)
+			}
+			newSRKTemplatePolicyKeyName = keyName
+			template = makeSRKTemplateWithTemplatePolicy(keyName)
+			if unique != nil {
+				template = makeSRKTemplateWithUnique(template, unique)
+			}
+		}
+	}
+	srk, err := provisionPrimaryKey(tpm.TPMContext, tpm.OwnerHandleContext(), template, srkHandle, params.EvictConflictingObjects, session)
+	if err != nil {
+		var e PersistentHandleInUseError
 		switch {
+		case xerrors.As(err, &e):
+			return e
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return AuthFailError{tpm2.HandleOwner}
 		default:
@@ -218,6 +396,17 @@ func ProvisionTPM(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte)
 	}
 	tpm.provisionedSrk = srk
 
+	// Record the name of the key for authorizing the templates of child objects now that the storage root key has been created
+	// with it, so that the recorded name always corresponds to the persistent storage root key.
+	if newSRKTemplatePolicyKeyName != nil {
+		if err := provisionSRKTemplatePolicyNVIndex(tpm.TPMContext, newSRKTemplatePolicyKeyName, session); err != nil {
+			if isAuthFailError(err, tpm2.AnyCommandCode, 1) {
+				return AuthFailError{tpm2.HandleOwner}
+			}
+			return xerrors.Errorf("cannot record SRK template policy key: %w", err)
+		}
+	}
+
 	// Provision a lock NV index
 	if err := ensureLockNVIndex(tpm.TPMContext, session); err != nil {
 		var e *tpmErrorWithHandle
@@ -259,6 +448,124 @@ func ProvisionTPM(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte)
 	return nil
 }
 
+// RepairProvisioning inspects each of the objects and settings managed by ProvisionTPM using ProvisionStatus, and recreates or
+// reconfigures only those that are missing or invalid. Objects that are already correct are left in place, and the TPM is never
+// cleared, so this can be used to repair a partially damaged TPM without invalidating existing sealed keys that are protected by
+// objects that remain intact.
+//
+// The endorsement key and storage root key are recreated at their expected handles if they are missing or invalid. If there is an
+// object at either location that doesn't look like it was created by ProvisionTPM, a PersistentHandleInUseError error will be
+// returned. The lock NV indices are recreated if they are missing. If there are already NV indices defined at the required handles
+// that don't meet the requirements of this function, a TPMResourceExistsError error will be returned.
+//
+// If the dictionary attack parameters are incorrect or owner clear is not disabled, these are corrected using the authorization
+// value for the lockout hierarchy, which must be set on the corresponding tpm2.ResourceContext before calling this function.
+// The authorization value for the lockout hierarchy is never changed by this function.
+//
+// On success, the set of attributes that were repaired is returned. This will be zero if nothing needed repairing.
+func (t *TPMConnection) RepairProvisioning() (ProvisionStatusAttributes, error) {
+	status, err := ProvisionStatus(t)
+	if err != nil {
+		return 0, xerrors.Errorf("cannot determine the current TPM status: %w", err)
+	}
+
+	var repaired ProvisionStatusAttributes
+
+	if status&AttrValidEK == 0 {
+		session, err := t.StartAuthSession(nil, nil, tpm2.SessionTypeHMAC, nil, defaultSessionHashAlgorithm, nil)
+		if err != nil {
+			return repaired, xerrors.Errorf("cannot start session: %w", err)
+		}
+		_, err = provisionPrimaryKey(t.TPMContext, t.EndorsementHandleContext(), t.endorsementKeyTemplate(), ekHandle, false, session)
+		t.FlushContext(session)
+		if err != nil {
+			var e PersistentHandleInUseError
+			switch {
+			case xerrors.As(err, &e):
+				return repaired, e
+			case isAuthFailError(err, tpm2.CommandEvictControl, 1):
+				return repaired, AuthFailError{tpm2.HandleOwner}
+			case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+				return repaired, AuthFailError{tpm2.HandleEndorsement}
+			default:
+				return repaired, xerrors.Errorf("cannot provision endorsement key: %w", err)
+			}
+		}
+		repaired |= AttrValidEK
+
+		// Reinitialize the connection so that the HMAC session is salted with the new EK.
+		if err := t.init(); err != nil {
+			var verifyErr verificationError
+			if xerrors.As(err, &verifyErr) {
+				return repaired, TPMVerificationError{fmt.Sprintf("cannot reinitialize TPM connection after provisioning endorsement key: %v", err)}
+			}
+			return repaired, xerrors.Errorf("cannot reinitialize TPM connection after provisioning endorsement key: %w", err)
+		}
+	}
+
+	session := t.HmacSession()
+
+	if status&AttrValidSRK == 0 {
+		template, _, err := readStorageRootKeyTemplate(t.TPMContext)
+		if err != nil {
+			return repaired, xerrors.Errorf("cannot determine storage root key template: %w", err)
+		}
+		srk, err := provisionPrimaryKey(t.TPMContext, t.OwnerHandleContext(), template, srkHandle, false, session)
+		if err != nil {
+			var e PersistentHandleInUseError
+			switch {
+			case xerrors.As(err, &e):
+				return repaired, e
+			case isAuthFailError(err, tpm2.AnyCommandCode, 1):
+				return repaired, AuthFailError{tpm2.HandleOwner}
+			default:
+				return repaired, xerrors.Errorf("cannot provision storage root key: %w", err)
+			}
+		}
+		t.provisionedSrk = srk
+		repaired |= AttrValidSRK
+	}
+
+	if status&AttrValidLockNVIndex == 0 {
+		if err := ensureLockNVIndex(t.TPMContext, session); err != nil {
+			var e *tpmErrorWithHandle
+			if tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.AnyCommandCode) && xerrors.As(err, &e) {
+				return repaired, TPMResourceExistsError{e.handle}
+			}
+			return repaired, xerrors.Errorf("cannot create lock NV index: %w", err)
+		}
+		repaired |= AttrValidLockNVIndex
+	}
+
+	if status&AttrDAParamsOK == 0 {
+		if err := t.DictionaryAttackParameters(t.LockoutHandleContext(), maxTries, recoveryTime, lockoutRecovery, session); err != nil {
+			switch {
+			case isAuthFailError(err, tpm2.CommandDictionaryAttackParameters, 1):
+				return repaired, AuthFailError{tpm2.HandleLockout}
+			case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandDictionaryAttackParameters):
+				return repaired, ErrTPMLockout
+			}
+			return repaired, xerrors.Errorf("cannot configure dictionary attack parameters: %w", err)
+		}
+		repaired |= AttrDAParamsOK
+	}
+
+	if status&AttrOwnerClearDisabled == 0 {
+		if err := t.ClearControl(t.LockoutHandleContext(), true, session); err != nil {
+			switch {
+			case isAuthFailError(err, tpm2.CommandClearControl, 1):
+				return repaired, AuthFailError{tpm2.HandleLockout}
+			case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandClearControl):
+				return repaired, ErrTPMLockout
+			}
+			return repaired, xerrors.Errorf("cannot disable owner clear: %w", err)
+		}
+		repaired |= AttrOwnerClearDisabled
+	}
+
+	return repaired, nil
+}
+
 // RequestTPMClearUsingPPI submits a request to the firmware to clear the TPM on the next reboot. This is the only way to clear
 // the TPM if owner clear has been disabled for the TPM, or the lockout hierarchy authorization value has been set previously but
 // is unknown.
@@ -309,8 +616,12 @@ func ProvisionStatus(tpm *TPMConnection) (ProvisionStatusAttributes, error) {
 		}
 	default:
 		// ProvisionTPM hasn't been called with this TPMConnection, but there is an object at srkHandle. Make sure it looks like a storage
-		// primary key.
-		ok, err := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, srkTemplate, tpm.HmacSession())
+		// primary key. It can't be validated if the SRK template policy NV index is invalid.
+		template, _, err := readStorageRootKeyTemplate(tpm.TPMContext)
+		if err != nil {
+			break
+		}
+		ok, err := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, template, tpm.HmacSession())
 		switch {
 		case err != nil:
 			return 0, xerrors.Errorf("cannot determine if object at %v is a primary key in the storage hierarchy: %w", srkHandle, err)
@@ -353,3 +664,162 @@ func ProvisionStatus(tpm *TPMConnection) (ProvisionStatusAttributes, error) {
 
 	return out, nil
 }
+
+// checkHierarchyAuth determines whether the authorization value associated with the supplied hierarchy is correct, by using it to
+// satisfy a TPM2_PolicySecret assertion. The storage and endorsement hierarchies are not protected by the TPM's dictionary attack
+// logic, so this doesn't have any side effects if the authorization value is incorrect. It must not be used for the lockout
+// hierarchy.
+func checkHierarchyAuth(tpm *tpm2.TPMContext, hierarchy tpm2.ResourceContext, hmacSession tpm2.SessionContext) (bool, error) {
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, defaultSessionHashAlgorithm)
+	if err != nil {
+		return false, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	_, _, err = tpm.PolicySecret(hierarchy, policySession, nil, nil, 0, hmacSession)
+	switch {
+	case isAuthFailError(err, tpm2.CommandPolicySecret, 1):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
+
+// CheckProvisionPreconditions determines whether the TPM can be provisioned with ProvisionTPM in the specified mode, without
+// making any changes to it. This allows a caller to detect conditions that require user intervention in the platform firmware
+// before attempting to provision the TPM.
+//
+// If mode is ProvisionModeClear and clearing the TPM with TPM2_Clear has been disabled, a ErrTPMClearDisabled error is returned.
+//
+// Otherwise, the authorization values for the storage and endorsement hierarchies are tested, which must be provided by calling
+// TPMConnection.OwnerHandleContext().SetAuthValue() and TPMConnection.EndorsementHandleContext().SetAuthValue() prior to this call
+// if they have been set. This doesn't affect the TPM's dictionary attack counter. If either value is incorrect, the TPM must be
+// cleared before it can be provisioned, and a ErrTPMClearRequired error is returned. If clearing the TPM with TPM2_Clear has also
+// been disabled, a ErrTPMClearDisabled error is returned instead.
+//
+// If the storage or endorsement hierarchy has been disabled by the platform firmware, a ErrTPMDisabled error is returned.
+//
+// Note that the authorization value for the lockout hierarchy is not tested, as doing so would trigger the TPM's dictionary attack
+// protection if it is incorrect.
+func CheckProvisionPreconditions(tpm *TPMConnection, mode ProvisionMode) error {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
+	if err != nil {
+		return xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	clearDisabled := tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrDisableClear > 0
+
+	if mode == ProvisionModeClear {
+		if clearDisabled {
+			return ErrTPMClearDisabled
+		}
+		return nil
+	}
+
+	for _, hierarchy := range []tpm2.ResourceContext{tpm.OwnerHandleContext(), tpm.EndorsementHandleContext()} {
+		ok, err := checkHierarchyAuth(tpm.TPMContext, hierarchy, tpm.HmacSession())
+		switch {
+		case tpm2.IsTPMHandleError(err, tpm2.ErrorHierarchy, tpm2.CommandPolicySecret, 1):
+			return ErrTPMDisabled
+		case err != nil:
+			return xerrors.Errorf("cannot test authorization value for %v: %w", hierarchy.Handle(), err)
+		case ok:
+			continue
+		case clearDisabled:
+			return ErrTPMClearDisabled
+		default:
+			return ErrTPMClearRequired
+		}
+	}
+
+	return nil
+}
+
+// StorageRootKeyName returns the name of the TPM's storage root key, which is required by a remote party in order to prepare a key
+// that can be imported in to the storage hierarchy of this TPM with TPM2_Import (eg, as the parent name for TPM2_Duplicate).
+//
+// If there is a persistent storage root key, its name is returned. Otherwise, a transient storage root key is created from the
+// standard template (or the template with a template authorization policy, if the TPM was provisioned with one, and with the unique
+// value recorded by RotateSRK, if the storage root key has been rotated) in order to
+// determine the name that a storage root key created by ProvisionTPM would have, and then flushed. This requires knowledge of the
+// authorization value for the storage hierarchy, and will return a AuthFailError error if it is incorrect.
+//
+// If the object at the persistent handle reserved for the storage root key isn't a valid storage root key, a ErrTPMProvisioning
+// error will be returned.
+func (t *TPMConnection) StorageRootKeyName() (tpm2.Name, error) {
+	session := t.HmacSession()
+
+	template, _, err := readStorageRootKeyTemplate(t.TPMContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine storage root key template: %w", err)
+	}
+
+	srk, err := t.CreateResourceContextFromTPM(srkHandle, session.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, srkHandle):
+		srk, _, _, _, _, err := t.CreatePrimary(t.OwnerHandleContext(), nil, template, nil, nil, session)
+		switch {
+		case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create transient storage root key: %w", err)
+		}
+		defer t.FlushContext(srk)
+		return srk.Name(), nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for storage root key: %w", err)
+	}
+
+	ok, err := isObjectPrimaryKeyWithTemplate(t.TPMContext, t.OwnerHandleContext(), srk, template, session)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot determine if object is a primary key in the storage hierarchy: %w", err)
+	case !ok:
+		return nil, ErrTPMProvisioning
+	}
+	return srk.Name(), nil
+}
+
+// LockoutAuthSet indicates whether the lockout hierarchy has an authorization value, obtained from the lockoutAuthSet attribute
+// of the TPM_PT_PERMANENT property.
+func (t *TPMConnection) LockoutAuthSet() (bool, error) {
+	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1, t.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return false, xerrors.Errorf("cannot fetch permanent properties: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyPermanent {
+		return false, errors.New("TPM did not return the permanent properties")
+	}
+	return tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrLockoutAuthSet > 0, nil
+}
+
+// SetLockoutAuth changes the authorization value for the lockout hierarchy from current to newAuth, without reprovisioning the TPM.
+// This is intended for rotating a lockout hierarchy credential that is managed externally. The new authorization value is sent to
+// the TPM using parameter encryption. On success, the authorization value for the ResourceContext returned from
+// TPMConnection.LockoutHandleContext is updated to newAuth.
+//
+// If current is incorrect, a AuthFailError error will be returned. As the lockout hierarchy is protected by the TPM's dictionary
+// attack logic, the lockout hierarchy will then be unavailable until the lockout recovery time configured by ProvisionTPM has
+// expired, or until the TPM is cleared via the physical presence interface. If the lockout hierarchy is already unavailable because
+// of a previous authorization failure, a ErrTPMLockout error will be returned instead, and the current authorization value has not
+// been checked. In both cases, and on any other error, the authorization value for the ResourceContext returned from
+// TPMConnection.LockoutHandleContext is restored to the value it had before this function was called.
+func (t *TPMConnection) SetLockoutAuth(current, newAuth []byte) error {
+	lockout := t.LockoutHandleContext()
+	prevAuth := resourceContextAuthValue(lockout)
+	lockout.SetAuthValue(current)
+
+	if err := t.HierarchyChangeAuth(lockout, tpm2.Auth(newAuth), t.HmacSession().IncludeAttrs(tpm2.AttrCommandEncrypt)); err != nil {
+		lockout.SetAuthValue(prevAuth)
+		switch {
+		case isAuthFailError(err, tpm2.CommandHierarchyChangeAuth, 1):
+			return AuthFailError{tpm2.HandleLockout}
+		case tpm2.IsTPMWarning(err, tpm2.WarningLockout, tpm2.CommandHierarchyChangeAuth):
+			return ErrTPMLockout
+		}
+		return xerrors.Errorf("cannot set the lockout hierarchy authorization value: %w", err)
+	}
+
+	lockout.SetAuthValue(newAuth)
+	return nil
+}
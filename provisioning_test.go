@@ -21,6 +21,9 @@ package secboot_test
 
 import (
 	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
 	"testing"
 
 	"github.com/canonical/go-tpm2"
@@ -148,7 +151,7 @@ func TestProvisionNewTPM(t *testing.T) {
 			origEk, _ := tpm.EndorsementKey()
 			origHmacSession := tpm.HmacSession()
 
-			if err := ProvisionTPM(tpm, data.mode, lockoutAuth); err != nil {
+			if err := ProvisionTPM(tpm, data.mode, lockoutAuth, true); err != nil {
 				t.Fatalf("ProvisionTPM failed: %v", err)
 			}
 
@@ -367,7 +370,7 @@ func TestProvisionErrorHandling(t *testing.T) {
 			tpm.OwnerHandleContext().SetAuthValue(nil)
 			tpm.EndorsementHandleContext().SetAuthValue(nil)
 
-			err := ProvisionTPM(tpm, data.mode, nil)
+			err := ProvisionTPM(tpm, data.mode, nil, true)
 			if err == nil {
 				t.Fatalf("ProvisionTPM should have returned an error")
 			}
@@ -378,6 +381,85 @@ func TestProvisionErrorHandling(t *testing.T) {
 	}
 }
 
+func TestCheckProvisionPreconditions(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	authValue := []byte("1234")
+
+	for _, data := range []struct {
+		desc    string
+		mode    ProvisionMode
+		prepare func(*testing.T)
+		err     error
+	}{
+		{
+			desc:    "Cleared",
+			mode:    ProvisionModeFull,
+			prepare: func(*testing.T) {},
+		},
+		{
+			desc: "KnownOwnerAuth",
+			mode: ProvisionModeFull,
+			prepare: func(t *testing.T) {
+				if err := tpm.HierarchyChangeAuth(tpm.OwnerHandleContext(), authValue, nil); err != nil {
+					t.Fatalf("HierarchyChangeAuth failed: %v", err)
+				}
+			},
+		},
+		{
+			desc: "UnknownOwnerAuth",
+			mode: ProvisionModeFull,
+			prepare: func(t *testing.T) {
+				if err := tpm.HierarchyChangeAuth(tpm.OwnerHandleContext(), authValue, nil); err != nil {
+					t.Fatalf("HierarchyChangeAuth failed: %v", err)
+				}
+				tpm.OwnerHandleContext().SetAuthValue(nil)
+			},
+			err: ErrTPMClearRequired,
+		},
+		{
+			desc: "UnknownEndorsementAuthWithClearDisabled",
+			mode: ProvisionModeWithoutLockout,
+			prepare: func(t *testing.T) {
+				if err := tpm.HierarchyChangeAuth(tpm.EndorsementHandleContext(), authValue, nil); err != nil {
+					t.Fatalf("HierarchyChangeAuth failed: %v", err)
+				}
+				tpm.EndorsementHandleContext().SetAuthValue(nil)
+				if err := tpm.ClearControl(tpm.LockoutHandleContext(), true, nil); err != nil {
+					t.Fatalf("ClearControl failed: %v", err)
+				}
+			},
+			err: ErrTPMClearDisabled,
+		},
+		{
+			desc: "ClearDisabled",
+			mode: ProvisionModeClear,
+			prepare: func(t *testing.T) {
+				if err := tpm.ClearControl(tpm.LockoutHandleContext(), true, nil); err != nil {
+					t.Fatalf("ClearControl failed: %v", err)
+				}
+			},
+			err: ErrTPMClearDisabled,
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			clearTPMWithPlatformAuth(t, tpm)
+			tpm.OwnerHandleContext().SetAuthValue(nil)
+			tpm.EndorsementHandleContext().SetAuthValue(nil)
+
+			data.prepare(t)
+
+			if err := CheckProvisionPreconditions(tpm, data.mode); err != data.err {
+				t.Errorf("CheckProvisionPreconditions returned an unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 func TestRecreateEK(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer closeTPM(t, tpm)
@@ -400,7 +482,7 @@ func TestRecreateEK(t *testing.T) {
 
 			lockoutAuth := []byte("1234")
 
-			if err := ProvisionTPM(tpm, ProvisionModeFull, lockoutAuth); err != nil {
+			if err := ProvisionTPM(tpm, ProvisionModeFull, lockoutAuth, true); err != nil {
 				t.Fatalf("ProvisionTPM failed: %v", err)
 			}
 
@@ -424,7 +506,7 @@ func TestRecreateEK(t *testing.T) {
 				t.Errorf("EvictControl failed: %v", err)
 			}
 
-			if err := ProvisionTPM(tpm, data.mode, lockoutAuth); err != nil {
+			if err := ProvisionTPM(tpm, data.mode, lockoutAuth, true); err != nil {
 				t.Fatalf("ProvisionTPM failed: %v", err)
 			}
 
@@ -473,7 +555,7 @@ func TestRecreateSRK(t *testing.T) {
 
 			lockoutAuth := []byte("1234")
 
-			if err := ProvisionTPM(tpm, ProvisionModeFull, lockoutAuth); err != nil {
+			if err := ProvisionTPM(tpm, ProvisionModeFull, lockoutAuth, true); err != nil {
 				t.Fatalf("ProvisionTPM failed: %v", err)
 			}
 
@@ -486,7 +568,7 @@ func TestRecreateSRK(t *testing.T) {
 				t.Errorf("EvictControl failed: %v", err)
 			}
 
-			if err := ProvisionTPM(tpm, data.mode, lockoutAuth); err != nil {
+			if err := ProvisionTPM(tpm, data.mode, lockoutAuth, true); err != nil {
 				t.Fatalf("ProvisionTPM failed: %v", err)
 			}
 
@@ -510,7 +592,7 @@ func TestProvisionWithEndorsementAuth(t *testing.T) {
 		t.Fatalf("HierarchyChangeAuth failed: %v", err)
 	}
 
-	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 		t.Fatalf("ProvisionTPM failed: %v", err)
 	}
 
@@ -533,7 +615,7 @@ func TestProvisionWithOwnerAuth(t *testing.T) {
 		t.Fatalf("HierarchyChangeAuth failed: %v", err)
 	}
 
-	if err := ProvisionTPM(tpm, ProvisionModeClear, nil); err != nil {
+	if err := ProvisionTPM(tpm, ProvisionModeClear, nil, true); err != nil {
 		t.Fatalf("ProvisionTPM failed: %v", err)
 	}
 
@@ -541,6 +623,128 @@ func TestProvisionWithOwnerAuth(t *testing.T) {
 	validateSRK(t, tpm.TPMContext)
 }
 
+func TestProvisionWithHierarchyAuth(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	ownerAuth := []byte("1234")
+	endorsementAuth := []byte("5678")
+	lockoutAuth := []byte("9012")
+
+	// Simulate the hierarchy authorization values being set by an external manager.
+	for _, h := range []struct {
+		context tpm2.ResourceContext
+		auth    []byte
+	}{
+		{tpm.OwnerHandleContext(), ownerAuth},
+		{tpm.EndorsementHandleContext(), endorsementAuth},
+		{tpm.LockoutHandleContext(), lockoutAuth},
+	} {
+		if err := tpm.HierarchyChangeAuth(h.context, h.auth, nil); err != nil {
+			t.Fatalf("HierarchyChangeAuth failed: %v", err)
+		}
+		h.context.SetAuthValue(nil)
+	}
+
+	auths := &HierarchyAuthValues{Owner: ownerAuth, Endorsement: endorsementAuth, Lockout: lockoutAuth}
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeFull, lockoutAuth, true, &ProvisionParams{HierarchyAuth: auths}); err != nil {
+		t.Fatalf("ProvisionTPMWithParams failed: %v", err)
+	}
+
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+
+	tpm.OwnerHandleContext().SetAuthValue(nil)
+
+	tmpDir, err := ioutil.TempDir("", "_TestProvisionWithHierarchyAuth_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	if err := SealKeyToTPM(tpm, key, tmpDir+"/keydata", "", &KeyCreationParams{
+		PCRProfile:    getTestPCRProfile(),
+		PINHandle:     0x01810000,
+		HierarchyAuth: &HierarchyAuthValues{Owner: ownerAuth}}); err != nil {
+		t.Errorf("SealKeyToTPM failed: %v", err)
+	}
+
+	// Supplying only the authorization value for the storage hierarchy shouldn't clear the ones already associated with the
+	// connection for the other hierarchies.
+	if err := tpm.HierarchyChangeAuth(tpm.EndorsementHandleContext(), nil, nil); err != nil {
+		t.Errorf("HierarchyChangeAuth for the endorsement hierarchy failed: %v", err)
+	}
+}
+
+func TestProvisionWithConflictingObject(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	for _, data := range []struct {
+		desc      string
+		handle    tpm2.Handle
+		hierarchy tpm2.ResourceContext
+	}{
+		{
+			desc:      "SRK",
+			handle:    SrkHandle,
+			hierarchy: tpm.OwnerHandleContext(),
+		},
+		{
+			desc:      "EK",
+			handle:    EkHandle,
+			hierarchy: tpm.EndorsementHandleContext(),
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			clearTPMWithPlatformAuth(t, tpm)
+
+			// Persist an object that wasn't created by ProvisionTPM at the handle required for the primary key.
+			template := tpm2.Public{
+				Type:    tpm2.ObjectTypeKeyedHash,
+				NameAlg: tpm2.HashAlgorithmSHA256,
+				Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrUserWithAuth,
+				Params:  tpm2.PublicParamsU{Data: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
+			transient, _, _, _, _, err := tpm.CreatePrimary(data.hierarchy, nil, &template, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("CreatePrimary failed: %v", err)
+			}
+			defer flushContext(t, tpm, transient)
+			persistent, err := tpm.EvictControl(tpm.OwnerHandleContext(), transient, data.handle, nil)
+			if err != nil {
+				t.Fatalf("EvictControl failed: %v", err)
+			}
+
+			err = ProvisionTPM(tpm, ProvisionModeFull, nil, true)
+			if e, ok := err.(PersistentHandleInUseError); !ok || e.Handle != data.handle || !bytes.Equal(e.Name, persistent.Name()) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			if _, err := tpm.CreateResourceContextFromTPM(data.handle); err != nil {
+				t.Errorf("The conflicting object should not have been evicted: %v", err)
+			}
+
+			if err := ProvisionTPMWithParams(tpm, ProvisionModeFull, nil, true, &ProvisionParams{EvictConflictingObjects: true}); err != nil {
+				t.Fatalf("ProvisionTPMWithParams failed: %v", err)
+			}
+
+			validateEK(t, tpm.TPMContext)
+			validateSRK(t, tpm.TPMContext)
+		})
+	}
+}
+
 func TestProvisionWithInvalidEkCert(t *testing.T) {
 	tpm, _ := openTPMSimulatorForTesting(t)
 	defer func() {
@@ -556,7 +760,7 @@ func TestProvisionWithInvalidEkCert(t *testing.T) {
 	restore := MockEKTemplate(ekTemplate)
 	defer restore()
 
-	err := ProvisionTPM(tpm, ProvisionModeFull, nil)
+	err := ProvisionTPM(tpm, ProvisionModeFull, nil, true)
 	if err == nil {
 		t.Fatalf("ProvisionTPM should have returned an error")
 	}
@@ -586,7 +790,7 @@ func TestProvisionStatus(t *testing.T) {
 
 	lockoutAuth := []byte("1234")
 
-	if err := ProvisionTPM(tpm, ProvisionModeClear, lockoutAuth); err != nil {
+	if err := ProvisionTPM(tpm, ProvisionModeClear, lockoutAuth, true); err != nil {
 		t.Fatalf("ProvisionTPM failed: %v", err)
 	}
 
@@ -719,3 +923,362 @@ func TestProvisionStatus(t *testing.T) {
 		t.Errorf("Unexpected status %d", status)
 	}
 }
+
+func TestProvisionWithAdditionalEntropy(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	lockoutAuth := []byte("1234")
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, lockoutAuth, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+
+	readNames := func() (ekName, srkName tpm2.Name) {
+		ek, err := tpm.CreateResourceContextFromTPM(EkHandle)
+		if err != nil {
+			t.Fatalf("No EK context: %v", err)
+		}
+		srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+		if err != nil {
+			t.Fatalf("No SRK context: %v", err)
+		}
+		return ek.Name(), srk.Name()
+	}
+
+	ekName, srkName := readNames()
+
+	entropy := make([]byte, 300)
+	rand.Read(entropy)
+
+	// The EK and SRK are derived from the primary seeds, so stirring the RNG shouldn't change them.
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeFull, lockoutAuth, true, &ProvisionParams{AdditionalEntropy: entropy}); err != nil {
+		t.Fatalf("ProvisionTPMWithParams failed: %v", err)
+	}
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+
+	ekName2, srkName2 := readNames()
+	if !bytes.Equal(ekName, ekName2) {
+		t.Errorf("EK changed")
+	}
+	if !bytes.Equal(srkName, srkName2) {
+		t.Errorf("SRK changed")
+	}
+
+	// Clearing the TPM regenerates the storage primary seed, which is affected by the RNG state, but not the endorsement primary
+	// seed.
+	clearTPMWithPlatformAuth(t, tpm)
+	tpm.LockoutHandleContext().SetAuthValue(nil)
+	rand.Read(entropy)
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeClear, nil, true, &ProvisionParams{AdditionalEntropy: entropy}); err != nil {
+		t.Fatalf("ProvisionTPMWithParams failed: %v", err)
+	}
+	validateEK(t, tpm.TPMContext)
+	validateSRK(t, tpm.TPMContext)
+
+	ekName3, srkName3 := readNames()
+	if !bytes.Equal(ekName, ekName3) {
+		t.Errorf("EK changed")
+	}
+	if bytes.Equal(srkName, srkName3) {
+		t.Errorf("SRK should have changed")
+	}
+}
+
+func TestProvisionWithCustomEKTemplate(t *testing.T) {
+	func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+		clearTPMWithPlatformAuth(t, tpm)
+	}()
+
+	// The test EK certificate is for the default template, so use an unverified connection.
+	tpm, err := ConnectToDefaultTPM()
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPM failed: %v", err)
+	}
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	template := MakeDefaultEKTemplate()
+	template.Attrs |= tpm2.AttrNoDA
+
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeWithoutLockout, nil, false, &ProvisionParams{EKTemplate: template}); err != nil {
+		t.Fatalf("ProvisionTPMWithParams failed: %v", err)
+	}
+
+	ek, err := tpm.EndorsementKey()
+	if err != nil {
+		t.Fatalf("EndorsementKey failed: %v", err)
+	}
+	if ek.Handle() != EkHandle {
+		t.Errorf("Unexpected EK handle")
+	}
+
+	expected, _, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, template, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("CreatePrimary failed: %v", err)
+	}
+	defer flushContext(t, tpm, expected)
+
+	if !bytes.Equal(ek.Name(), expected.Name()) {
+		t.Errorf("EK wasn't created from the custom template")
+	}
+
+	status, err := ProvisionStatus(tpm)
+	if err != nil {
+		t.Fatalf("ProvisionStatus failed: %v", err)
+	}
+	if status&AttrValidEK == 0 {
+		t.Errorf("EK should be valid")
+	}
+
+	template = MakeDefaultEKTemplate()
+	template.Type = tpm2.ObjectTypeECC
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeWithoutLockout, nil, true, &ProvisionParams{EKTemplate: template}); err == nil ||
+		err.Error() != "unsupported EK template type" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestProvisionRequiresConfirmation(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	// Clearing the TPM always requires confirmation.
+	if err := ProvisionTPM(tpm, ProvisionModeClear, nil, false); err != ErrProvisioningNotConfirmed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(EkHandle); err == nil {
+		t.Errorf("ProvisionTPM shouldn't have modified the TPM")
+	}
+
+	// Provisioning a TPM that hasn't been provisioned before doesn't require confirmation.
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, false); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+
+	// Reprovisioning a TPM that has been provisioned by us requires confirmation, regardless of mode.
+	for _, mode := range []ProvisionMode{ProvisionModeFull, ProvisionModeWithoutLockout} {
+		if err := ProvisionTPM(tpm, mode, nil, false); err != ErrProvisioningNotConfirmed {
+			t.Errorf("Unexpected error for mode %d: %v", mode, err)
+		}
+	}
+
+	// The connection shouldn't be modified if confirmation is required.
+	template := MakeDefaultEKTemplate()
+	template.Attrs |= tpm2.AttrNoDA
+	params := &ProvisionParams{
+		HierarchyAuth: &HierarchyAuthValues{Owner: []byte("1234"), Endorsement: []byte("5678")},
+		EKTemplate:    template}
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeFull, nil, false, params); err != ErrProvisioningNotConfirmed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if tpm.EndorsementKeyTemplate() == template {
+		t.Errorf("ProvisionTPMWithParams shouldn't have changed the EK template")
+	}
+
+	// This requires the original authorization values for the storage and endorsement hierarchies.
+	if err := ProvisionTPM(tpm, ProvisionModeWithoutLockout, nil, true); err != nil {
+		t.Errorf("ProvisionTPM failed: %v", err)
+	}
+}
+
+func TestRepairProvisioning(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	lockoutAuth := []byte("1234")
+	if err := ProvisionTPM(tpm, ProvisionModeFull, lockoutAuth, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+
+	ek, err := tpm.CreateResourceContextFromTPM(EkHandle)
+	if err != nil {
+		t.Fatalf("No EK context: %v", err)
+	}
+	ekName := ek.Name()
+
+	// Nothing should be repaired on a correctly provisioned TPM.
+	repaired, err := tpm.RepairProvisioning()
+	if err != nil {
+		t.Fatalf("RepairProvisioning failed: %v", err)
+	}
+	if repaired != 0 {
+		t.Errorf("Unexpected repaired attributes %d", repaired)
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+	if err != nil {
+		t.Fatalf("No SRK context: %v", err)
+	}
+	if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), srk, srk.Handle(), nil); err != nil {
+		t.Errorf("EvictControl failed: %v", err)
+	}
+	lockIndex, err := tpm.CreateResourceContextFromTPM(LockNVHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), lockIndex, nil); err != nil {
+		t.Errorf("NVUndefineSpace failed: %v", err)
+	}
+
+	repaired, err = tpm.RepairProvisioning()
+	if err != nil {
+		t.Fatalf("RepairProvisioning failed: %v", err)
+	}
+	if repaired != AttrValidSRK|AttrValidLockNVIndex {
+		t.Errorf("Unexpected repaired attributes %d", repaired)
+	}
+
+	validateSRK(t, tpm.TPMContext)
+
+	ek, err = tpm.CreateResourceContextFromTPM(EkHandle)
+	if err != nil {
+		t.Fatalf("No EK context: %v", err)
+	}
+	if !bytes.Equal(ek.Name(), ekName) {
+		t.Errorf("EK shouldn't have changed")
+	}
+
+	status, err := ProvisionStatus(tpm)
+	if err != nil {
+		t.Errorf("ProvisionStatus failed: %v", err)
+	}
+	expected := AttrValidEK | AttrValidSRK | AttrDAParamsOK | AttrOwnerClearDisabled | AttrLockoutAuthSet | AttrValidLockNVIndex
+	if status != expected {
+		t.Errorf("Unexpected status %d", status)
+	}
+}
+
+func TestStorageRootKeyName(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	// Without a persistent SRK, the name should be derived from a transient SRK.
+	transientName, err := tpm.StorageRootKeyName()
+	if err != nil {
+		t.Fatalf("StorageRootKeyName failed: %v", err)
+	}
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+	if err != nil {
+		t.Fatalf("No SRK context: %v", err)
+	}
+
+	name, err := tpm.StorageRootKeyName()
+	if err != nil {
+		t.Fatalf("StorageRootKeyName failed: %v", err)
+	}
+	if !bytes.Equal(name, srk.Name()) {
+		t.Errorf("Unexpected name for persistent SRK")
+	}
+	if !bytes.Equal(name, transientName) {
+		t.Errorf("Name derived from transient SRK doesn't match persistent SRK")
+	}
+}
+
+func TestSetLockoutAuth(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	set, err := tpm.LockoutAuthSet()
+	if err != nil {
+		t.Fatalf("LockoutAuthSet failed: %v", err)
+	}
+	if set {
+		t.Errorf("LockoutAuthSet returned the wrong value")
+	}
+
+	if err := tpm.SetLockoutAuth(nil, []byte("1234")); err != nil {
+		t.Fatalf("SetLockoutAuth failed: %v", err)
+	}
+	set, err = tpm.LockoutAuthSet()
+	if err != nil {
+		t.Fatalf("LockoutAuthSet failed: %v", err)
+	}
+	if !set {
+		t.Errorf("LockoutAuthSet returned the wrong value")
+	}
+
+	// Rotate the lockout auth and check that the new value works.
+	if err := tpm.SetLockoutAuth([]byte("1234"), []byte("5678")); err != nil {
+		t.Fatalf("SetLockoutAuth failed: %v", err)
+	}
+	if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), nil); err != nil {
+		t.Errorf("DictionaryAttackLockReset failed: %v", err)
+	}
+
+	err = tpm.SetLockoutAuth([]byte("1234"), nil)
+	if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The lockout hierarchy is now unavailable because of the previous failure.
+	if err := tpm.SetLockoutAuth([]byte("5678"), nil); err != ErrTPMLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSetLockoutAuthWrongCurrentAuth(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	// Make the lockout hierarchy available again after the next TPM reset following an authorization failure.
+	if err := tpm.DictionaryAttackParameters(tpm.LockoutHandleContext(), 32, 7200, 0, nil); err != nil {
+		t.Fatalf("DictionaryAttackParameters failed: %v", err)
+	}
+
+	if err := tpm.SetLockoutAuth(nil, []byte("1234")); err != nil {
+		t.Fatalf("SetLockoutAuth failed: %v", err)
+	}
+
+	err := tpm.SetLockoutAuth([]byte("5678"), []byte("abcd"))
+	if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	resetTPMSimulator(t, tpm, tcti)
+
+	// The connection should still have the correct authorization value for the lockout hierarchy.
+	if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), nil); err != nil {
+		t.Errorf("DictionaryAttackLockReset failed: %v", err)
+	}
+	if err := tpm.SetLockoutAuth([]byte("1234"), []byte("abcd")); err != nil {
+		t.Errorf("SetLockoutAuth failed: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// TPMResetCounts contains counters maintained by the TPM that can be recorded when the TPM is provisioned and compared later on
+// in order to detect that the TPM has been cleared. The TPM doesn't maintain a count of the number of times that it has been
+// cleared or that the owner has changed, but TPM2_Clear sets ResetCount and RestartCount back to zero. As this isn't detectable
+// once enough TPM resets have occurred, the name of the storage root key is recorded as well.
+type TPMResetCounts struct {
+	// TotalCommands is the total number of commands implemented by the TPM, obtained from the TPM_PT_TOTAL_COMMANDS property.
+	// This is not a count of executed commands, and it only changes if the TPM's firmware is updated.
+	TotalCommands uint32
+
+	// ResetCount is the number of TPM resets (a TPM2_Startup(CLEAR) that isn't preceded by a TPM2_Shutdown(STATE)) since the TPM
+	// was last cleared, obtained from the TPM's clock information.
+	ResetCount uint32
+
+	// RestartCount is the number of TPM restarts or resumes since the last TPM reset, obtained from the TPM's clock information.
+	// This is set back to zero on each TPM reset.
+	RestartCount uint32
+
+	// SRKName is the name of the persistent storage root key created by ProvisionTPM, or nil if there isn't one. TPM2_Clear
+	// changes the primary seed of the storage hierarchy, so a storage root key created after the TPM is cleared has a different
+	// name.
+	SRKName tpm2.Name
+}
+
+// ClearedSince indicates whether these counters show that the TPM has been cleared since the supplied baseline counters were
+// obtained. If the baseline contains the name of a storage root key, this returns true if the storage root key is missing or
+// has a different name, which is the case once the TPM has been cleared regardless of how many TPM resets have occurred since.
+// This also happens if the storage root key is evicted or replaced (eg, by TPMConnection.RotateSRK) without the TPM being
+// cleared, so the baseline should be obtained again whenever this is done intentionally. In every case, the TPM needs to be
+// provisioned again.
+//
+// Otherwise, the TPM reset and restart counters are compared. A TPM reset increments ResetCount and a restart or resume increments
+// RestartCount, so a decrease in either count without a corresponding increase in ResetCount can only be explained by
+// TPM2_Clear. This can't detect that the TPM was cleared if enough TPM resets have occurred since for ResetCount to reach the
+// baseline value again, or if the TPM was cleared shortly after the baseline was obtained from a recently cleared TPM. A false
+// result should therefore not be treated as proof that the TPM hasn't been cleared - ProvisionStatus should still be used to
+// check that the TPM is correctly provisioned.
+func (c *TPMResetCounts) ClearedSince(baseline *TPMResetCounts) bool {
+	switch {
+	case len(baseline.SRKName) > 0:
+		return !bytes.Equal(c.SRKName, baseline.SRKName)
+	case c.ResetCount < baseline.ResetCount:
+		return true
+	case c.ResetCount == baseline.ResetCount && c.RestartCount < baseline.RestartCount:
+		return true
+	default:
+		return false
+	}
+}
+
+// readResetCounts obtains the TPM's reset and restart counters, the TPM_PT_TOTAL_COMMANDS property and the name of the persistent
+// storage root key.
+func readResetCounts(tpm *tpm2.TPMContext, session tpm2.SessionContext) (*TPMResetCounts, error) {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyTotalCommands, 1, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot request total commands property from TPM: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyTotalCommands {
+		return nil, fmt.Errorf("TPM did not return the %v property", tpm2.PropertyTotalCommands)
+	}
+
+	time, err := tpm.ReadClock(session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read clock information from TPM: %w", err)
+	}
+
+	var srkName tpm2.Name
+	srk, err := tpm.CreateResourceContextFromTPM(srkHandle, session)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, srkHandle):
+		// No storage root key
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for storage root key: %w", err)
+	default:
+		srkName = srk.Name()
+	}
+
+	return &TPMResetCounts{
+		TotalCommands: props[0].Value,
+		ResetCount:    time.ClockInfo.ResetCount,
+		RestartCount:  time.ClockInfo.RestartCount,
+		SRKName:       srkName}, nil
+}
+
+// ResetCounts returns the TPM's reset and restart counters along with the number of commands that it implements and the name of the
+// persistent storage root key. These can be recorded when the TPM is provisioned and compared with the values returned from
+// subsequent calls in order to detect that the TPM has been cleared, which invalidates the provisioning and any sealed key files.
+// See TPMResetCounts.ClearedSince.
+func (t *TPMConnection) ResetCounts() (*TPMResetCounts, error) {
+	return readResetCounts(t.TPMContext, t.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+}
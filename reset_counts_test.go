@@ -0,0 +1,142 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestTPMResetCountsClearedSince(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		baseline TPMResetCounts
+		counts   TPMResetCounts
+		cleared  bool
+	}{
+		{desc: "Unchanged", baseline: TPMResetCounts{ResetCount: 5, RestartCount: 2}, counts: TPMResetCounts{ResetCount: 5, RestartCount: 2}},
+		{desc: "Restart", baseline: TPMResetCounts{ResetCount: 5, RestartCount: 2}, counts: TPMResetCounts{ResetCount: 5, RestartCount: 3}},
+		{desc: "Reset", baseline: TPMResetCounts{ResetCount: 5, RestartCount: 2}, counts: TPMResetCounts{ResetCount: 6}},
+		{desc: "ResetCountDecreased", baseline: TPMResetCounts{ResetCount: 5, RestartCount: 2}, counts: TPMResetCounts{ResetCount: 1, RestartCount: 4}, cleared: true},
+		{desc: "RestartCountDecreased", baseline: TPMResetCounts{ResetCount: 5, RestartCount: 2}, counts: TPMResetCounts{ResetCount: 5}, cleared: true},
+		{desc: "SRKUnchanged", baseline: TPMResetCounts{ResetCount: 5, SRKName: tpm2.Name{0x00, 0x0b, 0x01}}, counts: TPMResetCounts{ResetCount: 6, SRKName: tpm2.Name{0x00, 0x0b, 0x01}}},
+		{desc: "SRKChanged", baseline: TPMResetCounts{ResetCount: 5, SRKName: tpm2.Name{0x00, 0x0b, 0x01}}, counts: TPMResetCounts{ResetCount: 6, SRKName: tpm2.Name{0x00, 0x0b, 0x02}}, cleared: true},
+		{desc: "SRKMissing", baseline: TPMResetCounts{ResetCount: 5, SRKName: tpm2.Name{0x00, 0x0b, 0x01}}, counts: TPMResetCounts{ResetCount: 6}, cleared: true},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			if cleared := data.counts.ClearedSince(&data.baseline); cleared != data.cleared {
+				t.Errorf("Unexpected result (got %t, expected %t)", cleared, data.cleared)
+			}
+		})
+	}
+}
+
+func TestResetCounts(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	// Make sure that the reset count isn't zero before obtaining the baseline.
+	resetTPMSimulator(t, tpm, tcti)
+
+	baseline, err := tpm.ResetCounts()
+	if err != nil {
+		t.Fatalf("ResetCounts failed: %v", err)
+	}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyTotalCommands, 1)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if baseline.TotalCommands != props[0].Value {
+		t.Errorf("Unexpected total commands (got %d, expected %d)", baseline.TotalCommands, props[0].Value)
+	}
+	time, err := tpm.ReadClock()
+	if err != nil {
+		t.Fatalf("ReadClock failed: %v", err)
+	}
+	if baseline.ResetCount != time.ClockInfo.ResetCount || baseline.RestartCount != time.ClockInfo.RestartCount {
+		t.Errorf("Unexpected counts (got %d/%d, expected %d/%d)", baseline.ResetCount, baseline.RestartCount,
+			time.ClockInfo.ResetCount, time.ClockInfo.RestartCount)
+	}
+	if baseline.ResetCount == 0 {
+		t.Errorf("Unexpected reset count")
+	}
+	srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(baseline.SRKName, srk.Name()) {
+		t.Errorf("Unexpected SRK name")
+	}
+
+	resetTPMSimulator(t, tpm, tcti)
+
+	counts, err := tpm.ResetCounts()
+	if err != nil {
+		t.Fatalf("ResetCounts failed: %v", err)
+	}
+	if counts.ResetCount != baseline.ResetCount+1 {
+		t.Errorf("Unexpected reset count (got %d, expected %d)", counts.ResetCount, baseline.ResetCount+1)
+	}
+	if counts.ClearedSince(baseline) {
+		t.Errorf("ClearedSince should have returned false after a TPM reset")
+	}
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	counts, err = tpm.ResetCounts()
+	if err != nil {
+		t.Fatalf("ResetCounts failed: %v", err)
+	}
+	if !counts.ClearedSince(baseline) {
+		t.Errorf("ClearedSince should have returned true after clearing the TPM")
+	}
+
+	// Re-provision the TPM and perform enough TPM resets for the reset count to exceed the baseline again. The clear should
+	// still be detected from the SRK name.
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+	for i := uint32(0); i <= baseline.ResetCount; i++ {
+		resetTPMSimulator(t, tpm, tcti)
+	}
+
+	counts, err = tpm.ResetCounts()
+	if err != nil {
+		t.Fatalf("ResetCounts failed: %v", err)
+	}
+	if counts.ResetCount <= baseline.ResetCount {
+		t.Errorf("Unexpected reset count (got %d, expected more than %d)", counts.ResetCount, baseline.ResetCount)
+	}
+	if !counts.ClearedSince(baseline) {
+		t.Errorf("ClearedSince should have returned true after clearing and re-provisioning the TPM")
+	}
+}
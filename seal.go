@@ -20,15 +20,19 @@
 package secboot
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/canonical/go-tpm2"
+	"github.com/snapcore/snapd/osutil"
+	"github.com/snapcore/snapd/osutil/sys"
 
 	"golang.org/x/xerrors"
 )
@@ -41,30 +45,19 @@ func makeSealedKeyTemplate() *tpm2.Public {
 		Params:  tpm2.PublicParamsU{Data: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}}
 }
 
-func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey *rsa.PrivateKey,
-	countIndexPub *tpm2.NVPublic, countIndexAuthPolicies tpm2.DigestList, pcrProfile *PCRProtectionProfile,
-	session tpm2.SessionContext) (*dynamicPolicyData, error) {
-	// Obtain the count for the new dynamic authorization policy
-	nextPolicyCount, err := readDynamicPolicyCounter(tpm, countIndexPub, countIndexAuthPolicies, session)
-	if err != nil {
-		return nil, xerrors.Errorf("cannot read dynamic policy counter: %w", err)
-	}
-	nextPolicyCount += 1
-
-	countIndexName, _ := countIndexPub.Name()
-	if err != nil {
-		return nil, xerrors.Errorf("cannot compute name of dynamic policy counter: %w", err)
-	}
-
+// computePCRPolicyDigests computes the PCR selection and the approved PCR digests for a dynamic authorization policy from the supplied
+// PCR profile, and checks that all of the selected PCRs are supported by the TPM.
+func computePCRPolicyDigests(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId, pcrProfile *PCRProtectionProfile,
+	session tpm2.SessionContext) (tpm2.PCRSelectionList, tpm2.DigestList, error) {
 	supportedPcrs, err := tpm.GetCapabilityPCRs(session.IncludeAttrs(tpm2.AttrAudit))
 	if err != nil {
-		return nil, xerrors.Errorf("cannot determine supported PCRs: %w", err)
+		return nil, nil, xerrors.Errorf("cannot determine supported PCRs: %w", err)
 	}
 
 	// Compute PCR digests
-	pcrs, pcrDigests, err := pcrProfile.computePCRDigests(tpm, alg)
+	pcrs, pcrDigests, err := pcrProfile.computePCRDigests(newPCRSourceFromTPMContext(tpm), alg)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
+		return nil, nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
 	}
 
 	for _, p := range pcrs {
@@ -85,19 +78,66 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 				}
 			}
 			if !found {
-				return nil, errors.New("PCR protection profile contains digests for unsupported PCRs")
+				return nil, nil, errors.New("PCR protection profile contains digests for unsupported PCRs")
 			}
 		}
 	}
 
+	return pcrs, pcrDigests, nil
+}
+
+// computeSealedKeyDynamicAuthPolicy computes a dynamic authorization policy for a sealed key object from the supplied PCR profile.
+// If revokeOld is true, the policy count for the new dynamic authorization policy is one more than the current value of the dynamic
+// policy counter, so that previous dynamic authorization policies can be revoked by incrementing the counter once the new policy
+// has been persisted. If revokeOld is false, the policy count for the new dynamic authorization policy is the current value of the
+// dynamic policy counter. If authKey is nil, the new dynamic authorization policy is not signed. If userPINPolicyORDigests is not
+// empty, the new dynamic authorization policy requires authorization with one of the associated user PIN NV indices. The supplied
+// source of randomness is used to create the signature.
+func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey *rsa.PrivateKey, random io.Reader,
+	countIndexPub *tpm2.NVPublic, countIndexAuthPolicies tpm2.DigestList, pcrProfile *PCRProtectionProfile, revokeOld bool,
+	revocationCheck *pcrPolicyRevocationCheck, userPINPolicyORDigests tpm2.DigestList, session tpm2.SessionContext) (*dynamicPolicyData, error) {
+	// Obtain the count for the new dynamic authorization policy
+	nextPolicyCount, err := readDynamicPolicyCounter(tpm, countIndexPub, countIndexAuthPolicies, session)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read dynamic policy counter: %w", err)
+	}
+
+	pcrs, pcrDigests, err := computePCRPolicyDigests(tpm, alg, pcrProfile, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return computeSealedKeyDynamicAuthPolicyWithPCRDigests(version, alg, signAlg, authKey, random, countIndexPub, nextPolicyCount, pcrs, pcrDigests,
+		revokeOld, revocationCheck, userPINPolicyORDigests)
+}
+
+// computeSealedKeyDynamicAuthPolicyWithPCRDigests computes a dynamic authorization policy for a sealed key object from the supplied
+// PCR selection and approved PCR digests, which must have been computed with computePCRPolicyDigests. The policyCount argument is the
+// current value of the dynamic policy counter. The remaining arguments behave as they do for computeSealedKeyDynamicAuthPolicy.
+func computeSealedKeyDynamicAuthPolicyWithPCRDigests(version uint32, alg, signAlg tpm2.HashAlgorithmId, authKey *rsa.PrivateKey, random io.Reader,
+	countIndexPub *tpm2.NVPublic, policyCount uint64, pcrs tpm2.PCRSelectionList, pcrDigests tpm2.DigestList, revokeOld bool,
+	revocationCheck *pcrPolicyRevocationCheck, userPINPolicyORDigests tpm2.DigestList) (*dynamicPolicyData, error) {
+	nextPolicyCount := policyCount
+	if revokeOld {
+		nextPolicyCount += 1
+	}
+
+	countIndexName, err := countIndexPub.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of dynamic policy counter: %w", err)
+	}
+
 	// Use the PCR digests and NV index names to generate a single signed dynamic authorization policy digest
 	policyParams := dynamicPolicyComputeParams{
-		key:                  authKey,
-		signAlg:              signAlg,
-		pcrs:                 pcrs,
-		pcrDigests:           pcrDigests,
-		policyCountIndexName: countIndexName,
-		policyCount:          nextPolicyCount}
+		key:                    authKey,
+		signAlg:                signAlg,
+		random:                 random,
+		pcrs:                   pcrs,
+		pcrDigests:             pcrDigests,
+		policyCountIndexName:   countIndexName,
+		policyCount:            nextPolicyCount,
+		revocationCheck:        revocationCheck,
+		userPINPolicyORDigests: userPINPolicyORDigests}
 
 	policyData, err := computeDynamicPolicy(version, alg, &policyParams)
 	if err != nil {
@@ -109,13 +149,263 @@ func computeSealedKeyDynamicAuthPolicy(tpm *tpm2.TPMContext, version uint32, alg
 
 // KeyCreationParams provides arguments for SealKeyToTPM.
 type KeyCreationParams struct {
-	// PCRProfile defines the profile used to generate a PCR protection policy for the newly created sealed key file.
+	// PCRProfile defines the profile used to generate a PCR protection policy for the newly created sealed key file. If this is nil
+	// or empty, the sealed key file is not bound to any PCR values and can be unsealed regardless of the TPM's PCR state.
 	PCRProfile *PCRProtectionProfile
 
+	// RecoveryPCRProfile optionally defines a second profile for booting in to a recovery environment, which has different
+	// measurements to a normal boot. If this is set, the PCR protection policy for the newly created sealed key file is computed
+	// from a profile that is satisfied by either PCRProfile or RecoveryPCRProfile, as returned from
+	// NewNormalAndRecoveryPCRProtectionProfile. Both profiles must contain values for the same set of PCRs. Note that this profile
+	// isn't stored, so subsequent calls to UpdateKeyPCRProtectionPolicy should supply a profile that was created with
+	// NewNormalAndRecoveryPCRProtectionProfile in order to retain the recovery environment branch.
+	RecoveryPCRProfile *PCRProtectionProfile
+
 	// PINHandle is the handle at which to create a NV index for PIN support. The handle must be a valid NV index handle (MSO == 0x01)
 	// and the choice of handle should take in to consideration the reserved indices from the "Registry of reserved TPM 2.0 handles and
 	// localities" specification. It is recommended that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff).
 	PINHandle tpm2.Handle
+
+	// ExistingPINIndex can be used to specify that the newly created sealed key file should share the PIN NV index associated with
+	// an existing sealed key file, rather than creating a new NV index at PINHandle. If this is set, PINHandle is ignored.
+	ExistingPINIndex *ExistingPINIndexParams
+
+	// ForceRecreatePINIndex specifies that if there is already a NV index at PINHandle, it should be undefined and a new PIN NV
+	// index created in its place, rather than being reused. See the documentation for SealKeyToTPM for the conditions under which
+	// an existing NV index is reused. The existing NV index is only undefined once everything else has been validated, immediately
+	// before the new one is created, and a file must not already exist at the key data file path. Note that this will make any other
+	// sealed key files associated with the existing NV index permanently unusable. This is ignored if ExistingPINIndex is set.
+	ForceRecreatePINIndex bool
+
+	// Label is an optional caller supplied label that is stored in the newly created sealed key file, and which can be retrieved
+	// later on via SealedKeyObject.Label without access to the TPM. This can be used to associate an identifier with a sealed key
+	// file. It must be no longer than MaxKeyLabelLength bytes, must be valid UTF-8 and must not contain control characters. The label
+	// does not form part of the authorization policy for the sealed key object.
+	Label string
+
+	// HierarchyAuth can be used to supply the authorization values for the TPM's hierarchies, for TPMs where these are managed
+	// externally. If this is set, the authorization values are applied to the TPMConnection before any other operations are
+	// performed, and it isn't necessary to call TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling SealKeyToTPM.
+	HierarchyAuth *HierarchyAuthValues
+
+	// PolicyAuthKey can be used to specify the public part of an externally held key that is used to authorize PCR protection
+	// policies for the newly created sealed key file, for scenarios where PCR protection policies are approved by a remote party
+	// rather than by the device. If this is set, no policy update data file is created and the newly created sealed key file does
+	// not have an authorized PCR protection policy, so it cannot be unsealed until a PCR protection policy signed with the
+	// private part of this key is supplied to UpdateKeyPCRProtectionPolicyWithSignature. This cannot be used in combination with
+	// ExistingPINIndex.
+	PolicyAuthKey *rsa.PublicKey
+
+	// AdminOverrideKey can be used to specify the public part of a centrally held admin key that can be used to unseal the newly
+	// created sealed key file via SealedKeyObject.UnsealFromTPMWithAdminKey, as a break-glass mechanism that is an alternative to
+	// the normal PCR and PIN protected path. WARNING: this significantly weakens the protection provided by the TPM. Anybody with
+	// access to the private part of this key can unseal the key regardless of the TPM's PCR values and without knowledge of the PIN,
+	// so the private part of this key must be protected at least as well as the data protected by every key sealed with it. The
+	// authorization policy for the sealed key file is bound to this key for its lifetime, and it cannot be removed later on without
+	// creating a new sealed key file. This is nil by default, in which case no admin override is possible.
+	AdminOverrideKey *rsa.PublicKey
+
+	// PlatformPINIndex specifies that the NV index for PIN support should be created in the platform hierarchy with the
+	// TPMA_NV_PLATFORMCREATE attribute, in the same way that platform firmware defines the endorsement certificate indices. This is
+	// intended for locked-down devices where the owner hierarchy is delegated to firmware. It requires that the platform hierarchy
+	// is enabled and that its authorization value is set via TPMConnection.PlatformHandleContext().SetAuthValue() prior to calling
+	// SealKeyToTPM, which normally means that this can only be used from a pre-boot environment before the firmware disables the
+	// platform hierarchy. This is ignored if ExistingPINIndex is set, in which case the attributes of the existing NV index are used.
+	//
+	// A NV index created this way cannot be undefined with the owner authorization, and is not removed by TPM2_Clear. Re-provisioning
+	// the TPM with ProvisionTPM in ProvisionModeClear mode will therefore leave it defined, and it must be explicitly undefined with
+	// TPM2_NV_UndefineSpace using the platform hierarchy authorization before its handle can be reused. The NV index is not
+	// write-locked after initialization, as it must remain writable so that the dynamic authorization policy counter can be
+	// incremented and the PIN can be changed. Writes are still restricted by its authorization policy to those authorized by the
+	// key used to sign dynamic authorization policy updates or with knowledge of the current PIN.
+	PlatformPINIndex bool
+
+	// RequirePhysicalPresence specifies that the authorization policy for the newly created sealed key file should include a
+	// TPM2_PolicyPhysicalPresence assertion, in addition to the PCR and PIN requirements. This is intended for embedded hardware
+	// where physical presence is signalled to the TPM by the platform (eg, via a button or GPIO). The sealed key can then only be
+	// unsealed whilst physical presence is asserted. The requirement is part of the authorization policy for the lifetime of the
+	// sealed key file and cannot be removed later on. It does not apply to the admin override branch of the authorization policy.
+	RequirePhysicalPresence bool
+
+	// AllowIncrementalPCRPolicyUpdates specifies that the PCR values for each branch of the PCR protection policy should be recorded
+	// in the newly created sealed key file, so that the policy for a subset of PCRs can later be updated with
+	// UpdateKeyPCRProtectionPolicyIncremental without having to supply a complete profile. The recorded values are not secret, but
+	// the resulting sealed key file can't be read by older versions of this package. Subsequent calls to
+	// UpdateKeyPCRProtectionPolicy continue to record the PCR values for the new policy.
+	AllowIncrementalPCRPolicyUpdates bool
+
+	// MinFirmwareVersion specifies the minimum TPM firmware version required to unseal the newly created sealed key file, in the
+	// format of the TPM_PT_FIRMWARE_VERSION_1 property (the major and minor version in the most and least significant 16 bits
+	// respectively). This is intended to prevent the sealed key from being unsealed after the TPM firmware has been downgraded to a
+	// version with known vulnerabilities. A value of zero means that there is no minimum version.
+	//
+	// Note that TPM2 has no authorization policy assertion that can be used to check a TPM property, so this requirement is
+	// enforced in software by this package when unsealing rather than by the TPM, and it is not part of the authorization policy.
+	// It does not apply to the admin override, and it offers no protection against an adversary that can unseal the key without
+	// using this package. The firmware version reported by the TPM is also not authenticated. The resulting sealed key file can't
+	// be read by older versions of this package.
+	MinFirmwareVersion uint32
+
+	// NameAlg specifies the name algorithm for the newly created sealed key object and PIN NV index, which is also the digest
+	// algorithm used to compute their authorization policies. This must be one of tpm2.HashAlgorithmSHA256,
+	// tpm2.HashAlgorithmSHA384 or tpm2.HashAlgorithmSHA512, and must be supported by the TPM. If this is not set, SHA-256 is used.
+	// If ExistingPINIndex is set, the name algorithm of the existing PIN NV index is retained and this only applies to the sealed
+	// key object.
+	//
+	// This is also the algorithm used for the trial sessions that compute the PCR authorization policy and for the policy session
+	// created during unsealing, which is obtained from the sealed key file. It is independent of the PCR banks selected by
+	// PCRProfile, so on a TPM without an active SHA-256 PCR bank, PCRProfile should select the SHA-384 bank and this should be set
+	// to tpm2.HashAlgorithmSHA384 so that the whole authorization policy uses SHA-384.
+	NameAlg tpm2.HashAlgorithmId
+
+	// NetworkSecretIndexHandle is the handle at which to create a NV index for network-bound unlocking, where the sealed key can
+	// only be unsealed with a secret provided by a remote service. If this is set, the authorization policy for the newly created
+	// sealed key file includes a TPM2_PolicySecret assertion for this NV index, in addition to the PCR, PIN and other assertions.
+	// The network secret is therefore required in addition to (AND) a valid PCR protection policy, rather than as an alternative
+	// to it. The admin override branch of the authorization policy (an OR) doesn't require the network secret. The sealed key can
+	// be unsealed with SealedKeyObject.UnsealFromTPMWithNetworkSecret.
+	//
+	// The handle must be a valid NV index handle, and the same considerations apply as for PINHandle. The NV index is not
+	// removed when the sealed key file is no longer required, and it is the caller's responsibility to undefine it.
+	NetworkSecretIndexHandle tpm2.Handle
+
+	// NetworkSecret is the authorization value for the NV index created at NetworkSecretIndexHandle, provided by the remote
+	// service. This must be a high entropy secret, as the NV index is not protected by the TPM's dictionary attack logic.
+	NetworkSecret []byte
+
+	// SingleUseIndexHandle is the handle at which to create a NV counter index that makes the newly created sealed key file single
+	// use, for secrets that should only ever be unsealed once (eg, initial provisioning secrets). If this is set, the authorization
+	// policy for the newly created sealed key file includes a TPM2_PolicyNV assertion that checks that the counter still has the
+	// value it had when the key was sealed, and the counter is incremented immediately after the key has been unsealed
+	// successfully. Subsequent attempts to unseal it will fail with a ErrSingleUseKeyConsumed error. If the counter cannot be
+	// incremented after unsealing, the unsealed key is returned along with a SingleUseRevocationError error.
+	//
+	// The counter can be incremented by anybody with access to the TPM, which will revoke the sealed key file. It does not apply
+	// to the admin override branch of the authorization policy, although unsealing with the admin override still increments the
+	// counter. The handle must be a valid NV index handle, and the same considerations apply as for PINHandle. The NV index is
+	// not removed when the sealed key file is no longer required, and it is the caller's responsibility to undefine it. The
+	// resulting sealed key file can't be read by older versions of this package.
+	SingleUseIndexHandle tpm2.Handle
+
+	// VolumeIdentity optionally specifies the identity of the encrypted volume that the newly created sealed key file is intended
+	// to unlock, which is the UUID of a LUKS2 container as reported by "cryptsetup luksUUID". If this is set,
+	// ActivateVolumeWithTPMSealedKey and ActivateVolumeWithTPMSealedKeyFromLUKS2Token will refuse to use the sealed key file to
+	// activate a volume with a different identity, and the activation error will wrap ErrVolumeIdentityMismatch. The identity can
+	// be retrieved later on via SealedKeyObject.VolumeIdentity.
+	//
+	// Note that this binding is recorded in the sealed key file metadata and is enforced in software by this package rather than
+	// by the TPM. It is not part of the authorization policy, and offers no protection against an adversary that can unseal the
+	// key without using this package. The resulting sealed key file can't be read by older versions of this package.
+	VolumeIdentity string
+
+	// SRKTemplatePolicyKey is the private part of the key that authorizes the templates of objects created under the storage root
+	// key, and must be supplied if the TPM was provisioned with the SRKTemplatePolicyKey field of ProvisionParams set. It is used
+	// to authorize the template of the newly created sealed key object, and is not retained. It must not be set if the storage root
+	// key does not have a template authorization policy. Loading the newly created sealed key object doesn't require it.
+	SRKTemplatePolicyKey *rsa.PrivateKey
+
+	// RandReader can be used to supply the source of randomness used by SealKeyToTPM to generate the key for authorizing dynamic
+	// authorization policies, the ephemeral key used to initialize the PIN NV index and the signature for the initial dynamic
+	// authorization policy. If this is nil, crypto/rand is used. This exists to support reproducible tests and fuzzing with a
+	// deterministic source of randomness. It doesn't affect randomness generated by the TPM.
+	//
+	// WARNING: This must never be set in production, as a predictable source of randomness allows the key for authorizing dynamic
+	// authorization policies to be recovered.
+	RandReader io.Reader
+}
+
+// Validate checks these parameters for problems that can be detected without a TPM, such as invalid handles, unsupported
+// algorithms, invalid PCR indices in the PCR profiles and combinations of options that conflict with each other. It is called by
+// SealKeyToTPM before any TPM operations are performed, but can also be called by callers that construct parameters
+// programmatically in order to detect problems early. If any problems are detected, a InvalidKeyCreationParamsError error is
+// returned which describes every one of them.
+func (p *KeyCreationParams) Validate() error {
+	var problems []string
+
+	if err := validateKeyLabel(p.Label); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid label: %v", err))
+	}
+	nameAlg := p.NameAlg
+	if nameAlg == 0 {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+	if !isSupportedNameAlg(nameAlg) {
+		problems = append(problems, fmt.Sprintf("unsupported name algorithm %v", nameAlg))
+	}
+
+	if p.ExistingPINIndex == nil && p.PINHandle.Type() != tpm2.HandleTypeNVIndex {
+		problems = append(problems, "invalid PIN NV index handle")
+	}
+	if p.ExistingPINIndex != nil {
+		if p.ForceRecreatePINIndex {
+			problems = append(problems, "cannot recreate the PIN NV index when sharing an existing PIN NV index")
+		}
+		if p.PlatformPINIndex {
+			problems = append(problems, "cannot create the PIN NV index in the platform hierarchy when sharing an existing PIN NV index")
+		}
+		if p.PolicyAuthKey != nil {
+			problems = append(problems, "cannot share an existing PIN NV index with a key with an external policy authorization key")
+		}
+	}
+
+	if p.NetworkSecretIndexHandle != 0 {
+		if p.NetworkSecretIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+			problems = append(problems, "invalid network secret NV index handle")
+		}
+		if len(p.NetworkSecret) == 0 {
+			problems = append(problems, "no network secret provided")
+		}
+	} else if len(p.NetworkSecret) > 0 {
+		problems = append(problems, "network secret provided without a network secret NV index handle")
+	}
+	if p.SingleUseIndexHandle != 0 && p.SingleUseIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+		problems = append(problems, "invalid single use NV index handle")
+	}
+
+	handles := make(map[tpm2.Handle]bool)
+	for _, h := range []tpm2.Handle{p.PINHandle, p.NetworkSecretIndexHandle, p.SingleUseIndexHandle} {
+		if h == 0 || (h == p.PINHandle && p.ExistingPINIndex != nil) {
+			continue
+		}
+		if handles[h] {
+			problems = append(problems, fmt.Sprintf("NV index handle %v is specified more than once", h))
+		}
+		handles[h] = true
+	}
+
+	if p.PCRProfile != nil {
+		problems = append(problems, p.PCRProfile.checkPCRSelections()...)
+	}
+	if p.RecoveryPCRProfile != nil {
+		problems = append(problems, p.RecoveryPCRProfile.checkPCRSelections()...)
+	}
+
+	if len(problems) > 0 {
+		return InvalidKeyCreationParamsError{problems}
+	}
+	return nil
+}
+
+// isSupportedNameAlg indicates whether the supplied digest algorithm can be used as the name algorithm for sealed key objects and
+// PIN NV indices.
+func isSupportedNameAlg(alg tpm2.HashAlgorithmId) bool {
+	switch alg {
+	case tpm2.HashAlgorithmSHA256, tpm2.HashAlgorithmSHA384, tpm2.HashAlgorithmSHA512:
+		return alg.Supported()
+	default:
+		return false
+	}
+}
+
+// ExistingPINIndexParams references the PIN NV index associated with a sealed key file previously created by SealKeyToTPM, so that
+// it can be shared with a new sealed key file.
+type ExistingPINIndexParams struct {
+	// KeyPath is the path of an existing sealed key data file associated with the PIN NV index to share.
+	KeyPath string
+
+	// PolicyUpdatePath is the path of the policy update data file associated with the key data file at KeyPath. This is required
+	// because all sealed key files that share a PIN NV index must also share the key used to sign authorization policy updates.
+	PolicyUpdatePath string
 }
 
 // SealKeyToTPM seals the supplied disk encryption key to the storage hierarchy of the TPM. The sealed key object and associated
@@ -127,41 +417,181 @@ type KeyCreationParams struct {
 // The supplied key must be 64-bytes long. An error will be returned if it isn't.
 //
 // This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
-// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is incorrect,
-// a AuthFailError error will be returned.
+// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function, or via the HierarchyAuth field of the params
+// argument. If the provided authorization value is incorrect, a AuthFailError error will be returned.
 //
 // If the TPM is not correctly provisioned, a ErrTPMProvisioning error will be returned. In this case, ProvisionTPM must be called
 // before proceeding.
 //
-// This function expects there to be no files at the specified paths. If either path references a file that already exists, a wrapped
-// *os.PathError error will be returned with an underlying error of syscall.EEXIST. A wrapped *os.PathError error will be returned if
-// either file cannot be created and opened for writing.
+// This function expects there to be no files at the specified paths, unless the PIN NV index is being reused as described below.
+// If either path references a file that already exists, a wrapped *os.PathError error will be returned with an underlying error of
+// syscall.EEXIST. A wrapped *os.PathError error will be returned if either file cannot be created and opened for writing.
+//
+// This function will create a NV index at the handle specified by the PINHandle field of the params argument. The handle must be a
+// valid NV index handle (MSO == 0x01), and the choice of handle should take in to consideration the reserved indices from the
+// "Registry of reserved TPM 2.0 handles and localities" specification. It is recommended that the handle is in the block reserved
+// for owner objects (0x01800000 - 0x01bfffff).
+//
+// If the handle is already in use, the existing NV index is reused if the files at keyPath and policyUpdatePath are a valid sealed
+// key file and policy update data file that are associated with it, and the NV index has exactly the public area and authorization
+// policy that it was created with. This makes it possible to re-run a seal operation. In this case, the new sealed key file shares
+// the existing NV index in the same way as if ExistingPINIndex were set to reference the existing files, which are then atomically
+// replaced. If the ForceRecreatePINIndex field of the params argument is set, the existing NV index is undefined and a new one is
+// created instead, as long as there is no existing file at keyPath. Otherwise, a TPMResourceExistsError error will be returned.
+// In this case, the caller will need to either choose a different handle or undefine the existing one.
 //
-// This function will create a NV index at the handle specified by the PINHandle field of the params argument. If the handle is already
-// in use, a TPMResourceExistsError error will be returned. In this case, the caller will need to either choose a different handle or
-// undefine the existing one. The handle must be a valid NV index handle (MSO == 0x01), and the choice of handle should take in to
-// consideration the reserved indices from the "Registry of reserved TPM 2.0 handles and localities" specification. It is recommended
-// that the handle is in the block reserved for owner objects (0x01800000 - 0x01bfffff).
+// If the ExistingPINIndex field of the params argument is set, the new sealed key file will share the PIN NV index, and therefore
+// the PIN and dynamic authorization policy revocation counter, with the existing sealed key file specified by it, and no new NV
+// index will be created. The existing key data file and policy update data file are validated first. If either file cannot be
+// opened, a wrapped *os.PathError error will be returned. If either file fails validation, a InvalidKeyFileError error will be
+// returned. Note that the PIN for all sealed key files that share a PIN NV index is the same, and so ChangePIN will change the PIN
+// for all of them, and the new sealed key file records the same authentication mode as the existing one. Note also that
+// UpdateKeyPCRProtectionPolicy revokes the previous PCR protection policies for all sealed key files
+// that share a PIN NV index, so the PCR protection policies for all of them need to be updated together. The policy update data file
+// for the new sealed key file will contain the same key as the one for the existing sealed key file.
 //
 // The key will be protected with a PCR policy computed from the PCRProtectionProfile supplied via the PCRProfile field of the params
-// argument.
+// argument. If no profile is supplied or the profile is empty, the key will only be bound to this TPM (and the PIN, if one is set
+// later on), and will be able to be unsealed regardless of the TPM's PCR state.
+//
+// The key can only be unsealed whilst the owner (storage) hierarchy of the TPM is enabled. This is enforced by the TPM rather than
+// being an option: the sealed key object is a child of the storage root key, and its authorization policy always contains a
+// TPM2_PolicyNV assertion against the owner-created global lock NV index, and both of these are inaccessible whilst the owner
+// hierarchy is disabled. SealedKeyObject.UnsealFromTPM returns ErrOwnerHierarchyDisabled in this case.
+//
+// If the AdminOverrideKey field of the params argument is set, the key can also be unsealed with a signed authorization from the
+// private part of the supplied key, bypassing the PCR protection policy and PIN. See the documentation for AdminOverrideKey for the
+// security implications of this.
+//
+// If the connection was created with the TransientOnly option set, the sealed key object is created under a transient storage root
+// key and the persistent storage root key is neither used nor provisioned. The resulting key file can be loaded with or without
+// this option. Existing key files cannot be validated in this mode, so an error will be returned if the ExistingPINIndex field of
+// the params argument is set. If there is already a NV index at the handle specified by the PINHandle field, it is neither reused
+// nor undefined, even if the ForceRecreatePINIndex field is set, and a TPMResourceExistsError error will be returned.
+//
+// If the TPM was provisioned with a template authorization policy for the storage root key, the template of the sealed key object
+// is authorized with the key supplied via the SRKTemplatePolicyKey field of the params argument. If it isn't supplied, a
+// ErrSRKTemplateAuthorizationRequired error will be returned.
 func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath string, params *KeyCreationParams) error {
+	return sealKeyToTPM(tpm, key, keyPath, policyUpdatePath, params, nil)
+}
+
+// pcrPolicyDigests contains the PCR selection and approved PCR digests computed from a PCR protection profile by
+// computePCRPolicyDigests, so that they can be shared between sealed key objects protected by the same profile.
+type pcrPolicyDigests struct {
+	pcrs    tpm2.PCRSelectionList
+	digests tpm2.DigestList
+}
+
+// sealKeyToTPM is the implementation of SealKeyToTPM. If pcrPolicy is not nil, it is used for the PCR policy of the new sealed key
+// object instead of the PCR protection profiles in params.
+func sealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath string, params *KeyCreationParams, pcrPolicy *pcrPolicyDigests) error {
 	// params is mandatory.
 	if params == nil {
 		return errors.New("no KeyCreationParams provided")
 	}
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	nameAlg := params.NameAlg
+	if nameAlg == 0 {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+	random := params.RandReader
+	if random == nil {
+		random = rand.Reader
+	}
+	if params.HierarchyAuth != nil {
+		params.HierarchyAuth.apply(tpm)
+	}
+	pcrProfile := params.PCRProfile
+	if params.RecoveryPCRProfile != nil {
+		normalProfile := pcrProfile
+		if normalProfile == nil {
+			normalProfile = &PCRProtectionProfile{}
+		}
+		var err error
+		pcrProfile, err = NewNormalAndRecoveryPCRProtectionProfile(normalProfile, params.RecoveryPCRProfile, newPCRSourceFromTPMContext(tpm.TPMContext))
+		if err != nil {
+			return xerrors.Errorf("cannot combine normal and recovery PCR profiles: %w", err)
+		}
+	}
+	if params.PolicyAuthKey != nil && policyUpdatePath != "" {
+		return errors.New("cannot create a policy update data file for a key with an external policy authorization key")
+	}
+	if tpm.transientOnly && params.ExistingPINIndex != nil {
+		return errors.New("cannot reuse an existing PIN NV index on a connection that doesn't use persistent objects")
+	}
 
 	// Use the HMAC session created when the connection was opened rather than creating a new one.
 	session := tpm.HmacSession()
 
+	// If there is already a NV index at PINHandle, determine whether it should be reused or recreated.
+	existingPINIndex := params.ExistingPINIndex
+	reusePINIndex := false
+	var staleIndex tpm2.ResourceContext
+	if existingPINIndex == nil && params.PINHandle.Type() == tpm2.HandleTypeNVIndex {
+		index, err := tpm.CreateResourceContextFromTPM(params.PINHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, params.PINHandle):
+			// There is no existing NV index.
+		case err != nil:
+			return xerrors.Errorf("cannot create context for existing NV index: %w", err)
+		case tpm.transientOnly:
+			// Existing persistent resources are neither reused nor undefined on a connection that doesn't use persistent objects.
+			return TPMResourceExistsError{params.PINHandle}
+		case params.ForceRecreatePINIndex:
+			// The existing NV index is undefined just before the new one is created. Refuse to overwrite an existing key data
+			// file, as it may be the one associated with the existing NV index.
+			if _, err := os.Lstat(keyPath); err == nil {
+				return fmt.Errorf("cannot recreate PIN NV index: %s already exists", keyPath)
+			} else if !os.IsNotExist(err) {
+				return xerrors.Errorf("cannot determine if key data file exists: %w", err)
+			}
+			staleIndex = index
+		case params.PolicyAuthKey == nil && policyUpdatePath != "":
+			existing := &ExistingPINIndexParams{KeyPath: keyPath, PolicyUpdatePath: policyUpdatePath}
+			data, _, _, err := readAndValidateExistingPINIndexKeyData(tpm.TPMContext, existing, session)
+			if err == nil && data.staticPolicyData.PinIndexHandle == params.PINHandle {
+				existingPINIndex = existing
+				reusePINIndex = true
+			}
+		}
+	}
+
+	// Make sure that the TPM supports the PIN NV index before doing anything else.
+	if existingPINIndex == nil {
+		if err := checkNVIndexFits(tpm.TPMContext, tpm2.NVTypeCounter, pinNVIndexSize, session.IncludeAttrs(tpm2.AttrAudit)); err != nil {
+			if err == ErrNoNVCounterSupport {
+				return err
+			}
+			return xerrors.Errorf("cannot create PIN NV index: %w", err)
+		}
+	}
+
 	// Obtain a context for the SRK now. If we're called immediately after ProvisionTPM without closing the TPMConnection, we use the
 	// context cached by ProvisionTPM, which corresponds to the object provisioned. If not, we just unconditionally provision a new
 	// SRK as this function requires knowledge of the owner hierarchy authorization anyway. This way, we know that the primary key we
 	// seal to is good and future calls to ProvisionTPM won't provision an object that cannot unseal the key we protect.
+	//
+	// If persistent objects aren't being used, we create a transient SRK from the same template instead.
 	srk := tpm.provisionedSrk
-	if srk == nil {
+	switch {
+	case tpm.transientOnly:
 		var err error
-		srk, err = provisionPrimaryKey(tpm.TPMContext, tpm.OwnerHandleContext(), srkTemplate, srkHandle, session)
+		srk, err = tpm.storageRootKey(session)
+		switch {
+		case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+			return AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return xerrors.Errorf("cannot create transient storage root key: %w", err)
+		}
+	case srk == nil:
+		template, _, err := readStorageRootKeyTemplate(tpm.TPMContext)
+		if err != nil {
+			return xerrors.Errorf("cannot determine storage root key template: %w", err)
+		}
+		srk, err = provisionPrimaryKey(tpm.TPMContext, tpm.OwnerHandleContext(), template, srkHandle, false, session)
 		switch {
 		case isAuthFailError(err, tpm2.AnyCommandCode, 1):
 			return AuthFailError{tpm2.HandleOwner}
@@ -190,125 +620,298 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 
 	succeeded := false
 
-	// Create destination files
-	keyFile, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-	if err != nil {
-		return xerrors.Errorf("cannot create key data file: %w", err)
-	}
-	defer func() {
-		keyFile.Close()
-		if succeeded {
-			return
-		}
-		os.Remove(keyPath)
-	}()
-
+	// Create destination files. If an existing PIN NV index is being reused, the existing files are atomically replaced once the
+	// new sealed key object has been created instead.
+	var keyFile *os.File
 	var policyUpdateFile *os.File
-	if policyUpdatePath != "" {
-		var err error
-		policyUpdateFile, err = os.OpenFile(policyUpdatePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if !reusePINIndex {
+		keyFile, err = os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
 		if err != nil {
-			return xerrors.Errorf("cannot create private data file: %w", err)
+			return xerrors.Errorf("cannot create key data file: %w", err)
 		}
 		defer func() {
-			policyUpdateFile.Close()
+			keyFile.Close()
 			if succeeded {
 				return
 			}
-			os.Remove(policyUpdatePath)
+			os.Remove(keyPath)
 		}()
-	}
 
-	// Create an asymmetric key for signing authorization policy updates, and authorizing dynamic authorization policy revocations.
-	authKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return xerrors.Errorf("cannot generate RSA key pair for signing dynamic authorization policies: %w", err)
+		if policyUpdatePath != "" {
+			var err error
+			policyUpdateFile, err = os.OpenFile(policyUpdatePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return xerrors.Errorf("cannot create private data file: %w", err)
+			}
+			defer func() {
+				policyUpdateFile.Close()
+				if succeeded {
+					return
+				}
+				os.Remove(policyUpdatePath)
+			}()
+		}
 	}
-	authPublicKey := createPublicAreaForRSASigningKey(&authKey.PublicKey)
-	authKeyName, err := authPublicKey.Name()
-	if err != nil {
-		return xerrors.Errorf("cannot compute name of signing key for dynamic policy authorization: %w", err)
+
+	var authKey *rsa.PrivateKey
+	var authPublicKey *tpm2.Public
+	var pinIndexPub *tpm2.NVPublic
+	var pinIndexAuthPolicies tpm2.DigestList
+	pinIndexAttrs := pinNVIndexAttrs
+	authModeHint := AuthModeNone
+
+	if existingPINIndex != nil {
+		// Obtain the PIN NV index and the key for signing authorization policy updates from the existing key files.
+		existingData, existingPolicyUpdateData, existingPinIndexPub, err :=
+			readAndValidateExistingPINIndexKeyData(tpm.TPMContext, existingPINIndex, session)
+		if err != nil {
+			if isKeyFileError(err) {
+				return InvalidKeyFileError{err.Error()}
+			}
+			return xerrors.Errorf("cannot read and validate existing key data file: %w", err)
+		}
+		authKey = existingPolicyUpdateData.authKey
+		authPublicKey = existingData.staticPolicyData.AuthPublicKey
+		pinIndexPub = existingPinIndexPub
+		pinIndexAuthPolicies = existingData.staticPolicyData.PinIndexAuthPolicies
+		pinIndexAttrs = existingData.pinIndexAttrs
+		authModeHint = existingData.authModeHint
+	} else {
+		if params.PolicyAuthKey != nil {
+			// Use the externally held key for signing authorization policy updates, and authorizing dynamic authorization policy
+			// revocations.
+			authPublicKey = createPublicAreaForRSASigningKey(params.PolicyAuthKey)
+		} else {
+			// Create an asymmetric key for signing authorization policy updates, and authorizing dynamic authorization policy
+			// revocations.
+			authKey, err = rsa.GenerateKey(random, 2048)
+			if err != nil {
+				return xerrors.Errorf("cannot generate RSA key pair for signing dynamic authorization policies: %w", err)
+			}
+			authPublicKey = createPublicAreaForRSASigningKey(&authKey.PublicKey)
+		}
+		authKeyName, err := authPublicKey.Name()
+		if err != nil {
+			return xerrors.Errorf("cannot compute name of signing key for dynamic policy authorization: %w", err)
+		}
+
+		if staleIndex != nil {
+			if err := undefineExistingPINNVIndex(tpm, staleIndex, session); err != nil {
+				return err
+			}
+		}
+
+		// Create pin NV index
+		hierarchy := tpm.OwnerHandleContext()
+		if params.PlatformPINIndex {
+			hierarchy = tpm.PlatformHandleContext()
+			pinIndexAttrs |= tpm2.AttrNVPlatformCreate
+		}
+		pinIndexPub, pinIndexAuthPolicies, err = createPinNVIndexInHierarchy(tpm.TPMContext, hierarchy, params.PINHandle, nameAlg, authKeyName, random, session)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return TPMResourceExistsError{params.PINHandle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return AuthFailError{hierarchy.Handle()}
+		case tpm2.IsTPMHandleError(err, tpm2.ErrorHierarchy, tpm2.CommandNVDefineSpace, 1):
+			return xerrors.Errorf("cannot create new pin NV index: the %v hierarchy is disabled", hierarchy.Handle())
+		case err != nil:
+			return xerrors.Errorf("cannot create new pin NV index: %w", err)
+		}
+		defer func() {
+			if succeeded {
+				return
+			}
+			index, err := tpm2.CreateNVIndexResourceContextFromPublic(pinIndexPub)
+			if err != nil {
+				return
+			}
+			tpm.NVUndefineSpace(hierarchy, index, session)
+		}()
 	}
 
-	// Create pin NV index
-	pinIndexPub, pinIndexAuthPolicies, err := createPinNVIndex(tpm.TPMContext, params.PINHandle, authKeyName, session)
-	switch {
-	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
-		return TPMResourceExistsError{params.PINHandle}
-	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
-		return AuthFailError{tpm2.HandleOwner}
-	case err != nil:
-		return xerrors.Errorf("cannot create new pin NV index: %w", err)
+	// Create the network secret NV index if required
+	var networkSecretIndexName tpm2.Name
+	if params.NetworkSecretIndexHandle != 0 {
+		networkSecretIndexPub, err := createNetworkSecretNVIndex(tpm.TPMContext, params.NetworkSecretIndexHandle, nameAlg,
+			params.NetworkSecret, session)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return TPMResourceExistsError{params.NetworkSecretIndexHandle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return xerrors.Errorf("cannot create network secret NV index: %w", err)
+		}
+		defer func() {
+			if succeeded {
+				return
+			}
+			index, err := tpm2.CreateNVIndexResourceContextFromPublic(networkSecretIndexPub)
+			if err != nil {
+				return
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+		}()
+		networkSecretIndexName, err = networkSecretIndexPub.Name()
+		if err != nil {
+			return xerrors.Errorf("cannot compute name of network secret NV index: %w", err)
+		}
 	}
-	defer func() {
-		if succeeded {
-			return
+
+	// Create the single use NV index if required
+	var singleUseIndexName tpm2.Name
+	var singleUseCount uint64
+	if params.SingleUseIndexHandle != 0 {
+		var singleUseIndexPub *tpm2.NVPublic
+		singleUseIndexPub, singleUseCount, err = createSingleUseNVIndex(tpm.TPMContext, params.SingleUseIndexHandle, nameAlg, session)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return TPMResourceExistsError{params.SingleUseIndexHandle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return xerrors.Errorf("cannot create single use NV index: %w", err)
 		}
-		index, err := tpm2.CreateNVIndexResourceContextFromPublic(pinIndexPub)
+		defer func() {
+			if succeeded {
+				return
+			}
+			index, err := tpm2.CreateNVIndexResourceContextFromPublic(singleUseIndexPub)
+			if err != nil {
+				return
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+		}()
+		singleUseIndexName, err = singleUseIndexPub.Name()
 		if err != nil {
-			return
+			return xerrors.Errorf("cannot compute name of single use NV index: %w", err)
 		}
-		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
-	}()
+	}
 
 	template := makeSealedKeyTemplate()
+	template.NameAlg = nameAlg
 
 	// Compute the static policy - this never changes for the lifetime of this key file
 	staticPolicyData, authPolicy, err := computeStaticPolicy(template.NameAlg, &staticPolicyComputeParams{
-		key:                  authPublicKey,
-		pinIndexPub:          pinIndexPub,
-		pinIndexAuthPolicies: pinIndexAuthPolicies,
-		lockIndexName:        lockIndexName})
+		key:                     authPublicKey,
+		pinIndexPub:             pinIndexPub,
+		pinIndexAuthPolicies:    pinIndexAuthPolicies,
+		lockIndexName:           lockIndexName,
+		requirePhysicalPresence: params.RequirePhysicalPresence,
+		networkSecretIndexName:  networkSecretIndexName,
+		singleUseIndexName:      singleUseIndexName,
+		singleUseCount:          singleUseCount})
 	if err != nil {
 		return xerrors.Errorf("cannot compute static authorization policy: %w", err)
 	}
 
+	// Add the admin override branch to the policy if requested
+	var adminData *adminPolicyData
+	if params.AdminOverrideKey != nil {
+		adminData, authPolicy, err = computeAuthPolicyWithAdminOverride(template.NameAlg, authPolicy,
+			createPublicAreaForRSASigningKey(params.AdminOverrideKey), lockIndexName)
+		if err != nil {
+			return xerrors.Errorf("cannot compute admin override authorization policy: %w", err)
+		}
+	}
+
 	// Define the template for the sealed key object, using the computed policy digest
 	template.AuthPolicy = authPolicy
 	sensitive := tpm2.SensitiveCreate{Data: key}
 
-	// Have the digest of the private data recorded in the creation data for the sealed data object.
-	authKeyBytes := x509.MarshalPKCS1PrivateKey(authKey)
-	h := crypto.SHA256.New()
-	if _, err := tpm2.MarshalToWriter(h, authKeyBytes); err != nil {
-		panic(fmt.Sprintf("cannot marshal dynamic authorization policy update data: %v", err))
+	// Have the digest of the private data recorded in the creation data for the sealed data object. There is no private data if
+	// the key used to authorize dynamic authorization policies is held externally.
+	var creationInfo tpm2.Data
+	if authKey != nil {
+		authKeyBytes := x509.MarshalPKCS1PrivateKey(authKey)
+		h := crypto.SHA256.New()
+		if _, err := tpm2.MarshalToWriter(h, authKeyBytes); err != nil {
+			panic(fmt.Sprintf("cannot marshal dynamic authorization policy update data: %v", err))
+		}
+		creationInfo = h.Sum(nil)
 	}
-	creationInfo := h.Sum(nil)
 
 	// Now create the sealed key object. The command is integrity protected so if the object at the handle we expect the SRK to reside
 	// at has a different name (ie, if we're connected via a resource manager and somebody swapped the object with another one), this
-	// command will fail. We take advantage of parameter encryption here too.
+	// command will fail. We take advantage of parameter encryption here too. If the SRK has a template authorization policy, the
+	// template is authorized with the supplied key.
 	priv, pub, creationData, _, creationTicket, err :=
-		tpm.Create(srk, &sensitive, template, creationInfo, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
-	if err != nil {
+		createUnderSRK(tpm.TPMContext, srk, params.SRKTemplatePolicyKey, &sensitive, template, creationInfo, session)
+	switch {
+	case err == ErrSRKTemplateAuthorizationRequired:
+		return err
+	case err != nil:
 		return xerrors.Errorf("cannot create sealed data object for key: %w", err)
 	}
 
-	// Create a dynamic authorization policy
-	pcrProfile := params.PCRProfile
+	// Create a dynamic authorization policy. If the PIN NV index is shared with other sealed keys, the dynamic policy counter isn't
+	// incremented as this would revoke the dynamic authorization policies of the other sealed keys. If the key used to authorize
+	// dynamic authorization policies is held externally, the dynamic policy counter can't be incremented and the policy is left
+	// unsigned.
 	if pcrProfile == nil {
 		pcrProfile = &PCRProtectionProfile{}
 	}
-	dynamicPolicyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, currentMetadataVersion, template.NameAlg,
-		authPublicKey.NameAlg, authKey, pinIndexPub, pinIndexAuthPolicies, pcrProfile, session)
+	var pcrValues pcrValuesList
+	if params.AllowIncrementalPCRPolicyUpdates {
+		pcrValues, err = pcrProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+		if err != nil {
+			return xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+		}
+		pcrProfile = makePCRProtectionProfileFromValues(pcrValues)
+	}
+	revokeOld := existingPINIndex == nil && params.PolicyAuthKey == nil
+	var policyData *dynamicPolicyData
+	if pcrPolicy != nil {
+		var policyCount uint64
+		policyCount, err = readDynamicPolicyCounter(tpm.TPMContext, pinIndexPub, pinIndexAuthPolicies, session)
+		if err != nil {
+			return xerrors.Errorf("cannot read dynamic policy counter: %w", err)
+		}
+		policyData, err = computeSealedKeyDynamicAuthPolicyWithPCRDigests(currentMetadataVersion, template.NameAlg,
+			authPublicKey.NameAlg, authKey, random, pinIndexPub, policyCount, pcrPolicy.pcrs, pcrPolicy.digests, revokeOld, nil, nil)
+	} else {
+		policyData, err = computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, currentMetadataVersion, template.NameAlg,
+			authPublicKey.NameAlg, authKey, random, pinIndexPub, pinIndexAuthPolicies, pcrProfile, revokeOld, nil, nil, session)
+	}
 	if err != nil {
 		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
 	// Marshal the entire object (sealed key object and auxiliary data) to disk
 	data := keyData{
-		version:           currentMetadataVersion,
-		keyPrivate:        priv,
-		keyPublic:         pub,
-		authModeHint:      AuthModeNone,
-		staticPolicyData:  staticPolicyData,
-		dynamicPolicyData: dynamicPolicyData}
-
-	if err := data.write(keyFile); err != nil {
+		version:                  currentMetadataVersion,
+		keyPrivate:               priv,
+		keyPublic:                pub,
+		authModeHint:             authModeHint,
+		staticPolicyData:         staticPolicyData,
+		dynamicPolicyData:        policyData,
+		label:                    params.Label,
+		adminPolicyData:          adminData,
+		pinIndexAttrs:            pinIndexAttrs,
+		pinIndexNameAlg:          pinIndexPub.NameAlg,
+		requirePhysicalPresence:  params.RequirePhysicalPresence,
+		minFirmwareVersion:       params.MinFirmwareVersion,
+		networkSecretIndexHandle: params.NetworkSecretIndexHandle,
+		networkSecretIndexName:   networkSecretIndexName,
+		singleUseIndexHandle:     params.SingleUseIndexHandle,
+		singleUseIndexName:       singleUseIndexName,
+		singleUseCount:           singleUseCount,
+		volumeIdentity:           params.VolumeIdentity}
+	if params.AllowIncrementalPCRPolicyUpdates {
+		data.pcrBranchValues = encodePCRBranchValues(policyData.PCRSelection, pcrValues)
+	}
+
+	if reusePINIndex {
+		err = data.writeToFileAtomic(keyPath)
+	} else {
+		err = data.write(keyFile)
+	}
+	if err != nil {
 		return xerrors.Errorf("cannot write key data file: %w", err)
 	}
 
-	if policyUpdateFile != nil {
+	if policyUpdatePath != "" {
 		policyUpdateData := keyPolicyUpdateData{
 			version:        currentMetadataVersion,
 			authKey:        authKey,
@@ -317,72 +920,283 @@ func SealKeyToTPM(tpm *TPMConnection, key []byte, keyPath, policyUpdatePath stri
 			creationTicket: creationTicket}
 
 		// Marshal the private data to disk
-		if err := policyUpdateData.write(policyUpdateFile); err != nil {
+		if reusePINIndex {
+			err = policyUpdateData.writeToFileAtomic(policyUpdatePath)
+		} else {
+			err = policyUpdateData.write(policyUpdateFile)
+		}
+		if err != nil {
 			return xerrors.Errorf("cannot write dynamic authorization policy update data file: %w", err)
 		}
 	}
 
-	if err := incrementDynamicPolicyCounter(tpm.TPMContext, pinIndexPub, pinIndexAuthPolicies, authKey, authPublicKey, session); err != nil {
-		return xerrors.Errorf("cannot increment dynamic policy counter: %w", err)
+	if revokeOld {
+		if err := incrementDynamicPolicyCounter(tpm.TPMContext, pinIndexPub, pinIndexAuthPolicies, authKey, authPublicKey, session); err != nil {
+			return xerrors.Errorf("cannot increment dynamic policy counter: %w", err)
+		}
 	}
 
 	succeeded = true
 	return nil
 }
 
-// UpdateKeyPCRProtectionPolicy updates the PCR protection policy for the sealed key at the path specified by the keyPath argument
-// to the profile defined by the pcrProfile argument. In order to do this, the caller must also specify the path to the policy update
-// data file that was saved by SealKeyToTPM.
-//
-// If either file cannot be opened, a wrapped *os.PathError error will be returned.
+// ProvisionAndSeal provisions the TPM associated with the tpm parameter if required and then seals the supplied disk encryption key
+// to it, as a single operation. This is equivalent to calling ProvisionTPMWithParams followed by SealKeyToTPM, except that the
+// TPM is only provisioned if ProvisionStatus indicates that it isn't already fully provisioned for the specified mode (or if mode
+// is ProvisionModeClear), and that if sealing fails, any NV indices that were created by this call are undefined again so that
+// the TPM isn't left partially configured. The endorsement key and storage root key are retained on failure because they can be
+// reused by a subsequent attempt.
 //
-// If either file cannot be deserialized correctly or validation of the files fails, a InvalidKeyFileError error will be returned.
-//
-// On success, the sealed key data file is updated atomically with an updated authorization policy that includes a PCR policy
-// computed from the supplied PCRProtectionProfile.
-func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile) error {
-	// Use the HMAC session created when the connection was opened rather than creating a new one.
-	session := tpm.HmacSession()
+// The mode, newLockoutAuth, confirmDataLoss and provisionParams arguments are passed to ProvisionTPMWithParams, and the key, keyPath,
+// policyUpdatePath and params arguments are passed to SealKeyToTPM. This function returns the same errors as those functions.
+func ProvisionAndSeal(tpm *TPMConnection, mode ProvisionMode, newLockoutAuth []byte, confirmDataLoss bool, provisionParams *ProvisionParams,
+	key []byte, keyPath, policyUpdatePath string, params *KeyCreationParams) error {
+	if provisionParams != nil && provisionParams.HierarchyAuth != nil {
+		provisionParams.HierarchyAuth.apply(tpm)
+	}
 
-	// Open the key data file
-	keyFile, err := os.Open(keyPath)
+	status, err := ProvisionStatus(tpm)
 	if err != nil {
-		return xerrors.Errorf("cannot open key data file: %w", err)
+		return xerrors.Errorf("cannot determine the current TPM status: %w", err)
 	}
-	defer keyFile.Close()
 
-	// Open the policy update data file
-	policyUpdateFile, err := os.Open(policyUpdatePath)
-	if err != nil {
-		return xerrors.Errorf("cannot open private data file: %w", err)
+	required := AttrValidSRK | AttrValidEK | AttrValidLockNVIndex
+	if mode != ProvisionModeWithoutLockout {
+		required |= AttrDAParamsOK | AttrOwnerClearDisabled | AttrLockoutAuthSet
 	}
-	defer policyUpdateFile.Close()
 
-	data, policyUpdateData, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, policyUpdateFile, session)
-	if err != nil {
-		if isKeyFileError(err) {
-			return InvalidKeyFileError{err.Error()}
+	// Determine whether the global lock NV index exists before provisioning, so that we know whether it needs to be removed again
+	// if sealing fails. Clearing the TPM removes it.
+	_, err = tpm.CreateResourceContextFromTPM(lockNVHandle)
+	lockIndexExisted := err == nil && mode != ProvisionModeClear
+
+	if mode == ProvisionModeClear || status&required != required {
+		if err := ProvisionTPMWithParams(tpm, mode, newLockoutAuth, confirmDataLoss, provisionParams); err != nil {
+			return err
 		}
-		// FIXME: Turn the missing lock NV index in to ErrProvisioning
-		return xerrors.Errorf("cannot read and validate key data file: %w", err)
 	}
 
-	authKey := policyUpdateData.authKey
-	authPublicKey := data.staticPolicyData.AuthPublicKey
-	pinIndexAuthPolicies := data.staticPolicyData.PinIndexAuthPolicies
-
-	// Compute a new dynamic authorization policy
+	succeeded := false
+	defer func() {
+		if succeeded || lockIndexExisted {
+			return
+		}
+		for _, handle := range []tpm2.Handle{lockNVHandle, lockNVDataHandle} {
+			index, err := tpm.CreateResourceContextFromTPM(handle)
+			if err != nil {
+				continue
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, tpm.HmacSession())
+		}
+	}()
+
+	// SealKeyToTPM undefines the PIN NV index that it creates on failure.
+	if err := SealKeyToTPM(tpm, key, keyPath, policyUpdatePath, params); err != nil {
+		return err
+	}
+
+	succeeded = true
+	return nil
+}
+
+// undefineExistingPINNVIndex undefines the supplied NV index so that a new PIN NV index can be created in its place. The NV index is
+// undefined with the authorization of the platform hierarchy if it was created with the TPMA_NV_PLATFORMCREATE attribute, or the
+// owner hierarchy otherwise. If the authorization fails, a AuthFailError error is returned.
+func undefineExistingPINNVIndex(tpm *TPMConnection, index tpm2.ResourceContext, session tpm2.SessionContext) error {
+	pub, _, err := tpm.NVReadPublic(index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return xerrors.Errorf("cannot read public area of existing NV index: %w", err)
+	}
+
+	hierarchy := tpm.OwnerHandleContext()
+	if pub.Attrs&tpm2.AttrNVPlatformCreate != 0 {
+		hierarchy = tpm.PlatformHandleContext()
+	}
+
+	err = tpm.NVUndefineSpace(hierarchy, index, session)
+	switch {
+	case isAuthFailError(err, tpm2.CommandNVUndefineSpace, 1):
+		return AuthFailError{hierarchy.Handle()}
+	case err != nil:
+		return xerrors.Errorf("cannot undefine existing NV index: %w", err)
+	}
+	return nil
+}
+
+// readAndValidateExistingPINIndexKeyData reads and validates the key data file and policy update data file referenced by params,
+// in order to share the associated PIN NV index with a new sealed key object.
+func readAndValidateExistingPINIndexKeyData(tpm *tpm2.TPMContext, params *ExistingPINIndexParams, session tpm2.SessionContext) (*keyData, *keyPolicyUpdateData, *tpm2.NVPublic, error) {
+	keyFile, err := os.Open(params.KeyPath)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer keyFile.Close()
+
+	policyUpdateFile, err := os.Open(params.PolicyUpdatePath)
+	if err != nil {
+		return nil, nil, nil, xerrors.Errorf("cannot open policy update data file: %w", err)
+	}
+	defer policyUpdateFile.Close()
+
+	return decodeAndValidateKeyData(tpm, keyFile, policyUpdateFile, session)
+}
+
+// NeedsReseal determines whether the PCR protection policy for the supplied sealed key object needs to be updated with
+// UpdateKeyPCRProtectionPolicy in order to match the supplied PCR protection profile, by comparing the sealed key object's current
+// dynamic authorization policy digest with the digest computed from the new profile. It returns true if the digests differ, or if
+// the sealed key object's current dynamic authorization policy has been revoked. Note that the comparison is sensitive to the order
+// of the branches in the profile, so a profile that is equivalent to the current one but which has been constructed differently
+// may be reported as requiring a reseal.
+//
+// If the sealed key object's current dynamic authorization policy was created by UpdateKeyPCRProtectionPolicyWithGracePeriod,
+// the PCR digests that are accepted during the grace period are included in the comparison, so a reseal is only reported as
+// required if the new profile differs from the one that the policy was updated with.
+//
+// This function only reads from the TPM - it doesn't modify the sealed key object or any TPM resources.
+//
+// If the PIN NV index associated with the sealed key object is not available, a InvalidKeyFileError error will be returned.
+func (t *TPMConnection) NeedsReseal(k *SealedKeyObject, newProfile *PCRProtectionProfile) (bool, error) {
+	if newProfile == nil {
+		newProfile = &PCRProtectionProfile{}
+	}
+
+	session := t.HmacSession()
+
+	pinIndexHandle := k.data.staticPolicyData.PinIndexHandle
+	if pinIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+		return false, InvalidKeyFileError{"invalid handle type for PIN NV index"}
+	}
+	pinIndex, err := t.CreateResourceContextFromTPM(pinIndexHandle, session.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, pinIndexHandle):
+		return false, InvalidKeyFileError{"no PIN NV index found"}
+	case err != nil:
+		return false, xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+	}
+	pinIndexPub, _, err := t.NVReadPublic(pinIndex, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return false, xerrors.Errorf("cannot read public area of PIN NV index: %w", err)
+	}
+
+	// If the current policy has been revoked, then it needs to be updated regardless of the new profile.
+	policyCount, err := readDynamicPolicyCounter(t.TPMContext, pinIndexPub, k.data.staticPolicyData.PinIndexAuthPolicies, session)
+	if err != nil {
+		return false, xerrors.Errorf("cannot read dynamic policy counter: %w", err)
+	}
+	if policyCount > k.data.dynamicPolicyData.PolicyCount {
+		return true, nil
+	}
+
+	alg := k.data.keyPublic.NameAlg
+	pcrs, pcrDigests, err := newProfile.computePCRDigests(newPCRSourceFromTPMContext(t.TPMContext), alg)
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
+	}
+
+	pinIndexName, err := pinIndexPub.Name()
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute name of PIN NV index: %w", err)
+	}
+
+	policyData, err := computeDynamicPolicy(k.data.policyVersion(), alg, &dynamicPolicyComputeParams{
+		pcrs:                   pcrs,
+		pcrDigests:             pcrDigests,
+		policyCountIndexName:   pinIndexName,
+		policyCount:            k.data.dynamicPolicyData.PolicyCount,
+		userPINPolicyORDigests: k.data.userPINPolicyORDigests,
+		pcrGracePeriodDigests:  k.data.pcrGracePeriodDigests,
+		pcrGracePeriodExpiry:   k.data.pcrGracePeriodExpiry})
+	if err != nil {
+		return false, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+
+	return !bytes.Equal(policyData.AuthorizedPolicy, k.data.dynamicPolicyData.AuthorizedPolicy), nil
+}
+
+// UpdateKeyPCRProtectionPolicy updates the PCR protection policy for the sealed key at the path specified by the keyPath argument
+// to the profile defined by the pcrProfile argument. In order to do this, the caller must also specify the path to the policy update
+// data file that was saved by SealKeyToTPM.
+//
+// If either file cannot be opened, a wrapped *os.PathError error will be returned.
+//
+// If either file cannot be deserialized correctly or validation of the files fails, a InvalidKeyFileError error will be returned.
+//
+// On success, the sealed key data file is updated atomically with an updated authorization policy that includes a PCR policy
+// computed from the supplied PCRProtectionProfile.
+func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile) error {
 	if pcrProfile == nil {
 		pcrProfile = &PCRProtectionProfile{}
 	}
-	policyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, data.version, data.keyPublic.NameAlg, authPublicKey.NameAlg,
-		authKey, pinIndexPublic, pinIndexAuthPolicies, pcrProfile, session)
+	return updateKeyPCRProtectionPolicy(tpm, keyPath, policyUpdatePath, func(_ *keyData) (pcrValuesList, error) {
+		values, err := pcrProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+		}
+		return values, nil
+	})
+}
+
+// updateKeyPCRProtectionPolicy is the common implementation of UpdateKeyPCRProtectionPolicy and
+// UpdateKeyPCRProtectionPolicyIncremental. The computeValues callback is called with the validated key data in order to compute
+// the PCR values for each branch of the new PCR policy. It may also modify the key data, eg, to change the user PINs associated
+// with it, before the new PCR policy is computed.
+func updateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath, policyUpdatePath string, computeValues func(data *keyData) (pcrValuesList, error)) error {
+	// Use the HMAC session created when the connection was opened rather than creating a new one.
+	session := tpm.HmacSession()
+
+	// Open the key data file
+	keyFile, err := os.Open(keyPath)
+	if err != nil {
+		return xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer keyFile.Close()
+
+	// Open the policy update data file
+	policyUpdateFile, err := os.Open(policyUpdatePath)
+	if err != nil {
+		return xerrors.Errorf("cannot open private data file: %w", err)
+	}
+	defer policyUpdateFile.Close()
+
+	data, policyUpdateData, pinIndexPublic, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, policyUpdateFile, session)
+	if err != nil {
+		if isKeyFileError(err) {
+			return InvalidKeyFileError{err.Error()}
+		}
+		// FIXME: Turn the missing lock NV index in to ErrProvisioning
+		return xerrors.Errorf("cannot read and validate key data file: %w", err)
+	}
+
+	authKey := policyUpdateData.authKey
+	authPublicKey := data.staticPolicyData.AuthPublicKey
+	pinIndexAuthPolicies := data.staticPolicyData.PinIndexAuthPolicies
+
+	values, err := computeValues(data)
+	if err != nil {
+		return err
+	}
+
+	// Compute a new dynamic authorization policy
+	policyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, data.policyVersion(), data.keyPublic.NameAlg, authPublicKey.NameAlg,
+		authKey, rand.Reader, pinIndexPublic, pinIndexAuthPolicies, makePCRProtectionProfileFromValues(values), true, nil, data.userPINPolicyORDigests,
+		session)
 	if err != nil {
 		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
 	}
 
+	// Make sure that the new dynamic authorization policy is authorized by the key that the static authorization policy's
+	// TPM2_PolicyAuthorize assertion is bound to, before replacing the existing one.
+	if err := verifyDynamicPolicyAuthorization(tpm.TPMContext, data.staticPolicyData, policyData, session); err != nil {
+		return xerrors.Errorf("cannot verify new dynamic authorization policy: %w", err)
+	}
+
 	// Atomically update the key data file
 	data.dynamicPolicyData = policyData
+	data.pcrGracePeriodExpiry = 0
+	data.pcrGracePeriodDigests = nil
+	if len(data.pcrBranchValues) > 0 {
+		data.pcrBranchValues = encodePCRBranchValues(policyData.PCRSelection, values)
+	}
 
 	if err := data.writeToFileAtomic(keyPath); err != nil {
 		return xerrors.Errorf("cannot write key data file: %v", err)
@@ -394,3 +1208,489 @@ func UpdateKeyPCRProtectionPolicy(tpm *TPMConnection, keyPath, policyUpdatePath
 
 	return nil
 }
+
+// SRKRotationKeyParams identifies a sealed key file to be re-created under a new storage root key by RotateSRK.
+type SRKRotationKeyParams struct {
+	// KeyPath is the path of the sealed key data file.
+	KeyPath string
+
+	// PolicyUpdatePath is the path of the policy update data file associated with the sealed key data file. This should be
+	// supplied if the sealed key was created with one, as the policy update data file is bound to the sealed key object and will
+	// become unusable if it isn't updated.
+	PolicyUpdatePath string
+
+	// PIN is the PIN for the sealed key.
+	PIN string
+}
+
+// RotateSRK replaces the storage root key with a newly provisioned one and re-creates the sealed key objects associated with the
+// supplied key files under it. As sealed key objects created by SealKeyToTPM cannot be duplicated, each one is unsealed with the
+// current storage root key and then a new sealed key object is created under the new storage root key with the same sensitive data
+// and the same authorization policy. The associated PIN NV index and the PCR protection policy are not modified, and the keys
+// protected by the sealed key objects do not change.
+//
+// Because each key has to be unsealed, the current PCR values must satisfy the PCR protection policy of every key, and the correct
+// PIN must be supplied for each key. The errors returned from unsealing a key are the same as those returned from UnsealFromTPM.
+// Unsealing a single use key here does not revoke it, and the new sealed key object can still be unsealed once.
+//
+// This function requires knowledge of the authorization value for the storage hierarchy, which must be provided by calling
+// TPMConnection.OwnerHandleContext().SetAuthValue() prior to calling this function. If the provided authorization value is incorrect,
+// a AuthFailError error will be returned.
+//
+// The new storage root key is created from the current template with a new random value in its unique field, so that it differs
+// from the previous one without changing the primary seed of the storage hierarchy. The unique value is recorded on the TPM so that
+// the new storage root key can be recreated by ProvisionTPM. The new storage root key and the new sealed key objects are created
+// before the previous storage root key is evicted, so if any of these steps fail, the previous storage root key remains in place.
+//
+// The updated key data files and policy update data files are written to temporary files alongside the originals before the new
+// unique value is recorded and the storage root key is replaced, and are only moved in to place afterwards. If any step fails before
+// the storage root key is replaced, the temporary files are removed and the TPM and the existing key files are left unmodified. If a
+// temporary file cannot be moved in to place after the storage root key has been replaced, it is left on disk and the returned
+// error identifies it. Any other key data files that were created under the previous storage root key will no longer be loadable,
+// and will need to be recreated with SealKeyToTPM.
+//
+// Sealed key objects that are network-bound or that have user PINs are not supported, and an error will be returned for these
+// before the TPM is modified.
+//
+// This isn't supported if the TPM was provisioned with a template authorization policy for the storage root key, and a
+// ErrSRKTemplateAuthorizationRequired error will be returned.
+func RotateSRK(tpm *TPMConnection, keys []*SRKRotationKeyParams) error {
+	// Use the HMAC session created when the connection was opened rather than creating a new one.
+	session := tpm.HmacSession()
+
+	if keyName, err := readSRKTemplatePolicyKeyName(tpm.TPMContext); err != nil {
+		return xerrors.Errorf("cannot determine if the storage root key has a template authorization policy: %w", err)
+	} else if keyName != nil {
+		return ErrSRKTemplateAuthorizationRequired
+	}
+
+	type keyToRotate struct {
+		params           *SRKRotationKeyParams
+		data             *keyData
+		policyUpdateData *keyPolicyUpdateData
+		key              []byte
+	}
+	var toRotate []*keyToRotate
+
+	// Read and validate each of the keys before unsealing any of them.
+	for _, k := range keys {
+		data, policyUpdateData, err := func() (*keyData, *keyPolicyUpdateData, error) {
+			keyFile, err := os.Open(k.KeyPath)
+			if err != nil {
+				return nil, nil, xerrors.Errorf("cannot open key data file: %w", err)
+			}
+			defer keyFile.Close()
+
+			var policyUpdateFile *os.File
+			if k.PolicyUpdatePath != "" {
+				policyUpdateFile, err = os.Open(k.PolicyUpdatePath)
+				if err != nil {
+					return nil, nil, xerrors.Errorf("cannot open policy update data file: %w", err)
+				}
+				defer policyUpdateFile.Close()
+			}
+
+			data, policyUpdateData, _, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, policyUpdateFile, session)
+			if err != nil {
+				if isKeyFileError(err) {
+					return nil, nil, InvalidKeyFileError{err.Error()}
+				}
+				return nil, nil, xerrors.Errorf("cannot read and validate key data file: %w", err)
+			}
+			return data, policyUpdateData, nil
+		}()
+		if err != nil {
+			return xerrors.Errorf("cannot read key file %s: %w", k.KeyPath, err)
+		}
+		if data.networkSecretIndexHandle != 0 {
+			return fmt.Errorf("cannot rotate the storage root key for key file %s: network-bound sealed key objects are not supported",
+				k.KeyPath)
+		}
+		if len(data.userPINIndexHandles) > 0 {
+			return fmt.Errorf("cannot rotate the storage root key for key file %s: sealed key objects with user PINs are not supported",
+				k.KeyPath)
+		}
+
+		toRotate = append(toRotate, &keyToRotate{params: k, data: data, policyUpdateData: policyUpdateData})
+	}
+
+	// Unseal each of the keys with the current SRK.
+	for _, k := range toRotate {
+		// Don't revoke a single use key here, as the new sealed key object is bound to the same value of the single use NV index.
+		key, err := (&SealedKeyObject{data: k.data}).unsealFromTPMCommon(tpm, k.params.PIN, nil, 0, false)
+		if err != nil {
+			return xerrors.Errorf("cannot unseal key file %s: %w", k.params.KeyPath, err)
+		}
+		k.key = key
+	}
+
+	defer func() {
+		for _, k := range toRotate {
+			for i := range k.key {
+				k.key[i] = 0
+			}
+		}
+	}()
+
+	// Create the new SRK as a transient object from the current template with a new random unique value, so that it differs from
+	// the current SRK. The current SRK isn't evicted until everything else has succeeded.
+	template, _, err := readStorageRootKeyTemplate(tpm.TPMContext)
+	if err != nil {
+		return xerrors.Errorf("cannot determine storage root key template: %w", err)
+	}
+	oldUnique, err := readSRKTemplateUnique(tpm.TPMContext)
+	if err != nil {
+		return xerrors.Errorf("cannot read current storage root key unique value: %w", err)
+	}
+	unique := make([]byte, srkTemplateUniqueSize)
+	if _, err := io.ReadFull(rand.Reader, unique); err != nil {
+		return xerrors.Errorf("cannot obtain unique value for new storage root key: %w", err)
+	}
+	template = makeSRKTemplateWithUnique(template, unique)
+
+	srk, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, template, nil, nil, session)
+	switch {
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		return AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return xerrors.Errorf("cannot create storage root key: %w", err)
+	}
+	defer tpm.FlushContext(srk)
+
+	// Re-create each of the sealed key objects under the new SRK with the same authorization policy, before updating any key files.
+	for _, k := range toRotate {
+		template := makeSealedKeyTemplate()
+		template.NameAlg = k.data.keyPublic.NameAlg
+		template.AuthPolicy = k.data.keyPublic.AuthPolicy
+
+		var creationInfo tpm2.Data
+		if k.policyUpdateData != nil {
+			creationInfo = k.policyUpdateData.creationInfo
+		}
+
+		priv, pub, creationData, _, creationTicket, err :=
+			tpm.Create(srk, &tpm2.SensitiveCreate{Data: k.key}, template, creationInfo, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+		if err != nil {
+			return xerrors.Errorf("cannot create sealed data object for key file %s: %w", k.params.KeyPath, err)
+		}
+
+		k.data.keyPrivate = priv
+		k.data.keyPublic = pub
+		if k.policyUpdateData != nil {
+			k.policyUpdateData.creationData = creationData
+			k.policyUpdateData.creationTicket = creationTicket
+		}
+	}
+
+	// Write each of the updated files to a temporary file alongside the original before modifying the TPM. The temporary files are
+	// removed if anything fails before the SRK is replaced.
+	var files []*osutil.AtomicFile
+	defer func() {
+		for _, f := range files {
+			f.Cancel()
+		}
+	}()
+	writeFile := func(path string, write func(io.Writer) error) error {
+		f, err := osutil.NewAtomicFile(path, 0600, 0, sys.UserID(osutil.NoChown), sys.GroupID(osutil.NoChown))
+		if err != nil {
+			return xerrors.Errorf("cannot create new atomic file: %w", err)
+		}
+		files = append(files, f)
+		if err := write(f); err != nil {
+			return xerrors.Errorf("cannot write to temporary file: %w", err)
+		}
+		return nil
+	}
+	for _, k := range toRotate {
+		if err := writeFile(k.params.KeyPath, k.data.write); err != nil {
+			return xerrors.Errorf("cannot write key data file %s: %w", k.params.KeyPath, err)
+		}
+		if k.policyUpdateData == nil {
+			continue
+		}
+		if err := writeFile(k.params.PolicyUpdatePath, k.policyUpdateData.write); err != nil {
+			return xerrors.Errorf("cannot write policy update data file %s: %w", k.params.PolicyUpdatePath, err)
+		}
+	}
+
+	// Record the new unique value so that the new SRK can be recreated from the template, and then replace the persistent SRK.
+	if err := provisionSRKTemplateUniqueNVIndex(tpm.TPMContext, unique, session); err != nil {
+		if isAuthFailError(err, tpm2.AnyCommandCode, 1) {
+			return AuthFailError{tpm2.HandleOwner}
+		}
+		return xerrors.Errorf("cannot record storage root key unique value: %w", err)
+	}
+
+	persistentSrk, err := func() (tpm2.ResourceContext, error) {
+		oldSrk, err := tpm.CreateResourceContextFromTPM(srkHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, srkHandle):
+			// No existing SRK to evict
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create context for current storage root key: %w", err)
+		default:
+			if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), oldSrk, srkHandle, session); err != nil {
+				return nil, xerrors.Errorf("cannot evict current storage root key: %w", err)
+			}
+		}
+		persistentSrk, err := tpm.EvictControl(tpm.OwnerHandleContext(), srk, srkHandle, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot make new storage root key persistent: %w", err)
+		}
+		return persistentSrk, nil
+	}()
+	if err != nil {
+		// Try to restore the previous unique value. If the previous SRK was evicted, it can be recreated from the template.
+		provisionSRKTemplateUniqueNVIndex(tpm.TPMContext, oldUnique, session)
+		return err
+	}
+	tpm.provisionedSrk = persistentSrk
+
+	// Move the updated files in to place. The existing files are no longer usable, so try to move every file even if one fails,
+	// and don't remove any temporary files that couldn't be moved.
+	toCommit := files
+	files = nil
+	var commitErr error
+	for _, f := range toCommit {
+		if err := f.Commit(); err != nil && commitErr == nil {
+			commitErr = xerrors.Errorf("cannot move temporary file %s in to place: %w", f.Name(), err)
+		}
+	}
+
+	return commitErr
+}
+
+// MoveKeyToNewPINIndex rebinds the sealed key object at the path specified by the keyPath argument to a newly created PIN NV index
+// at the specified handle, without changing the key that it protects. This is useful for moving a sealed key object from a PIN NV
+// index that is shared with other sealed key objects to a dedicated one. As the PIN NV index is bound to the static authorization
+// policy of the sealed key object, the key is unsealed with the supplied PIN and a new sealed key object is created with the same
+// sensitive data and a static authorization policy bound to the new PIN NV index. The new PIN NV index is created in the same
+// hierarchy as the existing one, and is initialized with the same PIN. A new PCR protection policy is computed from the supplied PCR
+// profile and installed in the same way as UpdateKeyPCRProtectionPolicy, which requires the private data file at the path specified
+// by the policyUpdatePath argument.
+//
+// The current PCR values must satisfy the existing PCR protection policy. The errors returned from unsealing the key are the same as
+// those returned from UnsealFromTPM. Sealed key objects with user PINs are not supported. If the sealed key object is network-bound,
+// the secret provided by the remote service must be supplied via the networkSecret argument in the same way as for
+// UnsealFromTPMWithNetworkSecret, and the new sealed key object remains bound to the same network secret NV index. Otherwise, the
+// networkSecret argument is ignored.
+//
+// If the sealed key object is single use, unsealing it here does not revoke it. The new sealed key object is bound to the same
+// value of the single use NV index, so whichever of the existing or new sealed key objects is unsealed first revokes both of them.
+//
+// If there is already a NV index defined at the specified handle, a TPMResourceExistsError error will be returned.
+//
+// If either file cannot be deserialized correctly or validation of the files fails, a InvalidKeyFileError error will be returned.
+//
+// The key data file and private data file are only updated once everything else has succeeded. If any step fails, the new PIN NV
+// index is undefined again and the existing files are left unmodified, so that they continue to work with the existing PIN NV index.
+// The exception is if the private data file can't be updated and the original key data file can't then be restored, in which case
+// the returned error says so and the new PIN NV index is retained because the key data file refers to it.
+// The existing PIN NV index is never modified or undefined by this function because it may be shared with other sealed key objects.
+// Once no other sealed key objects depend on it, it can be undefined with TPMConnection.NVUndefineSpace.
+//
+// This isn't supported if the storage root key has a template authorization policy, and a ErrSRKTemplateAuthorizationRequired
+// error will be returned.
+func MoveKeyToNewPINIndex(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile, handle tpm2.Handle, pin string, networkSecret []byte) error {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return errors.New("invalid handle type for PIN NV index")
+	}
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+
+	// Use the HMAC session created when the connection was opened rather than creating a new one.
+	session := tpm.HmacSession()
+
+	data, policyUpdateData, err := func() (*keyData, *keyPolicyUpdateData, error) {
+		keyFile, err := os.Open(keyPath)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot open key data file: %w", err)
+		}
+		defer keyFile.Close()
+
+		policyUpdateFile, err := os.Open(policyUpdatePath)
+		if err != nil {
+			return nil, nil, xerrors.Errorf("cannot open private data file: %w", err)
+		}
+		defer policyUpdateFile.Close()
+
+		data, policyUpdateData, _, err := decodeAndValidateKeyData(tpm.TPMContext, keyFile, policyUpdateFile, session)
+		if err != nil {
+			if isKeyFileError(err) {
+				return nil, nil, InvalidKeyFileError{err.Error()}
+			}
+			return nil, nil, xerrors.Errorf("cannot read and validate key data file: %w", err)
+		}
+		return data, policyUpdateData, nil
+	}()
+	if err != nil {
+		return err
+	}
+	if len(data.userPINIndexHandles) > 0 {
+		return errors.New("cannot move a sealed key object that has user PINs to a new PIN NV index")
+	}
+	if handle == data.staticPolicyData.PinIndexHandle {
+		return fmt.Errorf("%v is already the PIN NV index for the sealed key object", handle)
+	}
+
+	if data.networkSecretIndexHandle == 0 {
+		networkSecret = nil
+	}
+	// Don't revoke a single use key here, as the existing key data file must continue to work if anything fails.
+	key, err := (&SealedKeyObject{data: data}).unsealFromTPMCommon(tpm, pin, networkSecret, 0, false)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for i := range key {
+			key[i] = 0
+		}
+	}()
+
+	values, err := pcrProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+	if err != nil {
+		return xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(srkHandle)
+	if err != nil {
+		return xerrors.Errorf("cannot create context for SRK: %w", err)
+	}
+	required, err := srkRequiresTemplateAuthorization(tpm.TPMContext, srk)
+	switch {
+	case err != nil:
+		return err
+	case required:
+		return ErrSRKTemplateAuthorizationRequired
+	}
+
+	lockIndex, err := tpm.CreateResourceContextFromTPM(lockNVHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, lockNVHandle):
+		return ErrTPMProvisioning
+	case err != nil:
+		return xerrors.Errorf("cannot create context for lock NV index: %w", err)
+	}
+	lockIndexPub, err := readAndValidateLockNVIndexPublic(tpm.TPMContext, lockIndex, session)
+	if err != nil {
+		return ErrTPMProvisioning
+	}
+	lockIndexName, err := lockIndexPub.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of global lock NV index: %w", err)
+	}
+
+	authKey := policyUpdateData.authKey
+	authPublicKey := data.staticPolicyData.AuthPublicKey
+	authKeyName, err := authPublicKey.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of signing key for dynamic policy authorization: %w", err)
+	}
+
+	// Create the new PIN NV index in the same hierarchy as the existing one.
+	hierarchy := tpm.OwnerHandleContext()
+	if data.pinIndexAttrs&tpm2.AttrNVPlatformCreate != 0 {
+		hierarchy = tpm.PlatformHandleContext()
+	}
+	pinIndexPub, pinIndexAuthPolicies, err := createPinNVIndexInHierarchy(tpm.TPMContext, hierarchy, handle, data.pinIndexNameAlg, authKeyName, rand.Reader, session)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+		return TPMResourceExistsError{handle}
+	case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+		return AuthFailError{hierarchy.Handle()}
+	case err != nil:
+		return xerrors.Errorf("cannot create new PIN NV index: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		index, err := tpm2.CreateNVIndexResourceContextFromPublic(pinIndexPub)
+		if err != nil {
+			return
+		}
+		tpm.NVUndefineSpace(hierarchy, index, session)
+	}()
+
+	if err := performPinChange(tpm.TPMContext, pinIndexPub, pinIndexAuthPolicies, "", pinIndexAuthValue(pin), session); err != nil {
+		return xerrors.Errorf("cannot set authorization value for new PIN NV index: %w", err)
+	}
+
+	// Compute a new static policy bound to the new PIN NV index, keeping everything else the same.
+	staticPolicyData, authPolicy, err := computeStaticPolicy(data.keyPublic.NameAlg, &staticPolicyComputeParams{
+		key:                     authPublicKey,
+		pinIndexPub:             pinIndexPub,
+		pinIndexAuthPolicies:    pinIndexAuthPolicies,
+		lockIndexName:           lockIndexName,
+		requirePhysicalPresence: data.requirePhysicalPresence,
+		networkSecretIndexName:  data.networkSecretIndexName,
+		singleUseIndexName:      data.singleUseIndexName,
+		singleUseCount:          data.singleUseCount})
+	if err != nil {
+		return xerrors.Errorf("cannot compute static authorization policy: %w", err)
+	}
+
+	adminData := data.adminPolicyData
+	if adminData != nil {
+		adminData, authPolicy, err = computeAuthPolicyWithAdminOverride(data.keyPublic.NameAlg, authPolicy, adminData.AdminPublicKey, lockIndexName)
+		if err != nil {
+			return xerrors.Errorf("cannot compute admin override authorization policy: %w", err)
+		}
+	}
+
+	template := makeSealedKeyTemplate()
+	template.NameAlg = data.keyPublic.NameAlg
+	template.AuthPolicy = authPolicy
+
+	priv, pub, creationData, _, creationTicket, err :=
+		tpm.Create(srk, &tpm2.SensitiveCreate{Data: key}, template, policyUpdateData.creationInfo, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+	if err != nil {
+		return xerrors.Errorf("cannot create sealed data object for key: %w", err)
+	}
+
+	// The new PIN NV index has no previous dynamic authorization policies to revoke.
+	policyData, err := computeSealedKeyDynamicAuthPolicy(tpm.TPMContext, data.policyVersion(), template.NameAlg, authPublicKey.NameAlg,
+		authKey, rand.Reader, pinIndexPub, pinIndexAuthPolicies, makePCRProtectionProfileFromValues(values), false, nil, nil, session)
+	if err != nil {
+		return xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+	if err := verifyDynamicPolicyAuthorization(tpm.TPMContext, staticPolicyData, policyData, session); err != nil {
+		return xerrors.Errorf("cannot verify new dynamic authorization policy: %w", err)
+	}
+
+	newData := *data
+	newData.keyPrivate = priv
+	newData.keyPublic = pub
+	newData.staticPolicyData = staticPolicyData
+	newData.dynamicPolicyData = policyData
+	newData.pcrGracePeriodExpiry = 0
+	newData.pcrGracePeriodDigests = nil
+	newData.adminPolicyData = adminData
+	if len(newData.pcrBranchValues) > 0 {
+		newData.pcrBranchValues = encodePCRBranchValues(policyData.PCRSelection, values)
+	}
+
+	newPolicyUpdateData := *policyUpdateData
+	newPolicyUpdateData.creationData = creationData
+	newPolicyUpdateData.creationTicket = creationTicket
+
+	// Atomically update the key files. If the private data file can't be updated, restore the original key data file so that both
+	// files continue to refer to the existing PIN NV index.
+	if err := newData.writeToFileAtomic(keyPath); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+	if err := newPolicyUpdateData.writeToFileAtomic(policyUpdatePath); err != nil {
+		if err2 := data.writeToFileAtomic(keyPath); err2 != nil {
+			// The new key data file refers to the new PIN NV index, so don't undefine it.
+			succeeded = true
+			return xerrors.Errorf("cannot restore original key data file (%v) after failing to write private data file: %w", err2, err)
+		}
+		return xerrors.Errorf("cannot write private data file: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
@@ -0,0 +1,144 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// BulkSealRequest describes a single key to be sealed by SealKeysToTPM.
+type BulkSealRequest struct {
+	Key              []byte      // The disk encryption key to seal
+	KeyPath          string      // The path at which to create the sealed key data file
+	PolicyUpdatePath string      // The path at which to create the policy update data file, or empty if one isn't required
+	PINHandle        tpm2.Handle // The handle at which to create the PIN NV index for this key
+}
+
+// BulkSealResult contains the results of SealKeysToTPM.
+type BulkSealResult struct {
+	// Errors contains an entry for each request, in the same order as the requests. An entry is nil if the corresponding key was
+	// sealed successfully.
+	Errors []error
+
+	Sealed  int           // The number of keys that were sealed successfully
+	Elapsed time.Duration // The total time taken, including the time taken to compute the PCR policy
+}
+
+// KeysPerSecond returns the number of keys that were sealed successfully per second.
+func (r *BulkSealResult) KeysPerSecond() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Sealed) / r.Elapsed.Seconds()
+}
+
+// SealKeysToTPM seals each of the keys described by requests to the storage hierarchy of the TPM, in the same way as SealKeyToTPM.
+// This is intended for provisioning a large number of keys that are protected by the same PCR profile, such as when building
+// images. The PCR selection and approved PCR digests are computed from the PCR profiles in params once and shared between all of
+// the keys, so a profile that contains predicted PCR values is only evaluated once. Each key still has its own sealed key object,
+// PIN NV index and key for signing authorization policy updates, and so the remainder of the authorization policy is computed for
+// each key.
+//
+// The PINHandle field of params is ignored, and the PIN NV index for each key is created at the handle specified by the PINHandle
+// field of the corresponding request. Each request must specify a different handle. The remaining fields of params apply to all of
+// the keys. Fields that would create or share NV indices that can't be shared between keys are not supported, and an error will be
+// returned if the ExistingPINIndex, NetworkSecretIndexHandle or SingleUseIndexHandle fields are set. The
+// AllowIncrementalPCRPolicyUpdates field is also not supported.
+//
+// A failure to seal one key doesn't prevent the remaining keys from being sealed. Any files or NV indices created for a key that
+// fails are removed, and the error is recorded in the Errors field of the returned result at the same index as the request. The
+// returned result also records the number of keys sealed successfully and the time taken, so that the throughput can be reported.
+// An error is only returned if the PCR policy cannot be computed, in which case no keys are sealed.
+func SealKeysToTPM(tpm *TPMConnection, requests []*BulkSealRequest, params *KeyCreationParams) (*BulkSealResult, error) {
+	// params is mandatory.
+	if params == nil {
+		return nil, errors.New("no KeyCreationParams provided")
+	}
+	switch {
+	case params.ExistingPINIndex != nil:
+		return nil, errors.New("cannot share an existing PIN NV index when sealing keys in bulk")
+	case params.NetworkSecretIndexHandle != 0:
+		return nil, errors.New("cannot create a network secret NV index when sealing keys in bulk")
+	case params.SingleUseIndexHandle != 0:
+		return nil, errors.New("cannot create a single use NV index when sealing keys in bulk")
+	case params.AllowIncrementalPCRPolicyUpdates:
+		return nil, errors.New("cannot allow incremental PCR policy updates when sealing keys in bulk")
+	}
+
+	start := time.Now()
+
+	nameAlg := params.NameAlg
+	if nameAlg == 0 {
+		nameAlg = tpm2.HashAlgorithmSHA256
+	}
+	if !isSupportedNameAlg(nameAlg) {
+		return nil, fmt.Errorf("unsupported name algorithm %v", nameAlg)
+	}
+
+	// Compute the PCR policy once for all keys.
+	pcrProfile := params.PCRProfile
+	if params.RecoveryPCRProfile != nil {
+		normalProfile := pcrProfile
+		if normalProfile == nil {
+			normalProfile = &PCRProtectionProfile{}
+		}
+		var err error
+		pcrProfile, err = NewNormalAndRecoveryPCRProtectionProfile(normalProfile, params.RecoveryPCRProfile, newPCRSourceFromTPMContext(tpm.TPMContext))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot combine normal and recovery PCR profiles: %w", err)
+		}
+	}
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+	pcrs, pcrDigests, err := computePCRPolicyDigests(tpm.TPMContext, nameAlg, pcrProfile, tpm.HmacSession())
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR policy: %w", err)
+	}
+	pcrPolicy := &pcrPolicyDigests{pcrs: pcrs, digests: pcrDigests}
+
+	result := &BulkSealResult{Errors: make([]error, len(requests))}
+	for i, r := range requests {
+		if r == nil {
+			result.Errors[i] = errors.New("nil request")
+			continue
+		}
+
+		keyParams := *params
+		keyParams.PCRProfile = pcrProfile
+		keyParams.RecoveryPCRProfile = nil
+		keyParams.PINHandle = r.PINHandle
+
+		if err := sealKeyToTPM(tpm, r.Key, r.KeyPath, r.PolicyUpdatePath, &keyParams, pcrPolicy); err != nil {
+			result.Errors[i] = err
+			continue
+		}
+		result.Sealed++
+	}
+
+	result.Elapsed = time.Since(start)
+	return result, nil
+}
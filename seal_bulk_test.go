@@ -0,0 +1,140 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestSealKeysToTPM(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeysToTPM_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var requests []*BulkSealRequest
+	for i, handle := range []tpm2.Handle{0x01810000, 0x81000000, 0x01810001} {
+		key := make([]byte, 64)
+		rand.Read(key)
+		requests = append(requests, &BulkSealRequest{
+			Key:              key,
+			KeyPath:          filepath.Join(tmpDir, "keydata"+string(rune('0'+i))),
+			PolicyUpdatePath: filepath.Join(tmpDir, "keypolicyupdatedata"+string(rune('0'+i))),
+			PINHandle:        handle})
+	}
+
+	result, err := SealKeysToTPM(tpm, requests, &KeyCreationParams{PCRProfile: getTestPCRProfile()})
+	if err != nil {
+		t.Fatalf("SealKeysToTPM failed: %v", err)
+	}
+	for _, i := range []int{0, 2} {
+		if result.Errors[i] == nil {
+			defer undefineKeyNVSpace(t, tpm, requests[i].KeyPath)
+		}
+	}
+
+	if len(result.Errors) != len(requests) {
+		t.Fatalf("Unexpected number of results")
+	}
+	if result.Sealed != 2 {
+		t.Errorf("Unexpected number of sealed keys: %d", result.Sealed)
+	}
+	if result.Elapsed <= 0 || result.KeysPerSecond() <= 0 {
+		t.Errorf("Unexpected throughput")
+	}
+
+	// The request with the invalid PIN NV index handle should fail without aborting the others.
+	if result.Errors[1] == nil || result.Errors[1].Error() != "invalid PIN NV index handle" {
+		t.Errorf("Unexpected error: %v", result.Errors[1])
+	}
+	if _, err := os.Stat(requests[1].KeyPath); !os.IsNotExist(err) {
+		t.Errorf("Key data file should not exist for a failed request")
+	}
+
+	for _, i := range []int{0, 2} {
+		if result.Errors[i] != nil {
+			t.Errorf("Request %d failed: %v", i, result.Errors[i])
+			continue
+		}
+		if err := ValidateKeyDataFile(tpm.TPMContext, requests[i].KeyPath, requests[i].PolicyUpdatePath, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
+		}
+		k, err := ReadSealedKeyObject(requests[i].KeyPath)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		key, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, requests[i].Key) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+}
+
+func TestSealKeysToTPMUnsupportedParams(t *testing.T) {
+	for _, data := range []struct {
+		desc   string
+		params *KeyCreationParams
+		err    string
+	}{
+		{desc: "NoParams", err: "no KeyCreationParams provided"},
+		{
+			desc:   "ExistingPINIndex",
+			params: &KeyCreationParams{ExistingPINIndex: &ExistingPINIndexParams{}},
+			err:    "cannot share an existing PIN NV index when sealing keys in bulk",
+		},
+		{
+			desc:   "SingleUseIndex",
+			params: &KeyCreationParams{SingleUseIndexHandle: 0x01810010},
+			err:    "cannot create a single use NV index when sealing keys in bulk",
+		},
+		{
+			desc:   "IncrementalPCRPolicyUpdates",
+			params: &KeyCreationParams{AllowIncrementalPCRPolicyUpdates: true},
+			err:    "cannot allow incremental PCR policy updates when sealing keys in bulk",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			_, err := SealKeysToTPM(nil, nil, data.params)
+			if err == nil || err.Error() != data.err {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -21,11 +21,16 @@ package secboot_test
 
 import (
 	"bytes"
+	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/canonical/go-tpm2"
 	. "github.com/snapcore/secboot"
@@ -42,7 +47,7 @@ func TestSealKeyToTPM(t *testing.T) {
 		tpm := openTPMForTesting(t)
 		defer closeTPM(t, tpm)
 
-		if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+		if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 			t.Errorf("Failed to provision TPM for test: %v", err)
 		}
 	}()
@@ -95,7 +100,7 @@ func TestSealKeyToTPM(t *testing.T) {
 		// SealKeyToTPM behaves slightly different if called immediately after ProvisionTPM with the same TPMConnection
 		tpm := openTPMForTesting(t)
 		defer closeTPM(t, tpm)
-		if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+		if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 			t.Errorf("Failed to provision TPM for test: %v", err)
 		}
 		run(t, tpm, true, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
@@ -123,203 +128,1501 @@ func TestSealKeyToTPM(t *testing.T) {
 	})
 }
 
+func TestKeyCreationParamsValidate(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		params   KeyCreationParams
+		problems []string
+	}{
+		{
+			desc:   "Valid",
+			params: KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000},
+		},
+		{
+			desc: "ValidWithExistingPINIndex",
+			params: KeyCreationParams{
+				PCRProfile:       getTestPCRProfile(),
+				ExistingPINIndex: &ExistingPINIndexParams{KeyPath: "foo", PolicyUpdatePath: "bar"}},
+		},
+		{
+			desc:     "InvalidPINHandle",
+			params:   KeyCreationParams{PINHandle: 0x81000000},
+			problems: []string{"invalid PIN NV index handle"},
+		},
+		{
+			desc: "InvalidPCRProfile",
+			params: KeyCreationParams{
+				PCRProfile: NewPCRProtectionProfile().AddProfileOR(
+					NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 24),
+					NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7)),
+				RecoveryPCRProfile: NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, -1),
+				PINHandle:          0x01810000},
+			problems: []string{"PCR profile contains invalid PCR index 24", "PCR profile contains invalid PCR index -1"},
+		},
+		{
+			desc: "MultipleProblems",
+			params: KeyCreationParams{
+				PINHandle:                0x01810000,
+				Label:                    "foo\n",
+				NameAlg:                  tpm2.HashAlgorithmSHA1,
+				NetworkSecretIndexHandle: 0x01810000,
+				SingleUseIndexHandle:     0x81000000},
+			problems: []string{
+				"invalid label: label contains control characters",
+				"unsupported name algorithm TPM_ALG_SHA1",
+				"no network secret provided",
+				"invalid single use NV index handle",
+				"NV index handle 0x01810000 is specified more than once"},
+		},
+		{
+			desc: "ConflictingPINIndexOptions",
+			params: KeyCreationParams{
+				ExistingPINIndex:      &ExistingPINIndexParams{KeyPath: "foo", PolicyUpdatePath: "bar"},
+				ForceRecreatePINIndex: true,
+				PlatformPINIndex:      true,
+				NetworkSecret:         []byte("secret")},
+			problems: []string{
+				"cannot recreate the PIN NV index when sharing an existing PIN NV index",
+				"cannot create the PIN NV index in the platform hierarchy when sharing an existing PIN NV index",
+				"network secret provided without a network secret NV index handle"},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			err := data.params.Validate()
+			if len(data.problems) == 0 {
+				if err != nil {
+					t.Errorf("Validate failed: %v", err)
+				}
+				return
+			}
+			e, ok := err.(InvalidKeyCreationParamsError)
+			if !ok {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(e.Problems, data.problems) {
+				t.Errorf("Unexpected problems: %q", e.Problems)
+			}
+		})
+	}
+}
+
+func TestSealKeyToTPMWithPCRDigests(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithPCRDigests_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pcrs := tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}
+	_, values, err := tpm.PCRRead(pcrs)
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	digest, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, pcrs, values)
+
+	profile, err := NewPCRProtectionProfileFromDigests(tpm2.HashAlgorithmSHA256, []PCRDigestEntry{
+		{Selection: pcrs, Digest: hex.EncodeToString(make([]byte, 32))},
+		{Selection: pcrs, Digest: hex.EncodeToString(digest)}})
+	if err != nil {
+		t.Fatalf("NewPCRProtectionProfileFromDigests failed: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := tmpDir + "/keydata"
+	if err := SealKeyToTPM(tpm, key, keyFile, tmpDir+"/keypolicyupdatedata", &KeyCreationParams{PCRProfile: profile, PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), []byte("foo"), nil); err != nil {
+		t.Fatalf("PCREvent failed: %v", err)
+	}
+	if _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+		t.Errorf("UnsealFromTPM should have failed")
+	}
+}
+
+func TestSealKeyToTPMWithExistingPINIndex(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithExistingPINIndex_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key1 := make([]byte, 64)
+	rand.Read(key1)
+	key2 := make([]byte, 64)
+	rand.Read(key2)
+
+	keyFile1 := tmpDir + "/keydata1"
+	policyUpdateFile1 := tmpDir + "/keypolicyupdatedata1"
+	keyFile2 := tmpDir + "/keydata2"
+	policyUpdateFile2 := tmpDir + "/keypolicyupdatedata2"
+
+	if err := SealKeyToTPM(tpm, key1, keyFile1, policyUpdateFile1, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile1)
+
+	if err := SealKeyToTPM(tpm, key2, keyFile2, policyUpdateFile2, &KeyCreationParams{
+		PCRProfile:       getTestPCRProfile(),
+		ExistingPINIndex: &ExistingPINIndexParams{KeyPath: keyFile1, PolicyUpdatePath: policyUpdateFile1}}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	for _, f := range [][]string{{keyFile1, policyUpdateFile1}, {keyFile2, policyUpdateFile2}} {
+		if err := ValidateKeyDataFile(tpm.TPMContext, f[0], f[1], tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
+		}
+	}
+
+	k1, err := ReadSealedKeyObject(keyFile1)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	k2, err := ReadSealedKeyObject(keyFile2)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k1.PINIndexHandle() != k2.PINIndexHandle() {
+		t.Errorf("Sealed key objects should share a PIN NV index")
+	}
+
+	// Both keys should still be unsealable, as sealing the second key shouldn't revoke the policy for the first key.
+	for _, d := range []struct {
+		k   *SealedKeyObject
+		key []byte
+	}{{k1, key1}, {k2, key2}} {
+		keyUnsealed, err := d.k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(d.key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+}
+
+func TestSealKeyToTPMWithLabel(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithLabel_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	label := "8a8d5a3c-4a3b-4f5e-9c1e-2a4c7a4f3b21"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, Label: label}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	// The label should be preserved when the PCR protection policy is updated.
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.Label() != label {
+		t.Errorf("Unexpected label: %s", k.Label())
+	}
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+type countingRandReader struct {
+	n int
+}
+
+func (r *countingRandReader) Read(p []byte) (int, error) {
+	n, err := testRandReader.Read(p)
+	r.n += n
+	return n, err
+}
+
+type failingRandReader struct{}
+
+func (r failingRandReader) Read(p []byte) (int, error) {
+	return 0, errors.New("no randomness")
+}
+
+func TestSealKeyToTPMWithRandReader(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithRandReader_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	t.Run("Used", func(t *testing.T) {
+		keyFile := tmpDir + "/keydata"
+		policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+		var random countingRandReader
+		if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000,
+			RandReader: &random}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if random.n == 0 {
+			t.Errorf("SealKeyToTPM didn't use the supplied source of randomness")
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		err := SealKeyToTPM(tpm, key, tmpDir+"/keydata2", tmpDir+"/keypolicyupdatedata2", &KeyCreationParams{PCRProfile: getTestPCRProfile(),
+			PINHandle: 0x01810001, RandReader: failingRandReader{}})
+		if err == nil {
+			t.Fatalf("SealKeyToTPM should have failed")
+		}
+		if !strings.HasPrefix(err.Error(), "cannot generate RSA key pair for signing dynamic authorization policies: ") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestSealKeyToTPMWithPlatformPINIndex(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithPlatformPINIndex_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, PlatformPINIndex: true}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(0x01810000)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	defer undefineNVSpace(t, tpm, index, tpm.PlatformHandleContext())
+
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		t.Fatalf("NVReadPublic failed: %v", err)
+	}
+	if pub.Attrs&tpm2.AttrNVPlatformCreate == 0 {
+		t.Errorf("PIN NV index was not created in the platform hierarchy")
+	}
+
+	// The index should not be removable with the owner authorization.
+	if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err == nil {
+		t.Errorf("NVUndefineSpace with the owner hierarchy should have failed")
+	}
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := tpm.VerifyPINIndex(k); err != nil {
+		t.Errorf("VerifyPINIndex failed: %v", err)
+	}
+
+	// Revoking old policies requires the index to still be writable after initialization.
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, getTestPCRProfile()); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+// testSealKeyToTPMWithNameAlg seals a key with a SHA-384 name algorithm and the supplied PCR profile, and checks that it can be
+// unsealed. If checkUnseal is not nil, it is called with the sealed key object before the PIN NV index is undefined.
+func testSealKeyToTPMWithNameAlg(t *testing.T, tpm *TPMConnection, pcrProfile *PCRProtectionProfile, checkUnseal func(*SealedKeyObject)) {
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_testSealKeyToTPMWithNameAlg_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: pcrProfile, PINHandle: 0x01810000, NameAlg: tpm2.HashAlgorithmSHA384}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	index, err := tpm.CreateResourceContextFromTPM(0x01810000)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		t.Fatalf("NVReadPublic failed: %v", err)
+	}
+	if pub.NameAlg != tpm2.HashAlgorithmSHA384 {
+		t.Errorf("Unexpected PIN NV index name algorithm: %v", pub.NameAlg)
+	}
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if err := tpm.VerifyPINIndex(k); err != nil {
+		t.Errorf("VerifyPINIndex failed: %v", err)
+	}
+
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, pcrProfile); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+
+	testPIN := "1234"
+	if err := ChangePIN(tpm, keyFile, "", testPIN); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	keyUnsealed, err := k.UnsealFromTPM(tpm, testPIN)
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	if checkUnseal != nil {
+		checkUnseal(k)
+	}
+}
+
+func TestSealKeyToTPMWithNameAlg(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	testSealKeyToTPMWithNameAlg(t, tpm, getTestPCRProfile(), nil)
+}
+
+func TestSealKeyToTPMWithSHA384Policy(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	pcrs, err := tpm.GetCapabilityPCRs(nil)
+	if err != nil {
+		t.Fatalf("GetCapabilityPCRs failed: %v", err)
+	}
+	hasSHA384Bank := false
+	for _, s := range pcrs {
+		if s.Hash == tpm2.HashAlgorithmSHA384 && len(s.Select) > 0 {
+			hasSHA384Bank = true
+		}
+	}
+	if !hasSHA384Bank {
+		t.Skip("the TPM doesn't have an active SHA-384 PCR bank")
+	}
+
+	resetPCR := func() {
+		if err := tpm.PCRReset(tpm.PCRHandleContext(23), nil); err != nil {
+			t.Errorf("PCRReset failed: %v", err)
+		}
+	}
+	resetPCR()
+	defer resetPCR()
+
+	pcrProfile := NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA384, 23)
+	testSealKeyToTPMWithNameAlg(t, tpm, pcrProfile, func(k *SealedKeyObject) {
+		// Extending the SHA-384 bank of PCR 23 should prevent the key from being unsealed.
+		if _, err := tpm.PCREvent(tpm.PCRHandleContext(23), []byte("foo"), nil); err != nil {
+			t.Fatalf("PCREvent failed: %v", err)
+		}
+		if _, err := k.UnsealFromTPM(tpm, "1234"); err == nil {
+			t.Errorf("UnsealFromTPM should have failed")
+		}
+	})
+}
+
+func TestSealKeyToTPMReusesExistingPINIndex(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMReusesExistingPINIndex_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	pinIndexName := func() tpm2.Name {
+		index, err := tpm.CreateResourceContextFromTPM(0x01810000)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		return index.Name()
+	}
+	origName := pinIndexName()
+
+	// Sealing again with the same files should reuse the existing PIN NV index.
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	if !bytes.Equal(pinIndexName(), origName) {
+		t.Errorf("SealKeyToTPM should have reused the existing PIN NV index")
+	}
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	// Sealing to the same handle with different files shouldn't reuse the existing PIN NV index.
+	if err := SealKeyToTPM(tpm, key, tmpDir+"/keydata2", tmpDir+"/keypolicyupdatedata2", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err == nil {
+		t.Errorf("SealKeyToTPM should have failed")
+	} else if _, ok := err.(TPMResourceExistsError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Forcing recreation shouldn't overwrite an existing key data file, and shouldn't undefine the existing PIN NV index.
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, ForceRecreatePINIndex: true}); err == nil {
+		t.Errorf("SealKeyToTPM should have failed")
+	} else if err.Error() != "cannot recreate PIN NV index: "+keyFile+" already exists" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(pinIndexName(), origName) {
+		t.Errorf("SealKeyToTPM shouldn't have recreated the PIN NV index")
+	}
+
+	// Failing to create the key data file when forcing recreation shouldn't undefine the existing PIN NV index.
+	if err := SealKeyToTPM(tpm, key, tmpDir+"/nonexistent/keydata3", tmpDir+"/keypolicyupdatedata3", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, ForceRecreatePINIndex: true}); err == nil {
+		t.Errorf("SealKeyToTPM should have failed")
+	}
+	if !bytes.Equal(pinIndexName(), origName) {
+		t.Errorf("SealKeyToTPM shouldn't have recreated the PIN NV index")
+	}
+
+	// Forcing recreation should create a new PIN NV index.
+	if err := SealKeyToTPM(tpm, key, tmpDir+"/keydata3", tmpDir+"/keypolicyupdatedata3", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, ForceRecreatePINIndex: true}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	if bytes.Equal(pinIndexName(), origName) {
+		t.Errorf("SealKeyToTPM should have recreated the PIN NV index")
+	}
+}
+
+func TestSealKeyToTPMWithEmptyPCRProfile(t *testing.T) {
+	run := func(t *testing.T, profile *PCRProtectionProfile) {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+
+		if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+			t.Errorf("Failed to provision TPM for test: %v", err)
+		}
+
+		key := make([]byte, 64)
+		rand.Read(key)
+
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithEmptyPCRProfile_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := tmpDir + "/keydata"
+		policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+		if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: profile, PINHandle: 0x01810000}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
+		}
+
+		for _, pcr := range []int{0, 4, 7, 12, 23} {
+			if _, err := tpm.PCREvent(tpm.PCRHandleContext(pcr), tpm2.Event("foo"), nil); err != nil {
+				t.Errorf("PCREvent failed: %v", err)
+			}
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		run(t, NewPCRProtectionProfile())
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		run(t, nil)
+	})
+}
+
+func TestProvisionAndSeal(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestProvisionAndSeal_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	isDefined := func(handle tpm2.Handle) bool {
+		_, err := tpm.CreateResourceContextFromTPM(handle)
+		return err == nil
+	}
+
+	t.Run("Failure", func(t *testing.T) {
+		clearTPMWithPlatformAuth(t, tpm)
+
+		// Sealing will fail because the destination directory doesn't exist.
+		keyFile := tmpDir + "/missing/keydata"
+		policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+		err := ProvisionAndSeal(tpm, ProvisionModeFull, nil, true, nil, key, keyFile, policyUpdateFile,
+			&KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
+		if err == nil {
+			t.Fatalf("ProvisionAndSeal should have failed")
+		}
+
+		if isDefined(LockNVHandle) || isDefined(LockNVDataHandle) {
+			t.Errorf("The lock NV indices should have been removed")
+		}
+		if isDefined(0x01810000) {
+			t.Errorf("The PIN NV index should have been removed")
+		}
+		if !isDefined(SrkHandle) || !isDefined(EkHandle) {
+			t.Errorf("The SRK and EK should have been retained")
+		}
+		if _, err := os.Stat(policyUpdateFile); !os.IsNotExist(err) {
+			t.Errorf("The policy update data file should have been removed")
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		clearTPMWithPlatformAuth(t, tpm)
+
+		keyFile := tmpDir + "/keydata"
+		policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+		if err := ProvisionAndSeal(tpm, ProvisionModeFull, nil, true, nil, key, keyFile, policyUpdateFile,
+			&KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+			t.Fatalf("ProvisionAndSeal failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	})
+}
+
 func TestSealKeyToTPMErrorHandling(t *testing.T) {
 	tpm := openTPMForTesting(t)
 	defer closeTPM(t, tpm)
 
-	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	run := func(t *testing.T, tmpDir string, params *KeyCreationParams) error {
+		if tmpDir == "" {
+			var err error
+			tmpDir, err = ioutil.TempDir("", "_TestSealKeyToTPMErrors_")
+			if err != nil {
+				t.Fatalf("Creating temporary directory failed: %v", err)
+			}
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := tmpDir + "/keydata"
+		policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+		origKeyFileInfo, _ := os.Stat(keyFile)
+		origPolicyUpdateFileInfo, _ := os.Stat(policyUpdateFile)
+		var pinIndex tpm2.ResourceContext
+		if params != nil {
+			pinIndex, _ = tpm.CreateResourceContextFromTPM(params.PINHandle)
+		}
+
+		err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, params)
+
+		if fi, err := os.Stat(keyFile); err == nil && (origKeyFileInfo == nil || origKeyFileInfo.ModTime() != fi.ModTime()) {
+			t.Errorf("SealKeyToTPM created a key file")
+		}
+		if fi, err := os.Stat(policyUpdateFile); err == nil && (origPolicyUpdateFileInfo == nil || origPolicyUpdateFileInfo.ModTime() != fi.ModTime()) {
+			t.Errorf("SealKeyToTPM created a key file")
+		}
+		if params != nil {
+			if index, err := tpm.CreateResourceContextFromTPM(params.PINHandle); err == nil && (pinIndex == nil || !bytes.Equal(pinIndex.Name(), index.Name())) {
+				t.Errorf("SealKeyToTPM created a PIN NV index")
+			}
+		}
+		return err
+	}
+
+	t.Run("NilParams", func(t *testing.T) {
+		err := run(t, "", nil)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "no KeyCreationParams provided" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnsupportedNameAlg", func(t *testing.T) {
+		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, NameAlg: tpm2.HashAlgorithmSHA1})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "unsupported name algorithm TPM_ALG_SHA1" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("OwnerAuthFail", func(t *testing.T) {
+		setHierarchyAuthForTest(t, tpm, tpm.OwnerHandleContext())
+		tpm.OwnerHandleContext().SetAuthValue(nil)
+
+		defer func() {
+			tpm.OwnerHandleContext().SetAuthValue(testAuth)
+			resetHierarchyAuth(t, tpm, tpm.OwnerHandleContext())
+		}()
+
+		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
+		if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleOwner {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Provisioning/1", func(t *testing.T) {
+		index, err := tpm.CreateResourceContextFromTPM(LockNVHandle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
+			t.Errorf("NVUndefineSpace failed: %v", err)
+		}
+		defer func() {
+			index, err := tpm.CreateResourceContextFromTPM(LockNVDataHandle)
+			if err != nil {
+				t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+			}
+			if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
+				t.Errorf("NVUndefineSpace failed: %v", err)
+			}
+			if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+				t.Errorf("Failed to re-provision TPM after test: %v", err)
+			}
+		}()
+		if err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != ErrTPMProvisioning {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Provisioning/2", func(t *testing.T) {
+		index, err := tpm.CreateResourceContextFromTPM(LockNVDataHandle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
+			t.Errorf("NVUndefineSpace failed: %v", err)
+		}
+		defer func() {
+			index, err := tpm.CreateResourceContextFromTPM(LockNVHandle)
+			if err != nil {
+				t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+			}
+			if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
+				t.Errorf("NVUndefineSpace failed: %v", err)
+			}
+			if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+				t.Errorf("Failed to re-provision TPM after test: %v", err)
+			}
+		}()
+		if err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != ErrTPMProvisioning {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("FileExists/1", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMErrors_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		f, err := os.OpenFile(tmpDir+"/keydata", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		defer f.Close()
+		err = run(t, tmpDir, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
+		var e *os.PathError
+		if !xerrors.As(err, &e) || e.Path != tmpDir+"/keydata" || e.Err != syscall.EEXIST {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("FileExists/2", func(t *testing.T) {
+		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMErrors_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		f, err := os.OpenFile(tmpDir+"/keypolicyupdatedata", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			t.Fatalf("OpenFile failed: %v", err)
+		}
+		defer f.Close()
+		err = run(t, tmpDir, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
+		var e *os.PathError
+		if !xerrors.As(err, &e) || e.Path != tmpDir+"/keypolicyupdatedata" || e.Err != syscall.EEXIST {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("PinNVIndexExists", func(t *testing.T) {
+		public := tpm2.NVPublic{
+			Index:   0x0181ffff,
+			NameAlg: tpm2.HashAlgorithmSHA256,
+			Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+			Size:    0}
+		index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+		if err != nil {
+			t.Fatalf("NVDefineSpace failed: %v", err)
+		}
+		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+		err = run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: public.Index})
+		if e, ok := err.(TPMResourceExistsError); !ok || e.Handle != public.Index {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidPCRProfile", func(t *testing.T) {
+		pcrProfile := NewPCRProtectionProfile().
+			AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
+			AddProfileOR(
+				NewPCRProtectionProfile(),
+				NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 8))
+		err := run(t, "", &KeyCreationParams{PCRProfile: pcrProfile, PINHandle: 0x01810000})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "cannot compute dynamic authorization policy: cannot compute PCR digests from protection profile: not all "+
+			"branches contain values for the same sets of PCRs" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("LabelTooLong", func(t *testing.T) {
+		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, Label: strings.Repeat("a", MaxKeyLabelLength+1)})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "invalid label: label is too long (maximum length is 128 bytes)" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("LabelWithControlCharacters", func(t *testing.T) {
+		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, Label: "foo\nbar"})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "invalid label: label contains control characters" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("InvalidPCRProfileSelection", func(t *testing.T) {
+		pcrProfile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 50, make([]byte, tpm2.HashAlgorithmSHA256.Size()))
+		err := run(t, "", &KeyCreationParams{PCRProfile: pcrProfile, PINHandle: 0x01810000})
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "cannot compute dynamic authorization policy: PCR protection profile contains digests for unsupported PCRs" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestRotateSRK(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestRotateSRK_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	origKey, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	origSrkName, err := tpm.StorageRootKeyName()
+	if err != nil {
+		t.Fatalf("StorageRootKeyName failed: %v", err)
+	}
+
+	if err := RotateSRK(tpm, []*SRKRotationKeyParams{{KeyPath: keyFile, PolicyUpdatePath: policyUpdateFile}}); err != nil {
+		t.Fatalf("RotateSRK failed: %v", err)
+	}
+
+	srkName, err := tpm.StorageRootKeyName()
+	if err != nil {
+		t.Fatalf("StorageRootKeyName failed: %v", err)
+	}
+	if bytes.Equal(srkName, origSrkName) {
+		t.Errorf("RotateSRK didn't change the storage root key")
+	}
+
+	// Check that no temporary files were left behind.
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Unexpected number of files after RotateSRK (%d)", len(entries))
+	}
+
+	status, err := ProvisionStatus(tpm)
+	if err != nil {
+		t.Fatalf("ProvisionStatus failed: %v", err)
+	}
+	if status&AttrValidSRK == 0 {
+		t.Errorf("Unexpected provision status after RotateSRK: %v", status)
+	}
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.PINIndexHandle() != origKey.PINIndexHandle() {
+		t.Errorf("RotateSRK changed the PIN NV index")
+	}
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, getTestPCRProfile()); err != nil {
+		t.Errorf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+}
+
+func TestRotateSRKSingleUse(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestRotateSRKSingleUse_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:           getTestPCRProfile(),
+		PINHandle:            0x01810000,
+		SingleUseIndexHandle: 0x01810001}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	for _, handle := range []tpm2.Handle{0x01810000, 0x01810001} {
+		index, err := tpm.CreateResourceContextFromTPM(handle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}
+
+	// Rotating the SRK shouldn't consume the key.
+	if err := RotateSRK(tpm, []*SRKRotationKeyParams{{KeyPath: keyFile, PolicyUpdatePath: policyUpdateFile}}); err != nil {
+		t.Fatalf("RotateSRK failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.IsSingleUse() {
+		t.Errorf("Sealed key object should be single use")
+	}
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrSingleUseKeyConsumed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestRotateSRKUnsupportedKeys(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestRotateSRKUnsupportedKeys_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+	networkKeyFile := tmpDir + "/keydata2"
+	networkPolicyUpdateFile := tmpDir + "/keypolicyupdatedata2"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := SealKeyToTPM(tpm, key, networkKeyFile, networkPolicyUpdateFile, &KeyCreationParams{
+		PCRProfile:               getTestPCRProfile(),
+		PINHandle:                0x01810001,
+		NetworkSecretIndexHandle: 0x01810002,
+		NetworkSecret:            secret}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	for _, handle := range []tpm2.Handle{0x01810001, 0x01810002} {
+		index, err := tpm.CreateResourceContextFromTPM(handle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}
+
+	origKeyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	origSrkName, err := tpm.StorageRootKeyName()
+	if err != nil {
+		t.Fatalf("StorageRootKeyName failed: %v", err)
+	}
+
+	err = RotateSRK(tpm, []*SRKRotationKeyParams{
+		{KeyPath: keyFile, PolicyUpdatePath: policyUpdateFile},
+		{KeyPath: networkKeyFile, PolicyUpdatePath: networkPolicyUpdateFile}})
+	if err == nil {
+		t.Fatalf("RotateSRK should have failed")
+	}
+	if err.Error() != "cannot rotate the storage root key for key file "+networkKeyFile+": network-bound sealed key objects are not supported" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	srkName, err := tpm.StorageRootKeyName()
+	if err != nil {
+		t.Fatalf("StorageRootKeyName failed: %v", err)
+	}
+	if !bytes.Equal(srkName, origSrkName) {
+		t.Errorf("RotateSRK changed the storage root key")
+	}
+
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	if !bytes.Equal(keyData, origKeyData) {
+		t.Errorf("RotateSRK modified the key data file")
+	}
+	entries, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir failed: %v", err)
+	}
+	if len(entries) != 4 {
+		t.Errorf("Unexpected number of files after RotateSRK (%d)", len(entries))
+	}
+}
+
+func TestMoveKeyToNewPINIndex(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 		t.Errorf("Failed to provision TPM for test: %v", err)
 	}
 
+	tmpDir, err := ioutil.TempDir("", "_TestMoveKeyToNewPINIndex_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
 	key := make([]byte, 64)
 	rand.Read(key)
 
-	run := func(t *testing.T, tmpDir string, params *KeyCreationParams) error {
-		if tmpDir == "" {
-			var err error
-			tmpDir, err = ioutil.TempDir("", "_TestSealKeyToTPMErrors_")
-			if err != nil {
-				t.Fatalf("Creating temporary directory failed: %v", err)
-			}
-		}
-		defer os.RemoveAll(tmpDir)
-
-		keyFile := tmpDir + "/keydata"
-		policyUpdateFile := tmpDir + "/keypolicyupdatedata"
-
-		origKeyFileInfo, _ := os.Stat(keyFile)
-		origPolicyUpdateFileInfo, _ := os.Stat(policyUpdateFile)
-		var pinIndex tpm2.ResourceContext
-		if params != nil {
-			pinIndex, _ = tpm.CreateResourceContextFromTPM(params.PINHandle)
-		}
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
 
-		err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, params)
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	origIndex, err := tpm.CreateResourceContextFromTPM(0x01810000)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	defer undefineNVSpace(t, tpm, origIndex, tpm.OwnerHandleContext())
 
-		if fi, err := os.Stat(keyFile); err == nil && (origKeyFileInfo == nil || origKeyFileInfo.ModTime() != fi.ModTime()) {
-			t.Errorf("SealKeyToTPM created a key file")
-		}
-		if fi, err := os.Stat(policyUpdateFile); err == nil && (origPolicyUpdateFileInfo == nil || origPolicyUpdateFileInfo.ModTime() != fi.ModTime()) {
-			t.Errorf("SealKeyToTPM created a key file")
-		}
-		if params != nil {
-			if index, err := tpm.CreateResourceContextFromTPM(params.PINHandle); err == nil && (pinIndex == nil || !bytes.Equal(pinIndex.Name(), index.Name())) {
-				t.Errorf("SealKeyToTPM created a PIN NV index")
-			}
-		}
-		return err
+	if err := ChangePIN(tpm, keyFile, "", "1234"); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
 	}
 
-	t.Run("NilParams", func(t *testing.T) {
-		err := run(t, "", nil)
+	t.Run("ExistingIndex", func(t *testing.T) {
+		err := MoveKeyToNewPINIndex(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), 0x01810000, "1234", nil)
 		if err == nil {
-			t.Fatalf("Expected an error")
+			t.Fatalf("MoveKeyToNewPINIndex should have failed")
 		}
-		if err.Error() != "no KeyCreationParams provided" {
-			t.Errorf("Unexpected error: %v", err)
+		if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
 		}
 	})
 
-	t.Run("OwnerAuthFail", func(t *testing.T) {
-		setHierarchyAuthForTest(t, tpm, tpm.OwnerHandleContext())
-		tpm.OwnerHandleContext().SetAuthValue(nil)
-
-		defer func() {
-			tpm.OwnerHandleContext().SetAuthValue(testAuth)
-			resetHierarchyAuth(t, tpm, tpm.OwnerHandleContext())
-		}()
-
-		err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
-		if e, ok := err.(AuthFailError); !ok || e.Handle != tpm2.HandleOwner {
+	t.Run("WrongPIN", func(t *testing.T) {
+		err := MoveKeyToNewPINIndex(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), 0x01810001, "5678", nil)
+		if err != ErrPINFail {
 			t.Errorf("Unexpected error: %v", err)
 		}
-	})
+		if _, err := tpm.CreateResourceContextFromTPM(0x01810001); err == nil {
+			t.Errorf("New PIN NV index should not exist")
+		}
 
-	t.Run("Provisioning/1", func(t *testing.T) {
-		index, err := tpm.CreateResourceContextFromTPM(LockNVHandle)
+		k, err := ReadSealedKeyObject(keyFile)
 		if err != nil {
-			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
 		}
-		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
-			t.Errorf("NVUndefineSpace failed: %v", err)
+		keyUnsealed, err := k.UnsealFromTPM(tpm, "1234")
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
 		}
-		defer func() {
-			index, err := tpm.CreateResourceContextFromTPM(LockNVDataHandle)
-			if err != nil {
-				t.Errorf("CreateResourceContextFromTPM failed: %v", err)
-			}
-			if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
-				t.Errorf("NVUndefineSpace failed: %v", err)
-			}
-			if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
-				t.Errorf("Failed to re-provision TPM after test: %v", err)
-			}
-		}()
-		if err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != ErrTPMProvisioning {
-			t.Errorf("Unexpected error: %v", err)
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
 		}
 	})
 
-	t.Run("Provisioning/2", func(t *testing.T) {
-		index, err := tpm.CreateResourceContextFromTPM(LockNVDataHandle)
-		if err != nil {
-			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
-		}
-		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
-			t.Errorf("NVUndefineSpace failed: %v", err)
+	t.Run("Success", func(t *testing.T) {
+		if err := MoveKeyToNewPINIndex(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), 0x01810001, "1234", nil); err != nil {
+			t.Fatalf("MoveKeyToNewPINIndex failed: %v", err)
 		}
-		defer func() {
-			index, err := tpm.CreateResourceContextFromTPM(LockNVHandle)
-			if err != nil {
-				t.Errorf("CreateResourceContextFromTPM failed: %v", err)
-			}
-			if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, nil); err != nil {
-				t.Errorf("NVUndefineSpace failed: %v", err)
-			}
-			if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
-				t.Errorf("Failed to re-provision TPM after test: %v", err)
-			}
-		}()
-		if err := run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != ErrTPMProvisioning {
-			t.Errorf("Unexpected error: %v", err)
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+			t.Errorf("ValidateKeyDataFile failed: %v", err)
 		}
-	})
 
-	t.Run("FileExists/1", func(t *testing.T) {
-		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMErrors_")
+		k, err := ReadSealedKeyObject(keyFile)
 		if err != nil {
-			t.Fatalf("Creating temporary directory failed: %v", err)
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
 		}
-		f, err := os.OpenFile(tmpDir+"/keydata", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		if err != nil {
-			t.Fatalf("OpenFile failed: %v", err)
+		if k.PINIndexHandle() != 0x01810001 {
+			t.Errorf("Unexpected PIN NV index handle: %v", k.PINIndexHandle())
 		}
-		defer f.Close()
-		err = run(t, tmpDir, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
-		var e *os.PathError
-		if !xerrors.As(err, &e) || e.Path != tmpDir+"/keydata" || e.Err != syscall.EEXIST {
-			t.Errorf("Unexpected error: %v", err)
+		if k.AuthMode2F() != AuthModePIN {
+			t.Errorf("Unexpected auth mode: %v", k.AuthMode2F())
 		}
-	})
 
-	t.Run("FileExists/2", func(t *testing.T) {
-		tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMErrors_")
+		keyUnsealed, err := k.UnsealFromTPM(tpm, "1234")
 		if err != nil {
-			t.Fatalf("Creating temporary directory failed: %v", err)
+			t.Fatalf("UnsealFromTPM failed: %v", err)
 		}
-		f, err := os.OpenFile(tmpDir+"/keypolicyupdatedata", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-		if err != nil {
-			t.Fatalf("OpenFile failed: %v", err)
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
 		}
-		defer f.Close()
-		err = run(t, tmpDir, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000})
-		var e *os.PathError
-		if !xerrors.As(err, &e) || e.Path != tmpDir+"/keypolicyupdatedata" || e.Err != syscall.EEXIST {
-			t.Errorf("Unexpected error: %v", err)
+
+		if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, getTestPCRProfile()); err != nil {
+			t.Errorf("UpdateKeyPCRProtectionPolicy failed: %v", err)
 		}
 	})
+}
 
-	t.Run("PinNVIndexExists", func(t *testing.T) {
-		public := tpm2.NVPublic{
-			Index:   0x0181ffff,
-			NameAlg: tpm2.HashAlgorithmSHA256,
-			Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
-			Size:    0}
-		index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, nil)
+func TestMoveKeyToNewPINIndexSingleUse(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestMoveKeyToNewPINIndexSingleUse_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:           getTestPCRProfile(),
+		PINHandle:            0x01810000,
+		SingleUseIndexHandle: 0x01810001}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	for _, handle := range []tpm2.Handle{0x01810000, 0x01810001} {
+		index, err := tpm.CreateResourceContextFromTPM(handle)
 		if err != nil {
-			t.Fatalf("NVDefineSpace failed: %v", err)
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
 		}
 		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
-		err = run(t, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: public.Index})
-		if e, ok := err.(TPMResourceExistsError); !ok || e.Handle != public.Index {
-			t.Errorf("Unexpected error: %v", err)
-		}
-	})
+	}
 
-	t.Run("InvalidPCRProfile", func(t *testing.T) {
-		pcrProfile := NewPCRProtectionProfile().
-			AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7).
-			AddProfileOR(
-				NewPCRProtectionProfile(),
-				NewPCRProtectionProfile().AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 8))
-		err := run(t, "", &KeyCreationParams{PCRProfile: pcrProfile, PINHandle: 0x01810000})
-		if err == nil {
-			t.Fatalf("Expected an error")
-		}
-		if err.Error() != "cannot compute dynamic authorization policy: cannot compute PCR digests from protection profile: not all "+
-			"branches contain values for the same sets of PCRs" {
-			t.Errorf("Unexpected error: %v", err)
+	// Moving the key shouldn't consume it.
+	if err := MoveKeyToNewPINIndex(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), 0x01810002, "", nil); err != nil {
+		t.Fatalf("MoveKeyToNewPINIndex failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.IsSingleUse() {
+		t.Errorf("Sealed key object should be single use")
+	}
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrSingleUseKeyConsumed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestMoveKeyToNewPINIndexNetworkBound(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestMoveKeyToNewPINIndexNetworkBound_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:               getTestPCRProfile(),
+		PINHandle:                0x01810000,
+		NetworkSecretIndexHandle: 0x01810001,
+		NetworkSecret:            secret}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	for _, handle := range []tpm2.Handle{0x01810000, 0x01810001} {
+		index, err := tpm.CreateResourceContextFromTPM(handle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
 		}
-	})
+		defer undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}
 
-	t.Run("InvalidPCRProfileSelection", func(t *testing.T) {
-		pcrProfile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 50, make([]byte, tpm2.HashAlgorithmSHA256.Size()))
-		err := run(t, "", &KeyCreationParams{PCRProfile: pcrProfile, PINHandle: 0x01810000})
-		if err == nil {
-			t.Fatalf("Expected an error")
+	if err := MoveKeyToNewPINIndex(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), 0x01810002, "", nil); err != ErrNetworkSecretRequired {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := MoveKeyToNewPINIndex(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), 0x01810002, "", secret); err != nil {
+		t.Fatalf("MoveKeyToNewPINIndex failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.IsNetworkBound() {
+		t.Errorf("Sealed key object should be network-bound")
+	}
+
+	keyUnsealed, err := k.UnsealFromTPMWithNetworkSecret(tpm, "", secret)
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithNetworkSecret failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestNeedsReseal(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestNeedsReseal_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	profile1 := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "foo"))
+	profile2 := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, "bar"))
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: profile1, PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	check := func(t *testing.T, profile *PCRProtectionProfile, expected bool) {
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
 		}
-		if err.Error() != "cannot compute dynamic authorization policy: PCR protection profile contains digests for unsupported PCRs" {
-			t.Errorf("Unexpected error: %v", err)
+		needsReseal, err := tpm.NeedsReseal(k, profile)
+		if err != nil {
+			t.Fatalf("NeedsReseal failed: %v", err)
 		}
-	})
+		if needsReseal != expected {
+			t.Errorf("NeedsReseal returned the wrong result")
+		}
+	}
+
+	check(t, profile1, false)
+	check(t, profile2, true)
+	check(t, nil, true)
+
+	if err := UpdateKeyPCRProtectionPolicy(tpm, keyFile, policyUpdateFile, profile2); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicy failed: %v", err)
+	}
+
+	check(t, profile1, true)
+	check(t, profile2, false)
+
+	if err := UpdateKeyPCRProtectionPolicyWithGracePeriod(tpm, keyFile, policyUpdateFile, profile2, profile1, time.Hour); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicyWithGracePeriod failed: %v", err)
+	}
+
+	check(t, profile1, false)
+	check(t, profile2, true)
 }
@@ -0,0 +1,80 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// SecretBuffer wraps sensitive data such as an unsealed key, and provides a way to securely zero it once it is no longer required.
+// Where possible, the memory backing the buffer is locked with mlock(2) for the lifetime of the buffer in order to prevent it from
+// being written to swap.
+//
+// Note that this only reduces the window in which the data is present in reclaimable memory. The Go runtime may have made copies of
+// the data that this type doesn't know about (eg, when the data was decoded from a TPM response, or if the caller copies the slice
+// returned from Bytes), and these copies are not zeroed by Destroy.
+type SecretBuffer struct {
+	data   []byte
+	locked bool
+}
+
+// NewSecretBuffer returns a new SecretBuffer that takes ownership of the supplied data. The caller should not retain any other
+// reference to data, and should call Destroy once the data is no longer required.
+func NewSecretBuffer(data []byte) *SecretBuffer {
+	b := &SecretBuffer{data: data}
+	if len(data) > 0 {
+		// Locking the memory is best effort - it may fail if RLIMIT_MEMLOCK is too low.
+		b.locked = unix.Mlock(data) == nil
+	}
+	runtime.SetFinalizer(b, (*SecretBuffer).Destroy)
+	return b
+}
+
+// Bytes returns the data wrapped by this buffer. The returned slice aliases the memory owned by the buffer, and is only valid until
+// Destroy is called.
+func (b *SecretBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Len returns the length of the data wrapped by this buffer.
+func (b *SecretBuffer) Len() int {
+	return len(b.data)
+}
+
+// Destroy zeroes the data wrapped by this buffer and unlocks its memory. The buffer cannot be used after this. It is safe to call
+// Destroy more than once.
+func (b *SecretBuffer) Destroy() {
+	if b.data == nil {
+		return
+	}
+	for i := range b.data {
+		b.data[i] = 0
+	}
+	if b.locked {
+		unix.Munlock(b.data)
+		b.locked = false
+	}
+	// Make sure the zeroing isn't optimized away.
+	runtime.KeepAlive(b.data)
+	b.data = nil
+	runtime.SetFinalizer(b, nil)
+}
@@ -0,0 +1,52 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestSecretBuffer(t *testing.T) {
+	data := []byte("1234567890abcdef")
+	expected := make([]byte, len(data))
+	copy(expected, data)
+
+	b := NewSecretBuffer(data)
+	if !bytes.Equal(b.Bytes(), expected) {
+		t.Errorf("Unexpected data: %x", b.Bytes())
+	}
+	if b.Len() != len(expected) {
+		t.Errorf("Unexpected length: %d", b.Len())
+	}
+
+	b.Destroy()
+	if b.Bytes() != nil {
+		t.Errorf("Bytes should return nil after Destroy")
+	}
+	if !bytes.Equal(data, make([]byte, len(data))) {
+		t.Errorf("Data was not zeroed: %x", data)
+	}
+
+	// Calling Destroy a second time should be harmless.
+	b.Destroy()
+}
@@ -705,15 +705,11 @@ func (b *secureBootPolicyGenBranch) extendFirmwareVerificationMeasurement(digest
 // omputeAndExtendVariableMeasurement computes a EFI variable measurement from the supplied arguments and extends that to
 // this branch.
 func (b *secureBootPolicyGenBranch) computeAndExtendVariableMeasurement(varName *tcglog.EFIGUID, unicodeName string, varData []byte) error {
-	data := tcglog.EFIVariableEventData{
-		VariableName: *varName,
-		UnicodeName:  unicodeName,
-		VariableData: varData}
-	h := b.gen.PCRAlgorithm.NewHash()
-	if err := data.EncodeMeasuredBytes(h); err != nil {
-		return xerrors.Errorf("cannot encode EFI_VARIABLE_DATA: %w", err)
+	digest, err := computeEFIVariableMeasurement(b.gen.PCRAlgorithm, varName, unicodeName, varData)
+	if err != nil {
+		return err
 	}
-	b.extendMeasurement(h.Sum(nil))
+	b.extendMeasurement(digest)
 	return nil
 }
 
@@ -1313,13 +1309,9 @@ func (g *secureBootPolicyGen) run(profile *PCRProtectionProfile, events []*tcglo
 // adding a single PCR digest to the provided PCRProtectionProfile.
 func AddEFISecureBootPolicyProfile(profile *PCRProtectionProfile, params *EFISecureBootPolicyProfileParams) error {
 	// Load event log
-	eventLog, err := os.Open(eventLogPath)
-	if err != nil {
-		return xerrors.Errorf("cannot open TCG event log: %w", err)
-	}
-	log, err := tcglog.NewLog(eventLog, tcglog.LogOptions{})
+	log, err := openEventLog()
 	if err != nil {
-		return xerrors.Errorf("cannot parse TCG event log header: %w", err)
+		return err
 	}
 
 	if !log.Algorithms.Contains(tcglog.AlgorithmId(params.PCRAlgorithm)) {
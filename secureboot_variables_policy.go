@@ -0,0 +1,223 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+
+	"golang.org/x/xerrors"
+)
+
+const pkName = "PK" // Unicode variable name for the EFI platform key database
+
+// EFISecureBootVariablesProfileParams provides the parameters to AddEFISecureBootVariablesProfile. The contents of each signature
+// database are supplied as a sequence of EFI_SIGNATURE_LIST structures, in the same format as the corresponding EFI variable but
+// without the 4-byte attribute field that efivarfs prepends. An empty value corresponds to a variable that doesn't exist.
+type EFISecureBootVariablesProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// SecureBootEnabled is the expected value of the SecureBoot variable.
+	SecureBootEnabled bool
+
+	// PK is the expected contents of the platform key database.
+	PK []byte
+
+	// KEK is the expected contents of the key exchange key database.
+	KEK []byte
+
+	// Db is the expected contents of the authorized signature database.
+	Db []byte
+
+	// AllowedDbx is the set of acceptable contents of the forbidden signature database. A separate PCR value is computed for each
+	// entry. At least one entry is required - use a single empty entry if dbx is expected to not exist.
+	AllowedDbx [][]byte
+
+	// Authorities is the list of DER encoded X.509 certificates in Db that are expected to be used by the firmware to verify EFI
+	// images during boot, in the order in which each is first used. Each certificate must be present in Db.
+	Authorities [][]byte
+}
+
+// computeEFIVariableMeasurement computes the digest of the EFI_VARIABLE_DATA structure measured by the firmware for the specified
+// variable.
+func computeEFIVariableMeasurement(alg tpm2.HashAlgorithmId, guid *tcglog.EFIGUID, name string, data []byte) (tpm2.Digest, error) {
+	eventData := tcglog.EFIVariableEventData{
+		VariableName: *guid,
+		UnicodeName:  name,
+		VariableData: data}
+	h := alg.NewHash()
+	if err := eventData.EncodeMeasuredBytes(h); err != nil {
+		return nil, xerrors.Errorf("cannot encode EFI_VARIABLE_DATA: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// computeEFISecureBootAuthorityMeasurements computes the digests of the EV_EFI_VARIABLE_AUTHORITY events measured by the firmware
+// when verifying EFI images with the supplied certificates, which must be present in the supplied authorized signature database.
+func computeEFISecureBootAuthorityMeasurements(alg tpm2.HashAlgorithmId, db []byte, authorities [][]byte) (tpm2.DigestList, error) {
+	if len(authorities) == 0 {
+		return nil, nil
+	}
+
+	sigs, err := decodeSecureBootDb(bytes.NewReader(db))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot decode db: %w", err)
+	}
+
+	var out tpm2.DigestList
+	for i, a := range authorities {
+		if _, err := x509.ParseCertificate(a); err != nil {
+			return nil, xerrors.Errorf("cannot parse authority %d: %w", i, err)
+		}
+
+		var authority *efiSignatureData
+		for _, sig := range sigs {
+			if sig.signatureType == *efiCertX509Guid && bytes.Equal(sig.data, a) {
+				authority = sig
+				break
+			}
+		}
+		if authority == nil {
+			return nil, fmt.Errorf("authority %d is not in db", i)
+		}
+
+		// Firmware measures the entire EFI_SIGNATURE_DATA, including the SignatureOwner.
+		varData := new(bytes.Buffer)
+		if err := authority.encode(varData); err != nil {
+			return nil, xerrors.Errorf("cannot encode EFI_SIGNATURE_DATA for authority %d: %w", i, err)
+		}
+		digest, err := computeEFIVariableMeasurement(alg, efiImageSecurityDatabaseGuid, dbName, varData.Bytes())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute measurement for authority %d: %w", i, err)
+		}
+
+		// Each authority is only measured the first time that it is used.
+		found := false
+		for _, d := range out {
+			if bytes.Equal(d, digest) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			out = append(out, digest)
+		}
+	}
+
+	return out, nil
+}
+
+// AddEFISecureBootVariablesProfile adds a profile for the secure boot policy PCR (PCR 7) to the provided PCR protection profile,
+// computed from the supplied secure boot configuration rather than by replaying the TCG event log of the current boot. This makes
+// it possible to compute a single profile that applies to every machine with the same secure boot configuration, as well as to
+// compute a profile for a configuration that isn't the current one (eg, for a pending dbx update).
+//
+// The measurements are computed as described in the "TCG PC Client Platform Firmware Profile Specification", in the following
+// order:
+//   - EV_EFI_VARIABLE_DRIVER_CONFIG events for the SecureBoot, PK, KEK, db and dbx variables.
+//   - A EV_SEPARATOR event.
+//   - A EV_EFI_VARIABLE_AUTHORITY event for each unique entry in db that is used to verify an EFI image, in the order in which they
+//     are first used.
+//
+// A separate PCR value is computed for each entry in the AllowedDbx field of params, and these are added to the provided profile
+// as alternatives with PCRProtectionProfile.AddProfileOR.
+//
+// Some firmware implementations measure additional variables before the EV_SEPARATOR event (eg, dbt, dbr, AuditMode or
+// DeployedMode), and shim measures additional EV_EFI_VARIABLE_AUTHORITY events when it verifies images. These are not supported
+// by this function, so AddEFISecureBootPolicyProfile should be used on platforms where these are measured.
+func AddEFISecureBootVariablesProfile(profile *PCRProtectionProfile, params *EFISecureBootVariablesProfileParams) error {
+	if !params.PCRAlgorithm.Supported() {
+		return fmt.Errorf("unsupported digest algorithm %v", params.PCRAlgorithm)
+	}
+	if len(params.AllowedDbx) == 0 {
+		return errors.New("no acceptable dbx contents supplied")
+	}
+
+	authorities, err := computeEFISecureBootAuthorityMeasurements(params.PCRAlgorithm, params.Db, params.Authorities)
+	if err != nil {
+		return xerrors.Errorf("cannot compute secure boot authority measurements: %w", err)
+	}
+
+	sbState := []byte{0x00}
+	if params.SecureBootEnabled {
+		sbState[0] = 0x01
+	}
+
+	separator := params.PCRAlgorithm.NewHash()
+	binary.Write(separator, binary.LittleEndian, uint32(0))
+
+	var values tpm2.DigestList
+	for i, dbx := range params.AllowedDbx {
+		value := make(tpm2.Digest, params.PCRAlgorithm.Size())
+		extend := func(digest tpm2.Digest) {
+			h := params.PCRAlgorithm.NewHash()
+			h.Write(value)
+			h.Write(digest)
+			value = h.Sum(nil)
+		}
+
+		for _, v := range []struct {
+			guid *tcglog.EFIGUID
+			name string
+			data []byte
+		}{
+			{guid: efiGlobalVariableGuid, name: sbStateName, data: sbState},
+			{guid: efiGlobalVariableGuid, name: pkName, data: params.PK},
+			{guid: efiGlobalVariableGuid, name: kekName, data: params.KEK},
+			{guid: efiImageSecurityDatabaseGuid, name: dbName, data: params.Db},
+			{guid: efiImageSecurityDatabaseGuid, name: dbxName, data: dbx},
+		} {
+			digest, err := computeEFIVariableMeasurement(params.PCRAlgorithm, v.guid, v.name, v.data)
+			if err != nil {
+				return xerrors.Errorf("cannot compute measurement of %s for dbx %d: %w", v.name, i, err)
+			}
+			extend(digest)
+		}
+
+		extend(separator.Sum(nil))
+
+		for _, digest := range authorities {
+			extend(digest)
+		}
+
+		values = append(values, value)
+	}
+
+	if len(values) == 1 {
+		profile.AddPCRValue(params.PCRAlgorithm, secureBootPCR, values[0])
+		return nil
+	}
+
+	var branches []*PCRProtectionProfile
+	for _, v := range values {
+		branches = append(branches, NewPCRProtectionProfile().AddPCRValue(params.PCRAlgorithm, secureBootPCR, v))
+	}
+	profile.AddProfileOR(branches...)
+	return nil
+}
@@ -0,0 +1,223 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/canonical/go-tpm2"
+	"github.com/chrisccoulson/tcglog-parser"
+	. "github.com/snapcore/secboot"
+)
+
+func readEFIVarForTest(t *testing.T, path string) []byte {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	// Skip over the 4-byte attribute field
+	return d[4:]
+}
+
+// encodeEFIVariableDataForTest encodes a UEFI_VARIABLE_DATA structure as measured by the firmware.
+func encodeEFIVariableDataForTest(guid *tcglog.EFIGUID, name string, data []byte) []byte {
+	unicodeName := utf16.Encode([]rune(name))
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, *guid)
+	binary.Write(buf, binary.LittleEndian, uint64(len(unicodeName)))
+	binary.Write(buf, binary.LittleEndian, uint64(len(data)))
+	binary.Write(buf, binary.LittleEndian, unicodeName)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+func TestAddEFISecureBootVariablesProfile(t *testing.T) {
+	var (
+		efiGlobalVariableGuid        = tcglog.NewEFIGUID(0x8be4df61, 0x93ca, 0x11d2, 0xaa0d, [...]uint8{0x00, 0xe0, 0x98, 0x03, 0x2b, 0x8c})
+		efiImageSecurityDatabaseGuid = tcglog.NewEFIGUID(0xd719b2cb, 0x3d3a, 0x4596, 0xa3bc, [...]uint8{0xda, 0xd0, 0x0e, 0x67, 0x65, 0x6f})
+	)
+
+	kek := readEFIVarForTest(t, "testdata/efivars1/KEK-8be4df61-93ca-11d2-aa0d-00e098032b8c")
+	db := readEFIVarForTest(t, "testdata/efivars1/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	dbx1 := readEFIVarForTest(t, "testdata/efivars1/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	dbx2 := readEFIVarForTest(t, "testdata/efivars2/dbx-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	pk := []byte("mock PK")
+
+	sigs, err := DecodeSecureBootDb(bytes.NewReader(db))
+	if err != nil {
+		t.Fatalf("DecodeSecureBootDb failed: %v", err)
+	}
+	authority := (*EFISignatureData)(sigs[0])
+	authorityData := new(bytes.Buffer)
+	binary.Write(authorityData, binary.LittleEndian, *authority.Owner())
+	authorityData.Write(authority.Data())
+
+	computeExpected := func(alg tpm2.HashAlgorithmId, sbState byte, pk, kek, db, dbx []byte, authorities int) tpm2.Digest {
+		value := make(tpm2.Digest, alg.Size())
+		extend := func(data []byte) {
+			h := alg.NewHash()
+			h.Write(data)
+			digest := h.Sum(nil)
+
+			h = alg.NewHash()
+			h.Write(value)
+			h.Write(digest)
+			value = h.Sum(nil)
+		}
+		extend(encodeEFIVariableDataForTest(efiGlobalVariableGuid, "SecureBoot", []byte{sbState}))
+		extend(encodeEFIVariableDataForTest(efiGlobalVariableGuid, "PK", pk))
+		extend(encodeEFIVariableDataForTest(efiGlobalVariableGuid, "KEK", kek))
+		extend(encodeEFIVariableDataForTest(efiImageSecurityDatabaseGuid, "db", db))
+		extend(encodeEFIVariableDataForTest(efiImageSecurityDatabaseGuid, "dbx", dbx))
+		extend(make([]byte, 4))
+		for i := 0; i < authorities; i++ {
+			extend(encodeEFIVariableDataForTest(efiImageSecurityDatabaseGuid, "db", authorityData.Bytes()))
+		}
+		return value
+	}
+
+	for _, data := range []struct {
+		desc   string
+		params *EFISecureBootVariablesProfileParams
+		values []tpm2.PCRValues
+	}{
+		{
+			desc: "SingleDbx",
+			params: &EFISecureBootVariablesProfileParams{
+				PCRAlgorithm:      tpm2.HashAlgorithmSHA256,
+				SecureBootEnabled: true,
+				PK:                pk,
+				KEK:               kek,
+				Db:                db,
+				AllowedDbx:        [][]byte{dbx1},
+				Authorities:       [][]byte{authority.Data()}},
+			values: []tpm2.PCRValues{
+				{tpm2.HashAlgorithmSHA256: {7: computeExpected(tpm2.HashAlgorithmSHA256, 0x01, pk, kek, db, dbx1, 1)}},
+			},
+		},
+		{
+			// Verify that an authority is only measured once.
+			desc: "RepeatedAuthority",
+			params: &EFISecureBootVariablesProfileParams{
+				PCRAlgorithm:      tpm2.HashAlgorithmSHA256,
+				SecureBootEnabled: true,
+				PK:                pk,
+				KEK:               kek,
+				Db:                db,
+				AllowedDbx:        [][]byte{dbx1},
+				Authorities:       [][]byte{authority.Data(), authority.Data()}},
+			values: []tpm2.PCRValues{
+				{tpm2.HashAlgorithmSHA256: {7: computeExpected(tpm2.HashAlgorithmSHA256, 0x01, pk, kek, db, dbx1, 1)}},
+			},
+		},
+		{
+			desc: "MultipleDbx",
+			params: &EFISecureBootVariablesProfileParams{
+				PCRAlgorithm:      tpm2.HashAlgorithmSHA1,
+				SecureBootEnabled: true,
+				PK:                pk,
+				KEK:               kek,
+				Db:                db,
+				AllowedDbx:        [][]byte{dbx1, dbx2, nil}},
+			values: []tpm2.PCRValues{
+				{tpm2.HashAlgorithmSHA1: {7: computeExpected(tpm2.HashAlgorithmSHA1, 0x01, pk, kek, db, dbx1, 0)}},
+				{tpm2.HashAlgorithmSHA1: {7: computeExpected(tpm2.HashAlgorithmSHA1, 0x01, pk, kek, db, dbx2, 0)}},
+				{tpm2.HashAlgorithmSHA1: {7: computeExpected(tpm2.HashAlgorithmSHA1, 0x01, pk, kek, db, nil, 0)}},
+			},
+		},
+		{
+			desc: "SecureBootDisabled",
+			params: &EFISecureBootVariablesProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				AllowedDbx:   [][]byte{nil}},
+			values: []tpm2.PCRValues{
+				{tpm2.HashAlgorithmSHA256: {7: computeExpected(tpm2.HashAlgorithmSHA256, 0x00, nil, nil, nil, nil, 0)}},
+			},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			profile := NewPCRProtectionProfile()
+			if err := AddEFISecureBootVariablesProfile(profile, data.params); err != nil {
+				t.Fatalf("AddEFISecureBootVariablesProfile failed: %v", err)
+			}
+
+			expectedPcrs := data.values[0].SelectionList()
+			var expectedDigests tpm2.DigestList
+			for _, v := range data.values {
+				d, _ := tpm2.ComputePCRDigest(data.params.PCRAlgorithm, expectedPcrs, v)
+				expectedDigests = append(expectedDigests, d)
+			}
+
+			pcrs, digests, err := profile.ComputePCRDigests(nil, data.params.PCRAlgorithm)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			if !pcrs.Equal(expectedPcrs) {
+				t.Errorf("Unexpected PCRSelectionList")
+			}
+			if !reflect.DeepEqual(digests, expectedDigests) {
+				t.Errorf("Unexpected digests")
+				t.Logf("Profile:\n%s", profile)
+			}
+		})
+	}
+}
+
+func TestAddEFISecureBootVariablesProfileErrors(t *testing.T) {
+	db := readEFIVarForTest(t, "testdata/efivars1/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	otherDb := readEFIVarForTest(t, "testdata/efivars3/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+
+	sigs, err := DecodeSecureBootDb(bytes.NewReader(otherDb))
+	if err != nil {
+		t.Fatalf("DecodeSecureBootDb failed: %v", err)
+	}
+	var otherCert []byte
+	for _, s := range sigs {
+		sig := (*EFISignatureData)(s)
+		if *sig.SignatureType() == *EFICertX509Guid && !bytes.Contains(db, sig.Data()) {
+			otherCert = sig.Data()
+		}
+	}
+	if otherCert == nil {
+		t.Fatalf("No suitable certificate for test")
+	}
+
+	t.Run("NoDbx", func(t *testing.T) {
+		err := AddEFISecureBootVariablesProfile(NewPCRProtectionProfile(), &EFISecureBootVariablesProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256, SecureBootEnabled: true, Db: db})
+		if err == nil || err.Error() != "no acceptable dbx contents supplied" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("AuthorityNotInDb", func(t *testing.T) {
+		err := AddEFISecureBootVariablesProfile(NewPCRProtectionProfile(), &EFISecureBootVariablesProfileParams{
+			PCRAlgorithm: tpm2.HashAlgorithmSHA256, SecureBootEnabled: true, Db: db, AllowedDbx: [][]byte{nil},
+			Authorities: [][]byte{otherCert}})
+		if err == nil || err.Error() != "cannot compute secure boot authority measurements: authority 0 is not in db" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
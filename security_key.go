@@ -0,0 +1,64 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+)
+
+// RegisterSecurityKey sets the authorization value of the PIN NV index for the key data file at the specified path to a secret
+// obtained from a hardware security key, so that the security key takes the place of a PIN. This is the same as ChangePassphrase,
+// except that the secret is an arbitrary byte string. It is converted to the authorization value for the PIN NV index in the same
+// way as a passphrase, so the check is still performed by the TPM and is subject to its dictionary attack protection. The
+// existing PIN, passphrase or security key secret must be supplied via the oldPIN argument. Once a security key is registered, the
+// sealed key object must be unsealed with SealedKeyObject.UnsealFromTPMWithSecurityKey.
+//
+// This package doesn't communicate with security keys. The secret is intended to be the output of the hmac-secret extension of a
+// FIDO2 authenticator, which the caller obtains with a FIDO2 library. The caller creates a credential on the authenticator with
+// the hmac-secret extension enabled, and stores the credential ID and a random 32-byte salt alongside the key data file (neither
+// of these is secret). It then requests an assertion for that credential with the hmac-secret extension and the stored salt, and
+// supplies the decrypted hmac-secret output to this function and to SealedKeyObject.UnsealFromTPMWithSecurityKey. The output is
+// a deterministic function of the salt and a secret that never leaves the authenticator, so the same secret is obtained each
+// time. If the authenticator requires user verification, this should be requested as part of the assertion.
+//
+// To remove the security key, use ChangePIN or ChangePassphrase and supply the current security key secret as the old PIN.
+//
+// This returns the same errors as ChangePIN.
+func RegisterSecurityKey(tpm *TPMConnection, path string, oldPIN string, secret []byte) error {
+	if len(secret) == 0 {
+		return errors.New("no security key secret provided")
+	}
+	return changePINIndexAuth(tpm, path, oldPIN, string(secret), AuthModeSecurityKey)
+}
+
+// UnsealFromTPMWithSecurityKey will load the TPM sealed object in to the TPM and attempt to unseal it, using a secret obtained
+// from the hardware security key registered with RegisterSecurityKey in place of a PIN. See RegisterSecurityKey for how this secret
+// is obtained. If the secret is incorrect, a ErrPINFail error will be returned and the TPM's dictionary attack counter will be
+// incremented.
+//
+// If no security key has been registered for this sealed key object, an error will be returned without attempting to unseal it.
+//
+// Otherwise, this returns the same errors as SealedKeyObject.UnsealFromTPM. On success, the unsealed cleartext key is returned.
+func (k *SealedKeyObject) UnsealFromTPMWithSecurityKey(tpm *TPMConnection, secret []byte) ([]byte, error) {
+	if k.data.authModeHint != AuthModeSecurityKey {
+		return nil, errors.New("the sealed key object does not have a security key registered")
+	}
+	return k.unsealFromTPM(tpm, string(secret), nil, 0)
+}
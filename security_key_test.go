@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestUnsealWithSecurityKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+	defer func() {
+		if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), nil); err != nil {
+			t.Errorf("DictionaryAttackLockReset failed: %v", err)
+		}
+	}()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	// The secret is an arbitrary byte string, which can contain zero bytes.
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	secret[31] = 0
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithSecurityKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if _, err := k.UnsealFromTPMWithSecurityKey(tpm, secret); err == nil || err.Error() != "the sealed key object does not have a "+
+		"security key registered" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := RegisterSecurityKey(tpm, keyFile, "", nil); err == nil || err.Error() != "no security key secret provided" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := RegisterSecurityKey(tpm, keyFile, "", secret); err != nil {
+		t.Fatalf("RegisterSecurityKey failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if k.AuthMode2F() != AuthModeSecurityKey {
+		t.Errorf("Unexpected auth mode: %v", k.AuthMode2F())
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		keyUnsealed, err := k.UnsealFromTPMWithSecurityKey(tpm, secret)
+		if err != nil {
+			t.Fatalf("UnsealFromTPMWithSecurityKey failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	})
+
+	t.Run("WrongSecret", func(t *testing.T) {
+		wrong := make([]byte, 32)
+		copy(wrong, secret)
+		wrong[0] ^= 0xff
+		if _, err := k.UnsealFromTPMWithSecurityKey(tpm, wrong); err != ErrPINFail {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		if err := ChangePIN(tpm, keyFile, string(secret), ""); err != nil {
+			t.Fatalf("ChangePIN failed: %v", err)
+		}
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.AuthMode2F() != AuthModeNone {
+			t.Errorf("Unexpected auth mode: %v", k.AuthMode2F())
+		}
+		if _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+}
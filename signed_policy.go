@@ -0,0 +1,244 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	signedPCRProtectionPolicyHeader uint32 = 0x55534b41
+)
+
+// SignedPCRProtectionPolicy corresponds to a PCR protection policy for a sealed key object that has been authorized by the holder of
+// the private part of the key used to authorize PCR protection policies for that sealed key object. It is created by
+// SignPCRProtectionPolicy and consumed by UpdateKeyPCRProtectionPolicyWithSignature.
+//
+// The authorized policy is a TPM2 policy digest, computed using the name algorithm of the sealed key object, that corresponds to the
+// sequence of TPM2_PolicyPCR, TPM2_PolicyOR and TPM2_PolicyNV assertions executed by UnsealFromTPM before the TPM2_PolicyAuthorize
+// assertion. The signature is a RSASSA-PSS signature of the digest of the authorized policy (computed using the name algorithm of
+// the public part of the signing key), with a salt length equal to the length of the digest. This is the format that the TPM
+// expects for a TPM2_PolicyAuthorize assertion with an empty policyRef.
+type SignedPCRProtectionPolicy struct {
+	data *dynamicPolicyData
+}
+
+// Write serializes this policy to the supplied io.Writer.
+func (p *SignedPCRProtectionPolicy) Write(w io.Writer) error {
+	if _, err := tpm2.MarshalToWriter(w, signedPCRProtectionPolicyHeader, makeDynamicPolicyDataRaw_v0(p.data)); err != nil {
+		return xerrors.Errorf("cannot marshal policy: %w", err)
+	}
+	return nil
+}
+
+// ReadSignedPCRProtectionPolicy deserializes a policy created by SignPCRProtectionPolicy and serialized with
+// SignedPCRProtectionPolicy.Write from the supplied io.Reader.
+func ReadSignedPCRProtectionPolicy(r io.Reader) (*SignedPCRProtectionPolicy, error) {
+	var header uint32
+	if _, err := tpm2.UnmarshalFromReader(r, &header); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal header: %w", err)
+	}
+	if header != signedPCRProtectionPolicyHeader {
+		return nil, fmt.Errorf("unexpected header (%d)", header)
+	}
+
+	var raw dynamicPolicyDataRaw_v0
+	if _, err := tpm2.UnmarshalFromReader(r, &raw); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal policy: %w", err)
+	}
+
+	return &SignedPCRProtectionPolicy{data: raw.data()}, nil
+}
+
+// computeAuthorizedPolicyForSealedKey recomputes the authorized policy digest from the supplied dynamic authorization policy
+// metadata, for the sealed key object associated with the supplied keyData.
+func computeAuthorizedPolicyForSealedKey(data *keyData, policyData *dynamicPolicyData) (tpm2.Digest, error) {
+	if len(policyData.PCRSelection) > 0 && len(policyData.PCROrData) == 0 {
+		return nil, errors.New("no PCR policy data")
+	}
+
+	pinIndexPub := computePinNVIndexPublic(data.staticPolicyData.PinIndexHandle, data.pinIndexAttrs, data.pinIndexNameAlg,
+		data.staticPolicyData.PinIndexAuthPolicies)
+	pinIndexName, err := pinIndexPub.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of PIN NV index: %w", err)
+	}
+
+	trial, err := tpm2.ComputeAuthPolicy(data.keyPublic.NameAlg)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(policyData.PCRSelection) > 0:
+		trial.PolicyOR(ensureSufficientORDigests(policyData.PCROrData[len(policyData.PCROrData)-1].Digests))
+	case len(data.userPINPolicyORDigests) > 0:
+		trial.PolicyOR(ensureSufficientORDigests(data.userPINPolicyORDigests))
+	}
+
+	operandB := make([]byte, 8)
+	binary.BigEndian.PutUint64(operandB, policyData.PolicyCount)
+	trial.PolicyNV(pinIndexName, operandB, 0, tpm2.OpUnsignedLE)
+
+	return trial.GetDigest(), nil
+}
+
+// SignPCRProtectionPolicy computes a PCR protection policy for the supplied sealed key object from the profile defined by the
+// pcrProfile argument, and signs it with the supplied key. This is intended to be used by a remote party that holds the private part
+// of the key specified via the PolicyAuthKey field of KeyCreationParams when the sealed key object was created with SealKeyToTPM.
+// It doesn't require access to the TPM on which the sealed key object was created, and so the PCR protection profile must not
+// contain any values that need to be read from the TPM.
+//
+// If the supplied key does not correspond to the key that the sealed key object's authorization policy requires, an error will be
+// returned.
+//
+// The returned policy should be provided to UpdateKeyPCRProtectionPolicyWithSignature in order to install it in the sealed key data
+// file.
+func SignPCRProtectionPolicy(k *SealedKeyObject, key *rsa.PrivateKey, pcrProfile *PCRProtectionProfile) (*SignedPCRProtectionPolicy, error) {
+	authPublicKey := k.data.staticPolicyData.AuthPublicKey
+	if authPublicKey.Type != tpm2.ObjectTypeRSA {
+		return nil, errors.New("sealed key object has an invalid policy authorization key")
+	}
+	if key.E != int(authPublicKey.Params.RSADetail().Exponent) || key.N.Cmp(new(big.Int).SetBytes(authPublicKey.Unique.RSA())) != 0 {
+		return nil, errors.New("the supplied key is not the policy authorization key for the sealed key object")
+	}
+
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+
+	alg := k.data.keyPublic.NameAlg
+	pcrs, pcrDigests, err := pcrProfile.computePCRDigests(nil, alg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute PCR digests from protection profile: %w", err)
+	}
+
+	pinIndexPub := computePinNVIndexPublic(k.data.staticPolicyData.PinIndexHandle, k.data.pinIndexAttrs, k.data.pinIndexNameAlg,
+		k.data.staticPolicyData.PinIndexAuthPolicies)
+	pinIndexName, err := pinIndexPub.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of PIN NV index: %w", err)
+	}
+
+	policyData, err := computeDynamicPolicy(k.data.policyVersion(), alg, &dynamicPolicyComputeParams{
+		key:                    key,
+		signAlg:                authPublicKey.NameAlg,
+		pcrs:                   pcrs,
+		pcrDigests:             pcrDigests,
+		policyCountIndexName:   pinIndexName,
+		policyCount:            k.data.dynamicPolicyData.PolicyCount,
+		userPINPolicyORDigests: k.data.userPINPolicyORDigests})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute dynamic authorization policy: %w", err)
+	}
+
+	return &SignedPCRProtectionPolicy{data: policyData}, nil
+}
+
+// UpdateKeyPCRProtectionPolicyWithSignature updates the PCR protection policy for the sealed key at the path specified by the keyPath
+// argument to the supplied policy, which has been signed by the holder of the private part of the key used to authorize PCR
+// protection policies for the sealed key (see SignPCRProtectionPolicy). This does not require access to the private part of that
+// key or to the TPM.
+//
+// If the key data file cannot be opened, a wrapped *os.PathError error will be returned. If it cannot be deserialized correctly, a
+// InvalidKeyFileError error will be returned.
+//
+// Before the key data file is updated, the supplied policy is checked to make sure that it is consistent with the sealed key object,
+// and that its signature is valid for the public key recorded in the key data file. If either of these checks fail, an error will be
+// returned. Note that the TPM performs its own verification of the signature during a subsequent call to UnsealFromTPM, by loading
+// the public key in to the TPM, verifying the signature with TPM2_VerifySignature and then passing the resulting ticket to a
+// TPM2_PolicyAuthorize assertion. It is this assertion that enforces the authorization.
+//
+// On success, the sealed key data file is updated atomically with the supplied policy. Note that previous PCR protection policies for
+// this sealed key are not revoked by this function. As the PCR values for the supplied policy aren't known, any PCR values recorded
+// for incremental updates are discarded, and UpdateKeyPCRProtectionPolicyIncremental can no longer be used with this sealed key.
+func UpdateKeyPCRProtectionPolicyWithSignature(keyPath string, policy *SignedPCRProtectionPolicy) error {
+	if policy == nil || policy.data == nil {
+		return errors.New("no policy provided")
+	}
+
+	keyFile, err := os.Open(keyPath)
+	if err != nil {
+		return xerrors.Errorf("cannot open key data file: %w", err)
+	}
+	defer keyFile.Close()
+
+	data, err := decodeKeyData(keyFile)
+	if err != nil {
+		return InvalidKeyFileError{err.Error()}
+	}
+
+	authorizedPolicy, err := computeAuthorizedPolicyForSealedKey(data, policy.data)
+	if err != nil {
+		return xerrors.Errorf("cannot compute authorized policy: %w", err)
+	}
+	if !bytes.Equal(authorizedPolicy, policy.data.AuthorizedPolicy) {
+		return errors.New("the supplied policy is inconsistent with the sealed key object")
+	}
+
+	sig := policy.data.AuthorizedPolicySignature
+	if sig == nil || sig.SigAlg != tpm2.SigSchemeAlgRSAPSS {
+		return errors.New("the supplied policy has an invalid signature scheme")
+	}
+	sigData := sig.Signature.RSAPSS()
+	if !sigData.Hash.Supported() {
+		return errors.New("the supplied policy has an invalid signature digest algorithm")
+	}
+
+	authPublicKey := data.staticPolicyData.AuthPublicKey
+	if authPublicKey.Type != tpm2.ObjectTypeRSA {
+		return InvalidKeyFileError{"public area of dynamic authorization policy signing key has the wrong type"}
+	}
+	if !authPublicKey.NameAlg.Supported() || authPublicKey.NameAlg != sigData.Hash {
+		return errors.New("the supplied policy has an invalid signature digest algorithm")
+	}
+	goAuthPublicKey := rsa.PublicKey{
+		N: new(big.Int).SetBytes(authPublicKey.Unique.RSA()),
+		E: int(authPublicKey.Params.RSADetail().Exponent)}
+
+	h := sigData.Hash.NewHash()
+	h.Write(policy.data.AuthorizedPolicy)
+	if err := rsa.VerifyPSS(&goAuthPublicKey, sigData.Hash.GetHash(), h.Sum(nil), sigData.Sig,
+		&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}); err != nil {
+		return xerrors.Errorf("cannot verify policy signature: %w", err)
+	}
+
+	data.dynamicPolicyData = policy.data
+	data.pcrGracePeriodExpiry = 0
+	data.pcrGracePeriodDigests = nil
+	// The PCR values for the externally computed policy aren't known, so it can't be updated incrementally.
+	data.pcrBranchValues = nil
+
+	if err := data.writeToFileAtomic(keyPath); err != nil {
+		return xerrors.Errorf("cannot write key data file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestUpdateKeyPCRProtectionPolicyWithSignature(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	policyAuthKey, err := rsa.GenerateKey(testRandReader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUpdateKeyPCRProtectionPolicyWithSignature_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{
+		PCRProfile:    getTestPCRProfile(),
+		PINHandle:     0x01810000,
+		PolicyAuthKey: &policyAuthKey.PublicKey}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, "", tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	// The key shouldn't be unsealable without an authorized PCR protection policy.
+	if _, err := k.UnsealFromTPM(tpm, ""); err == nil {
+		t.Fatalf("UnsealFromTPM should have failed")
+	} else if _, ok := err.(InvalidKeyFileError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Compute and sign a policy "remotely", using PCR values supplied by the device.
+	_, pcrValues, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}})
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	profile := NewPCRProtectionProfile().AddPCRValue(tpm2.HashAlgorithmSHA256, 7, pcrValues[tpm2.HashAlgorithmSHA256][7])
+
+	t.Run("WrongKey", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(testRandReader, 2048)
+		if err != nil {
+			t.Fatalf("GenerateKey failed: %v", err)
+		}
+		if _, err := SignPCRProtectionPolicy(k, otherKey, profile); err == nil {
+			t.Errorf("SignPCRProtectionPolicy should have failed")
+		}
+	})
+
+	policy, err := SignPCRProtectionPolicy(k, policyAuthKey, profile)
+	if err != nil {
+		t.Fatalf("SignPCRProtectionPolicy failed: %v", err)
+	}
+
+	// Round trip the policy through its serialized form.
+	var b bytes.Buffer
+	if err := policy.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	policy, err = ReadSignedPCRProtectionPolicy(&b)
+	if err != nil {
+		t.Fatalf("ReadSignedPCRProtectionPolicy failed: %v", err)
+	}
+
+	if err := UpdateKeyPCRProtectionPolicyWithSignature(keyFile, policy); err != nil {
+		t.Fatalf("UpdateKeyPCRProtectionPolicyWithSignature failed: %v", err)
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestSealKeyToTPMWithPolicyAuthKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	policyAuthKey, err := rsa.GenerateKey(testRandReader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithPolicyAuthKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := tmpDir + "/keydata"
+
+	// The key used to authorize dynamic authorization policies is held externally, so there is no private data to record in the
+	// creation data for the sealed key object.
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{
+		PCRProfile:    getTestPCRProfile(),
+		PINHandle:     0x01810000,
+		PolicyAuthKey: &policyAuthKey.PublicKey}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, "", tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+}
+
+func TestSealKeyToTPMWithPolicyAuthKeyErrors(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	policyAuthKey, err := rsa.GenerateKey(testRandReader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSealKeyToTPMWithPolicyAuthKeyErrors_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	err = SealKeyToTPM(tpm, key, tmpDir+"/keydata", tmpDir+"/keypolicyupdatedata", &KeyCreationParams{
+		PCRProfile:    getTestPCRProfile(),
+		PINHandle:     0x01810000,
+		PolicyAuthKey: &policyAuthKey.PublicKey})
+	if err == nil {
+		t.Fatalf("SealKeyToTPM should have failed")
+	}
+	if err.Error() != "cannot create a policy update data file for a key with an external policy authorization key" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// ResetTPMSimulator executes a reset sequence (TPM2_Shutdown(CLEAR) -> reset -> TPM2_Startup(CLEAR)) of the TPM simulator
+// associated with the supplied connection and tcti, and then re-initializes the connection. This is intended to be used by tests.
+//
+// If the reset sequence doesn't complete within the specified timeout (eg, because the simulator process has died), the tcti will
+// be closed in order to abort any pending command and an error will be returned. In this case, the connection cannot be used
+// anymore.
+func ResetTPMSimulator(tpm *TPMConnection, tcti *tpm2.TctiMssim, timeout time.Duration) error {
+	done := make(chan error, 1)
+
+	go func() {
+		done <- func() error {
+			if err := tpm.Shutdown(tpm2.StartupClear); err != nil {
+				return xerrors.Errorf("shutdown failed: %w", err)
+			}
+			if err := tcti.Reset(); err != nil {
+				return xerrors.Errorf("resetting the TPM simulator failed: %w", err)
+			}
+			if err := tpm.Startup(tpm2.StartupClear); err != nil {
+				return xerrors.Errorf("startup failed: %w", err)
+			}
+			if err := tpm.init(); err != nil {
+				return xerrors.Errorf("cannot reinitialize TPM connection after reset: %w", err)
+			}
+			return nil
+		}()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		tcti.Close()
+		return fmt.Errorf("the TPM simulator did not complete the reset sequence within %v", timeout)
+	}
+}
@@ -0,0 +1,171 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+var (
+	// singleUseNVIndexAttrs are the attributes for a NV counter index created by createSingleUseNVIndex. The index can be read
+	// without an authorization value so that it can be used in a TPM2_PolicyNV assertion, and it is exempt from dictionary attack
+	// protection.
+	singleUseNVIndexAttrs = tpm2.NVTypeCounter.WithAttrs(tpm2.AttrNVPolicyWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA)
+)
+
+// computeSingleUseNVIndexAuthPolicy computes the authorization policy for a NV index created by createSingleUseNVIndex, which
+// permits anybody to increment it.
+func computeSingleUseNVIndexAuthPolicy(alg tpm2.HashAlgorithmId) tpm2.Digest {
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyCommandCode(tpm2.CommandNVIncrement)
+	return trial.GetDigest()
+}
+
+// makeSingleUseOperand returns the operand for the TPM2_PolicyNV assertion that checks that a NV index created by
+// createSingleUseNVIndex still has the supplied count.
+func makeSingleUseOperand(count uint64) []byte {
+	operand := make([]byte, 8)
+	binary.BigEndian.PutUint64(operand, count)
+	return operand
+}
+
+// incrementSingleUseNVIndex increments the supplied NV index that was created by createSingleUseNVIndex.
+func incrementSingleUseNVIndex(tpm *tpm2.TPMContext, index tpm2.ResourceContext, nameAlg tpm2.HashAlgorithmId, session tpm2.SessionContext) error {
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, nameAlg)
+	if err != nil {
+		return xerrors.Errorf("cannot begin policy session: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandNVIncrement); err != nil {
+		return xerrors.Errorf("cannot execute assertion to increment counter: %w", err)
+	}
+
+	if err := tpm.NVIncrement(index, index, policySession, session.IncludeAttrs(tpm2.AttrAudit)); err != nil {
+		return xerrors.Errorf("cannot increment NV index: %w", err)
+	}
+	return nil
+}
+
+// createSingleUseNVIndex creates and initializes a NV counter index at the specified handle, for use with a TPM2_PolicyNV
+// assertion in the authorization policy of a sealed key object that can only be unsealed once. The assertion checks that the
+// counter still has the value it had when the key was sealed, and the counter is incremented after the key has been unsealed.
+//
+// The index can be incremented by anybody, as incrementing it can only revoke the sealed key object. It can't be recreated with the
+// same value either - a newly created counter index is initialized to the highest value of any counter index that has existed on
+// the TPM.
+//
+// On success, the public area of the initialized index and its current value are returned.
+func createSingleUseNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, nameAlg tpm2.HashAlgorithmId, session tpm2.SessionContext) (*tpm2.NVPublic, uint64, error) {
+	public := &tpm2.NVPublic{
+		Index:      handle,
+		NameAlg:    nameAlg,
+		Attrs:      singleUseNVIndexAttrs,
+		AuthPolicy: computeSingleUseNVIndexAuthPolicy(nameAlg),
+		Size:       8}
+
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, public, session)
+	if err != nil {
+		return nil, 0, xerrors.Errorf("cannot define NV space: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+	}()
+
+	// Initialize the index
+	if err := incrementSingleUseNVIndex(tpm, index, nameAlg, session); err != nil {
+		return nil, 0, xerrors.Errorf("cannot initialize NV index: %w", err)
+	}
+
+	count, err := tpm.NVReadCounter(index, index, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, 0, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+
+	// The index has a different name now that it has been written, so update the public area we return so that it can be used
+	// to construct an authorization policy.
+	public.Attrs |= tpm2.AttrNVWritten
+
+	succeeded = true
+	return public, count, nil
+}
+
+// executeSingleUseAssertion executes the TPM2_PolicyNV assertion for the single use NV index in the supplied policy session if the
+// sealed key object is single use, converting errors in to the errors documented for UnsealFromTPM.
+func (k *SealedKeyObject) executeSingleUseAssertion(tpm *TPMConnection, policySession, hmacSession tpm2.SessionContext) error {
+	if k.data.singleUseIndexHandle == 0 {
+		return nil
+	}
+
+	handle := k.data.singleUseIndexHandle
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return InvalidKeyFileError{"single use NV index is unavailable"}
+	case err != nil:
+		return xerrors.Errorf("cannot create context for single use NV index: %w", err)
+	}
+
+	err = tpm.PolicyNV(index, index, policySession, makeSingleUseOperand(k.data.singleUseCount), 0, tpm2.OpEq, hmacSession)
+	switch {
+	case tpm2.IsTPMError(err, tpm2.ErrorPolicy, tpm2.CommandPolicyNV):
+		return ErrSingleUseKeyConsumed
+	case err != nil:
+		return xerrors.Errorf("cannot execute single use assertion: %w", err)
+	}
+	return nil
+}
+
+// revokeSingleUse increments the single use NV index if the sealed key object is single use, so that it can't be unsealed again.
+// This is called after the sealed key object has been unsealed successfully.
+func (k *SealedKeyObject) revokeSingleUse(tpm *TPMConnection, hmacSession tpm2.SessionContext) error {
+	if k.data.singleUseIndexHandle == 0 {
+		return nil
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(k.data.singleUseIndexHandle)
+	if err != nil {
+		return SingleUseRevocationError{xerrors.Errorf("cannot create context for single use NV index: %w", err)}
+	}
+	if !bytes.Equal(index.Name(), k.data.singleUseIndexName) {
+		return SingleUseRevocationError{errors.New("single use NV index has an unexpected name")}
+	}
+	if err := incrementSingleUseNVIndex(tpm.TPMContext, index, k.data.keyPublic.NameAlg, hmacSession); err != nil {
+		return SingleUseRevocationError{err}
+	}
+	return nil
+}
+
+// IsSingleUse indicates whether this sealed key object was created with the SingleUseIndexHandle field of KeyCreationParams set,
+// in which case it can only be unsealed once.
+func (k *SealedKeyObject) IsSingleUse() bool {
+	return k.data.singleUseIndexHandle != 0
+}
@@ -0,0 +1,156 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestUnsealSingleUse(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealSingleUse_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:           getTestPCRProfile(),
+		PINHandle:            0x01810000,
+		SingleUseIndexHandle: 0x01810001}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+	defer func() {
+		index, err := tpm.CreateResourceContextFromTPM(0x01810001)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}()
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if !k.IsSingleUse() {
+		t.Errorf("Sealed key object should be single use")
+	}
+	if err := tpm.VerifyPINIndex(k); err != nil {
+		t.Errorf("VerifyPINIndex failed: %v", err)
+	}
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrSingleUseKeyConsumed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUnsealSingleUseRevokedByOtherParty(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealSingleUseRevokedByOtherParty_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{
+		PCRProfile:           getTestPCRProfile(),
+		PINHandle:            0x01810000,
+		SingleUseIndexHandle: 0x01810001}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+	defer func() {
+		index, err := tpm.CreateResourceContextFromTPM(0x01810001)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+	}()
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(0x01810001)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+
+	// Anybody can increment the counter, which revokes the key before it has been used.
+	session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+	if err != nil {
+		t.Fatalf("StartAuthSession failed: %v", err)
+	}
+	if err := tpm.PolicyCommandCode(session, tpm2.CommandNVIncrement); err != nil {
+		t.Fatalf("PolicyCommandCode failed: %v", err)
+	}
+	if err := tpm.NVIncrement(index, index, session); err != nil {
+		t.Fatalf("NVIncrement failed: %v", err)
+	}
+
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrSingleUseKeyConsumed {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
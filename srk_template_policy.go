@@ -0,0 +1,452 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// commandPolicyTemplate is the command code for TPM2_PolicyTemplate.
+	commandPolicyTemplate tpm2.CommandCode = 0x00000190
+
+	srkTemplatePolicyNVIndexVersion uint8 = 0
+	srkTemplateUniqueNVIndexVersion uint8 = 0
+
+	// srkTemplateUniqueSize is the size of the value inserted in to the unique field of the storage root key template when the
+	// storage root key is rotated.
+	srkTemplateUniqueSize = 32
+)
+
+var (
+	// srkTemplateNVIndexAttrs are the attributes for the NV indices that record the name of the key used to authorize the
+	// templates of objects created under a storage root key with a template authorization policy, and the unique value of the
+	// storage root key template. The indices can be read without authorization so that the storage root key template can be
+	// reconstructed and the authorization policy of the storage root key can be satisfied for TPM2_Load. They are write locked
+	// once they have been initialized. Their contents aren't security sensitive - an adversary with knowledge of the storage
+	// hierarchy authorization who replaces them can only stop objects from being loaded, as the storage root key is fixed when it
+	// is created.
+	srkTemplateNVIndexAttrs = tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVWriteDefine | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA)
+)
+
+// computeSRKTemplatePolicyORDigests computes the branches of the authorization policy for a storage root key with a template
+// authorization policy. The first branch permits TPM2_Load without any further restriction, so that objects created under the
+// storage root key can be loaded without access to the key that authorizes templates. The second branch requires a policy that is
+// authorized with the key with the supplied name, which is a TPM2_PolicyTemplate assertion for the template of an object being
+// created.
+func computeSRKTemplatePolicyORDigests(alg tpm2.HashAlgorithmId, keyName tpm2.Name) tpm2.DigestList {
+	trial, _ := tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyCommandCode(tpm2.CommandLoad)
+	loadDigest := trial.GetDigest()
+
+	trial, _ = tpm2.ComputeAuthPolicy(alg)
+	trial.PolicyAuthorize(nil, keyName)
+	return tpm2.DigestList{loadDigest, trial.GetDigest()}
+}
+
+// makeSRKTemplateWithTemplatePolicy returns the template for a storage root key with a template authorization policy that is
+// bound to the key with the supplied name. This is the same as the default template, except that the TPMA_OBJECT_USERWITHAUTH
+// attribute is clear so that use of the key in the user role can only be authorized with its policy.
+func makeSRKTemplateWithTemplatePolicy(keyName tpm2.Name) *tpm2.Public {
+	template := makeDefaultSRKTemplate()
+	template.Attrs &^= tpm2.AttrUserWithAuth
+
+	trial, _ := tpm2.ComputeAuthPolicy(template.NameAlg)
+	trial.PolicyOR(computeSRKTemplatePolicyORDigests(template.NameAlg, keyName))
+	template.AuthPolicy = trial.GetDigest()
+
+	return template
+}
+
+// computeSRKTemplatePolicyKeyName returns the name of the supplied key used to authorize the templates of objects created under
+// the storage root key.
+func computeSRKTemplatePolicyKeyName(key *rsa.PublicKey) (tpm2.Name, error) {
+	return createPublicAreaForRSASigningKey(key).Name()
+}
+
+// readSRKTemplateNVIndex returns the contents of the NV index at the supplied handle, which records data that is used to
+// construct the template of the storage root key. If the index is not defined, nil is returned.
+func readSRKTemplateNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle) ([]byte, error) {
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil, nil
+	case err != nil:
+		return nil, xerrors.Errorf("cannot create context for NV index: %w", err)
+	}
+
+	pub, _, err := tpm.NVReadPublic(index)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of NV index: %w", err)
+	}
+	if pub.Attrs&tpm2.AttrNVWritten == 0 {
+		return nil, errors.New("NV index has not been initialized")
+	}
+	data, err := nvRead(tpm, index, index, pub.Size, 0, nil)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read NV index: %w", err)
+	}
+	return data, nil
+}
+
+// readSRKTemplatePolicyKeyName returns the name of the key used to authorize the templates of objects created under the storage
+// root key, as recorded on the TPM when it was provisioned. If the storage root key was provisioned without a template
+// authorization policy, nil is returned.
+func readSRKTemplatePolicyKeyName(tpm *tpm2.TPMContext) (tpm2.Name, error) {
+	data, err := readSRKTemplateNVIndex(tpm, srkTemplatePolicyNVHandle)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read SRK template policy NV index: %w", err)
+	case data == nil:
+		return nil, nil
+	}
+
+	var version uint8
+	var keyName tpm2.Name
+	if _, err := tpm2.UnmarshalFromBytes(data, &version, &keyName); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal SRK template policy data: %w", err)
+	}
+	if version != srkTemplatePolicyNVIndexVersion {
+		return nil, errors.New("unrecognized version for SRK template policy data")
+	}
+	if len(keyName) == 0 {
+		return nil, errors.New("SRK template policy data contains an empty key name")
+	}
+
+	return keyName, nil
+}
+
+// readSRKTemplateUnique returns the value that is inserted in to the unique field of the storage root key template, as recorded
+// on the TPM the last time that the storage root key was rotated. If the storage root key has never been rotated, nil is
+// returned.
+func readSRKTemplateUnique(tpm *tpm2.TPMContext) ([]byte, error) {
+	data, err := readSRKTemplateNVIndex(tpm, srkTemplateUniqueNVHandle)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read SRK template unique NV index: %w", err)
+	case data == nil:
+		return nil, nil
+	}
+
+	var version uint8
+	var unique []byte
+	if _, err := tpm2.UnmarshalFromBytes(data, &version, &unique); err != nil {
+		return nil, xerrors.Errorf("cannot unmarshal SRK template unique data: %w", err)
+	}
+	if version != srkTemplateUniqueNVIndexVersion {
+		return nil, errors.New("unrecognized version for SRK template unique data")
+	}
+	if len(unique) != srkTemplateUniqueSize {
+		return nil, errors.New("SRK template unique data has the wrong size")
+	}
+
+	return unique, nil
+}
+
+// makeSRKTemplateWithUnique returns a copy of the supplied storage root key template with the supplied value inserted at the
+// start of the unique field. As the storage root key is derived from the primary seed of the storage hierarchy and its template,
+// this produces a storage root key that is different to the one created from the supplied template, without requiring the
+// primary seed to be changed.
+func makeSRKTemplateWithUnique(template *tpm2.Public, unique []byte) *tpm2.Public {
+	var out *tpm2.Public
+	b, _ := tpm2.MarshalToBytes(template)
+	tpm2.UnmarshalFromBytes(b, &out)
+
+	rsaUnique := make(tpm2.PublicKeyRSA, template.Params.RSADetail().KeyBits/8)
+	copy(rsaUnique, unique)
+	out.Unique.Data = rsaUnique
+	return out
+}
+
+// readStorageRootKeyTemplate returns the template from which the storage root key should be created, which depends on whether the
+// TPM was provisioned with a template authorization policy for the storage root key and whether the storage root key has been
+// rotated. If the TPM was provisioned with a template authorization policy, the name of the key used to authorize templates is
+// also returned.
+func readStorageRootKeyTemplate(tpm *tpm2.TPMContext) (*tpm2.Public, tpm2.Name, error) {
+	keyName, err := readSRKTemplatePolicyKeyName(tpm)
+	if err != nil {
+		return nil, nil, err
+	}
+	unique, err := readSRKTemplateUnique(tpm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := srkTemplate
+	if keyName != nil {
+		template = makeSRKTemplateWithTemplatePolicy(keyName)
+	}
+	if unique != nil {
+		template = makeSRKTemplateWithUnique(template, unique)
+	}
+	return template, keyName, nil
+}
+
+// provisionSRKTemplateNVIndex records the supplied data in a write locked NV index at the supplied handle, replacing any existing
+// index.
+func provisionSRKTemplateNVIndex(tpm *tpm2.TPMContext, handle tpm2.Handle, data []byte, session tpm2.SessionContext) error {
+	existing, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		// Nothing to undefine
+	case err != nil:
+		return xerrors.Errorf("cannot create context for existing NV index: %w", err)
+	default:
+		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), existing, session); err != nil {
+			return xerrors.Errorf("cannot undefine existing NV index: %w", err)
+		}
+	}
+
+	public := tpm2.NVPublic{
+		Index:   handle,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   srkTemplateNVIndexAttrs,
+		Size:    uint16(len(data))}
+	index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &public, session)
+	if err != nil {
+		return xerrors.Errorf("cannot define NV index: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+	}()
+
+	if err := nvWrite(tpm, index, index, data, 0, session); err != nil {
+		return xerrors.Errorf("cannot initialize NV index: %w", err)
+	}
+	if err := tpm.NVWriteLock(index, index, session); err != nil {
+		return xerrors.Errorf("cannot write lock NV index: %w", err)
+	}
+
+	succeeded = true
+	return nil
+}
+
+// provisionSRKTemplatePolicyNVIndex records the supplied name of the key used to authorize the templates of objects created under
+// the storage root key in the NV index at srkTemplatePolicyNVHandle, replacing any existing index.
+func provisionSRKTemplatePolicyNVIndex(tpm *tpm2.TPMContext, keyName tpm2.Name, session tpm2.SessionContext) error {
+	data, err := tpm2.MarshalToBytes(srkTemplatePolicyNVIndexVersion, keyName)
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal contents for SRK template policy NV index: %v", err))
+	}
+	return provisionSRKTemplateNVIndex(tpm, srkTemplatePolicyNVHandle, data, session)
+}
+
+// provisionSRKTemplateUniqueNVIndex records the supplied value for the unique field of the storage root key template in the NV
+// index at srkTemplateUniqueNVHandle, replacing any existing index. If unique is nil, any existing index is undefined so that the
+// storage root key is created from the template with the default unique field.
+func provisionSRKTemplateUniqueNVIndex(tpm *tpm2.TPMContext, unique []byte, session tpm2.SessionContext) error {
+	if unique == nil {
+		index, err := tpm.CreateResourceContextFromTPM(srkTemplateUniqueNVHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err, srkTemplateUniqueNVHandle):
+			return nil
+		case err != nil:
+			return xerrors.Errorf("cannot create context for existing NV index: %w", err)
+		}
+		if err := tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session); err != nil {
+			return xerrors.Errorf("cannot undefine existing NV index: %w", err)
+		}
+		return nil
+	}
+
+	data, err := tpm2.MarshalToBytes(srkTemplateUniqueNVIndexVersion, unique)
+	if err != nil {
+		panic(fmt.Sprintf("cannot marshal contents for SRK template unique NV index: %v", err))
+	}
+	return provisionSRKTemplateNVIndex(tpm, srkTemplateUniqueNVHandle, data, session)
+}
+
+// srkRequiresTemplateAuthorization indicates whether the supplied storage root key has a template authorization policy, in which
+// case objects can only be created under it with a template that is authorized by the key recorded when the TPM was provisioned.
+func srkRequiresTemplateAuthorization(tpm *tpm2.TPMContext, srk tpm2.ResourceContext) (bool, error) {
+	pub, _, _, err := tpm.ReadPublic(srk)
+	if err != nil {
+		return false, xerrors.Errorf("cannot read public area of SRK: %w", err)
+	}
+	return pub.Attrs&tpm2.AttrUserWithAuth == 0, nil
+}
+
+// loadUnderSRK loads the object with the supplied private and public areas in to the TPM as a child of the supplied storage root
+// key. If the storage root key has a template authorization policy, the TPM2_Load branch of its authorization policy is satisfied
+// with a policy session. Otherwise, the supplied session is used for authorization.
+func loadUnderSRK(tpm *tpm2.TPMContext, srk tpm2.ResourceContext, inPrivate tpm2.Private, inPublic *tpm2.Public, session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	srkPub, _, _, err := tpm.ReadPublic(srk)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of SRK: %w", err)
+	}
+	if srkPub.Attrs&tpm2.AttrUserWithAuth != 0 {
+		return tpm.Load(srk, inPrivate, inPublic, session)
+	}
+
+	keyName, err := readSRKTemplatePolicyKeyName(tpm)
+	switch {
+	case err != nil:
+		return nil, xerrors.Errorf("cannot read name of SRK template policy key: %w", err)
+	case keyName == nil:
+		return nil, errors.New("the SRK has a template authorization policy, but no SRK template policy key is recorded on the TPM")
+	}
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, srkPub.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session for SRK: %w", err)
+	}
+	defer tpm.FlushContext(policySession)
+
+	if err := tpm.PolicyCommandCode(policySession, tpm2.CommandLoad); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion for SRK: %w", err)
+	}
+	if err := tpm.PolicyOR(policySession, computeSRKTemplatePolicyORDigests(srkPub.NameAlg, keyName)); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion for SRK: %w", err)
+	}
+
+	return tpm.Load(srk, inPrivate, inPublic, policySession)
+}
+
+// beginSRKTemplateAuthorization starts a policy session that satisfies the template authorization policy of the supplied storage
+// root key for the creation of an object from the supplied template, by executing a TPM2_PolicyTemplate assertion for the template
+// and authorizing it with the supplied key. The caller is responsible for flushing the returned session. The template must not be
+// modified after this, as the TPM checks that the object being created matches it exactly.
+func beginSRKTemplateAuthorization(tpm *tpm2.TPMContext, srk tpm2.ResourceContext, key *rsa.PrivateKey, template *tpm2.Public,
+	session tpm2.SessionContext) (tpm2.SessionContext, error) {
+	srkPub, _, _, err := tpm.ReadPublic(srk)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read public area of SRK: %w", err)
+	}
+
+	keyPublic := createPublicAreaForRSASigningKey(&key.PublicKey)
+	keyName, err := keyPublic.Name()
+	if err != nil {
+		return nil, xerrors.Errorf("cannot compute name of SRK template policy key: %w", err)
+	}
+	trial, _ := tpm2.ComputeAuthPolicy(srkPub.NameAlg)
+	trial.PolicyOR(computeSRKTemplatePolicyORDigests(srkPub.NameAlg, keyName))
+	if !bytes.Equal(trial.GetDigest(), srkPub.AuthPolicy) {
+		return nil, errors.New("the supplied key is not the SRK template policy key")
+	}
+
+	// Compute the policy digest for the TPM2_PolicyTemplate assertion and sign it.
+	templateBytes, err := tpm2.MarshalToBytes(template)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot marshal template: %w", err)
+	}
+	h := srkPub.NameAlg.NewHash()
+	h.Write(templateBytes)
+	templateHash := h.Sum(nil)
+
+	h = srkPub.NameAlg.NewHash()
+	h.Write(make([]byte, srkPub.NameAlg.Size()))
+	binary.Write(h, binary.BigEndian, commandPolicyTemplate)
+	h.Write(templateHash)
+	approvedPolicy := h.Sum(nil)
+
+	signDigest := keyPublic.NameAlg
+	h = signDigest.NewHash()
+	h.Write(approvedPolicy)
+	digest := h.Sum(nil)
+	sig, err := rsa.SignPSS(rand.Reader, key, signDigest.GetHash(), digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	if err != nil {
+		return nil, xerrors.Errorf("cannot sign template authorization: %w", err)
+	}
+	signature := tpm2.Signature{
+		SigAlg: tpm2.SigSchemeAlgRSAPSS,
+		Signature: tpm2.SignatureU{
+			Data: &tpm2.SignatureRSAPSS{
+				Hash: signDigest,
+				Sig:  tpm2.PublicKeyRSA(sig)}}}
+
+	// Have the TPM verify the signature in order to obtain the ticket consumed by TPM2_PolicyAuthorize.
+	keyContext, err := tpm.LoadExternal(nil, keyPublic, tpm2.HandleOwner)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot load SRK template policy key in to the TPM: %w", err)
+	}
+	defer tpm.FlushContext(keyContext)
+
+	ticket, err := tpm.VerifySignature(keyContext, digest, &signature, session.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return nil, xerrors.Errorf("cannot verify template authorization signature: %w", err)
+	}
+
+	policySession, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, srkPub.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session for SRK: %w", err)
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		tpm.FlushContext(policySession)
+	}()
+
+	if err := tpm.PolicyTemplate(policySession, templateHash); err != nil {
+		return nil, xerrors.Errorf("cannot execute template assertion for SRK: %w", err)
+	}
+	if err := tpm.PolicyAuthorize(policySession, approvedPolicy, nil, keyContext.Name(), ticket); err != nil {
+		return nil, xerrors.Errorf("cannot execute authorization assertion for SRK: %w", err)
+	}
+	if err := tpm.PolicyOR(policySession, computeSRKTemplatePolicyORDigests(srkPub.NameAlg, keyName)); err != nil {
+		return nil, xerrors.Errorf("cannot execute assertion for SRK: %w", err)
+	}
+
+	succeeded = true
+	return policySession, nil
+}
+
+// createUnderSRK creates an object from the supplied template as a child of the supplied storage root key, using parameter
+// encryption to protect the sensitive data. If the storage root key has a template authorization policy, the template is
+// authorized with the supplied key, and ErrSRKTemplateAuthorizationRequired is returned if no key is supplied. If the storage root
+// key doesn't have a template authorization policy, a key must not be supplied.
+func createUnderSRK(tpm *tpm2.TPMContext, srk tpm2.ResourceContext, templateKey *rsa.PrivateKey, sensitive *tpm2.SensitiveCreate,
+	template *tpm2.Public, outsideInfo tpm2.Data, session tpm2.SessionContext) (tpm2.Private, *tpm2.Public, *tpm2.CreationData, tpm2.Digest, *tpm2.TkCreation, error) {
+	required, err := srkRequiresTemplateAuthorization(tpm, srk)
+	switch {
+	case err != nil:
+		return nil, nil, nil, nil, nil, err
+	case !required && templateKey != nil:
+		return nil, nil, nil, nil, nil, errors.New("the SRK does not have a template authorization policy")
+	case !required:
+		return tpm.Create(srk, sensitive, template, outsideInfo, nil, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+	case templateKey == nil:
+		return nil, nil, nil, nil, nil, ErrSRKTemplateAuthorizationRequired
+	}
+
+	policySession, err := beginSRKTemplateAuthorization(tpm, srk, templateKey, template, session)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	defer tpm.FlushContext(policySession)
+
+	return tpm.Create(srk, sensitive, template, outsideInfo, nil, policySession, session.IncludeAttrs(tpm2.AttrCommandEncrypt))
+}
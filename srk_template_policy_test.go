@@ -0,0 +1,233 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+
+	. "github.com/snapcore/secboot"
+)
+
+func TestSRKTemplatePolicy(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	templateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeFull, nil, true, &ProvisionParams{SRKTemplatePolicyKey: &templateKey.PublicKey}); err != nil {
+		t.Fatalf("ProvisionTPMWithParams failed: %v", err)
+	}
+
+	status, err := ProvisionStatus(tpm)
+	if err != nil {
+		t.Fatalf("ProvisionStatus failed: %v", err)
+	}
+	if status&AttrValidSRK == 0 {
+		t.Errorf("ProvisionStatus should report a valid SRK")
+	}
+
+	srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	srkPub, _, _, err := tpm.ReadPublic(srk)
+	if err != nil {
+		t.Fatalf("ReadPublic failed: %v", err)
+	}
+	if srkPub.Attrs&tpm2.AttrUserWithAuth != 0 {
+		t.Errorf("SRK should not permit authorization with its auth value in the user role")
+	}
+
+	// Creating an object under the SRK without an authorized template should fail.
+	if _, _, _, _, _, err := tpm.Create(srk, nil, &tpm2.Public{
+		Type:    tpm2.ObjectTypeKeyedHash,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.AttrFixedTPM | tpm2.AttrFixedParent | tpm2.AttrUserWithAuth,
+		Params:  tpm2.PublicParamsU{Data: &tpm2.KeyedHashParams{Scheme: tpm2.KeyedHashScheme{Scheme: tpm2.KeyedHashSchemeNull}}}},
+		nil, nil, tpm.HmacSession()); err == nil {
+		t.Errorf("Create should have failed without an authorized template")
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSRKTemplatePolicy_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	keyFile := filepath.Join(tmpDir, "keydata")
+	policyUpdateFile := filepath.Join(tmpDir, "keypolicyupdatedata")
+
+	params := &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, params); err != ErrSRKTemplateAuthorizationRequired {
+		t.Errorf("SealKeyToTPM without a template policy key returned an unexpected error: %v", err)
+	}
+
+	params.SRKTemplatePolicyKey = otherKey
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, params); err == nil {
+		t.Errorf("SealKeyToTPM with the wrong template policy key should have failed")
+	}
+
+	params.SRKTemplatePolicyKey = templateKey
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, params); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	unsealedKey, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(unsealedKey, key) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	// The template authorization policy should be retained when re-provisioning without a key.
+	if err := ProvisionTPM(tpm, ProvisionModeWithoutLockout, nil, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+	if _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+		t.Errorf("UnsealFromTPM failed after re-provisioning: %v", err)
+	}
+
+	if _, err := tpm.BenchmarkUnseal(); err != ErrSRKTemplateAuthorizationRequired {
+		t.Errorf("BenchmarkUnseal returned an unexpected error: %v", err)
+	}
+}
+
+func TestSRKTemplatePolicyKeyWithoutPolicy(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+
+	templateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSRKTemplatePolicyKeyWithoutPolicy_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	params := &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000, SRKTemplatePolicyKey: templateKey}
+	err = SealKeyToTPM(tpm, key, filepath.Join(tmpDir, "keydata"), filepath.Join(tmpDir, "keypolicyupdatedata"), params)
+	if err == nil || err.Error() != "cannot create sealed data object for key: the SRK does not have a template authorization policy" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestSRKTemplatePolicyReplaceSRK(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer func() {
+		clearTPMWithPlatformAuth(t, tpm)
+		closeTPM(t, tpm)
+	}()
+
+	clearTPMWithPlatformAuth(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+
+	templateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %v", err)
+	}
+
+	srkRequiresTemplateAuthorization := func() bool {
+		srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+		if err != nil {
+			t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+		}
+		srkPub, _, _, err := tpm.ReadPublic(srk)
+		if err != nil {
+			t.Fatalf("ReadPublic failed: %v", err)
+		}
+		return srkPub.Attrs&tpm2.AttrUserWithAuth == 0
+	}
+
+	// The existing SRK shouldn't be replaced without EvictConflictingObjects, and the SRK template policy key shouldn't be
+	// recorded.
+	err = ProvisionTPMWithParams(tpm, ProvisionModeFull, nil, true, &ProvisionParams{SRKTemplatePolicyKey: &templateKey.PublicKey})
+	if _, ok := err.(PersistentHandleInUseError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if srkRequiresTemplateAuthorization() {
+		t.Errorf("SRK should not have been replaced")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(SrkTemplatePolicyNVHandle); !tpm2.IsResourceUnavailableError(err, SrkTemplatePolicyNVHandle) {
+		t.Errorf("SRK template policy NV index should not exist")
+	}
+
+	if err := ProvisionTPMWithParams(tpm, ProvisionModeFull, nil, true, &ProvisionParams{
+		SRKTemplatePolicyKey:    &templateKey.PublicKey,
+		EvictConflictingObjects: true}); err != nil {
+		t.Fatalf("ProvisionTPMWithParams failed: %v", err)
+	}
+	if !srkRequiresTemplateAuthorization() {
+		t.Errorf("SRK should have been replaced")
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(SrkTemplatePolicyNVHandle); err != nil {
+		t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+	}
+}
@@ -29,11 +29,13 @@ import (
 	"encoding/asn1"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/canonical/go-tpm2"
@@ -52,6 +54,15 @@ const (
 	ekCertHandle tpm2.Handle = 0x01c00002
 
 	sanDirectoryNameTag = 4 // Subject Alternative Name directoryName, see section 4.2.16 or RFC5280
+
+	responseFailure tpm2.ResponseCode = 0x101 // TPM_RC_FAILURE, returned by TPM2_GetTestResult when the TPM is in failure mode
+	responseTesting tpm2.ResponseCode = 0x90a // TPM_RC_TESTING, returned by TPM2_GetTestResult when self tests are in progress
+
+	selfTestPollInterval = 100 * time.Millisecond
+	selfTestTimeout      = 30 * time.Second
+
+	warmupPollInterval = 10 * time.Millisecond
+	warmupTimeout      = 10 * time.Second
 )
 
 var (
@@ -64,21 +75,311 @@ var (
 	oidTcgKpEkCertificate          = asn1.ObjectIdentifier{2, 23, 133, 8, 1} // tcg-kp-EKCertificate
 )
 
-// TPMDeviceAttributes contains details about the TPM extracted from a manufacturer issued endorsement key certificate.
+var (
+	ekCertAttributeOIDsMu sync.Mutex
+
+	// Additional OIDs registered with RegisterEKCertAttributeOIDs, for vendors that don't use the TCG OIDs.
+	extraTpmManufacturerOIDs []asn1.ObjectIdentifier
+	extraTpmModelOIDs        []asn1.ObjectIdentifier
+	extraTpmVersionOIDs      []asn1.ObjectIdentifier
+)
+
+// EKCertAttributeOIDs specifies a set of object identifiers that a TPM manufacturer uses to encode the TPM device attributes in
+// its endorsement key certificates. A nil identifier is ignored.
+type EKCertAttributeOIDs struct {
+	Manufacturer    asn1.ObjectIdentifier
+	Model           asn1.ObjectIdentifier
+	FirmwareVersion asn1.ObjectIdentifier
+}
+
+// RegisterEKCertAttributeOIDs registers additional object identifiers that are recognized as TPM device attributes when verifying
+// an endorsement key certificate, alongside the standard tcg-at-tpmManufacturer, tcg-at-tpmModel and tcg-at-tpmVersion identifiers
+// defined in the "TCG EK Credential Profile For TPM Family 2.0" specification. This is required to verify certificates from
+// vendors that don't strictly follow the TCG layout. Values associated with the additional identifiers must be encoded in the same
+// way as the standard attributes. This should be called before connecting to the TPM with SecureConnectToDefaultTPM.
+func RegisterEKCertAttributeOIDs(oids EKCertAttributeOIDs) {
+	ekCertAttributeOIDsMu.Lock()
+	defer ekCertAttributeOIDsMu.Unlock()
+
+	if oids.Manufacturer != nil {
+		extraTpmManufacturerOIDs = append(extraTpmManufacturerOIDs, oids.Manufacturer)
+	}
+	if oids.Model != nil {
+		extraTpmModelOIDs = append(extraTpmModelOIDs, oids.Model)
+	}
+	if oids.FirmwareVersion != nil {
+		extraTpmVersionOIDs = append(extraTpmVersionOIDs, oids.FirmwareVersion)
+	}
+}
+
+func isOIDInSet(oid asn1.ObjectIdentifier, standard asn1.ObjectIdentifier, extra []asn1.ObjectIdentifier) bool {
+	if oid.Equal(standard) {
+		return true
+	}
+	for _, e := range extra {
+		if oid.Equal(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// TPMDeviceAttributesSource indicates which part of an endorsement key certificate the TPM device attributes were extracted from.
+type TPMDeviceAttributesSource int
+
+const (
+	// TPMDeviceAttributesFromSAN indicates that the TPM device attributes were extracted from the directoryName of the subject
+	// alternative name extension, as required by the "TCG EK Credential Profile For TPM Family 2.0" specification.
+	TPMDeviceAttributesFromSAN TPMDeviceAttributesSource = iota + 1
+
+	// TPMDeviceAttributesFromSubject indicates that the certificate's subject alternative name extension didn't contain the TPM
+	// device attributes, and they were extracted from the subject distinguished name instead.
+	TPMDeviceAttributesFromSubject
+)
+
+func (s TPMDeviceAttributesSource) String() string {
+	switch s {
+	case TPMDeviceAttributesFromSAN:
+		return "subject alternative name"
+	case TPMDeviceAttributesFromSubject:
+		return "subject"
+	default:
+		return fmt.Sprintf("TPMDeviceAttributesSource(%d)", int(s))
+	}
+}
+
+// TPMDeviceAttributes contains details about the TPM extracted from a manufacturer issued endorsement key certificate. Source
+// indicates which part of the certificate these details were extracted from.
 type TPMDeviceAttributes struct {
 	Manufacturer    tpm2.TPMManufacturer
 	Model           string
 	FirmwareVersion uint32
+	Source          TPMDeviceAttributesSource
+}
+
+// FirmwareVersionString returns the firmware version from the TPM device attributes in a human readable form. The version is encoded
+// by the TPM manufacturer as 2 16-bit values, with the major version in the most significant 16 bits and the minor version in the
+// least significant 16 bits. The returned string is formatted as "major.minor".
+func (a *TPMDeviceAttributes) FirmwareVersionString() string {
+	return fmt.Sprintf("%d.%d", a.FirmwareVersion>>16, a.FirmwareVersion&0xffff)
+}
+
+// TPMCommandObserver is a callback that is invoked after each command is executed on a TPMConnection. It is supplied with the code
+// of the command that was executed, the amount of time that elapsed between submitting the command to the TPM and receiving the
+// response header, and the response code from the response header. It is never supplied with any command or response parameters.
+type TPMCommandObserver func(command tpm2.CommandCode, duration time.Duration, rc tpm2.ResponseCode)
+
+// readOnlyCommands are the commands that are permitted on a read-only connection. These don't modify any persistent or hierarchy
+// state on the TPM. TPM2_NV_Read and TPM2_PolicyNV increment the TPM's dictionary attack counter if they are authorized with an
+// incorrect authorization value for a NV index that doesn't have the TPMA_NV_NO_DA attribute set, so these are only permitted if
+// they are authorized with a hierarchy or with a NV index that has this attribute set (see observedTcti.checkNVCommand).
+var readOnlyCommands = map[tpm2.CommandCode]bool{
+	tpm2.CommandContextLoad:       true,
+	tpm2.CommandContextSave:       true,
+	tpm2.CommandFlushContext:      true,
+	tpm2.CommandGetCapability:     true,
+	tpm2.CommandGetRandom:         true,
+	tpm2.CommandGetTestResult:     true,
+	tpm2.CommandLoadExternal:      true,
+	tpm2.CommandNVRead:            true,
+	tpm2.CommandNVReadPublic:      true,
+	tpm2.CommandPCRRead:           true,
+	tpm2.CommandPolicyAuthorize:   true,
+	tpm2.CommandPolicyCommandCode: true,
+	tpm2.CommandPolicyGetDigest:   true,
+	tpm2.CommandPolicyNV:          true,
+	tpm2.CommandPolicyNvWritten:   true,
+	tpm2.CommandPolicyOR:          true,
+	tpm2.CommandPolicyPCR:         true,
+	tpm2.CommandPolicyRestart:     true,
+	tpm2.CommandPolicySigned:      true,
+	tpm2.CommandReadClock:         true,
+	tpm2.CommandReadPublic:        true,
+	tpm2.CommandStartAuthSession:  true,
+	tpm2.CommandVerifySignature:   true,
+}
+
+// observedTcti is a wrapper around a tcti that supports invoking a TPMCommandObserver for each command. It only inspects the
+// command code from each command header and the response code from each response header. It also supports rejecting commands that
+// aren't in readOnlyCommands, for read-only connections.
+type observedTcti struct {
+	io.ReadWriteCloser
+	observer TPMCommandObserver
+	readOnly bool
+
+	command tpm2.CommandCode
+	start   time.Time
+	pending bool
+	rspHdr  []byte
+}
+
+func (t *observedTcti) Write(data []byte) (int, error) {
+	if t.readOnly {
+		if len(data) < 10 {
+			return 0, ErrReadOnlyConnection
+		}
+		command := tpm2.CommandCode(binary.BigEndian.Uint32(data[6:10]))
+		if !readOnlyCommands[command] {
+			return 0, xerrors.Errorf("cannot execute %v: %w", command, ErrReadOnlyConnection)
+		}
+		switch command {
+		case tpm2.CommandNVRead, tpm2.CommandPolicyNV:
+			if err := t.checkNVCommand(command, data); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if t.observer == nil {
+		return t.ReadWriteCloser.Write(data)
+	}
+
+	t.pending = false
+	t.rspHdr = nil
+	if len(data) >= 10 {
+		t.command = tpm2.CommandCode(binary.BigEndian.Uint32(data[6:10]))
+		t.pending = true
+	}
+	t.start = time.Now()
+	return t.ReadWriteCloser.Write(data)
+}
+
+// checkNVCommand returns an error that wraps ErrReadOnlyConnection if the supplied TPM2_NV_Read or TPM2_PolicyNV command is
+// authorized with a NV index that is subject to dictionary attack protection. The first handle of both commands is the
+// authorization handle and the second is the NV index. Hierarchy authorizations other than the lockout hierarchy are exempt from
+// dictionary attack protection, and these commands can't be authorized with the lockout hierarchy.
+func (t *observedTcti) checkNVCommand(command tpm2.CommandCode, data []byte) error {
+	if len(data) < 18 {
+		return xerrors.Errorf("cannot execute %v: %w", command, ErrReadOnlyConnection)
+	}
+	authHandle := tpm2.Handle(binary.BigEndian.Uint32(data[10:14]))
+	index := tpm2.Handle(binary.BigEndian.Uint32(data[14:18]))
+	if authHandle != index {
+		return nil
+	}
+
+	attrs, err := t.nvIndexAttrs(index)
+	if err != nil {
+		return xerrors.Errorf("cannot execute %v because the attributes of %v cannot be determined (%v): %w", command, index, err,
+			ErrReadOnlyConnection)
+	}
+	if attrs&tpm2.AttrNVNoDA == 0 {
+		return xerrors.Errorf("cannot execute %v because %v is subject to dictionary attack protection: %w", command, index,
+			ErrReadOnlyConnection)
+	}
+	return nil
+}
+
+// nvIndexAttrs obtains the attributes of the NV index at the specified handle by submitting a TPM2_NV_ReadPublic command directly
+// to the underlying transport, bypassing the command observer.
+func (t *observedTcti) nvIndexAttrs(handle tpm2.Handle) (tpm2.NVAttributes, error) {
+	cmd := make([]byte, 14)
+	binary.BigEndian.PutUint16(cmd[0:2], uint16(tpm2.TagNoSessions))
+	binary.BigEndian.PutUint32(cmd[2:6], uint32(len(cmd)))
+	binary.BigEndian.PutUint32(cmd[6:10], uint32(tpm2.CommandNVReadPublic))
+	binary.BigEndian.PutUint32(cmd[10:14], uint32(handle))
+	if _, err := t.ReadWriteCloser.Write(cmd); err != nil {
+		return 0, xerrors.Errorf("cannot submit command: %w", err)
+	}
+
+	hdr := make([]byte, 10)
+	if _, err := io.ReadFull(t.ReadWriteCloser, hdr); err != nil {
+		return 0, xerrors.Errorf("cannot read response header: %w", err)
+	}
+	size := binary.BigEndian.Uint32(hdr[2:6])
+	if size < uint32(len(hdr)) {
+		return 0, errors.New("invalid response size")
+	}
+	rsp := make([]byte, size-uint32(len(hdr)))
+	if _, err := io.ReadFull(t.ReadWriteCloser, rsp); err != nil {
+		return 0, xerrors.Errorf("cannot read response: %w", err)
+	}
+	if rc := tpm2.ResponseCode(binary.BigEndian.Uint32(hdr[6:10])); rc != tpm2.ResponseSuccess {
+		return 0, fmt.Errorf("TPM returned an error: %v", rc)
+	}
+
+	// The response parameters begin with a TPM2B_NV_PUBLIC, which contains the index handle (4 bytes), the name algorithm
+	// (2 bytes) and then the attributes (4 bytes).
+	if len(rsp) < 12 {
+		return 0, errors.New("response is too short")
+	}
+	return tpm2.NVAttributes(binary.BigEndian.Uint32(rsp[8:12])), nil
+}
+
+func (t *observedTcti) Read(data []byte) (int, error) {
+	n, err := t.ReadWriteCloser.Read(data)
+	if t.observer == nil || !t.pending {
+		return n, err
+	}
+
+	needed := 10 - len(t.rspHdr)
+	if needed > n {
+		needed = n
+	}
+	t.rspHdr = append(t.rspHdr, data[:needed]...)
+	if len(t.rspHdr) == 10 {
+		t.pending = false
+		t.observer(t.command, time.Since(t.start), tpm2.ResponseCode(binary.BigEndian.Uint32(t.rspHdr[6:10])))
+	}
+	return n, err
+}
+
+// EKVerificationMethod indicates how the endorsement key was verified against the verified endorsement key certificate when a
+// connection was created.
+type EKVerificationMethod int
+
+const (
+	// EKVerificationNone indicates that the endorsement key wasn't verified, because the connection was not created with
+	// SecureConnectToDefaultTPM.
+	EKVerificationNone EKVerificationMethod = iota
+
+	// EKVerificationPersistentMatch indicates that the persistent endorsement key created by ProvisionTPM was successfully
+	// verified.
+	EKVerificationPersistentMatch
+
+	// EKVerificationTransientFallback indicates that there was no persistent endorsement key or that it could not be verified,
+	// and that a transient endorsement key had to be created and verified instead. This indicates that the TPM is not correctly
+	// provisioned.
+	EKVerificationTransientFallback
+
+	// EKVerificationTransientOnly indicates that the connection was created with the TransientOnly option set, and so a transient
+	// endorsement key was created and verified without considering the persistent endorsement key. This says nothing about
+	// whether the TPM is correctly provisioned.
+	EKVerificationTransientOnly
+)
+
+func (m EKVerificationMethod) String() string {
+	switch m {
+	case EKVerificationNone:
+		return "none"
+	case EKVerificationPersistentMatch:
+		return "persistent-match"
+	case EKVerificationTransientFallback:
+		return "transient-fallback"
+	case EKVerificationTransientOnly:
+		return "transient-only"
+	default:
+		return fmt.Sprintf("unknown (%d)", int(m))
+	}
 }
 
 // TPMConnection corresponds to a connection to a TPM device, and is a wrapper around *tpm2.TPMContext.
 type TPMConnection struct {
 	*tpm2.TPMContext
+	tcti                     *observedTcti
 	verifiedEkCertChain      []*x509.Certificate
 	verifiedDeviceAttributes *TPMDeviceAttributes
 	ek                       tpm2.ResourceContext
+	retainTransientEk        bool         // Whether a transient EK created during initialization is retained for the lifetime of the connection
+	ekTemplate               *tpm2.Public // A custom EK template, used instead of the default RSA2048 template if set
+	ignoreEkAuthPolicy       bool         // Whether EK verification ignores the fields of the EK template that aren't relevant to the certificate
+	ekVerificationMethod     EKVerificationMethod
+	transientOnly            bool                 // Whether persistent objects are never used by this connection
+	transientSrk             tpm2.ResourceContext // The transient SRK used when transientOnly is set
 	provisionedSrk           tpm2.ResourceContext
 	hmacSession              tpm2.SessionContext
+	sessionAudit             bool          // Whether session auditing is enabled for hmacSession
+	unsealBenchmark          time.Duration // The cached result of BenchmarkUnseal
 }
 
 // IsEnabled indicates whether the TPM is enabled or whether it has been disabled by the platform firmware. A TPM device can be
@@ -93,12 +394,68 @@ func (t *TPMConnection) IsEnabled() bool {
 	return tpm2.StartupClearAttributes(props[0].Value)&enabledMask == enabledMask
 }
 
+// Ping checks that the TPM is responsive by requesting a single fixed property with TPM2_GetCapability, and returns any transport
+// or TPM error. It doesn't start any sessions, allocate any handles or consume any dictionary attack protection, so it is suitable
+// for periodic liveness checks. An error from the transport indicates that the TPM or the connection to it is not functioning,
+// whereas a TPM warning (eg, TPM_RC_RETRY or TPM_RC_YIELDED) indicates that the TPM is working but busy.
+func (t *TPMConnection) Ping() error {
+	if _, err := t.GetCapabilityTPMProperties(tpm2.PropertyManufacturer, 1); err != nil {
+		return xerrors.Errorf("cannot request property from TPM: %w", err)
+	}
+	return nil
+}
+
+// Warmup issues a benign read-only command to the TPM in order to trigger any deferred firmware initialization, so that a later
+// boot-critical operation such as unsealing isn't delayed by it. It is intended to be called as soon as the connection is opened,
+// from a separate goroutine if necessary, whilst other setup proceeds in parallel. Like Ping, it doesn't start any sessions,
+// allocate any handles or consume any dictionary attack protection.
+//
+// If the TPM responds with a warning that indicates that it is busy or still initializing (TPM_RC_RETRY, TPM_RC_YIELDED or
+// TPM_RC_TESTING), the command is retried until the TPM responds successfully, or until a timeout is reached in which case an
+// error is returned. Any other error is returned immediately.
+func (t *TPMConnection) Warmup() error {
+	for start := time.Now(); ; time.Sleep(warmupPollInterval) {
+		_, err := t.GetCapabilityTPMProperties(tpm2.PropertyManufacturer, 1)
+		busy := tpm2.IsTPMWarning(err, tpm2.WarningRetry, tpm2.CommandGetCapability) ||
+			tpm2.IsTPMWarning(err, tpm2.WarningYielded, tpm2.CommandGetCapability) ||
+			tpm2.IsTPMWarning(err, tpm2.WarningTesting, tpm2.CommandGetCapability)
+		switch {
+		case err == nil:
+			return nil
+		case busy && time.Since(start) < warmupTimeout:
+			continue
+		case busy:
+			return errors.New("timeout waiting for the TPM to become responsive")
+		default:
+			return xerrors.Errorf("cannot request property from TPM: %w", err)
+		}
+	}
+}
+
 // VerifiedEKCertChain returns the verified certificate chain for the endorsement key certificate obtained from this TPM. It was
 // verified using one of the built-in TPM manufacturer root CA certificates.
 func (t *TPMConnection) VerifiedEKCertChain() []*x509.Certificate {
 	return t.verifiedEkCertChain
 }
 
+// ExportVerifiedEKCertChainPEM writes the verified certificate chain for the endorsement key certificate obtained from this TPM to
+// w as a sequence of PEM encoded certificates, in order from the endorsement key certificate to the root CA certificate. This is
+// suitable for logging or for persisting the chain after the first verification.
+//
+// If the connection was not created with SecureConnectToDefaultTPM, then no certificate chain will have been verified and a
+// ErrNoVerifiedEKCertChain error will be returned.
+func (t *TPMConnection) ExportVerifiedEKCertChainPEM(w io.Writer) error {
+	if len(t.verifiedEkCertChain) == 0 {
+		return ErrNoVerifiedEKCertChain
+	}
+	for _, cert := range t.verifiedEkCertChain {
+		if err := pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return xerrors.Errorf("cannot encode certificate: %w", err)
+		}
+	}
+	return nil
+}
+
 // VerifiedDeviceAttributes returns the TPM device attributes for this TPM, obtained from the verified endorsement key certificate.
 func (t *TPMConnection) VerifiedDeviceAttributes() *TPMDeviceAttributes {
 	return t.verifiedDeviceAttributes
@@ -107,6 +464,11 @@ func (t *TPMConnection) VerifiedDeviceAttributes() *TPMDeviceAttributes {
 // EndorsementKey returns a reference to the TPM's persistent endorsement key, if one exists. If the endorsement key certificate has
 // been verified, the returned ResourceContext will correspond to the object for which the certificate was issued and can safely be
 // used to share secrets with the TPM.
+//
+// If the connection was created with SecureConnectToDefaultTPMWithOptions with the RetainTransientEK option set and a transient
+// endorsement key had to be created, or with the TransientOnly option set, this returns a reference to the transient endorsement
+// key. It remains loaded until the
+// connection is closed.
 func (t *TPMConnection) EndorsementKey() (tpm2.ResourceContext, error) {
 	if t.ek == nil {
 		return nil, ErrTPMProvisioning
@@ -114,6 +476,13 @@ func (t *TPMConnection) EndorsementKey() (tpm2.ResourceContext, error) {
 	return t.ek, nil
 }
 
+// EKVerificationMethod indicates how the endorsement key was verified when the connection was created. If this returns
+// EKVerificationTransientFallback, the persistent endorsement key is missing or invalid and the TPM should be re-provisioned with
+// ProvisionTPM. If the connection was created with the TransientOnly option set, this returns EKVerificationTransientOnly.
+func (t *TPMConnection) EKVerificationMethod() EKVerificationMethod {
+	return t.ekVerificationMethod
+}
+
 // HmacSession returns a HMAC session instance which was created in order to conduct a proof-of-ownership check of the private part
 // of the endorsement key on the TPM. It is retained in order to reduce the number of sessions that need to be created during unseal
 // operations, and is created with a symmetric algorithm so that it is suitable for parameter encryption.
@@ -126,28 +495,161 @@ func (t *TPMConnection) HmacSession() tpm2.SessionContext {
 	if t.hmacSession == nil {
 		return nil
 	}
+	if t.sessionAudit {
+		return t.hmacSession.WithAttrs(tpm2.AttrContinueSession | tpm2.AttrAudit)
+	}
 	return t.hmacSession.WithAttrs(tpm2.AttrContinueSession)
 }
 
+// FirmwareVersionString returns the firmware version of the TPM in a human readable form, obtained from the TPM_PT_FIRMWARE_VERSION_1
+// and TPM_PT_FIRMWARE_VERSION_2 properties. TPM_PT_FIRMWARE_VERSION_1 contains the major and minor version in its most and least
+// significant 16 bits respectively. TPM_PT_FIRMWARE_VERSION_2 contains additional vendor specific version information. If
+// TPM_PT_FIRMWARE_VERSION_2 is non-zero, the returned string is formatted as "major.minor.x.y", where x and y are the most and least
+// significant 16 bits of TPM_PT_FIRMWARE_VERSION_2. Otherwise, it is formatted as "major.minor".
+//
+// Note that this is obtained directly from the TPM and is not authenticated. The firmware version obtained from the verified
+// endorsement key certificate can be obtained from VerifiedDeviceAttributes.
+func (t *TPMConnection) FirmwareVersionString() (string, error) {
+	props, err := t.GetCapabilityTPMProperties(tpm2.PropertyFirmwareVersion1, 2, t.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return "", xerrors.Errorf("cannot request firmware version properties from TPM: %w", err)
+	}
+
+	var v1, v2 uint32
+	for _, prop := range props {
+		switch prop.Property {
+		case tpm2.PropertyFirmwareVersion1:
+			v1 = prop.Value
+		case tpm2.PropertyFirmwareVersion2:
+			v2 = prop.Value
+		}
+	}
+
+	s := fmt.Sprintf("%d.%d", v1>>16, v1&0xffff)
+	if v2 != 0 {
+		s += fmt.Sprintf(".%d.%d", v2>>16, v2&0xffff)
+	}
+	return s, nil
+}
+
+// RunSelfTest executes TPM2_SelfTest on the TPM and then waits for the tests to complete. If full is true, the TPM will test all
+// functions. If full is false, the TPM will only test functions that haven't already been tested. This can be used by recovery
+// tooling to attempt to clear the condition if the TPM is in failure mode.
+//
+// If the self tests fail and the TPM is in failure mode, a ErrTPMFailure error will be returned. In this case, a TPM reset is
+// required in order to attempt recovery from failure mode.
+//
+// If the self tests succeed and the connection was created whilst the TPM was in failure mode, the connection should be closed and
+// a new connection created.
+func (t *TPMConnection) RunSelfTest(full bool) error {
+	if err := t.SelfTest(full); err != nil {
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorFailure, tpm2.CommandSelfTest):
+			return ErrTPMFailure
+		case tpm2.IsTPMWarning(err, tpm2.WarningTesting, tpm2.CommandSelfTest):
+			// Tests are running in the background.
+		default:
+			return xerrors.Errorf("cannot execute self test: %w", err)
+		}
+	}
+
+	// Wait for the tests to complete
+	for start := time.Now(); ; time.Sleep(selfTestPollInterval) {
+		_, rc, err := t.GetTestResult()
+		if err != nil {
+			return xerrors.Errorf("cannot obtain self test result: %w", err)
+		}
+		switch {
+		case rc == responseFailure:
+			return ErrTPMFailure
+		case rc == responseTesting && time.Since(start) < selfTestTimeout:
+			continue
+		case rc == responseTesting:
+			return errors.New("timeout waiting for self tests to complete")
+		case rc != tpm2.ResponseSuccess:
+			return fmt.Errorf("self test failed with response code 0x%08x", rc)
+		}
+		return nil
+	}
+}
+
+// SetCommandObserver registers a callback that will be invoked after each command is executed on this connection, which can be
+// used to gather statistics about the latency of each TPM command. The callback is invoked synchronously from the goroutine that
+// executed the command, and so it should return quickly. The callback is never supplied with any command or response parameters.
+// Supplying a nil callback disables it.
+func (t *TPMConnection) SetCommandObserver(fn TPMCommandObserver) {
+	if t.tcti == nil {
+		return
+	}
+	t.tcti.observer = fn
+}
+
+// IsReadOnly indicates whether this connection was created with ConnectToDefaultTPMReadOnly.
+func (t *TPMConnection) IsReadOnly() bool {
+	return t.tcti != nil && t.tcti.readOnly
+}
+
 func (t *TPMConnection) Close() error {
-	t.FlushContext(t.hmacSession)
+	if t.hmacSession != nil {
+		// There is no session if the connection was created whilst the TPM was in failure mode.
+		t.FlushContext(t.hmacSession)
+	}
+	if t.ek != nil && t.ek.Handle() != ekHandle {
+		t.FlushContext(t.ek)
+	}
+	if t.transientSrk != nil {
+		t.FlushContext(t.transientSrk)
+	}
 	return t.TPMContext.Close()
 }
 
-// createTransientEk creates a new primary key in the endorsement hierarchy using the default RSA2048 EK template.
-func createTransientEk(tpm *tpm2.TPMContext) (tpm2.ResourceContext, error) {
+// endorsementKeyTemplate returns the template used to create and verify the endorsement key for this connection. This is the
+// default RSA2048 EK template unless a custom one has been supplied.
+func (t *TPMConnection) endorsementKeyTemplate() *tpm2.Public {
+	if t.ekTemplate != nil {
+		return t.ekTemplate
+	}
+	return ekTemplate
+}
+
+// storageRootKey returns a context for the storage root key that sealed key objects are created under and loaded in to. This is
+// the persistent storage root key, unless the connection was created with the TransientOnly option set. In that case, a transient
+// storage root key is created on first use from the same template that ProvisionTPM uses for the persistent storage root key, and
+// it remains loaded until the connection is closed.
+// Creating it requires knowledge of the authorization value for the storage hierarchy.
+func (t *TPMConnection) storageRootKey(session tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	if !t.transientOnly {
+		return t.CreateResourceContextFromTPM(srkHandle)
+	}
+	if t.transientSrk != nil {
+		return t.transientSrk, nil
+	}
+	template, _, err := readStorageRootKeyTemplate(t.TPMContext)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot determine storage root key template: %w", err)
+	}
+	srk, _, _, _, _, err := t.CreatePrimary(t.OwnerHandleContext(), nil, template, nil, nil, session)
+	if err != nil {
+		return nil, err
+	}
+	t.transientSrk = srk
+	return srk, nil
+}
+
+// createTransientEk creates a new primary key in the endorsement hierarchy using the supplied EK template.
+func createTransientEk(tpm *tpm2.TPMContext, template *tpm2.Public) (tpm2.ResourceContext, error) {
 	session, err := tpm.StartAuthSession(nil, tpm.EndorsementHandleContext(), tpm2.SessionTypeHMAC, nil, tpm2.HashAlgorithmSHA256)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot start auth session: %w", err)
 	}
 	defer tpm.FlushContext(session)
 
-	ek, _, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, ekTemplate, nil, nil, session)
+	ek, _, _, _, _, err := tpm.CreatePrimary(tpm.EndorsementHandleContext(), nil, template, nil, nil, session)
 	return ek, err
 }
 
 // verifyEk verifies that the public area of the ResourceContext that was read back from the TPM is associated with the supplied EK
-// certificate. It does this by obtaining the public key from the EK certificate, inserting it in to the standard EK template,
+// certificate. It does this by obtaining the public key from the EK certificate, inserting it in to the supplied EK template,
 // computing the expected name of the EK object and then verifying that this name matches the result of ResourceContext.Name. This
 // works because go-tpm2 cross-checks that the name and public area returned from TPM2_ReadPublic match when initializing the
 // ResourceContext.
@@ -156,7 +658,11 @@ func createTransientEk(tpm *tpm2.TPMContext) (tpm2.ResourceContext, error) {
 // If that certificate has been verified, the ResourceContext can safely be used to encrypt secrets that can only be decrpyted and
 // used by the TPM for which the EK certificate was issued, eg, for salting an authorization session that is then used for parameter
 // encryption.
-func verifyEk(cert *x509.Certificate, ek tpm2.ResourceContext) error {
+func verifyEk(cert *x509.Certificate, ek tpm2.ResourceContext, template *tpm2.Public) error {
+	if template.Type != tpm2.ObjectTypeRSA {
+		return errors.New("unsupported EK template type")
+	}
+
 	// Obtain the RSA public key from the endorsement certificate
 	pubKey, ok := cert.PublicKey.(*rsa.PublicKey)
 	if !ok {
@@ -165,7 +671,7 @@ func verifyEk(cert *x509.Certificate, ek tpm2.ResourceContext) error {
 
 	// Insert the RSA public key in to the EK template to compute the name of the EK object we expected to read back from the TPM.
 	var ekPublic *tpm2.Public
-	b, _ := tpm2.MarshalToBytes(ekTemplate)
+	b, _ := tpm2.MarshalToBytes(template)
 	tpm2.UnmarshalFromBytes(b, &ekPublic)
 
 	// The default exponent of 2^^16-1 is indicated by the value of 0 in the public area.
@@ -199,6 +705,34 @@ func verifyEk(cert *x509.Certificate, ek tpm2.ResourceContext) error {
 	return nil
 }
 
+// ekTemplateWithAuthFieldsFrom returns a copy of the supplied EK template with the name algorithm, attributes and authorization
+// policy replaced by those from pub. Verifying an EK against the returned template with verifyEk only checks the fields that are
+// relevant to the EK certificate - the key type, parameters and public key.
+func ekTemplateWithAuthFieldsFrom(template, pub *tpm2.Public) *tpm2.Public {
+	var out *tpm2.Public
+	b, _ := tpm2.MarshalToBytes(template)
+	tpm2.UnmarshalFromBytes(b, &out)
+
+	out.NameAlg = pub.NameAlg
+	out.Attrs = pub.Attrs
+	out.AuthPolicy = pub.AuthPolicy
+	return out
+}
+
+// verifyEk verifies that the supplied ResourceContext is associated with the verified EK certificate for this connection, using the
+// EK template for this connection.
+func (t *TPMConnection) verifyEk(ek tpm2.ResourceContext) error {
+	template := t.endorsementKeyTemplate()
+	if t.ignoreEkAuthPolicy {
+		pub, _, _, err := t.ReadPublic(ek)
+		if err != nil {
+			return xerrors.Errorf("cannot read public area of endorsement key: %w", err)
+		}
+		template = ekTemplateWithAuthFieldsFrom(template, pub)
+	}
+	return verifyEk(t.verifiedEkCertChain[0], ek, template)
+}
+
 type verificationError struct {
 	err error
 }
@@ -213,13 +747,24 @@ func (t *TPMConnection) init() error {
 		t.FlushContext(t.hmacSession)
 		t.hmacSession = nil
 	}
+	if t.ek != nil && t.ek.Handle() != ekHandle {
+		// Flush a previously retained transient EK
+		t.FlushContext(t.ek)
+	}
 	t.ek = nil
+	t.ekVerificationMethod = EKVerificationNone
 	t.provisionedSrk = nil
+	if t.transientSrk != nil {
+		t.FlushContext(t.transientSrk)
+		t.transientSrk = nil
+	}
 
 	secureMode := len(t.verifiedEkCertChain) > 0
 
 	// Acquire an unverified ResourceContext for the EK. If there is no object at the persistent EK index, then attempt to create
-	// a transient EK with the supplied authorization if this is a secure connection.
+	// a transient EK with the supplied authorization if this is a secure connection. If the connection was created with the
+	// TransientOnly option, always create a transient EK and never use the persistent one. In this case, if the transient EK can't
+	// be created on a connection that isn't secure, the HMAC session is not salted.
 	//
 	// Under the hood, go-tpm2 initializes the ResourceContext with TPM2_ReadPublic (or TPM2_CreatePrimary if we create a new one),
 	// and it cross-checks that the returned name and public area match. The returned name is available via ek.Name and the
@@ -227,6 +772,14 @@ func (t *TPMConnection) init() error {
 	//
 	// Without verification against the EK certificate, ek isn't yet safe to use for secret sharing with the TPM.
 	ek, err := func() (tpm2.ResourceContext, error) {
+		if t.transientOnly {
+			// Don't use the persistent EK, even if there is one.
+			ek, err := createTransientEk(t.TPMContext, t.endorsementKeyTemplate())
+			if err == nil || secureMode {
+				return ek, err
+			}
+			return nil, nil
+		}
 		ek, err := t.CreateResourceContextFromTPM(ekHandle)
 		if err == nil || !secureMode {
 			return ek, nil
@@ -234,7 +787,7 @@ func (t *TPMConnection) init() error {
 		if !tpm2.IsResourceUnavailableError(err, ekHandle) {
 			return nil, err
 		}
-		if ek, err := createTransientEk(t.TPMContext); err == nil {
+		if ek, err := createTransientEk(t.TPMContext, t.endorsementKeyTemplate()); err == nil {
 			return ek, nil
 		}
 		return nil, err
@@ -249,7 +802,7 @@ func (t *TPMConnection) init() error {
 	}
 
 	defer func() {
-		if ek == nil || ekIsPersistent() {
+		if ek == nil || ekIsPersistent() || ek == t.ek {
 			return
 		}
 		t.FlushContext(ek)
@@ -260,7 +813,7 @@ func (t *TPMConnection) init() error {
 		// object, then try to create a transient EK with the provided authorization and make another attempt at verification, in case
 		// the persistent object isn't a valid EK.
 		rc, err := func() (tpm2.ResourceContext, error) {
-			err := verifyEk(t.verifiedEkCertChain[0], ek)
+			err := t.verifyEk(ek)
 			if err == nil {
 				return nil, nil
 			}
@@ -268,11 +821,11 @@ func (t *TPMConnection) init() error {
 				// If this was already a transient EK, fail now
 				return nil, err
 			}
-			transientEk, err2 := createTransientEk(t.TPMContext)
+			transientEk, err2 := createTransientEk(t.TPMContext, t.endorsementKeyTemplate())
 			if err2 != nil {
 				return nil, err
 			}
-			err = verifyEk(t.verifiedEkCertChain[0], transientEk)
+			err = t.verifyEk(transientEk)
 			if err == nil {
 				return transientEk, nil
 			}
@@ -288,7 +841,7 @@ func (t *TPMConnection) init() error {
 	} else if ek != nil {
 		// If we don't have a verified EK certificate and ek is a persistent object, just do a sanity check that the public area returned
 		// from the TPM has the expected properties. If it doesn't, then don't use it, as TPM2_StartAuthSession might fail.
-		if ok, err := isObjectPrimaryKeyWithTemplate(t.TPMContext, t.EndorsementHandleContext(), ek, ekTemplate, nil); err != nil {
+		if ok, err := isObjectPrimaryKeyWithTemplate(t.TPMContext, t.EndorsementHandleContext(), ek, t.endorsementKeyTemplate(), nil); err != nil {
 			return xerrors.Errorf("cannot determine if object is a primary key in the endorsement hierarchy: %w", err)
 		} else if !ok {
 			ek = nil
@@ -327,7 +880,17 @@ func (t *TPMConnection) init() error {
 
 	succeeded = true
 
-	if ekIsPersistent() {
+	if secureMode {
+		switch {
+		case t.transientOnly:
+			t.ekVerificationMethod = EKVerificationTransientOnly
+		case ekIsPersistent():
+			t.ekVerificationMethod = EKVerificationPersistentMatch
+		default:
+			t.ekVerificationMethod = EKVerificationTransientFallback
+		}
+	}
+	if ekIsPersistent() || (ek != nil && (t.retainTransientEk || t.transientOnly)) {
 		t.ek = ek
 	}
 	t.hmacSession = session
@@ -347,7 +910,7 @@ func readEkCertFromTPM(tpm *tpm2.TPMContext) ([]byte, error) {
 		return nil, xerrors.Errorf("cannot read public area of index: %w", err)
 	}
 
-	cert, err := tpm.NVRead(ekCertIndex, ekCertIndex, ekCertPub.Size, 0, nil)
+	cert, err := nvRead(tpm, ekCertIndex, ekCertIndex, ekCertPub.Size, 0, nil)
 	if err != nil {
 		return nil, xerrors.Errorf("cannot read index: %w", err)
 	}
@@ -360,28 +923,61 @@ var openDefaultTcti = func() (io.ReadWriteCloser, error) {
 	return tpm2.OpenTPMDevice(tpmPath)
 }
 
+// isTPMInFailureMode determines whether the TPM is in failure mode. In failure mode, TPM2_GetTestResult returns TPM_RC_FAILURE as
+// the test result, and all commands other than TPM2_GetTestResult and TPM2_GetCapability return TPM_RC_FAILURE. TPM2_GetCapability
+// will only return a limited set of properties in failure mode (TPM_PT_MANUFACTURER, TPM_PT_VENDOR_STRING_*, TPM_PT_VENDOR_TPM_TYPE
+// and TPM_PT_FIRMWARE_VERSION_*).
+func isTPMInFailureMode(tpm *tpm2.TPMContext) (bool, error) {
+	_, rc, err := tpm.GetTestResult()
+	if err != nil {
+		return false, err
+	}
+	return rc == responseFailure, nil
+}
+
+// isTPMNotStartedError indicates whether the supplied error is a TPM_RC_INITIALIZE error, which is returned for every command
+// until the TPM has been started with TPM2_Startup. The platform firmware is responsible for starting the TPM, and it doesn't do
+// this if the TPM has been disabled in the firmware settings.
+func isTPMNotStartedError(err error) bool {
+	return tpm2.IsTPMError(err, tpm2.ErrorInitialize, tpm2.AnyCommandCode)
+}
+
 // connectToDefaultTPM opens a connection to the default TPM device.
-func connectToDefaultTPM() (*tpm2.TPMContext, error) {
-	tcti, err := openDefaultTcti()
+func connectToDefaultTPM() (*tpm2.TPMContext, *observedTcti, error) {
+	rawTcti, err := openDefaultTcti()
 	if err != nil {
 		if isPathError(err) {
-			return nil, ErrNoTPM2Device
+			return nil, nil, ErrNoTPM2Device
 		}
-		return nil, xerrors.Errorf("cannot open TPM device: %w", err)
+		return nil, nil, xerrors.Errorf("cannot open TPM device: %w", err)
 	}
 
+	tcti := &observedTcti{ReadWriteCloser: rawTcti}
 	tpm, _ := tpm2.NewTPMContext(tcti)
 	isTpm2, err := tpm.IsTPM2()
-	if err != nil {
+	switch {
+	case isTPMNotStartedError(err):
 		tpm.Close()
-		return nil, xerrors.Errorf("cannot determine if TPM is a TPM2 device: %w", err)
+		return nil, nil, ErrTPMDisabled
+	case err != nil:
+		tpm.Close()
+		return nil, nil, xerrors.Errorf("cannot determine if TPM is a TPM2 device: %w", err)
 	}
 	if !isTpm2 {
 		tpm.Close()
-		return nil, ErrNoTPM2Device
+		return nil, nil, ErrNoTPM2Device
 	}
 
-	return tpm, nil
+	failureMode, err := isTPMInFailureMode(tpm)
+	if err != nil {
+		tpm.Close()
+		return nil, nil, xerrors.Errorf("cannot determine if TPM is in failure mode: %w", err)
+	}
+	if failureMode {
+		return tpm, tcti, ErrTPMFailure
+	}
+
+	return tpm, tcti, nil
 }
 
 func isExtKeyUsageAny(usage []x509.ExtKeyUsage) bool {
@@ -436,10 +1032,16 @@ func parseTPMDeviceAttributesFromDirectoryName(dirName pkix.RDNSequence) (*TPMDe
 
 	hasManufacturer, hasModel, hasVersion := false, false, false
 
+	ekCertAttributeOIDsMu.Lock()
+	manufacturerOIDs := extraTpmManufacturerOIDs
+	modelOIDs := extraTpmModelOIDs
+	versionOIDs := extraTpmVersionOIDs
+	ekCertAttributeOIDsMu.Unlock()
+
 	for _, rdns := range dirName {
 		for _, atv := range rdns {
 			switch {
-			case atv.Type.Equal(oidTcgAttributeTpmManufacturer):
+			case isOIDInSet(atv.Type, oidTcgAttributeTpmManufacturer, manufacturerOIDs):
 				if hasManufacturer {
 					return nil, nil, asn1.StructuralError{Msg: "duplicate TPM manufacturer"}
 				}
@@ -459,7 +1061,7 @@ func parseTPMDeviceAttributesFromDirectoryName(dirName pkix.RDNSequence) (*TPMDe
 					return nil, nil, asn1.StructuralError{Msg: "invalid TPM manufacturer: too short"}
 				}
 				attrs.Manufacturer = tpm2.TPMManufacturer(binary.BigEndian.Uint32(hex))
-			case atv.Type.Equal(oidTcgAttributeTpmModel):
+			case isOIDInSet(atv.Type, oidTcgAttributeTpmModel, modelOIDs):
 				if hasModel {
 					return nil, nil, asn1.StructuralError{Msg: "duplicate TPM model"}
 				}
@@ -469,7 +1071,7 @@ func parseTPMDeviceAttributesFromDirectoryName(dirName pkix.RDNSequence) (*TPMDe
 					return nil, nil, asn1.StructuralError{Msg: "invalid TPM attribute value"}
 				}
 				attrs.Model = s
-			case atv.Type.Equal(oidTcgAttributeTpmVersion):
+			case isOIDInSet(atv.Type, oidTcgAttributeTpmVersion, versionOIDs):
 				if hasVersion {
 					return nil, nil, asn1.StructuralError{Msg: "duplicate TPM firmware version"}
 				}
@@ -540,6 +1142,20 @@ func parseTPMDeviceAttributesFromSAN(data []byte) (*TPMDeviceAttributes, pkix.RD
 	return nil, nil, errors.New("no directoryName")
 }
 
+// parseTPMDeviceAttributesFromSubject attempts to extract the TPM device attributes from the subject distinguished name of the
+// supplied certificate. This is a fallback for vendors that don't encode the attributes in the subject alternative name extension.
+func parseTPMDeviceAttributesFromSubject(cert *x509.Certificate) (*TPMDeviceAttributes, error) {
+	var subject pkix.RDNSequence
+	if rest, err := asn1.Unmarshal(cert.RawSubject, &subject); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing bytes after subject")
+	}
+
+	attrs, _, err := parseTPMDeviceAttributesFromDirectoryName(subject)
+	return attrs, err
+}
+
 // isCertificateTrustedCA determines whether the supplied certificate is one of the trusted root CAs by comparing a digest of it
 // with the built-in digests.
 func isCertificateTrustedCA(cert *x509.Certificate) bool {
@@ -601,19 +1217,19 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttri
 	}
 
 	var attrs *TPMDeviceAttributes
+	var sanErr error
 	for _, e := range cert.Extensions {
 		if e.Id.Equal(oidExtensionSubjectAltName) {
 			// SubjectAltName MUST be critical if subject is empty
 			if len(cert.Subject.Names) == 0 && !e.Critical {
 				return nil, nil, errors.New("certificate with empty subject contains non-critical SAN extension")
 			}
-			var err error
 			var attrsRDN pkix.RDNSequence
-			attrs, attrsRDN, err = parseTPMDeviceAttributesFromSAN(e.Value)
-			// SubjectAltName MUST include TPM manufacturer, model and firmware version
-			if err != nil {
-				return nil, nil, xerrors.Errorf("cannot parse TPM device attributes: %w", err)
+			attrs, attrsRDN, sanErr = parseTPMDeviceAttributesFromSAN(e.Value)
+			if sanErr != nil {
+				break
 			}
+			attrs.Source = TPMDeviceAttributesFromSAN
 			if len(cert.Subject.Names) == 0 {
 				// If subject is empty, fill the Subject field with the TPM device attributes so that String() returns something useful
 				cert.Subject.FillFromRDNSequence(&attrsRDN)
@@ -623,9 +1239,19 @@ func verifyEkCertificate(data *ekCertData) ([]*x509.Certificate, *TPMDeviceAttri
 		}
 	}
 
-	// SubjectAltName MUST exist. If it does exist but doesn't contain the correct TPM device attributes, we would have returned earlier.
+	// SubjectAltName MUST include TPM manufacturer, model and firmware version. Some vendors put these in the subject instead, so
+	// fall back to that if the SAN extension is missing or doesn't contain the correct TPM device attributes.
 	if attrs == nil {
-		return nil, nil, errors.New("certificate has no SAN extension")
+		var err error
+		attrs, err = parseTPMDeviceAttributesFromSubject(cert)
+		switch {
+		case err == nil:
+			attrs.Source = TPMDeviceAttributesFromSubject
+		case sanErr != nil:
+			return nil, nil, xerrors.Errorf("cannot parse TPM device attributes: %w", sanErr)
+		default:
+			return nil, nil, errors.New("certificate has no SAN extension")
+		}
 	}
 
 	// If SAN contains only fields unhandled by crypto/x509 and it is marked as critical, then it ends up here. Remove it because
@@ -845,19 +1471,102 @@ func EncodeEKCertificateChain(ekCert *x509.Certificate, parents []*x509.Certific
 	return nil
 }
 
+// decodePEMCertificates decodes all of the PEM encoded certificates read from the supplied io.Reader, preserving the order in which
+// they appear.
+func decodePEMCertificates(r io.Reader) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read data: %w", err)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type \"%s\"", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates found")
+	}
+
+	return certs, nil
+}
+
+// EncodeEKCertificateChainPEM is a variant of EncodeEKCertificateChain that reads the certificates from PEM encoded data rather than
+// requiring them to be parsed by the caller. The EK certificate is read from ekCert, and the associated parent certificates are read
+// from parents. The data read from either io.Reader can contain more than one certificate. Certificates are written in the order in
+// which they appear, with any certificates read from ekCert preceding those read from parents. The first certificate read from ekCert
+// is the EK certificate, and any subsequent certificates read from ekCert are treated as parent certificates.
+//
+// If ekCert is nil, then the output won't contain a EK certificate, in the same way as when EncodeEKCertificateChain is called with a
+// nil ekCert argument.
+//
+// An error will be returned if either io.Reader doesn't provide any certificates, or if any PEM block read from either io.Reader isn't
+// a certificate.
+func EncodeEKCertificateChainPEM(ekCert, parents io.Reader, w io.Writer) error {
+	var certs []*x509.Certificate
+	if ekCert != nil {
+		c, err := decodePEMCertificates(ekCert)
+		if err != nil {
+			return xerrors.Errorf("cannot decode EK certificate: %w", err)
+		}
+		certs = c
+	}
+
+	if parents != nil {
+		c, err := decodePEMCertificates(parents)
+		if err != nil {
+			return xerrors.Errorf("cannot decode parent certificates: %w", err)
+		}
+		certs = append(certs, c...)
+	}
+
+	if len(certs) == 0 {
+		return errors.New("no certificates provided")
+	}
+
+	if ekCert == nil {
+		return EncodeEKCertificateChain(nil, certs, w)
+	}
+	return EncodeEKCertificateChain(certs[0], certs[1:], w)
+}
+
 // ConnectToDefaultTPM will attempt to connect to the default TPM. It makes no attempt to verify the authenticity of the TPM. This
 // function is useful for connecting to a device that isn't correctly provisioned and for which the endorsement hierarchy
 // authorization value is unknown (so that it can be cleared), or for connecting to a device in order to execute
 // FetchAndSaveEKCertificateChain. It should not be used in any other scenario.
 //
 // If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
+//
+// If a TPM2 device is available but it has been disabled by the platform firmware, then a ErrTPMDisabled error will be returned.
+// Note that a TPM for which the platform firmware has only disabled the storage and endorsement hierarchies will be connected to
+// successfully - use TPMConnection.IsEnabled to detect this case.
+//
+// If the TPM is in failure mode, then a ErrTPMFailure error will be returned. Unlike every other error returned from this function,
+// this is returned along with a non-nil connection, which can only be used to call TPMConnection.RunSelfTest in order to attempt
+// recovery. The caller must close this connection, even though an error was returned. The connection is not initialized - it
+// has no HMAC session and no endorsement key.
 func ConnectToDefaultTPM() (*TPMConnection, error) {
-	tpm, err := connectToDefaultTPM()
-	if err != nil {
+	tpm, tcti, err := connectToDefaultTPM()
+	switch {
+	case err == ErrTPMFailure:
+		return &TPMConnection{TPMContext: tpm, tcti: tcti}, err
+	case err != nil:
 		return nil, err
 	}
 
-	t := &TPMConnection{TPMContext: tpm}
+	t := &TPMConnection{TPMContext: tpm, tcti: tcti}
 
 	succeeded := false
 	defer func() {
@@ -878,6 +1587,26 @@ func ConnectToDefaultTPM() (*TPMConnection, error) {
 	return t, nil
 }
 
+// ConnectToDefaultTPMReadOnly will attempt to connect to the default TPM in the same way as ConnectToDefaultTPM, and returns a
+// connection that is guaranteed not to modify the state of the TPM. This is intended for processes that only observe the TPM, such
+// as monitoring daemons. Only commands that read state (eg, TPM2_GetCapability, TPM2_PCR_Read, TPM2_ReadPublic, TPM2_NV_ReadPublic
+// and TPM2_NV_Read) and commands required to create and execute policy sessions that don't consume dictionary attack protection are
+// permitted on the returned connection. TPM2_NV_Read and TPM2_PolicyNV are only permitted if they are authorized with the owner or
+// platform hierarchy, or with a NV index that has the TPMA_NV_NO_DA attribute set, as authorization failures for other NV indices
+// increment the TPM's dictionary attack counter. Any other command (eg, TPM2_EvictControl, TPM2_NV_Write or TPM2_HierarchyChangeAuth) is
+// rejected without being submitted to the TPM, with an error that wraps ErrReadOnlyConnection. This means that functions such as
+// ProvisionTPM and SealKeyToTPM will fail when supplied with the returned connection.
+//
+// This returns the same errors as ConnectToDefaultTPM. If the TPM is in failure mode, the returned connection is also read-only
+// and so cannot be used to call TPMConnection.RunSelfTest.
+func ConnectToDefaultTPMReadOnly() (*TPMConnection, error) {
+	t, err := ConnectToDefaultTPM()
+	if t != nil && t.tcti != nil {
+		t.tcti.readOnly = true
+	}
+	return t, err
+}
+
 // SecureConnectToDefaultTPM will attempt to connect to the default TPM, verify the manufacturer issued endorsement key certificate
 // against the built-in CA roots and then verify that the TPM is the one for which the endorsement certificate was issued.
 //
@@ -907,13 +1636,108 @@ func ConnectToDefaultTPM() (*TPMConnection, error) {
 // authorization value hasn't been provided via the endorsementAuth argument.
 //
 // If no TPM2 device is available, then a ErrNoTPM2Device error will be returned.
+//
+// If a TPM2 device is available but it has been disabled by the platform firmware, then a ErrTPMDisabled error will be returned.
+//
+// If the TPM is in failure mode, then a ErrTPMFailure error will be returned.
 func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byte) (*TPMConnection, error) {
+	return SecureConnectToDefaultTPMWithOptions(ekCertDataReader, endorsementAuth, nil)
+}
+
+// SecureConnectOptions provides options to SecureConnectToDefaultTPMWithOptions.
+type SecureConnectOptions struct {
+	// RetainTransientEK indicates that if a transient endorsement key has to be created because there isn't a valid persistent
+	// endorsement key, it should remain loaded for the lifetime of the connection rather than being flushed once the connection
+	// has been verified. It is made available via TPMConnection.EndorsementKey and is used by subsequent operations that require
+	// the endorsement key, avoiding the cost of recreating it each time. It is flushed by TPMConnection.Close.
+	RetainTransientEK bool
+
+	// SkipEKCertNVRead indicates that the endorsement key certificate must be provided by the data read from ekCertDataReader,
+	// and that it should never be read from the TPM's NV storage. This is useful on devices where reading the endorsement key
+	// certificate NV index is disallowed at runtime but the certificate is available from manufacturing. If this is set and the
+	// supplied data doesn't contain an endorsement key certificate, a EKCertVerificationError error will be returned without
+	// accessing the TPM's NV storage.
+	SkipEKCertNVRead bool
+
+	// EKTemplate can be used to supply a custom template for the endorsement key, for TPMs where the endorsement key certificate
+	// was issued for a key created from a template other than the default RSA2048 template defined in the TCG EK Credential
+	// Profile (eg, one with a different authorization policy or with the noda attribute set). It is used when creating a transient
+	// endorsement key and when verifying the endorsement key against the endorsement key certificate. Only RSA templates are
+	// supported. If this is nil, the default template is used.
+	EKTemplate *tpm2.Public
+
+	// IgnoreEKAuthPolicy indicates that when verifying the endorsement key against the endorsement key certificate, only the fields
+	// of the template that are relevant to the certificate (the key type, parameters and public key) should be compared. Differences
+	// in the name algorithm, object attributes and authorization policy between the endorsement key and the template are ignored.
+	// The proof of ownership check performed during connection still ensures that the TPM has the private part of the certified
+	// key.
+	IgnoreEKAuthPolicy bool
+
+	// AllowedManufacturers can be used to restrict connections to TPMs from a vetted set of manufacturers. If this is not empty,
+	// the manufacturer obtained from the verified endorsement key certificate must be one of these, else a ErrUnsupportedTPMVendor
+	// error will be returned. The check is performed before the TPM is asked to prove that it is the device for which the
+	// endorsement key certificate was issued, so that unsupported devices are rejected without creating a transient endorsement key.
+	AllowedManufacturers []tpm2.TPMManufacturer
+
+	// TransientOnly indicates that the connection should never use or create persistent objects. The endorsement key is always
+	// created as a transient object during connection, even if there is a valid persistent endorsement key, and it remains loaded
+	// for the lifetime of the connection as if RetainTransientEK were set. SealKeyToTPM and UnsealFromTPM create and load sealed
+	// key objects under a transient storage root key created from the same template as the persistent storage root key rather
+	// than using or provisioning it, and this also remains loaded until the connection is closed. TPMConnection.Close flushes both
+	// of these. Sealed key objects created in this mode can be loaded by connections that use the persistent storage root key, and
+	// vice versa.
+	//
+	// This mode is more expensive, because the endorsement key and storage root key are recreated for every connection, and
+	// creating a RSA primary key can take several seconds on some TPMs. Creating the storage root key also requires knowledge of
+	// the authorization value for the storage hierarchy. Note that NV indices are not objects - sealed keys still depend on the
+	// PIN NV index and the global lock NV index, and SealKeyToTPM still defines the NV indices that a new key requires.
+	TransientOnly bool
+
+	// ApproveEKCertChain can be used to supply a callback that applies a custom policy to the verified endorsement key certificate
+	// chain, beyond the chain being trusted (eg, rejecting certificates that expire soon or requiring specific certificate policy
+	// OIDs). It is called with the verified chain, starting with the endorsement key certificate and ending with the root CA
+	// certificate, and the TPM device attributes obtained from the endorsement key certificate. It is only called once the chain
+	// has been verified successfully and the AllowedManufacturers check has passed, and before the TPM is asked to prove that it is
+	// the device for which the endorsement key certificate was issued. If it returns an error, the connection is aborted and a
+	// EKCertChainRejectedError error that wraps the returned error will be returned. The callback must not retain or modify the
+	// supplied arguments.
+	ApproveEKCertChain func(chain []*x509.Certificate, attrs *TPMDeviceAttributes) error
+}
+
+// isManufacturerAllowed indicates whether the manufacturer in the supplied verified TPM device attributes is in the supplied
+// allow-list. An empty allow-list permits any manufacturer.
+func isManufacturerAllowed(attrs *TPMDeviceAttributes, allowed []tpm2.TPMManufacturer) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	if attrs == nil {
+		return false
+	}
+	for _, m := range allowed {
+		if attrs.Manufacturer == m {
+			return true
+		}
+	}
+	return false
+}
+
+// SecureConnectToDefaultTPMWithOptions behaves like SecureConnectToDefaultTPM, but allows additional options to be supplied via
+// the options argument. A nil options argument is equivalent to SecureConnectToDefaultTPM.
+func SecureConnectToDefaultTPMWithOptions(ekCertDataReader io.Reader, endorsementAuth []byte, options *SecureConnectOptions) (*TPMConnection, error) {
+	if options == nil {
+		options = &SecureConnectOptions{}
+	}
+
 	if ekCertDataReader == nil {
 		return nil, errors.New("no EK certificate data was provided")
 	}
 
-	tpm, err := connectToDefaultTPM()
-	if err != nil {
+	tpm, tcti, err := connectToDefaultTPM()
+	switch {
+	case err == ErrTPMFailure:
+		tpm.Close()
+		return nil, err
+	case err != nil:
 		return nil, err
 	}
 	tpm.EndorsementHandleContext().SetAuthValue(endorsementAuth)
@@ -926,7 +1750,13 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 		tpm.Close()
 	}()
 
-	t := &TPMConnection{TPMContext: tpm}
+	t := &TPMConnection{
+		TPMContext:         tpm,
+		tcti:               tcti,
+		retainTransientEk:  options.RetainTransientEK,
+		ekTemplate:         options.EKTemplate,
+		ignoreEkAuthPolicy: options.IgnoreEKAuthPolicy,
+		transientOnly:      options.TransientOnly}
 
 	var certData *ekCertData
 	// Unmarshal supplied EK cert data
@@ -934,6 +1764,10 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 		return nil, EKCertVerificationError{fmt.Sprintf("cannot unmarshal supplied EK certificate data: %v", err)}
 	}
 	if len(certData.Cert) == 0 {
+		if options.SkipEKCertNVRead {
+			return nil, EKCertVerificationError{"the supplied data doesn't contain an endorsement key certificate and reading it " +
+				"from the TPM is disabled"}
+		}
 		// The supplied data only contains parent certificates. Retrieve the EK cert from the TPM.
 		if cert, err := readEkCertFromTPM(tpm); err != nil {
 			return nil, EKCertVerificationError{fmt.Sprintf("cannot obtain endorsement key certificate from TPM: %v", err)}
@@ -946,6 +1780,14 @@ func SecureConnectToDefaultTPM(ekCertDataReader io.Reader, endorsementAuth []byt
 	if err != nil {
 		return nil, EKCertVerificationError{err.Error()}
 	}
+	if !isManufacturerAllowed(attrs, options.AllowedManufacturers) {
+		return nil, ErrUnsupportedTPMVendor
+	}
+	if options.ApproveEKCertChain != nil {
+		if err := options.ApproveEKCertChain(chain, attrs); err != nil {
+			return nil, EKCertChainRejectedError{err}
+		}
+	}
 
 	t.verifiedEkCertChain = chain
 	t.verifiedDeviceAttributes = attrs
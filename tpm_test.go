@@ -28,6 +28,7 @@ import (
 	"encoding/asn1"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
@@ -35,6 +36,7 @@ import (
 	"io/ioutil"
 	"math/big"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -46,6 +48,8 @@ import (
 	"github.com/canonical/go-tpm2"
 	. "github.com/snapcore/secboot"
 	"github.com/snapcore/snapd/snap"
+
+	"golang.org/x/xerrors"
 )
 
 var (
@@ -194,20 +198,7 @@ func clearTPMWithPlatformAuth(t *testing.T, tpm *TPMConnection) {
 }
 
 func resetTPMSimulatorCommon(tpm *TPMConnection, tcti *tpm2.TctiMssim) error {
-	if err := tpm.Shutdown(tpm2.StartupClear); err != nil {
-		return fmt.Errorf("Shutdown failed: %v", err)
-	}
-	if err := tcti.Reset(); err != nil {
-		return fmt.Errorf("resetting the TPM simulator failed: %v", err)
-	}
-	if err := tpm.Startup(tpm2.StartupClear); err != nil {
-		return fmt.Errorf("Startup failed: %v", err)
-	}
-
-	if err := InitTPMConnection(tpm); err != nil {
-		return fmt.Errorf("failed to reinitialize TPMConnection after reset: %v", err)
-	}
-	return nil
+	return ResetTPMSimulator(tpm, tcti, 10*time.Second)
 }
 
 // resetTPMSimulator executes reset sequence of the TPM (Shutdown(CLEAR) -> reset -> Startup(CLEAR)) and the re-initializes the
@@ -218,6 +209,37 @@ func resetTPMSimulator(t *testing.T, tpm *TPMConnection, tcti *tpm2.TctiMssim) {
 	}
 }
 
+// setSimulatorPhysicalPresence asserts or deasserts physical presence on the simulator by sending a platform signal to its
+// platform port. The simulator only services one platform connection at a time, so this must not be called whilst a connection
+// to the simulator is open.
+func setSimulatorPhysicalPresence(t *testing.T, on bool) {
+	const (
+		signalPhysPresOn  uint32 = 3
+		signalPhysPresOff uint32 = 4
+	)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf(":%d", *mssimPort+1))
+	if err != nil {
+		t.Fatalf("Cannot connect to simulator platform port: %v", err)
+	}
+	defer conn.Close()
+
+	signal := signalPhysPresOff
+	if on {
+		signal = signalPhysPresOn
+	}
+	if err := binary.Write(conn, binary.BigEndian, signal); err != nil {
+		t.Fatalf("Cannot send platform signal: %v", err)
+	}
+	var rc uint32
+	if err := binary.Read(conn, binary.BigEndian, &rc); err != nil {
+		t.Fatalf("Cannot read platform signal response: %v", err)
+	}
+	if rc != 0 {
+		t.Fatalf("Platform signal failed: %d", rc)
+	}
+}
+
 func closeTPM(t *testing.T, tpm *TPMConnection) {
 	if err := tpm.Close(); err != nil {
 		t.Fatalf("Close failed: %v", err)
@@ -346,7 +368,7 @@ func certifyTPM(tpm *tpm2.TPMContext) error {
 		if err != nil {
 			return fmt.Errorf("cannot define NV index for EK certificate: %v", err)
 		}
-		if err := tpm.NVWrite(tpm.PlatformHandleContext(), index, tpm2.MaxNVBuffer(cert), 0, nil); err != nil {
+		if err := NVWrite(tpm, tpm.PlatformHandleContext(), index, cert, 0, nil); err != nil {
 			return fmt.Errorf("cannot write EK certificate to NV index: %v", err)
 		}
 	}
@@ -385,6 +407,400 @@ func TestTPMConnectionIsEnabled(t *testing.T) {
 	}
 }
 
+func TestTPMDeviceAttributesFirmwareVersionString(t *testing.T) {
+	for _, data := range []struct {
+		desc     string
+		version  uint32
+		expected string
+	}{
+		{
+			desc:     "1",
+			version:  0x00010002,
+			expected: "1.2",
+		},
+		{
+			desc:     "2",
+			version:  0x0007003f,
+			expected: "7.63",
+		},
+		{
+			desc:     "3",
+			version:  0,
+			expected: "0.0",
+		},
+		{
+			desc:     "4",
+			version:  0xffffffff,
+			expected: "65535.65535",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			attrs := TPMDeviceAttributes{FirmwareVersion: data.version}
+			if s := attrs.FirmwareVersionString(); s != data.expected {
+				t.Errorf("Unexpected version string: %s", s)
+			}
+		})
+	}
+}
+
+func createTestEkCertWithAttributes(caCert []byte, caKey crypto.PrivateKey, subject pkix.Name, sanAttrs pkix.RDNSequence) ([]byte, error) {
+	key, err := rsa.GenerateKey(testRandReader, 768)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate RSA key: %v", err)
+	}
+
+	t := time.Now()
+
+	template := x509.Certificate{
+		SignatureAlgorithm:    x509.SHA256WithRSA,
+		SerialNumber:          big.NewInt(rand.Int63()),
+		Subject:               subject,
+		NotBefore:             t.Add(time.Hour * -24),
+		NotAfter:              t.Add(time.Hour * 240),
+		KeyUsage:              x509.KeyUsageKeyEncipherment,
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{OidTcgKpEkCertificate},
+		BasicConstraintsValid: true,
+		IsCA:                  false}
+
+	if sanAttrs != nil {
+		tpmDeviceAttrData, err := asn1.Marshal(sanAttrs)
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal SAN value: %v", err)
+		}
+		sanData, err := asn1.Marshal([]asn1.RawValue{
+			asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: SanDirectoryNameTag, IsCompound: true, Bytes: tpmDeviceAttrData}})
+		if err != nil {
+			return nil, fmt.Errorf("cannot marshal SAN value: %v", err)
+		}
+		template.ExtraExtensions = []pkix.Extension{{Id: OidExtensionSubjectAltName, Critical: true, Value: sanData}}
+	}
+
+	root, err := x509.ParseCertificate(caCert)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse CA certificate: %v", err)
+	}
+
+	cert, err := x509.CreateCertificate(testRandReader, &template, root, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create EK certificate: %v", err)
+	}
+
+	return cert, nil
+}
+
+func TestVerifyEkCertificateDeviceAttributes(t *testing.T) {
+	caCert, caKey, err := createTestCA()
+	if err != nil {
+		t.Fatalf("createTestCA failed: %v", err)
+	}
+	h := crypto.SHA256.New()
+	h.Write(caCert)
+	AppendRootCAHash(h.Sum(nil))
+
+	oidVendorManufacturer := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+	oidVendorModel := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 2}
+	oidVendorVersion := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 3}
+
+	for _, data := range []struct {
+		desc     string
+		oids     *EKCertAttributeOIDs
+		subject  pkix.Name
+		sanAttrs pkix.RDNSequence
+		source   TPMDeviceAttributesSource
+		err      string
+	}{
+		{
+			desc: "SAN",
+			sanAttrs: pkix.RDNSequence{
+				pkix.RelativeDistinguishedNameSET{
+					pkix.AttributeTypeAndValue{Type: OidTcgAttributeTpmManufacturer, Value: "id:49424d00"},
+					pkix.AttributeTypeAndValue{Type: OidTcgAttributeTpmModel, Value: "FakeTPM"},
+					pkix.AttributeTypeAndValue{Type: OidTcgAttributeTpmVersion, Value: "id:00010002"}}},
+			source: TPMDeviceAttributesFromSAN,
+		},
+		{
+			desc: "SANCustomOIDs",
+			oids: &EKCertAttributeOIDs{Manufacturer: oidVendorManufacturer, Model: oidVendorModel, FirmwareVersion: oidVendorVersion},
+			sanAttrs: pkix.RDNSequence{
+				pkix.RelativeDistinguishedNameSET{
+					pkix.AttributeTypeAndValue{Type: oidVendorManufacturer, Value: "id:49424d00"},
+					pkix.AttributeTypeAndValue{Type: oidVendorModel, Value: "FakeTPM"},
+					pkix.AttributeTypeAndValue{Type: oidVendorVersion, Value: "id:00010002"}}},
+			source: TPMDeviceAttributesFromSAN,
+		},
+		{
+			desc: "SANUnregisteredOIDs",
+			sanAttrs: pkix.RDNSequence{
+				pkix.RelativeDistinguishedNameSET{
+					pkix.AttributeTypeAndValue{Type: oidVendorManufacturer, Value: "id:49424d00"},
+					pkix.AttributeTypeAndValue{Type: oidVendorModel, Value: "FakeTPM"},
+					pkix.AttributeTypeAndValue{Type: oidVendorVersion, Value: "id:00010002"}}},
+			err: "cannot parse TPM device attributes: incomplete or missing attributes",
+		},
+		{
+			desc: "Subject",
+			subject: pkix.Name{
+				ExtraNames: []pkix.AttributeTypeAndValue{
+					{Type: OidTcgAttributeTpmManufacturer, Value: "id:49424d00"},
+					{Type: OidTcgAttributeTpmModel, Value: "FakeTPM"},
+					{Type: OidTcgAttributeTpmVersion, Value: "id:00010002"}}},
+			source: TPMDeviceAttributesFromSubject,
+		},
+		{
+			desc: "SubjectCustomOIDs",
+			oids: &EKCertAttributeOIDs{Model: oidVendorModel},
+			subject: pkix.Name{
+				ExtraNames: []pkix.AttributeTypeAndValue{
+					{Type: OidTcgAttributeTpmManufacturer, Value: "id:49424d00"},
+					{Type: oidVendorModel, Value: "FakeTPM"},
+					{Type: OidTcgAttributeTpmVersion, Value: "id:00010002"}}},
+			source: TPMDeviceAttributesFromSubject,
+		},
+		{
+			desc:    "NoAttributes",
+			subject: pkix.Name{CommonName: "Fake EK"},
+			err:     "certificate has no SAN extension",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			defer ResetEKCertAttributeOIDs()
+			if data.oids != nil {
+				RegisterEKCertAttributeOIDs(*data.oids)
+			}
+
+			cert, err := createTestEkCertWithAttributes(caCert, caKey, data.subject, data.sanAttrs)
+			if err != nil {
+				t.Fatalf("createTestEkCertWithAttributes failed: %v", err)
+			}
+
+			_, attrs, err := VerifyEkCertificate(cert, [][]byte{caCert})
+			if data.err != "" {
+				if err == nil || err.Error() != data.err {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("VerifyEkCertificate failed: %v", err)
+			}
+
+			if attrs.Manufacturer != tpm2.TPMManufacturerIBM {
+				t.Errorf("Unexpected manufacturer: %v", attrs.Manufacturer)
+			}
+			if attrs.Model != "FakeTPM" {
+				t.Errorf("Unexpected model: %s", attrs.Model)
+			}
+			if attrs.FirmwareVersion != 0x00010002 {
+				t.Errorf("Unexpected firmware version: %x", attrs.FirmwareVersion)
+			}
+			if attrs.Source != data.source {
+				t.Errorf("Unexpected source: %v", attrs.Source)
+			}
+		})
+	}
+}
+
+func TestTPMConnectionFirmwareVersionString(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyFirmwareVersion1, 2, nil)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if len(props) != 2 {
+		t.Fatalf("Unexpected number of properties")
+	}
+	expected := fmt.Sprintf("%d.%d", props[0].Value>>16, props[0].Value&0xffff)
+	if props[1].Value != 0 {
+		expected += fmt.Sprintf(".%d.%d", props[1].Value>>16, props[1].Value&0xffff)
+	}
+
+	s, err := tpm.FirmwareVersionString()
+	if err != nil {
+		t.Fatalf("FirmwareVersionString failed: %v", err)
+	}
+	if s != expected {
+		t.Errorf("Unexpected version string (got %s, expected %s)", s, expected)
+	}
+}
+
+func TestResetTPMSimulator(t *testing.T) {
+	tpm, tcti := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := tpm.PCRExtend(tpm.PCRHandleContext(23), tpm2.TaggedHashList{{HashAlg: tpm2.HashAlgorithmSHA256, Digest: make(tpm2.Digest, 32)}}, nil); err != nil {
+		t.Fatalf("PCRExtend failed: %v", err)
+	}
+
+	if err := ResetTPMSimulator(tpm, tcti, 10*time.Second); err != nil {
+		t.Fatalf("ResetTPMSimulator failed: %v", err)
+	}
+
+	_, values, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{23}}})
+	if err != nil {
+		t.Fatalf("PCRRead failed: %v", err)
+	}
+	if !bytes.Equal(values[tpm2.HashAlgorithmSHA256][23], make([]byte, 32)) {
+		t.Errorf("PCR23 should have been reset")
+	}
+	if tpm.HmacSession() == nil {
+		t.Errorf("Connection should have been reinitialized")
+	}
+}
+
+func TestTPMConnectionRunSelfTest(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	for _, full := range []bool{false, true} {
+		if err := tpm.RunSelfTest(full); err != nil {
+			t.Errorf("RunSelfTest(%v) failed: %v", full, err)
+		}
+	}
+}
+
+func TestTPMConnectionCloseUninitialized(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	closeTPM(t, tpm)
+
+	// A connection created whilst the TPM is in failure mode isn't initialized and has no HMAC session.
+	tcti, err := tpm2.OpenMssim("", *mssimPort, *mssimPort+1)
+	if err != nil {
+		t.Fatalf("OpenMssim failed: %v", err)
+	}
+	tpmContext, _ := tpm2.NewTPMContext(tcti)
+	conn := &TPMConnection{TPMContext: tpmContext}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestTPMConnectionSetCommandObserver(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	type observedCommand struct {
+		command tpm2.CommandCode
+		rc      tpm2.ResponseCode
+	}
+	var observed []observedCommand
+	tpm.SetCommandObserver(func(command tpm2.CommandCode, duration time.Duration, rc tpm2.ResponseCode) {
+		if duration < 0 {
+			t.Errorf("Invalid duration")
+		}
+		observed = append(observed, observedCommand{command, rc})
+	})
+
+	if _, err := tpm.GetRandom(8, nil); err != nil {
+		t.Fatalf("GetRandom failed: %v", err)
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(0x81ffffff); err == nil {
+		t.Fatalf("CreateResourceContextFromTPM should have failed")
+	}
+
+	tpm.SetCommandObserver(nil)
+
+	if _, err := tpm.GetRandom(8, nil); err != nil {
+		t.Fatalf("GetRandom failed: %v", err)
+	}
+
+	if len(observed) != 2 {
+		t.Fatalf("Unexpected number of observed commands (%d)", len(observed))
+	}
+	if observed[0].command != tpm2.CommandGetRandom || observed[0].rc != tpm2.ResponseSuccess {
+		t.Errorf("Unexpected observed command %v (rc: 0x%08x)", observed[0].command, observed[0].rc)
+	}
+	if observed[1].command != tpm2.CommandReadPublic || observed[1].rc == tpm2.ResponseSuccess {
+		t.Errorf("Unexpected observed command %v (rc: 0x%08x)", observed[1].command, observed[1].rc)
+	}
+}
+
+func TestEncodeEKCertificateChainPEM(t *testing.T) {
+	var certs []*x509.Certificate
+	for i := 0; i < 3; i++ {
+		data, _, err := createTestCA()
+		if err != nil {
+			t.Fatalf("createTestCA failed: %v", err)
+		}
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			t.Fatalf("ParseCertificate failed: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	encodePEM := func(certs ...*x509.Certificate) io.Reader {
+		b := new(bytes.Buffer)
+		for _, c := range certs {
+			pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+		}
+		return b
+	}
+
+	for _, data := range []struct {
+		desc     string
+		ekCert   io.Reader
+		parents  io.Reader
+		expected func(w io.Writer) error
+	}{
+		{
+			desc:     "Full",
+			ekCert:   encodePEM(certs[0]),
+			parents:  encodePEM(certs[1], certs[2]),
+			expected: func(w io.Writer) error { return EncodeEKCertificateChain(certs[0], certs[1:], w) },
+		},
+		{
+			desc:     "ParentsOnly",
+			parents:  encodePEM(certs[1], certs[2]),
+			expected: func(w io.Writer) error { return EncodeEKCertificateChain(nil, certs[1:], w) },
+		},
+		{
+			desc:     "Bundle",
+			ekCert:   encodePEM(certs[0], certs[1], certs[2]),
+			expected: func(w io.Writer) error { return EncodeEKCertificateChain(certs[0], certs[1:], w) },
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			var expected bytes.Buffer
+			if err := data.expected(&expected); err != nil {
+				t.Fatalf("EncodeEKCertificateChain failed: %v", err)
+			}
+
+			var b bytes.Buffer
+			if err := EncodeEKCertificateChainPEM(data.ekCert, data.parents, &b); err != nil {
+				t.Fatalf("EncodeEKCertificateChainPEM failed: %v", err)
+			}
+			if !bytes.Equal(b.Bytes(), expected.Bytes()) {
+				t.Errorf("Unexpected encoding")
+			}
+		})
+	}
+
+	t.Run("NoCertificates", func(t *testing.T) {
+		err := EncodeEKCertificateChainPEM(bytes.NewReader([]byte("foo")), nil, ioutil.Discard)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "cannot decode EK certificate: no certificates found" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnexpectedBlock", func(t *testing.T) {
+		b := new(bytes.Buffer)
+		pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: certs[1].Raw})
+		pem.Encode(b, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: []byte{0x01, 0x02}})
+		err := EncodeEKCertificateChainPEM(encodePEM(certs[0]), b, ioutil.Discard)
+		if err == nil {
+			t.Fatalf("Expected an error")
+		}
+		if err.Error() != "cannot decode parent certificates: unexpected PEM block type \"RSA PRIVATE KEY\"" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
 func TestConnectToDefaultTPM(t *testing.T) {
 	SetOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
 		return tpm2.OpenMssim("", *mssimPort, *mssimPort+1)
@@ -411,9 +827,15 @@ func TestConnectToDefaultTPM(t *testing.T) {
 		if len(tpm.VerifiedEKCertChain()) > 0 {
 			t.Errorf("Should be no verified EK cert chain")
 		}
+		if err := tpm.ExportVerifiedEKCertChainPEM(ioutil.Discard); err != ErrNoVerifiedEKCertChain {
+			t.Errorf("ExportVerifiedEKCertChainPEM returned an unexpected error: %v", err)
+		}
 		if tpm.VerifiedDeviceAttributes() != nil {
 			t.Errorf("Should be no verified device attributes")
 		}
+		if tpm.EKVerificationMethod() != EKVerificationNone {
+			t.Errorf("Unexpected EK verification method: %v", tpm.EKVerificationMethod())
+		}
 		rc, err := tpm.EndorsementKey()
 		if !hasEk {
 			if err == nil {
@@ -456,7 +878,7 @@ func TestConnectToDefaultTPM(t *testing.T) {
 			tpm := connectAndClear(t)
 			defer closeTPM(t, tpm)
 
-			if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+			if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 				t.Fatalf("ProvisionTPM failed: %v", err)
 			}
 		}()
@@ -524,6 +946,215 @@ func TestConnectToDefaultTPMNoTPM(t *testing.T) {
 	}
 }
 
+// notStartedTcti is a fake TPM device that responds to every command with TPM_RC_INITIALIZE, which is the behaviour of a TPM that
+// hasn't been started by the platform firmware.
+type notStartedTcti struct {
+	rsp *bytes.Reader
+}
+
+func (t *notStartedTcti) Read(data []byte) (int, error) {
+	if t.rsp == nil {
+		return 0, io.EOF
+	}
+	return t.rsp.Read(data)
+}
+
+func (t *notStartedTcti) Write(data []byte) (int, error) {
+	t.rsp = bytes.NewReader([]byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x0a, 0x00, 0x00, 0x01, 0x00})
+	return len(data), nil
+}
+
+func (t *notStartedTcti) Close() error {
+	return nil
+}
+
+// handleRecordingTcti is a wrapper around a tcti that records the first handle in the handle area of each command.
+type handleRecordingTcti struct {
+	io.ReadWriteCloser
+	handles []tpm2.Handle
+}
+
+func (t *handleRecordingTcti) Write(data []byte) (int, error) {
+	if len(data) >= 14 {
+		t.handles = append(t.handles, tpm2.Handle(binary.BigEndian.Uint32(data[10:14])))
+	}
+	return t.ReadWriteCloser.Write(data)
+}
+
+func TestConnectToDefaultTPMDisabled(t *testing.T) {
+	SetOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return &notStartedTcti{}, nil
+	})
+
+	tpm, err := ConnectToDefaultTPM()
+	if tpm != nil {
+		t.Errorf("ConnectToDefaultTPM should have failed")
+	}
+	if err != ErrTPMDisabled {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestConnectToDefaultTPMReadOnly(t *testing.T) {
+	if !*useMssim {
+		t.SkipNow()
+	}
+
+	SetOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenMssim("", *mssimPort, *mssimPort+1)
+	})
+
+	tpm, err := ConnectToDefaultTPMReadOnly()
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPMReadOnly failed: %v", err)
+	}
+	defer closeTPM(t, tpm)
+
+	if !tpm.IsReadOnly() {
+		t.Errorf("Connection should be read-only")
+	}
+
+	if _, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1); err != nil {
+		t.Errorf("GetCapability failed: %v", err)
+	}
+	if _, _, err := tpm.PCRRead(tpm2.PCRSelectionList{{Hash: tpm2.HashAlgorithmSHA256, Select: []int{7}}}); err != nil {
+		t.Errorf("PCRRead failed: %v", err)
+	}
+
+	nvPub := tpm2.NVPublic{
+		Index:   0x0181ffff,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead),
+		Size:    8}
+	if _, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, &nvPub, nil); !xerrors.Is(err, ErrReadOnlyConnection) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := tpm.HierarchyChangeAuth(tpm.OwnerHandleContext(), []byte("foo"), nil); !xerrors.Is(err, ErrReadOnlyConnection) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := ProvisionTPM(tpm, ProvisionModeWithoutLockout, nil, true); err == nil {
+		t.Errorf("ProvisionTPM should have failed")
+	}
+}
+
+func TestConnectToDefaultTPMReadOnlyNVRead(t *testing.T) {
+	daPub := tpm2.NVPublic{
+		Index:   0x0181fffe,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVOwnerRead),
+		Size:    8}
+	noDAPub := tpm2.NVPublic{
+		Index:   0x0181ffff,
+		NameAlg: tpm2.HashAlgorithmSHA256,
+		Attrs:   tpm2.NVTypeOrdinary.WithAttrs(tpm2.AttrNVAuthWrite | tpm2.AttrNVAuthRead | tpm2.AttrNVNoDA),
+		Size:    8}
+
+	// Define the NV indices before opening the read-only connection.
+	func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+
+		for _, pub := range []*tpm2.NVPublic{&daPub, &noDAPub} {
+			index, err := tpm.NVDefineSpace(tpm.OwnerHandleContext(), nil, pub, nil)
+			if err != nil {
+				t.Fatalf("NVDefineSpace failed: %v", err)
+			}
+			if err := tpm.NVWrite(index, index, make([]byte, 8), 0, nil); err != nil {
+				t.Fatalf("NVWrite failed: %v", err)
+			}
+		}
+	}()
+	defer func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+
+		for _, handle := range []tpm2.Handle{daPub.Index, noDAPub.Index} {
+			index, err := tpm.CreateResourceContextFromTPM(handle)
+			if err != nil {
+				t.Errorf("CreateResourceContextFromTPM failed: %v", err)
+				continue
+			}
+			undefineNVSpace(t, tpm, index, tpm.OwnerHandleContext())
+		}
+	}()
+
+	SetOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenMssim("", *mssimPort, *mssimPort+1)
+	})
+
+	tpm, err := ConnectToDefaultTPMReadOnly()
+	if err != nil {
+		t.Fatalf("ConnectToDefaultTPMReadOnly failed: %v", err)
+	}
+	defer closeTPM(t, tpm)
+
+	noDAIndex, err := tpm.CreateResourceContextFromTPM(noDAPub.Index)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if _, err := tpm.NVRead(noDAIndex, noDAIndex, 8, 0, nil); err != nil {
+		t.Errorf("NVRead failed: %v", err)
+	}
+
+	// Reading an index that is subject to dictionary attack protection with its own authorization value is rejected.
+	daIndex, err := tpm.CreateResourceContextFromTPM(daPub.Index)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+	if _, err := tpm.NVRead(daIndex, daIndex, 8, 0, nil); !xerrors.Is(err, ErrReadOnlyConnection) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// The owner hierarchy is exempt from dictionary attack protection.
+	if _, err := tpm.NVRead(tpm.OwnerHandleContext(), daIndex, 8, 0, nil); err != nil {
+		t.Errorf("NVRead failed: %v", err)
+	}
+}
+
+func TestPing(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+
+	if err := tpm.Ping(); err != nil {
+		t.Errorf("Ping failed: %v", err)
+	}
+
+	handles2, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if len(handles2) != len(handles) {
+		t.Errorf("Ping should not allocate any handles")
+	}
+}
+
+func TestWarmup(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+
+	if err := tpm.Warmup(); err != nil {
+		t.Errorf("Warmup failed: %v", err)
+	}
+
+	handles2, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if len(handles2) != len(handles) {
+		t.Errorf("Warmup should not allocate any handles")
+	}
+}
+
 func TestSecureConnectToDefaultTPM(t *testing.T) {
 	SetOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
 		return tpm2.OpenMssim("", *mssimPort, *mssimPort+1)
@@ -554,6 +1185,25 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 			t.Errorf("Unexpected leaf certificate")
 		}
 
+		var chainPEM bytes.Buffer
+		if err := tpm.ExportVerifiedEKCertChainPEM(&chainPEM); err != nil {
+			t.Fatalf("ExportVerifiedEKCertChainPEM failed: %v", err)
+		}
+		rest := chainPEM.Bytes()
+		for i, cert := range tpm.VerifiedEKCertChain() {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				t.Fatalf("Missing PEM block for certificate %d", i)
+			}
+			if block.Type != "CERTIFICATE" || !bytes.Equal(block.Bytes, cert.Raw) {
+				t.Errorf("Unexpected PEM block for certificate %d", i)
+			}
+		}
+		if len(rest) > 0 {
+			t.Errorf("Unexpected trailing data in PEM output")
+		}
+
 		if tpm.VerifiedDeviceAttributes() == nil {
 			t.Fatalf("Should have verified device attributes")
 		}
@@ -566,6 +1216,17 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 		if tpm.VerifiedDeviceAttributes().FirmwareVersion != binary.BigEndian.Uint32([]byte{0x00, 0x01, 0x00, 0x02}) {
 			t.Errorf("Unexpected verified firmware version")
 		}
+		if tpm.VerifiedDeviceAttributes().FirmwareVersionString() != "1.2" {
+			t.Errorf("Unexpected verified firmware version string")
+		}
+
+		expectedMethod := EKVerificationTransientFallback
+		if hasEk {
+			expectedMethod = EKVerificationPersistentMatch
+		}
+		if tpm.EKVerificationMethod() != expectedMethod {
+			t.Errorf("Unexpected EK verification method: %v", tpm.EKVerificationMethod())
+		}
 
 		rc, err := tpm.EndorsementKey()
 		if !hasEk {
@@ -605,6 +1266,95 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 		run(t, bytes.NewReader(testEncodedEkCertChain), false, nil, nil)
 	})
 
+	t.Run("AllowedManufacturer", func(t *testing.T) {
+		tpm, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil,
+			&SecureConnectOptions{AllowedManufacturers: []tpm2.TPMManufacturer{tpm2.TPMManufacturerINTC, tpm2.TPMManufacturerIBM}})
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+		closeTPM(t, tpm)
+	})
+
+	t.Run("UnsupportedManufacturer", func(t *testing.T) {
+		_, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil,
+			&SecureConnectOptions{AllowedManufacturers: []tpm2.TPMManufacturer{tpm2.TPMManufacturerINTC, tpm2.TPMManufacturerIFX}})
+		if err != ErrUnsupportedTPMVendor {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ApproveEKCertChain", func(t *testing.T) {
+		var approvedChain []*x509.Certificate
+		var approvedAttrs *TPMDeviceAttributes
+		tpm, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil,
+			&SecureConnectOptions{ApproveEKCertChain: func(chain []*x509.Certificate, attrs *TPMDeviceAttributes) error {
+				approvedChain = chain
+				approvedAttrs = attrs
+				return nil
+			}})
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		if len(approvedChain) == 0 || !approvedChain[0].Equal(tpm.VerifiedEKCertChain()[0]) {
+			t.Errorf("Callback was called with an unexpected chain")
+		}
+		if approvedAttrs == nil || *approvedAttrs != *tpm.VerifiedDeviceAttributes() {
+			t.Errorf("Callback was called with unexpected device attributes")
+		}
+	})
+
+	t.Run("RejectEKCertChain", func(t *testing.T) {
+		rejectErr := errors.New("certificate expires too soon")
+		_, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil,
+			&SecureConnectOptions{ApproveEKCertChain: func(chain []*x509.Certificate, attrs *TPMDeviceAttributes) error {
+				return rejectErr
+			}})
+		var e EKCertChainRejectedError
+		if !xerrors.As(err, &e) || !xerrors.Is(err, rejectErr) {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("UnprovisionedRetainTransientEK", func(t *testing.T) {
+		// Test that a transient EK is retained for the lifetime of the connection when requested
+		func() {
+			tpm := connectAndClear(t)
+			defer closeTPM(t, tpm)
+		}()
+
+		tpm, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil, &SecureConnectOptions{RetainTransientEK: true})
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+
+		rc, err := tpm.EndorsementKey()
+		if err != nil {
+			t.Fatalf("TPMConnection.EndorsementKey failed: %v", err)
+		}
+		if rc.Handle().Type() != tpm2.HandleTypeTransient {
+			t.Errorf("TPMConnection.EndorsementKey returned an unexpected context")
+		}
+		if _, _, _, err := tpm.ReadPublic(rc); err != nil {
+			t.Errorf("ReadPublic failed: %v", err)
+		}
+		handle := rc.Handle()
+
+		closeTPM(t, tpm)
+
+		tpm = openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+
+		handles, err := tpm.GetCapabilityHandles(handle, 1)
+		if err != nil {
+			t.Fatalf("GetCapabilityHandles failed: %v", err)
+		}
+		if len(handles) > 0 && handles[0] == handle {
+			t.Errorf("Transient EK should have been flushed on Close")
+		}
+	})
+
 	t.Run("UnprovisionedWithEndorsementAuth", func(t *testing.T) {
 		// Test that we verify successfully with a transient EK when the endorsement hierarchy has an authorization value and we know it
 		testAuth := []byte("56789")
@@ -657,7 +1407,7 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 			tpm := connectAndClear(t)
 			defer closeTPM(t, tpm)
 
-			if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+			if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 				t.Fatalf("ProvisionTPM failed: %v", err)
 			}
 		}()
@@ -683,6 +1433,105 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 		run(t, certData, false, nil, nil)
 	})
 
+	t.Run("SkipEKCertNVRead", func(t *testing.T) {
+		// Test that we can verify with a caller provided EK certificate when reading it from the TPM is disabled
+		func() {
+			tpm := connectAndClear(t)
+			defer closeTPM(t, tpm)
+		}()
+
+		cert, _ := x509.ParseCertificate(testEkCert)
+		caCert, _ := x509.ParseCertificate(testCACert)
+
+		certData := new(bytes.Buffer)
+		if err := EncodeEKCertificateChain(cert, []*x509.Certificate{caCert}, certData); err != nil {
+			t.Fatalf("EncodeEKCertificateChain failed: %v", err)
+		}
+
+		tpm, err := SecureConnectToDefaultTPMWithOptions(certData, nil, &SecureConnectOptions{SkipEKCertNVRead: true})
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+		if !bytes.Equal(tpm.VerifiedEKCertChain()[0].Raw, testEkCert) {
+			t.Errorf("Unexpected leaf certificate")
+		}
+	})
+
+	t.Run("SkipEKCertNVReadNoCert", func(t *testing.T) {
+		// Test that we get the right error if the EK certificate isn't provided and reading it from the TPM is disabled
+		func() {
+			tpm := connectAndClear(t)
+			defer closeTPM(t, tpm)
+		}()
+
+		_, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil, &SecureConnectOptions{SkipEKCertNVRead: true})
+		if err == nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions should have failed")
+		}
+		if _, ok := err.(EKCertVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("ProvisionedCustomEKTemplateIgnoreAuthPolicy", func(t *testing.T) {
+		// Test that the persistent EK is verified against the certificate when a custom template with a different authorization
+		// policy is supplied and only the certificate relevant fields are compared
+		func() {
+			tpm := connectAndClear(t)
+			defer closeTPM(t, tpm)
+
+			if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+				t.Fatalf("ProvisionTPM failed: %v", err)
+			}
+		}()
+
+		template := MakeDefaultEKTemplate()
+		template.Attrs |= tpm2.AttrNoDA
+		template.AuthPolicy = make(tpm2.Digest, 32)
+
+		tpm, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil,
+			&SecureConnectOptions{EKTemplate: template, IgnoreEKAuthPolicy: true})
+		if err != nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+		}
+		defer closeTPM(t, tpm)
+
+		rc, err := tpm.EndorsementKey()
+		if err != nil {
+			t.Fatalf("TPMConnection.EndorsementKey failed: %v", err)
+		}
+		if rc.Handle() != EkHandle {
+			t.Errorf("TPMConnection.EndorsementKey returned an unexpected context")
+		}
+	})
+
+	t.Run("ProvisionedCustomEKTemplateMismatch", func(t *testing.T) {
+		// Test that verification fails if a custom template with a different authorization policy is supplied and all fields are
+		// compared, as neither the persistent EK nor a transient EK created from the template match the certificate
+		func() {
+			tpm := connectAndClear(t)
+			defer closeTPM(t, tpm)
+
+			if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+				t.Fatalf("ProvisionTPM failed: %v", err)
+			}
+		}()
+
+		template := MakeDefaultEKTemplate()
+		template.Attrs |= tpm2.AttrNoDA
+		template.AuthPolicy = make(tpm2.Digest, 32)
+
+		_, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil,
+			&SecureConnectOptions{EKTemplate: template})
+		if err == nil {
+			t.Fatalf("SecureConnectToDefaultTPMWithOptions should have failed")
+		}
+		if _, ok := err.(TPMVerificationError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
 	t.Run("InvalidEkCert", func(t *testing.T) {
 		// Test that we get the right error if the provided EK cert data is invalid
 		func() {
@@ -837,6 +1686,169 @@ func TestSecureConnectToDefaultTPM(t *testing.T) {
 	})
 }
 
+func TestSecureConnectToDefaultTPMTransientOnly(t *testing.T) {
+	SetOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		return tpm2.OpenMssim("", *mssimPort, *mssimPort+1)
+	})
+
+	defer func() {
+		// Restore the persistent objects evicted below.
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+		if err := ProvisionTPM(tpm, ProvisionModeWithoutLockout, nil, true); err != nil {
+			t.Errorf("Failed to restore persistent objects: %v", err)
+		}
+	}()
+
+	// Provision the TPM in order to create the lock NV index, and then evict the persistent objects so that we can detect if any
+	// are created.
+	func() {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+
+		clearTPMWithPlatformAuth(t, tpm)
+		if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+			t.Fatalf("Failed to provision TPM for test: %v", err)
+		}
+		for _, h := range []tpm2.Handle{SrkHandle, EkHandle} {
+			rc, err := tpm.CreateResourceContextFromTPM(h)
+			if err != nil {
+				t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+			}
+			if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), rc, rc.Handle(), nil); err != nil {
+				t.Fatalf("EvictControl failed: %v", err)
+			}
+		}
+	}()
+
+	checkNoPersistentObjects := func(t *testing.T, tpm *TPMConnection) {
+		handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypePersistent.BaseHandle(), tpm2.CapabilityMaxProperties)
+		if err != nil {
+			t.Fatalf("GetCapabilityHandles failed: %v", err)
+		}
+		if len(handles) > 0 {
+			t.Errorf("Unexpected persistent objects: %v", handles)
+		}
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestSecureConnectToDefaultTPMTransientOnly_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keyFile := filepath.Join(tmpDir, "keydata")
+
+	tpm, err := SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil, &SecureConnectOptions{TransientOnly: true})
+	if err != nil {
+		t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+	}
+
+	ek, err := tpm.EndorsementKey()
+	if err != nil {
+		t.Fatalf("TPMConnection.EndorsementKey failed: %v", err)
+	}
+	if ek.Handle().Type() != tpm2.HandleTypeTransient {
+		t.Errorf("TPMConnection.EndorsementKey returned an unexpected context")
+	}
+	if tpm.EKVerificationMethod() != EKVerificationTransientOnly {
+		t.Errorf("Unexpected EK verification method: %v", tpm.EKVerificationMethod())
+	}
+	checkNoPersistentObjects(t, tpm)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x01810000}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer func() {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+		undefineKeyNVSpace(t, tpm, keyFile)
+	}()
+	checkNoPersistentObjects(t, tpm)
+
+	// The existing PIN NV index must not be undefined.
+	err = SealKeyToTPM(tpm, key, filepath.Join(tmpDir, "keydata2"), "", &KeyCreationParams{
+		PCRProfile:            getTestPCRProfile(),
+		PINHandle:             0x01810000,
+		ForceRecreatePINIndex: true})
+	if _, ok := err.(TPMResourceExistsError); !ok {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+	checkNoPersistentObjects(t, tpm)
+
+	closeTPM(t, tpm)
+
+	tpm = openTPMForTesting(t)
+	defer func() {
+		closeTPM(t, tpm)
+	}()
+
+	// The EK, SRK and HMAC session created by the transient-only connection should have been flushed.
+	handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapabilityHandles failed: %v", err)
+	}
+	if len(handles) > 0 {
+		t.Errorf("Unexpected transient objects: %v", handles)
+	}
+	checkNoPersistentObjects(t, tpm)
+
+	// Create a persistent EK, and check that a transient-only connection never uses it.
+	if err := ProvisionTPM(tpm, ProvisionModeWithoutLockout, nil, true); err != nil {
+		t.Fatalf("ProvisionTPM failed: %v", err)
+	}
+	persistentEk, err := tpm.CreateResourceContextFromTPM(EkHandle)
+	if err != nil {
+		t.Fatalf("CreateResourceContextFromTPM failed: %v", err)
+	}
+
+	var tcti *handleRecordingTcti
+	SetOpenDefaultTctiFn(func() (io.ReadWriteCloser, error) {
+		mssim, err := tpm2.OpenMssim("", *mssimPort, *mssimPort+1)
+		if err != nil {
+			return nil, err
+		}
+		tcti = &handleRecordingTcti{ReadWriteCloser: mssim}
+		return tcti, nil
+	})
+
+	closeTPM(t, tpm)
+	tpm, err = SecureConnectToDefaultTPMWithOptions(bytes.NewReader(testEncodedEkCertChain), nil, &SecureConnectOptions{TransientOnly: true})
+	if err != nil {
+		t.Fatalf("SecureConnectToDefaultTPMWithOptions failed: %v", err)
+	}
+
+	ek, err = tpm.EndorsementKey()
+	if err != nil {
+		t.Fatalf("TPMConnection.EndorsementKey failed: %v", err)
+	}
+	if ek.Handle().Type() != tpm2.HandleTypeTransient {
+		t.Errorf("TPMConnection.EndorsementKey returned an unexpected context")
+	}
+	if !bytes.Equal(ek.Name(), persistentEk.Name()) {
+		t.Errorf("Transient EK doesn't match the persistent EK")
+	}
+	for _, h := range tcti.handles {
+		if h == EkHandle {
+			t.Errorf("The persistent EK was used by a transient-only connection")
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
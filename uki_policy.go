@@ -0,0 +1,124 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/canonical/go-tpm2"
+)
+
+const (
+	// ukiPCR is the PCR that systemd-stub measures the sections of a unified kernel image to, and that systemd-pcrphase measures
+	// boot phases to.
+	ukiPCR = 11
+
+	ukiPCRSigSection = ".pcrsig"
+)
+
+// ukiMeasuredSections is the set of unified kernel image PE sections that systemd-stub measures, in the order that they are
+// measured. This order is fixed and doesn't depend on the order of the sections in the image.
+var ukiMeasuredSections = []string{".linux", ".osrel", ".cmdline", ".initrd", ".splash", ".dtb", ".uname", ".sbat", ".pcrpkey"}
+
+// UnifiedKernelImageProfileParams provides the parameters to AddUnifiedKernelImageProfile.
+type UnifiedKernelImageProfileParams struct {
+	// PCRAlgorithm is the algorithm for which to compute PCR digests for. TPMs compliant with the "TCG PC Client Platform TPM Profile
+	// (PTP) Specification" Level 00, Revision 01.03 v22, May 22 2017 are required to support tpm2.HashAlgorithmSHA1 and
+	// tpm2.HashAlgorithmSHA256. Support for other digest algorithms is optional.
+	PCRAlgorithm tpm2.HashAlgorithmId
+
+	// Sections contains the contents of the PE sections of the unified kernel image, keyed by section name (eg, ".linux"). The
+	// .linux section is mandatory. The .pcrsig section is not measured by systemd-stub and is ignored if supplied.
+	Sections map[string][]byte
+
+	// Phases is the set of boot phases for which to compute PCR values. Each phase is specified as the colon separated sequence of
+	// words measured by systemd-pcrphase up to that point (eg, "enter-initrd:leave-initrd"), and is added to the PCR profile as a
+	// separate branch. An empty string corresponds to the value before any boot phase has been measured. If no phases are supplied,
+	// the "enter-initrd" and "enter-initrd:leave-initrd" phases are used.
+	Phases []string
+}
+
+// AddUnifiedKernelImageProfile adds the profile for a unified kernel image booted with systemd-stub to the PCR protection profile,
+// in order to generate a PCR policy that restricts access to a key to a specific unified kernel image and a defined set of boot
+// phases.
+//
+// systemd-stub measures each of the unified kernel image sections that are present to PCR 11 in a fixed order, regardless of the
+// order of the sections in the image. For each section, it measures the section name including the NUL terminator, followed by
+// the contents of the section. systemd-pcrphase then measures a word to PCR 11 at each boot phase transition, which is supplied via
+// the Phases field of params.
+func AddUnifiedKernelImageProfile(profile *PCRProtectionProfile, params *UnifiedKernelImageProfileParams) error {
+	if !params.PCRAlgorithm.Supported() {
+		return errors.New("unsupported PCR algorithm")
+	}
+	if _, ok := params.Sections[".linux"]; !ok {
+		return errors.New("no .linux section specified")
+	}
+
+	measured := make(map[string]bool)
+	for _, name := range ukiMeasuredSections {
+		measured[name] = true
+	}
+	for name := range params.Sections {
+		if !measured[name] && name != ukiPCRSigSection {
+			return fmt.Errorf("unrecognized section %s", name)
+		}
+	}
+
+	phases := params.Phases
+	if len(phases) == 0 {
+		phases = []string{"enter-initrd", "enter-initrd:leave-initrd"}
+	}
+
+	var subProfiles []*PCRProtectionProfile
+	for _, phase := range phases {
+		subProfile := NewPCRProtectionProfile()
+		if phase != "" {
+			for _, word := range strings.Split(phase, ":") {
+				if word == "" {
+					return fmt.Errorf("invalid boot phase \"%s\"", phase)
+				}
+				h := params.PCRAlgorithm.NewHash()
+				h.Write([]byte(word))
+				subProfile.ExtendPCR(params.PCRAlgorithm, ukiPCR, h.Sum(nil))
+			}
+		}
+		subProfiles = append(subProfiles, subProfile)
+	}
+
+	for _, name := range ukiMeasuredSections {
+		data, ok := params.Sections[name]
+		if !ok {
+			continue
+		}
+
+		h := params.PCRAlgorithm.NewHash()
+		h.Write(append([]byte(name), 0))
+		profile.ExtendPCR(params.PCRAlgorithm, ukiPCR, h.Sum(nil))
+
+		h = params.PCRAlgorithm.NewHash()
+		h.Write(data)
+		profile.ExtendPCR(params.PCRAlgorithm, ukiPCR, h.Sum(nil))
+	}
+
+	profile.AddProfileOR(subProfiles...)
+	return nil
+}
@@ -0,0 +1,149 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2021 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestAddUnifiedKernelImageProfile(t *testing.T) {
+	for _, data := range []struct {
+		desc   string
+		params UnifiedKernelImageProfileParams
+		values []tpm2.PCRValues
+	}{
+		{
+			desc: "DefaultPhases",
+			params: UnifiedKernelImageProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Sections: map[string][]byte{
+					".linux":   []byte("kernel"),
+					".initrd":  []byte("initrd"),
+					".cmdline": []byte("console=ttyS0"),
+					".osrel":   []byte("ID=ubuntu"),
+					".pcrsig":  []byte("signature")},
+			},
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA256: {
+						11: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, ".linux\x00", "kernel", ".osrel\x00", "ID=ubuntu",
+							".cmdline\x00", "console=ttyS0", ".initrd\x00", "initrd", "enter-initrd"),
+					},
+				},
+				{
+					tpm2.HashAlgorithmSHA256: {
+						11: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA256, ".linux\x00", "kernel", ".osrel\x00", "ID=ubuntu",
+							".cmdline\x00", "console=ttyS0", ".initrd\x00", "initrd", "enter-initrd", "leave-initrd"),
+					},
+				},
+			},
+		},
+		{
+			desc: "CustomPhases",
+			params: UnifiedKernelImageProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA1,
+				Sections:     map[string][]byte{".linux": []byte("kernel")},
+				Phases:       []string{"", "enter-initrd:leave-initrd:sysinit"},
+			},
+			values: []tpm2.PCRValues{
+				{
+					tpm2.HashAlgorithmSHA1: {
+						11: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA1, ".linux\x00", "kernel"),
+					},
+				},
+				{
+					tpm2.HashAlgorithmSHA1: {
+						11: makePCRDigestFromEvents(tpm2.HashAlgorithmSHA1, ".linux\x00", "kernel", "enter-initrd", "leave-initrd",
+							"sysinit"),
+					},
+				},
+			},
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			expectedPcrs := tpm2.PCRSelectionList{{Hash: data.params.PCRAlgorithm, Select: []int{11}}}
+			var expectedDigests tpm2.DigestList
+			for _, v := range data.values {
+				d, _ := tpm2.ComputePCRDigest(tpm2.HashAlgorithmSHA256, expectedPcrs, v)
+				expectedDigests = append(expectedDigests, d)
+			}
+
+			profile := NewPCRProtectionProfile()
+			if err := AddUnifiedKernelImageProfile(profile, &data.params); err != nil {
+				t.Fatalf("AddUnifiedKernelImageProfile failed: %v", err)
+			}
+			pcrs, digests, err := profile.ComputePCRDigests(nil, tpm2.HashAlgorithmSHA256)
+			if err != nil {
+				t.Fatalf("ComputePCRDigests failed: %v", err)
+			}
+			if !pcrs.Equal(expectedPcrs) {
+				t.Errorf("ComputePCRDigests returned the wrong PCR selection")
+			}
+			if !reflect.DeepEqual(digests, expectedDigests) {
+				t.Errorf("ComputePCRDigests returned unexpected values")
+				t.Logf("Profile:\n%s", profile)
+				t.Logf("Values:\n%s", profile.DumpValues(nil))
+			}
+		})
+	}
+}
+
+func TestAddUnifiedKernelImageProfileErrors(t *testing.T) {
+	for _, data := range []struct {
+		desc   string
+		params UnifiedKernelImageProfileParams
+		err    string
+	}{
+		{
+			desc:   "NoLinuxSection",
+			params: UnifiedKernelImageProfileParams{PCRAlgorithm: tpm2.HashAlgorithmSHA256, Sections: map[string][]byte{".initrd": nil}},
+			err:    "no .linux section specified",
+		},
+		{
+			desc: "UnrecognizedSection",
+			params: UnifiedKernelImageProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Sections:     map[string][]byte{".linux": nil, ".foo": nil}},
+			err: "unrecognized section .foo",
+		},
+		{
+			desc: "InvalidPhase",
+			params: UnifiedKernelImageProfileParams{
+				PCRAlgorithm: tpm2.HashAlgorithmSHA256,
+				Sections:     map[string][]byte{".linux": nil},
+				Phases:       []string{"enter-initrd:"}},
+			err: "invalid boot phase \"enter-initrd:\"",
+		},
+	} {
+		t.Run(data.desc, func(t *testing.T) {
+			err := AddUnifiedKernelImageProfile(NewPCRProtectionProfile(), &data.params)
+			if err == nil {
+				t.Fatalf("AddUnifiedKernelImageProfile should have failed")
+			}
+			if err.Error() != data.err {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
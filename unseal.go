@@ -20,11 +20,271 @@
 package secboot
 
 import (
+	"bytes"
+	"crypto"
+	"errors"
+
 	"github.com/canonical/go-tpm2"
 
 	"golang.org/x/xerrors"
 )
 
+// loadToTPM loads the sealed key object in to the TPM, converting errors from the load in to the errors documented for UnsealFromTPM.
+func (k *SealedKeyObject) loadToTPM(tpm *TPMConnection, hmacSession tpm2.SessionContext) (tpm2.ResourceContext, error) {
+	key, err := func() (tpm2.ResourceContext, error) {
+		srk, err := tpm.storageRootKey(hmacSession)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create context for SRK: %w", err)
+		}
+		return k.data.load(tpm.TPMContext, srk, hmacSession)
+	}()
+	if err != nil && !isOwnerHierarchyEnabled(tpm.TPMContext) {
+		// The SRK and the global lock NV index both belong to the storage hierarchy, so they are inaccessible whilst it is disabled.
+		return nil, ErrOwnerHierarchyDisabled
+	}
+	switch {
+	case isKeyFileError(err) && tpm.transientOnly:
+		// The transient SRK was created from the standard template, so this isn't a provisioning error.
+		return nil, InvalidKeyFileError{err.Error()}
+	case isKeyFileError(err):
+		// A keyFileError can be as a result of an improperly provisioned TPM - detect if the object at srkHandle is a valid primary key
+		// with the correct attributes. If it's not, then it's definitely a provisioning error. If it is, then it could still be a
+		// provisioning error because we don't know if the object was created with the same template that ProvisionTPM uses. In that case,
+		// we'll just assume an invalid key file
+		srk, err2 := tpm.CreateResourceContextFromTPM(srkHandle)
+		switch {
+		case tpm2.IsResourceUnavailableError(err2, srkHandle):
+			return nil, ErrTPMProvisioning
+		case err2 != nil:
+			return nil, xerrors.Errorf("cannot create context for SRK: %w", err2)
+		}
+		template, _, err2 := readStorageRootKeyTemplate(tpm.TPMContext)
+		if err2 != nil {
+			return nil, xerrors.Errorf("cannot determine storage root key template: %w", err2)
+		}
+		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, template, tpm.HmacSession())
+		switch {
+		case err2 != nil:
+			return nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", srkHandle, err2)
+		case !ok:
+			return nil, ErrTPMProvisioning
+		}
+		// This is probably a broken key file, but it could still be a provisioning error because we don't know if the SRK object was
+		// created with the same template that ProvisionTPM uses.
+		return nil, InvalidKeyFileError{err.Error()}
+	case tpm2.IsResourceUnavailableError(err, srkHandle):
+		return nil, ErrTPMProvisioning
+	case isAuthFailError(err, tpm2.CommandCreatePrimary, 1):
+		return nil, AuthFailError{tpm2.HandleOwner}
+	case err != nil:
+		return nil, err
+	}
+
+	if err := k.verifyLoadedAuthPolicy(tpm, key, hmacSession); err != nil {
+		tpm.FlushContext(key)
+		return nil, err
+	}
+	return key, nil
+}
+
+// isOwnerHierarchyEnabled indicates whether the storage hierarchy is enabled. If this can't be determined, it is assumed to be
+// enabled so that the original error is reported.
+func isOwnerHierarchyEnabled(tpm *tpm2.TPMContext) bool {
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyStartupClear, 1)
+	if err != nil || len(props) == 0 || props[0].Property != tpm2.PropertyStartupClear {
+		return true
+	}
+	return tpm2.StartupClearAttributes(props[0].Value)&tpm2.AttrShEnable != 0
+}
+
+// verifyLoadedAuthPolicy checks that the authorization policy of the supplied loaded sealed key object matches the policy computed
+// from the static metadata in the key file, in order to detect a corrupted or tampered key file before attempting to unseal it. If
+// the policy doesn't match, a ErrKeyFileCorrupt error is returned.
+func (k *SealedKeyObject) verifyLoadedAuthPolicy(tpm *TPMConnection, key tpm2.ResourceContext, hmacSession tpm2.SessionContext) error {
+	pub, _, _, err := tpm.ReadPublic(key, hmacSession.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return xerrors.Errorf("cannot read public area of sealed key object: %w", err)
+	}
+
+	lockIndex, err := tpm.CreateResourceContextFromTPM(lockNVHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, lockNVHandle):
+		return ErrTPMProvisioning
+	case err != nil:
+		return xerrors.Errorf("cannot create context for lock NV index: %w", err)
+	}
+	lockIndexPub, _, err := tpm.NVReadPublic(lockIndex, hmacSession.IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return xerrors.Errorf("cannot read public area of lock NV index: %w", err)
+	}
+	// The authorization policy is computed against the name of the lock NV index before access to sealed key objects is locked.
+	lockIndexPub.Attrs &^= tpm2.AttrNVReadLocked
+	lockIndexName, err := lockIndexPub.Name()
+	if err != nil {
+		return xerrors.Errorf("cannot compute name of lock NV index: %w", err)
+	}
+
+	pinIndexHandle := k.data.staticPolicyData.PinIndexHandle
+	if pinIndexHandle.Type() != tpm2.HandleTypeNVIndex {
+		return InvalidKeyFileError{"invalid handle type for PIN NV index"}
+	}
+	pinIndex, err := tpm.CreateResourceContextFromTPM(pinIndexHandle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, pinIndexHandle):
+		return InvalidKeyFileError{"no PIN NV index found"}
+	case err != nil:
+		return xerrors.Errorf("cannot create context for PIN NV index: %w", err)
+	}
+
+	authPolicy, err := k.data.computeAuthPolicy(pinIndex.Name(), lockIndexName)
+	if err != nil || !bytes.Equal(authPolicy, pub.AuthPolicy) {
+		return ErrKeyFileCorrupt
+	}
+	return nil
+}
+
+// checkFirmwareVersion checks that the TPM's firmware version is not older than the minimum firmware version required by the
+// sealed key object, if there is one. There isn't a TPM2 policy assertion that can compare a TPM property against a reference
+// value (TPM2_PolicyNV only operates on NV indices), so this check is enforced in software rather than by the TPM.
+func (k *SealedKeyObject) checkFirmwareVersion(tpm *TPMConnection) error {
+	if k.data.minFirmwareVersion == 0 {
+		return nil
+	}
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyFirmwareVersion1, 1, tpm.HmacSession().IncludeAttrs(tpm2.AttrAudit))
+	if err != nil {
+		return xerrors.Errorf("cannot request firmware version from TPM: %w", err)
+	}
+	if len(props) == 0 || props[0].Property != tpm2.PropertyFirmwareVersion1 {
+		return errors.New("TPM did not return the firmware version")
+	}
+	if props[0].Value < k.data.minFirmwareVersion {
+		return ErrTPMFirmwareVersionTooOld
+	}
+	return nil
+}
+
+// convertPolicySessionError converts an error from executing the authorization policy assertions for a sealed key object in to
+// the errors documented for UnsealFromTPM.
+func convertPolicySessionError(err error) error {
+	err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
+	switch {
+	case isDynamicPolicyDataError(err):
+		// TODO: Add a separate error for this
+		return InvalidKeyFileError{err.Error()}
+	case isStaticPolicyDataError(err):
+		return InvalidKeyFileError{err.Error()}
+	case isAuthFailError(err, tpm2.CommandPolicySecret, 1):
+		return ErrPINFail
+	case tpm2.IsResourceUnavailableError(err, lockNVHandle):
+		return ErrTPMProvisioning
+	case tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandPolicyNV):
+		return ErrSealedKeyAccessLocked
+	}
+	return err
+}
+
+// executePolicySession executes the authorization policy assertions for the sealed key object in the supplied policy session,
+// converting errors in to the errors documented for UnsealFromTPM. If userPINIndex is not zero, the supplied PIN is used to
+// authorize the user PIN NV index at that handle rather than the sealed key object's PIN NV index. If authorization is not nil,
+// it is used for the TPM2_PolicyAuthorize assertion rather than verifying the signature of the dynamic authorization policy again.
+func (k *SealedKeyObject) executePolicySession(tpm *TPMConnection, policySession, hmacSession tpm2.SessionContext, pin string, networkSecret []byte,
+	userPINIndex tpm2.Handle, authorization *dynamicPolicyAuthorization) error {
+	pinIndexAuth := pinIndexAuthValue(pin)
+	switch {
+	case len(k.data.userPINIndexHandles) > 0:
+		if userPINIndex == 0 {
+			return ErrUserPINRequired
+		}
+		if err := k.executeUserPINAssertions(tpm, policySession, hmacSession, userPINIndex, pin); err != nil {
+			return err
+		}
+		// The sealed key object's PIN NV index has no authorization value when there are user PINs.
+		pinIndexAuth = ""
+	case userPINIndex != 0:
+		return errors.New("the sealed key object has no user PINs")
+	}
+
+	if err := executePolicySession(tpm.TPMContext, policySession, k.data.staticPolicyData, k.data.dynamicPolicyData, authorization,
+		k.data.pcrGracePeriodExpiry, pinIndexAuth, hmacSession); err != nil {
+		return convertPolicySessionError(err)
+	}
+	if err := k.executePhysicalPresenceAssertion(tpm, policySession); err != nil {
+		return err
+	}
+	if err := k.executeNetworkSecretAssertion(tpm, policySession, hmacSession, networkSecret); err != nil {
+		return err
+	}
+	if err := k.executeSingleUseAssertion(tpm, policySession, hmacSession); err != nil {
+		return err
+	}
+	return k.executeAdminOverrideORAssertion(tpm, policySession)
+}
+
+// executePhysicalPresenceAssertion executes the TPM2_PolicyPhysicalPresence assertion in the supplied policy session if the sealed key
+// object requires physical presence. The TPM doesn't check that physical presence is asserted until the policy session is used for
+// authorization.
+func (k *SealedKeyObject) executePhysicalPresenceAssertion(tpm *TPMConnection, policySession tpm2.SessionContext) error {
+	if !k.data.requirePhysicalPresence {
+		return nil
+	}
+	if err := tpm.PolicyPhysicalPresence(policySession); err != nil {
+		return xerrors.Errorf("cannot execute physical presence assertion: %w", err)
+	}
+	return nil
+}
+
+// unsealWithPolicySessionNoRevoke unseals the supplied loaded sealed key object using a policy session in which the authorization
+// policy assertions have already been executed, converting errors in to the errors documented for UnsealFromTPM. A single use
+// sealed key object is not revoked.
+func (k *SealedKeyObject) unsealWithPolicySessionNoRevoke(tpm *TPMConnection, key tpm2.ResourceContext, policySession, hmacSession tpm2.SessionContext) ([]byte, error) {
+	keyData, err := tpm.Unseal(key, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
+	switch {
+	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
+		return nil, InvalidKeyFileError{"the authorization policy check failed during unsealing"}
+	case tpm2.IsTPMError(err, tpm2.ErrorPP, tpm2.CommandUnseal):
+		return nil, ErrPhysicalPresenceRequired
+	case err != nil:
+		return nil, xerrors.Errorf("cannot unseal key: %w", err)
+	}
+	return keyData, nil
+}
+
+// unsealWithPolicySession unseals the supplied loaded sealed key object in the same way as unsealWithPolicySessionNoRevoke. If the
+// sealed key object is single use, it is revoked after it has been unsealed.
+func (k *SealedKeyObject) unsealWithPolicySession(tpm *TPMConnection, key tpm2.ResourceContext, policySession, hmacSession tpm2.SessionContext) ([]byte, error) {
+	keyData, err := k.unsealWithPolicySessionNoRevoke(tpm, key, policySession, hmacSession)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := k.revokeSingleUse(tpm, hmacSession); err != nil {
+		return keyData, err
+	}
+
+	return keyData, nil
+}
+
+// CanLoadKey checks that the supplied sealed key object can be loaded in to the storage hierarchy of the TPM, without attempting to
+// unseal it. This can be used to detect a sealed key object that was created under a different storage root key (eg, one that was
+// sealed on a different TPM, or before the TPM was cleared) before it is deployed. The loaded object is flushed from the TPM
+// immediately.
+//
+// If the TPM is not provisioned correctly, then a ErrTPMProvisioning error will be returned.
+//
+// If the sealed key object cannot be loaded because it isn't associated with the storage root key on this TPM, or because it is
+// invalid, then a InvalidKeyFileError error will be returned.
+//
+// If the sealed key object loads but its authorization policy is inconsistent with the policy metadata in the key file, then a
+// ErrKeyFileCorrupt error will be returned.
+func (t *TPMConnection) CanLoadKey(k *SealedKeyObject) error {
+	key, err := k.loadToTPM(t, t.HmacSession())
+	if err != nil {
+		return err
+	}
+	t.FlushContext(key)
+	return nil
+}
+
 // UnsealFromTPM will load the TPM sealed object in to the TPM and attempt to unseal it, returning the cleartext key on success.
 // If a PIN has been set, the correct PIN must be provided via the pin argument. If the wrong PIN is provided, a ErrPINFail error
 // will be returned, and the TPM's dictionary attack counter will be incremented.
@@ -44,8 +304,28 @@ import (
 // If the TPM's current PCR values are not consistent with the PCR protection policy for this key file, a InvalidKeyFileError error
 // will be returned.
 //
+// If the connection was created with the TransientOnly option set, the sealed object is loaded under a transient storage root key
+// rather than the persistent one. If the authorization value for the storage hierarchy is incorrect, a AuthFailError error will
+// be returned.
+//
+// If this key file was created with the RequirePhysicalPresence field of KeyCreationParams set, the caller must assert physical
+// presence to the TPM via the platform (eg, by a button or GPIO signal handled by the platform firmware) before calling this
+// function. If physical presence is not asserted, a ErrPhysicalPresenceRequired error will be returned.
+//
+// If this key file was created with the NetworkSecretIndexHandle field of KeyCreationParams set, it must be unsealed with
+// UnsealFromTPMWithNetworkSecret, and this function will return a ErrNetworkSecretRequired error.
+//
+// If this key file was created with the MinFirmwareVersion field of KeyCreationParams set and the firmware version reported by
+// the TPM is older than this, a ErrTPMFirmwareVersionTooOld error will be returned.
+//
+// If user PINs have been added to this key file with AddUserPIN, it must be unsealed with UnsealFromTPMWithUserPIN, and this
+// function will return a ErrUserPINRequired error.
+//
 // If any of the metadata in this key file is invalid, a InvalidKeyFileError error will be returned.
 //
+// If the sealed object loads but its authorization policy is inconsistent with the policy metadata in this key file, a
+// ErrKeyFileCorrupt error will be returned before attempting to unseal it.
+//
 // If the TPM is missing any persistent resources associated with this key file, then a InvalidKeyFileError error will be returned.
 //
 // If the key file has been superceded (eg, by a call to UpdateKeyPCRProtectionPolicy), then a InvalidKeyFileError error will be
@@ -57,59 +337,65 @@ import (
 // If the metadata for the updatable part of the key file's authorization policy is not consistent with the approved policy, then a
 // InvalidKeyFileError error will be returned.
 //
-// If the provided PIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be
-// incremented.
+// If a passphrase has been set with ChangePassphrase, it should be provided via the pin argument. It is converted in the same way
+// as when it was set in order to compute the authorization value checked by the TPM.
+//
+// If the provided PIN or passphrase is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter
+// will be incremented.
 //
 // If access to sealed key objects created by this package is disallowed until the next TPM reset or TPM restart, then a
 // ErrSealedKeyAccessLocked error will be returned.
 //
+// If the owner (storage) hierarchy has been disabled, then a ErrOwnerHierarchyDisabled error will be returned.
+//
 // If the authorization policy check fails during unsealing, then a InvalidKeyFileError error will be returned. Note that this
 // condition can also occur as the result of an incorrectly provisioned TPM, which will be detected during a subsequent call to
 // SealKeyToTPM.
 //
+// If this key file was created with the SingleUseIndexHandle field of KeyCreationParams set and it has already been unsealed, a
+// ErrSingleUseKeyConsumed error will be returned. If the key is unsealed but it can't be revoked afterwards, the unsealed key is
+// returned along with a SingleUseRevocationError error.
+//
 // On success, the unsealed cleartext key is returned.
 func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) ([]byte, error) {
-	// Check if the TPM is in lockout mode
+	return k.unsealFromTPM(tpm, pin, nil, 0)
+}
+
+// checkLockout returns a ErrTPMLockout error if the TPM's dictionary attack logic has been triggered.
+func checkLockout(tpm *TPMConnection) error {
 	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyPermanent, 1)
 	if err != nil {
-		return nil, xerrors.Errorf("cannot fetch properties from TPM: %w", err)
+		return xerrors.Errorf("cannot fetch properties from TPM: %w", err)
 	}
 
 	if tpm2.PermanentAttributes(props[0].Value)&tpm2.AttrInLockout > 0 {
-		return nil, ErrTPMLockout
+		return ErrTPMLockout
+	}
+	return nil
+}
+
+func (k *SealedKeyObject) unsealFromTPM(tpm *TPMConnection, pin string, networkSecret []byte, userPINIndex tpm2.Handle) ([]byte, error) {
+	return k.unsealFromTPMCommon(tpm, pin, networkSecret, userPINIndex, true)
+}
+
+// unsealFromTPMCommon unseals the sealed key object in the same way as UnsealFromTPM. If revokeSingleUse is false, a single use
+// sealed key object is not revoked after it has been unsealed.
+func (k *SealedKeyObject) unsealFromTPMCommon(tpm *TPMConnection, pin string, networkSecret []byte, userPINIndex tpm2.Handle, revokeSingleUse bool) ([]byte, error) {
+	// Check if the TPM is in lockout mode
+	if err := checkLockout(tpm); err != nil {
+		return nil, err
+	}
+
+	if err := k.checkFirmwareVersion(tpm); err != nil {
+		return nil, err
 	}
 
 	// Use the HMAC session created when the connection was opened for parameter encryption rather than creating a new one.
 	hmacSession := tpm.HmacSession()
 
 	// Load the key data
-	key, err := k.data.load(tpm.TPMContext, hmacSession)
-	switch {
-	case isKeyFileError(err):
-		// A keyFileError can be as a result of an improperly provisioned TPM - detect if the object at srkHandle is a valid primary key
-		// with the correct attributes. If it's not, then it's definitely a provisioning error. If it is, then it could still be a
-		// provisioning error because we don't know if the object was created with the same template that ProvisionTPM uses. In that case,
-		// we'll just assume an invalid key file
-		srk, err2 := tpm.CreateResourceContextFromTPM(srkHandle)
-		switch {
-		case tpm2.IsResourceUnavailableError(err2, srkHandle):
-			return nil, ErrTPMProvisioning
-		case err2 != nil:
-			return nil, xerrors.Errorf("cannot create context for SRK: %w", err2)
-		}
-		ok, err2 := isObjectPrimaryKeyWithTemplate(tpm.TPMContext, tpm.OwnerHandleContext(), srk, srkTemplate, tpm.HmacSession())
-		switch {
-		case err2 != nil:
-			return nil, xerrors.Errorf("cannot determine if object at 0x%08x is a primary key in the storage hierarchy: %w", srkHandle, err2)
-		case !ok:
-			return nil, ErrTPMProvisioning
-		}
-		// This is probably a broken key file, but it could still be a provisioning error because we don't know if the SRK object was
-		// created with the same template that ProvisionTPM uses.
-		return nil, InvalidKeyFileError{err.Error()}
-	case tpm2.IsResourceUnavailableError(err, srkHandle):
-		return nil, ErrTPMProvisioning
-	case err != nil:
+	key, err := k.loadToTPM(tpm, hmacSession)
+	if err != nil {
 		return nil, err
 	}
 	defer tpm.FlushContext(key)
@@ -121,32 +407,168 @@ func (k *SealedKeyObject) UnsealFromTPM(tpm *TPMConnection, pin string) ([]byte,
 	}
 	defer tpm.FlushContext(policySession)
 
-	if err := executePolicySession(tpm.TPMContext, policySession, k.data.staticPolicyData, k.data.dynamicPolicyData, pin, hmacSession); err != nil {
-		err = xerrors.Errorf("cannot complete authorization policy assertions: %w", err)
-		switch {
-		case isDynamicPolicyDataError(err):
-			// TODO: Add a separate error for this
-			return nil, InvalidKeyFileError{err.Error()}
-		case isStaticPolicyDataError(err):
-			return nil, InvalidKeyFileError{err.Error()}
-		case isAuthFailError(err, tpm2.CommandPolicySecret, 1):
-			return nil, ErrPINFail
-		case tpm2.IsResourceUnavailableError(err, lockNVHandle):
-			return nil, ErrTPMProvisioning
-		case tpm2.IsTPMError(err, tpm2.ErrorNVLocked, tpm2.CommandPolicyNV):
-			return nil, ErrSealedKeyAccessLocked
+	if err := k.executePolicySession(tpm, policySession, hmacSession, pin, networkSecret, userPINIndex, nil); err != nil {
+		return nil, err
+	}
+
+	// Unseal
+	if !revokeSingleUse {
+		return k.unsealWithPolicySessionNoRevoke(tpm, key, policySession, hmacSession)
+	}
+	return k.unsealWithPolicySession(tpm, key, policySession, hmacSession)
+}
+
+// UnsealWithPINCallback will unseal the supplied sealed key object in the same way as SealedKeyObject.UnsealFromTPM, obtaining the
+// PIN or passphrase by calling getPIN. The number of authorization attempts remaining before the TPM enters dictionary attack
+// lockout mode is passed to getPIN. If the supplied PIN or passphrase is incorrect, getPIN is called again until unsealing succeeds
+// or the TPM enters lockout mode. If the sealed key object doesn't have a PIN or passphrase, then it is unsealed without calling
+// getPIN.
+//
+// If getPIN returns an error, this function returns immediately with that error. This can be used by the caller to abort.
+//
+// If the TPM's dictionary attack logic has been triggered, or no authorization attempts remain, a ErrTPMLockout error will be
+// returned.
+//
+// If user PINs have been added to the sealed key object with AddUserPIN, a ErrUserPINRequired error will be returned without
+// calling getPIN, as the caller must identify the user PIN NV index and use SealedKeyObject.UnsealFromTPMWithUserPIN. If a security
+// key has been registered with RegisterSecurityKey, an error will be returned without calling getPIN, as the secret must be obtained
+// from the security key and supplied to SealedKeyObject.UnsealFromTPMWithSecurityKey.
+//
+// Other errors returned from SealedKeyObject.UnsealFromTPM are returned from this function unmodified.
+func (t *TPMConnection) UnsealWithPINCallback(k *SealedKeyObject, getPIN func(attemptsRemaining int) (string, error)) ([]byte, error) {
+	if len(k.data.userPINIndexHandles) > 0 {
+		return nil, ErrUserPINRequired
+	}
+
+	switch k.AuthMode2F() {
+	case AuthModeNone:
+		return k.UnsealFromTPM(t, "")
+	case AuthModeSecurityKey:
+		return nil, errors.New("the sealed key object has a security key registered, which cannot be supplied via a PIN callback")
+	}
+
+	for {
+		state, err := readDALockoutState(t.TPMContext)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot read dictionary attack state: %w", err)
+		}
+		if state.InLockout || state.FailedTries >= state.MaxTries {
+			return nil, ErrTPMLockout
+		}
+
+		pin, err := getPIN(int(state.MaxTries - state.FailedTries))
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := k.UnsealFromTPM(t, pin)
+		if xerrors.Is(err, ErrPINFail) {
+			continue
 		}
+		return key, err
+	}
+}
+
+// UnsealSecretFromTPM will unseal the key in the same way as UnsealFromTPM, but returns the cleartext key wrapped in a SecretBuffer,
+// which the caller should destroy with SecretBuffer.Destroy once the key is no longer required.
+//
+// This returns the same errors as UnsealFromTPM.
+func (k *SealedKeyObject) UnsealSecretFromTPM(tpm *TPMConnection, pin string) (*SecretBuffer, error) {
+	key, err := k.UnsealFromTPM(tpm, pin)
+	var revokeErr SingleUseRevocationError
+	if err != nil && !xerrors.As(err, &revokeErr) {
+		return nil, err
+	}
+	return NewSecretBuffer(key), err
+}
+
+// UnsealFromTPMWithSession will load the TPM sealed object in to the TPM and attempt to unseal it using the supplied policy session,
+// returning the cleartext key on success. This is intended for use by callers that execute the authorization policy assertions
+// themselves (eg, an external policy solver), and the supplied session must already be in a state that satisfies the authorization
+// policy of the sealed object. This function does not execute any policy assertions, and it does not flush the supplied session.
+// Note that the TPM flushes the policy session after a successful unseal unless it has the tpm2.AttrContinueSession attribute set.
+//
+// If the TPM is not provisioned correctly, then a ErrTPMProvisioning error will be returned.
+//
+// If the TPM sealed object cannot be loaded in to the TPM for reasons other than the lack of a storage root key, then a
+// InvalidKeyFileError error will be returned.
+//
+// If the supplied session does not satisfy the authorization policy of the sealed object, then a ErrPolicySessionNotSatisfied error
+// will be returned.
+func (k *SealedKeyObject) UnsealFromTPMWithSession(tpm *TPMConnection, policySession tpm2.SessionContext) ([]byte, error) {
+	if policySession == nil {
+		return nil, errors.New("no policy session provided")
+	}
+
+	// Use the HMAC session created when the connection was opened for parameter encryption rather than creating a new one.
+	hmacSession := tpm.HmacSession()
+
+	// Load the key data
+	key, err := k.loadToTPM(tpm, hmacSession)
+	if err != nil {
 		return nil, err
 	}
+	defer tpm.FlushContext(key)
 
 	// Unseal
 	keyData, err := tpm.Unseal(key, policySession, hmacSession.IncludeAttrs(tpm2.AttrResponseEncrypt))
 	switch {
 	case tpm2.IsTPMSessionError(err, tpm2.ErrorPolicyFail, tpm2.CommandUnseal, 1):
-		return nil, InvalidKeyFileError{"the authorization policy check failed during unsealing"}
+		return nil, ErrPolicySessionNotSatisfied
 	case err != nil:
 		return nil, xerrors.Errorf("cannot unseal key: %w", err)
 	}
 
+	if err := k.revokeSingleUse(tpm, hmacSession); err != nil {
+		return keyData, err
+	}
+
 	return keyData, nil
 }
+
+// KeyDerivationParams contains the parameters used by UnsealDerivedKeyFromTPM to derive a key from the secret protected by a sealed
+// key object.
+type KeyDerivationParams struct {
+	// Info is a context specific label that is used to derive a unique key, such as a volume identifier. Keys derived from the same
+	// sealed secret with a different Info are independent of each other.
+	Info []byte
+
+	// Length is the length of the derived key in bytes. This must be between 1 and 8160.
+	Length int
+}
+
+// UnsealDerivedKeyFromTPM will unseal the secret protected by this sealed key object in the same way as UnsealFromTPM, but rather
+// than returning the unsealed secret, it uses the unsealed secret as a seed to derive a key using HKDF-Expand (RFC5869) with SHA-256
+// and the label and length specified via the params argument. This allows a single sealed secret to protect multiple volumes using
+// distinct derived keys. The derivation is reproducible, so the same params must be supplied each time a key is derived. These are
+// not stored in the key data file and are the responsibility of the caller.
+//
+// The sealed secret must be at least 32 bytes long in order to be used as a seed. The unsealed secret is cleared from memory once
+// the key has been derived from it.
+//
+// This returns the same errors as UnsealFromTPM.
+func (k *SealedKeyObject) UnsealDerivedKeyFromTPM(tpm *TPMConnection, pin string, params *KeyDerivationParams) ([]byte, error) {
+	if params == nil {
+		return nil, errors.New("no key derivation params provided")
+	}
+	if params.Length < 1 || params.Length > 255*crypto.SHA256.Size() {
+		return nil, errors.New("invalid derived key length")
+	}
+
+	seed, err := k.UnsealFromTPM(tpm, pin)
+	var revokeErr SingleUseRevocationError
+	if err != nil && !xerrors.As(err, &revokeErr) {
+		return nil, err
+	}
+	defer func() {
+		for i := range seed {
+			seed[i] = 0
+		}
+	}()
+
+	if len(seed) < crypto.SHA256.Size() {
+		return nil, errors.New("the sealed secret is too short to be used as a seed for key derivation")
+	}
+
+	return hkdfExpand(crypto.SHA256, seed, params.Info, params.Length), err
+}
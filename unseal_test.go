@@ -21,6 +21,9 @@ package secboot_test
 
 import (
 	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
 	"io/ioutil"
 	"math/rand"
 	"os"
@@ -34,7 +37,7 @@ func TestUnsealWithNo2FA(t *testing.T) {
 	tpm := openTPMForTesting(t)
 	defer closeTPM(t, tpm)
 
-	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 		t.Fatalf("Failed to provision TPM for test: %v", err)
 	}
 
@@ -77,13 +80,20 @@ func TestUnsealWithNo2FA(t *testing.T) {
 	t.Run("NilPCRProfile", func(t *testing.T) {
 		run(t, &KeyCreationParams{PINHandle: 0x0181fff0})
 	})
+
+	t.Run("MixedPCRBanks", func(t *testing.T) {
+		profile := NewPCRProtectionProfile().
+			AddPCRValueFromTPM(tpm2.HashAlgorithmSHA1, 0).
+			AddPCRValueFromTPM(tpm2.HashAlgorithmSHA256, 7)
+		run(t, &KeyCreationParams{PCRProfile: profile, PINHandle: 0x0181fff0})
+	})
 }
 
 func TestUnsealWithPIN(t *testing.T) {
 	tpm := openTPMForTesting(t)
 	defer closeTPM(t, tpm)
 
-	if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 		t.Fatalf("Failed to provision TPM for test: %v", err)
 	}
 
@@ -124,12 +134,283 @@ func TestUnsealWithPIN(t *testing.T) {
 	}
 }
 
+func TestUnsealWithSession(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithSession_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	t.Run("Satisfied", func(t *testing.T) {
+		session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatalf("StartAuthSession failed: %v", err)
+		}
+		defer flushContext(t, tpm, session)
+
+		if err := k.ExecutePolicySession(tpm, session, ""); err != nil {
+			t.Fatalf("ExecutePolicySession failed: %v", err)
+		}
+
+		keyUnsealed, err := k.UnsealFromTPMWithSession(tpm, session.IncludeAttrs(tpm2.AttrContinueSession))
+		if err != nil {
+			t.Fatalf("UnsealFromTPMWithSession failed: %v", err)
+		}
+
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	})
+
+	t.Run("NotSatisfied", func(t *testing.T) {
+		session, err := tpm.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, tpm2.HashAlgorithmSHA256)
+		if err != nil {
+			t.Fatalf("StartAuthSession failed: %v", err)
+		}
+		defer flushContext(t, tpm, session)
+
+		_, err = k.UnsealFromTPMWithSession(tpm, session.IncludeAttrs(tpm2.AttrContinueSession))
+		if err != ErrPolicySessionNotSatisfied {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestUnsealer(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealer_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	unsealer, err := tpm.NewUnsealer(k)
+	if err != nil {
+		t.Fatalf("NewUnsealer failed: %v", err)
+	}
+	defer func() {
+		if err := unsealer.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		keyUnsealed, err := unsealer.Unseal("")
+		if err != nil {
+			t.Fatalf("Unseal failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+
+	changed, err := unsealer.PCRsChanged()
+	if err != nil {
+		t.Fatalf("PCRsChanged failed: %v", err)
+	}
+	if changed {
+		t.Errorf("PCRsChanged should have returned false")
+	}
+
+	if _, err := tpm.PCREvent(tpm.PCRHandleContext(7), tpm2.Event("foo"), nil); err != nil {
+		t.Errorf("PCREvent failed: %v", err)
+	}
+
+	changed, err = unsealer.PCRsChanged()
+	if err != nil {
+		t.Fatalf("PCRsChanged failed: %v", err)
+	}
+	if !changed {
+		t.Errorf("PCRsChanged should have returned true")
+	}
+
+	_, err = unsealer.Unseal("")
+	if _, ok := err.(InvalidKeyFileError); !ok || err.Error() != "invalid key data file: cannot complete authorization policy "+
+		"assertions: cannot complete OR assertions: current session digest not found in policy data" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestUnsealerWithPIN(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealerWithPIN_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	if err := ChangePIN(tpm, keyFile, "", "1234"); err != nil {
+		t.Fatalf("ChangePIN failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	unsealer, err := tpm.NewUnsealer(k)
+	if err != nil {
+		t.Fatalf("NewUnsealer failed: %v", err)
+	}
+	defer func() {
+		if err := unsealer.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+	}()
+
+	if _, err := unsealer.Unseal("5678"); err != ErrPINFail {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	keyUnsealed, err := unsealer.Unseal("1234")
+	if err != nil {
+		t.Fatalf("Unseal failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+
+	// The TPM's dictionary attack logic should be checked for each unseal, not just when the unsealer is created.
+	if err := tpm.DictionaryAttackParameters(tpm.LockoutHandleContext(), 0, 7200, 86400, nil); err != nil {
+		t.Fatalf("DictionaryAttackParameters failed: %v", err)
+	}
+	if _, err := unsealer.Unseal("1234"); err != ErrTPMLockout {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestHkdfExpand(t *testing.T) {
+	// Test case 1 from RFC5869, appendix A.1
+	prk, _ := hex.DecodeString("077709362c2e32df0ddc3f0dc47bba6390b6c73bb50f9c3122ec844ad7c2b3e5")
+	info, _ := hex.DecodeString("f0f1f2f3f4f5f6f7f8f9")
+	expected, _ := hex.DecodeString("3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865")
+
+	okm := HkdfExpand(crypto.SHA256, prk, info, 42)
+	if !bytes.Equal(okm, expected) {
+		t.Errorf("Unexpected output: %x", okm)
+	}
+}
+
+func TestUnsealDerivedKey(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealDerivedKey_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	run := func(t *testing.T, info []byte, length int) []byte {
+		derived, err := k.UnsealDerivedKeyFromTPM(tpm, "", &KeyDerivationParams{Info: info, Length: length})
+		if err != nil {
+			t.Fatalf("UnsealDerivedKeyFromTPM failed: %v", err)
+		}
+		if len(derived) != length {
+			t.Errorf("Derived key has the wrong length")
+		}
+		if !bytes.Equal(derived, HkdfExpand(crypto.SHA256, key, info, length)) {
+			t.Errorf("Unexpected derived key")
+		}
+		return derived
+	}
+
+	key1 := run(t, []byte("volume1"), 32)
+	key2 := run(t, []byte("volume2"), 32)
+	if bytes.Equal(key1, key2) {
+		t.Errorf("Derived keys for different labels should be different")
+	}
+	run(t, []byte("volume1"), 64)
+
+	if _, err := k.UnsealDerivedKeyFromTPM(tpm, "", &KeyDerivationParams{Info: []byte("foo"), Length: 0}); err == nil {
+		t.Errorf("UnsealDerivedKeyFromTPM should have failed with an invalid length")
+	}
+}
+
 func TestUnsealErrorHandling(t *testing.T) {
 	key := make([]byte, 64)
 	rand.Read(key)
 
 	run := func(t *testing.T, tpm *TPMConnection, fn func(string, string)) error {
-		if err := ProvisionTPM(tpm, ProvisionModeFull, nil); err != nil {
+		if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
 			t.Errorf("ProvisionTPM failed: %v", err)
 		}
 
@@ -283,4 +564,456 @@ func TestUnsealErrorHandling(t *testing.T) {
 			t.Errorf("Unexpected error: %v", err)
 		}
 	})
+
+	t.Run("OwnerHierarchyDisabled", func(t *testing.T) {
+		tpm, _ := openTPMSimulatorForTesting(t)
+		defer closeTPM(t, tpm)
+
+		if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+			t.Errorf("ProvisionTPM failed: %v", err)
+		}
+
+		tmpDir, err := ioutil.TempDir("", "_TestUnsealErrorHandling_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := tmpDir + "/keydata"
+
+		if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+
+		if err := tpm.HierarchyControl(tpm.OwnerHandleContext(), tpm2.HandleOwner, false, nil); err != nil {
+			t.Fatalf("HierarchyControl failed: %v", err)
+		}
+		if _, err := k.UnsealFromTPM(tpm, ""); err != ErrOwnerHierarchyDisabled {
+			t.Errorf("Unexpected error: %v", err)
+		}
+		if err := tpm.HierarchyControl(tpm.PlatformHandleContext(), tpm2.HandleOwner, true, nil); err != nil {
+			t.Fatalf("HierarchyControl failed: %v", err)
+		}
+
+		if _, err := k.UnsealFromTPM(tpm, ""); err != nil {
+			t.Errorf("UnsealFromTPM failed: %v", err)
+		}
+	})
+}
+
+func TestCanLoadKey(t *testing.T) {
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	run := func(t *testing.T, tpm *TPMConnection, fn func()) error {
+		if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+			t.Errorf("ProvisionTPM failed: %v", err)
+		}
+
+		tmpDir, err := ioutil.TempDir("", "_TestCanLoadKey_")
+		if err != nil {
+			t.Fatalf("Creating temporary directory failed: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		keyFile := tmpDir + "/keydata"
+
+		if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+
+		fn()
+
+		return tpm.CanLoadKey(k)
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+
+		if err := run(t, tpm, func() {}); err != nil {
+			t.Errorf("CanLoadKey failed: %v", err)
+		}
+
+		// Make sure that the sealed key object was flushed.
+		handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+		if err != nil {
+			t.Fatalf("GetCapability failed: %v", err)
+		}
+		if len(handles) > 0 {
+			t.Errorf("Unexpected transient objects: %v", handles)
+		}
+	})
+
+	t.Run("NoSRK", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+
+		err := run(t, tpm, func() {
+			srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+			if err != nil {
+				t.Fatalf("No SRK: %v", err)
+			}
+			if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), srk, srk.Handle(), nil); err != nil {
+				t.Errorf("EvictControl failed: %v", err)
+			}
+		})
+		if err != ErrTPMProvisioning {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("DifferentSRK", func(t *testing.T) {
+		tpm := openTPMForTesting(t)
+		defer closeTPM(t, tpm)
+
+		err := run(t, tpm, func() {
+			srk, err := tpm.CreateResourceContextFromTPM(SrkHandle)
+			if err != nil {
+				t.Fatalf("No SRK: %v", err)
+			}
+			if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), srk, srk.Handle(), nil); err != nil {
+				t.Errorf("EvictControl failed: %v", err)
+			}
+			srkTemplate := MakeDefaultSRKTemplate()
+			srkTemplate.Unique.RSA()[0] = 0xff
+			srkTransient, _, _, _, _, err := tpm.CreatePrimary(tpm.OwnerHandleContext(), nil, srkTemplate, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("CreatePrimary failed: %v", err)
+			}
+			defer flushContext(t, tpm, srkTransient)
+			if _, err := tpm.EvictControl(tpm.OwnerHandleContext(), srkTransient, SrkHandle, nil); err != nil {
+				t.Errorf("EvictControl failed: %v", err)
+			}
+		})
+		if _, ok := err.(InvalidKeyFileError); !ok {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestUnsealCorruptKeyFile(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Errorf("ProvisionTPM failed: %v", err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealCorruptKeyFile_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	// The sealed object still loads, but its authorization policy no longer matches the metadata.
+	k.SetRequirePhysicalPresence(true)
+
+	if err := tpm.CanLoadKey(k); err != ErrKeyFileCorrupt {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrKeyFileCorrupt {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Make sure that the sealed key object was flushed.
+	handles, err := tpm.GetCapabilityHandles(tpm2.HandleTypeTransient.BaseHandle(), tpm2.CapabilityMaxProperties)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	if len(handles) > 0 {
+		t.Errorf("Unexpected transient objects: %v", handles)
+	}
+}
+
+func TestUnsealWithPhysicalPresence(t *testing.T) {
+	tpm, _ := openTPMSimulatorForTesting(t)
+	closed := false
+	defer func() {
+		if !closed {
+			closeTPM(t, tpm)
+		}
+	}()
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithPhysicalPresence_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0, RequirePhysicalPresence: true}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrPhysicalPresenceRequired {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Assert physical presence. The connection to the simulator has to be closed for this.
+	closeTPM(t, tpm)
+	closed = true
+	setSimulatorPhysicalPresence(t, true)
+	defer setSimulatorPhysicalPresence(t, false)
+
+	tpm, _ = openTPMSimulatorForTesting(t)
+	defer closeTPM(t, tpm)
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+	if err != nil {
+		t.Fatalf("UnsealFromTPM failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestUnsealWithMinFirmwareVersion(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	props, err := tpm.GetCapabilityTPMProperties(tpm2.PropertyFirmwareVersion1, 1)
+	if err != nil {
+		t.Fatalf("GetCapability failed: %v", err)
+	}
+	firmwareVersion := props[0].Value
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithMinFirmwareVersion_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	run := func(t *testing.T, minVersion uint32, expectedErr error) {
+		keyFile := tmpDir + "/keydata"
+
+		if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0, MinFirmwareVersion: minVersion}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if k.MinFirmwareVersion() != minVersion {
+			t.Errorf("Unexpected minimum firmware version: 0x%08x", k.MinFirmwareVersion())
+		}
+
+		keyUnsealed, err := k.UnsealFromTPM(tpm, "")
+		if expectedErr != nil {
+			if err != expectedErr {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("UnsealFromTPM failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+
+	t.Run("Current", func(t *testing.T) {
+		run(t, firmwareVersion, nil)
+	})
+	t.Run("Newer", func(t *testing.T) {
+		run(t, firmwareVersion+1, ErrTPMFirmwareVersionTooOld)
+	})
+}
+
+func TestUnsealWithPINCallback(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+	defer func() {
+		if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), nil); err != nil {
+			t.Errorf("DictionaryAttackLockReset failed: %v", err)
+		}
+	}()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithPINCallback_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	testPIN := "1234"
+
+	if err := ChangePIN(tpm, keyFile, "", testPIN); err != nil {
+		t.Errorf("ChangePIN failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+
+	t.Run("Retry", func(t *testing.T) {
+		var attempts []int
+		keyUnsealed, err := tpm.UnsealWithPINCallback(k, func(attemptsRemaining int) (string, error) {
+			attempts = append(attempts, attemptsRemaining)
+			if len(attempts) == 1 {
+				return "5678", nil
+			}
+			return testPIN, nil
+		})
+		if err != nil {
+			t.Fatalf("UnsealWithPINCallback failed: %v", err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+		if len(attempts) != 2 {
+			t.Fatalf("Unexpected number of attempts: %d", len(attempts))
+		}
+		if attempts[1] != attempts[0]-1 {
+			t.Errorf("Unexpected attempts remaining: %v", attempts)
+		}
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		abortErr := errors.New("aborted")
+		_, err := tpm.UnsealWithPINCallback(k, func(int) (string, error) {
+			return "", abortErr
+		})
+		if err != abortErr {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+}
+
+func TestUnsealWithPINCallbackUnsupportedAuthModes(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUnsealWithPINCallbackUnsupportedAuthModes_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	getPIN := func(int) (string, error) {
+		t.Errorf("getPIN shouldn't be called")
+		return "", errors.New("unexpected call")
+	}
+
+	t.Run("UserPIN", func(t *testing.T) {
+		keyFile := tmpDir + "/keydata1"
+		policyUpdateFile := tmpDir + "/keypolicyupdatedata1"
+
+		if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		if err := AddUserPIN(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), 0x0181ff00, "1234"); err != nil {
+			t.Fatalf("AddUserPIN failed: %v", err)
+		}
+		defer func() {
+			if rc, err := tpm.CreateResourceContextFromTPM(0x0181ff00); err == nil {
+				undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+			}
+		}()
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		if _, err := tpm.UnsealWithPINCallback(k, getPIN); err != ErrUserPINRequired {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
+
+	t.Run("SecurityKey", func(t *testing.T) {
+		keyFile := tmpDir + "/keydata2"
+
+		if err := SealKeyToTPM(tpm, key, keyFile, "", &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff1}); err != nil {
+			t.Fatalf("SealKeyToTPM failed: %v", err)
+		}
+		defer undefineKeyNVSpace(t, tpm, keyFile)
+
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		if err := RegisterSecurityKey(tpm, keyFile, "", secret); err != nil {
+			t.Fatalf("RegisterSecurityKey failed: %v", err)
+		}
+
+		k, err := ReadSealedKeyObject(keyFile)
+		if err != nil {
+			t.Fatalf("ReadSealedKeyObject failed: %v", err)
+		}
+		_, err = tpm.UnsealWithPINCallback(k, getPIN)
+		if err == nil || err.Error() != "the sealed key object has a security key registered, which cannot be supplied via a PIN callback" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	})
 }
@@ -0,0 +1,191 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+// Unsealer supports unsealing the same sealed key object repeatedly, without the overhead of loading the object in to the TPM,
+// starting a new policy session and verifying the signature of the dynamic authorization policy for each unseal. It is returned
+// from TPMConnection.NewUnsealer, and must be closed with Close when it is no longer required in order to free the resources that
+// it holds on the TPM.
+//
+// The TPM resets the policy session after each use, so the remaining authorization policy assertions are still executed for each
+// call to Unseal, using the verification ticket for the dynamic authorization policy obtained when the Unsealer was created. The
+// PIN and any other secrets required by the authorization policy are supplied to each call, and are not retained.
+//
+// If any of the PCRs included in the PCR selection of the sealed key object's authorization policy are extended between calls to
+// Unseal, the authorization policy will most likely no longer be satisfied and Unseal will return a InvalidKeyFileError error.
+// PCRsChanged can be used to detect whether any PCR has been extended since the Unsealer was created.
+type Unsealer struct {
+	tpm              *TPMConnection
+	k                *SealedKeyObject
+	key              tpm2.ResourceContext
+	policySession    tpm2.SessionContext
+	authorization    *dynamicPolicyAuthorization
+	pcrUpdateCounter uint32
+}
+
+// NewUnsealer loads the supplied sealed key object in to the TPM, verifies the signature of its dynamic authorization policy and
+// starts a policy session that can be used for unsealing it repeatedly via the returned Unsealer.
+//
+// If the TPM's dictionary attack logic has been triggered, a ErrTPMLockout error will be returned.
+//
+// If the sealed key object requires a minimum TPM firmware version and the firmware version reported by the TPM is older than
+// this, a ErrTPMFirmwareVersionTooOld error will be returned.
+//
+// If the TPM is not provisioned correctly, then a ErrTPMProvisioning error will be returned.
+//
+// If the TPM sealed object cannot be loaded in to the TPM for reasons other than the lack of a storage root key, or the dynamic
+// authorization policy is invalid or has not been signed, then a InvalidKeyFileError error will be returned.
+func (t *TPMConnection) NewUnsealer(k *SealedKeyObject) (*Unsealer, error) {
+	if k == nil {
+		return nil, errors.New("no sealed key object provided")
+	}
+
+	// Check if the TPM is in lockout mode
+	if err := checkLockout(t); err != nil {
+		return nil, err
+	}
+
+	if err := k.checkFirmwareVersion(t); err != nil {
+		return nil, err
+	}
+
+	hmacSession := t.HmacSession()
+
+	pcrUpdateCounter, _, err := t.PCRRead(k.data.dynamicPolicyData.PCRSelection)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot read PCR update counter: %w", err)
+	}
+
+	key, err := k.loadToTPM(t, hmacSession)
+	if err != nil {
+		return nil, err
+	}
+
+	succeeded := false
+	defer func() {
+		if succeeded {
+			return
+		}
+		t.FlushContext(key)
+	}()
+
+	authorization, err := authorizeDynamicPolicy(t.TPMContext, k.data.staticPolicyData, k.data.dynamicPolicyData)
+	if err != nil {
+		return nil, convertPolicySessionError(err)
+	}
+
+	policySession, err := t.StartAuthSession(nil, nil, tpm2.SessionTypePolicy, nil, k.data.keyPublic.NameAlg)
+	if err != nil {
+		return nil, xerrors.Errorf("cannot start policy session: %w", err)
+	}
+
+	succeeded = true
+	return &Unsealer{
+		tpm:              t,
+		k:                k,
+		key:              key,
+		policySession:    policySession.IncludeAttrs(tpm2.AttrContinueSession),
+		authorization:    authorization,
+		pcrUpdateCounter: pcrUpdateCounter}, nil
+}
+
+// Unseal executes the authorization policy assertions for the sealed key object associated with this Unsealer and then unseals it,
+// returning the cleartext key on success. If a PIN has been set, the correct PIN must be provided via the pin argument.
+//
+// This returns the same errors as SealedKeyObject.UnsealFromTPM. The TPM's dictionary attack logic is checked on each call.
+func (u *Unsealer) Unseal(pin string) ([]byte, error) {
+	return u.unseal(pin, nil, 0)
+}
+
+// UnsealWithNetworkSecret is like Unseal, but for a sealed key object that is bound to a network secret. It returns the same
+// errors as SealedKeyObject.UnsealFromTPMWithNetworkSecret.
+func (u *Unsealer) UnsealWithNetworkSecret(pin string, secret []byte) ([]byte, error) {
+	if !u.k.IsNetworkBound() {
+		secret = nil
+	}
+	return u.unseal(pin, secret, 0)
+}
+
+// UnsealWithUserPIN is like Unseal, but for a sealed key object that has user PINs. It returns the same errors as
+// SealedKeyObject.UnsealFromTPMWithUserPIN.
+func (u *Unsealer) UnsealWithUserPIN(handle tpm2.Handle, pin string) ([]byte, error) {
+	return u.unseal(pin, nil, handle)
+}
+
+func (u *Unsealer) unseal(pin string, networkSecret []byte, userPINIndex tpm2.Handle) ([]byte, error) {
+	if u.key == nil {
+		return nil, errors.New("the unsealer has been closed")
+	}
+
+	// Check if the TPM is in lockout mode, as this may have changed since the last call.
+	if err := checkLockout(u.tpm); err != nil {
+		return nil, err
+	}
+
+	hmacSession := u.tpm.HmacSession()
+
+	if err := u.tpm.PolicyRestart(u.policySession); err != nil {
+		return nil, xerrors.Errorf("cannot restart policy session: %w", err)
+	}
+	if err := u.k.executePolicySession(u.tpm, u.policySession, hmacSession, pin, networkSecret, userPINIndex, u.authorization); err != nil {
+		return nil, err
+	}
+
+	return u.k.unsealWithPolicySession(u.tpm, u.key, u.policySession, hmacSession)
+}
+
+// PCRsChanged indicates whether any PCR has been extended since this Unsealer was created, by comparing the TPM's PCR update
+// counter. If this returns true, subsequent calls to Unseal may fail if the PCR protection policy of the sealed key object is no
+// longer satisfied. Note that the TPM doesn't increment the PCR update counter when some PCRs are extended (such as the debug
+// PCR), so this is not a guarantee that Unseal will succeed.
+func (u *Unsealer) PCRsChanged() (bool, error) {
+	pcrUpdateCounter, _, err := u.tpm.PCRRead(u.k.data.dynamicPolicyData.PCRSelection)
+	if err != nil {
+		return false, xerrors.Errorf("cannot read PCR update counter: %w", err)
+	}
+	return pcrUpdateCounter != u.pcrUpdateCounter, nil
+}
+
+// Close flushes the sealed key object and policy session associated with this Unsealer from the TPM. The Unsealer cannot be used
+// after this.
+func (u *Unsealer) Close() error {
+	if u.key == nil {
+		return errors.New("the unsealer has already been closed")
+	}
+
+	var firstErr error
+	if err := u.tpm.FlushContext(u.key); err != nil {
+		firstErr = xerrors.Errorf("cannot flush sealed key object: %w", err)
+	}
+	if err := u.tpm.FlushContext(u.policySession); err != nil && firstErr == nil {
+		firstErr = xerrors.Errorf("cannot flush policy session: %w", err)
+	}
+	u.key = nil
+	u.policySession = nil
+	return firstErr
+}
@@ -0,0 +1,268 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/canonical/go-tpm2"
+
+	"golang.org/x/xerrors"
+)
+
+const (
+	// MaxUserPINs is the maximum number of user PINs that can be associated with a sealed key object. This is the maximum number
+	// of digests supported by a single TPM2_PolicyOR assertion. AddUserPIN returns an error if a sealed key object already has this
+	// many user PINs, and key data files with more than this are rejected as invalid.
+	MaxUserPINs = 8
+)
+
+// computeUserPINPolicyORDigests computes the digests for the TPM2_PolicyOR assertion that authorizes one of the user PIN NV indices
+// at the specified handles. Each digest corresponds to a TPM2_PolicySecret assertion for one of the NV indices, computed from its
+// current name.
+func computeUserPINPolicyORDigests(tpm *tpm2.TPMContext, alg tpm2.HashAlgorithmId, handles []tpm2.Handle, session tpm2.SessionContext) (tpm2.DigestList, error) {
+	var digests tpm2.DigestList
+	for _, h := range handles {
+		index, err := tpm.CreateResourceContextFromTPM(h, session.IncludeAttrs(tpm2.AttrAudit))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot create context for user PIN NV index %v: %w", h, err)
+		}
+
+		trial, err := tpm2.ComputeAuthPolicy(alg)
+		if err != nil {
+			return nil, err
+		}
+		trial.PolicySecret(index.Name(), nil)
+		digests = append(digests, trial.GetDigest())
+	}
+	return digests, nil
+}
+
+// executeUserPINAssertions executes a TPM2_PolicySecret assertion for the user PIN NV index at the specified handle with the supplied
+// PIN, followed by the TPM2_PolicyOR assertion that authorizes any of the sealed key object's user PIN NV indices. These are the
+// first assertions of the dynamic authorization policy for a sealed key object with user PINs.
+func (k *SealedKeyObject) executeUserPINAssertions(tpm *TPMConnection, policySession, hmacSession tpm2.SessionContext, handle tpm2.Handle, pin string) error {
+	found := false
+	for _, h := range k.data.userPINIndexHandles {
+		if h == handle {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%v is not a user PIN NV index for this sealed key object", handle)
+	}
+
+	index, err := tpm.CreateResourceContextFromTPM(handle)
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return InvalidKeyFileError{fmt.Sprintf("no user PIN NV index found at %v", handle)}
+	case err != nil:
+		return xerrors.Errorf("cannot obtain context for user PIN NV index: %w", err)
+	}
+
+	index.SetAuthValue([]byte(pinIndexAuthValue(pin)))
+	if _, _, err := tpm.PolicySecret(index, policySession, nil, nil, 0, hmacSession); err != nil {
+		if isAuthFailError(err, tpm2.CommandPolicySecret, 1) {
+			return ErrPINFail
+		}
+		return xerrors.Errorf("cannot execute PolicySecret assertion for user PIN NV index: %w", err)
+	}
+
+	if err := tpm.PolicyOR(policySession, ensureSufficientORDigests(k.data.userPINPolicyORDigests)); err != nil {
+		if tpm2.IsTPMParameterError(err, tpm2.ErrorValue, tpm2.CommandPolicyOR, 1) {
+			return InvalidKeyFileError{"cannot complete OR assertion for user PINs: invalid data"}
+		}
+		return xerrors.Errorf("cannot execute OR assertion for user PINs: %w", err)
+	}
+
+	return nil
+}
+
+// UserPINIndexHandles returns the handles of the user PIN NV indices associated with this sealed key object by AddUserPIN.
+func (k *SealedKeyObject) UserPINIndexHandles() []tpm2.Handle {
+	return k.data.userPINIndexHandles
+}
+
+// UnsealFromTPMWithUserPIN will load the TPM sealed object in to the TPM and attempt to unseal it in the same way as
+// UnsealFromTPM, but authorizes access with the user PIN associated with the NV index at the specified handle, which must have been
+// added to this sealed key object with AddUserPIN.
+//
+// The caller must identify which user PIN NV index the supplied PIN belongs to. The PIN is only tried against that index, because
+// every failed authorization attempt against a user PIN NV index increments the TPM's dictionary attack counter. Trying the PIN
+// against every index in turn would consume an attempt for each index that the PIN doesn't belong to.
+//
+// If the supplied PIN is incorrect, then a ErrPINFail error will be returned and the TPM's dictionary attack counter will be
+// incremented. Note that the TPM only has a single dictionary attack counter, which is shared by all user PIN NV indices and all
+// other objects that are subject to dictionary attack protection.
+//
+// If the specified handle is not one of this sealed key object's user PIN NV indices, an error will be returned. Otherwise, this
+// returns the same errors as UnsealFromTPM.
+func (k *SealedKeyObject) UnsealFromTPMWithUserPIN(tpm *TPMConnection, handle tpm2.Handle, pin string) ([]byte, error) {
+	return k.unsealFromTPM(tpm, pin, nil, handle)
+}
+
+// AddUserPIN creates a new user PIN NV index at the specified handle with the supplied PIN as its authorization value, and associates
+// it with the sealed key object at the path specified by the keyPath argument. This allows a sealed key object to be shared between
+// multiple users, each with their own PIN. Once a sealed key object has user PINs, it can only be unsealed with
+// SealedKeyObject.UnsealFromTPMWithUserPIN using one of them.
+//
+// User PINs are authorized by a TPM2_PolicyOR assertion of TPM2_PolicySecret assertions, one for each user PIN NV index, at the start
+// of the sealed key object's PCR protection policy. Adding a user PIN therefore computes and installs a new PCR protection policy
+// from the supplied PCR profile in the same way as UpdateKeyPCRProtectionPolicy, which requires the private data file at the path
+// specified by the policyUpdatePath argument. Previous PCR protection policies are revoked.
+//
+// The sealed key object must not have a PIN or passphrase set with ChangePIN or ChangePassphrase. A maximum of MaxUserPINs user PINs
+// can be associated with a sealed key object, and an error is returned if it already has this many.
+//
+// Each user PIN NV index is subject to the TPM's dictionary attack protection, but the TPM only has a single dictionary attack
+// counter. Failed attempts with one user's PIN therefore count towards the lockout of every user, and of every other object on the
+// TPM that is subject to dictionary attack protection. Independent lockout for each user is not provided.
+//
+// If there is already a NV index defined at the specified handle, a TPMResourceExistsError error will be returned.
+//
+// If either file cannot be deserialized correctly or validation of the files fails, a InvalidKeyFileError error will be returned.
+func AddUserPIN(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile, handle tpm2.Handle, pin string) error {
+	if handle.Type() != tpm2.HandleTypeNVIndex {
+		return errors.New("invalid handle type for user PIN NV index")
+	}
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+
+	return updateKeyPCRProtectionPolicy(tpm, keyPath, policyUpdatePath, func(data *keyData) (pcrValuesList, error) {
+		if data.authModeHint != AuthModeNone {
+			return nil, errors.New("cannot add a user PIN to a sealed key object that has a PIN or passphrase")
+		}
+		if len(data.userPINIndexHandles) >= MaxUserPINs {
+			return nil, fmt.Errorf("the maximum number of user PINs (%d) are already associated with the sealed key object", MaxUserPINs)
+		}
+		for _, h := range data.userPINIndexHandles {
+			if h == handle {
+				return nil, fmt.Errorf("%v is already a user PIN NV index for the sealed key object", handle)
+			}
+		}
+
+		values, err := pcrProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+		}
+
+		session := tpm.HmacSession()
+
+		authKeyName, err := data.staticPolicyData.AuthPublicKey.Name()
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute name of signing key for dynamic policy authorization: %w", err)
+		}
+
+		indexPub, indexAuthPolicies, err := createPinNVIndex(tpm.TPMContext, handle, authKeyName, session)
+		switch {
+		case tpm2.IsTPMError(err, tpm2.ErrorNVDefined, tpm2.CommandNVDefineSpace):
+			return nil, TPMResourceExistsError{handle}
+		case isAuthFailError(err, tpm2.CommandNVDefineSpace, 1):
+			return nil, AuthFailError{tpm2.HandleOwner}
+		case err != nil:
+			return nil, xerrors.Errorf("cannot create user PIN NV index: %w", err)
+		}
+
+		succeeded := false
+		defer func() {
+			if succeeded {
+				return
+			}
+			index, err := tpm2.CreateNVIndexResourceContextFromPublic(indexPub)
+			if err != nil {
+				return
+			}
+			tpm.NVUndefineSpace(tpm.OwnerHandleContext(), index, session)
+		}()
+
+		if err := performPinChange(tpm.TPMContext, indexPub, indexAuthPolicies, "", pinIndexAuthValue(pin), session); err != nil {
+			return nil, xerrors.Errorf("cannot set authorization value for user PIN NV index: %w", err)
+		}
+
+		handles := append(append([]tpm2.Handle(nil), data.userPINIndexHandles...), handle)
+		digests, err := computeUserPINPolicyORDigests(tpm.TPMContext, data.keyPublic.NameAlg, handles, session)
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute user PIN authorization policy: %w", err)
+		}
+
+		data.userPINIndexHandles = handles
+		data.userPINPolicyORDigests = digests
+
+		succeeded = true
+		return values, nil
+	})
+}
+
+// RemoveUserPIN disassociates the user PIN NV index at the specified handle from the sealed key object at the path specified by the
+// keyPath argument, and then undefines it. As with AddUserPIN, this computes and installs a new PCR protection policy from the
+// supplied PCR profile, and previous PCR protection policies are revoked. If the last user PIN is removed, the sealed key object
+// can be unsealed with SealedKeyObject.UnsealFromTPM again without a PIN.
+//
+// If the specified handle is not one of the sealed key object's user PIN NV indices, an error will be returned.
+//
+// If either file cannot be deserialized correctly or validation of the files fails, a InvalidKeyFileError error will be returned.
+func RemoveUserPIN(tpm *TPMConnection, keyPath, policyUpdatePath string, pcrProfile *PCRProtectionProfile, handle tpm2.Handle) error {
+	if pcrProfile == nil {
+		pcrProfile = &PCRProtectionProfile{}
+	}
+
+	if err := updateKeyPCRProtectionPolicy(tpm, keyPath, policyUpdatePath, func(data *keyData) (pcrValuesList, error) {
+		var handles []tpm2.Handle
+		for _, h := range data.userPINIndexHandles {
+			if h == handle {
+				continue
+			}
+			handles = append(handles, h)
+		}
+		if len(handles) == len(data.userPINIndexHandles) {
+			return nil, fmt.Errorf("%v is not a user PIN NV index for the sealed key object", handle)
+		}
+
+		values, err := pcrProfile.computePCRValues(newPCRSourceFromTPMContext(tpm.TPMContext))
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute PCR values from protection profile: %w", err)
+		}
+
+		digests, err := computeUserPINPolicyORDigests(tpm.TPMContext, data.keyPublic.NameAlg, handles, tpm.HmacSession())
+		if err != nil {
+			return nil, xerrors.Errorf("cannot compute user PIN authorization policy: %w", err)
+		}
+
+		data.userPINIndexHandles = handles
+		data.userPINPolicyORDigests = digests
+		return values, nil
+	}); err != nil {
+		return err
+	}
+
+	// The old PCR protection policies that authorized this user PIN NV index have been revoked, so it can be undefined now.
+	session := tpm.HmacSession()
+	index, err := tpm.CreateResourceContextFromTPM(handle, session.IncludeAttrs(tpm2.AttrAudit))
+	switch {
+	case tpm2.IsResourceUnavailableError(err, handle):
+		return nil
+	case err != nil:
+		return xerrors.Errorf("cannot create context for user PIN NV index: %w", err)
+	}
+	return undefineExistingPINNVIndex(tpm, index, session)
+}
@@ -0,0 +1,190 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2019 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package secboot_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/canonical/go-tpm2"
+	. "github.com/snapcore/secboot"
+)
+
+func TestUserPINs(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+	defer func() {
+		if err := tpm.DictionaryAttackLockReset(tpm.LockoutHandleContext(), nil); err != nil {
+			t.Errorf("DictionaryAttackLockReset failed: %v", err)
+		}
+	}()
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestUserPINs_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	user1 := tpm2.Handle(0x0181ff00)
+	user2 := tpm2.Handle(0x0181ff01)
+
+	if err := AddUserPIN(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), user1, "1234"); err != nil {
+		t.Fatalf("AddUserPIN failed: %v", err)
+	}
+	if err := AddUserPIN(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), user2, "5678"); err != nil {
+		t.Fatalf("AddUserPIN failed: %v", err)
+	}
+	defer func() {
+		if rc, err := tpm.CreateResourceContextFromTPM(user2); err == nil {
+			undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+		}
+	}()
+
+	if err := ValidateKeyDataFile(tpm.TPMContext, keyFile, policyUpdateFile, tpm.HmacSession()); err != nil {
+		t.Errorf("ValidateKeyDataFile failed: %v", err)
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if handles := k.UserPINIndexHandles(); len(handles) != 2 || handles[0] != user1 || handles[1] != user2 {
+		t.Errorf("Unexpected user PIN handles: %v", handles)
+	}
+
+	for _, data := range []struct {
+		handle tpm2.Handle
+		pin    string
+	}{
+		{handle: user1, pin: "1234"},
+		{handle: user2, pin: "5678"},
+	} {
+		keyUnsealed, err := k.UnsealFromTPMWithUserPIN(tpm, data.handle, data.pin)
+		if err != nil {
+			t.Fatalf("UnsealFromTPMWithUserPIN failed for %v: %v", data.handle, err)
+		}
+		if !bytes.Equal(key, keyUnsealed) {
+			t.Errorf("TPM returned the wrong key")
+		}
+	}
+
+	if _, err := k.UnsealFromTPMWithUserPIN(tpm, user1, "5678"); err != ErrPINFail {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, err := k.UnsealFromTPM(tpm, ""); err != ErrUserPINRequired {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if err := RemoveUserPIN(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), user1); err != nil {
+		t.Fatalf("RemoveUserPIN failed: %v", err)
+	}
+	if _, err := tpm.CreateResourceContextFromTPM(user1); err == nil {
+		t.Errorf("RemoveUserPIN should have undefined the NV index")
+	}
+
+	k, err = ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if _, err := k.UnsealFromTPMWithUserPIN(tpm, user1, "1234"); err == nil {
+		t.Errorf("UnsealFromTPMWithUserPIN should have failed for a removed user PIN")
+	}
+	keyUnsealed, err := k.UnsealFromTPMWithUserPIN(tpm, user2, "5678")
+	if err != nil {
+		t.Fatalf("UnsealFromTPMWithUserPIN failed: %v", err)
+	}
+	if !bytes.Equal(key, keyUnsealed) {
+		t.Errorf("TPM returned the wrong key")
+	}
+}
+
+func TestAddUserPINTooMany(t *testing.T) {
+	tpm := openTPMForTesting(t)
+	defer closeTPM(t, tpm)
+
+	if err := ProvisionTPM(tpm, ProvisionModeFull, nil, true); err != nil {
+		t.Fatalf("Failed to provision TPM for test: %v", err)
+	}
+
+	key := make([]byte, 64)
+	rand.Read(key)
+
+	tmpDir, err := ioutil.TempDir("", "_TestAddUserPINTooMany_")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	keyFile := tmpDir + "/keydata"
+	policyUpdateFile := tmpDir + "/keypolicyupdatedata"
+
+	if err := SealKeyToTPM(tpm, key, keyFile, policyUpdateFile, &KeyCreationParams{PCRProfile: getTestPCRProfile(), PINHandle: 0x0181fff0}); err != nil {
+		t.Fatalf("SealKeyToTPM failed: %v", err)
+	}
+	defer undefineKeyNVSpace(t, tpm, keyFile)
+
+	for i := 0; i <= MaxUserPINs; i++ {
+		handle := tpm2.Handle(0x0181ff00 + i)
+		err := AddUserPIN(tpm, keyFile, policyUpdateFile, getTestPCRProfile(), handle, "1234")
+		if i == MaxUserPINs {
+			if err == nil || err.Error() != "the maximum number of user PINs (8) are already associated with the sealed key object" {
+				t.Errorf("Unexpected error: %v", err)
+			}
+			if _, err := tpm.CreateResourceContextFromTPM(handle); err == nil {
+				t.Errorf("AddUserPIN shouldn't have created a NV index")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatalf("AddUserPIN failed: %v", err)
+		}
+		defer func() {
+			if rc, err := tpm.CreateResourceContextFromTPM(handle); err == nil {
+				undefineNVSpace(t, tpm, rc, tpm.OwnerHandleContext())
+			}
+		}()
+	}
+
+	k, err := ReadSealedKeyObject(keyFile)
+	if err != nil {
+		t.Fatalf("ReadSealedKeyObject failed: %v", err)
+	}
+	if len(k.UserPINIndexHandles()) != MaxUserPINs {
+		t.Errorf("Unexpected user PIN handles: %v", k.UserPINIndexHandles())
+	}
+}
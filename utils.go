@@ -21,6 +21,8 @@ package secboot
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/hmac"
 	"crypto/rsa"
 	"fmt"
 	"os"
@@ -41,6 +43,16 @@ func isAuthFailError(err error, command tpm2.CommandCode, index int) bool {
 		tpm2.IsTPMSessionError(err, tpm2.ErrorBadAuth, command, index)
 }
 
+// resourceContextAuthValue returns the authorization value that is currently set for the supplied ResourceContext, so that it can be
+// restored after temporarily setting a different one. Versions of go-tpm2 that don't expose the authorization value of a
+// ResourceContext are treated as having an empty authorization value.
+func resourceContextAuthValue(rc tpm2.ResourceContext) []byte {
+	if r, ok := rc.(interface{ AuthValue() []byte }); ok {
+		return r.AuthValue()
+	}
+	return nil
+}
+
 type tpmErrorWithHandle struct {
 	handle tpm2.Handle
 	err    *tpm2.TPMError
@@ -143,3 +155,23 @@ func digestListContains(list tpm2.DigestList, digest tpm2.Digest) bool {
 	}
 	return false
 }
+
+// hkdfExpand implements the HKDF-Expand step from RFC5869 using HMAC with the specified digest algorithm. The prk argument is used as
+// the pseudorandom key, and should be at least as long as the output of the digest algorithm.
+func hkdfExpand(alg crypto.Hash, prk, info []byte, length int) []byte {
+	if length > 255*alg.Size() {
+		panic("invalid output length")
+	}
+
+	var out []byte
+	var t []byte
+	for i := 1; len(out) < length; i++ {
+		h := hmac.New(alg.New, prk)
+		h.Write(t)
+		h.Write(info)
+		h.Write([]byte{byte(i)})
+		t = h.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}